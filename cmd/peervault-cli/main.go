@@ -0,0 +1,361 @@
+// Command peervault-cli runs single commands against a running PeerVault
+// daemon over its local socket or gRPC address.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
+	"github.com/AdityaKrSingh26/PeerVault/internal/metrics"
+	"github.com/AdityaKrSingh26/PeerVault/internal/spool"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/api"
+)
+
+// chunkSize is the size of the chunks uploaded to the daemon
+const chunkSize = 64 * 1024
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: peervault-cli [flags] <command>")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  store <file> [key]   - Store a file on the node, under its name by default")
+	fmt.Fprintln(os.Stderr, "  get <key> [file]     - Retrieve a file (to stdout without a file)")
+	fmt.Fprintln(os.Stderr, "  list [-network]      - List files on the node, or on the network")
+	fmt.Fprintln(os.Stderr, "  queue list           - Show stores waiting for the node")
+	fmt.Fprintln(os.Stderr, "  queue replay         - Send queued stores now")
+	fmt.Fprintln(os.Stderr, "  queue drop <id>      - Discard a queued store")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Flags:")
+}
+
+// defaultQueueDir is where queued stores are spooled unless -queue-dir is set
+func defaultQueueDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "peervault", "queue")
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run talks to a running daemon over its gRPC API. With queueing enabled,
+// stores made while the daemon is unreachable are spooled to disk and
+// replayed by the next command that reaches it.
+func run(args []string) int {
+	flags := flag.NewFlagSet("peervault-cli", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+
+	socketPath := grpcapi.DefaultSocketPath()
+	if val, ok := os.LookupEnv("PEERVAULT_SOCKET"); ok {
+		socketPath = val
+	}
+	addr := os.Getenv("PEERVAULT_GRPC_ADDR")
+	queueing := false
+	if val, ok := os.LookupEnv("PEERVAULT_QUEUE"); ok {
+		queueing = strings.ToLower(val) == "true" || val == "1"
+	}
+	apiKey := os.Getenv("PEERVAULT_API_KEY")
+	queueDir := defaultQueueDir()
+	if val, ok := os.LookupEnv("PEERVAULT_QUEUE_DIR"); ok {
+		queueDir = val
+	}
+
+	socket := flags.String("socket", socketPath, "Unix socket of the daemon")
+	grpcAddr := flags.String("grpc", addr, "gRPC API address of the daemon, instead of the socket")
+	key := flags.String("api-key", apiKey, "Scoped API key issued by the node")
+	queue := flags.Bool("queue", queueing, "Queue stores while the node is unreachable")
+	dir := flags.String("queue-dir", queueDir, "Directory holding queued stores")
+	timeout := flags.Duration("timeout", 5*time.Minute, "Timeout for each operation")
+	flags.Parse(args)
+
+	cmd := flags.Args()
+	if len(cmd) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	target := "unix://" + *socket
+	if *grpcAddr != "" {
+		target = *grpcAddr
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if *key != "" {
+		opts = append(opts, api.WithAPIKey(*key))
+	}
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	c := &client{api: api.NewPeerVaultClient(conn), timeout: *timeout}
+	if *queue || cmd[0] == "queue" {
+		if c.queue, err = spool.Open(*dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening queue: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := c.run(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+type client struct {
+	api     api.PeerVaultClient
+	queue   *spool.Queue // nil unless queueing is enabled
+	timeout time.Duration
+}
+
+func (c *client) run(cmd []string) error {
+	switch cmd[0] {
+	case "store":
+		if len(cmd) < 2 || len(cmd) > 3 {
+			return fmt.Errorf("usage: store <file> [key]")
+		}
+		key := filepath.Base(cmd[1])
+		if len(cmd) == 3 {
+			key = cmd[2]
+		}
+		c.replay(false)
+		return c.store(key, cmd[1])
+
+	case "get":
+		if len(cmd) < 2 || len(cmd) > 3 {
+			return fmt.Errorf("usage: get <key> [file]")
+		}
+		c.replay(false)
+		out := io.Writer(os.Stdout)
+		if len(cmd) == 3 {
+			f, err := os.Create(cmd[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		return c.get(cmd[1], out)
+
+	case "list":
+		c.replay(false)
+		return c.list(len(cmd) > 1 && cmd[1] == "-network")
+
+	case "queue":
+		if len(cmd) < 2 {
+			return fmt.Errorf("usage: queue list|replay|drop <id>")
+		}
+		switch cmd[1] {
+		case "list":
+			return c.queueList()
+		case "replay":
+			return c.replay(true)
+		case "drop":
+			if len(cmd) != 3 {
+				return fmt.Errorf("usage: queue drop <id>")
+			}
+			if err := c.queue.Remove(cmd[2]); err != nil {
+				return err
+			}
+			fmt.Printf("Dropped %s\n", cmd[2])
+			return nil
+		}
+		return fmt.Errorf("unknown queue command: %s", cmd[1])
+	}
+	return fmt.Errorf("unknown command: %s", cmd[0])
+}
+
+// send uploads r to the node, reporting an unreachable node as
+// spool.ErrUnreachable
+func (c *client) send(ctx context.Context, key string, r io.Reader) error {
+	stream, err := c.api.StoreFile(ctx)
+	if err != nil {
+		return clientError(err)
+	}
+	if err := stream.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Key{Key: key}}); err != nil {
+		_, err = stream.CloseAndRecv()
+		return clientError(err)
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Chunk{Chunk: buf[:n]}}); err != nil {
+				// The real error comes with the response
+				_, err = stream.CloseAndRecv()
+				return clientError(err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return clientError(err)
+}
+
+// clientError turns a gRPC status into a plain error, wrapping
+// spool.ErrUnreachable when the node cannot be reached
+func clientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(err)
+	if st.Code() == codes.Unavailable {
+		return fmt.Errorf("%w: %s", spool.ErrUnreachable, st.Message())
+	}
+	return fmt.Errorf("%s", st.Message())
+}
+
+func (c *client) store(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	err = c.send(ctx, key, f)
+	if err == nil {
+		fmt.Printf("Stored %s\n", key)
+		return nil
+	}
+	if c.queue == nil || !errors.Is(err, spool.ErrUnreachable) {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	entry, qerr := c.queue.Enqueue(key, f)
+	if qerr != nil {
+		return fmt.Errorf("%v, and queueing failed: %w", err, qerr)
+	}
+	fmt.Printf("Daemon unreachable, queued %s as %s (%s)\n", key, entry.ID, metrics.FormatBytes(entry.Size))
+	return nil
+}
+
+func (c *client) get(key string, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	stream, err := c.api.GetFile(ctx, &api.GetFileRequest{Key: key})
+	if err != nil {
+		return clientError(err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return clientError(err)
+		}
+		if _, err := out.Write(resp.Chunk); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) list(network bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	resp, err := c.api.ListFiles(ctx, &api.ListFilesRequest{Network: network})
+	if err != nil {
+		return clientError(err)
+	}
+	if len(resp.Files) == 0 {
+		fmt.Println("No files")
+		return nil
+	}
+	for _, f := range resp.Files {
+		line := fmt.Sprintf("%-30s %10s", f.Key, metrics.FormatBytes(f.Size))
+		if len(f.Holders) > 0 {
+			line += "  " + strings.Join(f.Holders, ", ")
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func (c *client) queueList() error {
+	entries, err := c.queue.List()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Queue is empty")
+		return nil
+	}
+	for _, e := range entries {
+		line := fmt.Sprintf("%s  %-30s %10s  queued %s", e.ID, e.Key, metrics.FormatBytes(e.Size), e.Queued.Format(time.RFC3339))
+		if e.Attempts > 0 {
+			line += fmt.Sprintf("  attempts %d: %s", e.Attempts, e.LastError)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// replay sends queued stores to the node. Before other commands it is
+// best-effort and quiet while the node stays unreachable; asked for
+// explicitly, failures are errors.
+func (c *client) replay(explicit bool) error {
+	if c.queue == nil {
+		return nil
+	}
+	if !explicit {
+		if entries, err := c.queue.List(); err != nil || len(entries) == 0 {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	sent, err := c.queue.Replay(ctx, c.send)
+	if sent > 0 {
+		fmt.Fprintf(os.Stderr, "Replayed %d queued store(s)\n", sent)
+	}
+	if err != nil && explicit {
+		return err
+	}
+	if explicit {
+		remaining, _ := c.queue.List()
+		if len(remaining) > 0 {
+			return fmt.Errorf("%d queued store(s) failed, see queue list", len(remaining))
+		}
+		if sent == 0 {
+			fmt.Println("Queue is empty")
+		}
+	}
+	return nil
+}
@@ -4,41 +4,140 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
 )
 
 type Config struct {
-	ListenAddr     string        `yaml:"listen_addr"`
-	AdvertiseAddr  string        `yaml:"advertise_addr"`
-	Bootstrap      []string      `yaml:"bootstrap"`
-	Interactive    bool          `yaml:"interactive"`
-	Demo           bool          `yaml:"demo"`
-	EncKey         string        `yaml:"enc_key"`
-	DetectPublicIP bool          `yaml:"detect_public_ip"`
-	Verbose        bool          `yaml:"verbose"`
-	Debug          bool          `yaml:"debug"`
-	MetricsAddr    string        `yaml:"metrics_addr"`
-	DiscoverLocal  bool          `yaml:"discover_local"`
-	DiscoverPex    bool          `yaml:"discover_pex"`
-	QuotaSize      string        `yaml:"quota"`
-	LogLevel       string        `yaml:"log_level"`
-	FetchTimeout   time.Duration `yaml:"fetch_timeout"`
-	PexInterval    time.Duration `yaml:"pex_interval"`
-	GCInterval     time.Duration `yaml:"gc_interval"`
-	GCDelay        time.Duration `yaml:"gc_delay"`
+	ListenAddr        string            `yaml:"listen_addr"`
+	StorageRoot       string            `yaml:"storage_root"`
+	Disks             []string          `yaml:"disks"`
+	StorageBackend    string            `yaml:"storage_backend"`
+	Compression       string            `yaml:"compression"`
+	AdvertiseAddr     string            `yaml:"advertise_addr"`
+	Bootstrap         []string          `yaml:"bootstrap"`
+	Interactive       bool              `yaml:"interactive"`
+	Demo              bool              `yaml:"demo"`
+	EncKey            string            `yaml:"enc_key"`
+	Keyring           string            `yaml:"keyring"`
+	Keychain          bool              `yaml:"keychain"`
+	DetectPublicIP    bool              `yaml:"detect_public_ip"`
+	PublicIPServices  []string          `yaml:"public_ip_services"`
+	PublicIPTimeout   time.Duration     `yaml:"public_ip_timeout"`
+	PublicIPRetries   int               `yaml:"public_ip_retries"`
+	PublicIPTTL       time.Duration     `yaml:"public_ip_ttl"`
+	Verbose           bool              `yaml:"verbose"`
+	Debug             bool              `yaml:"debug"`
+	MetricsAddr       string            `yaml:"metrics_addr"`
+	MetricsInterval   time.Duration     `yaml:"metrics_interval"`
+	MetricsUser       string            `yaml:"metrics_user"`
+	MetricsPassword   string            `yaml:"metrics_password"`
+	MetricsToken      string            `yaml:"metrics_token"`
+	MetricsTLSCert    string            `yaml:"metrics_tls_cert"`
+	MetricsTLSKey     string            `yaml:"metrics_tls_key"`
+	MinReadyPeers     int               `yaml:"min_ready_peers"`
+	AlertWebhooks     []string          `yaml:"alert_webhooks"`
+	AlertErrorRate    float64           `yaml:"alert_error_rate"`
+	Pprof             bool              `yaml:"pprof"`
+	Admin             bool              `yaml:"admin"`
+	OTLPEndpoint      string            `yaml:"otlp_endpoint"`
+	OTLPInsecure      bool              `yaml:"otlp_insecure"`
+	GRPCAddr          string            `yaml:"grpc_addr"`
+	Socket            string            `yaml:"socket"`
+	RequireAPIKey     bool              `yaml:"require_api_key"`
+	WebDAVAddr        string            `yaml:"webdav_addr"`
+	DiscoverLocal     bool              `yaml:"discover_local"`
+	DiscoverPex       bool              `yaml:"discover_pex"`
+	HolePunch         bool              `yaml:"hole_punch"`
+	RelayAddr         string            `yaml:"relay_addr"`
+	NetworkID         string            `yaml:"network_id"`
+	QuotaSize         string            `yaml:"quota"`
+	LogLevel          string            `yaml:"log_level"`
+	FetchTimeout      time.Duration     `yaml:"fetch_timeout"`
+	PexInterval       time.Duration     `yaml:"pex_interval"`
+	GCInterval        time.Duration     `yaml:"gc_interval"`
+	GCDelay           time.Duration     `yaml:"gc_delay"`
+	KeepVersions      int               `yaml:"keep_versions"`
+	VersionMaxAge     time.Duration     `yaml:"version_max_age"`
+	TrashMaxAge       time.Duration     `yaml:"trash_max_age"`
+	QuarantineRetries int               `yaml:"quarantine_retries"`
+	Convergent        bool              `yaml:"convergent_encryption"`
+	Cipher            string            `yaml:"cipher"`
+	FramedEncryption  bool              `yaml:"framed_encryption"`
+	EncryptMetadata   bool              `yaml:"encrypt_metadata"`
+	MinPeerScore      float64           `yaml:"min_peer_score"`
+	PeerScoreBan      time.Duration     `yaml:"peer_score_ban"`
+	MaxPeers          int               `yaml:"max_peers"`
+	QuotaWarning      float64           `yaml:"quota_warning"`
+	AntiEntropy       time.Duration     `yaml:"anti_entropy_interval"`
+	ReplicationFactor int               `yaml:"replication_factor"`
+	ReplicaTimeout    time.Duration     `yaml:"replica_timeout"`
+	WriteConcern      int               `yaml:"write_concern"`
+	OfflineQueue      bool              `yaml:"offline_queue"`
+	ShutdownTimeout   time.Duration     `yaml:"shutdown_timeout"`
+	TrustedPeers      []string          `yaml:"trusted_peers"`
+	AllowPeers        []string          `yaml:"allow_peers"`
+	BlockPeers        []string          `yaml:"block_peers"`
+	PolicyAdmins      []string          `yaml:"policy_admins"`
+	PolicyOverrides   []string          `yaml:"policy_overrides"`
+	Transport         string            `yaml:"transport"`
+	TransportOptions  map[string]string `yaml:"transport_options"`
+	GuestToken        string            `yaml:"guest_token"`
+	GuestIssuers      []string          `yaml:"guest_issuers"`
+	Labels            map[string]string `yaml:"labels"`
+	DeviceKeys        bool              `yaml:"device_keys"`
+	Pin               string            `yaml:"pin"`
+	PinToken          string            `yaml:"pin_token"`
+	InboxAutoAccept   string            `yaml:"inbox_auto_accept"`
+	Readahead         string            `yaml:"readahead"`
+	MaxUpload         string            `yaml:"max_upload"`
+	MaxDownload       string            `yaml:"max_download"`
+	MaxPeerUpload     string            `yaml:"max_peer_upload"`
+	MaxPeerDownload   string            `yaml:"max_peer_download"`
+	MaxInStreams      int               `yaml:"max_inbound_streams"`
+	MaxOutStreams     int               `yaml:"max_outbound_streams"`
+	AllowDowngrade    bool              `yaml:"allow_downgrade"`
+	MetadataOnly      bool              `yaml:"metadata_only"`
+	Mount             string            `yaml:"mount"`
+	SyncDir           string            `yaml:"sync_dir"`
+	SyncPrefix        string            `yaml:"sync_prefix"`
+	Doctor            bool              `yaml:"-"` // set by "peervault [flags] doctor"
+	InitPath          string            `yaml:"-"` // set by "peervault [flags] init [config-file]"
+	KeyCommand        []string          `yaml:"-"` // set by "peervault [flags] key <command>"
+	VerifyPeer        string            `yaml:"-"` // set by "peervault [flags] verify-peer <addr>"
+	KeyFromFlag       bool              `yaml:"-"` // the key was given with -key
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		ListenAddr:   ":3000",
-		LogLevel:     "info",
-		FetchTimeout: 5 * time.Second,
-		PexInterval:  5 * time.Minute,
-		GCInterval:   1 * time.Hour,
-		GCDelay:      5 * time.Minute,
+		ListenAddr: ":3000",
+		LogLevel:   "info",
+		Transport:  "tcp",
+		TransportOptions: map[string]string{
+			"dial_timeout": "10s",
+			"max_retries":  "3",
+			"retry_delay":  "2s",
+		},
+		PublicIPTimeout:   5 * time.Second,
+		PublicIPRetries:   2,
+		PublicIPTTL:       time.Hour,
+		FetchTimeout:      5 * time.Second,
+		PexInterval:       5 * time.Minute,
+		GCInterval:        1 * time.Hour,
+		GCDelay:           5 * time.Minute,
+		AntiEntropy:       2 * time.Minute,
+		MetricsInterval:   15 * time.Second,
+		ReplicationFactor: 3,
+		ReplicaTimeout:    10 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		HolePunch:         true,
+		Socket:            grpcapi.DefaultSocketPath(),
 	}
 }
 
@@ -46,6 +145,22 @@ func (cfg *Config) LoadFromEnv() {
 	if val, ok := os.LookupEnv("PEERVAULT_LISTEN"); ok {
 		cfg.ListenAddr = val
 	}
+	if val, ok := os.LookupEnv("PEERVAULT_STORAGE"); ok {
+		cfg.StorageRoot = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_DISKS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.Disks = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_STORAGE_BACKEND"); ok {
+		cfg.StorageBackend = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_COMPRESSION"); ok {
+		cfg.Compression = val
+	}
 	if val, ok := os.LookupEnv("PEERVAULT_ADVERTISE"); ok {
 		cfg.AdvertiseAddr = val
 	}
@@ -67,9 +182,37 @@ func (cfg *Config) LoadFromEnv() {
 	} else if val, ok := os.LookupEnv("PEERVAULT_KEY"); ok {
 		cfg.EncKey = val
 	}
+	if val, ok := os.LookupEnv("PEERVAULT_KEYRING"); ok {
+		cfg.Keyring = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_KEYCHAIN"); ok {
+		cfg.Keychain = strings.ToLower(val) == "true" || val == "1"
+	}
 	if val, ok := os.LookupEnv("PEERVAULT_PUBLIC_IP"); ok {
 		cfg.DetectPublicIP = strings.ToLower(val) == "true" || val == "1"
 	}
+	if val, ok := os.LookupEnv("PEERVAULT_PUBLIC_IP_SERVICES"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.PublicIPServices = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PUBLIC_IP_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.PublicIPTimeout = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PUBLIC_IP_RETRIES"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.PublicIPRetries = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PUBLIC_IP_TTL"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.PublicIPTTL = d
+		}
+	}
 	if val, ok := os.LookupEnv("PEERVAULT_VERBOSE"); ok {
 		cfg.Verbose = strings.ToLower(val) == "true" || val == "1"
 	}
@@ -79,12 +222,82 @@ func (cfg *Config) LoadFromEnv() {
 	if val, ok := os.LookupEnv("PEERVAULT_METRICS"); ok {
 		cfg.MetricsAddr = val
 	}
+	if val, ok := os.LookupEnv("PEERVAULT_METRICS_INTERVAL"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.MetricsInterval = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_METRICS_USER"); ok {
+		cfg.MetricsUser = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_METRICS_PASSWORD"); ok {
+		cfg.MetricsPassword = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_METRICS_TOKEN"); ok {
+		cfg.MetricsToken = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_METRICS_TLS_CERT"); ok {
+		cfg.MetricsTLSCert = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_METRICS_TLS_KEY"); ok {
+		cfg.MetricsTLSKey = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MIN_READY_PEERS"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.MinReadyPeers = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ALERT_WEBHOOKS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.AlertWebhooks = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ALERT_ERROR_RATE"); ok {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			cfg.AlertErrorRate = f
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PPROF"); ok {
+		cfg.Pprof = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ADMIN"); ok {
+		cfg.Admin = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_OTLP_ENDPOINT"); ok {
+		cfg.OTLPEndpoint = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_OTLP_INSECURE"); ok {
+		cfg.OTLPInsecure = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_GRPC_ADDR"); ok {
+		cfg.GRPCAddr = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_SOCKET"); ok {
+		cfg.Socket = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_WEBDAV_ADDR"); ok {
+		cfg.WebDAVAddr = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_REQUIRE_API_KEY"); ok {
+		cfg.RequireAPIKey = strings.ToLower(val) == "true" || val == "1"
+	}
 	if val, ok := os.LookupEnv("PEERVAULT_DISCOVER_LOCAL"); ok {
 		cfg.DiscoverLocal = strings.ToLower(val) == "true" || val == "1"
 	}
 	if val, ok := os.LookupEnv("PEERVAULT_DISCOVER_PEX"); ok {
 		cfg.DiscoverPex = strings.ToLower(val) == "true" || val == "1"
 	}
+	if val, ok := os.LookupEnv("PEERVAULT_HOLE_PUNCH"); ok {
+		cfg.HolePunch = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_RELAY_ADDR"); ok {
+		cfg.RelayAddr = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_NETWORK_ID"); ok {
+		cfg.NetworkID = val
+	}
 	if val, ok := os.LookupEnv("PEERVAULT_QUOTA"); ok {
 		cfg.QuotaSize = val
 	}
@@ -111,6 +324,189 @@ func (cfg *Config) LoadFromEnv() {
 			cfg.GCDelay = d
 		}
 	}
+	if val, ok := os.LookupEnv("PEERVAULT_KEEP_VERSIONS"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.KeepVersions = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_VERSION_MAX_AGE"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.VersionMaxAge = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_TRASH_MAX_AGE"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.TrashMaxAge = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_QUARANTINE_RETRIES"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.QuarantineRetries = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_CONVERGENT_ENCRYPTION"); ok {
+		cfg.Convergent = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_CIPHER"); ok {
+		cfg.Cipher = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_FRAMED_ENCRYPTION"); ok {
+		cfg.FramedEncryption = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ENCRYPT_METADATA"); ok {
+		cfg.EncryptMetadata = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MIN_PEER_SCORE"); ok {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			cfg.MinPeerScore = f
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PEER_SCORE_BAN"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.PeerScoreBan = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_PEERS"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.MaxPeers = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_QUOTA_WARNING"); ok {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			cfg.QuotaWarning = f
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ANTI_ENTROPY_INTERVAL"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.AntiEntropy = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_REPLICATION_FACTOR"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.ReplicationFactor = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_WRITE_CONCERN"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.WriteConcern = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_OFFLINE_QUEUE"); ok {
+		cfg.OfflineQueue = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_REPLICA_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.ReplicaTimeout = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_SHUTDOWN_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			cfg.ShutdownTimeout = d
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_GUEST_TOKEN"); ok {
+		cfg.GuestToken = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_TRANSPORT"); ok {
+		cfg.Transport = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_TRUSTED_PEERS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.TrustedPeers = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_GUEST_ISSUERS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.GuestIssuers = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ALLOW_PEERS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.AllowPeers = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_BLOCK_PEERS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.BlockPeers = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_POLICY_ADMINS"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.PolicyAdmins = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_POLICY_OVERRIDES"); ok {
+		parts := strings.Split(val, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.PolicyOverrides = parts
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_DEVICE_KEYS"); ok {
+		cfg.DeviceKeys = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_LABELS"); ok {
+		cfg.Labels = parseLabels(val)
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PIN"); ok {
+		cfg.Pin = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_PIN_TOKEN"); ok {
+		cfg.PinToken = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_INBOX_AUTO_ACCEPT"); ok {
+		cfg.InboxAutoAccept = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_READAHEAD"); ok {
+		cfg.Readahead = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_UPLOAD"); ok {
+		cfg.MaxUpload = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_DOWNLOAD"); ok {
+		cfg.MaxDownload = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_PEER_UPLOAD"); ok {
+		cfg.MaxPeerUpload = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_PEER_DOWNLOAD"); ok {
+		cfg.MaxPeerDownload = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_INBOUND_STREAMS"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.MaxInStreams = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MAX_OUTBOUND_STREAMS"); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.MaxOutStreams = n
+		}
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_ALLOW_DOWNGRADE"); ok {
+		cfg.AllowDowngrade = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_METADATA_ONLY"); ok {
+		cfg.MetadataOnly = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_MOUNT"); ok {
+		cfg.Mount = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_SYNC_DIR"); ok {
+		cfg.SyncDir = val
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_SYNC_PREFIX"); ok {
+		cfg.SyncPrefix = val
+	}
 }
 
 func LoadConfig() (*Config, error) {
@@ -119,23 +515,94 @@ func LoadConfig() (*Config, error) {
 	// Define command-line flags
 	configPath := flag.String("config", "", "Path to YAML config file")
 	listenAddr := flag.String("addr", "", "Listen address")
+	storageRoot := flag.String("storage", "", "Storage directory (default storage/node_<addr>)")
+	disks := flag.String("disks", "", "Disks files are spread over (path or path=quota, comma-separated)")
+	storageBackend := flag.String("storage-backend", "", "Where stored files are kept instead of the disks (memory or s3://bucket/prefix)")
+	compression := flag.String("compression", "", "Compress stored files before encrypting them (none, gzip or zstd)")
 	advertiseAddr := flag.String("advertise", "", "Address to advertise to peers")
 	bootstrap := flag.String("bootstrap", "", "Bootstrap nodes (comma-separated)")
 	interactive := flag.Bool("interactive", false, "Run in interactive mode")
 	demo := flag.Bool("demo", false, "Run demo mode")
 	encKey := flag.String("key", "", "Encryption key (32 bytes)")
+	keyringPath := flag.String("keyring", "", "Keyring file holding the network key (default ~/.peervault/keyring)")
+	keychain := flag.Bool("keychain", false, "Keep the keyring passphrase in the OS keychain")
 	detectPublicIP := flag.Bool("public-ip", false, "Auto-detect public IP")
+	publicIPServices := flag.String("public-ip-services", "", "URLs asked for the public IP (comma-separated)")
+	publicIPTimeout := flag.Duration("public-ip-timeout", 0, "Timeout of each public IP request")
+	publicIPRetries := flag.Int("public-ip-retries", 0, "Extra rounds over the public IP services when all fail")
+	publicIPTTL := flag.Duration("public-ip-ttl", 0, "How long a detected public IP is cached")
 	verbose := flag.Bool("verbose", false, "Enable verbose logging")
 	debug := flag.Bool("debug", false, "Enable debug mode")
-	metricsAddr := flag.String("metrics", "", "Metrics server address")
+	metricsAddr := flag.String("metrics", "", "Metrics server address (without a host, on localhost only)")
+	metricsInterval := flag.Duration("metrics-interval", 0, "How often storage and peer gauges are refreshed")
+	metricsUser := flag.String("metrics-user", "", "User the metrics server asks for with basic auth")
+	metricsPassword := flag.String("metrics-password", "", "Password the metrics server asks for with basic auth")
+	metricsToken := flag.String("metrics-token", "", "Bearer token the metrics server asks for")
+	metricsTLSCert := flag.String("metrics-tls-cert", "", "Certificate (PEM) the metrics server serves HTTPS with")
+	metricsTLSKey := flag.String("metrics-tls-key", "", "Private key (PEM) of -metrics-tls-cert")
+	minReadyPeers := flag.Int("min-ready-peers", 0, "Peers that must be connected before /readyz reports the node ready")
+	alertWebhooks := flag.String("alert-webhooks", "", "Slack or HTTP webhooks alerts are posted to (comma-separated)")
+	alertErrorRate := flag.Float64("alert-error-rate", 0, "Errors per minute that alert, -1 for no alert (default: 10)")
+	pprofEnabled := flag.Bool("pprof", false, "Serve /debug/pprof profiles on the metrics server")
+	adminEnabled := flag.Bool("admin", false, "Serve maintenance endpoints under /admin/ on the metrics server")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/gRPC collector address for traces (host:port)")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "Connect to the OTLP collector without TLS")
+	grpcAddr := flag.String("grpc", "", "gRPC API address")
+	socket := flag.String("socket", "", "Unix socket for peervault-cli (empty disables)")
+	requireAPIKey := flag.Bool("require-api-key", false, "Refuse gRPC calls over TCP and WebDAV requests without an API key")
+	webdavAddr := flag.String("webdav", "", "WebDAV server address")
 	discoverLocal := flag.Bool("discover-local", false, "Enable local discovery")
 	discoverPex := flag.Bool("discover-pex", false, "Enable peer exchange")
+	holePunch := flag.Bool("hole-punch", true, "Punch through NATs to peers introduced by other peers")
+	relayAddr := flag.String("relay", "", "Address to relay connections for peers that cannot punch through")
+	networkID := flag.String("network-id", "", "Network to join, peers of other networks are refused (default: derived from the key)")
 	quotaSize := flag.String("quota", "", "Storage quota size")
 	logLevel := flag.String("log-level", "", "Log level")
 	fetchTimeout := flag.Duration("fetch-timeout", 0, "Fetch timeout")
 	pexInterval := flag.Duration("pex-interval", 0, "PEX interval")
 	gcInterval := flag.Duration("gc-interval", 0, "GC interval")
 	gcDelay := flag.Duration("gc-delay", 0, "GC delay")
+	keepVersions := flag.Int("keep-versions", 0, "Earlier versions kept of each file stored again, -1 for all (default: overwrite)")
+	versionMaxAge := flag.Duration("version-max-age", 0, "How long an earlier version is kept once replaced")
+	trashMaxAge := flag.Duration("trash-max-age", 0, "How long deleted files are kept in the trash (default: delete at once)")
+	convergent := flag.Bool("convergent-encryption", false, "Encrypt identical files to identical bytes, for deduplication across nodes")
+	cipherName := flag.String("cipher", "", "Cipher stored files are encrypted with (aes or chacha20)")
+	framed := flag.Bool("framed-encryption", false, "Seal stored files in authenticated frames, checked as they are read")
+	encryptMetadata := flag.Bool("encrypt-metadata", false, "Encrypt the key map, metadata and other records naming stored files")
+	minPeerScore := flag.Float64("min-peer-score", 0, "Ban peers whose reputation falls below this score out of 100 (default: never ban)")
+	peerScoreBan := flag.Duration("peer-score-ban", 0, "How long peers below -min-peer-score are banned (default: 1h)")
+	maxPeers := flag.Int("max-peers", 0, "Connections beyond which inbound ones are declined (default: no limit)")
+	quotaWarning := flag.Float64("quota-warning", 0, "Percentage of the storage quota in use that publishes a warning, -1 for none (default: 90)")
+	quarantineRetries := flag.Int("quarantine-retries", 0, "Failed repairs of a corrupted file before it is removed (default: 3)")
+	antiEntropy := flag.Duration("anti-entropy-interval", 0, "Anti-entropy interval")
+	replicationFactor := flag.Int("replication-factor", 0, "Copies of each stored file to maintain")
+	replicaTimeout := flag.Duration("replica-timeout", 0, "Offline time before a peer's replicas are re-created")
+	writeConcern := flag.Int("write-concern", 0, "Peer replicas that must be acknowledged before a store succeeds")
+	offlineQueue := flag.Bool("offline-queue", false, "Queue replication of files stored without peers, and deletes, until peers connect")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 0, "Time to wait for in-flight transfers on shutdown")
+	trustedPeers := flag.String("trusted-peers", "", "Identity fingerprints whose revocations are honored (comma-separated)")
+	allowPeers := flag.String("allow-peers", "", "Only accept these hosts or node IDs (comma-separated)")
+	blockPeers := flag.String("block-peers", "", "Always refuse these hosts or node IDs (comma-separated)")
+	policyAdmins := flag.String("policy-admins", "", "Identity fingerprints whose shared policies are applied (comma-separated)")
+	policyOverrides := flag.String("policy-overrides", "", "Shared policy settings to keep from local config: replication_factor, denylist, retention (comma-separated)")
+	transport := flag.String("transport", "", "Transport to use (registered name, e.g. tcp)")
+	guestToken := flag.String("guest-token", "", "Join read-only with a guest token")
+	guestIssuers := flag.String("guest-issuers", "", "Identity fingerprints whose guest tokens are honored, besides this node's (comma-separated)")
+	deviceKeys := flag.Bool("device-keys", false, "Encrypt files with per-file keys wrapped for authorized devices")
+	labels := flag.String("labels", "", "Node labels announced to peers (key=value, comma-separated)")
+	pin := flag.String("pin", "", "Pinning service for stored files (gRPC address of a node, or http(s) URL)")
+	pinToken := flag.String("pin-token", "", "Bearer token for an HTTP pinning service")
+	metadataOnly := flag.Bool("metadata-only", false, "Index the network's files without storing any")
+	syncPrefix := flag.String("sync-prefix", "", "Namespace synced files are stored under (e.g. laptop/)")
+	inboxAutoAccept := flag.String("inbox-auto-accept", "", "Accept files peers send up to this size without asking (e.g. 10MB)")
+	readahead := flag.String("readahead", "", "Bytes read ahead of sequential range reads of files on peers, 0 for none (default: 4MB)")
+	maxUpload := flag.String("max-upload", "", "Upload rate limit per second across all peers (e.g. 1MB)")
+	maxDownload := flag.String("max-download", "", "Download rate limit per second across all peers (e.g. 5MB)")
+	maxPeerUpload := flag.String("max-peer-upload", "", "Upload rate limit per second to each peer (e.g. 512KB)")
+	maxPeerDownload := flag.String("max-peer-download", "", "Download rate limit per second from each peer (e.g. 2MB)")
+	maxInboundStreams := flag.Int("max-inbound-streams", 0, "Streams received from peers at once, -1 for no limit (default 64)")
+	maxOutboundStreams := flag.Int("max-outbound-streams", 0, "Streams sent to peers at once, -1 for no limit (default 64)")
+	allowDowngrade := flag.Bool("allow-downgrade", false, "Accept peers that announce an older protocol than they did before")
 
 	flag.Parse()
 
@@ -162,6 +629,22 @@ func LoadConfig() (*Config, error) {
 	if setFlags["addr"] {
 		cfg.ListenAddr = *listenAddr
 	}
+	if setFlags["storage"] {
+		cfg.StorageRoot = *storageRoot
+	}
+	if setFlags["disks"] {
+		parts := strings.Split(*disks, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.Disks = parts
+	}
+	if setFlags["storage-backend"] {
+		cfg.StorageBackend = *storageBackend
+	}
+	if setFlags["compression"] {
+		cfg.Compression = *compression
+	}
 	if setFlags["advertise"] {
 		cfg.AdvertiseAddr = *advertiseAddr
 	}
@@ -180,10 +663,33 @@ func LoadConfig() (*Config, error) {
 	}
 	if setFlags["key"] {
 		cfg.EncKey = *encKey
+		cfg.KeyFromFlag = true
+	}
+	if setFlags["keyring"] {
+		cfg.Keyring = *keyringPath
+	}
+	if setFlags["keychain"] {
+		cfg.Keychain = *keychain
 	}
 	if setFlags["public-ip"] {
 		cfg.DetectPublicIP = *detectPublicIP
 	}
+	if setFlags["public-ip-services"] {
+		parts := strings.Split(*publicIPServices, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.PublicIPServices = parts
+	}
+	if setFlags["public-ip-timeout"] {
+		cfg.PublicIPTimeout = *publicIPTimeout
+	}
+	if setFlags["public-ip-retries"] {
+		cfg.PublicIPRetries = *publicIPRetries
+	}
+	if setFlags["public-ip-ttl"] {
+		cfg.PublicIPTTL = *publicIPTTL
+	}
 	if setFlags["verbose"] {
 		cfg.Verbose = *verbose
 	}
@@ -193,12 +699,76 @@ func LoadConfig() (*Config, error) {
 	if setFlags["metrics"] {
 		cfg.MetricsAddr = *metricsAddr
 	}
+	if setFlags["metrics-interval"] {
+		cfg.MetricsInterval = *metricsInterval
+	}
+	if setFlags["metrics-user"] {
+		cfg.MetricsUser = *metricsUser
+	}
+	if setFlags["metrics-password"] {
+		cfg.MetricsPassword = *metricsPassword
+	}
+	if setFlags["metrics-token"] {
+		cfg.MetricsToken = *metricsToken
+	}
+	if setFlags["metrics-tls-cert"] {
+		cfg.MetricsTLSCert = *metricsTLSCert
+	}
+	if setFlags["metrics-tls-key"] {
+		cfg.MetricsTLSKey = *metricsTLSKey
+	}
+	if setFlags["min-ready-peers"] {
+		cfg.MinReadyPeers = *minReadyPeers
+	}
+	if setFlags["alert-webhooks"] {
+		parts := strings.Split(*alertWebhooks, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.AlertWebhooks = parts
+	}
+	if setFlags["alert-error-rate"] {
+		cfg.AlertErrorRate = *alertErrorRate
+	}
+	if setFlags["pprof"] {
+		cfg.Pprof = *pprofEnabled
+	}
+	if setFlags["admin"] {
+		cfg.Admin = *adminEnabled
+	}
+	if setFlags["otlp-endpoint"] {
+		cfg.OTLPEndpoint = *otlpEndpoint
+	}
+	if setFlags["otlp-insecure"] {
+		cfg.OTLPInsecure = *otlpInsecure
+	}
+	if setFlags["grpc"] {
+		cfg.GRPCAddr = *grpcAddr
+	}
+	if setFlags["socket"] {
+		cfg.Socket = *socket
+	}
+	if setFlags["webdav"] {
+		cfg.WebDAVAddr = *webdavAddr
+	}
+	if setFlags["require-api-key"] {
+		cfg.RequireAPIKey = *requireAPIKey
+	}
 	if setFlags["discover-local"] {
 		cfg.DiscoverLocal = *discoverLocal
 	}
 	if setFlags["discover-pex"] {
 		cfg.DiscoverPex = *discoverPex
 	}
+	if setFlags["hole-punch"] {
+		cfg.HolePunch = *holePunch
+	}
+	if setFlags["relay"] {
+		cfg.RelayAddr = *relayAddr
+	}
+	if setFlags["network-id"] {
+		cfg.NetworkID = *networkID
+	}
 	if setFlags["quota"] {
 		cfg.QuotaSize = *quotaSize
 	}
@@ -217,6 +787,222 @@ func LoadConfig() (*Config, error) {
 	if setFlags["gc-delay"] {
 		cfg.GCDelay = *gcDelay
 	}
+	if setFlags["keep-versions"] {
+		cfg.KeepVersions = *keepVersions
+	}
+	if setFlags["version-max-age"] {
+		cfg.VersionMaxAge = *versionMaxAge
+	}
+	if setFlags["trash-max-age"] {
+		cfg.TrashMaxAge = *trashMaxAge
+	}
+	if setFlags["quarantine-retries"] {
+		cfg.QuarantineRetries = *quarantineRetries
+	}
+	if setFlags["convergent-encryption"] {
+		cfg.Convergent = *convergent
+	}
+	if setFlags["cipher"] {
+		cfg.Cipher = *cipherName
+	}
+	if setFlags["framed-encryption"] {
+		cfg.FramedEncryption = *framed
+	}
+	if setFlags["encrypt-metadata"] {
+		cfg.EncryptMetadata = *encryptMetadata
+	}
+	if setFlags["min-peer-score"] {
+		cfg.MinPeerScore = *minPeerScore
+	}
+	if setFlags["peer-score-ban"] {
+		cfg.PeerScoreBan = *peerScoreBan
+	}
+	if setFlags["max-peers"] {
+		cfg.MaxPeers = *maxPeers
+	}
+	if setFlags["quota-warning"] {
+		cfg.QuotaWarning = *quotaWarning
+	}
+	if setFlags["anti-entropy-interval"] {
+		cfg.AntiEntropy = *antiEntropy
+	}
+	if setFlags["replication-factor"] {
+		cfg.ReplicationFactor = *replicationFactor
+	}
+	if setFlags["replica-timeout"] {
+		cfg.ReplicaTimeout = *replicaTimeout
+	}
+	if setFlags["write-concern"] {
+		cfg.WriteConcern = *writeConcern
+	}
+	if setFlags["offline-queue"] {
+		cfg.OfflineQueue = *offlineQueue
+	}
+	if setFlags["shutdown-timeout"] {
+		cfg.ShutdownTimeout = *shutdownTimeout
+	}
+	if setFlags["guest-token"] {
+		cfg.GuestToken = *guestToken
+	}
+	if setFlags["transport"] {
+		cfg.Transport = *transport
+	}
+	if setFlags["trusted-peers"] {
+		parts := strings.Split(*trustedPeers, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.TrustedPeers = parts
+	}
+	if setFlags["guest-issuers"] {
+		parts := strings.Split(*guestIssuers, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.GuestIssuers = parts
+	}
+	if setFlags["allow-peers"] {
+		parts := strings.Split(*allowPeers, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.AllowPeers = parts
+	}
+	if setFlags["block-peers"] {
+		parts := strings.Split(*blockPeers, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.BlockPeers = parts
+	}
+	if setFlags["policy-admins"] {
+		parts := strings.Split(*policyAdmins, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.PolicyAdmins = parts
+	}
+	if setFlags["policy-overrides"] {
+		parts := strings.Split(*policyOverrides, ",")
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+		cfg.PolicyOverrides = parts
+	}
+	if setFlags["device-keys"] {
+		cfg.DeviceKeys = *deviceKeys
+	}
+	if setFlags["labels"] {
+		cfg.Labels = parseLabels(*labels)
+	}
+	if setFlags["pin"] {
+		cfg.Pin = *pin
+	}
+	if setFlags["pin-token"] {
+		cfg.PinToken = *pinToken
+	}
+	if setFlags["inbox-auto-accept"] {
+		cfg.InboxAutoAccept = *inboxAutoAccept
+	}
+	if setFlags["readahead"] {
+		cfg.Readahead = *readahead
+	}
+	if setFlags["max-upload"] {
+		cfg.MaxUpload = *maxUpload
+	}
+	if setFlags["max-download"] {
+		cfg.MaxDownload = *maxDownload
+	}
+	if setFlags["max-peer-upload"] {
+		cfg.MaxPeerUpload = *maxPeerUpload
+	}
+	if setFlags["max-peer-download"] {
+		cfg.MaxPeerDownload = *maxPeerDownload
+	}
+	if setFlags["max-inbound-streams"] {
+		cfg.MaxInStreams = *maxInboundStreams
+	}
+	if setFlags["max-outbound-streams"] {
+		cfg.MaxOutStreams = *maxOutboundStreams
+	}
+	if setFlags["allow-downgrade"] {
+		cfg.AllowDowngrade = *allowDowngrade
+	}
+	if setFlags["metadata-only"] {
+		cfg.MetadataOnly = *metadataOnly
+	}
+	if setFlags["sync-prefix"] {
+		cfg.SyncPrefix = *syncPrefix
+	}
+
+	// "peervault [flags] mount <mountpoint>" runs the node with the vault
+	// mounted, "peervault [flags] sync <dir>" with a directory synced to it,
+	// "peervault [flags] doctor" runs diagnostics and exits,
+	// "peervault [flags] init [config-file]" writes a config and exits,
+	// "peervault [flags] key <command>" manages the keyring and exits, and
+	// "peervault [flags] verify-peer <addr>" shows who a node is and exits
+	if args := flag.Args(); len(args) > 0 {
+		switch {
+		case args[0] == "mount" && len(args) == 2:
+			cfg.Mount = args[1]
+		case args[0] == "sync" && len(args) == 2:
+			cfg.SyncDir = args[1]
+		case args[0] == "doctor" && len(args) == 1:
+			cfg.Doctor = true
+		case args[0] == "init" && len(args) <= 2:
+			cfg.InitPath = "peervault.yaml"
+			if len(args) == 2 {
+				cfg.InitPath = args[1]
+			}
+		case args[0] == "key" && len(args) >= 2:
+			cfg.KeyCommand = args[1:]
+		case args[0] == "verify-peer" && len(args) == 2:
+			cfg.VerifyPeer = args[1]
+		default:
+			return nil, fmt.Errorf("unknown command %q, expected: mount <mountpoint>, sync <dir>, doctor, init [config-file], key <command> or verify-peer <addr>", strings.Join(args, " "))
+		}
+	}
 
 	return cfg, nil
 }
+
+// parseLabels parses "zone=eu,rack=r1" into a label map, skipping
+// entries without a key
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if key = strings.TrimSpace(key); key != "" {
+			labels[key] = strings.TrimSpace(value)
+		}
+	}
+	return labels
+}
+
+// policyFile is the YAML form of a shared policy, see the policy command
+type policyFile struct {
+	ReplicationFactor int      `yaml:"replication_factor"`
+	Denylist          []string `yaml:"denylist"`
+	Retention         []struct {
+		Prefix string        `yaml:"prefix"`
+		MinAge time.Duration `yaml:"min_age"`
+	} `yaml:"retention"`
+}
+
+// loadPolicyFile reads a shared policy to publish from a YAML file
+func loadPolicyFile(path string) (network.Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return network.Policy{}, err
+	}
+	var f policyFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return network.Policy{}, fmt.Errorf("failed to parse policy: %w", err)
+	}
+
+	p := network.Policy{ReplicationFactor: f.ReplicationFactor, Denylist: f.Denylist}
+	for _, r := range f.Retention {
+		p.Retention = append(p.Retention, network.RetentionRule{Prefix: r.Prefix, MinAge: r.MinAge})
+	}
+	return p, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// failure is why the node could not start, reported to whoever supervises
+// it with an exit code of its own so the cause needs no log parsing
+type failure struct {
+	code string
+	exit int
+}
+
+var (
+	failStartup   = failure{"startup_failed", 1}   // anything not listed below
+	failConfig    = failure{"config_invalid", 2}   // invalid flags, environment or config file
+	failKey       = failure{"key_invalid", 3}      // missing or invalid network key or guest token
+	failAddrInUse = failure{"addr_in_use", 4}      // listen address taken by another process
+	failStorage   = failure{"storage_unusable", 5} // storage root unreadable, unwritable or full
+)
+
+// exitReport is written to stderr as one JSON line before the node exits
+type exitReport struct {
+	Time     time.Time `json:"time"`
+	Code     string    `json:"code"`
+	ExitCode int       `json:"exit_code"`
+	Msg      string    `json:"msg"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// classify narrows f down when err tells more about the cause
+func classify(f failure, err error) failure {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return failAddrInUse
+	case errors.Is(err, syscall.EROFS), errors.Is(err, syscall.ENOSPC):
+		return failStorage
+	}
+	return f
+}
+
+// fatal reports why the node could not start and exits with the code of f
+func fatal(f failure, msg string, err error) {
+	f = classify(f, err)
+	report := exitReport{Time: time.Now(), Code: f.code, ExitCode: f.exit, Msg: msg}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	data, _ := json.Marshal(report)
+	fmt.Fprintln(os.Stderr, string(data))
+	os.Exit(f.exit)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/quota"
+)
+
+// wizard asks the questions of "peervault init", offering a default for
+// each one that is taken when the answer is empty
+type wizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// ask returns the answer to a question, or def if there is none
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	if !w.in.Scan() {
+		if err := w.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	if answer := strings.TrimSpace(w.in.Text()); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// askValid asks until check accepts the answer
+func (w *wizard) askValid(question, def string, check func(string) error) (string, error) {
+	for {
+		answer, err := w.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintf(w.out, "  %v, please try again.\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// confirm asks a yes/no question
+func (w *wizard) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := w.askValid(question+" ("+hint+")", "", func(a string) error {
+		switch strings.ToLower(a) {
+		case "", "y", "yes", "n", "no":
+			return nil
+		}
+		return errors.New("answer y or n")
+	})
+	if err != nil || answer == "" {
+		return def, err
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+// runInit walks through the settings a new node needs and writes them as a
+// full config to path. cfg holds the defaults offered, so flags given with
+// init become the suggested answers. Nothing prompts at startup afterwards.
+func runInit(cfg *Config, path string, in io.Reader, out io.Writer) error {
+	w := &wizard{in: bufio.NewScanner(in), out: out}
+	fmt.Fprintln(out, "=== PeerVault Setup ===")
+	fmt.Fprintf(out, "Answers are written to %s. Press enter to accept the default in brackets.\n\n", path)
+
+	if _, err := os.Stat(path); err == nil {
+		overwrite, err := w.confirm(path+" already exists. Overwrite it?", false)
+		if err != nil {
+			return err
+		}
+		if !overwrite {
+			return errors.New("setup cancelled, existing config kept")
+		}
+	}
+
+	var err error
+	if cfg.ListenAddr, err = w.ask("Listen address", cfg.ListenAddr); err != nil {
+		return err
+	}
+	if cfg.StorageRoot, err = w.ask("Storage directory", storageRootFor(cfg)); err != nil {
+		return err
+	}
+
+	defQuota := cfg.QuotaSize
+	if defQuota == "" {
+		defQuota = "10GB"
+	}
+	cfg.QuotaSize, err = w.askValid("Storage quota (e.g. 500MB, 10GB)", defQuota, func(a string) error {
+		_, err := quota.ParseStorageSize(a)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	generate, err := w.confirm("Generate a new network key? Answer no to join an existing network", cfg.EncKey == "")
+	if err != nil {
+		return err
+	}
+	if generate {
+		key, err := crypto.NewEncryptionKey()
+		if err != nil {
+			return err
+		}
+		cfg.EncKey = hex.EncodeToString(key)
+	} else {
+		cfg.EncKey, err = w.askValid("Network key (64 hex digits, as in the other nodes' configs)", cfg.EncKey, func(a string) error {
+			if key, err := hex.DecodeString(a); err != nil || len(key) != 32 {
+				return errors.New("the key must be 64 hex digits")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	peers, err := w.ask("Bootstrap peers (host:port, comma-separated, empty for none)", strings.Join(cfg.Bootstrap, ","))
+	if err != nil {
+		return err
+	}
+	cfg.Bootstrap = nil
+	for _, p := range strings.Split(peers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.Bootstrap = append(cfg.Bootstrap, p)
+		}
+	}
+
+	if cfg.DiscoverLocal, err = w.confirm("Discover peers on the local network (mDNS)?", true); err != nil {
+		return err
+	}
+	if cfg.DiscoverPex, err = w.confirm("Learn about more peers from connected ones (peer exchange)?", true); err != nil {
+		return err
+	}
+	if cfg.DetectPublicIP, err = w.confirm("Detect and advertise this machine's public IP?", cfg.DetectPublicIP); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	header := "# PeerVault configuration written by \"peervault init\".\n" +
+		"# It holds the network key: keep it private. See config.yaml.example\n" +
+		"# for a description of every setting.\n\n"
+	// The network key is in it, so only the owner may read the file
+	if err := os.WriteFile(path, append([]byte(header), data...), 0600); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	fmt.Fprintf(out, "\nConfiguration written to %s.\n", path)
+	if generate {
+		fmt.Fprintln(out, "Other nodes join this network with the same key, found under enc_key.")
+	}
+	fmt.Fprintf(out, "Start the node with:\n\n  peervault -config %s\n", path)
+	return nil
+}
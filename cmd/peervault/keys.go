@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/keyring"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+)
+
+// keyCommands lists the commands of "peervault [flags] key"
+const keyCommands = "init, import, export, passwd, fingerprint, identity, split or recover"
+
+// keyringPathFor returns the keyring of the node, ~/.peervault/keyring
+// unless configured
+func keyringPathFor(cfg *Config) (string, error) {
+	if cfg.Keyring != "" {
+		return cfg.Keyring, nil
+	}
+	return keyring.DefaultPath()
+}
+
+// keyFromKeyring returns the network key kept in the keyring, or nil if
+// there is no keyring
+func keyFromKeyring(cfg *Config) ([]byte, error) {
+	path, err := keyringPathFor(cfg)
+	if err != nil || !keyring.Exists(path) {
+		return nil, nil
+	}
+	k, err := unlockKeyring(cfg, path, os.Stdin, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.Get(keyring.NetworkKey)
+	if !ok {
+		return nil, fmt.Errorf("keyring %s holds no network key", path)
+	}
+	return key, nil
+}
+
+// unlockKeyring opens the keyring at path with the passphrase kept in the
+// OS keychain if cfg.Keychain is set, the one in
+// PEERVAULT_KEYRING_PASSPHRASE, or one asked for on the terminal
+func unlockKeyring(cfg *Config, path string, in *os.File, out io.Writer) (*keyring.Keyring, error) {
+	if cfg.Keychain {
+		passphrase, err := keyring.LoadFromKeychain(path)
+		if err == nil {
+			return keyring.Open(path, passphrase)
+		}
+		fmt.Fprintf(out, "Keyring passphrase not found in the OS keychain: %v\n", err)
+	}
+	if val, ok := os.LookupEnv("PEERVAULT_KEYRING_PASSPHRASE"); ok {
+		return keyring.Open(path, []byte(val))
+	}
+	passphrase, err := keyring.ReadPassphrase(in, out, "Passphrase of "+path+": ")
+	if err != nil {
+		return nil, err
+	}
+	return keyring.Open(path, passphrase)
+}
+
+// newPassphrase asks for a passphrase twice, unless one is given in
+// PEERVAULT_KEYRING_PASSPHRASE
+func newPassphrase(in *os.File, out io.Writer) ([]byte, error) {
+	if val, ok := os.LookupEnv("PEERVAULT_KEYRING_PASSPHRASE"); ok {
+		return []byte(val), nil
+	}
+	passphrase, err := keyring.ReadPassphrase(in, out, "New keyring passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase is empty")
+	}
+	again, err := keyring.ReadPassphrase(in, out, "Repeat the passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// parseHexKey decodes a network key of 64 hex digits
+func parseHexKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key must be 64 hex digits")
+	}
+	return key, nil
+}
+
+// parseNetworkKey decodes a configured network key, 64 hex digits or 32
+// bytes as they are
+func parseNetworkKey(s string) ([]byte, error) {
+	key := []byte(s)
+	if len(s) == 64 {
+		if decoded, err := hex.DecodeString(s); err == nil {
+			key = decoded
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, want 32", len(key))
+	}
+	return key, nil
+}
+
+// networkKeyFor returns the network key configured for the node, or kept
+// in its keyring
+func networkKeyFor(cfg *Config) ([]byte, error) {
+	if cfg.EncKey != "" {
+		return parseNetworkKey(cfg.EncKey)
+	}
+	key, err := keyFromKeyring(cfg)
+	if err == nil && key == nil {
+		err = errors.New("no network key: set -key, or keep one in a keyring with: peervault key init")
+	}
+	return key, err
+}
+
+// networkIDFor returns the network the node joins, named in its handshakes
+func networkIDFor(cfg *Config, key []byte) string {
+	if cfg.NetworkID != "" {
+		return cfg.NetworkID
+	}
+	return network.NetworkIDFromKey(key)
+}
+
+// printFingerprint writes a fingerprint under label, with its emoji below
+func printFingerprint(out io.Writer, label string, f crypto.HumanFingerprint) {
+	fmt.Fprintf(out, "%-15s%s\n%-15s%s\n", label, f, "", f.Emoji())
+}
+
+// sharePrefix starts the text of a share of the network key, see shareText
+const sharePrefix = "pvshare"
+
+// shareText formats a share of key for writing down, as
+// pvshare-<threshold>-<index>-<network ID>-<hex>. The network ID of the key
+// tells shares of different keys apart and checks the recovered one.
+func shareText(key []byte, threshold int, share []byte) string {
+	return fmt.Sprintf("%s-%d-%d-%s-%x", sharePrefix, threshold, share[0], network.NetworkIDFromKey(key), share[1:])
+}
+
+// parseShareText reverses shareText
+func parseShareText(s string) (share []byte, threshold int, networkID string, err error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 5 || parts[0] != sharePrefix {
+		return nil, 0, "", errors.New("not a key share, expected pvshare-<threshold>-<index>-<network ID>-<hex>")
+	}
+	threshold, err = strconv.Atoi(parts[1])
+	if err != nil || threshold < 2 {
+		return nil, 0, "", fmt.Errorf("invalid threshold %q", parts[1])
+	}
+	index, err := strconv.Atoi(parts[2])
+	if err != nil || index < 1 || index > 255 {
+		return nil, 0, "", fmt.Errorf("invalid share index %q", parts[2])
+	}
+	data, err := hex.DecodeString(parts[4])
+	if err != nil || len(data) != 32 {
+		return nil, 0, "", errors.New("invalid share data, expected 64 hex digits")
+	}
+	return append([]byte{byte(index)}, data...), threshold, parts[3], nil
+}
+
+// keepNetworkKey puts key in the keyring at path, creating it if there is
+// none
+func keepNetworkKey(cfg *Config, path string, key []byte, in *os.File, out io.Writer) error {
+	var k *keyring.Keyring
+	var passphrase []byte
+	var err error
+	if keyring.Exists(path) {
+		if k, err = unlockKeyring(cfg, path, in, out); err != nil {
+			return err
+		}
+	} else {
+		if passphrase, err = newPassphrase(in, out); err != nil {
+			return err
+		}
+		if k, err = keyring.Create(path, passphrase); err != nil {
+			return err
+		}
+	}
+	k.Set(keyring.NetworkKey, key)
+	if passphrase == nil {
+		// The passphrase is unchanged, and in the keychain already
+		if err := k.Save(); err != nil {
+			return fmt.Errorf("failed to write keyring: %w", err)
+		}
+		fmt.Fprintf(out, "Network key replaced in %s.\n", path)
+		return nil
+	}
+	return saveKeyring(cfg, k, passphrase, out)
+}
+
+// saveKeyring writes k, and its passphrase to the OS keychain if
+// cfg.Keychain is set
+func saveKeyring(cfg *Config, k *keyring.Keyring, passphrase []byte, out io.Writer) error {
+	if err := k.Save(); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	fmt.Fprintf(out, "Keyring written to %s.\n", k.Path())
+	if cfg.Keychain {
+		if err := keyring.SaveToKeychain(k.Path(), passphrase); err != nil {
+			return fmt.Errorf("keyring written, but its passphrase was not kept in the OS keychain: %w", err)
+		}
+		fmt.Fprintln(out, "Passphrase kept in the OS keychain, nodes unlock the keyring without asking.")
+	}
+	return nil
+}
+
+// runKey runs "peervault [flags] key <command>":
+//
+//	init         create a keyring holding a new network key, or the one configured
+//	import       keep a network key typed on the terminal in the keyring
+//	export       print the network key, for configuring other nodes
+//	passwd       change the passphrase of the keyring
+//	fingerprint  print fingerprints of the network key and node identity
+//	split        split the network key into shares for backup, -n shares of
+//	             which -t recover it
+//	recover      put the network key recovered from shares in the keyring
+func runKey(cfg *Config, args []string, in *os.File, out io.Writer) error {
+	path, err := keyringPathFor(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "init":
+		if keyring.Exists(path) {
+			return fmt.Errorf("keyring %s already exists, replace its network key with: peervault key import", path)
+		}
+		var key []byte
+		if cfg.EncKey != "" {
+			// Moving a configured key into the keyring
+			if key, err = parseHexKey(cfg.EncKey); err != nil {
+				return err
+			}
+		} else if key, err = crypto.NewEncryptionKey(); err != nil {
+			return err
+		}
+		passphrase, err := newPassphrase(in, out)
+		if err != nil {
+			return err
+		}
+		k, err := keyring.Create(path, passphrase)
+		if err != nil {
+			return err
+		}
+		k.Set(keyring.NetworkKey, key)
+		if err := saveKeyring(cfg, k, passphrase, out); err != nil {
+			return err
+		}
+		if cfg.EncKey != "" {
+			fmt.Fprintln(out, "The configured network key is in the keyring now. Remove enc_key, PEERVAULT_ENC_KEY or -key from the node's setup.")
+		} else {
+			fmt.Fprintln(out, "A new network key was generated. Other nodes join with it, shown by: peervault key export")
+		}
+		return nil
+
+	case "import":
+		typed, err := keyring.ReadPassphrase(in, out, "Network key (64 hex digits): ")
+		if err != nil {
+			return err
+		}
+		key, err := parseHexKey(string(bytes.TrimSpace(typed)))
+		if err != nil {
+			return err
+		}
+		return keepNetworkKey(cfg, path, key, in, out)
+
+	case "export":
+		// Only the key goes to out, so it can be piped
+		k, err := unlockKeyring(cfg, path, in, os.Stderr)
+		if err != nil {
+			return err
+		}
+		key, ok := k.Get(keyring.NetworkKey)
+		if !ok {
+			return fmt.Errorf("keyring %s holds no network key", path)
+		}
+		fmt.Fprintln(out, hex.EncodeToString(key))
+		return nil
+
+	case "passwd":
+		k, err := unlockKeyring(cfg, path, in, out)
+		if err != nil {
+			return err
+		}
+		passphrase, err := newPassphrase(in, out)
+		if err != nil {
+			return err
+		}
+		if err := k.SetPassphrase(passphrase); err != nil {
+			return err
+		}
+		return saveKeyring(cfg, k, passphrase, out)
+
+	case "fingerprint":
+		key, err := networkKeyFor(cfg)
+		if err != nil {
+			return err
+		}
+		// Of the key's network ID, which is what verify-peer sees of
+		// other nodes
+		printFingerprint(out, "Network key", crypto.NewHumanFingerprint("network", []byte(network.NetworkIDFromKey(key))))
+		if cfg.NetworkID != "" {
+			printFingerprint(out, "Network ID", crypto.NewHumanFingerprint("network", []byte(cfg.NetworkID)))
+		}
+		// The identity is created on first start, not by this command
+		idPath := filepath.Join(storageRootFor(cfg), "identity.key")
+		if _, err := os.Stat(idPath); err != nil {
+			fmt.Fprintf(out, "%-15s%s\n", "Node identity", "none yet, created when the node first starts")
+		} else {
+			id, err := crypto.LoadOrCreateIdentity(idPath)
+			if err != nil {
+				return err
+			}
+			printFingerprint(out, "Node identity", crypto.NewHumanFingerprint("identity", id.PublicKey))
+		}
+		fmt.Fprintln(out, "Compare these with what other operators read out, or check a node with: peervault verify-peer <addr>")
+		return nil
+
+	case "identity":
+		// Needs no network key: a guest sends it to the member issuing
+		// its token before it has one
+		id, err := crypto.LoadOrCreateIdentity(filepath.Join(storageRootFor(cfg), "identity.key"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, id.Fingerprint())
+		return nil
+
+	case "split":
+		fs := flag.NewFlagSet("key split", flag.ContinueOnError)
+		n := fs.Int("n", 5, "Shares to split the key into")
+		threshold := fs.Int("t", 3, "Shares needed to recover the key")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		key, err := networkKeyFor(cfg)
+		if err != nil {
+			return err
+		}
+		shares, err := crypto.SplitSecret(key, *n, *threshold)
+		if err != nil {
+			return err
+		}
+		for i, share := range shares {
+			fmt.Fprintf(out, "Share %d of %d: %s\n", i+1, *n, shareText(key, *threshold, share))
+		}
+		fmt.Fprintf(out, "Give each share to a different holder. Any %d of them recover the network key with: peervault key recover\n", *threshold)
+		fmt.Fprintf(out, "Fewer than %d tell nothing about it.\n", *threshold)
+		return nil
+
+	case "recover":
+		var shares [][]byte
+		var threshold int
+		var networkID string
+		for len(shares) == 0 || len(shares) < threshold {
+			prompt := fmt.Sprintf("Share %d: ", len(shares)+1)
+			if threshold > 0 {
+				prompt = fmt.Sprintf("Share %d of %d: ", len(shares)+1, threshold)
+			}
+			typed, err := keyring.ReadPassphrase(in, out, prompt)
+			if err != nil {
+				return err
+			}
+			share, t, id, err := parseShareText(string(typed))
+			if err != nil {
+				fmt.Fprintf(out, "%v, try again.\n", err)
+				continue
+			}
+			if threshold > 0 && (t != threshold || id != networkID) {
+				fmt.Fprintln(out, "This share is of another key or split, try again.")
+				continue
+			}
+			if slices.ContainsFunc(shares, func(s []byte) bool { return s[0] == share[0] }) {
+				fmt.Fprintln(out, "This share was given already, try another.")
+				continue
+			}
+			threshold, networkID = t, id
+			shares = append(shares, share)
+		}
+		key, err := crypto.CombineShares(shares)
+		if err != nil {
+			return err
+		}
+		if network.NetworkIDFromKey(key) != networkID {
+			return errors.New("the shares do not give the key back: one is mistyped or from another split of the key")
+		}
+		fmt.Fprintln(out, "Network key recovered.")
+		return keepNetworkKey(cfg, path, key, in, out)
+	}
+	return fmt.Errorf("unknown key command %q, expected %s", args[0], keyCommands)
+}
+
+// runVerifyPeer runs "peervault [flags] verify-peer <addr>": it connects to
+// the node at addr without joining it and prints the fingerprints of its
+// network and identity, failing if it is on another network
+func runVerifyPeer(cfg *Config, addr string, out io.Writer) error {
+	key, err := networkKeyFor(cfg)
+	if err != nil {
+		return err
+	}
+	networkID := networkIDFor(cfg, key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	node, err := network.VerifyPeer(ctx, addr, networkID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%-15s%s\n", "Node", addr)
+	printFingerprint(out, "Network", crypto.NewHumanFingerprint("network", []byte(node.NetworkID)))
+	if node.NetworkID != networkID {
+		printFingerprint(out, "This network", crypto.NewHumanFingerprint("network", []byte(networkID)))
+		return fmt.Errorf("%s is on another network: it was set up with another key or network ID, or is not the node meant", addr)
+	}
+	fmt.Fprintf(out, "%-15s%s\n", "Node ID", node.ID)
+	printFingerprint(out, "Node identity", crypto.NewHumanFingerprint("identity", node.PublicKey))
+	fmt.Fprintln(out, "The node is on this network. Check its identity with its operator, shown on the node by: peervault key fingerprint")
+	return nil
+}
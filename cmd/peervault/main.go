@@ -4,94 +4,310 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/dav"
+	"github.com/AdityaKrSingh26/PeerVault/internal/dirsync"
+	"github.com/AdityaKrSingh26/PeerVault/internal/doctor"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
 	"github.com/AdityaKrSingh26/PeerVault/internal/logger"
 	"github.com/AdityaKrSingh26/PeerVault/internal/metrics"
+	"github.com/AdityaKrSingh26/PeerVault/internal/mount"
 	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/pinning"
 	"github.com/AdityaKrSingh26/PeerVault/internal/quota"
 	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/internal/tracing"
 	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
 )
 
 func makeServer(
-	listenAddr string,
+	cfg *Config,
 	networkKey []byte,
 	slogLogger *slog.Logger,
-	fetchTimeout time.Duration,
-	pexInterval time.Duration,
-	gcInterval time.Duration,
-	gcDelay time.Duration,
-	nodes ...string,
-) *network.FileServer {
-	tcptransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
-		DialTimeout:   10 * time.Second,
-		MaxRetries:    3,
-		RetryDelay:    2 * time.Second,
+	listener net.Listener,
+	advertiseAddr string,
+	publicIP *network.PublicIPDetector,
+) (*network.FileServer, error) {
+	fileServerOpts := network.FileServerOpts{
+		EncKey:              networkKey, // Use shared network key
+		StorageRoot:         storageRootFor(cfg),
+		PathTransformFunc:   storage.CASPathTransformFunc,
+		BootstrapNodes:      cfg.Bootstrap,
+		Logger:              slogLogger,
+		FetchTimeout:        cfg.FetchTimeout,
+		PexInterval:         cfg.PexInterval,
+		GCInterval:          cfg.GCInterval,
+		GCDelay:             cfg.GCDelay,
+		AntiEntropyInterval: cfg.AntiEntropy,
+		MetricsInterval:     cfg.MetricsInterval,
+		ReplicationFactor:   cfg.ReplicationFactor,
+		ReplicaTimeout:      cfg.ReplicaTimeout,
+		TrustedPeers:        cfg.TrustedPeers,
+		AllowPeers:          cfg.AllowPeers,
+		BlockPeers:          cfg.BlockPeers,
+		PolicyAdmins:        cfg.PolicyAdmins,
+		PolicyOverrides:     cfg.PolicyOverrides,
+		GuestToken:          cfg.GuestToken,
+		GuestIssuers:        cfg.GuestIssuers,
+		Labels:              cfg.Labels,
+		DeviceKeys:          cfg.DeviceKeys,
+		MetadataOnly:        cfg.MetadataOnly,
+		AllowDowngrade:      cfg.AllowDowngrade,
+		MaxInboundStreams:   cfg.MaxInStreams,
+		MaxOutboundStreams:  cfg.MaxOutStreams,
+		AdvertiseAddr:       advertiseAddr,
+		PublicIP:            publicIP,
+		RelayAddr:           cfg.RelayAddr,
+		NetworkID:           cfg.NetworkID,
+	}
+	if fileServerOpts.NetworkID == "" {
+		fileServerOpts.NetworkID = network.NetworkIDFromKey(networkKey)
+	}
+	if cfg.Pin != "" {
+		pinner, err := pinning.New(cfg.Pin, cfg.PinToken)
+		if err != nil {
+			return nil, err
+		}
+		fileServerOpts.Pinner = pinner
+	}
+	if cfg.InboxAutoAccept != "" {
+		limit, err := quota.ParseStorageSize(cfg.InboxAutoAccept)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inbox auto-accept size: %w", err)
+		}
+		fileServerOpts.InboxAutoAccept = limit
+	}
+	if cfg.Readahead != "" {
+		window, err := quota.ParseStorageSize(cfg.Readahead)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readahead size: %w", err)
+		}
+		fileServerOpts.Readahead = window
+		if window == 0 {
+			fileServerOpts.Readahead = -1
+		}
+	}
+	rates := []struct {
+		name  string
+		value string
+		limit *int64
+	}{
+		{"max-upload", cfg.MaxUpload, &fileServerOpts.MaxUpload},
+		{"max-download", cfg.MaxDownload, &fileServerOpts.MaxDownload},
+		{"max-peer-upload", cfg.MaxPeerUpload, &fileServerOpts.PeerMaxUpload},
+		{"max-peer-download", cfg.MaxPeerDownload, &fileServerOpts.PeerMaxDownload},
+	}
+	for _, rate := range rates {
+		if rate.value == "" {
+			continue
+		}
+		limit, err := quota.ParseStorageSize(rate.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rate: %w", rate.name, err)
+		}
+		*rate.limit = limit
+	}
+	disks, err := parseDisks(cfg.Disks)
+	if err != nil {
+		return nil, err
+	}
+	fileServerOpts.Disks = disks
+	backend, err := storage.OpenBackend(cfg.StorageBackend)
+	if err != nil {
+		return nil, err
+	}
+	fileServerOpts.Backend = backend
+	compression, err := storage.ParseCompression(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	fileServerOpts.Compression = compression
+	if cfg.KeepVersions != 0 || cfg.VersionMaxAge > 0 {
+		fileServerOpts.Versions = &storage.VersionRetention{Keep: max(cfg.KeepVersions, 0), MaxAge: cfg.VersionMaxAge}
+	}
+	fileServerOpts.Trash = cfg.TrashMaxAge
+	fileServerOpts.QuarantineRetries = cfg.QuarantineRetries
+	fileServerOpts.Convergent = cfg.Convergent
+	suite, err := crypto.ParseSuite(cfg.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.FramedEncryption {
+		suite = suite.Framed()
+	}
+	fileServerOpts.Cipher = suite
+	fileServerOpts.EncryptMetadata = cfg.EncryptMetadata
+	fileServerOpts.MinPeerScore = cfg.MinPeerScore
+	fileServerOpts.PeerScoreBan = cfg.PeerScoreBan
+	fileServerOpts.MaxPeers = cfg.MaxPeers
+	fileServerOpts.QuotaWarning = cfg.QuotaWarning
+	fileServerOpts.WriteConcern = cfg.WriteConcern
+	fileServerOpts.OfflineQueue = cfg.OfflineQueue
+
+	s, err := network.NewFileServer(fileServerOpts)
+	if err != nil {
+		return nil, err
 	}
-	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
 
-	// Create a safe storage root name in a dedicated storage directory
-	// Replace : with _ for Windows compatibility
-	portName := strings.ReplaceAll(listenAddr, ":", "port_")
-	storageRoot := fmt.Sprintf("storage/node_%s", portName)
+	// Hole punching dials from the listening port, so the port is shared
+	params := maps.Clone(cfg.TransportOptions)
+	if cfg.HolePunch && cfg.Transport == "tcp" {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		if _, ok := params["reuse_port"]; !ok {
+			params["reuse_port"] = "true"
+		}
+	}
 
-	fileServerOpts := network.FileServerOpts{
-		EncKey:            networkKey, // Use shared network key
-		StorageRoot:       storageRoot,
-		PathTransformFunc: storage.CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    nodes,
-		Logger:            slogLogger,
-		FetchTimeout:      fetchTimeout,
-		PexInterval:       pexInterval,
-		GCInterval:        gcInterval,
-		GCDelay:           gcDelay,
+	// The transport is looked up by name so third-party transports
+	// registered with p2p.RegisterTransport can be selected from config
+	transport, err := p2p.NewTransport(cfg.Transport, p2p.TransportOptions{
+		ListenAddr:    cfg.ListenAddr,
+		HandshakeFunc: p2p.NetworkHandshakeFunc(fileServerOpts.NetworkID),
+		Decoder:       p2p.DefaultDecoder{},
+		OnPeer:        s.OnPeer,
+		OnPeerClose:   s.OnPeerClose,
+		Listener:      listener,
+		Params:        params,
+	})
+	if err != nil {
+		return nil, err
 	}
+	s.Transport = transport
 
-	s := network.NewFileServer(fileServerOpts)
+	return s, nil
+}
 
-	tcpTransport.OnPeer = s.OnPeer
+// parseDisks parses disk entries of the form "path" or "path=quota",
+// e.g. "/mnt/disk1=500GB"
+func parseDisks(entries []string) ([]storage.Disk, error) {
+	var disks []storage.Disk
+	for _, entry := range entries {
+		path, size, hasQuota := strings.Cut(strings.TrimSpace(entry), "=")
+		if path == "" {
+			continue
+		}
+		disk := storage.Disk{Path: path}
+		if hasQuota {
+			limit, err := quota.ParseStorageSize(size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quota of disk %s: %w", path, err)
+			}
+			disk.Quota = limit
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
 
-	return s
+// storageRootFor returns the storage directory of the node, by default
+// one named after its listen address
+func storageRootFor(cfg *Config) string {
+	if cfg.StorageRoot != "" {
+		return cfg.StorageRoot
+	}
+	// Create a safe storage root name in a dedicated storage directory
+	// Replace : with _ for Windows compatibility
+	portName := strings.ReplaceAll(cfg.ListenAddr, ":", "port_")
+	return fmt.Sprintf("storage/node_%s", portName)
 }
 
 // Interactive mode for file operations
-func interactiveMode(ctx context.Context, server *network.FileServer) {
+func interactiveMode(ctx context.Context, server *network.FileServer, apiKeys *grpcapi.KeyStore, doctorOpts doctor.Options, restart func()) {
 	scanner := bufio.NewScanner(os.Stdin)
 
 	fmt.Println("\n=== PeerVault Interactive Mode ===")
 	fmt.Println("Commands:")
-	fmt.Println("  store <filename>  - Store a file with sample data")
+	fmt.Println("  store <filename> [ttl] - Store a file with sample data, expiring after ttl (e.g. 24h)")
 	fmt.Println("  get <filename>    - Retrieve and display a file")
+	fmt.Println("  range <filename> <offset> <length> - Display part of a file without fetching all of it")
+	fmt.Println("  versions <filename> [n] - List the versions of a file, or show version n")
+	fmt.Println("  store-dir <path> [key] - Store a directory tree")
+	fmt.Println("  get-dir <key> <dest> - Restore a stored directory tree into dest")
 	fmt.Println("  delete <filename> - Delete a file from network")
+	fmt.Println("  restore <filename> - Restore a deleted file from the trash")
+	fmt.Println("  trash [list|empty] - List or empty the trash of deleted files")
+	fmt.Println("  receipt <filename> - Show the signed replication receipt of a file")
+	fmt.Println("  stat <filename>   - Show a stored file's size, timestamps, content type and tags")
+	fmt.Println("  tag <filename> <name=value|name=>... - Set or remove tags of a stored file")
 	fmt.Println("  list              - List all stored files")
+	fmt.Println("  list --network    - List files available across connected peers")
+	fmt.Println("  search <text>     - Find files on the network by name")
 	fmt.Println("  quota             - Show storage quota status")
+	fmt.Println("  dedup-stats [n]   - Show duplicated content and the space it takes")
+	fmt.Println("  hold [list|<key|prefix/> [reason]|release <key|prefix/>] - Manage legal holds")
+	fmt.Println("  audit [n]         - Show the last n audit log entries")
+	fmt.Println("  policy [publish <file>] - Show or publish the shared network policy")
+	fmt.Println("  apikey [list|issue <name> <verb:pattern>... [ttl]|revoke <id>] - Manage scoped API keys")
 	fmt.Println("  metrics           - Show server metrics")
+	fmt.Println("  activity [n] [-f] - Show recent operations, -f to follow live")
 	fmt.Println("  status            - Show server and network status")
 	fmt.Println("  peers             - Show connected peers")
 	fmt.Println("  discover          - Show discovered peers (mDNS/PEX)")
-	fmt.Println("  send <file> <peer> - Send file to specific peer")
+	fmt.Println("  doctor            - Diagnose connectivity, clock, disk and key problems")
+	fmt.Println("  gc [run]          - Show the garbage collector's schedule and last run, or run it now")
+	fmt.Println("  maintenance <gc|scrub|repair|rebalance> - Run a maintenance operation now")
+	fmt.Println("  maintenance [runs [n]|show <id>] - Show the last maintenance runs or one run's report")
+	fmt.Println("  send <file> <peer> - Offer a stored file to one peer's inbox")
+	fmt.Println("  outbox            - Show files offered to peers and their status")
+	fmt.Println("  inbox [list]      - List pending offers and files peers sent to this node")
+	fmt.Println("  inbox accept <id> - Accept a file a peer offered")
+	fmt.Println("  inbox reject <id> - Reject a file a peer offered")
+	fmt.Println("  inbox get <node> <file> - Show a file from the inbox")
 	fmt.Println("  fetch <key> <peer> - Fetch file from specific peer")
-	fmt.Println("  clean             - Clean local storage")
+	fmt.Println("  clean [files|all [--keys]] [--force] - Delete stored files, or everything but the node's keys")
+	fmt.Println("  peer kick <peer> [ban] - Disconnect a peer, optionally banning it (e.g. 1h)")
+	fmt.Println("  peer unban <peer> - Lift a peer ban")
+	fmt.Println("  peer bans         - Show banned hosts and the blocklist and allowlist")
+	fmt.Println("  peer scores       - Show the reputation of peers")
+	fmt.Println("  ban <peer>        - Block an address or node ID for good")
+	fmt.Println("  unban <peer>      - Unblock an address or node ID and lift its ban")
+	fmt.Println("  allow [remove] <peer> - Add an address or node ID to the allowlist, or remove it")
+	fmt.Println("  peer find [text]  - List connected peers matching an ID prefix, label or address")
+	fmt.Println("  guest <duration> <id> - Issue a read-only guest token (e.g. 24h) for a guest identity")
+	fmt.Println("  device            - Show this device's key and the authorized devices")
+	fmt.Println("  device authorize <key> [name] - Let another device read the files stored here")
+	fmt.Println("  restart           - Restart the node in place (e.g. after an upgrade)")
 	fmt.Println("  quit              - Exit PeerVault")
 	fmt.Println()
 
+	// Tell the user about files peers send here as they arrive
+	arrivals, unsubscribe := server.Events.Subscribe(16)
+	defer unsubscribe()
+	go func() {
+		for e := range arrivals {
+			switch e.Type {
+			case events.FileOffered:
+				fmt.Printf("\n%s wants to send '%s' (%s), see 'inbox'\nPeerVault> ", e.Peer, e.Key, e.Detail)
+			case events.FileDropped:
+				fmt.Printf("\nReceived '%s' from %s (%s), see 'inbox'\nPeerVault> ", e.Key, e.Peer, e.Detail)
+			}
+		}
+	}()
+
 	for {
 		fmt.Print("PeerVault> ")
 		if !scanner.Scan() {
@@ -109,13 +325,22 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 		switch command {
 		case "store":
 			if len(parts) < 2 {
-				fmt.Println("Usage: store <filename>")
+				fmt.Println("Usage: store <filename> [ttl]")
 				continue
 			}
 			filename := parts[1]
+			var expires time.Time
+			if len(parts) > 2 {
+				ttl, err := time.ParseDuration(parts[2])
+				if err != nil || ttl <= 0 {
+					fmt.Printf("Invalid ttl %q\n", parts[2])
+					continue
+				}
+				expires = time.Now().Add(ttl)
+			}
 			// For demo, store some sample data
 			data := bytes.NewReader([]byte(fmt.Sprintf("Sample data for file: %s (stored at %s)", filename, time.Now().Format("15:04:05"))))
-			err := server.Store(ctx, filename, data)
+			err := server.StoreWithExpiry(ctx, filename, data, expires)
 			if err != nil {
 				fmt.Printf("Error storing file: %v\n", err)
 			} else {
@@ -140,6 +365,90 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 				}
 			}
 
+		case "range":
+			if len(parts) < 4 {
+				fmt.Println("Usage: range <filename> <offset> <length>")
+				continue
+			}
+			offset, err1 := strconv.ParseInt(parts[2], 10, 64)
+			length, err2 := strconv.ParseInt(parts[3], 10, 64)
+			if err1 != nil || err2 != nil {
+				fmt.Println("Usage: range <filename> <offset> <length>")
+				continue
+			}
+			data, err := server.ReadRange(ctx, parts[1], offset, length)
+			if err != nil {
+				fmt.Printf("Error reading range: %v\n", err)
+				continue
+			}
+			fmt.Printf("Bytes %d-%d: %s\n", offset, offset+int64(len(data)), string(data))
+
+		case "versions":
+			if len(parts) < 2 {
+				fmt.Println("Usage: versions <filename> [n]")
+				continue
+			}
+			if len(parts) > 2 {
+				n, err := strconv.Atoi(parts[2])
+				if err != nil {
+					fmt.Printf("Invalid version %q\n", parts[2])
+					continue
+				}
+				reader, err := server.GetVersion(ctx, parts[1], n)
+				if err != nil {
+					fmt.Printf("Error retrieving version: %v\n", err)
+					continue
+				}
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					fmt.Printf("Error reading version: %v\n", err)
+					continue
+				}
+				fmt.Printf("Version %d content: %s\n", n, string(data))
+				continue
+			}
+			versions, err := server.ListVersions(parts[1])
+			if err != nil {
+				fmt.Printf("Error listing versions: %v\n", err)
+				continue
+			}
+			fmt.Printf("Versions of %s (%d):\n", parts[1], len(versions))
+			for _, v := range versions {
+				current := ""
+				if v.Current {
+					current = " (current)"
+				}
+				fmt.Printf("  %3d  %10s  %s%s\n", v.Number, metrics.FormatBytes(v.Size), v.ModTime.Local().Format("2006-01-02 15:04:05"), current)
+			}
+
+		case "store-dir":
+			if len(parts) < 2 {
+				fmt.Println("Usage: store-dir <path> [key]")
+				continue
+			}
+			key := filepath.Base(filepath.Clean(parts[1]))
+			if len(parts) > 2 {
+				key = parts[2]
+			}
+			manifest, err := server.StoreDir(ctx, key, parts[1])
+			if err != nil {
+				fmt.Printf("Error storing directory: %v\n", err)
+				continue
+			}
+			fmt.Printf("Directory '%s' stored as '%s' (%d entries)\n", parts[1], key, len(manifest.Entries))
+
+		case "get-dir":
+			if len(parts) < 3 {
+				fmt.Println("Usage: get-dir <key> <dest>")
+				continue
+			}
+			manifest, err := server.GetDir(ctx, parts[1], parts[2])
+			if err != nil {
+				fmt.Printf("Error retrieving directory: %v\n", err)
+				continue
+			}
+			fmt.Printf("Directory '%s' restored to '%s' (%d entries)\n", parts[1], parts[2], len(manifest.Entries))
+
 		case "delete":
 			if len(parts) < 2 {
 				fmt.Println("Usage: delete <filename>")
@@ -158,13 +467,144 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 				continue
 			}
 
-			err := server.Delete(filename)
+			err := server.DeleteContext(ctx, filename)
 			if err != nil {
 				fmt.Printf("Error deleting file: %v\n", err)
 			} else {
 				fmt.Printf("File '%s' deleted successfully from all nodes\n", filename)
 			}
 
+		case "restore":
+			if len(parts) < 2 {
+				fmt.Println("Usage: restore <filename>")
+				continue
+			}
+			if err := server.Restore(parts[1]); err != nil {
+				fmt.Printf("Error restoring file: %v\n", err)
+				continue
+			}
+			fmt.Printf("File '%s' restored from the trash\n", parts[1])
+
+		case "trash":
+			if len(parts) > 1 && parts[1] == "empty" {
+				n, err := server.EmptyTrash()
+				if err != nil {
+					fmt.Printf("Error emptying trash: %v\n", err)
+					continue
+				}
+				fmt.Printf("Removed %d file(s) from the trash\n", n)
+				continue
+			}
+			entries, err := server.Trash()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if len(entries) == 0 {
+				fmt.Println("The trash is empty")
+				continue
+			}
+			fmt.Printf("Trash (%d):\n", len(entries))
+			for _, e := range entries {
+				fmt.Printf("  %-30s %10s  deleted %s\n", e.Key, metrics.FormatBytes(e.Size), e.Deleted.Local().Format("2006-01-02 15:04"))
+			}
+
+		case "receipt":
+			if len(parts) < 2 {
+				fmt.Println("Usage: receipt <filename> [--json]")
+				continue
+			}
+			receipt, ok := server.Receipt(parts[1])
+			if !ok {
+				fmt.Printf("No receipt for '%s' (receipts exist for files stored on this node)\n", parts[1])
+				continue
+			}
+			if len(parts) > 2 && parts[2] == "--json" {
+				data, err := json.MarshalIndent(receipt, "", "  ")
+				if err != nil {
+					fmt.Printf("Error encoding receipt: %v\n", err)
+					continue
+				}
+				fmt.Println(string(data))
+				continue
+			}
+
+			status := "valid"
+			if err := network.VerifyReceipt(receipt); err != nil {
+				status = fmt.Sprintf("INVALID (%v)", err)
+			}
+			fmt.Println("\n=== Store Receipt ===")
+			fmt.Printf("Key:          %s\n", receipt.Key)
+			fmt.Printf("Content hash: %s\n", receipt.ContentHash)
+			fmt.Printf("Size:         %s\n", metrics.FormatBytes(receipt.Size))
+			fmt.Printf("Stored at:    %s\n", receipt.StoredAt.Local().Format(time.RFC3339))
+			fmt.Printf("Stored by:    %s (key %s)\n", shortID(receipt.NodeID), crypto.Fingerprint(receipt.PublicKey))
+			fmt.Printf("Signature:    %s\n", status)
+			fmt.Printf("Confirmations (%d):\n", len(receipt.Confirmations))
+			for _, c := range receipt.Confirmations {
+				fmt.Printf("  - node %s (key %s) at %s\n", shortID(c.NodeID), crypto.Fingerprint(c.PublicKey), c.SignedAt.Local().Format(time.RFC3339))
+			}
+
+		case "stat":
+			if len(parts) < 2 {
+				fmt.Println("Usage: stat <filename>")
+				continue
+			}
+			info, err := server.Stat(parts[1])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("File:         %s\n", info.Key)
+			fmt.Printf("Size:         %s\n", metrics.FormatBytes(info.Size))
+			fmt.Printf("Content type: %s\n", info.ContentType)
+			fmt.Printf("Content hash: %s\n", info.ContentHash)
+			fmt.Printf("Created:      %s\n", info.Created.Local().Format(time.RFC3339))
+			fmt.Printf("Modified:     %s\n", info.ModTime.Local().Format(time.RFC3339))
+			if !info.Expires.IsZero() {
+				fmt.Printf("Expires:      %s\n", info.Expires.Local().Format(time.RFC3339))
+			}
+			for _, name := range slices.Sorted(maps.Keys(info.Tags)) {
+				fmt.Printf("Tag:          %s=%s\n", name, info.Tags[name])
+			}
+
+		case "tag":
+			if len(parts) < 3 {
+				fmt.Println("Usage: tag <filename> <name=value|name=>...")
+				continue
+			}
+			info, err := server.Stat(parts[1])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			tags := maps.Clone(info.Tags)
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			valid := true
+			for _, arg := range parts[2:] {
+				name, value, ok := strings.Cut(arg, "=")
+				if !ok || name == "" {
+					fmt.Printf("Invalid tag %q, want name=value, or name= to remove it\n", arg)
+					valid = false
+					break
+				}
+				if value == "" {
+					delete(tags, name)
+				} else {
+					tags[name] = value
+				}
+			}
+			if !valid {
+				continue
+			}
+			if err := server.SetTags(parts[1], tags); err != nil {
+				fmt.Printf("Error tagging file: %v\n", err)
+				continue
+			}
+			fmt.Printf("%s has %d tags\n", parts[1], len(tags))
+
 		case "quota":
 			used, total, available, err := server.QuotaManager.GetStorageStats(server.StorageRoot)
 			if err != nil {
@@ -189,9 +629,279 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 			bar := strings.Repeat("█", usedBars) + strings.Repeat("░", barWidth-usedBars)
 			fmt.Printf("[%s] %.1f%%\n", bar, percentage)
 
+			if disks := server.DiskUsage(); len(disks) > 0 {
+				fmt.Println("\n=== Disks ===")
+				for _, d := range disks {
+					limit := "no quota"
+					if d.Quota > 0 {
+						limit = metrics.FormatBytes(d.Quota)
+					}
+					fmt.Printf("  %-30s %-10s %10s / %s\n", d.Path, d.State, metrics.FormatBytes(d.Used), limit)
+				}
+			}
+
+		case "dedup-stats":
+			top := 10
+			if len(parts) > 1 {
+				n, err := strconv.Atoi(parts[1])
+				if err != nil || n < 0 {
+					fmt.Println("Usage: dedup-stats [n]")
+					continue
+				}
+				top = n
+			}
+
+			report, err := server.DedupStats(ctx, top)
+			if err != nil {
+				fmt.Printf("Error computing dedup stats: %v\n", err)
+				continue
+			}
+
+			fmt.Println("\n=== Deduplication ===")
+			fmt.Printf("Files:     %d\n", report.Files)
+			fmt.Printf("Logical:   %s\n", metrics.FormatBytes(report.LogicalBytes))
+			fmt.Printf("Physical:  %s\n", metrics.FormatBytes(report.PhysicalBytes))
+			fmt.Printf("Ratio:     %.2fx\n", report.Ratio())
+			fmt.Printf("Savings:   %s\n", metrics.FormatBytes(report.Savings()))
+			if len(report.Duplicates) == 0 {
+				fmt.Println("No duplicated content")
+				continue
+			}
+			fmt.Println("Top duplicated content:")
+			for _, g := range report.Duplicates {
+				fmt.Printf("  %s  %d copies of %s, %s extra\n", g.Hash[:8], len(g.Keys), metrics.FormatBytes(g.Size), metrics.FormatBytes(g.Wasted()))
+				for _, key := range g.Keys {
+					fmt.Printf("    - %s\n", key)
+				}
+			}
+
+		case "hold":
+			if len(parts) < 2 || parts[1] == "list" {
+				holds := server.Holds()
+				if len(holds) == 0 {
+					fmt.Println("No legal holds")
+					continue
+				}
+				fmt.Printf("Legal holds (%d):\n", len(holds))
+				for _, h := range holds {
+					fmt.Printf("  %-30s by %s at %s", h.Pattern, h.By, h.Placed.Local().Format("2006-01-02 15:04"))
+					if h.Reason != "" {
+						fmt.Printf(" (%s)", h.Reason)
+					}
+					fmt.Println()
+				}
+				continue
+			}
+			if parts[1] == "release" {
+				if len(parts) < 3 {
+					fmt.Println("Usage: hold release <key|prefix/>")
+					continue
+				}
+				if err := server.ReleaseHold(parts[2], operatorName()); err != nil {
+					fmt.Printf("Error releasing hold: %v\n", err)
+					continue
+				}
+				fmt.Printf("Released legal hold on %s\n", parts[2])
+				continue
+			}
+			if err := server.PlaceHold(parts[1], operatorName(), strings.Join(parts[2:], " ")); err != nil {
+				fmt.Printf("Error placing hold: %v\n", err)
+				continue
+			}
+			fmt.Printf("%s is under legal hold\n", parts[1])
+
+		case "audit":
+			count := 20
+			if len(parts) > 1 {
+				n, err := strconv.Atoi(parts[1])
+				if err != nil || n <= 0 {
+					fmt.Println("Usage: audit [n]")
+					continue
+				}
+				count = n
+			}
+			entries, err := server.AuditLog(count)
+			if err != nil {
+				fmt.Printf("Error reading audit log: %v\n", err)
+				continue
+			}
+			if len(entries) == 0 {
+				fmt.Println("Audit log is empty")
+				continue
+			}
+			for _, e := range entries {
+				fmt.Printf("%s %-8s %s", e.Time.Local().Format("2006-01-02 15:04:05"), e.Action, e.Pattern)
+				if e.Key != "" && e.Key != e.Pattern {
+					fmt.Printf(" key=%s", e.Key)
+				}
+				if e.By != "" {
+					fmt.Printf(" by=%s", e.By)
+				}
+				if e.Reason != "" {
+					fmt.Printf(" (%s)", e.Reason)
+				}
+				fmt.Println()
+			}
+
+		case "policy":
+			if len(parts) > 1 {
+				if parts[1] != "publish" || len(parts) != 3 {
+					fmt.Println("Usage: policy [publish <file>]")
+					continue
+				}
+				p, err := loadPolicyFile(parts[2])
+				if err != nil {
+					fmt.Printf("Error reading policy: %v\n", err)
+					continue
+				}
+				published, err := server.PublishPolicy(p)
+				if err != nil {
+					fmt.Printf("Error publishing policy: %v\n", err)
+					continue
+				}
+				fmt.Printf("Published policy version %d\n", published.Version)
+				continue
+			}
+			fmt.Printf("This node's key: %s\n", server.Identity.Fingerprint())
+			p, ok := server.CurrentPolicy()
+			if !ok {
+				fmt.Println("No shared policy")
+				continue
+			}
+			fmt.Printf("Policy version %d from %s, published %s\n", p.Version, p.Publisher(), p.Published.Local().Format("2006-01-02 15:04"))
+			if p.ReplicationFactor > 0 {
+				fmt.Printf("  Replication factor: %d\n", p.ReplicationFactor)
+			}
+			if len(p.Denylist) > 0 {
+				fmt.Printf("  Denied hosts:       %s\n", strings.Join(p.Denylist, ", "))
+			}
+			for _, r := range p.Retention {
+				prefix := r.Prefix
+				if prefix == "" {
+					prefix = "(all files)"
+				}
+				fmt.Printf("  Retain %-12s at least %s\n", prefix, r.MinAge)
+			}
+			if len(server.PolicyOverrides) > 0 {
+				fmt.Printf("  Local overrides:    %s\n", strings.Join(server.PolicyOverrides, ", "))
+			}
+
+		case "apikey":
+			if len(parts) < 2 || parts[1] == "list" {
+				keys := apiKeys.List()
+				if len(keys) == 0 {
+					fmt.Println("No API keys")
+					continue
+				}
+				fmt.Printf("API keys (%d):\n", len(keys))
+				for _, k := range keys {
+					scopes := make([]string, len(k.Scopes))
+					for i, s := range k.Scopes {
+						scopes[i] = s.String()
+					}
+					expires := "never expires"
+					if !k.Expires.IsZero() {
+						expires = "expires " + k.Expires.Local().Format("2006-01-02 15:04")
+					}
+					fmt.Printf("  %s  %-16s %s (%s)\n", k.ID, k.Name, strings.Join(scopes, ", "), expires)
+				}
+				continue
+			}
+			switch parts[1] {
+			case "issue":
+				if len(parts) < 4 {
+					fmt.Println("Usage: apikey issue <name> <verb:pattern>... [ttl]")
+					continue
+				}
+				var scopes []grpcapi.Scope
+				var ttl time.Duration
+				valid := true
+				for _, arg := range parts[3:] {
+					if d, err := time.ParseDuration(arg); err == nil {
+						ttl = d
+						continue
+					}
+					scope, err := grpcapi.ParseScope(arg)
+					if err != nil {
+						fmt.Printf("Error: %v\n", err)
+						valid = false
+						break
+					}
+					scopes = append(scopes, scope)
+				}
+				if !valid {
+					continue
+				}
+				token, key, err := apiKeys.Issue(parts[2], scopes, ttl, operatorName())
+				if err != nil {
+					fmt.Printf("Error issuing API key: %v\n", err)
+					continue
+				}
+				fmt.Printf("API key %s issued for %s. It is shown only once:\n%s\n", key.ID, key.Name, token)
+			case "revoke":
+				if len(parts) != 3 {
+					fmt.Println("Usage: apikey revoke <id>")
+					continue
+				}
+				if err := apiKeys.Revoke(parts[2], operatorName()); err != nil {
+					fmt.Printf("Error revoking API key: %v\n", err)
+					continue
+				}
+				fmt.Printf("Revoked API key %s\n", parts[2])
+			default:
+				fmt.Println("Usage: apikey [list|issue <name> <verb:pattern>... [ttl]|revoke <id>]")
+			}
+
 		case "metrics":
 			fmt.Print(server.Metrics.ToHumanFormat())
 
+		case "activity":
+			count := 20
+			follow := false
+			valid := true
+			for _, arg := range parts[1:] {
+				if arg == "-f" {
+					follow = true
+				} else if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+					count = n
+				} else {
+					valid = false
+				}
+			}
+			if !valid {
+				fmt.Println("Usage: activity [count] [-f]")
+				continue
+			}
+
+			// Subscribe before reading history so no event falls in between
+			var live <-chan events.Event
+			var cancel func()
+			if follow {
+				live, cancel = server.Events.Subscribe(64)
+			}
+
+			recent := server.Events.Recent(count)
+			if len(recent) == 0 && !follow {
+				fmt.Println("No recent activity")
+			}
+			for _, e := range recent {
+				fmt.Println(e)
+			}
+
+			if follow {
+				fmt.Println("Following activity, press Enter to stop...")
+				done := make(chan struct{})
+				go func() {
+					for e := range live {
+						fmt.Println(e)
+					}
+					close(done)
+				}()
+				scanner.Scan()
+				cancel()
+				<-done
+			}
+
 		case "discover":
 			fmt.Println("\n=== Peer Discovery Status ===")
 
@@ -212,7 +922,7 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 			}
 
 			// PEX known peers
-			if server.Pex != nil && server.Pex.Enabled {
+			if server.Pex != nil && server.Pex.Enabled() {
 				knownPeers := server.Pex.ExportPeerList()
 				fmt.Printf("PEX Known Peers: %d\n", len(knownPeers))
 
@@ -236,13 +946,61 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 
 		case "status":
 			fmt.Printf("Server listening on: %s\n", server.Transport.Addr())
+			fmt.Printf("Network ID: %s\n", server.NetworkID)
+			if server.IsGuest() {
+				fmt.Printf("Guest access (read-only) until: %s\n", server.GuestUntil().Local().Format("2006-01-02 15:04:05"))
+			}
+			if server.MetadataOnly {
+				files, peers, updated := server.IndexStats()
+				fmt.Printf("Metadata-only: indexing %d files from %d peers", files, peers)
+				if !updated.IsZero() {
+					fmt.Printf(", updated %v ago", time.Since(updated).Round(time.Second))
+				}
+				fmt.Println()
+			}
 			fmt.Printf("Local IP: %s\n", network.GetLocalIP())
 			fmt.Printf("Connected peers: %d\n", len(server.Peers))
-			for addr := range server.Peers {
-				fmt.Printf("  - %s\n", addr)
+			for node, peer := range server.Peers {
+				fmt.Printf("  - %s (%s)\n", peer.RemoteAddr(), node)
+			}
+			if paths := server.PeerPaths(); len(paths) > 0 {
+				fmt.Println("Paths by node:")
+				for _, p := range paths {
+					preferred := ""
+					if p.Preferred {
+						preferred = " (preferred)"
+					}
+					protocol := ""
+					if p.Version > 0 {
+						protocol = fmt.Sprintf(" v%d", p.Version)
+						if len(p.Caps) > 0 {
+							protocol += " [" + strings.Join(p.Caps, ",") + "]"
+						}
+					}
+					if p.Suspect {
+						preferred += " (suspect)"
+					}
+					fmt.Printf("  %s  %-22s rtt %v%s%s\n", p.Node, p.Addr, p.RTT.Round(time.Microsecond), protocol, preferred)
+				}
 			}
 
 		case "list":
+			if len(parts) > 1 && parts[1] == "--network" {
+				files, err := server.ListNetworkFiles(ctx)
+				if err != nil {
+					fmt.Printf("Error listing network files: %v\n", err)
+					continue
+				}
+				if len(files) == 0 {
+					fmt.Println("No files found on the network")
+					continue
+				}
+
+				fmt.Printf("Files available on the network (%d files):\n", len(files))
+				printNetworkFiles(files)
+				continue
+			}
+
 			// List files stored on this node
 			files, err := server.ListFiles(server.ID)
 			if err != nil {
@@ -295,90 +1053,277 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 			}
 
 			fmt.Printf("Connected Peers (%d):\n", peerCount)
-			fmt.Println("┌───────────────────────────────┬─────────────┬────────────────┐")
-			fmt.Println("│ Address                       │ Status      │ Last Seen      │")
-			fmt.Println("├───────────────────────────────┼─────────────┼────────────────┤")
+			fmt.Println("┌──────────────────┬───────────────────────────────┬─────────────┐")
+			fmt.Println("│ Node             │ Address                       │ Status      │")
+			fmt.Println("├──────────────────┼───────────────────────────────┼─────────────┤")
 
-			for addr := range server.Peers {
-				addrDisplay := addr
+			for node, peer := range server.Peers {
+				addrDisplay := peer.RemoteAddr().String()
 				if len(addrDisplay) > 29 {
 					addrDisplay = addrDisplay[:26] + "..."
 				}
-				fmt.Printf("│ %-29s │ %-11s │ %-14s │\n", addrDisplay, "Connected", "Now")
+				fmt.Printf("│ %-16s │ %-29s │ %-11s │\n", node, addrDisplay, "Connected")
+			}
+			fmt.Println("└──────────────────┴───────────────────────────────┴─────────────┘")
+			server.PeerLock.Unlock()
+
+		case "peer":
+			if len(parts) < 2 {
+				fmt.Println("Usage: peer kick <peer> [ban_duration] | peer unban <peer_address> | peer bans | peer scores | peer find [text]")
+				continue
+			}
+			switch parts[1] {
+			case "kick":
+				if len(parts) < 3 {
+					fmt.Println("Usage: peer kick <peer> [ban_duration]")
+					fmt.Println("Example: peer kick 192.168.1.100:3000 24h")
+					continue
+				}
+				// Hosts that are not connected can still be banned by address
+				peerAddr, err := server.ResolvePeer(parts[2])
+				if errors.Is(err, network.ErrNoPeerMatch) {
+					peerAddr = parts[2]
+				} else if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				var banFor time.Duration
+				if len(parts) > 3 {
+					d, err := time.ParseDuration(parts[3])
+					if err != nil || d <= 0 {
+						fmt.Printf("Invalid ban duration: %s\n", parts[3])
+						continue
+					}
+					banFor = d
+				}
+				if err := server.KickPeer(peerAddr, banFor); err != nil {
+					fmt.Printf("Error kicking peer: %v\n", err)
+				} else if banFor > 0 {
+					fmt.Printf("Peer %s kicked and banned for %s\n", peerAddr, banFor)
+				} else {
+					fmt.Printf("Peer %s kicked\n", peerAddr)
+				}
+			case "unban":
+				if len(parts) < 3 {
+					fmt.Println("Usage: peer unban <peer_address>")
+					continue
+				}
+				server.UnbanPeer(parts[2])
+				fmt.Printf("Ban on %s lifted\n", parts[2])
+			case "find":
+				matches := server.MatchPeers(strings.Join(parts[2:], " "))
+				if len(matches) == 0 {
+					fmt.Println("No matching peers")
+					continue
+				}
+				for _, m := range matches {
+					fmt.Printf("  %-22s %-16s %s\n", m.Addr, m.Node, formatLabels(m.Labels))
+				}
+			case "bans":
+				bans := server.Bans()
+				lists := server.PeerLists()
+				if len(bans) == 0 && len(lists.Block) == 0 && len(lists.Allow) == 0 {
+					fmt.Println("No banned peers")
+					continue
+				}
+				if len(bans) > 0 {
+					fmt.Printf("Banned Peers (%d):\n", len(bans))
+					for host, until := range bans {
+						fmt.Printf("  - %s (%v left)\n", host, time.Until(until).Round(time.Second))
+					}
+				}
+				if len(lists.Block) > 0 {
+					fmt.Printf("Blocked Peers (%d):\n", len(lists.Block))
+					for _, entry := range lists.Block {
+						fmt.Printf("  - %s\n", entry)
+					}
+				}
+				if len(lists.Allow) > 0 {
+					fmt.Printf("Allowed Peers (%d, all others refused):\n", len(lists.Allow))
+					for _, entry := range lists.Allow {
+						fmt.Printf("  - %s\n", entry)
+					}
+				}
+			case "scores":
+				scores := server.PeerScores()
+				if len(scores) == 0 {
+					fmt.Println("No peer scores yet")
+					continue
+				}
+				fmt.Printf("Peer Scores (%d):\n", len(scores))
+				fmt.Printf("  %-22s %-16s %6s %11s %15s %7s\n", "ADDRESS", "NODE", "SCORE", "DIALS", "TRANSFERS", "CORRUPT")
+				for _, p := range scores {
+					fmt.Printf("  %-22s %-16s %6.1f %5d/%-5d %7d/%-7d %7d\n", p.Addr, shortID(p.Peer), p.Score,
+						p.Dials-p.DialFailures, p.Dials, p.Transfers-p.TransferFailures, p.Transfers, p.Corrupt)
+				}
+			default:
+				fmt.Printf("Unknown peer command: %s\n", parts[1])
+			}
+
+		case "ban":
+			if len(parts) < 2 {
+				fmt.Println("Usage: ban <address|node_id>")
+				continue
+			}
+			if err := server.BlockPeer(parts[1]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Blocked %s\n", parts[1])
+
+		case "unban":
+			if len(parts) < 2 {
+				fmt.Println("Usage: unban <address|node_id>")
+				continue
+			}
+			if err := server.UnblockPeer(parts[1]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Unblocked %s\n", parts[1])
+
+		case "allow":
+			if len(parts) < 2 {
+				fmt.Println("Usage: allow <address|node_id> | allow remove <address|node_id>")
+				continue
+			}
+			if parts[1] == "remove" {
+				if len(parts) < 3 {
+					fmt.Println("Usage: allow remove <address|node_id>")
+					continue
+				}
+				if err := server.DisallowPeer(parts[2]); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Printf("Removed %s from the allowlist\n", parts[2])
+				continue
 			}
-			fmt.Println("└───────────────────────────────┴─────────────┴────────────────┘")
-			server.PeerLock.Unlock()
+			if err := server.AllowPeer(parts[1]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Allowed %s, peers not on the allowlist are refused\n", parts[1])
 
 		case "send":
 			if len(parts) < 3 {
-				fmt.Println("Usage: send <filename> <peer_address>")
+				fmt.Println("Usage: send <filename> <peer>")
 				fmt.Println("Example: send myfile.txt 192.168.1.100:3000")
 				continue
 			}
 			filename := parts[1]
-			peerAddr := parts[2]
+			peerAddr, err := server.ResolvePeer(parts[2])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
 
-			server.PeerLock.Lock()
-			peer, exists := server.Peers[peerAddr]
-			server.PeerLock.Unlock()
+			if err := server.SendTo(peerAddr, filename); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("File '%s' offered to %s, see 'outbox' for its status\n", filename, peerAddr)
 
-			if !exists {
-				fmt.Printf("Peer %s not found. Use 'peers' command to see connected peers.\n", peerAddr)
+		case "outbox":
+			entries := server.Outbox()
+			if len(entries) == 0 {
+				fmt.Println("Outbox is empty")
 				continue
 			}
+			fmt.Printf("Files offered to peers (%d files):\n", len(entries))
+			for _, e := range entries {
+				status := e.Status
+				if e.Reason != "" {
+					status += ": " + e.Reason
+				}
+				fmt.Printf("  %-21s %-35s %-10s %s\n", e.Peer, e.Key, metrics.FormatBytes(e.Size), status)
+			}
 
-			// Read file from local storage
-			_, fileReader, err := server.ReadFile(server.ID, filename)
+		case "search":
+			if len(parts) < 2 {
+				fmt.Println("Usage: search <text>")
+				continue
+			}
+			files, err := server.SearchNetworkFiles(ctx, strings.Join(parts[1:], " "))
 			if err != nil {
-				fmt.Printf("Error reading file: %v\n", err)
+				fmt.Printf("Error searching network files: %v\n", err)
 				continue
 			}
-
-			if rc, ok := fileReader.(io.ReadCloser); ok {
-				defer rc.Close()
+			if len(files) == 0 {
+				fmt.Println("No matching files on the network")
+				continue
 			}
-
-			// Send directly to peer (simplified - you may want to use proper protocol)
-			fmt.Printf("Sending '%s' to %s...\n", filename, peerAddr)
-
-			// Notify peer about incoming file
-			msg := network.Message{
-				Payload: network.MessageStoreFile{
-					ID:   server.ID,
-					Key:  crypto.HashKey(filename),
-					Size: 0, // Size would need to be calculated
-				},
+			fmt.Printf("Matching files on the network (%d files):\n", len(files))
+			printNetworkFiles(files)
+
+		case "inbox":
+			if len(parts) == 3 && (parts[1] == "accept" || parts[1] == "reject") {
+				var err error
+				if parts[1] == "accept" {
+					err = server.AcceptOffer(parts[2])
+				} else {
+					err = server.RejectOffer(parts[2])
+				}
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Printf("Offer %s %sed\n", parts[2], parts[1])
+				continue
 			}
-
-			buf := new(bytes.Buffer)
-			if err := gob.NewEncoder(buf).Encode(&msg); err != nil {
-				fmt.Printf("Error encoding message: %v\n", err)
+			if len(parts) >= 4 && parts[1] == "get" {
+				reader, err := server.GetDropped(ctx, parts[2], parts[3])
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					fmt.Printf("Error reading file: %v\n", err)
+					continue
+				}
+				fmt.Printf("File content: %s\n", string(data))
 				continue
 			}
-
-			peer.Send([]byte{p2p.IncomingMessage})
-			if err := peer.Send(buf.Bytes()); err != nil {
-				fmt.Printf("Error sending to peer: %v\n", err)
+			if len(parts) > 1 && parts[1] != "list" {
+				fmt.Println("Usage: inbox [list | accept <id> | reject <id> | get <node> <filename>]")
 				continue
 			}
 
-			fmt.Printf("File '%s' sent to %s\n", filename, peerAddr)
+			offers := server.Offers()
+			files, err := server.Inbox()
+			if err != nil {
+				fmt.Printf("Error listing inbox: %v\n", err)
+				continue
+			}
+			if len(offers) == 0 && len(files) == 0 {
+				fmt.Println("Inbox is empty")
+				continue
+			}
+			if len(offers) > 0 {
+				fmt.Printf("Pending offers (%d files):\n", len(offers))
+				for _, o := range offers {
+					fmt.Printf("  %s  %-21s %-35s %s\n", o.ID, o.Peer, o.Key, metrics.FormatBytes(o.Size))
+				}
+			}
+			if len(files) == 0 {
+				continue
+			}
+			fmt.Printf("Files sent to this node (%d files):\n", len(files))
+			for _, file := range files {
+				fmt.Printf("  %s  %-35s %s\n", file.NodeID, file.Key, metrics.FormatBytes(file.Size))
+			}
 
 		case "fetch":
 			if len(parts) < 3 {
-				fmt.Println("Usage: fetch <filename> <peer_address>")
+				fmt.Println("Usage: fetch <filename> <peer>")
 				fmt.Println("Example: fetch myfile.txt 192.168.1.100:3000")
 				continue
 			}
 			filename := parts[1]
-			peerAddr := parts[2]
-
-			server.PeerLock.Lock()
-			_, exists := server.Peers[peerAddr]
-			server.PeerLock.Unlock()
-
-			if !exists {
-				fmt.Printf("Peer %s not found. Use 'peers' command to see connected peers.\n", peerAddr)
+			peerAddr, err := server.ResolvePeer(parts[2])
+			if err != nil {
+				fmt.Printf("Error: %v. Use 'peer find' to see connected peers.\n", err)
 				continue
 			}
 
@@ -391,46 +1336,239 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 				continue
 			}
 
-			// Display file contents
-			data, err := io.ReadAll(reader)
+			// Display the start of the file, without holding large files in memory
+			preview := make([]byte, 500)
+			n, err := io.ReadFull(reader, preview)
+			var rest int64
+			if err == nil {
+				rest, err = io.Copy(io.Discard, reader)
+			} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
 			if err != nil {
 				fmt.Printf("Error reading file data: %v\n", err)
 				continue
 			}
 
-			fmt.Printf("File '%s' fetched successfully (%d bytes)\n", filename, len(data))
-			if len(data) < 500 {
-				fmt.Printf("Contents: %s\n", string(data))
+			fmt.Printf("File '%s' fetched successfully (%d bytes)\n", filename, int64(n)+rest)
+			if rest == 0 {
+				fmt.Printf("Contents: %s\n", string(preview[:n]))
 			} else {
-				fmt.Printf("Contents (first 500 bytes): %s...\n", string(data[:500]))
+				fmt.Printf("Contents (first 500 bytes): %s...\n", string(preview))
 			}
 
 		case "clean":
-			fmt.Print("Are you sure you want to delete all local files? (y/N): ")
-			if !scanner.Scan() {
+			scope, withKeys, force, valid := network.ClearFiles, false, false, true
+			for _, arg := range parts[1:] {
+				switch arg {
+				case "files":
+					scope = network.ClearFiles
+				case "all":
+					scope = network.ClearAll
+				case "--keys":
+					withKeys = true
+				case "--force":
+					force = true
+				default:
+					valid = false
+				}
+			}
+			if !valid || (withKeys && scope != network.ClearAll) {
+				fmt.Println("Usage: clean [files|all [--keys]] [--force]")
+				continue
+			}
+			if len(server.Holds()) > 0 {
+				fmt.Println("Cannot clean while legal holds are in place (see 'hold list')")
 				continue
 			}
-			confirmation := strings.TrimSpace(strings.ToLower(scanner.Text()))
-			if confirmation == "y" || confirmation == "yes" {
-				// First stop the server to close any open files
-				server.Stop()
-				time.Sleep(500 * time.Millisecond) // Give time for cleanup
 
-				err := server.ClearStorage()
-				if err != nil {
-					fmt.Printf("Error cleaning storage: %v\n", err)
-				} else {
-					fmt.Println("Local storage cleaned successfully")
-					// Clear the key mapping as well
-					server.ClearKeyMapping()
+			what, phrase := "every stored file and its metadata", "delete files"
+			switch {
+			case withKeys:
+				what, phrase = "everything in "+server.StorageRoot+", including this node's identity and keys", "delete all and keys"
+			case scope == network.ClearAll:
+				what, phrase = "everything in "+server.StorageRoot+" except this node's identity and keys", "delete all"
+			}
+			fmt.Printf("This deletes %s.\n", what)
+			if withKeys {
+				fmt.Println("The node will come back as a new identity: peers, trusted lists and API clients will not recognize it.")
+			}
+			if !force {
+				fmt.Printf("Type '%s' to confirm: ", phrase)
+				if !scanner.Scan() {
+					continue
 				}
+				if strings.TrimSpace(scanner.Text()) != phrase {
+					fmt.Println("Clean operation cancelled")
+					continue
+				}
+			}
+
+			// First stop the server to close any open files
+			server.Stop()
+			time.Sleep(500 * time.Millisecond) // Give time for cleanup
 
-				fmt.Println("Server stopped. Please restart to continue.")
-				return
+			if err := server.ClearStorage(scope, withKeys); err != nil {
+				fmt.Printf("Error cleaning storage: %v\n", err)
 			} else {
-				fmt.Println("Clean operation cancelled")
+				fmt.Println("Local storage cleaned successfully")
 			}
 
+			fmt.Println("Server stopped. Please restart to continue.")
+			return
+
+		case "guest":
+			if len(parts) < 3 {
+				fmt.Println("Usage: guest <duration> <guest identity>")
+				fmt.Println("The guest reads its identity with: peervault key identity")
+				continue
+			}
+			ttl, err := time.ParseDuration(parts[1])
+			if err != nil {
+				fmt.Printf("Invalid duration: %v\n", err)
+				continue
+			}
+			token, err := server.IssueGuestToken(parts[2], ttl)
+			if err != nil {
+				fmt.Printf("Error issuing guest token: %v\n", err)
+				continue
+			}
+			fmt.Printf("Guest token for %s (valid until %s):\n%s\n", parts[2], time.Now().Add(ttl).Format("2006-01-02 15:04"), token)
+			fmt.Println("Only that node can use it. Members that do not list this node's key in -guest-issuers refuse it.")
+			fmt.Println("The guest joins with: peervault -guest-token <token> -bootstrap <this node>")
+
+		case "device":
+			if server.DevicePublicKey() == nil {
+				fmt.Println("Device keys are disabled, start with -device-keys")
+				continue
+			}
+			if len(parts) >= 3 && parts[1] == "authorize" {
+				publicKey, err := hex.DecodeString(parts[2])
+				if err != nil {
+					fmt.Printf("Invalid device key: %v\n", err)
+					continue
+				}
+				name := strings.Join(parts[3:], " ")
+				if err := server.AuthorizeDevice(publicKey, name); err != nil {
+					fmt.Printf("Error authorizing device: %v\n", err)
+					continue
+				}
+				fmt.Printf("Device %s authorized. Its file keys are sent when it connects.\n", crypto.Fingerprint(publicKey))
+				continue
+			}
+			if len(parts) > 1 {
+				fmt.Println("Usage: device [authorize <key> [name]]")
+				continue
+			}
+			fmt.Printf("This device: %s\n", hex.EncodeToString(server.DevicePublicKey()))
+			fmt.Println("Authorized devices:")
+			for _, d := range server.Devices() {
+				fmt.Printf("  %s  %-16s added %s\n", crypto.Fingerprint(d.PublicKey), d.Name, d.Added.Format("2006-01-02 15:04"))
+			}
+
+		case "gc":
+			if server.GC == nil {
+				fmt.Println("Garbage collection is disabled")
+				continue
+			}
+			if len(parts) > 1 && parts[1] == "run" {
+				fmt.Println("Running garbage collection...")
+				if _, err := server.GC.RunNow(nil); err != nil {
+					fmt.Printf("Garbage collection finished with errors: %v\n", err)
+				}
+			}
+			interval, delay := server.GC.Schedule()
+			fmt.Printf("Schedule: every %s, first run %s after start\n", interval, delay)
+			report, ok := server.GC.LastRun()
+			if !ok {
+				fmt.Println("No garbage collection run yet")
+				continue
+			}
+			fmt.Printf("Last run: %s, took %s\n", report.Started.Local().Format(time.RFC3339), report.Duration.Round(time.Millisecond))
+			counts := report.Stats.Counts()
+			for _, name := range []string{"checked", "unchecked", "corrupted", "missing", "repaired", "orphaned", "pruned", "expired", "purged", "removed"} {
+				fmt.Printf("  %-10s %d\n", name+":", counts[name])
+			}
+			if report.Err != "" {
+				fmt.Printf("  errors:    %s\n", report.Err)
+			}
+			quarantined, err := server.Quarantined()
+			if err != nil {
+				fmt.Printf("Error listing quarantine: %v\n", err)
+				continue
+			}
+			if len(quarantined) > 0 {
+				fmt.Println("Quarantined:")
+			}
+			for _, e := range quarantined {
+				key := e.Key
+				if key == "" {
+					key = e.Hash
+				}
+				fmt.Printf("  %s  since %s, %d failed repairs\n", key, e.Quarantined.Local().Format("2006-01-02 15:04"), e.Attempts)
+			}
+
+		case "maintenance":
+			count := 10
+			switch {
+			case len(parts) == 1:
+			case parts[1] == "runs" && len(parts) <= 3:
+				if len(parts) == 3 {
+					n, err := strconv.Atoi(parts[2])
+					if err != nil || n <= 0 {
+						fmt.Println("Usage: maintenance runs [n]")
+						continue
+					}
+					count = n
+				}
+			case parts[1] == "show" && len(parts) == 3:
+				run, ok := server.MaintenanceRunByID(parts[2])
+				if !ok {
+					fmt.Printf("No maintenance run %s\n", parts[2])
+					continue
+				}
+				data, _ := json.MarshalIndent(run, "", "  ")
+				fmt.Println(string(data))
+				continue
+			case len(parts) == 2:
+				run, err := server.StartMaintenance(parts[1])
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+				fmt.Printf("Started %s as run %s, see 'maintenance show %s'\n", run.Op, run.ID, run.ID)
+				continue
+			default:
+				fmt.Println("Usage: maintenance [gc|scrub|repair|rebalance | runs [n] | show <id>]")
+				continue
+			}
+
+			runs := server.MaintenanceRuns(count)
+			if len(runs) == 0 {
+				fmt.Println("No maintenance runs")
+				continue
+			}
+			for _, r := range runs {
+				fmt.Printf("  %s  %-9s %-7s %s  %d/%d", r.ID, r.Op, r.Status,
+					r.Started.Local().Format("2006-01-02 15:04:05"), r.Done, r.Total)
+				for _, k := range slices.Sorted(maps.Keys(r.Result)) {
+					fmt.Printf(" %s=%d", k, r.Result[k])
+				}
+				fmt.Println()
+				if r.Error != "" {
+					fmt.Printf("            %s\n", r.Error)
+				}
+			}
+
+		case "doctor":
+			fmt.Println("Running diagnostics...")
+			printFindings(doctor.Run(ctx, doctorOpts))
+
+		case "restart":
+			fmt.Println("Restarting...")
+			restart()
+			return
+
 		case "quit", "exit":
 			fmt.Println("Shutting down...")
 			server.Stop()
@@ -447,8 +1585,29 @@ func interactiveMode(ctx context.Context, server *network.FileServer) {
 func main() {
 	cfg, err := LoadConfig()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
-		os.Exit(1)
+		fatal(failConfig, "Error loading configuration", err)
+	}
+
+	if cfg.InitPath != "" {
+		if err := runInit(cfg, cfg.InitPath, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(cfg.KeyCommand) > 0 {
+		if err := runKey(cfg, cfg.KeyCommand, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Key command failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.VerifyPeer != "" {
+		if err := runVerifyPeer(cfg, cfg.VerifyPeer, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// Initialize structured logger
@@ -459,32 +1618,41 @@ func main() {
 
 	// Get encryption key from config
 	var networkKey []byte
-	if cfg.EncKey == "" {
-		slogLogger.Error("-key is required. Generate one with: openssl rand -hex 32")
-		os.Exit(1)
+	if cfg.GuestToken != "" {
+		// Guests get their data key and the network ID from their token.
+		// An expired token is refused when the server is created, which
+		// purges the data cached during the visit.
+		grant, err := network.ParseGuestToken(cfg.GuestToken)
+		if err != nil && !errors.Is(err, network.ErrGuestExpired) {
+			fatal(failKey, "Invalid guest token", err)
+		}
+		cfg.EncKey = hex.EncodeToString(grant.Key)
+		cfg.NetworkID = grant.NetworkID
+		slogLogger.Info("Joining as a read-only guest", "until", grant.Expires.Local().Format(time.RFC3339))
 	}
-	keySource := cfg.EncKey
-
-	// If key is 64 characters of hex, decode it to 32 bytes
-	if len(keySource) == 64 {
-		decoded, err := hex.DecodeString(keySource)
-		if err == nil {
-			networkKey = decoded
-		} else {
-			networkKey = []byte(keySource)
+	if cfg.EncKey == "" {
+		key, err := keyFromKeyring(cfg)
+		if err != nil {
+			fatal(failKey, "Failed to unlock the keyring", err)
 		}
-	} else {
-		networkKey = []byte(keySource)
+		if key == nil {
+			fatal(failKey, "-key is required. Keep it in a keyring with: peervault key init, or set up the node with: peervault init", nil)
+		}
+		cfg.EncKey = hex.EncodeToString(key)
+	} else if cfg.KeyFromFlag {
+		slogLogger.Warn("The network key given with -key is visible to other users in the process list; keep it in a keyring instead with: peervault key import")
 	}
-
-	// Ensure key is exactly 32 bytes for AES-256
-	if len(networkKey) != 32 {
-		slogLogger.Error("invalid key size", "size", len(networkKey))
-		os.Exit(1)
+	// 64 hex digits, or 32 bytes as they are for AES-256
+	key, err := parseNetworkKey(cfg.EncKey)
+	if err != nil {
+		fatal(failKey, "Invalid key size", err)
 	}
+	networkKey = key
 
-	// Determine advertise address
+	// Determine advertise address. A detected public IP is cached and
+	// checked again while the node runs.
 	var finalAdvertiseAddr string
+	var publicIP *network.PublicIPDetector
 	if cfg.AdvertiseAddr != "" {
 		// Use explicitly provided advertise address
 		finalAdvertiseAddr = cfg.AdvertiseAddr
@@ -492,15 +1660,22 @@ func main() {
 	} else if cfg.DetectPublicIP {
 		// Auto-detect public IP
 		slogLogger.Info("Detecting public IP address...")
-		publicIP, err := network.GetPublicIP()
+		publicIP = network.NewPublicIPDetector(network.PublicIPOpts{
+			Services:  cfg.PublicIPServices,
+			Timeout:   cfg.PublicIPTimeout,
+			Retries:   cfg.PublicIPRetries,
+			TTL:       cfg.PublicIPTTL,
+			CachePath: filepath.Join(storageRootFor(cfg), "publicip.json"),
+		})
+		ip, err := publicIP.Get(context.Background())
 		if err != nil {
 			slogLogger.Warn("Failed to detect public IP", "err", err)
 			slogLogger.Info("Falling back to local IP")
 			localIP := network.GetLocalIP()
 			finalAdvertiseAddr, _ = network.BuildAdvertiseAddr(localIP, cfg.ListenAddr)
 		} else {
-			slogLogger.Info("Detected public IP", "ip", publicIP)
-			finalAdvertiseAddr, _ = network.BuildAdvertiseAddr(publicIP, cfg.ListenAddr)
+			slogLogger.Info("Detected public IP", "ip", ip)
+			finalAdvertiseAddr, _ = network.BuildAdvertiseAddr(ip, cfg.ListenAddr)
 		}
 	} else {
 		// Use local IP as default
@@ -508,8 +1683,22 @@ func main() {
 		finalAdvertiseAddr, _ = network.BuildAdvertiseAddr(localIP, cfg.ListenAddr)
 	}
 
+	// Pick up the listening socket if the node was restarted in place
+	listener, err := inheritedListener()
+	if err != nil {
+		slogLogger.Warn("Failed to inherit listener, binding a new one", "err", err)
+	} else if listener != nil {
+		slogLogger.Info("Inherited listener from before the restart", "addr", listener.Addr().String())
+	}
+
 	// Create and start server
-	server := makeServer(cfg.ListenAddr, networkKey, slogLogger, cfg.FetchTimeout, cfg.PexInterval, cfg.GCInterval, cfg.GCDelay, cfg.Bootstrap...)
+	server, err := makeServer(cfg, networkKey, slogLogger, listener, finalAdvertiseAddr, publicIP)
+	if errors.Is(err, network.ErrGuestExpired) {
+		fatal(failKey, "Invalid guest token", err)
+	}
+	if err != nil {
+		fatal(failConfig, "Failed to create server", err)
+	}
 
 	// Determine override quota
 	var initialQuota int64
@@ -517,44 +1706,27 @@ func main() {
 	if quotaStr != "" {
 		bytes, err := quota.ParseStorageSize(quotaStr)
 		if err != nil {
-			slogLogger.Error("Invalid quota format", "err", err)
-			os.Exit(1)
+			fatal(failConfig, "Invalid quota format", err)
 		}
 		initialQuota = bytes
 	}
 
-	// Initialize quota manager and load/create configuration
+	// Initialize quota manager and load its configuration. Startup never
+	// prompts: without a saved quota the -quota flag or the default is used.
 	slogLogger.Info("Initializing storage quota...")
-	if err := server.QuotaManager.LoadOrCreate(); err != nil {
-		// If load/create failed (e.g. because of non-interactive stdin prompt)
-		if initialQuota > 0 {
-			server.QuotaManager.SetMaxStorage(initialQuota)
-			if err := server.QuotaManager.Save(); err != nil {
-				slogLogger.Error("Failed to save quota config", "err", err)
-				os.Exit(1)
-			}
-		} else {
-			// Check if we are headless/non-interactive
-			if !isTerminal(os.Stdin) {
-				slogLogger.Info("Headless/non-interactive startup detected. Using default 10GB storage quota.")
-				server.QuotaManager.SetMaxStorage(10 * 1024 * 1024 * 1024) // 10GB
-				if err := server.QuotaManager.Save(); err != nil {
-					slogLogger.Error("Failed to save default quota config", "err", err)
-					os.Exit(1)
-				}
-			} else {
-				slogLogger.Error("Failed to initialize quota", "err", err)
-				os.Exit(1)
-			}
+	if err := server.QuotaManager.Load(); errors.Is(err, quota.ErrNotConfigured) {
+		if initialQuota == 0 {
+			initialQuota = quota.DefaultMaxStorage
+			slogLogger.Info("No storage quota configured, using the default. Set -quota or run peervault init to choose one.")
 		}
-	} else if initialQuota > 0 {
-		// If it loaded successfully but user specified an override quota flag, update it
+	} else if err != nil {
+		fatal(failStorage, "Failed to load quota config", err)
+	}
+	if initialQuota > 0 {
 		server.QuotaManager.SetMaxStorage(initialQuota)
 		if err := server.QuotaManager.Save(); err != nil {
-			slogLogger.Error("Failed to update quota config", "err", err)
-			os.Exit(1)
+			fatal(failStorage, "Failed to save quota config", err)
 		}
-		slogLogger.Info("Storage quota updated", "quota", metrics.FormatBytes(initialQuota))
 	}
 	slogLogger.Info("Storage quota configured", "quota", metrics.FormatBytes(server.QuotaManager.GetMaxStorage()))
 
@@ -562,6 +1734,24 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// SIGHUP (or the interactive restart command) restarts the node in place
+	var restartRequested atomic.Bool
+	restart := func() {
+		restartRequested.Store(true)
+		stop()
+	}
+	hupch := make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+	defer signal.Stop(hupch)
+	go func() {
+		select {
+		case <-hupch:
+			slogLogger.Info("Received SIGHUP, restarting in place")
+			restart()
+		case <-ctx.Done():
+		}
+	}()
+
 	// Enable peer discovery if requested
 	if cfg.DiscoverLocal {
 		slogLogger.Info("Enabling local network discovery (mDNS)...")
@@ -575,10 +1765,55 @@ func main() {
 		server.EnablePeerExchange(ctx)
 	}
 
+	// Export traces if a collector is configured
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Options{
+		Endpoint: cfg.OTLPEndpoint,
+		Insecure: cfg.OTLPInsecure,
+		NodeID:   server.ID,
+	})
+	if err != nil {
+		slogLogger.Warn("Tracing disabled", "err", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
 	// Start metrics server if enabled
 	var metricsServer *metrics.MetricsServer
+	if cfg.Pprof && cfg.MetricsAddr == "" {
+		slogLogger.Warn("Profiling needs the metrics server, set -metrics to enable it")
+	}
+	if cfg.Admin && cfg.MetricsAddr == "" {
+		slogLogger.Warn("Admin endpoints need the metrics server, set -metrics to enable them")
+	}
 	if cfg.MetricsAddr != "" {
 		metricsServer = metrics.NewMetricsServer(cfg.MetricsAddr, server.Metrics)
+		metricsServer.ServeTopology(func() metrics.Graph { return server.Topology() })
+		for name, check := range server.ReadyChecks(cfg.MinReadyPeers) {
+			metricsServer.AddReadyCheck(name, check)
+		}
+		if cfg.MetricsUser != "" {
+			if cfg.MetricsPassword == "" {
+				fatal(failConfig, "-metrics-user needs -metrics-password", nil)
+			}
+			metricsServer.RequireBasicAuth(cfg.MetricsUser, cfg.MetricsPassword)
+		}
+		if cfg.MetricsToken != "" {
+			metricsServer.RequireToken(cfg.MetricsToken)
+		}
+		if (cfg.MetricsTLSCert == "") != (cfg.MetricsTLSKey == "") {
+			fatal(failConfig, "-metrics-tls-cert and -metrics-tls-key go together", nil)
+		}
+		if cfg.MetricsTLSCert != "" {
+			metricsServer.UseTLS(cfg.MetricsTLSCert, cfg.MetricsTLSKey)
+		}
+		if metricsServer.Exposed() {
+			slogLogger.Warn("The metrics server is reachable from other hosts without authentication, set -metrics-token or -metrics-user", "addr", metricsServer.Addr())
+		}
+		if cfg.Pprof {
+			metricsServer.EnableProfiling()
+		}
+		if cfg.Admin {
+			metricsServer.ServeAdmin(server.MaintenanceHandler())
+		}
 		go func() {
 			if err := metricsServer.Start(); err != nil && err != http.ErrServerClosed {
 				slogLogger.Error("Metrics server error", "err", err)
@@ -586,7 +1821,72 @@ func main() {
 		}()
 	}
 
-	// Start server in background
+	// Serve the API to peervault-cli on the local socket, and over TCP if enabled
+	apiKeys, err := grpcapi.OpenKeyStore(server)
+	if err != nil {
+		fatal(failStorage, "Failed to load API keys", err)
+	}
+	var grpcServer *grpcapi.Server
+	if cfg.Socket != "" || cfg.GRPCAddr != "" {
+		grpcServer = grpcapi.NewServer(server, slogLogger)
+		grpcServer.UseKeys(apiKeys, cfg.RequireAPIKey)
+	}
+	if cfg.Socket != "" {
+		if lis, err := grpcapi.ListenSocket(cfg.Socket); err != nil {
+			slogLogger.Warn("Cannot listen on API socket, peervault-cli will not reach this node", "socket", cfg.Socket, "err", err)
+		} else {
+			go func() {
+				if err := grpcServer.Serve(lis); err != nil {
+					slogLogger.Error("gRPC API server error", "err", err)
+				}
+			}()
+		}
+	}
+	if cfg.GRPCAddr != "" {
+		go func() {
+			if err := grpcServer.ListenAndServe(cfg.GRPCAddr); err != nil {
+				slogLogger.Error("gRPC API server error", "err", err)
+			}
+		}()
+	}
+
+	// Serve the vault over WebDAV if enabled, with the same API keys
+	var davServer *dav.Server
+	if cfg.WebDAVAddr != "" {
+		davServer = dav.NewServer(cfg.WebDAVAddr, server, dav.Options{Keys: apiKeys, RequireKey: cfg.RequireAPIKey, Logger: slogLogger})
+		go func() {
+			if err := davServer.Start(); err != nil && err != http.ErrServerClosed {
+				slogLogger.Error("WebDAV server error", "err", err)
+			}
+		}()
+	}
+
+	// The server outlives the signal context, so Shutdown can drain it
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+
+	// Alerts are evaluated on the metrics, which need no metrics server
+	if len(cfg.AlertWebhooks) > 0 && cfg.AlertWebhooks[0] != "" {
+		errorRate := cfg.AlertErrorRate
+		if errorRate == 0 {
+			errorRate = 10
+		}
+		node := finalAdvertiseAddr
+		if node == "" {
+			node = cfg.ListenAddr
+		}
+		alerter := metrics.NewAlerter(server.Metrics, metrics.AlertOptions{
+			Webhooks:        cfg.AlertWebhooks,
+			StoragePercent:  cfg.QuotaWarning,
+			ErrorsPerMinute: errorRate,
+			Node:            node,
+			Logger:          slogLogger,
+		})
+		go alerter.Start(runCtx, server.MetricsInterval)
+	}
+
+	// Start server in background. It fails right away if it cannot listen.
+	startErr := make(chan error, 1)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -598,21 +1898,86 @@ func main() {
 			"bootstrap", cfg.Bootstrap,
 		)
 
-		if err := server.Start(ctx); err != nil && err != context.Canceled {
-			slogLogger.Error("Server stopped with error", "err", err)
+		if err := server.Start(runCtx); err != nil && err != context.Canceled {
+			startErr <- err
+		}
+	}()
+
+	// A guest node stops on its own once its access expires and has purged
+	// its data. The interactive prompt may be blocked on input, so exit here.
+	go func() {
+		select {
+		case <-server.Done():
+			if server.IsGuest() && !time.Now().Before(server.GuestUntil()) {
+				slogLogger.Warn("Guest access expired, cached data purged. Exiting.")
+				os.Exit(0)
+			}
+		case <-ctx.Done():
 		}
 	}()
 
 	// Give server time to start
 	select {
 	case <-time.After(2 * time.Second):
+	case err := <-startErr:
+		fatal(failStartup, "Failed to start server", err)
 	case <-ctx.Done():
 	}
 
+	// Expose the stored files as a filesystem if requested
+	var unmount func() error
+	if cfg.Mount != "" && ctx.Err() == nil {
+		if unmount, err = mount.Mount(server, cfg.Mount, mount.Options{Logger: slogLogger}); err != nil {
+			slogLogger.Error("Failed to mount vault", "mountpoint", cfg.Mount, "err", err)
+		} else {
+			fmt.Printf("Vault mounted at %s\n", cfg.Mount)
+		}
+	}
+
+	// Keep a local directory stored if requested
+	if cfg.SyncDir != "" && ctx.Err() == nil {
+		if syncer, err := dirsync.New(server, cfg.SyncDir, dirsync.Options{Prefix: cfg.SyncPrefix, Logger: slogLogger}); err != nil {
+			slogLogger.Error("Failed to sync directory", "dir", cfg.SyncDir, "err", err)
+		} else {
+			go func() {
+				if err := syncer.Run(ctx); err != nil {
+					slogLogger.Error("Directory sync stopped", "dir", cfg.SyncDir, "err", err)
+				}
+			}()
+			fmt.Printf("Syncing %s\n", cfg.SyncDir)
+		}
+	}
+
+	port, _ := network.ParseListenAddr(cfg.ListenAddr)
+	doctorOpts := doctor.Options{
+		Server:        server,
+		Key:           networkKey,
+		KeyHex:        len(cfg.EncKey) == 64,
+		Discovery:     cfg.DiscoverLocal,
+		GRPCAddr:      cfg.GRPCAddr,
+		WebDAVAddr:    cfg.WebDAVAddr,
+		RequireAPIKey: cfg.RequireAPIKey,
+	}
+	doctorOpts.Port, _ = strconv.Atoi(port)
+	doctorFailed := false
+
 	if ctx.Err() == nil {
-		if cfg.Interactive {
+		if cfg.Doctor {
+			// Hellos, and the clock readings in their echoes, need a moment
+			select {
+			case <-time.After(3 * time.Second):
+			case <-ctx.Done():
+			}
+			fmt.Println("Running diagnostics...")
+			findings := doctor.Run(ctx, doctorOpts)
+			printFindings(findings)
+			for _, f := range findings {
+				doctorFailed = doctorFailed || f.Status == doctor.Fail
+			}
+			stop()
+		} else if cfg.Interactive {
 			// Interactive mode
-			interactiveMode(ctx, server)
+			interactiveMode(ctx, server, apiKeys, doctorOpts, restart)
 			stop() // Signal loop cancellation on exit
 		} else if cfg.Demo {
 			// Demo mode - store and retrieve some test files
@@ -662,26 +2027,114 @@ func main() {
 		}
 	}
 
-	slogLogger.Info("Shutting down PeerVault server...")
-	server.Stop()
-	if metricsServer != nil {
-		metricsServer.Stop()
+	// Keep a copy of the listening socket before shutting down. Connections
+	// arriving in between queue on it until the new process accepts them.
+	var listenerFile *os.File
+	if restartRequested.Load() {
+		if tcpTransport, ok := server.Transport.(*p2p.TCPTransport); ok {
+			if listenerFile, err = tcpTransport.ListenerFile(); err != nil {
+				slogLogger.Warn("Cannot hand over listener, new process will rebind", "err", err)
+			}
+		}
 	}
-	if server.Discovery != nil {
-		server.Discovery.Stop()
+
+	// A second interrupt while transfers drain kills the process
+	stop()
+
+	slogLogger.Info("Shutting down PeerVault server...", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if unmount != nil {
+		if err := unmount(); err != nil {
+			slogLogger.Warn("Failed to unmount vault", "mountpoint", cfg.Mount, "err", err)
+		}
+	}
+	if davServer != nil {
+		davServer.Stop()
 	}
-	if server.Pex != nil {
-		server.Pex.Stop()
+	if grpcServer != nil {
+		grpcServer.Stop(shutdownCtx)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slogLogger.Warn("In-flight transfers were cut off", "err", err)
+	}
+	cancelShutdown()
+	cancelRun()
+	if metricsServer != nil {
+		metricsServer.Stop()
 	}
 
 	wg.Wait()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slogLogger.Warn("Failed to flush traces", "err", err)
+	}
+	cancelFlush()
 	slogLogger.Info("PeerVault server cleanly shut down.")
+
+	if restartRequested.Load() {
+		slogLogger.Info("Restarting PeerVault", "pid", os.Getpid())
+		if err := restartProcess(listenerFile); err != nil {
+			slogLogger.Error("Failed to restart", "err", err)
+			os.Exit(1)
+		}
+	}
+	if doctorFailed {
+		os.Exit(1)
+	}
 }
 
-func isTerminal(f *os.File) bool {
-	stat, err := f.Stat()
-	if err != nil {
-		return false
+// printFindings shows the results of the doctor checks with what to do
+// about each problem
+func printFindings(findings []doctor.Finding) {
+	for _, f := range findings {
+		fmt.Printf("  [%-4s] %-18s %s\n", f.Status, f.Check, f.Detail)
+		if f.Advice != "" {
+			fmt.Printf("  %-25s -> %s\n", "", f.Advice)
+		}
+	}
+}
+
+// printNetworkFiles shows files available on the network as a table
+func printNetworkFiles(files []network.NetworkFile) {
+	fmt.Println("┌─────────────────────────────────────┬─────────────┬──────────┬─────────┐")
+	fmt.Println("│ Filename                            │ Size (bytes)│ Hash     │ Holders │")
+	fmt.Println("├─────────────────────────────────────┼─────────────┼──────────┼─────────┤")
+	for _, file := range files {
+		filename := file.Key
+		if len(filename) > 35 {
+			filename = filename[:32] + "..."
+		}
+		hashShort := file.Hash
+		if len(hashShort) > 8 {
+			hashShort = hashShort[:8]
+		}
+		fmt.Printf("│ %-35s │ %11d │ %-8s │ %7d │\n", filename, file.Size, hashShort, len(file.Holders))
+	}
+	fmt.Println("└─────────────────────────────────────┴─────────────┴──────────┴─────────┘")
+}
+
+// formatLabels shows node labels as key=value pairs in a stable order
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// operatorName identifies the local user in the audit log
+func operatorName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
 	}
-	return (stat.Mode() & os.ModeCharDevice) != 0
+	return "unknown"
 }
+
+// shortID abbreviates a node ID for display
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDEnv tells a restarted process which file descriptor holds the
+// listening socket kept from before the restart.
+const listenFDEnv = "PEERVAULT_LISTEN_FD"
+
+// inheritedListener returns the listener kept across a restart, or nil if
+// this is a fresh start.
+func inheritedListener() (net.Listener, error) {
+	value := os.Getenv(listenFDEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", listenFDEnv, value, err)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// restartEnv returns the environment of the restarted program, without a
+// listener handed to this one
+func restartEnv() []string {
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, listenFDEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,33 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// restartProcess starts a new copy of the current executable with the same
+// arguments, for the caller to exit after. Processes cannot be replaced in
+// place on this platform, so the new one gets another PID and binds the
+// port itself; listener is closed.
+func restartProcess(listener *os.File) error {
+	if listener != nil {
+		listener.Close()
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate executable: %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = restartEnv()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", exe, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// restartProcess replaces the running process with a new copy of the
+// current executable, started with the same arguments. The PID stays the
+// same, so a supervisor such as systemd keeps tracking the node, and the
+// terminal stays with it. The executable is looked up again, so a binary
+// replaced on disk is picked up. The listening socket is kept open across
+// the exec so peers can reconnect immediately; if listener is nil, the new
+// program binds the port itself. It only returns if the exec failed.
+func restartProcess(listener *os.File) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate executable: %w", err)
+	}
+
+	env := restartEnv()
+	if listener != nil {
+		// Go opens every file close-on-exec, so clear the flag on this one
+		fd := listener.Fd()
+		if _, err := unix.FcntlInt(fd, unix.F_SETFD, 0); err != nil {
+			return fmt.Errorf("keep listener open: %w", err)
+		}
+		env = append(env, fmt.Sprintf("%s=%d", listenFDEnv, fd))
+	}
+
+	if err := syscall.Exec(exe, os.Args, env); err != nil {
+		return fmt.Errorf("exec %s: %w", exe, err)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"os"
 )
 
 // GenerateID generates unique identifiers safely, returning an error on entropy failure.
@@ -37,9 +38,9 @@ func NewEncryptionKey() ([]byte, error) {
 }
 
 // Copies data from a (src) to a (dst) while applying a stream cipher
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int64, error) {
 	buf := make([]byte, 32*1024)
-	nw := blockSize
+	nw := int64(blockSize)
 
 	for {
 		n, err := src.Read(buf)
@@ -49,7 +50,7 @@ func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Write
 			if err != nil {
 				return 0, err
 			}
-			nw += nn
+			nw += int64(nn)
 		}
 		if err == io.EOF {
 			break
@@ -62,6 +63,35 @@ func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Write
 	return nw, nil
 }
 
+// rewindable returns src as a reader that can seek back to where it starts.
+// Readers that cannot seek, such as network streams, are first copied to a
+// temporary file, which the returned cleanup function removes.
+func rewindable(src io.Reader) (io.ReadSeeker, int64, func(), error) {
+	if rs, ok := src.(io.ReadSeeker); ok {
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			return rs, start, func() {}, nil
+		}
+	}
+
+	f, err := os.CreateTemp("", "peervault-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, 0, cleanup, nil
+}
+
 func hmacKey(key []byte) []byte {
 	h := sha256.New()
 	h.Write(key)
@@ -69,95 +99,318 @@ func hmacKey(key []byte) []byte {
 	return h.Sum(nil)
 }
 
-// CopyDecrypt decrypts data from src and writes the decrypted data to dst
-// Used to decrypt data that was encrypted using CopyEncrypt
-func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+// verify reads data encrypted with CopyEncrypt to its end and checks its
+// MAC, or each of its frames, returning its suite and the contents of its
+// IV slot
+func verify(key []byte, r io.Reader) (Suite, []byte, error) {
+	// 1. Read the expected MAC (32 bytes), which tells the suite
+	header := make([]byte, Overhead)
+	if _, err := io.ReadFull(r, header[:sha256.Size]); err != nil {
+		return 0, nil, err
+	}
+	expectedMac := header[:sha256.Size]
+	suite := SuiteOf(expectedMac)
+
+	// 2. Read IV (16 bytes)
+	iv := header[sha256.Size:]
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return 0, nil, err
+	}
+	if suite.framed() {
+		_, err := decryptFrames(key, header, r, io.Discard)
+		return suite, iv, err
+	}
+
+	// 3. Recompute the MAC over the ciphertext
+	_, mac, err := suite.newCipher(key, iv)
 	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.Copy(mac, r); err != nil {
+		return 0, nil, err
+	}
+	computedMac := mac.Sum(nil)
+
+	// 4. Compare MACs in constant time
+	if !hmac.Equal(expectedMac, computedMac) {
+		return 0, nil, errors.New("HMAC verification failed: ciphertext is corrupted or wrong key used")
+	}
+	return suite, iv, nil
+}
+
+// CopyDecrypt decrypts data from src and writes the decrypted data to dst
+// Used to decrypt data that was encrypted using CopyEncrypt, with any
+// suite. Nothing is written before the MAC is verified, so src is read
+// twice: in place when it can seek, like a stored file, otherwise from a
+// temporary copy. Framed data is read once instead, each frame written
+// once it is checked. Memory use does not grow with the size of the data.
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	header := make([]byte, Overhead)
+	if _, err := io.ReadFull(src, header); err != nil {
 		return 0, err
 	}
+	if SuiteOf(header).framed() {
+		return decryptFrames(key, header, src, dst)
+	}
+	src = unread(src, header)
 
-	// 1. Read expected HMAC (32 bytes)
-	expectedMac := make([]byte, 32)
-	if _, err := io.ReadFull(src, expectedMac); err != nil {
+	rs, start, cleanup, err := rewindable(src)
+	if err != nil {
 		return 0, err
 	}
+	defer cleanup()
 
-	// 2. Read IV (16 bytes)
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(src, iv); err != nil {
+	suite, iv, err := verify(key, rs)
+	if err != nil {
 		return 0, err
 	}
 
-	// 3. Read the rest as ciphertext
-	ciphertext, err := io.ReadAll(src)
+	// Go back to the ciphertext, decrypt it and write to dst
+	if _, err := rs.Seek(start+Overhead, io.SeekStart); err != nil {
+		return 0, err
+	}
+	stream, _, err := suite.newCipher(key, iv)
 	if err != nil {
 		return 0, err
 	}
+	return copyStream(stream, 0, rs, dst)
+}
 
-	// 4. Recompute HMAC over [IV + ciphertext]
-	h := hmac.New(sha256.New, hmacKey(key))
-	h.Write(iv)
-	h.Write(ciphertext)
-	computedMac := h.Sum(nil)
+// Overhead is the number of bytes CopyEncrypt adds to the plaintext: the
+// HMAC and the IV. It is the same for every suite.
+const Overhead = sha256.Size + aes.BlockSize
 
-	// 5. Compare HMACs in constant time
-	if !hmac.Equal(expectedMac, computedMac) {
-		return 0, errors.New("HMAC verification failed: ciphertext is corrupted or wrong key used")
-	}
+// CopyEncrypt encrypts data for secure storage or transmission with
+// AES256CTR. The HMAC comes first but covers the ciphertext, so it is
+// written last: in place when dst can seek, like a file, otherwise the
+// output goes through a temporary file. Memory use does not grow with the
+// size of the data.
+func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	return AES256CTR.CopyEncrypt(key, src, dst)
+}
 
-	// 6. Decrypt the ciphertext and write to dst
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
+// CopyEncryptConvergent encrypts like CopyEncrypt, but with an IV derived
+// from a keyed hash of the plaintext instead of a random one, so the same
+// content encrypted with the same key always gives the same bytes. The key
+// itself is still the caller's, not derived from the content. Anyone
+// holding the key can then tell which data holds content they guess. src
+// is read twice: in place when it can seek, otherwise from a temporary copy.
+func CopyEncryptConvergent(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	return AES256CTR.CopyEncryptConvergent(key, src, dst)
+}
 
-	n, err := dst.Write(ciphertext)
-	if err != nil {
-		return 0, err
+// unread returns src as it was before header was read from it: seeked
+// back when it can seek, otherwise with header in front
+func unread(src io.Reader, header []byte) io.Reader {
+	if rs, ok := src.(io.ReadSeeker); ok {
+		if _, err := rs.Seek(-int64(len(header)), io.SeekCurrent); err == nil {
+			return rs
+		}
 	}
+	return io.MultiReader(bytes.NewReader(header), src)
+}
 
-	return n, nil
+func convergentKey(key []byte) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte("peervault-convergent-v1"))
+	return h.Sum(nil)
 }
 
-// CopyEncrypt encrypts data for secure storage or transmission
-func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+// copyEncrypt encrypts src to dst with suite and iv, see CopyEncrypt
+func copyEncrypt(suite Suite, key []byte, iv []byte, src io.Reader, dst io.Writer) (int64, error) {
+	ws, ok := dst.(io.WriteSeeker)
+	var start int64
+	if ok {
+		var err error
+		start, err = ws.Seek(0, io.SeekCurrent)
+		ok = err == nil
+	}
+	if suite.framed() {
+		return copyEncryptFrames(suite, key, iv, src, dst)
+	}
+	if !ok {
+		return copyEncryptSpooled(suite, key, iv, src, dst)
+	}
+
+	stream, mac, err := suite.newCipher(key, iv)
 	if err != nil {
 		return 0, err
 	}
 
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	// Leave room for the MAC (32 bytes), then write IV (16 bytes) || ciphertext
+	if _, err := ws.Write(make([]byte, sha256.Size)); err != nil {
+		return 0, err
+	}
+	if _, err := ws.Write(iv); err != nil {
 		return 0, err
 	}
 
-	// Encrypt to a temp buffer first so we can compute the HMAC over [IV + ciphertext]
-	var ciphertextBuf bytes.Buffer
-	stream := cipher.NewCTR(block, iv)
-
-	// XORKeyStream to ciphertextBuf
-	_, err = copyStream(stream, 0, src, &ciphertextBuf)
+	// Compute the MAC over the ciphertext while encrypting
+	n, err := copyStream(stream, 0, suite.limit(src), io.MultiWriter(ws, mac))
 	if err != nil {
 		return 0, err
 	}
 
-	ciphertext := ciphertextBuf.Bytes()
+	if _, err := ws.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := ws.Write(mac.Sum(nil)); err != nil {
+		return 0, err
+	}
+	if _, err := ws.Seek(start+Overhead+n, io.SeekStart); err != nil {
+		return 0, err
+	}
 
-	// Compute HMAC-SHA256 over [IV + ciphertext]
-	h := hmac.New(sha256.New, hmacKey(key))
-	h.Write(iv)
-	h.Write(ciphertext)
-	mac := h.Sum(nil) // 32 bytes
+	return Overhead + n, nil
+}
 
-	// Write HMAC (32 bytes) || IV (16 bytes) || ciphertext to dst
-	if _, err := dst.Write(mac); err != nil {
+// copyEncryptSpooled encrypts src to a temporary file and copies the
+// result to dst, for destinations that cannot seek
+func copyEncryptSpooled(suite Suite, key []byte, iv []byte, src io.Reader, dst io.Writer) (int64, error) {
+	f, err := os.CreateTemp("", "peervault-*")
+	if err != nil {
 		return 0, err
 	}
-	if _, err := dst.Write(iv); err != nil {
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := copyEncrypt(suite, key, iv, src, f); err != nil {
 		return 0, err
 	}
-	if _, err := dst.Write(ciphertext); err != nil {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
 		return 0, err
 	}
+	return io.Copy(dst, f)
+}
+
+// Verify checks the MAC of size bytes of data encrypted with CopyEncrypt,
+// reading them once without keeping them in memory
+func Verify(key []byte, src io.ReaderAt, size int64) error {
+	_, _, err := verify(key, io.NewSectionReader(src, 0, size))
+	return err
+}
+
+// ReaderAt decrypts any part of data encrypted with CopyEncrypt without
+// reading what comes before it, for partial reads of large files. The
+// suites are stream ciphers with a block counter, so decryption can start
+// at any offset, or seal data in frames that are opened on their own. It
+// checks the frames it reads but not the MAC of unframed data, so callers
+// check that data with Verify first (see Authenticated).
+type ReaderAt struct {
+	suite  Suite
+	key    []byte
+	iv     []byte
+	src    io.ReaderAt
+	size   int64        // size of the plaintext
+	frames *frameReader // for framed data
+}
+
+// NewReaderAt returns random access to the plaintext of the size bytes of
+// encrypted data in src
+func NewReaderAt(key []byte, src io.ReaderAt, size int64) (*ReaderAt, error) {
+	if size < Overhead {
+		return nil, errors.New("encrypted data is shorter than its header")
+	}
+	header := make([]byte, Overhead)
+	if _, err := src.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	suite := SuiteOf(header)
+	if suite.framed() {
+		frames, plain, err := newFrameReader(key, header, src, size)
+		if err != nil {
+			return nil, err
+		}
+		return &ReaderAt{suite: suite, src: src, size: plain, frames: frames}, nil
+	}
+	iv := header[sha256.Size:]
+	if _, _, err := suite.newCipher(key, iv); err != nil {
+		return nil, err
+	}
+	return &ReaderAt{suite: suite, key: key, iv: iv, src: src, size: size - Overhead}, nil
+}
 
-	return len(mac) + len(iv) + len(ciphertext), nil
+// Authenticated reports whether every read is checked, as for framed
+// data, so the data need not be checked with Verify first
+func (r *ReaderAt) Authenticated() bool {
+	return r.frames != nil
+}
+
+// Size returns the size of the plaintext
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at off
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := p[:min(int64(len(p)), r.size-off)]
+	if r.frames != nil {
+		n, err := r.frames.readAt(want, off)
+		if err == nil && n < len(p) {
+			err = io.EOF
+		}
+		return n, err
+	}
+	n, err := r.src.ReadAt(want, Overhead+off)
+	stream, serr := r.suite.streamAt(r.key, r.iv, off)
+	if serr != nil {
+		return 0, serr
+	}
+	stream.XORKeyStream(p[:n], p[:n])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// DeriveKey derives a key for a separate use of key, named by purpose, so
+// one secret can protect several kinds of data
+func DeriveKey(key []byte, purpose string) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte("peervault-" + purpose + "-v1"))
+	return h.Sum(nil)
+}
+
+// Seal encrypts and authenticates a small record held in memory with
+// AES-GCM, prefixing the random nonce
+func Seal(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Unseal decrypts a record sealed with Seal, failing if it was changed or
+// sealed with another key
+func Unseal(key []byte, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed record is shorter than its nonce")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
@@ -3,7 +3,13 @@ package crypto
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Steps:
@@ -41,7 +47,7 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	}
 
 	// copyDecrypt should return the number of decrypted bytes written (not including IV)
-	if nw != len(payload) {
+	if nw != int64(len(payload)) {
 		t.Errorf("Expected %d decrypted bytes, got %d", len(payload), nw)
 	}
 
@@ -139,3 +145,422 @@ func TestLargeInput(t *testing.T) {
 		t.Error("Large input roundtrip failed - decrypted data does not match original")
 	}
 }
+
+func TestStreamingFileRoundtrip(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	payload := make([]byte, 8<<20)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	// Files are encrypted in place, the HMAC is written once the data is
+	f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := CopyEncrypt(key, bytes.NewReader(payload), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(payload))+Overhead {
+		t.Errorf("Expected %d encrypted bytes, got %d", len(payload)+Overhead, n)
+	}
+
+	// Streams that cannot seek decrypt through a temporary copy
+	f.Seek(0, io.SeekStart)
+	out := new(bytes.Buffer)
+	if _, err := CopyDecrypt(key, io.MultiReader(f), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Error("decrypted stream does not match original")
+	}
+
+	// A corrupted file is refused before anything is written
+	b := make([]byte, 1)
+	f.ReadAt(b, Overhead+10)
+	f.WriteAt([]byte{b[0] ^ 0xFF}, Overhead+10)
+	f.Seek(0, io.SeekStart)
+	out.Reset()
+	if _, err := CopyDecrypt(key, f, out); err == nil {
+		t.Error("Expected error due to corrupted ciphertext, but got nil")
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output for corrupted ciphertext, got %d bytes", out.Len())
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	payload := make([]byte, 100000)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	enc := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(enc.Bytes())
+
+	if err := Verify(key, src, src.Size()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderAt(key, src, src.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(payload)) {
+		t.Errorf("Expected size %d, got %d", len(payload), r.Size())
+	}
+
+	// Ranges starting inside a cipher block, across blocks, and at the end
+	for _, rng := range [][2]int{{0, 10}, {7, 40}, {4095, 4097}, {99990, 100000}} {
+		buf := make([]byte, rng[1]-rng[0])
+		n, err := r.ReadAt(buf, int64(rng[0]))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], payload[rng[0]:rng[1]]) {
+			t.Errorf("range %d-%d does not match original", rng[0], rng[1])
+		}
+	}
+	buf := make([]byte, 10)
+	if n, err := r.ReadAt(buf, int64(len(payload))-4); n != 4 || err != io.EOF {
+		t.Errorf("Expected 4 bytes and EOF at the end, got %d, %v", n, err)
+	}
+
+	// Tampering is caught by Verify, not by ReadAt
+	tampered := bytes.Clone(enc.Bytes())
+	tampered[Overhead+500] ^= 0xFF
+	if err := Verify(key, bytes.NewReader(tampered), int64(len(tampered))); err == nil {
+		t.Error("Expected error due to corrupted ciphertext, but got nil")
+	}
+}
+
+func TestCopyEncryptConvergent(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	payload := []byte("the same holiday photo")
+
+	// Same content, once from a reader that can seek and once from one that cannot
+	first, second := new(bytes.Buffer), new(bytes.Buffer)
+	if _, err := CopyEncryptConvergent(key, bytes.NewReader(payload), first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyEncryptConvergent(key, io.MultiReader(bytes.NewReader(payload)), second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Expected the same content to encrypt to the same bytes")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := CopyDecrypt(key, bytes.NewReader(first.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Error("decryption failed")
+	}
+
+	other := new(bytes.Buffer)
+	if _, err := CopyEncryptConvergent(key, bytes.NewReader([]byte("another photo")), other); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.Bytes()[32:Overhead], first.Bytes()[32:Overhead]) {
+		t.Error("Expected different content to get a different IV")
+	}
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	payload := make([]byte, 100000)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	enc := new(bytes.Buffer)
+	if _, err := ChaCha20Poly1305.CopyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+	if SuiteOf(enc.Bytes()) != ChaCha20Poly1305 {
+		t.Fatal("Expected the header to name the ChaCha20-Poly1305 suite")
+	}
+
+	// The ciphertext and tag are those of the RFC 8439 AEAD
+	aead, err := chacha20poly1305.New(DeriveKey(key, "chacha20-poly1305"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nil, enc.Bytes()[32:32+chacha20poly1305.NonceSize], payload, chachaSuiteID)
+	if !bytes.Equal(sealed[len(payload):], enc.Bytes()[:16]) || !bytes.Equal(sealed[:len(payload)], enc.Bytes()[Overhead:]) {
+		t.Error("Expected the output of the RFC 8439 construction")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := CopyDecrypt(key, bytes.NewReader(enc.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Error("decryption failed")
+	}
+
+	// Random access lands on the right block of the key stream
+	src := bytes.NewReader(enc.Bytes())
+	r, err := NewReaderAt(key, src, src.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rng := range [][2]int{{0, 10}, {63, 65}, {4095, 4097}, {99990, 100000}} {
+		buf := make([]byte, rng[1]-rng[0])
+		n, err := r.ReadAt(buf, int64(rng[0]))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], payload[rng[0]:rng[1]]) {
+			t.Errorf("range %d-%d does not match original", rng[0], rng[1])
+		}
+	}
+
+	tampered := bytes.Clone(enc.Bytes())
+	tampered[Overhead+500] ^= 0xFF
+	if err := Verify(key, bytes.NewReader(tampered), int64(len(tampered))); err == nil {
+		t.Error("Expected error due to corrupted ciphertext, but got nil")
+	}
+
+	// Data encrypted before suites existed still decrypts
+	legacy := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader(payload), legacy); err != nil {
+		t.Fatal(err)
+	}
+	if SuiteOf(legacy.Bytes()) != AES256CTR {
+		t.Error("Expected AES data to be detected as such")
+	}
+
+	first, second := new(bytes.Buffer), new(bytes.Buffer)
+	ChaCha20Poly1305.CopyEncryptConvergent(key, bytes.NewReader(payload), first)
+	ChaCha20Poly1305.CopyEncryptConvergent(key, io.MultiReader(bytes.NewReader(payload)), second)
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Expected the same content to encrypt to the same bytes")
+	}
+
+	if _, err := ParseSuite("rot13"); err == nil {
+		t.Error("Expected an unknown cipher to be refused")
+	}
+}
+
+func TestFramedSuites(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	for _, suite := range []Suite{AES256GCMFrames, ChaCha20Poly1305Frames} {
+		for _, size := range []int{0, 1, frameSize, frameSize + 1, 3*frameSize + 5} {
+			payload := make([]byte, size)
+			for i := range payload {
+				payload[i] = byte(i % 251)
+			}
+			enc := new(bytes.Buffer)
+			n, err := suite.CopyEncrypt(key, bytes.NewReader(payload), enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(enc.Len()) || n != EncryptedSize(enc.Bytes(), int64(size)) {
+				t.Errorf("%s/%d: Expected %d encrypted bytes, wrote %d", suite, size, EncryptedSize(enc.Bytes(), int64(size)), n)
+			}
+			if plain, err := PlainSize(enc.Bytes(), n); err != nil || plain != int64(size) {
+				t.Errorf("%s/%d: Expected plaintext size %d, got %d, %v", suite, size, size, plain, err)
+			}
+
+			out := new(bytes.Buffer)
+			if _, err := CopyDecrypt(key, io.MultiReader(bytes.NewReader(enc.Bytes())), out); err != nil {
+				t.Fatalf("%s/%d: %v", suite, size, err)
+			}
+			if !bytes.Equal(out.Bytes(), payload) {
+				t.Errorf("%s/%d: decryption failed", suite, size)
+			}
+		}
+	}
+
+	payload := make([]byte, 3*frameSize+5)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	enc := new(bytes.Buffer)
+	if _, err := AES256GCMFrames.CopyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges are read from the frames covering them alone
+	src := bytes.NewReader(enc.Bytes())
+	r, err := NewReaderAt(key, src, src.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Authenticated() || r.Size() != int64(len(payload)) {
+		t.Errorf("Expected an authenticated reader of %d bytes", len(payload))
+	}
+	for _, rng := range [][2]int{{0, 10}, {frameSize - 3, frameSize + 3}, {frameSize, 3 * frameSize}, {3*frameSize + 1, 3*frameSize + 5}} {
+		at, length := EncryptedRange(enc.Bytes(), int64(rng[0]), int64(rng[1]-rng[0]))
+		partial := make([]byte, len(enc.Bytes()))
+		copy(partial, enc.Bytes()[:Overhead])
+		copy(partial[at:], enc.Bytes()[at:min(at+length, int64(enc.Len()))])
+		pr, err := NewReaderAt(key, bytes.NewReader(partial), int64(len(partial)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, rng[1]-rng[0])
+		n, err := pr.ReadAt(buf, int64(rng[0]))
+		if err != nil && err != io.EOF {
+			t.Fatalf("range %d-%d: %v", rng[0], rng[1], err)
+		}
+		if !bytes.Equal(buf[:n], payload[rng[0]:rng[1]]) {
+			t.Errorf("range %d-%d does not match original", rng[0], rng[1])
+		}
+	}
+
+	// A tampered frame fails before anything after it is written
+	tampered := bytes.Clone(enc.Bytes())
+	tampered[Overhead+frameSize+frameTagSize+10] ^= 0xFF
+	out := new(bytes.Buffer)
+	if _, err := CopyDecrypt(key, bytes.NewReader(tampered), out); err == nil {
+		t.Error("Expected error due to corrupted frame, but got nil")
+	}
+	if out.Len() != frameSize {
+		t.Errorf("Expected only the frame before the tampered one, got %d bytes", out.Len())
+	}
+	if err := Verify(key, bytes.NewReader(tampered), int64(len(tampered))); err == nil {
+		t.Error("Expected Verify to fail on a corrupted frame")
+	}
+	tr, _ := NewReaderAt(key, bytes.NewReader(tampered), int64(len(tampered)))
+	if _, err := tr.ReadAt(make([]byte, 10), frameSize+5); err == nil {
+		t.Error("Expected ReadAt to fail on a corrupted frame")
+	}
+
+	// Dropping whole frames from the end is caught too
+	truncated := enc.Bytes()[:Overhead+2*(frameSize+frameTagSize)]
+	if _, err := CopyDecrypt(key, bytes.NewReader(truncated), io.Discard); err == nil {
+		t.Error("Expected error due to truncated data, but got nil")
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	id, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("replica of foo")
+	sig := id.Sign(msg)
+	if !VerifySignature(id.PublicKey, msg, sig) {
+		t.Error("signature does not verify")
+	}
+
+	// Loading again returns the same key
+	again, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.PublicKey, again.PublicKey) {
+		t.Error("identity changed after reload")
+	}
+	if VerifySignature(again.PublicKey, []byte("replica of bar"), sig) {
+		t.Error("signature verified for a different message")
+	}
+}
+
+func TestHumanFingerprint(t *testing.T) {
+	f := NewHumanFingerprint("network", []byte("3f2a91c077de0b14"))
+	if f != NewHumanFingerprint("network", []byte("3f2a91c077de0b14")) {
+		t.Error("fingerprint is not deterministic")
+	}
+	if f == NewHumanFingerprint("identity", []byte("3f2a91c077de0b14")) {
+		t.Error("fingerprints of different kinds are equal")
+	}
+	if s := f.String(); len(s) != 19 || strings.Count(s, " ") != 3 {
+		t.Errorf("unexpected fingerprint %q", s)
+	}
+	if n := len(strings.Split(f.Emoji(), "  ")); n != 8 {
+		t.Errorf("got %d emoji, want 8", n)
+	}
+
+	// Each emoji and name stands for one value
+	symbols, names := make(map[string]bool), make(map[string]bool)
+	for _, e := range fingerprintEmoji {
+		symbols[e.symbol], names[e.name] = true, true
+	}
+	if len(symbols) != 64 || len(names) != 64 {
+		t.Errorf("%d symbols and %d names, want 64 each", len(symbols), len(names))
+	}
+}
+
+func TestShamir(t *testing.T) {
+	secret, _ := NewEncryptionKey()
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any 3 of the 5 shares give the secret back
+	for _, pick := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var some [][]byte
+		for _, i := range pick {
+			some = append(some, shares[i])
+		}
+		got, err := CombineShares(some)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("shares %v gave a different secret", pick)
+		}
+	}
+
+	// Fewer do not
+	got, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("2 shares gave the secret back with a threshold of 3")
+	}
+	if _, err := CombineShares([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("repeated share accepted")
+	}
+	if _, err := SplitSecret(secret, 2, 3); err == nil {
+		t.Error("threshold above the number of shares accepted")
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.key")
+
+	dk, err := LoadOrCreateDeviceKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, _ := NewEncryptionKey()
+	wrapped, err := WrapKey(dk.PublicKey, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reloaded device key unwraps it
+	again, err := LoadOrCreateDeviceKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := again.UnwrapKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Error("unwrapped key differs from the data key")
+	}
+
+	// Another device cannot
+	other, _ := NewDeviceKey()
+	if _, err := other.UnwrapKey(wrapped); err == nil {
+		t.Error("key unwrapped by a device it was not wrapped for")
+	}
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := dk.UnwrapKey(wrapped); err == nil {
+		t.Error("tampered wrapped key accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// wrapInfo separates the key derived for key wrapping from other uses
+const wrapInfo = "peervault-key-wrap-v1"
+
+// DeviceKey is the X25519 key pair of one device. File data keys are
+// wrapped to its public key, so only the device holding the private key
+// can unwrap them.
+type DeviceKey struct {
+	PrivateKey *ecdh.PrivateKey
+	PublicKey  []byte
+}
+
+// NewDeviceKey generates a fresh device key pair
+func NewDeviceKey() (*DeviceKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceKey{PrivateKey: priv, PublicKey: priv.PublicKey().Bytes()}, nil
+}
+
+// LoadOrCreateDeviceKey reads the device key stored at path, creating and
+// saving a new one if the file does not exist
+func LoadOrCreateDeviceKey(path string) (*DeviceKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid device key file %s", path)
+		}
+		priv, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device key file %s", path)
+		}
+		return &DeviceKey{PrivateKey: priv, PublicKey: priv.PublicKey().Bytes()}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	dk, err := NewDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(dk.PrivateKey.Bytes())), 0600); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// Fingerprint returns a short printable form of the public key
+func (dk *DeviceKey) Fingerprint() string {
+	return Fingerprint(dk.PublicKey)
+}
+
+// wrapCipher derives the AES-GCM cipher shared by an ephemeral key and a
+// device key
+func wrapCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte(wrapInfo))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKey encrypts key for the device with the given public key. The result
+// holds an ephemeral public key, a nonce and the sealed key.
+func WrapKey(publicKey []byte, key []byte) ([]byte, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device public key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, err := wrapCipher(shared, ephemeralPub, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	wrapped := append(ephemeralPub, nonce...)
+	return aead.Seal(wrapped, nonce, key, nil), nil
+}
+
+// UnwrapKey decrypts a key wrapped for this device with WrapKey
+func (dk *DeviceKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	const pubSize = 32
+	if len(wrapped) < pubSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(wrapped[:pubSize])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := dk.PrivateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := wrapCipher(shared, wrapped[:pubSize], dk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	rest := wrapped[pubSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	key, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("wrapped key is not for this device or was tampered with")
+	}
+	return key, nil
+}
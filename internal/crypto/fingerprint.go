@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// HumanFingerprint is a short digest for people to compare, e.g. read out
+// over the phone, to check two nodes share a network key or that a node is
+// the one they meant
+type HumanFingerprint [8]byte
+
+// NewHumanFingerprint returns the fingerprint of data. kind keeps
+// fingerprints of different things apart, e.g. "network" or "identity".
+func NewHumanFingerprint(kind string, data []byte) HumanFingerprint {
+	var f HumanFingerprint
+	sum := sha256.Sum256(append([]byte("peervault fingerprint:"+kind+":"), data...))
+	copy(f[:], sum[:])
+	return f
+}
+
+// String returns the fingerprint as 16 hex digits in groups of four
+func (f HumanFingerprint) String() string {
+	return fmt.Sprintf("%X %X %X %X", f[0:2], f[2:4], f[4:6], f[6:8])
+}
+
+// Emoji returns the first 48 bits of the fingerprint as eight emoji, each
+// with its name so it can be said aloud
+func (f HumanFingerprint) Emoji() string {
+	bits := binary.BigEndian.Uint64(f[:])
+	words := make([]string, 8)
+	for i := range words {
+		e := fingerprintEmoji[bits>>(58-6*i)&63]
+		words[i] = e.symbol + " " + e.name
+	}
+	return strings.Join(words, "  ")
+}
+
+// fingerprintEmoji are told apart easily both on screen and aloud. There are
+// 64, so each stands for 6 bits.
+var fingerprintEmoji = [64]struct{ symbol, name string }{
+	{"🐶", "dog"}, {"🐱", "cat"}, {"🦁", "lion"}, {"🐎", "horse"},
+	{"🦄", "unicorn"}, {"🐷", "pig"}, {"🐘", "elephant"}, {"🐰", "rabbit"},
+	{"🐼", "panda"}, {"🐓", "rooster"}, {"🐧", "penguin"}, {"🐢", "turtle"},
+	{"🐟", "fish"}, {"🐙", "octopus"}, {"🦋", "butterfly"}, {"🌷", "flower"},
+	{"🌳", "tree"}, {"🌵", "cactus"}, {"🍄", "mushroom"}, {"🌏", "globe"},
+	{"🌙", "moon"}, {"☁️", "cloud"}, {"🔥", "fire"}, {"🍌", "banana"},
+	{"🍎", "apple"}, {"🍓", "strawberry"}, {"🌽", "corn"}, {"🍕", "pizza"},
+	{"🎂", "cake"}, {"❤️", "heart"}, {"😀", "smiley"}, {"🤖", "robot"},
+	{"🎩", "hat"}, {"👓", "glasses"}, {"🔧", "spanner"}, {"🎅", "santa"},
+	{"👍", "thumbs up"}, {"☂️", "umbrella"}, {"⌛", "hourglass"}, {"⏰", "clock"},
+	{"🎁", "gift"}, {"💡", "light bulb"}, {"📕", "book"}, {"✏️", "pencil"},
+	{"📎", "paperclip"}, {"✂️", "scissors"}, {"🔒", "lock"}, {"🔑", "key"},
+	{"🔨", "hammer"}, {"☎️", "telephone"}, {"🏁", "flag"}, {"🚂", "train"},
+	{"🚲", "bicycle"}, {"✈️", "aeroplane"}, {"🚀", "rocket"}, {"🏆", "trophy"},
+	{"⚽", "ball"}, {"🎸", "guitar"}, {"🎺", "trumpet"}, {"🔔", "bell"},
+	{"⚓", "anchor"}, {"🎧", "headphones"}, {"📁", "folder"}, {"📌", "pin"},
+}
@@ -0,0 +1,321 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Framed data is split into frames of frameSize bytes of plaintext, each
+// sealed on its own with an AEAD and followed by its 16-byte tag. Every
+// frame is checked as it is read, so data is decrypted in one pass and in
+// constant memory, a tampered frame fails before anything after it is
+// read, and a range is read by opening only the frames it covers.
+//
+// The header keeps the Overhead bytes of the other suites:
+//
+//	[frame size, 4 bytes big-endian][12 zero bytes][suite id, 16][salt, 16]
+//
+// Each file is sealed with its own key, derived from the key and the salt.
+// The nonce of a frame is its index, with a last byte set on the final
+// frame, so frames cannot be reordered, dropped or appended, and the
+// header is the associated data of every frame.
+
+// frameSize is the plaintext bytes in each frame but the last
+const frameSize = 64 * 1024
+
+// maxFrameSize bounds the frame size read from a header, so a corrupted
+// header cannot make readers allocate much
+const maxFrameSize = 16 << 20
+
+// frameTagSize is the bytes the AEAD of both framed suites adds to a frame
+const frameTagSize = 16
+
+var (
+	gcmFramesID    = []byte("peervault-gcmfrm")
+	chachaFramesID = []byte("peervault-ccpfrm")
+)
+
+// errFrame is returned for a frame that fails authentication
+var errFrame = errors.New("verification failed: ciphertext is corrupted or wrong key used")
+
+// framed reports whether the suite seals data in frames
+func (s Suite) framed() bool {
+	return s == AES256GCMFrames || s == ChaCha20Poly1305Frames
+}
+
+// Framed returns the suite sealing data in frames with the cipher of s
+func (s Suite) Framed() Suite {
+	switch s {
+	case AES256CTR:
+		return AES256GCMFrames
+	case ChaCha20Poly1305:
+		return ChaCha20Poly1305Frames
+	}
+	return s
+}
+
+// frameHeader returns the header of data sealed in frames with salt
+func frameHeader(suite Suite, salt []byte) []byte {
+	header := make([]byte, Overhead)
+	binary.BigEndian.PutUint32(header, frameSize)
+	if suite == AES256GCMFrames {
+		copy(header[16:], gcmFramesID)
+	} else {
+		copy(header[16:], chachaFramesID)
+	}
+	copy(header[sha256.Size:], salt)
+	return header
+}
+
+// frameSizeOf returns the frame size a header of framed data names
+func frameSizeOf(header []byte) (int64, error) {
+	frame := int64(binary.BigEndian.Uint32(header))
+	if frame == 0 || frame > maxFrameSize {
+		return 0, fmt.Errorf("invalid frame size %d", frame)
+	}
+	return frame, nil
+}
+
+// newFrameAEAD returns the AEAD sealing the frames of data with header
+func newFrameAEAD(key []byte, header []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+	mac := hmac.New(sha256.New, DeriveKey(key, "frames"))
+	mac.Write(header[16:]) // suite id and salt
+	fileKey := mac.Sum(nil)
+
+	if SuiteOf(header) == AES256GCMFrames {
+		block, err := aes.NewCipher(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.New(fileKey)
+}
+
+// frameNonce returns the nonce of frame i
+func frameNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// copyEncryptFrames seals src in frames to dst, see Framed. Unlike the
+// other suites nothing is written back, so dst need not seek.
+func copyEncryptFrames(suite Suite, key []byte, salt []byte, src io.Reader, dst io.Writer) (int64, error) {
+	header := frameHeader(suite, salt)
+	aead, err := newFrameAEAD(key, header)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReaderSize(src, frameSize)
+	plain := make([]byte, frameSize)
+	sealed := make([]byte, 0, frameSize+frameTagSize)
+	written := int64(Overhead)
+	for i := int64(0); ; i++ {
+		n, err := io.ReadFull(br, plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		// A full frame is the last one if nothing follows it
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], frameNonce(i, last), plain[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return 0, err
+		}
+		written += int64(len(sealed))
+		if last {
+			return written, nil
+		}
+	}
+}
+
+// decryptFrames opens the frames of data with header that follow it in
+// src and writes their plaintext to dst, failing at the first frame that
+// does not authenticate
+func decryptFrames(key []byte, header []byte, src io.Reader, dst io.Writer) (int64, error) {
+	frame, err := frameSizeOf(header)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newFrameAEAD(key, header)
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReaderSize(src, int(frame)+frameTagSize)
+	sealed := make([]byte, frame+frameTagSize)
+	plain := make([]byte, 0, frame)
+	var written int64
+	for i := int64(0); ; i++ {
+		n, err := io.ReadFull(br, sealed)
+		last := err == io.ErrUnexpectedEOF
+		if err == io.EOF {
+			return 0, fmt.Errorf("frame %d: %w", i, io.ErrUnexpectedEOF) // the final frame is missing
+		}
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		plain, err = aead.Open(plain[:0], frameNonce(i, last), sealed[:n], header)
+		if err != nil {
+			return 0, fmt.Errorf("frame %d: %w", i, errFrame)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return 0, err
+		}
+		written += int64(len(plain))
+		if last {
+			return written, nil
+		}
+	}
+}
+
+// framedSizes returns the frame size, the number of frames and the size of
+// the plaintext of size bytes of framed data with header
+func framedSizes(header []byte, size int64) (frame int64, frames int64, plain int64, err error) {
+	if frame, err = frameSizeOf(header); err != nil {
+		return 0, 0, 0, err
+	}
+	body := size - Overhead
+	frames = (body + frame + frameTagSize - 1) / (frame + frameTagSize)
+	if frames == 0 || body-(frames-1)*(frame+frameTagSize) < frameTagSize {
+		return 0, 0, 0, errors.New("framed data is truncated")
+	}
+	return frame, frames, body - frames*frameTagSize, nil
+}
+
+// PlainSize returns the size of the plaintext of size bytes of encrypted
+// data starting with header, its first Overhead bytes
+func PlainSize(header []byte, size int64) (int64, error) {
+	if size < Overhead || len(header) < Overhead {
+		return 0, errors.New("encrypted data is shorter than its header")
+	}
+	if !SuiteOf(header).framed() {
+		return size - Overhead, nil
+	}
+	_, _, plain, err := framedSizes(header, size)
+	return plain, err
+}
+
+// EncryptedSize returns the size of encrypted data starting with header
+// whose plaintext is plain bytes long
+func EncryptedSize(header []byte, plain int64) int64 {
+	frame, err := frameSizeOf(header)
+	if !SuiteOf(header).framed() || err != nil {
+		return Overhead + plain
+	}
+	frames := max((plain+frame-1)/frame, 1)
+	return Overhead + plain + frames*frameTagSize
+}
+
+// EncryptedRange returns the offset and length of the encrypted bytes a
+// ReaderAt reads to decrypt length bytes of plaintext at off: the same
+// range after the header, or the whole frames covering it. The length may
+// run past the end of the data.
+func EncryptedRange(header []byte, off int64, length int64) (int64, int64) {
+	frame, err := frameSizeOf(header)
+	if !SuiteOf(header).framed() || err != nil {
+		return Overhead + off, length
+	}
+	first := off / frame
+	end := (off + length + frame - 1) / frame
+	return Overhead + first*(frame+frameTagSize), (end - first) * (frame + frameTagSize)
+}
+
+// frameReader opens frames of framed data for a ReaderAt, keeping the
+// last one opened for reads that continue it
+type frameReader struct {
+	aead   cipher.AEAD
+	header []byte
+	src    io.ReaderAt
+	frame  int64 // plaintext bytes of each frame but the last
+	frames int64
+	size   int64 // size of the encrypted data
+
+	mu     sync.Mutex
+	cached int64 // index of the frame in plain, -1 if none
+	plain  []byte
+}
+
+func newFrameReader(key []byte, header []byte, src io.ReaderAt, size int64) (*frameReader, int64, error) {
+	frame, frames, plain, err := framedSizes(header, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newFrameAEAD(key, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &frameReader{aead: aead, header: header, src: src, frame: frame, frames: frames, size: size, cached: -1}, plain, nil
+}
+
+// readAt fills p with plaintext at off, which the caller keeps within
+// the plaintext
+func (r *frameReader) readAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		at := off + int64(n)
+		i := at / r.frame
+		if err := r.open(i); err != nil {
+			return n, err
+		}
+		n += copy(p[n:], r.plain[at-i*r.frame:])
+	}
+	return n, nil
+}
+
+// open reads and authenticates frame i into r.plain
+func (r *frameReader) open(i int64) error {
+	if r.cached == i {
+		return nil
+	}
+	start := Overhead + i*(r.frame+frameTagSize)
+	sealed := make([]byte, min(r.frame+frameTagSize, r.size-start))
+	if _, err := r.src.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return err
+	}
+	plain, err := r.aead.Open(r.plain[:0], frameNonce(i, i == r.frames-1), sealed, r.header)
+	if err != nil {
+		r.cached = -1
+		return fmt.Errorf("frame %d: %w", i, errFrame)
+	}
+	r.plain, r.cached = plain, i
+	return nil
+}
@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Identity is a node's long-lived signing key. Unlike the node ID it
+// survives restarts, so signatures made with it can be checked later.
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// NewIdentity generates a fresh signing key
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PrivateKey: priv, PublicKey: pub}, nil
+}
+
+// LoadOrCreateIdentity reads the signing key stored at path, creating and
+// saving a new one if the file does not exist
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid identity file %s", path)
+		}
+		priv := ed25519.NewKeyFromSeed(seed)
+		return &Identity{PrivateKey: priv, PublicKey: priv.Public().(ed25519.PublicKey)}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	id, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(id.PrivateKey.Seed())), 0600); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Sign signs msg with the identity's private key
+func (id *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(id.PrivateKey, msg)
+}
+
+// Fingerprint returns a short printable form of the public key
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.PublicKey)
+}
+
+// Fingerprint returns the first 16 hex characters of the SHA-256 of a public key
+func Fingerprint(publicKey []byte) string {
+	return HashKey(string(publicKey))[:16]
+}
+
+// VerifySignature reports whether sig is a valid signature of msg by publicKey
+func VerifySignature(publicKey []byte, msg []byte, sig []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(publicKey), msg, sig)
+}
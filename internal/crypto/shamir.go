@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SplitSecret splits secret into n shares with Shamir's secret sharing, so
+// any threshold of them give it back and fewer tell nothing about it. Each
+// share is its index, 1 to n, followed by as many bytes as the secret.
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("the secret is empty")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("cannot split into %d shares with a threshold of %d: want 2 <= threshold <= shares <= 255", n, threshold)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	// Each byte of the secret is the constant term of its own random
+	// polynomial of degree threshold-1, and the shares are its values
+	coeffs := make([]byte, threshold)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := io.ReadFull(rand.Reader, coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x, y := share[0], byte(0)
+			for i := len(coeffs) - 1; i >= 0; i-- {
+				y = gfMul(y, x) ^ coeffs[i]
+			}
+			share[1+b] = y
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares returns the secret shares were split from. Given fewer
+// shares than the threshold, it returns garbage rather than an error, so
+// callers check the result.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are needed")
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, errors.New("shares differ in size")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("invalid or repeated share index %d", share[0])
+		}
+		seen[share[0]] = true
+	}
+
+	// Lagrange interpolation at x = 0, where subtracting is xor
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		weight := byte(1)
+		for j, other := range shares {
+			if i != j {
+				weight = gfMul(weight, gfDiv(other[0], other[0]^share[0]))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(weight, share[1+b])
+		}
+	}
+	return secret, nil
+}
+
+// gfExp and gfLog are powers and logarithms of the generator 3 in GF(2^8)
+// with the AES polynomial x^8 + x^4 + x^3 + x + 1
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// x *= 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv divides a by b, which must not be 0
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
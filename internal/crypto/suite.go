@@ -0,0 +1,260 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Suite is the cipher data is encrypted with. Every suite uses the same
+// header of Overhead bytes: a 32-byte MAC slot followed by a 16-byte IV
+// slot, so sizes and offsets do not depend on the suite.
+type Suite byte
+
+const (
+	// AES256CTR encrypts with AES-256 in CTR mode and authenticates with
+	// HMAC-SHA256, which fills the MAC slot. It is the original format and
+	// carries no suite identifier.
+	AES256CTR Suite = iota
+	// ChaCha20Poly1305 is the AEAD construction of RFC 8439 over the whole
+	// data, computed as it streams. The MAC slot holds the Poly1305 tag and
+	// chachaSuiteID, the IV slot the 12-byte nonce. It is faster than AES
+	// on CPUs without AES instructions, such as many ARM boards.
+	ChaCha20Poly1305
+	// AES256GCMFrames and ChaCha20Poly1305Frames seal data in frames with
+	// AES-256-GCM or ChaCha20-Poly1305, see frames.go. They are checked
+	// frame by frame rather than as a whole, which suits large files.
+	AES256GCMFrames
+	ChaCha20Poly1305Frames
+)
+
+// chachaSuiteID identifies ChaCha20Poly1305 data in the second half of the
+// MAC slot. An HMAC in that place matches it by chance with a probability
+// of 2^-128.
+var chachaSuiteID = []byte("peervault-cc20p1")
+
+// maxChaChaSize is the most data ChaCha20Poly1305 encrypts under one
+// nonce: 2^32 blocks of 64 bytes, less the block of the Poly1305 key
+const maxChaChaSize = (1<<32 - 1) * 64
+
+// ParseSuite returns the suite named name: "aes" (or "aes-256-ctr") or
+// "chacha20" (or "chacha20-poly1305"). An empty name is AES256CTR.
+func ParseSuite(name string) (Suite, error) {
+	switch strings.ToLower(name) {
+	case "", "aes", "aes-256-ctr":
+		return AES256CTR, nil
+	case "chacha20", "chacha20-poly1305":
+		return ChaCha20Poly1305, nil
+	}
+	return 0, fmt.Errorf("unknown cipher %q, want aes or chacha20", name)
+}
+
+func (s Suite) String() string {
+	switch s {
+	case AES256CTR:
+		return "aes-256-ctr"
+	case ChaCha20Poly1305:
+		return "chacha20-poly1305"
+	case AES256GCMFrames:
+		return "aes-256-gcm-frames"
+	case ChaCha20Poly1305Frames:
+		return "chacha20-poly1305-frames"
+	}
+	return fmt.Sprintf("suite(%d)", byte(s))
+}
+
+// SuiteOf returns the suite of encrypted data from its header, the first
+// Overhead bytes
+func SuiteOf(header []byte) Suite {
+	if len(header) < sha256.Size {
+		return AES256CTR
+	}
+	switch id := header[poly1305.TagSize:sha256.Size]; {
+	case bytes.Equal(id, chachaSuiteID):
+		return ChaCha20Poly1305
+	case bytes.Equal(id, gcmFramesID):
+		return AES256GCMFrames
+	case bytes.Equal(id, chachaFramesID):
+		return ChaCha20Poly1305Frames
+	}
+	return AES256CTR
+}
+
+// ivSize returns how many bytes of the IV slot the suite uses
+func (s Suite) ivSize() int {
+	if s == ChaCha20Poly1305 {
+		return chacha20.NonceSize
+	}
+	return aes.BlockSize
+}
+
+// macWriter authenticates ciphertext written to it. Sum returns the
+// contents of the MAC slot.
+type macWriter interface {
+	io.Writer
+	Sum(b []byte) []byte
+}
+
+// newCipher returns the key stream of the suite for iv, positioned at the
+// start of the plaintext, and the MAC of the ciphertext that follows
+func (s Suite) newCipher(key []byte, iv []byte) (cipher.Stream, macWriter, error) {
+	switch s {
+	case AES256CTR:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		h := hmac.New(sha256.New, hmacKey(key))
+		h.Write(iv)
+		return cipher.NewCTR(block, iv), h, nil
+
+	case ChaCha20Poly1305:
+		c, err := chacha20.NewUnauthenticatedCipher(DeriveKey(key, "chacha20-poly1305"), iv[:chacha20.NonceSize])
+		if err != nil {
+			return nil, nil, err
+		}
+		// The first block keys Poly1305, the data starts at the second
+		var polyKey [32]byte
+		c.XORKeyStream(polyKey[:], polyKey[:])
+		c.SetCounter(1)
+		mac := &aeadMAC{mac: poly1305.New(&polyKey)}
+		mac.mac.Write(chachaSuiteID) // the suite is the associated data
+		return c, mac, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported cipher %s", s)
+}
+
+// aeadMAC is the Poly1305 tag of RFC 8439 over the associated data and the
+// ciphertext, which are padded to 16 bytes and followed by their lengths
+type aeadMAC struct {
+	mac *poly1305.MAC
+	n   int64 // ciphertext bytes
+}
+
+func (m *aeadMAC) Write(p []byte) (int, error) {
+	m.n += int64(len(p))
+	return m.mac.Write(p)
+}
+
+func (m *aeadMAC) Sum(b []byte) []byte {
+	var pad [16]byte
+	m.mac.Write(pad[:(16-len(chachaSuiteID)%16)%16])
+	m.mac.Write(pad[:(16-m.n%16)%16])
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(chachaSuiteID)))
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(m.n))
+	m.mac.Write(lengths[:])
+	return append(m.mac.Sum(b), chachaSuiteID...)
+}
+
+// streamAt returns the key stream of the suite positioned at plaintext
+// offset off
+func (s Suite) streamAt(key []byte, iv []byte, off int64) (cipher.Stream, error) {
+	if s == AES256CTR {
+		return aesStreamAt(key, iv, off)
+	}
+	stream, _, err := s.newCipher(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	c := stream.(*chacha20.Cipher)
+	if off >= maxChaChaSize {
+		return nil, errors.New("offset beyond the data")
+	}
+	c.SetCounter(uint32(1 + off/64))
+	if skip := off % 64; skip > 0 {
+		discard := make([]byte, skip)
+		c.XORKeyStream(discard, discard)
+	}
+	return c, nil
+}
+
+// aesStreamAt returns the CTR key stream positioned at plaintext offset off
+func aesStreamAt(key []byte, iv []byte, off int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := int64(block.BlockSize())
+
+	// The counter is the IV as a big-endian number plus the block index
+	counter := append([]byte(nil), iv...)
+	carry := uint64(off / blockSize)
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	if skip := off % blockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream, nil
+}
+
+// sizeLimit fails reads past the most data a suite can encrypt, rather
+// than letting the key stream wrap around
+type sizeLimit struct {
+	r io.Reader
+	n int64 // bytes left
+}
+
+func (l *sizeLimit) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return 0, errors.New("data too large for the cipher")
+	}
+	return n, err
+}
+
+// limit wraps src in the size limit of the suite, if it has one
+func (s Suite) limit(src io.Reader) io.Reader {
+	if s == ChaCha20Poly1305 {
+		return &sizeLimit{r: src, n: maxChaChaSize}
+	}
+	return src
+}
+
+// CopyEncrypt encrypts data with the suite, see the CopyEncrypt function.
+// Data of every suite is decrypted with CopyDecrypt.
+func (s Suite) CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv[:s.ivSize()]); err != nil {
+		return 0, err
+	}
+	return copyEncrypt(s, key, iv, src, dst)
+}
+
+// CopyEncryptConvergent encrypts data with the suite and an IV derived
+// from the plaintext, see the CopyEncryptConvergent function
+func (s Suite) CopyEncryptConvergent(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	rs, start, cleanup, err := rewindable(src)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	h := hmac.New(sha256.New, convergentKey(key))
+	if _, err := io.Copy(h, rs); err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, h.Sum(nil)[:s.ivSize()])
+	return copyEncrypt(s, key, iv, rs, dst)
+}
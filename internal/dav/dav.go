@@ -0,0 +1,176 @@
+package dav
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+)
+
+// Options configures the WebDAV server
+type Options struct {
+	Keys       *grpcapi.KeyStore // API keys accepted as the password of HTTP basic auth
+	RequireKey bool              // Refuse requests without an API key
+	Logger     *slog.Logger
+}
+
+// Server serves the vault over WebDAV
+type Server struct {
+	addr    string
+	handler http.Handler
+	server  *http.Server
+}
+
+// NewServer creates a WebDAV server for the files stored on fs
+func NewServer(addr string, fs *network.FileServer, opts Options) *Server {
+	return &Server{addr: addr, handler: Handler(fs, opts)}
+}
+
+// Start begins serving WebDAV over HTTP
+func (s *Server) Start() error {
+	s.server = &http.Server{
+		Addr:    s.addr,
+		Handler: s.handler,
+	}
+	return s.server.ListenAndServe()
+}
+
+// Stop shuts down the WebDAV server
+func (s *Server) Stop() error {
+	if s.server != nil {
+		return s.server.Close()
+	}
+	return nil
+}
+
+// apiKeyContext is the context key of the API key a request was made with
+type apiKeyContext struct{}
+
+// handler checks API keys before passing requests to the WebDAV handler
+type handler struct {
+	fs   *network.FileServer
+	dav  *webdav.Handler
+	opts Options
+}
+
+// Handler serves the files stored on fs over WebDAV, so desktop systems can
+// map the vault as a network drive. Keys are paths like in the FUSE mount:
+// "docs/a.txt" is file a.txt in folder docs. GET supports range requests,
+// which read only the requested part of large files, and uploads are
+// streamed to Store without being held in memory.
+//
+// Requests may carry an API key as the password of HTTP basic auth. They
+// can then only do what its scopes allow, and only see the keys it may
+// read in folder listings.
+func Handler(fs *network.FileServer, opts Options) http.Handler {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &handler{
+		fs: fs,
+		dav: &webdav.Handler{
+			FileSystem: newFileSystem(fs),
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					opts.Logger.Debug("webdav request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+				}
+			},
+		},
+		opts: opts,
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="PeerVault"`)
+		http.Error(w, "a valid API key is required", http.StatusUnauthorized)
+		return
+	}
+	if key != nil {
+		if !h.authorize(r, key) {
+			http.Error(w, "API key "+key.Name+" may not "+r.Method+" "+r.URL.Path, http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key))
+	}
+	h.dav.ServeHTTP(w, r)
+}
+
+// authenticate returns the API key of a request, if any. It returns false
+// for invalid keys, and for requests without one if keys are required.
+func (h *handler) authenticate(r *http.Request) (*grpcapi.APIKey, bool) {
+	token := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	if token == "" {
+		return nil, !h.opts.RequireKey
+	}
+	if h.opts.Keys == nil {
+		return nil, false
+	}
+	key, err := h.opts.Keys.Authenticate(token)
+	if err != nil {
+		h.fs.Audit(network.AuditEntry{Action: "denied", By: "webdav", Reason: r.Method + " " + r.URL.Path + ": " + err.Error()})
+		return nil, false
+	}
+	return key, true
+}
+
+// authorize checks that key allows a request, recording it in the audit
+// log. Listings are filtered instead, see fileSystem.readable.
+func (h *handler) authorize(r *http.Request, key *grpcapi.APIKey) bool {
+	path := keyOf(r.URL.Path)
+	var checks [][2]string // verb, key
+	switch r.Method {
+	case http.MethodOptions, "PROPFIND":
+		return true
+	case http.MethodGet, http.MethodHead:
+		checks = append(checks, [2]string{grpcapi.VerbRead, path})
+	case "COPY":
+		checks = append(checks, [2]string{grpcapi.VerbRead, path})
+		checks = append(checks, [2]string{grpcapi.VerbWrite, destination(r)})
+	case "MOVE":
+		checks = append(checks, [2]string{grpcapi.VerbWrite, path})
+		checks = append(checks, [2]string{grpcapi.VerbWrite, destination(r)})
+	default:
+		// PUT, DELETE, MKCOL, PROPPATCH, LOCK and UNLOCK change the vault
+		checks = append(checks, [2]string{grpcapi.VerbWrite, path})
+	}
+
+	for _, c := range checks {
+		scope, ok := key.Match(c[0], c[1])
+		if !ok {
+			h.fs.Audit(network.AuditEntry{Action: "denied", Key: c[1], By: key.String(), Reason: "WebDAV " + r.Method})
+			return false
+		}
+		h.fs.Audit(network.AuditEntry{Action: "api", Pattern: scope.String(), Key: c[1], By: key.String(), Reason: "WebDAV " + r.Method})
+	}
+	return true
+}
+
+// destination returns the key named by the Destination header of a COPY
+// or MOVE request
+func destination(r *http.Request) string {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return ""
+	}
+	return keyOf(u.Path)
+}
+
+// requestKey returns the API key a request was made with, if any
+func requestKey(ctx context.Context) (*grpcapi.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContext{}).(*grpcapi.APIKey)
+	return key, ok
+}
@@ -0,0 +1,144 @@
+package dav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// newTestNode returns an unconnected node and its API keys
+func newTestNode(t *testing.T) (*network.FileServer, *grpcapi.KeyStore) {
+	root := filepath.Join(os.TempDir(), "pv_dav_node")
+	os.RemoveAll(root)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	encKey, _ := crypto.NewEncryptionKey()
+	fs, err := network.NewFileServer(network.FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+		FetchTimeout:      100 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	fs.Transport = p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5920",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	keys, err := grpcapi.OpenKeyStore(fs)
+	assert.Nil(t, err)
+	return fs, keys
+}
+
+// do sends a request to the WebDAV server, with token as the basic auth
+// password if set, and returns the status and body of the response
+func do(t *testing.T, srv *httptest.Server, method, path, body, token string, header map[string]string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+	if token != "" {
+		req.SetBasicAuth("peervault", token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := srv.Client().Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestWebDAV(t *testing.T) {
+	fs, keys := newTestNode(t)
+	srv := httptest.NewServer(Handler(fs, Options{Keys: keys}))
+	defer srv.Close()
+
+	content := strings.Repeat("0123456789", 1000)
+	code, _ := do(t, srv, "PUT", "/docs/report.txt", content, "", nil)
+	assert.Equal(t, http.StatusCreated, code)
+	stored, err := fs.Get(context.Background(), "docs/report.txt")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(stored)
+	assert.Equal(t, content, string(data))
+
+	code, body := do(t, srv, "GET", "/docs/report.txt", "", "", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, content, body)
+
+	// Range requests decrypt only the requested bytes
+	code, body = do(t, srv, "GET", "/docs/report.txt", "", "", map[string]string{"Range": "bytes=5005-5014"})
+	assert.Equal(t, http.StatusPartialContent, code)
+	assert.Equal(t, "5678901234", body)
+
+	code, body = do(t, srv, "PROPFIND", "/", "", "", map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, code)
+	assert.Contains(t, body, "/docs/")
+	code, body = do(t, srv, "PROPFIND", "/docs/", "", "", map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, code)
+	assert.Contains(t, body, "/docs/report.txt")
+
+	code, _ = do(t, srv, "MOVE", "/docs/report.txt", "", "", map[string]string{"Destination": srv.URL + "/archive/report.txt"})
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, srv, "GET", "/docs/report.txt", "", "", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body = do(t, srv, "GET", "/archive/report.txt", "", "", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, content, body)
+
+	code, _ = do(t, srv, "DELETE", "/archive/report.txt", "", "", nil)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = do(t, srv, "GET", "/archive/report.txt", "", "", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestWebDAVScopedKeys(t *testing.T) {
+	fs, keys := newTestNode(t)
+	srv := httptest.NewServer(Handler(fs, Options{Keys: keys, RequireKey: true}))
+	defer srv.Close()
+
+	backups, _ := grpcapi.ParseScope("read:backups/*")
+	token, _, err := keys.Issue("restore", []grpcapi.Scope{backups}, 0, "test")
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Store(context.Background(), "backups/db.tar", strings.NewReader("db")))
+	assert.Nil(t, fs.Store(context.Background(), "private/notes.txt", strings.NewReader("secret")))
+
+	// Keys are required, and must be valid
+	code, _ := do(t, srv, "GET", "/backups/db.tar", "", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(t, srv, "GET", "/backups/db.tar", "", token+"x", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body := do(t, srv, "GET", "/backups/db.tar", "", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "db", body)
+	code, _ = do(t, srv, "GET", "/private/notes.txt", "", token, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(t, srv, "PUT", "/backups/new.tar", "x", token, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(t, srv, "DELETE", "/backups/db.tar", "", token, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Listings only show what the key may read
+	code, body = do(t, srv, "PROPFIND", "/", "", token, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, code)
+	assert.Contains(t, body, "/backups/")
+	assert.NotContains(t, body, "/private/")
+}
@@ -0,0 +1,511 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// fileSystem is the vault as a webdav.FileSystem. Names are slash-separated
+// paths starting with "/", the key of a file is its path without it.
+type fileSystem struct {
+	server *network.FileServer
+
+	// The stored files, listed at most once a second: a PROPFIND stats and
+	// opens every entry of a folder
+	listMu   sync.Mutex
+	listed   []storage.FileInfo
+	listedAt time.Time
+
+	// Folders created with MKCOL. Only keys are stored, so any other folder
+	// exists only while a key lives below it.
+	dirsMu sync.Mutex
+	dirs   map[string]bool
+}
+
+var _ webdav.FileSystem = (*fileSystem)(nil)
+
+func newFileSystem(server *network.FileServer) *fileSystem {
+	return &fileSystem{server: server, dirs: make(map[string]bool)}
+}
+
+// keyOf returns the key of a WebDAV path, "" for the root
+func keyOf(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// readable reports whether the caller may read key
+func readable(ctx context.Context, key string) bool {
+	k, ok := requestKey(ctx)
+	if !ok {
+		return true
+	}
+	_, ok = k.Match(grpcapi.VerbRead, key)
+	return ok
+}
+
+// writable reports whether the caller may write key
+func writable(ctx context.Context, key string) bool {
+	k, ok := requestKey(ctx)
+	if !ok {
+		return true
+	}
+	_, ok = k.Match(grpcapi.VerbWrite, key)
+	return ok
+}
+
+// pathError wraps err so the WebDAV handler recognizes it, as it only
+// looks inside *os.PathError
+func pathError(op, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, network.ErrNotFound):
+		err = fs.ErrNotExist
+	case errors.Is(err, network.ErrLegalHold), errors.Is(err, network.ErrRetention):
+		err = fs.ErrPermission
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// entry is a file or folder in a listing
+type entry struct {
+	key     string
+	size    int64 // size of the content, without the encryption overhead
+	modTime time.Time
+	dir     bool
+}
+
+// fileInfo describes an entry for the WebDAV handler
+type fileInfo struct {
+	entry
+}
+
+func (fi fileInfo) Name() string {
+	if fi.key == "" {
+		return "/"
+	}
+	return path.Base(fi.key)
+}
+
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() any           { return nil }
+
+// ContentType guesses the type from the extension only, so listings do
+// not read every file
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(fi.key)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// list returns the entries directly in folder dir that the caller may see.
+// A key that is also a folder, such as the manifest of a tree stored with
+// StoreDir, shows up as the folder. A folder is visible if anything below
+// it is.
+func (fsys *fileSystem) list(ctx context.Context, dir string) (map[string]entry, error) {
+	files, err := fsys.files()
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	entries := make(map[string]entry)
+	addDir := func(name string, modTime time.Time) {
+		e := entries[name]
+		if !e.dir || modTime.After(e.modTime) {
+			entries[name] = entry{key: prefix + name, modTime: modTime, dir: true}
+		}
+	}
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Key, prefix)
+		if !ok || rest == "" || !readable(ctx, f.Key) {
+			continue
+		}
+		if name, _, nested := strings.Cut(rest, "/"); nested {
+			addDir(name, f.ModTime)
+		} else if !entries[name].dir {
+			entries[name] = entry{key: f.Key, size: max(f.Size-crypto.Overhead, 0), modTime: f.ModTime}
+		}
+	}
+
+	fsys.dirsMu.Lock()
+	defer fsys.dirsMu.Unlock()
+	for d := range fsys.dirs {
+		if rest, ok := strings.CutPrefix(d, prefix); ok && rest != "" {
+			name, _, _ := strings.Cut(rest, "/")
+			addDir(name, time.Time{})
+		}
+	}
+	return entries, nil
+}
+
+// files returns the stored files
+func (fsys *fileSystem) files() ([]storage.FileInfo, error) {
+	fsys.listMu.Lock()
+	defer fsys.listMu.Unlock()
+	if fsys.listed != nil && time.Since(fsys.listedAt) < time.Second {
+		return fsys.listed, nil
+	}
+	files, err := fsys.server.ListFiles(fsys.server.ID)
+	if err != nil {
+		return nil, err
+	}
+	fsys.listed, fsys.listedAt = files, time.Now()
+	return files, nil
+}
+
+// changed drops the cached listing after a change through WebDAV
+func (fsys *fileSystem) changed() {
+	fsys.listMu.Lock()
+	defer fsys.listMu.Unlock()
+	fsys.listed = nil
+}
+
+// stat returns the entry of key
+func (fsys *fileSystem) stat(ctx context.Context, key string) (entry, error) {
+	if key == "" {
+		return entry{dir: true}, nil
+	}
+	dir, name := path.Split(key)
+	entries, err := fsys.list(ctx, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return entry{}, err
+	}
+	e, ok := entries[name]
+	if !ok {
+		return entry{}, fs.ErrNotExist
+	}
+	return e, nil
+}
+
+func (fsys *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	e, err := fsys.stat(ctx, keyOf(name))
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fileInfo{e}, nil
+}
+
+func (fsys *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key := keyOf(name)
+	if key == "" {
+		return pathError("mkdir", name, fs.ErrExist)
+	}
+	if !writable(ctx, key) {
+		return pathError("mkdir", name, fs.ErrPermission)
+	}
+	if _, err := fsys.stat(ctx, key); err == nil {
+		return pathError("mkdir", name, fs.ErrExist)
+	}
+	fsys.dirsMu.Lock()
+	defer fsys.dirsMu.Unlock()
+	fsys.dirs[key] = true
+	return nil
+}
+
+func (fsys *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	key := keyOf(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if key == "" {
+			return nil, pathError("open", name, fs.ErrInvalid)
+		}
+		if e, err := fsys.stat(ctx, key); err == nil && e.dir {
+			return nil, pathError("open", name, fs.ErrExist)
+		}
+		if !writable(ctx, key) {
+			return nil, pathError("open", name, fs.ErrPermission)
+		}
+		return newWriteFile(ctx, fsys, key), nil
+	}
+
+	e, err := fsys.stat(ctx, key)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if e.dir {
+		return &dirFile{fsys: fsys, ctx: ctx, info: fileInfo{e}}, nil
+	}
+	return &readFile{server: fsys.server, ctx: ctx, info: fileInfo{e}}, nil
+}
+
+// RemoveAll deletes a file, or a folder with every key below it. Nothing is
+// deleted if the caller may not delete all of them.
+func (fsys *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	key := keyOf(name)
+	if key == "" {
+		return pathError("remove", name, fs.ErrPermission)
+	}
+	e, err := fsys.stat(ctx, key)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	defer fsys.changed()
+	if !e.dir {
+		if !writable(ctx, key) {
+			return pathError("remove", name, fs.ErrPermission)
+		}
+		return pathError("remove", name, fsys.server.DeleteContext(ctx, key))
+	}
+
+	files, err := fsys.files()
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	var keys []string
+	for _, f := range files {
+		if f.Key == key || strings.HasPrefix(f.Key, key+"/") {
+			if !writable(ctx, f.Key) {
+				return pathError("remove", name, fs.ErrPermission)
+			}
+			keys = append(keys, f.Key)
+		}
+	}
+	for _, k := range keys {
+		if err := fsys.server.DeleteContext(ctx, k); err != nil {
+			return pathError("remove", name, err)
+		}
+	}
+
+	fsys.dirsMu.Lock()
+	defer fsys.dirsMu.Unlock()
+	for d := range fsys.dirs {
+		if d == key || strings.HasPrefix(d, key+"/") {
+			delete(fsys.dirs, d)
+		}
+	}
+	return nil
+}
+
+// Rename stores the content of a file under its new key and deletes the
+// old one. Folders cannot be renamed, as that would rewrite every key
+// below them.
+func (fsys *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := keyOf(oldName), keyOf(newName)
+	e, err := fsys.stat(ctx, from)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	if e.dir {
+		return pathError("rename", oldName, fs.ErrPermission)
+	}
+
+	f, err := fsys.server.Open(ctx, from)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	defer f.Close()
+	defer fsys.changed()
+	if err := fsys.server.Store(ctx, to, f); err != nil {
+		return pathError("rename", newName, err)
+	}
+	if err := fsys.server.DeleteContext(ctx, from); err != nil {
+		return pathError("rename", oldName, err)
+	}
+	return nil
+}
+
+// readFile is a stored file opened for reading. Reads and seeks go
+// straight to the requested offset, so range requests on large files only
+// read the requested part. The stored file is opened on the first read or
+// seek, as a PROPFIND opens every file it lists.
+type readFile struct {
+	server *network.FileServer
+	ctx    context.Context
+	info   fileInfo
+	f      *network.File
+}
+
+// open opens the stored file if it is not yet
+func (f *readFile) open() error {
+	if f.f != nil {
+		return nil
+	}
+	file, err := f.server.Open(f.ctx, f.info.key)
+	if err != nil {
+		return pathError("open", f.info.key, err)
+	}
+	f.f = file
+	return nil
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.Read(p)
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.Seek(offset, whence)
+}
+
+func (f *readFile) Close() error {
+	if f.f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
+
+func (f *readFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, pathError("readdir", f.info.key, fs.ErrInvalid)
+}
+
+func (f *readFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, pathError("write", f.info.key, fs.ErrPermission)
+}
+
+// writeFile is a file being uploaded. What is written streams to Store,
+// which completes when the file is closed.
+type writeFile struct {
+	fsys *fileSystem
+	key  string
+	pw   *io.PipeWriter
+	done chan error
+
+	mu      sync.Mutex
+	written int64
+}
+
+func newWriteFile(ctx context.Context, fsys *fileSystem, key string) *writeFile {
+	pr, pw := io.Pipe()
+	f := &writeFile{fsys: fsys, key: key, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := fsys.server.Store(ctx, key, pr)
+		// Unblock writes if Store gave up before the end of the upload
+		pr.CloseWithError(errors.Join(err, io.ErrClosedPipe))
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	n, err := f.pw.Write(p)
+	f.mu.Lock()
+	f.written += int64(n)
+	f.mu.Unlock()
+	return n, err
+}
+
+// Close finishes the upload and returns once the file is stored
+func (f *writeFile) Close() error {
+	f.pw.Close()
+	err := <-f.done
+	f.fsys.changed()
+	if err != nil {
+		return pathError("store", f.key, err)
+	}
+	return nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, pathError("read", f.key, fs.ErrInvalid)
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, pathError("seek", f.key, fs.ErrInvalid)
+}
+
+func (f *writeFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, pathError("readdir", f.key, fs.ErrInvalid)
+}
+
+func (f *writeFile) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fileInfo{entry{key: f.key, size: f.written, modTime: time.Now()}}, nil
+}
+
+// dirFile is an open folder
+type dirFile struct {
+	fsys *fileSystem
+	ctx  context.Context
+	info fileInfo
+
+	entries []fs.FileInfo // listed on the first Readdir
+	listed  bool
+}
+
+func (d *dirFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.fsys.list(d.ctx, d.info.key)
+		if err != nil {
+			return nil, pathError("readdir", d.info.key, err)
+		}
+		for _, e := range entries {
+			d.entries = append(d.entries, fileInfo{e})
+		}
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].Name() < d.entries[j].Name()
+		})
+		d.listed = true
+	}
+
+	if count <= 0 {
+		rest := d.entries
+		d.entries = nil
+		return rest, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	batch := d.entries[:n]
+	d.entries = d.entries[n:]
+	return batch, nil
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, pathError("read", d.info.key, fs.ErrInvalid)
+}
+
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, pathError("seek", d.info.key, fs.ErrInvalid)
+}
+
+func (d *dirFile) Write(p []byte) (int, error) {
+	return 0, pathError("write", d.info.key, fs.ErrInvalid)
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
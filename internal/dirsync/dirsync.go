@@ -0,0 +1,369 @@
+package dirsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+)
+
+// defaultDebounce is how long a file must stay unchanged before it is
+// stored when Options.Debounce is zero
+const defaultDebounce = 500 * time.Millisecond
+
+// Options configures a synced directory
+type Options struct {
+	Prefix   string        // Namespace the files are stored under, e.g. "laptop/"
+	Debounce time.Duration // Time a file must stay unchanged before it is stored
+	Logger   *slog.Logger
+}
+
+// fileState is what was last stored for a file
+type fileState struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Syncer keeps a local directory stored on the node. It is one-way: new
+// and changed files are stored, deleted files are deleted from the vault,
+// and changes made in the vault are not written back.
+type Syncer struct {
+	server    *network.FileServer
+	dir       string
+	opts      Options
+	statePath string
+
+	// Files as last stored, by path relative to dir. Only the Run loop
+	// touches it after New.
+	state map[string]fileState
+}
+
+// New prepares syncing dir to server. The hashes of the files already
+// stored are kept in a state file in the node's storage directory, so
+// files that did not change are not stored again after a restart.
+func New(server *network.FileServer, dir string, opts Options) (*Syncer, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Debounce == 0 {
+		opts.Debounce = defaultDebounce
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	s := &Syncer{
+		server:    server,
+		dir:       dir,
+		opts:      opts,
+		statePath: filepath.Join(server.StorageRoot, "sync-"+crypto.HashKey(opts.Prefix + dir)[:16]+".json"),
+		state:     make(map[string]fileState),
+	}
+	data, err := os.ReadFile(s.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("corrupt sync state %s: %w", s.statePath, err)
+		}
+	}
+	return s, nil
+}
+
+// Run stores what changed since the last run, then watches the directory
+// until ctx is cancelled. Changes are stored once a file has not changed
+// for the debounce time, so files being written are stored once.
+func (s *Syncer) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Watch before scanning, so nothing changing during the scan is missed
+	if err := s.watch(watcher, s.dir); err != nil {
+		return err
+	}
+	if err := s.Scan(ctx); err != nil {
+		return err
+	}
+	s.opts.Logger.Info("syncing directory", "dir", s.dir, "files", len(s.state))
+
+	pending := make(map[string]time.Time)
+	ticker := time.NewTicker(s.opts.Debounce / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			rel, err := filepath.Rel(s.dir, event.Name)
+			if err != nil || ignored(rel) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				// Directories need their own watch, and may already hold files
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err := s.watch(watcher, event.Name); err != nil {
+						s.opts.Logger.Warn("cannot watch directory", "dir", event.Name, "err", err)
+					}
+				}
+			}
+			pending[rel] = time.Now()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Events were dropped, so compare everything again
+			s.opts.Logger.Warn("directory watch failed, rescanning", "dir", s.dir, "err", err)
+			if err := s.Scan(ctx); err != nil {
+				s.opts.Logger.Error("failed to rescan synced directory", "dir", s.dir, "err", err)
+			}
+
+		case now := <-ticker.C:
+			var ready []string
+			for rel, changed := range pending {
+				if now.Sub(changed) >= s.opts.Debounce {
+					ready = append(ready, rel)
+					delete(pending, rel)
+				}
+			}
+			sort.Strings(ready)
+			for _, rel := range ready {
+				if err := s.sync(ctx, rel); err != nil {
+					s.opts.Logger.Error("failed to sync file", "path", rel, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// Scan compares the whole directory with the state file, storing new and
+// changed files and deleting the keys of removed ones
+func (s *Syncer) Scan(ctx context.Context) error {
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.dir, path)
+		if rel == "." {
+			return nil
+		}
+		if ignored(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		seen[rel] = true
+		if err := s.sync(ctx, rel); err != nil {
+			s.opts.Logger.Error("failed to sync file", "path", rel, "err", err)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	for rel := range s.state {
+		if !seen[rel] {
+			if err := s.sync(ctx, rel); err != nil {
+				s.opts.Logger.Error("failed to sync file", "path", rel, "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sync brings the vault in line with path rel: it stores the file if it
+// changed, or deletes its key, and every key below it, if it is gone
+func (s *Syncer) sync(ctx context.Context, rel string) error {
+	path := filepath.Join(s.dir, rel)
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return s.remove(ctx, rel)
+	case err != nil:
+		return err
+	case info.IsDir():
+		// A directory moved in: store what it holds
+		return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			child, _ := filepath.Rel(s.dir, p)
+			if ignored(child) {
+				return nil
+			}
+			return s.store(ctx, child)
+		})
+	case !info.Mode().IsRegular():
+		return nil
+	}
+	return s.store(ctx, rel)
+}
+
+// store stores file rel unless its content is the one stored last
+func (s *Syncer) store(ctx context.Context, rel string) error {
+	path := filepath.Join(s.dir, rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	prev, known := s.state[rel]
+	if known && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	next := fileState{Hash: hash, Size: info.Size(), ModTime: info.ModTime()}
+	if known && prev.Hash == hash {
+		// Touched but not changed
+		s.state[rel] = next
+		return s.save()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	key := s.key(rel)
+	if err := s.server.Store(ctx, key, f); err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	s.opts.Logger.Info("synced file", "path", rel, "key", key, "size", info.Size())
+	s.state[rel] = next
+	return s.save()
+}
+
+// remove deletes the key of rel, or of every file below it if rel was a
+// directory, from the vault
+func (s *Syncer) remove(ctx context.Context, rel string) error {
+	var gone []string
+	for known := range s.state {
+		if known == rel || strings.HasPrefix(known, rel+string(filepath.Separator)) {
+			gone = append(gone, known)
+		}
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	sort.Strings(gone)
+
+	var errs []error
+	for _, known := range gone {
+		key := s.key(known)
+		err := s.server.DeleteContext(ctx, key)
+		switch {
+		case err == nil, errors.Is(err, network.ErrNotFound):
+			s.opts.Logger.Info("deleted synced file", "path", known, "key", key)
+		case errors.Is(err, network.ErrLegalHold), errors.Is(err, network.ErrRetention):
+			// Trying again would fail the same way, so stop tracking it
+			s.opts.Logger.Warn("synced file was deleted locally but is kept in the vault", "path", known, "key", key, "err", err)
+		default:
+			errs = append(errs, fmt.Errorf("failed to delete %s: %w", key, err))
+			continue
+		}
+		delete(s.state, known)
+	}
+	if err := s.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// key is the key file rel is stored under
+func (s *Syncer) key(rel string) string {
+	return s.opts.Prefix + filepath.ToSlash(rel)
+}
+
+// watch adds a watch for dir and every directory below it
+func (s *Syncer) watch(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if rel, _ := filepath.Rel(s.dir, path); rel != "." && ignored(rel) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// save writes the state file
+func (s *Syncer) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.statePath), 0755); err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath)
+}
+
+// ignored reports whether path rel is left out of the sync: temporary
+// files of editors, and files and directories starting with a dot
+func ignored(rel string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	name := filepath.Base(rel)
+	return strings.HasSuffix(name, "~") || strings.HasSuffix(name, ".swp") || strings.HasSuffix(name, ".tmp")
+}
+
+// hashFile returns the SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
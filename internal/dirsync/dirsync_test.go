@@ -0,0 +1,122 @@
+package dirsync
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+func newTestNode(t *testing.T) *network.FileServer {
+	root := filepath.Join(os.TempDir(), "pv_dirsync_node")
+	os.RemoveAll(root)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	encKey, _ := crypto.NewEncryptionKey()
+	fs, err := network.NewFileServer(network.FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+		FetchTimeout:      100 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	fs.Transport = p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5940",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	return fs
+}
+
+// content returns what is stored under key, or "" if nothing is
+func content(fs *network.FileServer, key string) string {
+	r, err := fs.Get(context.Background(), key)
+	if err != nil {
+		return ""
+	}
+	data, _ := io.ReadAll(r)
+	return string(data)
+}
+
+func TestIgnored(t *testing.T) {
+	assert.False(t, ignored("docs/report.pdf"))
+	assert.True(t, ignored(".git/config"))
+	assert.True(t, ignored("docs/.report.pdf.swp"))
+	assert.True(t, ignored("notes.txt~"))
+	assert.True(t, ignored("download.tmp"))
+}
+
+func TestScanStoresChangesOnly(t *testing.T) {
+	fs := newTestNode(t)
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "docs"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "docs", "b.txt"), []byte("b"), 0644))
+
+	s, err := New(fs, dir, Options{Prefix: "laptop/"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Scan(context.Background()))
+	assert.Equal(t, "a", content(fs, "laptop/a.txt"))
+	assert.Equal(t, "b", content(fs, "laptop/docs/b.txt"))
+
+	// The state survives a restart: a touched file is not stored again,
+	// a changed one is, and a deleted one is deleted from the vault
+	assert.Nil(t, fs.Delete("laptop/a.txt"))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "a.txt"), later, later))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "docs", "b.txt"), []byte("b2"), 0644))
+	assert.Nil(t, os.RemoveAll(filepath.Join(dir, "docs")))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "c.txt"), []byte("c"), 0644))
+
+	s, err = New(fs, dir, Options{Prefix: "laptop/"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Scan(context.Background()))
+	assert.Equal(t, "", content(fs, "laptop/a.txt"))
+	assert.Equal(t, "", content(fs, "laptop/docs/b.txt"))
+	assert.Equal(t, "c", content(fs, "laptop/c.txt"))
+	assert.Len(t, s.state, 2)
+}
+
+func TestRunWatchesDirectory(t *testing.T) {
+	fs := newTestNode(t)
+	dir := t.TempDir()
+	s, err := New(fs, dir, Options{Debounce: 50 * time.Millisecond})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// Files in new directories are picked up too
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "photos"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "photos", "cat.jpg"), []byte("meow"), 0644))
+	assert.Eventually(t, func() bool {
+		return content(fs, "photos/cat.jpg") == "meow"
+	}, 2*time.Second, 50*time.Millisecond)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "photos", "cat.jpg"), []byte("purr"), 0644))
+	assert.Eventually(t, func() bool {
+		return content(fs, "photos/cat.jpg") == "purr"
+	}, 2*time.Second, 50*time.Millisecond)
+
+	assert.Nil(t, os.RemoveAll(filepath.Join(dir, "photos")))
+	assert.Eventually(t, func() bool {
+		return content(fs, "photos/cat.jpg") == ""
+	}, 2*time.Second, 50*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
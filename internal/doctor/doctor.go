@@ -0,0 +1,333 @@
+package doctor
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// Status is the outcome of a check
+type Status int
+
+const (
+	OK Status = iota
+	Warn
+	Fail
+	Skipped
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Warn:
+		return "warn"
+	case Fail:
+		return "fail"
+	default:
+		return "skip"
+	}
+}
+
+// Finding is the result of one check, with what to do about it
+type Finding struct {
+	Check  string
+	Status Status
+	Detail string
+	Advice string // empty when there is nothing to do
+}
+
+// Options describes the node to diagnose
+type Options struct {
+	Server        *network.FileServer
+	Port          int      // TCP port peers connect to
+	Key           []byte   // network encryption key
+	KeyHex        bool     // the key was given as 64 hex digits
+	Discovery     bool     // mDNS discovery is enabled
+	GRPCAddr      string   // gRPC API address, if served over TCP
+	WebDAVAddr    string   // WebDAV address, if served
+	RequireAPIKey bool     // API keys are required over TCP
+	STUNServers   []string // DefaultSTUNServers if empty
+	DiskTestSize  int64    // bytes written to measure disk speed, 64 MB if zero
+}
+
+// Thresholds of the checks
+const (
+	maxClockSkew    = time.Second      // receipts and tokens carry timestamps
+	badClockSkew    = 30 * time.Second // guest tokens and bans expire noticeably early or late
+	minDiskSpeed    = 20 << 20         // bytes per second
+	defaultDiskTest = 64 << 20
+)
+
+// Run runs every check against the node. Checks that talk to peers need
+// the node to be started and connected.
+func Run(ctx context.Context, opts Options) []Finding {
+	if len(opts.STUNServers) == 0 {
+		opts.STUNServers = DefaultSTUNServers
+	}
+	if opts.DiskTestSize == 0 {
+		opts.DiskTestSize = defaultDiskTest
+	}
+	return []Finding{
+		checkReachability(ctx, opts),
+		checkNAT(ctx, opts),
+		checkMDNS(ctx, opts),
+		checkClockSkew(opts),
+		checkDisk(opts),
+		checkKey(opts),
+		checkIdentity(opts),
+		checkAPIExposure(opts),
+	}
+}
+
+// checkReachability asks the connected peers to connect back to the node
+func checkReachability(ctx context.Context, opts Options) Finding {
+	f := Finding{Check: "Port reachability"}
+	if _, ok := opts.Server.Transport.(*p2p.TCPTransport); !ok {
+		f.Status, f.Detail = Skipped, "only TCP transports can be probed"
+		return f
+	}
+	results, err := opts.Server.ProbeReachability(ctx, opts.Port)
+	if err != nil {
+		f.Status, f.Detail = Fail, err.Error()
+		return f
+	}
+	if len(results) == 0 {
+		f.Status, f.Detail = Skipped, "no connected peer answered"
+		f.Advice = "Connect to a peer outside this network with -bootstrap and run doctor again"
+		return f
+	}
+
+	var reached, failed []string
+	for _, r := range results {
+		if r.Reachable {
+			reached = append(reached, r.Peer)
+		} else {
+			failed = append(failed, fmt.Sprintf("%s could not connect to %s (%s)", r.Peer, r.Addr, r.Err))
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		f.Status, f.Detail = OK, fmt.Sprintf("port %d reached from %d peers", opts.Port, len(reached))
+	case len(reached) == 0:
+		f.Status, f.Detail = Fail, strings.Join(failed, "; ")
+		f.Advice = fmt.Sprintf("Open TCP port %d in the firewall and forward it on the router to this machine, or peers can only reach this node through connections it opens", opts.Port)
+	default:
+		f.Status, f.Detail = Warn, fmt.Sprintf("reached from %d peers; %s", len(reached), strings.Join(failed, "; "))
+		f.Advice = fmt.Sprintf("Some networks cannot reach TCP port %d; check the firewall and port forwarding for the addresses above", opts.Port)
+	}
+	return f
+}
+
+// checkNAT finds out how the node's router maps connections
+func checkNAT(ctx context.Context, opts Options) Finding {
+	f := Finding{Check: "NAT type"}
+	info, err := DetectNAT(ctx, opts.STUNServers)
+	if err != nil {
+		f.Status, f.Detail = Warn, "STUN servers did not answer: "+err.Error()
+		f.Advice = "Outgoing UDP may be blocked; the NAT type cannot be determined"
+		return f
+	}
+	switch info.Type {
+	case NATNone:
+		f.Status, f.Detail = OK, "public address "+info.Mapped[0]+", no NAT"
+	case NATCone:
+		f.Status, f.Detail = OK, "behind a NAT with a stable mapping, public address "+info.Mapped[0]
+		f.Advice = fmt.Sprintf("Forward TCP port %d to this machine and use -advertise with the public address so peers elsewhere can connect", opts.Port)
+	case NATSymmetric:
+		f.Status, f.Detail = Warn, "behind a symmetric NAT, seen as "+strings.Join(info.Mapped, " and ")
+		f.Advice = fmt.Sprintf("Peers outside this network can only connect if TCP port %d is forwarded to this machine; otherwise bootstrap to a reachable node", opts.Port)
+	}
+	return f
+}
+
+// checkMDNS looks for PeerVault nodes on the local network
+func checkMDNS(ctx context.Context, opts Options) Finding {
+	f := Finding{Check: "mDNS discovery"}
+	entries := make(chan *mdns.ServiceEntry, 32)
+	found := make(map[string]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range entries {
+			found[e.Name] = true
+		}
+	}()
+	err := mdns.QueryContext(ctx, &mdns.QueryParam{
+		Service:     network.ServiceType,
+		Domain:      network.ServiceDomain,
+		Timeout:     2 * time.Second,
+		Entries:     entries,
+		DisableIPv6: true,
+		Logger:      log.New(io.Discard, "", 0),
+	})
+	close(entries)
+	<-done
+
+	switch {
+	case err != nil:
+		f.Status, f.Detail = Fail, "cannot send mDNS queries: "+err.Error()
+		f.Advice = "Multicast is not available on this machine; connect to peers with -bootstrap instead"
+	case len(found) == 0 && opts.Discovery:
+		f.Status, f.Detail = Warn, "no answers, not even from this node"
+		f.Advice = "Multicast traffic (UDP port 5353) is probably blocked by a firewall or the Wi-Fi access point"
+	case len(found) == 0:
+		f.Status, f.Detail = OK, "no PeerVault nodes announce themselves on this network"
+		f.Advice = "Start nodes with -discover-local to find each other on the LAN"
+	case !opts.Discovery:
+		f.Status, f.Detail = Warn, fmt.Sprintf("%d nodes announce themselves, but local discovery is off", len(found))
+		f.Advice = "Start with -discover-local to connect to them automatically"
+	default:
+		f.Status, f.Detail = OK, fmt.Sprintf("%d nodes answered, including this one", len(found))
+	}
+	return f
+}
+
+// checkClockSkew compares this node's clock with its peers'
+func checkClockSkew(opts Options) Finding {
+	f := Finding{Check: "Clock skew"}
+	var worst time.Duration
+	worstNode := ""
+	for _, p := range opts.Server.PeerPaths() {
+		if p.RTT == 0 {
+			continue
+		}
+		if skew := p.ClockSkew.Abs(); skew >= worst {
+			worst, worstNode = skew, p.Node
+		}
+	}
+	switch {
+	case worstNode == "":
+		f.Status, f.Detail = Skipped, "no peer clock measured yet"
+	case worst < maxClockSkew:
+		f.Status, f.Detail = OK, fmt.Sprintf("within %v of every peer", worst.Round(time.Millisecond))
+	default:
+		f.Status, f.Detail = Warn, fmt.Sprintf("%v apart from node %s", worst.Round(time.Millisecond), worstNode)
+		if worst >= badClockSkew {
+			f.Status = Fail
+		}
+		f.Advice = "Enable time synchronization (NTP) on both machines, e.g. timedatectl set-ntp true; receipts, guest tokens and bans depend on the time"
+	}
+	return f
+}
+
+// checkDisk measures how fast the storage directory takes writes
+func checkDisk(opts Options) Finding {
+	f := Finding{Check: "Disk write speed"}
+	if err := os.MkdirAll(opts.Server.StorageRoot, 0755); err != nil {
+		f.Status, f.Detail = Fail, err.Error()
+		return f
+	}
+	tmp, err := os.CreateTemp(opts.Server.StorageRoot, "doctor-*.tmp")
+	if err != nil {
+		f.Status, f.Detail = Fail, "cannot write to the storage directory: "+err.Error()
+		f.Advice = "Check the permissions of " + opts.Server.StorageRoot
+		return f
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	start := time.Now()
+	if _, err := io.CopyN(tmp, rand.Reader, opts.DiskTestSize); err != nil {
+		f.Status, f.Detail = Fail, err.Error()
+		return f
+	}
+	if err := tmp.Sync(); err != nil {
+		f.Status, f.Detail = Fail, err.Error()
+		return f
+	}
+	elapsed := time.Since(start)
+	speed := float64(opts.DiskTestSize) / elapsed.Seconds()
+
+	f.Status, f.Detail = OK, fmt.Sprintf("%.0f MB/s to %s", speed/(1<<20), opts.Server.StorageRoot)
+	if speed < minDiskSpeed {
+		f.Status = Warn
+		f.Advice = "Storing and replicating large files will be slow; move -storage to a faster disk"
+	}
+	return f
+}
+
+// checkKey looks for weak network keys
+func checkKey(opts Options) Finding {
+	f := Finding{Check: "Encryption key"}
+	distinct := make(map[byte]bool)
+	for _, b := range opts.Key {
+		distinct[b] = true
+	}
+	switch {
+	case len(distinct) < 16:
+		f.Status, f.Detail = Fail, fmt.Sprintf("the key has only %d distinct bytes", len(distinct))
+		f.Advice = "Generate a random key with: openssl rand -hex 32, and re-encrypt the vault with it"
+	case !opts.KeyHex:
+		f.Status, f.Detail = Warn, "the key is 32 characters of text"
+		f.Advice = "Text keys are easier to guess than random ones; prefer 64 hex digits from: openssl rand -hex 32"
+	default:
+		f.Status, f.Detail = OK, "random 256-bit key"
+	}
+	return f
+}
+
+// checkIdentity checks that the node's signing key is private
+func checkIdentity(opts Options) Finding {
+	f := Finding{Check: "Key files"}
+	var open []string
+	for _, name := range []string{"node.id", "identity.key", "device.key", "apikeys.json"} {
+		info, err := os.Stat(filepath.Join(opts.Server.StorageRoot, name))
+		if err == nil && info.Mode().Perm()&0077 != 0 {
+			open = append(open, fmt.Sprintf("%s (%v)", name, info.Mode().Perm()))
+		}
+	}
+	if len(open) > 0 {
+		f.Status, f.Detail = Warn, "readable by other users: "+strings.Join(open, ", ")
+		f.Advice = "Run chmod 600 on them in " + opts.Server.StorageRoot
+		return f
+	}
+	f.Status, f.Detail = OK, "only readable by their owner"
+	return f
+}
+
+// checkAPIExposure warns about APIs open to the network without keys
+func checkAPIExposure(opts Options) Finding {
+	f := Finding{Check: "API access"}
+	var exposed []string
+	for _, api := range [][2]string{{"gRPC", opts.GRPCAddr}, {"WebDAV", opts.WebDAVAddr}} {
+		if addr := api[1]; addr != "" && !isLoopback(addr) {
+			exposed = append(exposed, api[0]+" on "+addr)
+		}
+	}
+	switch {
+	case len(exposed) == 0:
+		f.Status, f.Detail = OK, "no API is served beyond this machine"
+	case opts.RequireAPIKey:
+		f.Status, f.Detail = OK, strings.Join(exposed, ", ")+", API keys required"
+	default:
+		f.Status, f.Detail = Warn, strings.Join(exposed, ", ")+" without requiring API keys"
+		f.Advice = "Anyone who can reach these addresses has full access; set -require-api-key and issue keys with apikey issue"
+	}
+	return f
+}
+
+// isLoopback reports whether a listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
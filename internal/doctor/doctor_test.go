@@ -0,0 +1,89 @@
+package doctor
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveSTUN answers binding requests on a local UDP port with the address
+// they came from, as a STUN server does
+func serveSTUN(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < stunHeaderSize {
+				continue
+			}
+			resp := make([]byte, stunHeaderSize+12)
+			binary.BigEndian.PutUint16(resp[0:], stunBindingResponse)
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:20], buf[4:20])
+			attr := resp[stunHeaderSize:]
+			binary.BigEndian.PutUint16(attr[0:], stunXorMappedAddr)
+			binary.BigEndian.PutUint16(attr[2:], 8)
+			attr[5] = 0x01
+			binary.BigEndian.PutUint16(attr[6:], uint16(from.Port)^stunMagicCookie>>16)
+			binary.BigEndian.PutUint32(attr[8:], binary.BigEndian.Uint32(from.IP.To4())^stunMagicCookie)
+			conn.WriteToUDP(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDetectNAT(t *testing.T) {
+	info, err := DetectNAT(context.Background(), []string{serveSTUN(t), serveSTUN(t)})
+	assert.Nil(t, err)
+	assert.Len(t, info.Mapped, 2)
+	assert.Equal(t, info.Mapped[0], info.Mapped[1])
+	host, _, _ := net.SplitHostPort(info.Mapped[0])
+	assert.Equal(t, "127.0.0.1", host)
+	assert.Equal(t, NATNone, info.Type)
+}
+
+func TestParseBindingResponse(t *testing.T) {
+	msg := make([]byte, stunHeaderSize+12)
+	binary.BigEndian.PutUint16(msg[0:], stunBindingResponse)
+	attr := msg[stunHeaderSize:]
+	binary.BigEndian.PutUint16(attr[0:], stunMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:], 8)
+	attr[5] = 0x01
+	binary.BigEndian.PutUint16(attr[6:], 3000)
+	copy(attr[8:], net.IPv4(203, 0, 113, 7).To4())
+
+	addr, err := parseBindingResponse(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7:3000", addr.String())
+
+	_, err = parseBindingResponse(msg[:stunHeaderSize])
+	assert.NotNil(t, err)
+}
+
+func TestCheckKey(t *testing.T) {
+	random := make([]byte, 32)
+	for i := range random {
+		random[i] = byte(i * 7)
+	}
+	assert.Equal(t, OK, checkKey(Options{Key: random, KeyHex: true}).Status)
+	assert.Equal(t, Warn, checkKey(Options{Key: random}).Status)
+	assert.Equal(t, Fail, checkKey(Options{Key: []byte("00000000000000000000000000000000"), KeyHex: false}).Status)
+}
+
+func TestCheckAPIExposure(t *testing.T) {
+	assert.Equal(t, OK, checkAPIExposure(Options{GRPCAddr: "127.0.0.1:9000", WebDAVAddr: "localhost:8080"}).Status)
+	f := checkAPIExposure(Options{GRPCAddr: ":9000"})
+	assert.Equal(t, Warn, f.Status)
+	assert.Contains(t, f.Detail, "gRPC on :9000")
+	assert.Equal(t, OK, checkAPIExposure(Options{WebDAVAddr: ":8080", RequireAPIKey: true}).Status)
+}
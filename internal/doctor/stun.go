@@ -0,0 +1,179 @@
+package doctor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultSTUNServers are asked for this node's public address. Two servers
+// are needed to tell symmetric NATs from the others.
+var DefaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+// NAT types reported by DetectNAT
+const (
+	NATNone      = "none"      // the node has a public address
+	NATCone      = "cone"      // one public address and port for every destination
+	NATSymmetric = "symmetric" // a new public port for every destination
+)
+
+// STUN message types and attributes, RFC 5389
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunMappedAddress   = 0x0001
+	stunXorMappedAddr   = 0x0020
+	stunHeaderSize      = 20
+)
+
+// NATInfo is what the STUN servers saw of this node
+type NATInfo struct {
+	Type   string
+	Mapped []string // public address:port as seen by each server that answered
+}
+
+// DetectNAT asks the STUN servers for the public address of one UDP socket.
+// If every server sees the same address the NAT keeps one mapping per
+// socket, and peers can reach the node once its port is forwarded;
+// different addresses mean a symmetric NAT.
+func DetectNAT(ctx context.Context, servers []string) (NATInfo, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return NATInfo{}, err
+	}
+	defer conn.Close()
+
+	var info NATInfo
+	var errs []string
+	for _, server := range servers {
+		mapped, err := stunBinding(ctx, conn, server)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", server, err))
+			continue
+		}
+		info.Mapped = append(info.Mapped, mapped.String())
+	}
+	if len(info.Mapped) == 0 {
+		return info, errors.New(strings.Join(errs, "; "))
+	}
+
+	host, _, _ := net.SplitHostPort(info.Mapped[0])
+	switch {
+	case isLocalIP(net.ParseIP(host)):
+		info.Type = NATNone
+	case len(info.Mapped) > 1 && info.Mapped[0] != info.Mapped[1]:
+		info.Type = NATSymmetric
+	default:
+		info.Type = NATCone
+	}
+	return info, nil
+}
+
+// stunBinding sends a binding request to server and returns the address
+// it saw the request come from
+func stunBinding(ctx context.Context, conn *net.UDPConn, server string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetWriteDeadline(deadline)
+
+	// UDP may drop the request, so send it a few times
+	buf := make([]byte, 1024)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := conn.WriteToUDP(req, addr); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(time.Second)
+		if deadline.Before(wait) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break // try again, or give up at the deadline
+			}
+			if !from.IP.Equal(addr.IP) || n < stunHeaderSize || string(buf[8:20]) != string(req[8:20]) {
+				continue // not the answer to this request
+			}
+			return parseBindingResponse(buf[:n])
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+	}
+	return nil, errors.New("no answer")
+}
+
+// parseBindingResponse returns the mapped address of a binding response
+func parseBindingResponse(msg []byte) (*net.UDPAddr, error) {
+	if binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse {
+		return nil, fmt.Errorf("unexpected STUN message type %#x", binary.BigEndian.Uint16(msg[0:]))
+	}
+	attrs := msg[stunHeaderSize:]
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		length := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+length {
+			break
+		}
+		value := attrs[4 : 4+length]
+		// Only IPv4 addresses are asked for
+		if len(value) >= 8 && value[1] == 0x01 {
+			port := binary.BigEndian.Uint16(value[2:])
+			ip := net.IP(append([]byte(nil), value[4:8]...))
+			switch typ {
+			case stunXorMappedAddr:
+				port ^= stunMagicCookie >> 16
+				binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)^stunMagicCookie)
+				return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+			case stunMappedAddress:
+				mapped = &net.UDPAddr{IP: ip, Port: int(port)}
+			}
+		}
+		// Attributes are padded to 4 bytes
+		next := 4 + (length+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, errors.New("STUN response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// isLocalIP reports whether ip belongs to an interface of this machine
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil || ip == nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package events
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type identifies what happened
+type Type string
+
+const (
+	FileStored     Type = "store"       // File stored by this node
+	FileReplicated Type = "replica"     // Replica received from a peer
+	FileRetrieved  Type = "get"         // File retrieved locally or from the network
+	FileDeleted    Type = "delete"      // File deleted from this node
+	FileRestored   Type = "restore"     // Deleted file restored from the trash
+	FileOffered    Type = "offer"       // Peer offered to send a file to this node
+	FileDropped    Type = "drop"        // File sent directly to this node by a peer
+	PeerJoined     Type = "peer_join"   // Peer connected
+	PeerLeft       Type = "peer_leave"  // Peer disconnected
+	PeerDowngrade  Type = "downgrade"   // Peer refused for announcing a weaker protocol than before
+	GCFinding      Type = "gc"          // Garbage collector found or removed something
+	HoldPlaced     Type = "hold"        // Key or namespace put under legal hold
+	HoldReleased   Type = "release"     // Legal hold lifted
+	PolicyApplied  Type = "policy"      // Shared policy from an admin node applied
+	Maintenance    Type = "maintenance" // Maintenance operation started on demand finished
+	QuotaWarning   Type = "quota"       // Storage use crossed the warning share of the quota
+)
+
+// Event is a single recorded operation
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   Type      `json:"type"`
+	Key    string    `json:"key,omitempty"`
+	Peer   string    `json:"peer,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// String formats the event as a single line for terminal output
+func (e Event) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-10s", e.Time.Format("15:04:05"), e.Type)
+	if e.Key != "" {
+		fmt.Fprintf(&b, " %s", e.Key)
+	}
+	if e.Peer != "" {
+		fmt.Fprintf(&b, " peer=%s", e.Peer)
+	}
+	if e.Detail != "" {
+		fmt.Fprintf(&b, " (%s)", e.Detail)
+	}
+	return b.String()
+}
+
+// Bus keeps the most recent events in a ring buffer and fans new events
+// out to live subscribers
+type Bus struct {
+	mu     sync.Mutex
+	ring   []Event
+	next   int
+	full   bool
+	subs   map[int]subscription
+	nextID int
+}
+
+// subscription is a live subscriber and the event types it wants, every
+// type if none
+type subscription struct {
+	ch    chan Event
+	types []Type
+}
+
+// wants reports whether the subscriber asked for events of type t
+func (s subscription) wants(t Type) bool {
+	return len(s.types) == 0 || slices.Contains(s.types, t)
+}
+
+// NewBus creates a bus that remembers up to capacity events
+func NewBus(capacity int) *Bus {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &Bus{
+		ring: make([]Event, capacity),
+		subs: make(map[int]subscription),
+	}
+}
+
+// Publish records an event and delivers it to subscribers.
+// Subscribers that are not keeping up miss the event instead of blocking.
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ring[b.next] = e
+	b.next = (b.next + 1) % len(b.ring)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for _, sub := range b.subs {
+		if !sub.wants(e.Type) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+// Recent returns up to n of the latest events, oldest first
+func (b *Bus) Recent(n int) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.ring)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	out := make([]Event, 0, n)
+	for i := n; i > 0; i-- {
+		idx := (b.next - i + len(b.ring)) % len(b.ring)
+		out = append(out, b.ring[idx])
+	}
+	return out
+}
+
+// Subscribe returns a channel receiving every event of the given types
+// published from now on, of any type if none are given, and a function that
+// ends the subscription
+func (b *Bus) Subscribe(buffer int, types ...Type) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, buffer)
+	b.subs[id] = subscription{ch: ch, types: slices.Clone(types)}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs, id)
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBusRecentWrapsAround(t *testing.T) {
+	bus := NewBus(3)
+	assert.Empty(t, bus.Recent(10))
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: FileStored, Key: fmt.Sprintf("file_%d", i)})
+	}
+
+	recent := bus.Recent(10)
+	assert.Len(t, recent, 3)
+	assert.Equal(t, "file_2", recent[0].Key)
+	assert.Equal(t, "file_4", recent[2].Key)
+
+	recent = bus.Recent(1)
+	assert.Len(t, recent, 1)
+	assert.Equal(t, "file_4", recent[0].Key)
+	assert.False(t, recent[0].Time.IsZero())
+}
+
+func TestBusSubscribe(t *testing.T) {
+	bus := NewBus(10)
+	bus.Publish(Event{Type: FileStored, Key: "before"})
+
+	ch, cancel := bus.Subscribe(1)
+	bus.Publish(Event{Type: PeerJoined, Peer: "127.0.0.1:3000"})
+	// The buffer is full, so this one is dropped for the subscriber
+	bus.Publish(Event{Type: PeerLeft, Peer: "127.0.0.1:3000"})
+
+	e := <-ch
+	assert.Equal(t, PeerJoined, e.Type)
+
+	cancel()
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+	assert.Len(t, bus.Recent(0), 3)
+}
+
+func TestBusSubscribeTypes(t *testing.T) {
+	bus := NewBus(10)
+	ch, cancel := bus.Subscribe(4, FileStored, QuotaWarning)
+	defer cancel()
+
+	bus.Publish(Event{Type: PeerJoined, Peer: "127.0.0.1:3000"})
+	bus.Publish(Event{Type: FileStored, Key: "a"})
+	bus.Publish(Event{Type: FileRetrieved, Key: "a"})
+	bus.Publish(Event{Type: QuotaWarning, Detail: "91% used"})
+
+	assert.Equal(t, FileStored, (<-ch).Type)
+	assert.Equal(t, QuotaWarning, (<-ch).Type)
+	assert.Empty(t, ch)
+}
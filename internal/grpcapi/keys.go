@@ -0,0 +1,265 @@
+package grpcapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+)
+
+// Verbs an API key can be granted on a namespace
+const (
+	VerbRead  = "read"  // GetFile, and ListFiles shows the matching keys
+	VerbWrite = "write" // StoreFile
+)
+
+// keyPrefix starts every API key, so keys are easy to spot in configs
+const keyPrefix = "pvk_"
+
+// ErrInvalidKey is returned for unknown, revoked or expired API keys
+var ErrInvalidKey = errors.New("invalid API key")
+
+// Scope allows one verb on the keys matching Pattern: a key, a namespace
+// ending in "/*" such as "backups/*", or "*" for every key
+type Scope struct {
+	Verb    string `json:"verb"`
+	Pattern string `json:"pattern"`
+}
+
+// ParseScope parses "verb:pattern", e.g. "read:backups/*"
+func ParseScope(s string) (Scope, error) {
+	verb, pattern, ok := strings.Cut(s, ":")
+	if !ok || pattern == "" {
+		return Scope{}, fmt.Errorf("invalid scope %q, expected verb:pattern", s)
+	}
+	if verb != VerbRead && verb != VerbWrite {
+		return Scope{}, fmt.Errorf("invalid scope %q, verb must be %s or %s", s, VerbRead, VerbWrite)
+	}
+	return Scope{Verb: verb, Pattern: pattern}, nil
+}
+
+func (s Scope) String() string {
+	return s.Verb + ":" + s.Pattern
+}
+
+// allows reports whether the scope grants verb on key
+func (s Scope) allows(verb, key string) bool {
+	if s.Verb != verb {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(s.Pattern, "*"); ok {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == s.Pattern
+}
+
+// APIKey is an issued key. Only a hash of its secret is kept.
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scopes  []Scope   `json:"scopes"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero for keys that do not expire
+	Hash    string    `json:"hash"`
+}
+
+// Match returns the scope of the key that grants verb on key
+func (k *APIKey) Match(verb, key string) (Scope, bool) {
+	for _, s := range k.Scopes {
+		if s.allows(verb, key) {
+			return s, true
+		}
+	}
+	return Scope{}, false
+}
+
+// String identifies the key in the audit log
+func (k *APIKey) String() string {
+	return "apikey:" + k.Name + "/" + k.ID
+}
+
+// whole reports whether the key has a scope covering every key, which
+// node-wide calls such as PeerInfo require
+func (k *APIKey) whole() bool {
+	for _, s := range k.Scopes {
+		if s.Pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether the key is past its expiry
+func (k *APIKey) expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// KeyStore holds the API keys issued by a node, in apikeys.json in its
+// storage directory. Issuing and revoking keys is recorded in the node's
+// audit log.
+type KeyStore struct {
+	fs   *network.FileServer
+	path string
+
+	mu   sync.Mutex
+	keys map[string]*APIKey
+}
+
+// OpenKeyStore loads the API keys of fs
+func OpenKeyStore(fs *network.FileServer) (*KeyStore, error) {
+	ks := &KeyStore{
+		fs:   fs,
+		path: filepath.Join(fs.StorageRoot, "apikeys.json"),
+		keys: make(map[string]*APIKey),
+	}
+	data, err := os.ReadFile(ks.path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ks.keys); err != nil {
+		return nil, fmt.Errorf("corrupt API key file %s: %w", ks.path, err)
+	}
+	return ks, nil
+}
+
+// Issue creates a key named name with the given scopes, valid for ttl or
+// forever if ttl is 0. The returned token is shown only once.
+func (ks *KeyStore) Issue(name string, scopes []Scope, ttl time.Duration, by string) (string, *APIKey, error) {
+	if name == "" {
+		return "", nil, errors.New("API key needs a name")
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("API key needs at least one scope")
+	}
+	if ttl < 0 {
+		return "", nil, errors.New("API key lifetime must be positive")
+	}
+
+	random := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", nil, err
+	}
+	id, secret := hex.EncodeToString(random[:4]), hex.EncodeToString(random[4:])
+	key := &APIKey{
+		ID:      id,
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Hash:    hashSecret(secret),
+	}
+	if ttl > 0 {
+		key.Expires = key.Created.Add(ttl)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[id] = key
+	if err := ks.save(); err != nil {
+		delete(ks.keys, id)
+		return "", nil, fmt.Errorf("failed to persist API key: %w", err)
+	}
+
+	ks.fs.Audit(network.AuditEntry{
+		Time: key.Created, Action: "key-issue", Pattern: scopeList(scopes), Key: id, By: by, Reason: name,
+	})
+	return keyPrefix + id + "_" + secret, key, nil
+}
+
+// Revoke deletes the key with the given ID
+func (ks *KeyStore) Revoke(id, by string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("no API key %s", id)
+	}
+	delete(ks.keys, id)
+	if err := ks.save(); err != nil {
+		ks.keys[id] = key
+		return fmt.Errorf("failed to persist API keys: %w", err)
+	}
+
+	ks.fs.Audit(network.AuditEntry{
+		Time: time.Now().UTC(), Action: "key-revoke", Pattern: scopeList(key.Scopes), Key: id, By: by, Reason: key.Name,
+	})
+	return nil
+}
+
+// List returns the issued keys, oldest first
+func (ks *KeyStore) List() []APIKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	keys := make([]APIKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// Authenticate returns the key a token belongs to
+func (ks *KeyStore) Authenticate(token string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(token, keyPrefix)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+
+	ks.mu.Lock()
+	key, ok := ks.keys[id]
+	ks.mu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidKey
+	}
+	if key.expired() {
+		return nil, fmt.Errorf("%w: expired %s", ErrInvalidKey, key.Expires.Format(time.RFC3339))
+	}
+	return key, nil
+}
+
+// save writes the keys to disk. Callers hold mu.
+func (ks *KeyStore) save() error {
+	data, err := json.MarshalIndent(ks.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(ks.path, data, 0600)
+}
+
+// hashSecret is how key secrets are stored
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// scopeList formats scopes for display and the audit log
+func scopeList(scopes []Scope) string {
+	parts := make([]string, len(scopes))
+	for i, s := range scopes {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,268 @@
+// Package grpcapi serves the gRPC control-plane API defined in pkg/api
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/api"
+)
+
+// chunkSize is the size of the chunks GetFile streams
+const chunkSize = 64 * 1024
+
+// Server exposes a file server over gRPC
+type Server struct {
+	api.UnimplementedPeerVaultServer
+
+	fs     *network.FileServer
+	grpc   *grpc.Server
+	logger *slog.Logger
+
+	// Scoped API keys, see auth.go
+	keys         *KeyStore
+	keysRequired bool
+}
+
+// NewServer creates a gRPC API server for fs
+func NewServer(fs *network.FileServer, logger *slog.Logger) *Server {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &Server{
+		fs:     fs,
+		logger: logger,
+	}
+	s.grpc = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.unaryAuth),
+		grpc.ChainStreamInterceptor(s.streamAuth),
+	)
+	api.RegisterPeerVaultServer(s.grpc, s)
+	return s
+}
+
+// ListenAndServe serves the API on addr until Stop is called
+func (s *Server) ListenAndServe(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+// Serve serves the API on lis until Stop is called
+func (s *Server) Serve(lis net.Listener) error {
+	s.logger.Info("gRPC API listening", "addr", lis.Addr().String())
+	return s.grpc.Serve(lis)
+}
+
+// Stop waits for running calls to finish, cutting them off once ctx is done
+func (s *Server) Stop(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.grpc.Stop()
+	}
+}
+
+// rpcError converts a file server error into a gRPC status
+func rpcError(err error) error {
+	switch {
+	case errors.Is(err, network.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, network.ErrPeerUnreachable):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, network.ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, network.ErrCorrupted):
+		return status.Error(codes.DataLoss, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, network.ErrReadOnly):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// chunkReader reads the chunks of a StoreFile stream as one byte stream
+type chunkReader struct {
+	stream api.PeerVault_StoreFileServer
+	buf    []byte
+	n      int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err // io.EOF once the client closes its side
+		}
+		r.buf = req.GetChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.n += int64(n)
+	return n, nil
+}
+
+// StoreFile stores a file streamed by the client
+func (s *Server) StoreFile(stream api.PeerVault_StoreFileServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	key := first.GetKey()
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "the first message must name the key")
+	}
+	if err := s.authorize(stream.Context(), "StoreFile", VerbWrite, key); err != nil {
+		return err
+	}
+
+	r := &chunkReader{stream: stream, buf: first.GetChunk()}
+	if err := s.fs.Store(stream.Context(), key, r); err != nil {
+		return rpcError(err)
+	}
+	return stream.SendAndClose(&api.StoreFileResponse{Key: key, Size: r.n})
+}
+
+// GetFile streams a file to the client
+func (s *Server) GetFile(req *api.GetFileRequest, stream api.PeerVault_GetFileServer) error {
+	if req.GetKey() == "" {
+		return status.Error(codes.InvalidArgument, "key is required")
+	}
+	if err := s.authorize(stream.Context(), "GetFile", VerbRead, req.GetKey()); err != nil {
+		return err
+	}
+	r, err := s.fs.Get(stream.Context(), req.GetKey())
+	if err != nil {
+		return rpcError(err)
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&api.GetFileResponse{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return rpcError(err)
+		}
+	}
+}
+
+// ListFiles lists local files, or the files held across the network. Calls
+// made with an API key only see the keys it may read.
+func (s *Server) ListFiles(ctx context.Context, req *api.ListFilesRequest) (*api.ListFilesResponse, error) {
+	apiKey, scoped := ctx.Value(apiKeyContext{}).(*APIKey)
+	if scoped {
+		s.fs.Audit(network.AuditEntry{Action: "api", By: apiKey.String(), Reason: "ListFiles"})
+	}
+	visible := func(k string) bool {
+		if !scoped {
+			return true
+		}
+		_, ok := apiKey.Match(VerbRead, k)
+		return ok
+	}
+
+	resp := &api.ListFilesResponse{}
+	if req.GetNetwork() {
+		files, err := s.fs.ListNetworkFiles(ctx)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		for _, f := range files {
+			if !visible(f.Key) {
+				continue
+			}
+			resp.Files = append(resp.Files, &api.File{Key: f.Key, Hash: f.Hash, Size: f.Size, Holders: f.Holders})
+		}
+		return resp, nil
+	}
+
+	files, err := s.fs.ListFiles(s.fs.ID)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	for _, f := range files {
+		if !visible(f.Key) {
+			continue
+		}
+		resp.Files = append(resp.Files, &api.File{Key: f.Key, Hash: f.Hash, Size: f.Size})
+	}
+	return resp, nil
+}
+
+// PeerInfo describes the node and its connections
+func (s *Server) PeerInfo(ctx context.Context, req *api.PeerInfoRequest) (*api.PeerInfoResponse, error) {
+	if err := s.authorizeNode(ctx, "PeerInfo"); err != nil {
+		return nil, err
+	}
+	resp := &api.PeerInfoResponse{
+		Id:          s.fs.ID,
+		ListenAddr:  s.fs.Transport.Addr(),
+		Fingerprint: s.fs.Identity.Fingerprint(),
+	}
+
+	s.fs.PeerLock.Lock()
+	for _, peer := range s.fs.Peers {
+		resp.Peers = append(resp.Peers, peer.RemoteAddr().String())
+	}
+	s.fs.PeerLock.Unlock()
+	sort.Strings(resp.Peers)
+
+	for _, p := range s.fs.PeerPaths() {
+		resp.Paths = append(resp.Paths, &api.PeerPath{
+			Node:      p.Node,
+			Addr:      p.Addr,
+			RttMicros: p.RTT.Microseconds(),
+			Preferred: p.Preferred,
+		})
+	}
+	return resp, nil
+}
+
+// Metrics returns the node's counters and gauges
+func (s *Server) Metrics(ctx context.Context, req *api.MetricsRequest) (*api.MetricsResponse, error) {
+	if err := s.authorizeNode(ctx, "Metrics"); err != nil {
+		return nil, err
+	}
+	m := s.fs.Metrics.Snapshot()
+	return &api.MetricsResponse{
+		FilesStored:          m.FilesStored,
+		FilesRetrieved:       m.FilesRetrieved,
+		FilesDeleted:         m.FilesDeleted,
+		BytesSent:            m.BytesSent,
+		BytesReceived:        m.BytesReceived,
+		Errors:               m.Errors,
+		PeersConnected:       m.PeersConnected,
+		PeersDiscovered:      m.PeersDiscovered,
+		ReplicasLost:         m.ReplicasLost,
+		ReplicaRepairs:       m.ReplicaRepairs,
+		UnderReplicatedFiles: m.UnderReplicated,
+		StorageUsedBytes:     m.StorageUsed,
+		StorageTotalBytes:    m.StorageTotal,
+		UptimeSeconds:        m.Uptime.Seconds(),
+	}, nil
+}
@@ -0,0 +1,274 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/api"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+func newTestClient(t *testing.T) api.PeerVaultClient {
+	_, dial := newTestServer(t)
+	return dial()
+}
+
+// newTestServer starts an API server over an unconnected node, returning
+// it and a function connecting clients to it
+func newTestServer(t *testing.T) (*Server, func(...grpc.DialOption) api.PeerVaultClient) {
+	root := filepath.Join(os.TempDir(), "pv_grpcapi_node")
+	os.RemoveAll(root)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	encKey, _ := crypto.NewEncryptionKey()
+	fs, err := network.NewFileServer(network.FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+	})
+	assert.Nil(t, err)
+	fs.Transport = p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5960",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewServer(fs, nil)
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	dial := func(opts ...grpc.DialOption) api.PeerVaultClient {
+		opts = append(opts,
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+		assert.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewPeerVaultClient(conn)
+	}
+	return srv, dial
+}
+
+func TestStoreAndGetFile(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	// Larger than one chunk, so both directions stream several messages
+	data := bytes.Repeat([]byte("peervault grpc "), 10000)
+
+	up, err := client.StoreFile(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, up.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Key{Key: "grpc_file"}}))
+	for i := 0; i < len(data); i += 4096 {
+		end := min(i+4096, len(data))
+		assert.Nil(t, up.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Chunk{Chunk: data[i:end]}}))
+	}
+	stored, err := up.CloseAndRecv()
+	assert.Nil(t, err)
+	assert.Equal(t, "grpc_file", stored.Key)
+	assert.Equal(t, int64(len(data)), stored.Size)
+
+	down, err := client.GetFile(ctx, &api.GetFileRequest{Key: "grpc_file"})
+	assert.Nil(t, err)
+	var got bytes.Buffer
+	for {
+		resp, err := down.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		got.Write(resp.Chunk)
+	}
+	assert.Equal(t, data, got.Bytes())
+
+	list, err := client.ListFiles(ctx, &api.ListFilesRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, list.Files, 1)
+	assert.Equal(t, "grpc_file", list.Files[0].Key)
+
+	m, err := client.Metrics(ctx, &api.MetricsRequest{})
+	assert.Nil(t, err)
+	assert.Greater(t, m.UptimeSeconds, 0.0)
+}
+
+func TestStoreFileRequiresKey(t *testing.T) {
+	client := newTestClient(t)
+
+	up, err := client.StoreFile(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, up.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Chunk{Chunk: []byte("data")}}))
+	_, err = up.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestStoreFileReadOnly(t *testing.T) {
+	srv, dial := newTestServer(t)
+	srv.fs.MetadataOnly = true
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(storeFile(dial(), "notes.txt", []byte("data"))))
+}
+
+func TestGetFileNotFound(t *testing.T) {
+	client := newTestClient(t)
+
+	down, err := client.GetFile(context.Background(), &api.GetFileRequest{Key: "missing"})
+	assert.Nil(t, err)
+	_, err = down.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestListenSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pv.sock")
+
+	// A socket left behind by a crashed daemon is replaced
+	assert.Nil(t, os.WriteFile(path, nil, 0600))
+	lis, err := ListenSocket(path)
+	assert.Nil(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// One that answers belongs to a running daemon
+	_, err = ListenSocket(path)
+	assert.NotNil(t, err)
+}
+
+// storeFile stores data under key through the API
+func storeFile(client api.PeerVaultClient, key string, data []byte) error {
+	up, err := client.StoreFile(context.Background())
+	if err != nil {
+		return err
+	}
+	up.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Key{Key: key}})
+	up.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Chunk{Chunk: data}})
+	_, err = up.CloseAndRecv()
+	return err
+}
+
+// getFile reads key through the API
+func getFile(client api.PeerVaultClient, key string) ([]byte, error) {
+	down, err := client.GetFile(context.Background(), &api.GetFileRequest{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	var got bytes.Buffer
+	for {
+		resp, err := down.Recv()
+		if err == io.EOF {
+			return got.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		got.Write(resp.Chunk)
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	scope, err := ParseScope("read:backups/*")
+	assert.Nil(t, err)
+	assert.True(t, scope.allows(VerbRead, "backups/2024/db.tar"))
+	assert.False(t, scope.allows(VerbRead, "backupsX"))
+	assert.False(t, scope.allows(VerbWrite, "backups/db.tar"))
+
+	scope, err = ParseScope("write:report.pdf")
+	assert.Nil(t, err)
+	assert.True(t, scope.allows(VerbWrite, "report.pdf"))
+	assert.False(t, scope.allows(VerbWrite, "report.pdf.bak"))
+
+	for _, bad := range []string{"read", "read:", "delete:inbox/*"} {
+		_, err := ParseScope(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	srv, dial := newTestServer(t)
+	keys, err := OpenKeyStore(srv.fs)
+	assert.Nil(t, err)
+	srv.UseKeys(keys, true)
+
+	backups, _ := ParseScope("read:backups/*")
+	inbox, _ := ParseScope("write:inbox/*")
+	readToken, _, err := keys.Issue("restore", []Scope{backups}, 0, "test")
+	assert.Nil(t, err)
+	writeToken, writeKey, err := keys.Issue("mailer", []Scope{inbox}, time.Hour, "test")
+	assert.Nil(t, err)
+
+	// Keys are required over TCP
+	_, err = dial().ListFiles(context.Background(), &api.ListFilesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = dial(api.WithAPIKey(readToken+"x")).ListFiles(context.Background(), &api.ListFilesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Write-only inbox/*
+	writer := dial(api.WithAPIKey(writeToken))
+	assert.Nil(t, storeFile(writer, "inbox/msg.eml", []byte("hi")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(storeFile(writer, "backups/db.tar", []byte("x"))))
+	_, err = getFile(writer, "inbox/msg.eml")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = writer.Metrics(context.Background(), &api.MetricsRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Read-only backups/*, listing shows only what the key may read
+	assert.Nil(t, srv.fs.Store(context.Background(), "backups/db.tar", bytes.NewReader([]byte("db"))))
+	reader := dial(api.WithAPIKey(readToken))
+	data, err := getFile(reader, "backups/db.tar")
+	assert.Nil(t, err)
+	assert.Equal(t, "db", string(data))
+	_, err = getFile(reader, "inbox/msg.eml")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	list, err := reader.ListFiles(context.Background(), &api.ListFilesRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, list.Files, 1)
+	assert.Equal(t, "backups/db.tar", list.Files[0].Key)
+
+	// Revoked keys stop working, and keys survive a restart of the store
+	assert.Nil(t, keys.Revoke(writeKey.ID, "test"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(storeFile(writer, "inbox/late.eml", []byte("x"))))
+	reopened, err := OpenKeyStore(srv.fs)
+	assert.Nil(t, err)
+	assert.Len(t, reopened.List(), 1)
+
+	entries, err := srv.fs.AuditLog(0)
+	assert.Nil(t, err)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	assert.Equal(t, []string{
+		"key-issue", "key-issue", "denied",
+		"api", "denied", "denied", "denied",
+		"api", "denied", "api",
+		"key-revoke", "denied",
+	}, actions)
+}
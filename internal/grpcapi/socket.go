@@ -0,0 +1,51 @@
+package grpcapi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultSocketPath is where the daemon serves the API to local clients
+// unless configured otherwise
+func DefaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "peervault.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("peervault-%d.sock", os.Getuid()))
+}
+
+// ListenSocket listens on a unix socket only the current user can connect
+// to. A socket left behind by a daemon that did not shut down cleanly is
+// replaced; one that still answers belongs to a running daemon and is an
+// error.
+func ListenSocket(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use by another daemon", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
@@ -0,0 +1,101 @@
+package hlc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading: the highest physical time
+// seen, in Unix nanoseconds, and a counter that orders events sharing it.
+// Timestamps of causally related events compare in happens-before order
+// however skewed the clocks of the nodes involved are.
+type Timestamp struct {
+	Wall    int64  `json:"wall" wire:"1"`
+	Logical uint32 `json:"logical" wire:"2"`
+}
+
+// IsZero reports whether t was never set, e.g. by a node without a clock
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+// Compare returns -1, 0 or +1 as t is before, equal to or after u
+func (t Timestamp) Compare(u Timestamp) int {
+	switch {
+	case t.Wall < u.Wall:
+		return -1
+	case t.Wall > u.Wall:
+		return 1
+	case t.Logical < u.Logical:
+		return -1
+	case t.Logical > u.Logical:
+		return 1
+	}
+	return 0
+}
+
+// Before reports whether t orders before u
+func (t Timestamp) Before(u Timestamp) bool {
+	return t.Compare(u) < 0
+}
+
+// Time returns the physical part of t
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall).UTC()
+}
+
+func (t Timestamp) String() string {
+	if t.IsZero() {
+		return "-"
+	}
+	return fmt.Sprintf("%s/%d", t.Time().Format(time.RFC3339Nano), t.Logical)
+}
+
+// Clock issues timestamps for local events and merges the timestamps of
+// remote ones. It is safe for concurrent use.
+type Clock struct {
+	mu   sync.Mutex
+	last Timestamp
+	now  func() time.Time
+}
+
+// NewClock returns a clock reading the system time
+func NewClock() *Clock {
+	return &Clock{now: time.Now}
+}
+
+// Now returns a timestamp for a local event, after every timestamp the
+// clock issued or merged before
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wall := c.now().UnixNano(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update merges the timestamp of a received event, so the next local event
+// orders after it, and returns the timestamp of receiving it. A zero
+// timestamp leaves the clock as it is.
+func (c *Clock) Update(remote Timestamp) Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.now().UnixNano()
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	}
+	return c.last
+}
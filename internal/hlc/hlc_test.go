@@ -0,0 +1,63 @@
+package hlc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock returns a clock reading the time from *wall
+func fakeClock(wall *int64) *Clock {
+	return &Clock{now: func() time.Time { return time.Unix(0, *wall) }}
+}
+
+func TestClockNowIsMonotonic(t *testing.T) {
+	wall := int64(1000)
+	c := fakeClock(&wall)
+
+	a := c.Now()
+	b := c.Now()
+	assert.Equal(t, Timestamp{Wall: 1000}, a)
+	assert.Equal(t, Timestamp{Wall: 1000, Logical: 1}, b)
+
+	// A clock stepped backwards keeps counting from the last timestamp
+	wall = 500
+	d := c.Now()
+	assert.True(t, b.Before(d))
+	assert.Equal(t, int64(1000), d.Wall)
+
+	wall = 2000
+	assert.Equal(t, Timestamp{Wall: 2000}, c.Now())
+}
+
+func TestClockUpdateOrdersAfterRemote(t *testing.T) {
+	wall := int64(1000)
+	c := fakeClock(&wall)
+
+	// A remote node whose clock runs ahead
+	remote := Timestamp{Wall: 5000, Logical: 3}
+	received := c.Update(remote)
+	assert.True(t, remote.Before(received))
+	assert.True(t, received.Before(c.Now()))
+
+	// Equal walls: the logical part breaks the tie
+	c = fakeClock(&wall)
+	c.Now()
+	assert.Equal(t, Timestamp{Wall: 1000, Logical: 8}, c.Update(Timestamp{Wall: 1000, Logical: 7}))
+
+	// Zero and older timestamps leave the physical time in charge
+	wall = 9000
+	assert.Equal(t, Timestamp{Wall: 9000}, c.Update(Timestamp{}))
+}
+
+func TestTimestampCompare(t *testing.T) {
+	a := Timestamp{Wall: 1, Logical: 5}
+	b := Timestamp{Wall: 2}
+	assert.Equal(t, -1, a.Compare(b))
+	assert.Equal(t, 1, b.Compare(a))
+	assert.Equal(t, 0, a.Compare(a))
+	assert.True(t, Timestamp{}.Before(a))
+	assert.True(t, Timestamp{}.IsZero())
+	assert.Equal(t, "-", Timestamp{}.String())
+}
@@ -0,0 +1,114 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// keychainService names the entries PeerVault keeps in the OS keychain
+const keychainService = "peervault"
+
+// ErrNoKeychain is returned when this system has no supported keychain
+var ErrNoKeychain = errors.New("no supported OS keychain: needs security (macOS), secret-tool (Linux) or PowerShell (Windows)")
+
+// SaveToKeychain keeps the passphrase of the keyring at path in the OS
+// keychain, so the node unlocks it at startup without asking: the login
+// keychain on macOS, the Secret Service (GNOME Keyring, KWallet) on Linux,
+// and a file next to the keyring protected with DPAPI on Windows. The
+// passphrase is handed to the tools on their standard input, never as an
+// argument.
+func SaveToKeychain(path string, passphrase []byte) error {
+	account, err := keychainAccount(path)
+	if err != nil {
+		return err
+	}
+	secret := hex.EncodeToString(passphrase)
+
+	switch runtime.GOOS {
+	case "darwin":
+		// security reads the commands of -i from stdin
+		cmd := fmt.Sprintf("add-generic-password -U -s %s -a %q -w %s\n", keychainService, account, secret)
+		_, err = runTool(cmd, "security", "-i")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		_, err = runTool(secret, "secret-tool", "store", "--label=PeerVault keyring passphrase",
+			"service", keychainService, "account", account)
+	case "windows":
+		var protected []byte
+		protected, err = runTool(secret, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Security; "+
+				"$d = [Text.Encoding]::UTF8.GetBytes([Console]::In.ReadToEnd()); "+
+				"[Convert]::ToBase64String([Security.Cryptography.ProtectedData]::Protect($d, $null, 'CurrentUser'))")
+		if err == nil {
+			err = os.WriteFile(path+".dpapi", bytes.TrimSpace(protected), 0600)
+		}
+	default:
+		return ErrNoKeychain
+	}
+	return err
+}
+
+// LoadFromKeychain returns the passphrase of the keyring at path kept with
+// SaveToKeychain
+func LoadFromKeychain(path string) ([]byte, error) {
+	account, err := keychainAccount(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	switch runtime.GOOS {
+	case "darwin":
+		out, err = runTool("", "security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		out, err = runTool("", "secret-tool", "lookup", "service", keychainService, "account", account)
+	case "windows":
+		var protected []byte
+		if protected, err = os.ReadFile(path + ".dpapi"); err != nil {
+			return nil, err
+		}
+		out, err = runTool(string(protected), "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Security; "+
+				"$d = [Convert]::FromBase64String([Console]::In.ReadToEnd().Trim()); "+
+				"[Text.Encoding]::UTF8.GetString([Security.Cryptography.ProtectedData]::Unprotect($d, $null, 'CurrentUser'))")
+	default:
+		return nil, ErrNoKeychain
+	}
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := hex.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil || len(passphrase) == 0 {
+		return nil, errors.New("no valid keyring passphrase in the OS keychain")
+	}
+	return passphrase, nil
+}
+
+// keychainAccount names the keychain entry of the keyring at path, so
+// several keyrings keep separate passphrases
+func keychainAccount(path string) (string, error) {
+	return filepath.Abs(path)
+}
+
+// runTool runs a keychain tool with stdin as its input and returns its
+// output
+func runTool(stdin string, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, ErrNoKeychain
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,191 @@
+// Package keyring keeps the keys of a node in a file encrypted under a
+// passphrase, so they need not be written in configs or passed on the
+// command line, where other users see them in the process list.
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// NetworkKey is the name of the network key in a keyring
+const NetworkKey = "network"
+
+// scrypt parameters of new keyrings, about 100ms and 32 MiB to unlock
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrWrongPassphrase is returned by Open when the passphrase does not
+// unlock the keyring
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted keyring")
+
+// Keyring holds named keys, sealed with AES-GCM under a key derived from a
+// passphrase with scrypt
+type Keyring struct {
+	path       string
+	passphrase []byte
+	keys       map[string][]byte
+}
+
+// file is the form of a keyring on disk
+type file struct {
+	Version int    `json:"version"`
+	KDF     kdf    `json:"kdf"`
+	Sealed  []byte `json:"sealed"` // the keys as JSON, sealed with crypto.Seal
+}
+
+type kdf struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// DefaultPath returns where the keyring is kept by default,
+// ~/.peervault/keyring
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".peervault", "keyring"), nil
+}
+
+// Exists reports whether there is a keyring at path
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Create returns a new empty keyring to be saved at path under passphrase.
+// It fails if a keyring exists there already.
+func Create(path string, passphrase []byte) (*Keyring, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase is empty")
+	}
+	if Exists(path) {
+		return nil, fmt.Errorf("keyring %s already exists", path)
+	}
+	return &Keyring{path: path, passphrase: passphrase, keys: make(map[string][]byte)}, nil
+}
+
+// Open unlocks the keyring at path with passphrase
+func Open(path string, passphrase []byte) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+	if f.Version != 1 || f.KDF.Name != "scrypt" {
+		return nil, fmt.Errorf("unsupported keyring %s: version %d, kdf %q", path, f.Version, f.KDF.Name)
+	}
+	if f.KDF.N > 1<<20 || f.KDF.R > 32 || f.KDF.P > 16 {
+		return nil, fmt.Errorf("invalid keyring %s: scrypt parameters too large", path)
+	}
+	key, err := scrypt.Key(passphrase, f.KDF.Salt, f.KDF.N, f.KDF.R, f.KDF.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+	plain, err := crypto.Unseal(key, f.Sealed)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	k := &Keyring{path: path, passphrase: passphrase}
+	if err := json.Unmarshal(plain, &k.keys); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+	return k, nil
+}
+
+// Path returns where the keyring is saved
+func (k *Keyring) Path() string {
+	return k.path
+}
+
+// Get returns the key called name
+func (k *Keyring) Get(name string) ([]byte, bool) {
+	key, ok := k.keys[name]
+	return key, ok
+}
+
+// Set adds or replaces the key called name. Call Save to keep it.
+func (k *Keyring) Set(name string, key []byte) {
+	k.keys[name] = slices.Clone(key)
+}
+
+// Names returns the names of the keys, sorted
+func (k *Keyring) Names() []string {
+	return slices.Sorted(maps.Keys(k.keys))
+}
+
+// SetPassphrase changes the passphrase the keyring is saved under. Call
+// Save to keep it.
+func (k *Keyring) SetPassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("the passphrase is empty")
+	}
+	k.passphrase = passphrase
+	return nil
+}
+
+// Save writes the keyring, readable by its owner only, with a fresh salt.
+// The file is replaced at once, so a failed save keeps the previous one.
+func (k *Keyring) Save() error {
+	plain, err := json.Marshal(k.keys)
+	if err != nil {
+		return err
+	}
+	f := file{Version: 1, KDF: kdf{Name: "scrypt", Salt: make([]byte, 16), N: scryptN, R: scryptR, P: scryptP}}
+	if _, err := io.ReadFull(rand.Reader, f.KDF.Salt); err != nil {
+		return err
+	}
+	key, err := scrypt.Key(k.passphrase, f.KDF.Salt, f.KDF.N, f.KDF.R, f.KDF.P, 32)
+	if err != nil {
+		return err
+	}
+	if f.Sealed, err = crypto.Seal(key, plain); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
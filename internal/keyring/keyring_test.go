@@ -0,0 +1,77 @@
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "keyring")
+	key := bytes.Repeat([]byte{7}, 32)
+
+	k, err := Create(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set(NetworkKey, key)
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the keyring to be private, got mode %v", info.Mode().Perm())
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, key) || strings.Contains(string(data), "0707070707") {
+		t.Error("Expected the key not to be stored in the clear")
+	}
+
+	if _, err := Create(path, []byte("again")); err == nil {
+		t.Error("Expected an existing keyring not to be replaced")
+	}
+	if _, err := Open(path, []byte("wrong horse")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	k, err = Open(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := k.Get(NetworkKey); !ok || !bytes.Equal(got, key) {
+		t.Error("Expected the network key back")
+	}
+
+	// A new passphrase replaces the old one
+	if err := k.SetPassphrase([]byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, []byte("correct horse")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected the old passphrase to be refused, got %v", err)
+	}
+	if k, err = Open(path, []byte("battery staple")); err != nil || len(k.Names()) != 1 {
+		t.Errorf("Expected the keyring to open with the new passphrase, got %v", err)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	in := strings.NewReader("first secret\r\nsecond")
+	for _, want := range []string{"first secret", "second"} {
+		line, err := readLine(in)
+		if err != nil || string(line) != want {
+			t.Errorf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+	if _, err := readLine(in); err == nil {
+		t.Error("Expected an error at the end of the input")
+	}
+}
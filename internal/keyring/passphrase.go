@@ -0,0 +1,44 @@
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ReadPassphrase prints prompt to out and reads a line from in. When in is
+// a terminal what is typed is not shown.
+func ReadPassphrase(in *os.File, out io.Writer, prompt string) ([]byte, error) {
+	fmt.Fprint(out, prompt)
+	if restore, err := echoOff(int(in.Fd())); err == nil {
+		defer func() {
+			restore()
+			fmt.Fprintln(out)
+		}()
+	}
+	return readLine(in)
+}
+
+// readLine reads up to the end of the line a byte at a time, so nothing
+// after it is consumed from in
+func readLine(in io.Reader) ([]byte, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := in.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimRight(line, "\r"), nil
+}
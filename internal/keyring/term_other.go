@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package keyring
+
+import "errors"
+
+// echoOff is not available on this platform, so what is typed is shown
+func echoOff(fd int) (func(), error) {
+	return nil, errors.New("hiding input is not supported on this platform")
+}
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AlertOptions configures the rules an Alerter starts with
+type AlertOptions struct {
+	// Webhooks alerts are posted to. Slack incoming webhooks get a Slack
+	// message, other URLs an Alert as JSON.
+	Webhooks []string
+
+	// Storage use, in percent of the quota, that alerts; 90 if 0. A
+	// negative value turns the rule off.
+	StoragePercent float64
+
+	// Errors per minute handling messages and streams from peers that
+	// alert, 0 for no rule
+	ErrorsPerMinute float64
+
+	// Node names the node in alerts
+	Node string
+
+	Logger *slog.Logger
+}
+
+// defaultStoragePercent is the storage alert threshold if none is set
+const defaultStoragePercent = 90
+
+// webhookTimeout bounds each webhook call
+const webhookTimeout = 10 * time.Second
+
+// Alert is what generic webhooks are sent, as JSON
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Status  string    `json:"status"` // firing, or resolved once the condition clears
+	Message string    `json:"message"`
+	Node    string    `json:"node,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Rule is a condition on the metrics. Eval is given the metrics of the
+// last evaluation and the current ones, the time between them, and
+// returns whether the condition holds and what to say about it.
+type Rule struct {
+	Name string
+	Eval func(prev, cur Snapshot, elapsed time.Duration) (bool, string)
+
+	// Event rules alert each time they hold, e.g. once per corruption
+	// found, and are never resolved. Others alert when they start to hold
+	// and again when they stop.
+	Event bool
+}
+
+// Alerter evaluates rules on the metrics at an interval and posts alerts
+// to webhooks when they fire or resolve
+type Alerter struct {
+	metrics *Metrics
+	opts    AlertOptions
+	rules   []Rule
+	client  *http.Client
+	firing  map[string]bool
+	prev    Snapshot
+	prevAt  time.Time
+	primed  bool // prev is set
+}
+
+// NewAlerter returns an alerter with the rules opts turns on: storage use
+// over the threshold, an error rate spike, the last peer disconnecting and
+// garbage collection finding corrupted files
+func NewAlerter(m *Metrics, opts AlertOptions) *Alerter {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	a := &Alerter{
+		metrics: m,
+		opts:    opts,
+		client:  &http.Client{Timeout: webhookTimeout},
+		firing:  make(map[string]bool),
+	}
+
+	threshold := opts.StoragePercent
+	if threshold == 0 {
+		threshold = defaultStoragePercent
+	}
+	if threshold > 0 {
+		a.AddRule(Rule{Name: "storage", Eval: func(_, cur Snapshot, _ time.Duration) (bool, string) {
+			if cur.StorageTotal <= 0 {
+				return false, ""
+			}
+			percent := float64(cur.StorageUsed) / float64(cur.StorageTotal) * 100
+			return percent >= threshold, fmt.Sprintf("storage %.0f%% full, %s of %s used",
+				percent, FormatBytes(cur.StorageUsed), FormatBytes(cur.StorageTotal))
+		}})
+	}
+	if opts.ErrorsPerMinute > 0 {
+		a.AddRule(Rule{Name: "errors", Eval: func(prev, cur Snapshot, elapsed time.Duration) (bool, string) {
+			rate := float64(cur.Errors-prev.Errors) / elapsed.Minutes()
+			return rate >= opts.ErrorsPerMinute, fmt.Sprintf("%.1f errors per minute", rate)
+		}})
+	}
+	// Only a node that had peers is told it lost them, not one starting
+	// alone
+	hadPeers := false
+	a.AddRule(Rule{Name: "no_peers", Eval: func(_, cur Snapshot, _ time.Duration) (bool, string) {
+		if cur.PeersConnected > 0 {
+			hadPeers = true
+			return false, fmt.Sprintf("%d peers connected", cur.PeersConnected)
+		}
+		return hadPeers, "no peers connected, files are not replicated"
+	}})
+	a.AddRule(Rule{Name: "corruption", Event: true, Eval: func(prev, cur Snapshot, _ time.Duration) (bool, string) {
+		n := cur.FilesCorrupted - prev.FilesCorrupted
+		return n > 0, fmt.Sprintf("garbage collection found %d corrupted files, quarantined for repair", n)
+	}})
+	return a
+}
+
+// AddRule adds a rule, evaluated from the next round on
+func (a *Alerter) AddRule(r Rule) {
+	a.rules = append(a.rules, r)
+}
+
+// Start evaluates the rules every interval until ctx ends
+func (a *Alerter) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Evaluate(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evaluate runs every rule once and sends the alerts due. The first call
+// only takes the metrics rules are compared against.
+func (a *Alerter) Evaluate(ctx context.Context, now time.Time) {
+	cur := a.metrics.Snapshot()
+	prev, elapsed := a.prev, now.Sub(a.prevAt)
+	ready := a.primed
+	a.prev, a.prevAt, a.primed = cur, now, true
+	if !ready || elapsed <= 0 {
+		return
+	}
+
+	for _, rule := range a.rules {
+		holds, msg := rule.Eval(prev, cur, elapsed)
+		switch {
+		case rule.Event:
+			if holds {
+				a.send(ctx, Alert{Rule: rule.Name, Status: "firing", Message: msg, Node: a.opts.Node, Time: now})
+			}
+		case holds && !a.firing[rule.Name]:
+			a.firing[rule.Name] = true
+			a.send(ctx, Alert{Rule: rule.Name, Status: "firing", Message: msg, Node: a.opts.Node, Time: now})
+		case !holds && a.firing[rule.Name]:
+			a.firing[rule.Name] = false
+			a.send(ctx, Alert{Rule: rule.Name, Status: "resolved", Message: msg, Node: a.opts.Node, Time: now})
+		}
+	}
+}
+
+// send posts alert to every webhook. Failures are logged; the alert is not
+// sent again.
+func (a *Alerter) send(ctx context.Context, alert Alert) {
+	a.opts.Logger.Warn("alert", "rule", alert.Rule, "status", alert.Status, "msg", alert.Message)
+	for _, hook := range a.opts.Webhooks {
+		body, err := webhookBody(hook, alert)
+		if err != nil {
+			a.opts.Logger.Warn("failed to encode alert", "webhook", redactURL(hook), "err", err)
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			a.opts.Logger.Warn("invalid alert webhook", "webhook", redactURL(hook), "err", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := a.client.Do(req)
+		if err != nil {
+			a.opts.Logger.Warn("failed to send alert", "webhook", redactURL(hook), "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			a.opts.Logger.Warn("alert webhook refused the alert", "webhook", redactURL(hook), "status", resp.Status)
+		}
+	}
+}
+
+// webhookBody formats alert for hook: a message for Slack, the Alert as
+// JSON for anything else
+func webhookBody(hook string, alert Alert) ([]byte, error) {
+	if u, err := url.Parse(hook); err == nil && u.Host == "hooks.slack.com" {
+		icon := ":rotating_light:"
+		if alert.Status == "resolved" {
+			icon = ":white_check_mark:"
+		}
+		text := fmt.Sprintf("%s *%s* %s: %s", icon, alert.Rule, alert.Status, alert.Message)
+		if alert.Node != "" {
+			text += " (node " + alert.Node + ")"
+		}
+		return json.Marshal(map[string]string{"text": text})
+	}
+	return json.Marshal(alert)
+}
+
+// redactURL returns hook without its path, which for Slack and most other
+// services holds the secret
+func redactURL(hook string) string {
+	u, err := url.Parse(hook)
+	if err != nil {
+		return "invalid URL"
+	}
+	return strings.TrimSuffix(u.Scheme+"://"+u.Host, "://")
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerter(t *testing.T) {
+	var mu sync.Mutex
+	var alerts []Alert
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&alert))
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		var got []string
+		for _, a := range alerts {
+			got = append(got, a.Rule+" "+a.Status)
+		}
+		alerts = nil
+		return got
+	}
+
+	m := NewMetrics()
+	a := NewAlerter(m, AlertOptions{Webhooks: []string{hook.URL}, StoragePercent: 80, ErrorsPerMinute: 10, Node: "node1"})
+	ctx := context.Background()
+	now := time.Now()
+	step := func() {
+		now = now.Add(time.Minute)
+		a.Evaluate(ctx, now)
+	}
+
+	m.UpdateStorageMetrics(50, 100)
+	m.SetPeersConnected(2)
+	step()
+	step()
+	assert.Empty(t, received())
+
+	// Conditions that start to hold fire once
+	m.UpdateStorageMetrics(85, 100)
+	m.SetPeersConnected(0)
+	for range 12 {
+		m.IncErrors()
+	}
+	m.IncGCFinding("corrupted")
+	step()
+	assert.ElementsMatch(t, []string{"storage firing", "errors firing", "no_peers firing", "corruption firing"}, received())
+
+	// and resolve when they stop; events do not
+	step()
+	assert.Equal(t, []string{"errors resolved"}, received())
+	m.UpdateStorageMetrics(50, 100)
+	m.SetPeersConnected(1)
+	step()
+	assert.ElementsMatch(t, []string{"storage resolved", "no_peers resolved"}, received())
+}
+
+func TestWebhookBody(t *testing.T) {
+	alert := Alert{Rule: "storage", Status: "firing", Message: "storage 95% full", Node: "node1"}
+	body, err := webhookBody("https://hooks.slack.com/services/T0/B0/secret", alert)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"text":":rotating_light: *storage* firing: storage 95% full (node node1)"}`, string(body))
+
+	body, err = webhookBody("https://alerts.example.com/hook", alert)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"rule":"storage"`)
+	assert.Equal(t, "https://hooks.slack.com", redactURL("https://hooks.slack.com/services/T0/B0/secret"))
+}
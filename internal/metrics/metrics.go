@@ -1,40 +1,299 @@
 package metrics
 
 import (
+	"bytes"
 	"fmt"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/expfmt"
 )
 
-// Metrics tracks various server statistics
+// Metrics tracks various server statistics. Every metric is registered with
+// a Prometheus registry; counters and gauges are also kept as plain values
+// for the JSON and human-readable formats.
 type Metrics struct {
 	// Counters
-	filesStored    int64
-	filesRetrieved int64
-	filesDeleted   int64
-	bytesSent      int64
-	bytesReceived  int64
-	errorsTotal    int64
+	filesStored     int64
+	filesRetrieved  int64
+	filesDeleted    int64
+	bytesSent       int64
+	bytesReceived   int64
+	errorsTotal     int64
+	replicasLost    int64 // replicas lost to peers offline past the replica timeout
+	replicaRepairs  int64 // replicas offered to healthy peers to replace them
+	filesRepaired   int64 // corrupted or missing files fetched again from peers by garbage collection
+	replicasResumed int64 // pending replica pushes found at startup
+	replicasBad     int64 // received replicas rejected for failing verification
+	getsCoalesced   int64 // Gets that joined a network fetch of the same key already running
+	downgrades      int64 // connections refused for announcing a weaker protocol than pinned
+	streamsBusy     int64 // streams refused or queued because every slot was taken
+	peersDeclined   int64 // inbound connections declined at the peer limit
+	filesCorrupted  int64 // files garbage collection found corrupted
 
 	// Gauges (current values)
 	peersConnected  int64
 	peersDiscovered int64 // Peers discovered via mDNS/PEX
 	storageUsed     int64
 	storageTotal    int64
+	underReplicated int64 // files short of the replication factor after a repair
+	pendingReplicas int64 // replica pushes not completed yet, offered again as peers connect
+	fetchesInFlight int64 // network fetches running, each shared by every Get of its key
+	dedupLogical    int64 // plaintext bytes of every stored file, as of the last dedup report
+	dedupPhysical   int64 // plaintext bytes of the distinct stored content
 
 	// Timing
 	startTime      time.Time
 	lastUpdateTime time.Time
 
 	mu sync.RWMutex
+
+	registry          *prometheus.Registry
+	getDuration       prometheus.Histogram
+	storeDuration     prometheus.Histogram
+	peerBytesSent     *prometheus.CounterVec
+	peerBytesReceived *prometheus.CounterVec
+	gcRuns            prometheus.Histogram
+	gcFindings        *prometheus.CounterVec
+	gcLastRun         prometheus.Gauge
+	gcLastRunFiles    *prometheus.GaugeVec
+	diskUsed          *prometheus.GaugeVec
+	diskQuota         *prometheus.GaugeVec
+	diskState         *prometheus.GaugeVec
 }
 
 // NewMetrics creates a new metrics collector
 func NewMetrics() *Metrics {
-	return &Metrics{
+	m := &Metrics{
 		startTime:      time.Now(),
 		lastUpdateTime: time.Now(),
+		registry:       prometheus.NewRegistry(),
+		getDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "peervault_get_duration_seconds",
+			Help:    "Time to retrieve a file, locally or from peers",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		storeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "peervault_store_duration_seconds",
+			Help:    "Time to store a file locally and start its replication",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		peerBytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "peervault_peer_bytes_sent_total",
+			Help: "Bytes of file data sent, by peer",
+		}, []string{"peer"}),
+		peerBytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "peervault_peer_bytes_received_total",
+			Help: "Bytes of file data received, by peer",
+		}, []string{"peer"}),
+		gcRuns: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "peervault_gc_duration_seconds",
+			Help:    "Duration of garbage collection runs",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		gcFindings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "peervault_gc_findings_total",
+			Help: "Corrupted files and orphaned directories found by garbage collection",
+		}, []string{"kind"}),
+		gcLastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "peervault_gc_last_run_timestamp_seconds",
+			Help: "When the last garbage collection run started",
+		}),
+		gcLastRunFiles: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "peervault_gc_last_run_files",
+			Help: "Files checked, found and removed by the last garbage collection run",
+		}, []string{"result"}),
+		diskUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "peervault_disk_used_bytes",
+			Help: "Bytes stored on each disk",
+		}, []string{"disk"}),
+		diskQuota: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "peervault_disk_quota_bytes",
+			Help: "Quota of each disk, 0 for no limit",
+		}, []string{"disk"}),
+		diskState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "peervault_disk_state",
+			Help: "State of each disk (ok, read-only or missing), 1 for the current one",
+		}, []string{"disk", "state"}),
+	}
+
+	counter := func(name, help string, v *int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			return float64(atomic.LoadInt64(v))
+		})
+	}
+	gauge := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+	}
+	load := func(v *int64) func() float64 {
+		return func() float64 { return float64(atomic.LoadInt64(v)) }
+	}
+
+	m.registry.MustRegister(
+		counter("peervault_files_stored_total", "Total number of files stored", &m.filesStored),
+		counter("peervault_files_retrieved_total", "Total number of files retrieved", &m.filesRetrieved),
+		counter("peervault_files_deleted_total", "Total number of files deleted", &m.filesDeleted),
+		counter("peervault_bytes_sent_total", "Total bytes sent to peers", &m.bytesSent),
+		counter("peervault_bytes_received_total", "Total bytes received from peers", &m.bytesReceived),
+		counter("peervault_errors_total", "Total number of errors", &m.errorsTotal),
+		counter("peervault_replicas_lost_total", "Replicas lost to peers offline past the replica timeout", &m.replicasLost),
+		counter("peervault_replica_repairs_total", "Replicas offered to healthy peers to replace lost ones", &m.replicaRepairs),
+		counter("peervault_files_repaired_total", "Corrupted or missing files fetched again from peers by garbage collection", &m.filesRepaired),
+		counter("peervault_replicas_resumed_total", "Pending replica pushes resumed after a restart", &m.replicasResumed),
+		counter("peervault_replicas_rejected_total", "Received replicas rejected for failing verification", &m.replicasBad),
+		counter("peervault_gets_coalesced_total", "Gets served by a network fetch of the same key already running", &m.getsCoalesced),
+		counter("peervault_downgrades_refused_total", "Connections refused for announcing a weaker protocol than before", &m.downgrades),
+		counter("peervault_streams_busy_total", "Streams refused or queued at the concurrent stream limit", &m.streamsBusy),
+		counter("peervault_peers_declined_total", "Inbound connections declined at the peer limit", &m.peersDeclined),
+		gauge("peervault_under_replicated_files", "Files short of the replication factor", load(&m.underReplicated)),
+		gauge("peervault_pending_replicas", "Replica pushes not completed yet", load(&m.pendingReplicas)),
+		gauge("peervault_fetches_in_flight", "Network fetches running", load(&m.fetchesInFlight)),
+		gauge("peervault_peers_connected", "Number of currently connected peers", load(&m.peersConnected)),
+		gauge("peervault_peers_discovered", "Number of peers discovered via mDNS/PEX", load(&m.peersDiscovered)),
+		gauge("peervault_storage_used_bytes", "Storage space used in bytes", load(&m.storageUsed)),
+		gauge("peervault_storage_total_bytes", "Total storage quota in bytes", load(&m.storageTotal)),
+		gauge("peervault_storage_utilization_percent", "Storage utilization percentage", m.getStorageUtilization),
+		gauge("peervault_dedup_logical_bytes", "Plaintext bytes of every stored file", load(&m.dedupLogical)),
+		gauge("peervault_dedup_physical_bytes", "Plaintext bytes of the distinct stored content", load(&m.dedupPhysical)),
+		gauge("peervault_dedup_ratio", "Logical over physical bytes of stored content", m.getDedupRatio),
+		gauge("peervault_uptime_seconds", "Server uptime in seconds", func() float64 { return m.GetUptime().Seconds() }),
+		m.getDuration,
+		m.storeDuration,
+		m.peerBytesSent,
+		m.peerBytesReceived,
+		m.gcRuns,
+		m.gcFindings,
+		m.gcLastRun,
+		m.gcLastRunFiles,
+		m.diskUsed,
+		m.diskQuota,
+		m.diskState,
+		// Goroutines, heap and GC pause distributions from runtime/metrics
+		collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(
+			collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler,
+		)),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Registry returns the Prometheus registry holding every metric
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Register adds a collector, e.g. for a subsystem with its own statistics
+func (m *Metrics) Register(c prometheus.Collector) error {
+	return m.registry.Register(c)
+}
+
+// Latency metrics
+func (m *Metrics) ObserveGet(d time.Duration) {
+	m.getDuration.Observe(d.Seconds())
+}
+
+func (m *Metrics) ObserveStore(d time.Duration) {
+	m.storeDuration.Observe(d.Seconds())
+}
+
+// Per-peer transfer metrics, also counted in the totals
+func (m *Metrics) AddPeerBytesSent(peer string, bytes int64) {
+	m.peerBytesSent.WithLabelValues(peer).Add(float64(bytes))
+	m.AddBytesSent(bytes)
+}
+
+func (m *Metrics) AddPeerBytesReceived(peer string, bytes int64) {
+	m.peerBytesReceived.WithLabelValues(peer).Add(float64(bytes))
+	m.AddBytesReceived(bytes)
+}
+
+// ForgetPeer drops the per-peer series of a disconnected peer
+func (m *Metrics) ForgetPeer(peer string) {
+	m.peerBytesSent.DeleteLabelValues(peer)
+	m.peerBytesReceived.DeleteLabelValues(peer)
+}
+
+// Garbage collection metrics
+func (m *Metrics) ObserveGCRun(d time.Duration) {
+	m.gcRuns.Observe(d.Seconds())
+}
+
+func (m *Metrics) IncGCFinding(kind string) {
+	m.gcFindings.WithLabelValues(kind).Inc()
+	if kind == "corrupted" {
+		atomic.AddInt64(&m.filesCorrupted, 1)
+	}
+}
+
+// SetGCLastRun records when the last garbage collection run started and
+// its file counts by result, e.g. "checked" or "removed"
+func (m *Metrics) SetGCLastRun(started time.Time, files map[string]int) {
+	m.gcLastRun.Set(float64(started.Unix()))
+	for result, n := range files {
+		m.gcLastRunFiles.WithLabelValues(result).Set(float64(n))
+	}
+}
+
+// SetDisk updates the usage and state of one disk of a node storing files
+// on several disks
+func (m *Metrics) SetDisk(disk, state string, used, quota int64) {
+	m.diskUsed.WithLabelValues(disk).Set(float64(used))
+	m.diskQuota.WithLabelValues(disk).Set(float64(quota))
+	m.diskState.DeletePartialMatch(prometheus.Labels{"disk": disk})
+	m.diskState.WithLabelValues(disk, state).Set(1)
+}
+
+// RegisterKnownPeers exports the peers a node knows of, by how they were
+// learned (bootstrap, mDNS, peer exchange), as read from bySource
+func (m *Metrics) RegisterKnownPeers(bySource func() map[string]int) error {
+	return m.Register(&knownPeersCollector{
+		desc:     prometheus.NewDesc("peervault_known_peers", "Peers known to this node, by discovery source", []string{"source"}, nil),
+		bySource: bySource,
+	})
+}
+
+// RegisterPeerRTT exports the round trip to each connected peer, by
+// address, as read from byPeer in seconds
+func (m *Metrics) RegisterPeerRTT(byPeer func() map[string]float64) error {
+	return m.Register(&peerRTTCollector{
+		desc:   prometheus.NewDesc("peervault_peer_rtt_seconds", "Round trip to each connected peer, from heartbeats", []string{"peer"}, nil),
+		byPeer: byPeer,
+	})
+}
+
+// peerRTTCollector reads round trips when scraped
+type peerRTTCollector struct {
+	desc   *prometheus.Desc
+	byPeer func() map[string]float64
+}
+
+func (c *peerRTTCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *peerRTTCollector) Collect(ch chan<- prometheus.Metric) {
+	for peer, rtt := range c.byPeer() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, rtt, peer)
+	}
+}
+
+// knownPeersCollector reads peer counts when scraped
+type knownPeersCollector struct {
+	desc     *prometheus.Desc
+	bySource func() map[string]int
+}
+
+func (c *knownPeersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *knownPeersCollector) Collect(ch chan<- prometheus.Metric) {
+	for source, count := range c.bySource() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), source)
 	}
 }
 
@@ -71,6 +330,71 @@ func (m *Metrics) IncErrors() {
 	m.updateTime()
 }
 
+// Replica repair metrics
+func (m *Metrics) AddReplicasLost(count int64) {
+	atomic.AddInt64(&m.replicasLost, count)
+	m.updateTime()
+}
+
+func (m *Metrics) IncReplicaRepairs() {
+	atomic.AddInt64(&m.replicaRepairs, 1)
+	m.updateTime()
+}
+
+// IncFilesRepaired counts a corrupted or missing file the garbage
+// collector fetched again from peers
+func (m *Metrics) IncFilesRepaired() {
+	atomic.AddInt64(&m.filesRepaired, 1)
+	m.updateTime()
+}
+
+func (m *Metrics) SetUnderReplicated(count int) {
+	atomic.StoreInt64(&m.underReplicated, int64(count))
+	m.updateTime()
+}
+
+func (m *Metrics) AddReplicasResumed(count int) {
+	atomic.AddInt64(&m.replicasResumed, int64(count))
+	m.updateTime()
+}
+
+func (m *Metrics) IncGetsCoalesced() {
+	atomic.AddInt64(&m.getsCoalesced, 1)
+	m.updateTime()
+}
+
+func (m *Metrics) IncDowngradesRefused() {
+	atomic.AddInt64(&m.downgrades, 1)
+	m.updateTime()
+}
+
+func (m *Metrics) IncStreamsBusy() {
+	atomic.AddInt64(&m.streamsBusy, 1)
+	m.updateTime()
+}
+
+// IncReplicasRejected counts a received replica that failed verification
+func (m *Metrics) IncReplicasRejected() {
+	atomic.AddInt64(&m.replicasBad, 1)
+	m.updateTime()
+}
+
+// IncPeersDeclined counts an inbound connection declined at the peer limit
+func (m *Metrics) IncPeersDeclined() {
+	atomic.AddInt64(&m.peersDeclined, 1)
+	m.updateTime()
+}
+
+func (m *Metrics) SetFetchesInFlight(count int) {
+	atomic.StoreInt64(&m.fetchesInFlight, int64(count))
+	m.updateTime()
+}
+
+func (m *Metrics) SetPendingReplicas(count int) {
+	atomic.StoreInt64(&m.pendingReplicas, int64(count))
+	m.updateTime()
+}
+
 // Gauge metrics (set values)
 func (m *Metrics) SetPeersConnected(count int) {
 	atomic.StoreInt64(&m.peersConnected, int64(count))
@@ -92,6 +416,21 @@ func (m *Metrics) SetStorageTotal(bytes int64) {
 	m.updateTime()
 }
 
+// SetDedupStats records the totals of the last deduplication report
+func (m *Metrics) SetDedupStats(logical, physical int64) {
+	atomic.StoreInt64(&m.dedupLogical, logical)
+	atomic.StoreInt64(&m.dedupPhysical, physical)
+}
+
+// getDedupRatio is 1 until a report has found duplicates
+func (m *Metrics) getDedupRatio() float64 {
+	physical := atomic.LoadInt64(&m.dedupPhysical)
+	if physical == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&m.dedupLogical)) / float64(physical)
+}
+
 // Update last activity time
 func (m *Metrics) updateTime() {
 	m.mu.Lock()
@@ -104,74 +443,77 @@ func (m *Metrics) GetUptime() time.Duration {
 	return time.Since(m.startTime)
 }
 
-// ToPrometheusFormat exports metrics in Prometheus text format
-func (m *Metrics) ToPrometheusFormat() string {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	uptime := time.Since(m.startTime).Seconds()
-
-	return fmt.Sprintf(`# HELP peervault_files_stored_total Total number of files stored
-# TYPE peervault_files_stored_total counter
-peervault_files_stored_total %d
-
-# HELP peervault_files_retrieved_total Total number of files retrieved
-# TYPE peervault_files_retrieved_total counter
-peervault_files_retrieved_total %d
-
-# HELP peervault_files_deleted_total Total number of files deleted
-# TYPE peervault_files_deleted_total counter
-peervault_files_deleted_total %d
-
-# HELP peervault_bytes_sent_total Total bytes sent to peers
-# TYPE peervault_bytes_sent_total counter
-peervault_bytes_sent_total %d
-
-# HELP peervault_bytes_received_total Total bytes received from peers
-# TYPE peervault_bytes_received_total counter
-peervault_bytes_received_total %d
-
-# HELP peervault_errors_total Total number of errors
-# TYPE peervault_errors_total counter
-peervault_errors_total %d
-
-# HELP peervault_peers_connected Current number of connected peers
-# TYPE peervault_peers_connected gauge
-peervault_peers_connected %d
-
-# HELP peervault_peers_discovered Peers discovered via mDNS/PEX
-# TYPE peervault_peers_discovered gauge
-peervault_peers_discovered %d
-
-# HELP peervault_storage_used_bytes Current storage used in bytes
-# TYPE peervault_storage_used_bytes gauge
-peervault_storage_used_bytes %d
-
-# HELP peervault_storage_total_bytes Total storage capacity in bytes
-# TYPE peervault_storage_total_bytes gauge
-peervault_storage_total_bytes %d
+// Snapshot is a point-in-time copy of all metrics
+type Snapshot struct {
+	FilesStored     int64
+	FilesRetrieved  int64
+	FilesDeleted    int64
+	BytesSent       int64
+	BytesReceived   int64
+	Errors          int64
+	ReplicasLost    int64
+	ReplicaRepairs  int64
+	FilesRepaired   int64
+	PeersConnected  int64
+	PeersDiscovered int64
+	StorageUsed     int64
+	StorageTotal    int64
+	UnderReplicated int64
+	PendingReplicas int64
+	ReplicasResumed int64
+	ReplicasBad     int64
+	GetsCoalesced   int64
+	FetchesInFlight int64
+	Downgrades      int64
+	StreamsBusy     int64
+	PeersDeclined   int64
+	FilesCorrupted  int64
+	Uptime          time.Duration
+}
 
-# HELP peervault_storage_utilization Storage utilization percentage (0-100)
-# TYPE peervault_storage_utilization gauge
-peervault_storage_utilization %.2f
+// Snapshot returns the current value of every metric
+func (m *Metrics) Snapshot() Snapshot {
+	return Snapshot{
+		FilesStored:     atomic.LoadInt64(&m.filesStored),
+		FilesRetrieved:  atomic.LoadInt64(&m.filesRetrieved),
+		FilesDeleted:    atomic.LoadInt64(&m.filesDeleted),
+		BytesSent:       atomic.LoadInt64(&m.bytesSent),
+		BytesReceived:   atomic.LoadInt64(&m.bytesReceived),
+		Errors:          atomic.LoadInt64(&m.errorsTotal),
+		ReplicasLost:    atomic.LoadInt64(&m.replicasLost),
+		ReplicaRepairs:  atomic.LoadInt64(&m.replicaRepairs),
+		FilesRepaired:   atomic.LoadInt64(&m.filesRepaired),
+		PeersConnected:  atomic.LoadInt64(&m.peersConnected),
+		PeersDiscovered: atomic.LoadInt64(&m.peersDiscovered),
+		StorageUsed:     atomic.LoadInt64(&m.storageUsed),
+		StorageTotal:    atomic.LoadInt64(&m.storageTotal),
+		UnderReplicated: atomic.LoadInt64(&m.underReplicated),
+		PendingReplicas: atomic.LoadInt64(&m.pendingReplicas),
+		ReplicasResumed: atomic.LoadInt64(&m.replicasResumed),
+		ReplicasBad:     atomic.LoadInt64(&m.replicasBad),
+		GetsCoalesced:   atomic.LoadInt64(&m.getsCoalesced),
+		FetchesInFlight: atomic.LoadInt64(&m.fetchesInFlight),
+		Downgrades:      atomic.LoadInt64(&m.downgrades),
+		StreamsBusy:     atomic.LoadInt64(&m.streamsBusy),
+		PeersDeclined:   atomic.LoadInt64(&m.peersDeclined),
+		FilesCorrupted:  atomic.LoadInt64(&m.filesCorrupted),
+		Uptime:          m.GetUptime(),
+	}
+}
 
-# HELP peervault_uptime_seconds Server uptime in seconds
-# TYPE peervault_uptime_seconds gauge
-peervault_uptime_seconds %.2f
-`,
-		atomic.LoadInt64(&m.filesStored),
-		atomic.LoadInt64(&m.filesRetrieved),
-		atomic.LoadInt64(&m.filesDeleted),
-		atomic.LoadInt64(&m.bytesSent),
-		atomic.LoadInt64(&m.bytesReceived),
-		atomic.LoadInt64(&m.errorsTotal),
-		atomic.LoadInt64(&m.peersConnected),
-		atomic.LoadInt64(&m.peersDiscovered),
-		atomic.LoadInt64(&m.storageUsed),
-		atomic.LoadInt64(&m.storageTotal),
-		m.getStorageUtilization(),
-		uptime,
-	)
+// ToPrometheusFormat exports metrics in Prometheus text format
+func (m *Metrics) ToPrometheusFormat() string {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return fmt.Sprintf("# error gathering metrics: %v\n", err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return fmt.Sprintf("# error encoding metrics: %v\n", err)
+		}
+	}
+	return buf.String()
 }
 
 // ToJSONFormat exports metrics in JSON format
@@ -180,18 +522,33 @@ func (m *Metrics) ToJSONFormat() string {
 	defer m.mu.RUnlock()
 
 	uptime := time.Since(m.startTime).Seconds()
+	rt := ReadRuntimeStats()
 
 	return fmt.Sprintf(`{
   "files": {
     "stored": %d,
     "retrieved": %d,
-    "deleted": %d
+    "deleted": %d,
+    "gets_coalesced": %d
   },
   "network": {
     "bytes_sent": %d,
     "bytes_received": %d,
     "peers_connected": %d,
-    "peers_discovered": %d
+    "peers_discovered": %d,
+    "fetches_in_flight": %d,
+    "downgrades_refused": %d,
+    "streams_busy": %d,
+    "peers_declined": %d
+  },
+  "replication": {
+    "replicas_lost": %d,
+    "repairs": %d,
+    "files_repaired": %d,
+    "under_replicated_files": %d,
+    "pending": %d,
+    "resumed": %d,
+    "rejected": %d
   },
   "storage": {
     "used_bytes": %d,
@@ -205,15 +562,35 @@ func (m *Metrics) ToJSONFormat() string {
     "uptime_seconds": %.2f,
     "start_time": "%s",
     "last_update": "%s"
+  },
+  "runtime": {
+    "goroutines": %d,
+    "heap_alloc_bytes": %d,
+    "heap_inuse_bytes": %d,
+    "gc_runs": %d,
+    "gc_last_pause_seconds": %.6f,
+    "gc_pause_total_seconds": %.6f
   }
 }`,
 		atomic.LoadInt64(&m.filesStored),
 		atomic.LoadInt64(&m.filesRetrieved),
 		atomic.LoadInt64(&m.filesDeleted),
+		atomic.LoadInt64(&m.getsCoalesced),
 		atomic.LoadInt64(&m.bytesSent),
 		atomic.LoadInt64(&m.bytesReceived),
 		atomic.LoadInt64(&m.peersConnected),
 		atomic.LoadInt64(&m.peersDiscovered),
+		atomic.LoadInt64(&m.fetchesInFlight),
+		atomic.LoadInt64(&m.downgrades),
+		atomic.LoadInt64(&m.streamsBusy),
+		atomic.LoadInt64(&m.peersDeclined),
+		atomic.LoadInt64(&m.replicasLost),
+		atomic.LoadInt64(&m.replicaRepairs),
+		atomic.LoadInt64(&m.filesRepaired),
+		atomic.LoadInt64(&m.underReplicated),
+		atomic.LoadInt64(&m.pendingReplicas),
+		atomic.LoadInt64(&m.replicasResumed),
+		atomic.LoadInt64(&m.replicasBad),
 		atomic.LoadInt64(&m.storageUsed),
 		atomic.LoadInt64(&m.storageTotal),
 		m.getStorageUtilization(),
@@ -221,6 +598,12 @@ func (m *Metrics) ToJSONFormat() string {
 		uptime,
 		m.startTime.Format(time.RFC3339),
 		m.lastUpdateTime.Format(time.RFC3339),
+		rt.Goroutines,
+		rt.HeapAlloc,
+		rt.HeapInuse,
+		rt.GCRuns,
+		rt.LastGCPause.Seconds(),
+		rt.GCPauseTotal.Seconds(),
 	)
 }
 
@@ -234,6 +617,8 @@ func (m *Metrics) ToHumanFormat() string {
 	hours := int(uptime.Hours()) % 24
 	minutes := int(uptime.Minutes()) % 60
 
+	rt := ReadRuntimeStats()
+
 	uptimeStr := fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
 	if days == 0 {
 		uptimeStr = fmt.Sprintf("%dh %dm", hours, minutes)
@@ -248,11 +633,24 @@ File Operations:
   Stored:     %d
   Retrieved:  %d
   Deleted:    %d
+  Coalesced:  %d
 
 Network:
   Bytes Sent:     %s
   Bytes Received: %s
   Peers Connected: %d
+  Fetches Running: %d
+  Downgrades Refused: %d
+  Streams Busy:       %d
+  Peers Declined:     %d
+
+Replication:
+  Replicas Lost:    %d
+  Repairs:          %d
+  Files Repaired:   %d
+  Under-Replicated: %d
+  Pending Pushes:   %d
+  Rejected:         %d
 
 Storage:
   Used:        %s
@@ -263,22 +661,71 @@ System:
   Errors:  %d
   Uptime:  %s
   Started: %s
+
+Runtime:
+  Goroutines: %d
+  Heap:       %s allocated, %s in use
+  GC:         %d runs, last pause %v, total %v
 `,
 		atomic.LoadInt64(&m.filesStored),
 		atomic.LoadInt64(&m.filesRetrieved),
 		atomic.LoadInt64(&m.filesDeleted),
+		atomic.LoadInt64(&m.getsCoalesced),
 		FormatBytes(atomic.LoadInt64(&m.bytesSent)),
 		FormatBytes(atomic.LoadInt64(&m.bytesReceived)),
 		atomic.LoadInt64(&m.peersConnected),
+		atomic.LoadInt64(&m.fetchesInFlight),
+		atomic.LoadInt64(&m.downgrades),
+		atomic.LoadInt64(&m.streamsBusy),
+		atomic.LoadInt64(&m.peersDeclined),
+		atomic.LoadInt64(&m.replicasLost),
+		atomic.LoadInt64(&m.replicaRepairs),
+		atomic.LoadInt64(&m.filesRepaired),
+		atomic.LoadInt64(&m.underReplicated),
+		atomic.LoadInt64(&m.pendingReplicas),
+		atomic.LoadInt64(&m.replicasBad),
 		FormatBytes(atomic.LoadInt64(&m.storageUsed)),
 		FormatBytes(atomic.LoadInt64(&m.storageTotal)),
 		m.getStorageUtilization(),
 		atomic.LoadInt64(&m.errorsTotal),
 		uptimeStr,
 		m.startTime.Format("2006-01-02 15:04:05"),
+		rt.Goroutines,
+		FormatBytes(int64(rt.HeapAlloc)),
+		FormatBytes(int64(rt.HeapInuse)),
+		rt.GCRuns,
+		rt.LastGCPause,
+		rt.GCPauseTotal,
 	)
 }
 
+// RuntimeStats is a snapshot of the Go runtime: goroutines, heap and GC
+type RuntimeStats struct {
+	Goroutines   int
+	HeapAlloc    uint64 // bytes of allocated heap objects
+	HeapInuse    uint64 // bytes in in-use heap spans
+	GCRuns       uint32
+	LastGCPause  time.Duration
+	GCPauseTotal time.Duration
+}
+
+// ReadRuntimeStats reads the current runtime statistics
+func ReadRuntimeStats() RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    ms.HeapAlloc,
+		HeapInuse:    ms.HeapInuse,
+		GCRuns:       ms.NumGC,
+		GCPauseTotal: time.Duration(ms.PauseTotalNs),
+	}
+	if ms.NumGC > 0 {
+		stats.LastGCPause = time.Duration(ms.PauseNs[(ms.NumGC+255)%256])
+	}
+	return stats
+}
+
 // getStorageUtilization calculates storage utilization percentage
 func (m *Metrics) getStorageUtilization() float64 {
 	total := atomic.LoadInt64(&m.storageTotal)
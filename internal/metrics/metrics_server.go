@@ -1,17 +1,40 @@
 package metrics
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"sort"
 	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // MetricsServer serves metrics over HTTP
 type MetricsServer struct {
-	addr    string
-	metrics *Metrics
-	server  *http.Server
+	addr     string
+	metrics  *Metrics
+	server   *http.Server
+	pprof    bool
+	topology func() Graph
+	admin    http.Handler
+	checks   map[string]func() error // run by /readyz, see AddReadyCheck
+
+	user     string // basic auth, see RequireBasicAuth
+	password string
+	token    string // bearer token, see RequireToken
+	certFile string // PEM files served over TLS, see UseTLS
+	keyFile  string
+}
+
+// Graph is a network graph served on /topology as JSON, or in Graphviz
+// format with ?format=dot
+type Graph interface {
+	DOT() string
 }
 
 // NewMetricsServer creates a new metrics HTTP server
@@ -22,12 +45,98 @@ func NewMetricsServer(addr string, metrics *Metrics) *MetricsServer {
 	}
 }
 
-// Start begins serving metrics over HTTP
+// EnableProfiling serves the pprof profiles under /debug/pprof/. Profiles
+// expose internals of the process, so keep the server on a private address.
+func (ms *MetricsServer) EnableProfiling() {
+	ms.pprof = true
+}
+
+// ServeTopology serves the graph returned by topology on /topology
+func (ms *MetricsServer) ServeTopology(topology func() Graph) {
+	ms.topology = topology
+}
+
+// ServeAdmin serves admin under /admin/. The endpoints change the node's
+// state, so keep the server on a private address.
+func (ms *MetricsServer) ServeAdmin(admin http.Handler) {
+	ms.admin = admin
+}
+
+// AddReadyCheck adds a check /readyz runs, reported under name. check
+// returns why the node is not ready, or nil.
+func (ms *MetricsServer) AddReadyCheck(name string, check func() error) {
+	if ms.checks == nil {
+		ms.checks = make(map[string]func() error)
+	}
+	ms.checks[name] = check
+}
+
+// RequireBasicAuth makes every endpoint but the health checks ask for user and
+// password with HTTP basic auth
+func (ms *MetricsServer) RequireBasicAuth(user, password string) {
+	ms.user, ms.password = user, password
+}
+
+// RequireToken makes every endpoint but the health checks ask for token as a bearer
+// token. With RequireBasicAuth as well, either is accepted.
+func (ms *MetricsServer) RequireToken(token string) {
+	ms.token = token
+}
+
+// UseTLS serves HTTPS with the certificate and key in the PEM files
+func (ms *MetricsServer) UseTLS(certFile, keyFile string) {
+	ms.certFile, ms.keyFile = certFile, keyFile
+}
+
+// Addr returns the address the server listens on. An address without a
+// host, e.g. ":9090", is on the loopback interface, so the server is only
+// reachable from other hosts when an address such as 0.0.0.0:9090 is given.
+func (ms *MetricsServer) Addr() string {
+	host, port, err := net.SplitHostPort(ms.addr)
+	if err != nil || host != "" {
+		return ms.addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// Exposed reports whether the server is reachable from other hosts
+// without authentication
+func (ms *MetricsServer) Exposed() bool {
+	if ms.user != "" || ms.token != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(ms.Addr())
+	if err != nil {
+		return true
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// Start begins serving metrics over HTTP, or HTTPS with UseTLS
 func (ms *MetricsServer) Start() error {
+	ms.server = &http.Server{
+		Addr:    ms.Addr(),
+		Handler: ms.Handler(),
+	}
+
+	if ms.certFile != "" {
+		log.Printf("Starting metrics server on https://%s", ms.server.Addr)
+		return ms.server.ListenAndServeTLS(ms.certFile, ms.keyFile)
+	}
+	log.Printf("Starting metrics server on %s", ms.server.Addr)
+	return ms.server.ListenAndServe()
+}
+
+// Handler returns the handler serving every endpoint
+func (ms *MetricsServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// Prometheus format endpoint
-	mux.HandleFunc("/metrics", ms.handleMetrics)
+	mux.Handle("/metrics", promhttp.HandlerFor(ms.metrics.Registry(), promhttp.HandlerOpts{}))
 
 	// JSON format endpoint
 	mux.HandleFunc("/metrics/json", ms.handleMetricsJSON)
@@ -35,19 +144,79 @@ func (ms *MetricsServer) Start() error {
 	// Human-readable format endpoint
 	mux.HandleFunc("/metrics/human", ms.handleMetricsHuman)
 
-	// Health check endpoint
+	// Health check endpoints: /healthz while the process is up, /readyz
+	// once it can take traffic. /health is kept for existing probes.
 	mux.HandleFunc("/health", ms.handleHealth)
+	mux.HandleFunc("/healthz", ms.handleHealth)
+	mux.HandleFunc("/readyz", ms.handleReady)
+
+	// Peer graph, if provided
+	if ms.topology != nil {
+		mux.HandleFunc("/topology", ms.handleTopology)
+	}
+
+	// Admin endpoints, if enabled
+	if ms.admin != nil {
+		mux.Handle("/admin/", ms.admin)
+	}
+
+	// Profiling endpoints, if enabled
+	if ms.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
 
 	// Root endpoint with documentation
 	mux.HandleFunc("/", ms.handleRoot)
 
-	ms.server = &http.Server{
-		Addr:    ms.addr,
-		Handler: mux,
+	if ms.user == "" && ms.token == "" {
+		return mux
 	}
+	return ms.authenticate(mux)
+}
 
-	log.Printf("Starting metrics server on %s", ms.addr)
-	return ms.server.ListenAndServe()
+// authenticate serves next to requests with the configured credentials.
+// The health checks stay open, for probes that cannot send them.
+func (ms *MetricsServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health", "/healthz", "/readyz":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ms.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ms.user != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="PeerVault metrics"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// authorized reports whether r carries the basic auth credentials or the
+// bearer token, compared in constant time
+func (ms *MetricsServer) authorized(r *http.Request) bool {
+	if ms.token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(ms.token)) == 1 {
+			return true
+		}
+	}
+	if ms.user != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(ms.user))&
+			subtle.ConstantTimeCompare([]byte(password), []byte(ms.password)) == 1 {
+			return true
+		}
+	}
+	return false
 }
 
 // Stop gracefully shuts down the metrics server
@@ -58,13 +227,6 @@ func (ms *MetricsServer) Stop() error {
 	return nil
 }
 
-// handleMetrics serves metrics in Prometheus format
-func (ms *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, ms.metrics.ToPrometheusFormat())
-}
-
 // handleMetricsJSON serves metrics in JSON format
 func (ms *MetricsServer) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -86,6 +248,58 @@ func (ms *MetricsServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"status":"healthy","uptime_seconds":%.2f}`, ms.metrics.GetUptime().Seconds())
 }
 
+// readyReport is the body of /readyz
+type readyReport struct {
+	Status string                 `json:"status"` // ready or not_ready
+	Checks map[string]checkResult `json:"checks"`
+	Failed []string               `json:"failed,omitempty"` // names of the failed checks, sorted
+}
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleReady runs the readiness checks and answers 200 if all pass, 503
+// otherwise
+func (ms *MetricsServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := readyReport{Status: "ready", Checks: make(map[string]checkResult, len(ms.checks))}
+	for name, check := range ms.checks {
+		if err := check(); err != nil {
+			report.Checks[name] = checkResult{Error: err.Error()}
+			report.Failed = append(report.Failed, name)
+		} else {
+			report.Checks[name] = checkResult{OK: true}
+		}
+	}
+	status := http.StatusOK
+	if len(report.Failed) > 0 {
+		sort.Strings(report.Failed)
+		report.Status = "not_ready"
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleTopology serves the peer graph as JSON or DOT
+func (ms *MetricsServer) handleTopology(w http.ResponseWriter, r *http.Request) {
+	graph := ms.topology()
+	switch r.URL.Query().Get("format") {
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, graph.DOT())
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(graph)
+	default:
+		http.Error(w, "format must be json or dot", http.StatusBadRequest)
+	}
+}
+
 // handleRoot serves documentation about available endpoints
 func (ms *MetricsServer) handleRoot(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
@@ -178,10 +392,15 @@ func (ms *MetricsServer) handleRoot(w http.ResponseWriter, r *http.Request) {
         </div>
 
         <div class="endpoint">
-            <a href="/health">/health</a>
-            <p>Health check endpoint</p>
+            <a href="/healthz">/healthz</a>
+            <p>Liveness: answers while the process is up</p>
         </div>
 
+        <div class="endpoint">
+            <a href="/readyz">/readyz</a>
+            <p>Readiness: 200 once the node can take traffic, 503 with the failed checks otherwise</p>
+        </div>
+` + ms.topologyLink() + ms.pprofLink() + `
         <h2>Quick Preview:</h2>
         <div class="metrics-preview">` + escapeHTML(ms.metrics.GetSummary()) + `</div>
 
@@ -195,6 +414,32 @@ func (ms *MetricsServer) handleRoot(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, html)
 }
 
+// topologyLink lists the topology endpoint on the root page when served
+func (ms *MetricsServer) topologyLink() string {
+	if ms.topology == nil {
+		return ""
+	}
+	return `
+        <div class="endpoint">
+            <a href="/topology">/topology</a>
+            <p>Peers, paths and round trips as JSON, or for Graphviz with <a href="/topology?format=dot">?format=dot</a></p>
+        </div>
+`
+}
+
+// pprofLink lists the profiling endpoint on the root page when enabled
+func (ms *MetricsServer) pprofLink() string {
+	if !ms.pprof {
+		return ""
+	}
+	return `
+        <div class="endpoint">
+            <a href="/debug/pprof/">/debug/pprof/</a>
+            <p>Go profiles (heap, goroutine, CPU, ...) for <code>go tool pprof</code></p>
+        </div>
+`
+}
+
 // escapeHTML escapes HTML special characters
 func escapeHTML(s string) string {
 	s = strings.ReplaceAll(s, "&", "&amp;")
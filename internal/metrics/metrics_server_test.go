@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func httpGet(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMetricsServerRuntimeMetrics(t *testing.T) {
+	ms := NewMetricsServer("", NewMetrics())
+	srv := httptest.NewServer(ms.Handler())
+	defer srv.Close()
+
+	_, body := httpGet(t, srv.URL+"/metrics")
+	for _, name := range []string{"go_goroutines", "go_memstats_heap_alloc_bytes", "go_gc_duration_seconds"} {
+		assert.True(t, strings.Contains(body, name), "missing %s", name)
+	}
+
+	_, body = httpGet(t, srv.URL+"/metrics/json")
+	var parsed struct {
+		Runtime struct {
+			Goroutines     int   `json:"goroutines"`
+			HeapAllocBytes int64 `json:"heap_alloc_bytes"`
+		} `json:"runtime"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(body), &parsed))
+	assert.Greater(t, parsed.Runtime.Goroutines, 0)
+	assert.Greater(t, parsed.Runtime.HeapAllocBytes, int64(0))
+}
+
+func TestMetricsServerPprofGated(t *testing.T) {
+	ms := NewMetricsServer("", NewMetrics())
+	srv := httptest.NewServer(ms.Handler())
+	_, body := httpGet(t, srv.URL+"/debug/pprof/")
+	srv.Close()
+	assert.NotContains(t, body, "goroutine?debug=1")
+
+	ms.EnableProfiling()
+	srv = httptest.NewServer(ms.Handler())
+	defer srv.Close()
+	status, body := httpGet(t, srv.URL+"/debug/pprof/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "goroutine")
+	status, _ = httpGet(t, srv.URL+"/debug/pprof/heap")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+type testGraph struct {
+	Nodes []string `json:"nodes"`
+}
+
+func (g testGraph) DOT() string {
+	return "graph { a -- b }"
+}
+
+func TestMetricsServerTopology(t *testing.T) {
+	ms := NewMetricsServer("", NewMetrics())
+	ms.ServeTopology(func() Graph { return testGraph{Nodes: []string{"a", "b"}} })
+	srv := httptest.NewServer(ms.Handler())
+	defer srv.Close()
+
+	status, body := httpGet(t, srv.URL+"/topology")
+	assert.Equal(t, http.StatusOK, status)
+	var parsed testGraph
+	assert.Nil(t, json.Unmarshal([]byte(body), &parsed))
+	assert.Equal(t, []string{"a", "b"}, parsed.Nodes)
+
+	status, body = httpGet(t, srv.URL+"/topology?format=dot")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "graph { a -- b }", body)
+
+	status, _ = httpGet(t, srv.URL+"/topology?format=svg")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestMetricsServerAuth(t *testing.T) {
+	ms := NewMetricsServer(":9090", NewMetrics())
+	assert.Equal(t, "127.0.0.1:9090", ms.Addr())
+	assert.False(t, ms.Exposed())
+	assert.True(t, NewMetricsServer("0.0.0.0:9090", NewMetrics()).Exposed())
+
+	ms.RequireBasicAuth("prometheus", "secret")
+	ms.RequireToken("t0ken")
+	srv := httptest.NewServer(ms.Handler())
+	defer srv.Close()
+
+	get := func(path string, auth func(*http.Request)) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get("/health", nil))
+	assert.Equal(t, http.StatusUnauthorized, get("/metrics", nil))
+	assert.Equal(t, http.StatusOK, get("/metrics", func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") }))
+	assert.Equal(t, http.StatusUnauthorized, get("/metrics", func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }))
+	assert.Equal(t, http.StatusOK, get("/metrics/json", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }))
+	assert.Equal(t, http.StatusUnauthorized, get("/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }))
+}
+
+func TestMetricsServerReady(t *testing.T) {
+	ms := NewMetricsServer("", NewMetrics())
+	ms.RequireToken("t0ken")
+	var storeErr error
+	ms.AddReadyCheck("transport", func() error { return nil })
+	ms.AddReadyCheck("store", func() error { return storeErr })
+	srv := httptest.NewServer(ms.Handler())
+	defer srv.Close()
+
+	// Probes need no credentials
+	status, _ := httpGet(t, srv.URL+"/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	status, body := httpGet(t, srv.URL+"/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"status":"ready"`)
+
+	storeErr = errors.New("disk full")
+	status, body = httpGet(t, srv.URL+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	var report readyReport
+	assert.Nil(t, json.Unmarshal([]byte(body), &report))
+	assert.Equal(t, "not_ready", report.Status)
+	assert.Equal(t, []string{"store"}, report.Failed)
+	assert.Equal(t, "disk full", report.Checks["store"].Error)
+	assert.True(t, report.Checks["transport"].OK)
+}
@@ -141,6 +141,6 @@ func FormatBytes(bytes int64) string {
 		exp++
 	}
 
-	units := []string{"KB", "MB", "GB", "TB", "PB"}
+	units := []string{"KB", "MB", "GB", "TB", "PB", "EB"}
 	return fmt.Sprintf("%.2f %s", float64(bytes)/float64(div), units[exp])
 }
@@ -0,0 +1,74 @@
+package mount
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cache keeps the decrypted content of recently read files, evicting the
+// least recently used ones once it holds more than max bytes
+type cache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newCache(max int64) *cache {
+	return &cache{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached content of key
+func (c *cache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).data, true
+}
+
+// put caches the content of key. Content larger than the whole cache is
+// not kept. The slice must not be modified afterwards.
+func (c *cache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	if int64(len(data)) > c.max {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		c.removeLocked(c.order.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// remove drops key from the cache
+func (c *cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *cache) removeLocked(key string) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.order.Remove(el)
+	delete(c.entries, key)
+	c.size -= int64(len(el.Value.(*cacheEntry).data))
+}
@@ -0,0 +1,242 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// defaultCacheSize is the decrypted content kept in memory when
+// Options.CacheSize is zero
+const defaultCacheSize = 64 << 20
+
+// Options configures a mounted vault
+type Options struct {
+	CacheSize int64 // Bytes of decrypted file content kept in memory
+	Debug     bool  // Log every FUSE request
+	Logger    *slog.Logger
+}
+
+// vault is the state shared by every node of a mounted filesystem
+type vault struct {
+	server *network.FileServer
+	cache  *cache
+	logger *slog.Logger
+
+	// Directories created with mkdir. Only keys are stored, so any other
+	// directory exists only while a key lives below it.
+	dirsMu sync.Mutex
+	dirs   map[string]bool
+}
+
+// Mount exposes the files stored on the node as a filesystem at mountpoint.
+// Keys are paths: "docs/a.txt" shows up as file a.txt in directory docs.
+// Reads go through Get, writes are buffered and stored with Store when the
+// file is closed, and deleting a file deletes the key. The returned
+// function unmounts the filesystem.
+func Mount(server *network.FileServer, mountpoint string, opts Options) (func() error, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if info, err := os.Stat(mountpoint); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", mountpoint)
+	}
+
+	v := &vault{
+		server: server,
+		cache:  newCache(opts.CacheSize),
+		logger: opts.Logger,
+		dirs:   make(map[string]bool),
+	}
+
+	// Replicas arrive from peers at any time, so attributes are not kept long
+	timeout := time.Second
+	fsOpts := &fs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			FsName: "peervault",
+			Name:   "peervault",
+			Debug:  opts.Debug,
+		},
+	}
+	if server.IsGuest() {
+		fsOpts.MountOptions.Options = append(fsOpts.MountOptions.Options, "ro")
+	}
+
+	fuseServer, err := fs.Mount(mountpoint, &dirNode{v: v}, fsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount %s: %w", mountpoint, err)
+	}
+	opts.Logger.Info("mounted vault", "mountpoint", mountpoint)
+	return fuseServer.Unmount, nil
+}
+
+// childKey is the key of entry name in directory dir
+func childKey(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// listDir returns the files directly in dir with their sizes, and its
+// subdirectories. A key that is also a directory, such as the manifest of a
+// tree stored with StoreDir, shows up as the directory.
+func listDir(files []storage.FileInfo, dirs []string, dir string) (map[string]int64, map[string]bool) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	entries := make(map[string]int64)
+	subdirs := make(map[string]bool)
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Key, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		if name, _, nested := strings.Cut(rest, "/"); nested {
+			subdirs[name] = true
+		} else {
+			entries[name] = max(f.Size-crypto.Overhead, 0)
+		}
+	}
+	for _, d := range dirs {
+		if rest, ok := strings.CutPrefix(d, prefix); ok && rest != "" {
+			name, _, _ := strings.Cut(rest, "/")
+			subdirs[name] = true
+		}
+	}
+	for name := range subdirs {
+		delete(entries, name)
+	}
+	return entries, subdirs
+}
+
+// list returns the files and subdirectories of dir
+func (v *vault) list(dir string) (map[string]int64, map[string]bool, error) {
+	files, err := v.server.ListFiles(v.server.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	v.dirsMu.Lock()
+	dirs := make([]string, 0, len(v.dirs))
+	for d := range v.dirs {
+		dirs = append(dirs, d)
+	}
+	v.dirsMu.Unlock()
+
+	entries, subdirs := listDir(files, dirs, dir)
+	return entries, subdirs, nil
+}
+
+// readDir lists dir for Readdir, sorted by name
+func (v *vault) readDir(dir string) ([]fuse.DirEntry, error) {
+	files, subdirs, err := v.list(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fuse.DirEntry, 0, len(files)+len(subdirs))
+	for name := range subdirs {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+	}
+	for name := range files {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// addDir remembers a directory created with mkdir
+func (v *vault) addDir(dir string) {
+	v.dirsMu.Lock()
+	defer v.dirsMu.Unlock()
+	v.dirs[dir] = true
+}
+
+// removeDir forgets a directory created with mkdir, and reports whether
+// there was one
+func (v *vault) removeDir(dir string) bool {
+	v.dirsMu.Lock()
+	defer v.dirsMu.Unlock()
+	if !v.dirs[dir] {
+		return false
+	}
+	delete(v.dirs, dir)
+	return true
+}
+
+// read returns the content of key from the cache, or with Get
+func (v *vault) read(ctx context.Context, key string) ([]byte, error) {
+	if data, ok := v.cache.get(key); ok {
+		return data, nil
+	}
+	r, err := v.server.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	v.cache.put(key, data)
+	return data, nil
+}
+
+// write stores data under key
+func (v *vault) write(ctx context.Context, key string, data []byte) error {
+	v.cache.remove(key)
+	if err := v.server.Store(ctx, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	v.cache.put(key, data)
+	return nil
+}
+
+// delete removes key from the node
+func (v *vault) delete(ctx context.Context, key string) error {
+	v.cache.remove(key)
+	return v.server.DeleteContext(ctx, key)
+}
+
+// errno translates an error from the file server for the kernel
+func (v *vault) errno(op, key string, err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, network.ErrNotFound):
+		return syscall.ENOENT
+	case errors.Is(err, network.ErrLegalHold), errors.Is(err, network.ErrRetention):
+		return syscall.EPERM
+	case errors.Is(err, network.ErrQuotaExceeded):
+		return syscall.ENOSPC
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	}
+	v.logger.Warn("vault operation failed", "op", op, "key", key, "err", err)
+	return syscall.EIO
+}
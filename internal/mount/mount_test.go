@@ -0,0 +1,144 @@
+package mount
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// newTestVault returns a vault over a node that is not connected to peers.
+// The filesystem is not mounted, nodes are called directly.
+func newTestVault(t *testing.T) *vault {
+	root := filepath.Join(os.TempDir(), "pv_mount_node")
+	os.RemoveAll(root)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	encKey, _ := crypto.NewEncryptionKey()
+	server, err := network.NewFileServer(network.FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+		FetchTimeout:      100 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	server.Transport = p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5985",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	return &vault{
+		server: server,
+		cache:  newCache(1 << 20),
+		logger: slog.Default(),
+		dirs:   make(map[string]bool),
+	}
+}
+
+func TestListDir(t *testing.T) {
+	files := []storage.FileInfo{
+		{Key: "a.txt", Size: crypto.Overhead + 5},
+		{Key: "docs/b.txt", Size: crypto.Overhead + 7},
+		{Key: "docs/deep/c.txt", Size: crypto.Overhead},
+		{Key: "photos", Size: crypto.Overhead + 90}, // manifest of a stored tree
+		{Key: "photos/d.jpg", Size: crypto.Overhead + 1},
+	}
+
+	entries, subdirs := listDir(files, []string{"empty"}, "")
+	assert.Equal(t, map[string]int64{"a.txt": 5}, entries)
+	assert.Equal(t, map[string]bool{"docs": true, "photos": true, "empty": true}, subdirs)
+
+	entries, subdirs = listDir(files, nil, "docs")
+	assert.Equal(t, map[string]int64{"b.txt": 7}, entries)
+	assert.Equal(t, map[string]bool{"deep": true}, subdirs)
+
+	entries, subdirs = listDir(files, nil, "doc")
+	assert.Empty(t, entries)
+	assert.Empty(t, subdirs)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCache(10)
+	c.put("a", []byte("aaaa"))
+	c.put("b", []byte("bbbb"))
+	c.get("a")
+	c.put("c", []byte("cccc"))
+
+	_, ok := c.get("b")
+	assert.False(t, ok)
+	data, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "aaaa", string(data))
+
+	// Content larger than the cache is not kept
+	c.put("big", make([]byte, 11))
+	_, ok = c.get("big")
+	assert.False(t, ok)
+	assert.Equal(t, int64(8), c.size)
+}
+
+func TestWriteReadRenameDelete(t *testing.T) {
+	v := newTestVault(t)
+	ctx := context.Background()
+	root := &dirNode{v: v}
+	docs := &dirNode{v: v, path: "docs"}
+
+	// Writes are stored when the file is flushed
+	h := &handle{v: v, key: "docs/a.txt", dirty: true}
+	_, errno := h.Write(ctx, []byte("hello world"), 0)
+	assert.Equal(t, syscall.Errno(0), errno)
+	_, errno = h.Write(ctx, []byte("vault"), 6)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, syscall.Errno(0), h.Flush(ctx))
+
+	r, err := v.server.Get(ctx, "docs/a.txt")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "hello vault", string(data))
+
+	entries, err := v.readDir("")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "docs", entries[0].Name)
+
+	// Files opened for reading are served from the cache
+	file := &fileNode{v: v, key: "docs/a.txt"}
+	fh, _, errno := file.Open(ctx, syscall.O_RDONLY)
+	assert.Equal(t, syscall.Errno(0), errno)
+	buf := make([]byte, 5)
+	res, errno := fh.(*handle).Read(ctx, buf, 6)
+	assert.Equal(t, syscall.Errno(0), errno)
+	out, _ := res.Bytes(buf)
+	assert.Equal(t, "vault", string(out))
+
+	// Renaming stores the content under the new key
+	assert.Equal(t, syscall.Errno(0), docs.Rename(ctx, "a.txt", root, "b.txt", 0))
+	files, _, err := v.list("docs")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+	data, err = v.read(ctx, "b.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello vault", string(data))
+
+	// Deleting removes the key, files under legal hold are refused
+	assert.Nil(t, v.server.PlaceHold("b.txt", "test", ""))
+	assert.Equal(t, syscall.EPERM, root.Unlink(ctx, "b.txt"))
+	assert.Nil(t, v.server.ReleaseHold("b.txt", "test"))
+	assert.Equal(t, syscall.Errno(0), root.Unlink(ctx, "b.txt"))
+	_, err = v.read(ctx, "b.txt")
+	assert.NotNil(t, err)
+}
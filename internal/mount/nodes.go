@@ -0,0 +1,313 @@
+package mount
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// listedSizeTimeout is how long the kernel keeps a size taken from the
+// file listing. Listed sizes are estimates, from the stored size, that
+// compressed and framed files differ from, so the kernel asks again before
+// it stops reading at one; an open file has its exact size. 0 would mean
+// the default timeout.
+const listedSizeTimeout = time.Nanosecond
+
+// dirNode is a directory: the root, or a key prefix ending before a "/"
+type dirNode struct {
+	fs.Inode
+	v    *vault
+	path string // "" for the root
+}
+
+var (
+	_ fs.NodeGetattrer = (*dirNode)(nil)
+	_ fs.NodeLookuper  = (*dirNode)(nil)
+	_ fs.NodeReaddirer = (*dirNode)(nil)
+	_ fs.NodeCreater   = (*dirNode)(nil)
+	_ fs.NodeMkdirer   = (*dirNode)(nil)
+	_ fs.NodeUnlinker  = (*dirNode)(nil)
+	_ fs.NodeRmdirer   = (*dirNode)(nil)
+	_ fs.NodeRenamer   = (*dirNode)(nil)
+)
+
+func (d *dirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0755
+	return 0
+}
+
+func (d *dirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	files, subdirs, err := d.v.list(d.path)
+	if err != nil {
+		return nil, d.v.errno("lookup", childKey(d.path, name), err)
+	}
+	if subdirs[name] {
+		out.Mode = fuse.S_IFDIR | 0755
+		return d.newDir(ctx, name), 0
+	}
+	size, ok := files[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(size)
+	out.SetAttrTimeout(listedSizeTimeout)
+	return d.newFile(ctx, name), 0
+}
+
+func (d *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, err := d.v.readDir(d.path)
+	if err != nil {
+		return nil, d.v.errno("readdir", d.path, err)
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Create starts a new file. It is stored when it is closed, so a file
+// nothing was written to is stored empty.
+func (d *dirNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	key := childKey(d.path, name)
+	out.Mode = fuse.S_IFREG | 0644
+	return d.newFile(ctx, name), &handle{v: d.v, key: key, dirty: true}, 0, 0
+}
+
+func (d *dirNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	files, subdirs, err := d.v.list(d.path)
+	if err != nil {
+		return nil, d.v.errno("mkdir", childKey(d.path, name), err)
+	}
+	if _, ok := files[name]; ok || subdirs[name] {
+		return nil, syscall.EEXIST
+	}
+	d.v.addDir(childKey(d.path, name))
+	out.Mode = fuse.S_IFDIR | 0755
+	return d.newDir(ctx, name), 0
+}
+
+func (d *dirNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	key := childKey(d.path, name)
+	return d.v.errno("delete", key, d.v.delete(ctx, key))
+}
+
+// Rmdir removes an empty directory. Only directories created with mkdir
+// can be empty, the others exist because of the files in them.
+func (d *dirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	dir := childKey(d.path, name)
+	files, subdirs, err := d.v.list(dir)
+	if err != nil {
+		return d.v.errno("rmdir", dir, err)
+	}
+	if len(files) > 0 || len(subdirs) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	if !d.v.removeDir(dir) {
+		return syscall.ENOENT
+	}
+	return 0
+}
+
+// Rename stores the content of a file under its new key and deletes the old
+// one. Editors save files this way. Directories cannot be renamed, as that
+// would rewrite every key below them.
+func (d *dirNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	parent, ok := newParent.(*dirNode)
+	if !ok {
+		return syscall.EINVAL
+	}
+	from, to := childKey(d.path, name), childKey(parent.path, newName)
+
+	files, _, err := d.v.list(d.path)
+	if err != nil {
+		return d.v.errno("rename", from, err)
+	}
+	if _, ok := files[name]; !ok {
+		return syscall.ENOTSUP
+	}
+	data, err := d.v.read(ctx, from)
+	if err != nil {
+		return d.v.errno("rename", from, err)
+	}
+	if err := d.v.write(ctx, to, data); err != nil {
+		return d.v.errno("rename", to, err)
+	}
+	return d.v.errno("rename", from, d.v.delete(ctx, from))
+}
+
+func (d *dirNode) newDir(ctx context.Context, name string) *fs.Inode {
+	return d.NewInode(ctx, &dirNode{v: d.v, path: childKey(d.path, name)}, fs.StableAttr{Mode: fuse.S_IFDIR})
+}
+
+func (d *dirNode) newFile(ctx context.Context, name string) *fs.Inode {
+	return d.NewInode(ctx, &fileNode{v: d.v, key: childKey(d.path, name)}, fs.StableAttr{Mode: fuse.S_IFREG})
+}
+
+// fileNode is a stored key
+type fileNode struct {
+	fs.Inode
+	v   *vault
+	key string
+}
+
+var (
+	_ fs.NodeGetattrer = (*fileNode)(nil)
+	_ fs.NodeSetattrer = (*fileNode)(nil)
+	_ fs.NodeOpener    = (*fileNode)(nil)
+)
+
+func (n *fileNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFREG | 0644
+	if h, ok := f.(*handle); ok {
+		out.Size = uint64(h.size())
+		return 0
+	}
+	if data, ok := n.v.cache.get(n.key); ok {
+		out.Size = uint64(len(data))
+		return 0
+	}
+
+	dir, name := splitKey(n.key)
+	files, _, err := n.v.list(dir)
+	if err != nil {
+		return n.v.errno("stat", n.key, err)
+	}
+	size, ok := files[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	out.Size = uint64(size)
+	out.SetTimeout(listedSizeTimeout)
+	return 0
+}
+
+// Setattr only supports changing the size, for truncate and O_TRUNC
+func (n *fileNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if h, ok := f.(*handle); ok {
+			h.truncate(int64(size))
+		} else {
+			data, err := n.v.read(ctx, n.key)
+			if err != nil {
+				return n.v.errno("truncate", n.key, err)
+			}
+			resized := make([]byte, size)
+			copy(resized, data)
+			if err := n.v.write(ctx, n.key, resized); err != nil {
+				return n.v.errno("truncate", n.key, err)
+			}
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+// Open reads the whole file, unless it is truncated anyway
+func (n *fileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	h := &handle{v: n.v, key: n.key}
+	if flags&syscall.O_TRUNC != 0 {
+		h.dirty = true
+		return h, 0, 0
+	}
+	data, err := n.v.read(ctx, n.key)
+	if err != nil {
+		return nil, 0, n.v.errno("open", n.key, err)
+	}
+	h.data = data
+	return h, 0, 0
+}
+
+// splitKey returns the directory and the name of a key
+func splitKey(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// handle is an open file. Its content is read when it is opened and
+// stored again when it is flushed, if it was written to.
+type handle struct {
+	v   *vault
+	key string
+
+	mu     sync.Mutex
+	data   []byte
+	dirty  bool
+	copied bool // data is no longer shared with the cache
+}
+
+var (
+	_ fs.FileReader  = (*handle)(nil)
+	_ fs.FileWriter  = (*handle)(nil)
+	_ fs.FileFlusher = (*handle)(nil)
+)
+
+func (h *handle) size() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return int64(len(h.data))
+}
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := min(off+int64(len(dest)), int64(len(h.data)))
+	return fuse.ReadResultData(h.data[off:end]), 0
+}
+
+func (h *handle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.own()
+	if end := off + int64(len(data)); end > int64(len(h.data)) {
+		h.data = append(h.data, make([]byte, end-int64(len(h.data)))...)
+	}
+	copy(h.data[off:], data)
+	h.dirty = true
+	return uint32(len(data)), 0
+}
+
+// truncate resizes the file
+func (h *handle) truncate(size int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.own()
+	if size <= int64(len(h.data)) {
+		h.data = h.data[:size]
+	} else {
+		h.data = append(h.data, make([]byte, size-int64(len(h.data)))...)
+	}
+	h.dirty = true
+}
+
+// own copies content shared with the cache before it is changed
+func (h *handle) own() {
+	if !h.copied {
+		h.data = append([]byte(nil), h.data...)
+		h.copied = true
+	}
+}
+
+// Flush stores the file if it was written to. It runs on every close of
+// the file, so the change is in the vault once close returns.
+func (h *handle) Flush(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return 0
+	}
+	if err := h.v.write(ctx, h.key, h.data); err != nil {
+		return h.v.errno("store", h.key, err)
+	}
+	h.dirty = false
+	// The cache now holds the stored content
+	h.copied = false
+	return 0
+}
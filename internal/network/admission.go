@@ -0,0 +1,123 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+const (
+	// maxFullPeerHints bounds how many other peers a full node suggests to
+	// the connections it declines
+	maxFullPeerHints = 8
+	// peersFullBackoff is how long a node that declined a connection is not
+	// dialed again by discovery and peer exchange
+	peersFullBackoff = time.Minute
+	// peersFullLinger bounds how long a declined connection is kept open
+	// for the peer to read why, before it is closed
+	peersFullLinger = time.Second
+)
+
+// MessagePeersFull declines a connection because the node already has
+// FileServerOpts.MaxPeers peers. It is sent right before the connection is
+// closed, with other peers the declined node may connect to instead.
+type MessagePeersFull struct {
+	ID    string     `wire:"1"`
+	Peers []PeerInfo `wire:"2"`
+}
+
+// peersFull reports whether the node has as many peers as MaxPeers allows,
+// counting a node reached over several paths once
+func (s *FileServer) peersFull() bool {
+	if s.MaxPeers <= 0 {
+		return false
+	}
+	return s.peerCount() >= s.MaxPeers
+}
+
+// admit declines an inbound connection if the node is full, telling the
+// peer so before the connection is closed
+func (s *FileServer) admit(p p2p.Peer) error {
+	if dp, ok := p.(dialedPeer); ok && dp.Outbound() {
+		return nil // dialed by this node, which checked the limit before
+	}
+	if !s.peersFull() {
+		return nil
+	}
+	s.Metrics.IncPeersDeclined()
+	s.Logger.Info("declined peer, peers full", "peer", p.RemoteAddr().String(), "max", s.MaxPeers)
+
+	msg := Message{Payload: MessagePeersFull{ID: s.ID, Peers: s.peerHints(p.RemoteAddr().String())}}
+	if err := s.sendMessage(p, &msg); err != nil {
+		s.Logger.Debug("failed to tell declined peer", "peer", p.RemoteAddr().String(), "err", err)
+	} else {
+		// Closing with the peer's hello unread would reset the connection
+		// and could discard the answer, so what the peer sends is drained
+		// until it hangs up
+		p.SetReadDeadline(time.Now().Add(peersFullLinger))
+		io.Copy(io.Discard, p)
+	}
+	return fmt.Errorf("peers full, declined %s", p.RemoteAddr())
+}
+
+// peerHints returns the addresses a declined peer may connect to instead:
+// the ones connected nodes advertise, or else those peer exchange knows
+func (s *FileServer) peerHints(declined string) []PeerInfo {
+	s.pathsMu.Lock()
+	hints := make([]PeerInfo, 0, maxFullPeerHints)
+	for _, addr := range s.nodeAddrs {
+		if len(hints) == maxFullPeerHints {
+			break
+		}
+		if addr != "" && addr != declined {
+			hints = append(hints, PeerInfo{Address: addr, LastSeen: time.Now(), Source: "pex"})
+		}
+	}
+	s.pathsMu.Unlock()
+
+	if s.Pex != nil {
+		for _, peer := range s.Pex.GetKnownPeers() {
+			if len(hints) == maxFullPeerHints {
+				break
+			}
+			if peer.Address != declined && !s.isBlocked(peer.Address) {
+				hints = append(hints, peer)
+			}
+		}
+	}
+	return hints
+}
+
+// handleMessagePeersFull keeps discovery and peer exchange from dialing a
+// full node again for a while, and learns the peers it suggested
+func (s *FileServer) handleMessagePeersFull(ctx context.Context, from string, msg MessagePeersFull) error {
+	s.Logger.Info("peer declined the connection, peers full", "peer", from, "suggested", len(msg.Peers))
+	s.admitMu.Lock()
+	s.fullPeers[from] = time.Now().Add(peersFullBackoff)
+	s.admitMu.Unlock()
+	s.disconnectHost(from, false)
+
+	if s.Pex == nil || !s.Pex.Enabled() || len(msg.Peers) == 0 {
+		return nil
+	}
+	return s.Pex.learnPeers(ctx, from, msg.Peers)
+}
+
+// declinedRecently reports whether addr declined a connection for being
+// full less than peersFullBackoff ago
+func (s *FileServer) declinedRecently(addr string) bool {
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+	until, ok := s.fullPeers[addr]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(s.fullPeers, addr)
+		return false
+	}
+	return true
+}
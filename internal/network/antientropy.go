@@ -0,0 +1,248 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+const (
+	// digestBuckets is how many buckets the file set is split into, by the
+	// first hex character of the hashed key. Only buckets whose hashes
+	// differ are exchanged in full.
+	digestBuckets = 16
+
+	// maxRepairsPerRound bounds how many files one anti-entropy round pulls
+	// or offers, so a peer coming back after a long downtime is caught up
+	// over several rounds instead of flooding the connection.
+	maxRepairsPerRound = 64
+)
+
+// MessageDigest carries a compact summary of the sender's file set: one
+// hash per bucket and a root hash over all buckets
+type MessageDigest struct {
+	ID      string   `wire:"1"`
+	Root    string   `wire:"2"`
+	Buckets []string `wire:"3"`
+}
+
+// MessageDigestEntries answers a digest whose root did not match. It lists
+// the responder's files in every bucket that differs.
+type MessageDigestEntries struct {
+	ID      string        `wire:"1"`
+	Buckets []int         `wire:"2"`
+	Files   []DigestEntry `wire:"3"`
+}
+
+// DigestEntry is a file in a digest bucket
+type DigestEntry struct {
+	Key   string        `wire:"1"`
+	Size  int64         `wire:"2"`
+	Clock hlc.Timestamp `wire:"3"` // when the listed version was stored, zero if unknown
+}
+
+// fileDigest is the digest of a local file set
+type fileDigest struct {
+	root    string
+	buckets []string
+	files   [digestBuckets][]storage.FileInfo
+}
+
+// bucketOf returns the digest bucket of a hashed key
+func bucketOf(hash string) int {
+	if hash == "" {
+		return 0
+	}
+	b, err := strconv.ParseUint(hash[:1], 16, 8)
+	if err != nil {
+		return 0
+	}
+	return int(b)
+}
+
+// localDigest summarizes the files stored by this node. Files whose
+// original key is unknown cannot be requested by peers and are left out.
+// Stamps are part of the digest, so different versions of a key differ.
+func (s *FileServer) localDigest() (*fileDigest, error) {
+	files, err := s.store.List(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	stamps := s.keyStamps()
+
+	d := &fileDigest{buckets: make([]string, digestBuckets)}
+	for _, f := range files {
+		if _, ok := s.store.GetOriginalKey(f.Hash); !ok {
+			continue
+		}
+		b := bucketOf(f.Hash)
+		d.files[b] = append(d.files[b], f)
+	}
+
+	root := sha256.New()
+	for b := range d.files {
+		sort.Slice(d.files[b], func(i, j int) bool {
+			return d.files[b][i].Hash < d.files[b][j].Hash
+		})
+		h := sha256.New()
+		for _, f := range d.files[b] {
+			h.Write([]byte(f.Hash))
+			if clock, ok := stamps[f.Key]; ok {
+				fmt.Fprintf(h, "@%d.%d", clock.Wall, clock.Logical)
+			}
+		}
+		d.buckets[b] = hex.EncodeToString(h.Sum(nil))
+		root.Write([]byte(d.buckets[b]))
+	}
+	d.root = hex.EncodeToString(root.Sum(nil))
+	return d, nil
+}
+
+// startAntiEntropy periodically compares the local file set with a random
+// peer and repairs missing replicas on both sides, so the network converges
+// after partitions or node downtime
+func (s *FileServer) startAntiEntropy(ctx context.Context) {
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.antiEntropyRound(); err != nil {
+				s.Logger.Warn("anti-entropy round failed", "err", err)
+			}
+		case <-s.quitch:
+			return
+		case <-s.drainch:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// antiEntropyRound sends the local digest to one randomly chosen peer
+func (s *FileServer) antiEntropyRound() error {
+	var peers []p2p.Peer
+	for _, peer := range s.replicaPeers() {
+		peers = append(peers, peer)
+	}
+
+	if len(peers) == 0 {
+		return nil
+	}
+	peer := peers[rand.Intn(len(peers))]
+
+	d, err := s.localDigest()
+	if err != nil {
+		return err
+	}
+
+	msg := Message{Payload: MessageDigest{ID: s.ID, Root: d.root, Buckets: d.buckets}}
+	return s.sendMessage(peer, &msg)
+}
+
+// handleMessageDigest compares a peer's digest with the local one and sends
+// back the local files of every bucket that differs
+func (s *FileServer) handleMessageDigest(from string, msg MessageDigest) error {
+	if s.IsGuest() || s.MetadataOnly || s.isGuestPeer(from) {
+		return nil // guests and metadata-only nodes take no part in anti-entropy
+	}
+
+	d, err := s.localDigest()
+	if err != nil {
+		return err
+	}
+	if msg.Root == d.root {
+		return nil // in sync
+	}
+	if len(msg.Buckets) != digestBuckets {
+		return fmt.Errorf("digest from %s has %d buckets, want %d", from, len(msg.Buckets), digestBuckets)
+	}
+
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageDigestEntries{ID: s.ID, Files: []DigestEntry{}}
+	for b := 0; b < digestBuckets; b++ {
+		if msg.Buckets[b] == d.buckets[b] {
+			continue
+		}
+		resp.Buckets = append(resp.Buckets, b)
+		for _, f := range d.files[b] {
+			if !s.allowReplica(f.Key, peer) {
+				continue // placement keeps the peer from pulling it
+			}
+			resp.Files = append(resp.Files, DigestEntry{Key: f.Key, Size: f.Size, Clock: s.KeyStamp(f.Key)})
+		}
+	}
+
+	return s.sendMessage(peer, &Message{Payload: resp})
+}
+
+// handleMessageDigestEntries repairs the differing buckets in both
+// directions: files only the peer holds, or holds a later version of, are
+// pulled, and files only this node holds, or holds a later version of, are
+// offered to the peer, which pulls them in turn
+func (s *FileServer) handleMessageDigestEntries(from string, msg MessageDigestEntries) error {
+	d, err := s.localDigest()
+	if err != nil {
+		return err
+	}
+
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	remote := make(map[string]hlc.Timestamp, len(msg.Files))
+	repairs := 0
+	for _, f := range msg.Files {
+		remote[f.Key] = f.Clock
+		if repairs >= maxRepairsPerRound || !s.supersedes(f.Key, f.Clock) {
+			continue
+		}
+		// Same path as a replica announcement: pull, resuming any partial copy
+		if err := s.handleMessageStoreFile(from, MessageStoreFile{ID: msg.ID, Key: f.Key, Size: f.Size, Clock: f.Clock}); err != nil {
+			return err
+		}
+		repairs++
+	}
+	pulled := repairs
+
+	for _, b := range msg.Buckets {
+		if b < 0 || b >= digestBuckets {
+			continue
+		}
+		for _, f := range d.files[b] {
+			if repairs >= maxRepairsPerRound || !s.allowReplica(f.Key, peer) {
+				continue
+			}
+			clock := s.KeyStamp(f.Key)
+			if theirs, ok := remote[f.Key]; ok && !theirs.Before(clock) {
+				continue
+			}
+			offer := Message{Payload: MessageStoreFile{ID: s.ID, Key: f.Key, Size: f.Size, Clock: clock}}
+			if err := s.sendMessage(peer, &offer); err != nil {
+				return err
+			}
+			repairs++
+		}
+	}
+
+	if repairs > 0 {
+		s.Logger.Info("anti-entropy repairing replicas", "peer", from, "pulled", pulled, "offered", repairs-pulled)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most a throttled stream moves before it waits for
+// tokens, which keeps the rate smooth for slow limits
+const throttleChunk = 32 * 1024
+
+// tokenBucket limits a byte rate. Tokens refill at rate bytes per second up
+// to one second's worth, so a stream that was idle can burst briefly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for rate bytes per second, or nil when
+// rate is not positive, meaning no limit
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, waiting until the bucket has refilled enough. Tokens
+// are taken up front, so concurrent streams queue behind each other instead
+// of all waking at once.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than every one of its buckets allows
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	for _, b := range t.buckets {
+		if werr := b.wait(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// peerBandwidth is the per-peer part of the limits
+type peerBandwidth struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+// peerBuckets returns the buckets of a peer, created on first use
+func (s *FileServer) peerBuckets(addr string) *peerBandwidth {
+	s.bandwidthMu.Lock()
+	defer s.bandwidthMu.Unlock()
+	pb, ok := s.peerBandwidth[addr]
+	if !ok {
+		pb = &peerBandwidth{
+			upload:   newTokenBucket(s.PeerMaxUpload),
+			download: newTokenBucket(s.PeerMaxDownload),
+		}
+		s.peerBandwidth[addr] = pb
+	}
+	return pb
+}
+
+// forgetBandwidth drops the buckets of a disconnected peer
+func (s *FileServer) forgetBandwidth(addr string) {
+	s.bandwidthMu.Lock()
+	defer s.bandwidthMu.Unlock()
+	delete(s.peerBandwidth, addr)
+}
+
+// throttleUpload limits how fast r is read to be streamed to a peer, by
+// MaxUpload and PeerMaxUpload. r is returned as is without limits.
+func (s *FileServer) throttleUpload(ctx context.Context, addr string, r io.Reader) io.Reader {
+	if s.MaxUpload <= 0 && s.PeerMaxUpload <= 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, buckets: []*tokenBucket{s.upload, s.peerBuckets(addr).upload}}
+}
+
+// throttleDownload returns the reader a stream from a peer is read
+// through, limited by MaxDownload and PeerMaxDownload. Reading slower makes
+// the sender's writes block, so the limit holds for senders that do not
+// throttle themselves.
+func (s *FileServer) throttleDownload(addr string, conn io.Reader) io.Reader {
+	if s.MaxDownload <= 0 && s.PeerMaxDownload <= 0 {
+		return conn
+	}
+	return &throttledReader{ctx: context.Background(), r: conn, buckets: []*tokenBucket{s.download, s.peerBuckets(addr).download}}
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottledReaderLimitsRate(t *testing.T) {
+	const rate = 64 * 1024
+	data := bytes.Repeat([]byte{1}, 2*rate)
+
+	// The first second's worth is a burst, the rest arrives at the rate
+	start := time.Now()
+	r := &throttledReader{ctx: context.Background(), r: bytes.NewReader(data), buckets: []*tokenBucket{newTokenBucket(rate)}}
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 900*time.Millisecond)
+	assert.Less(t, elapsed, 3*time.Second)
+
+	// The slowest bucket wins, and no limit is no bucket
+	start = time.Now()
+	r = &throttledReader{ctx: context.Background(), r: bytes.NewReader(data), buckets: []*tokenBucket{nil, newTokenBucket(4 * rate), newTokenBucket(rate)}}
+	_, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+	assert.Nil(t, newTokenBucket(0))
+}
+
+func TestThrottledReaderCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bucket := newTokenBucket(1024)
+	r := &throttledReader{ctx: ctx, r: bytes.NewReader(make([]byte, 64*1024)), buckets: []*tokenBucket{bucket}}
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
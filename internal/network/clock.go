@@ -0,0 +1,115 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+)
+
+// keyStamp is the hybrid logical clock time a key was last stored or
+// deleted at. When two nodes hold different copies of a key, the later
+// stamp wins, whatever the wall clocks of the nodes say.
+type keyStamp struct {
+	Clock   hlc.Timestamp `json:"hlc"`
+	Deleted bool          `json:"deleted,omitempty"`
+}
+
+// stampsPath is where key stamps are persisted, next to the key metadata
+func (s *FileServer) stampsPath() string {
+	return filepath.Join(s.StorageRoot, "stamps.json")
+}
+
+// loadStamps reads persisted key stamps, if any, and moves the clock past
+// the latest of them, so a clock stepped back while the node was down does
+// not stamp new versions before old ones
+func (s *FileServer) loadStamps() error {
+	data, err := os.ReadFile(s.stampsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.OpenRecord(data); err != nil {
+		return fmt.Errorf("failed to open key stamps: %w", err)
+	}
+
+	s.stampsMu.Lock()
+	defer s.stampsMu.Unlock()
+	if err := json.Unmarshal(data, &s.stamps); err != nil {
+		return err
+	}
+	for _, stamp := range s.stamps {
+		s.Clock.Update(stamp.Clock)
+	}
+	return nil
+}
+
+// saveStamps persists all key stamps. Callers hold stampsMu.
+func (s *FileServer) saveStamps() error {
+	data, err := json.MarshalIndent(s.stamps, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.SealRecord(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.stampsPath(), data, 0644)
+}
+
+// stampKey records that key was stored, or deleted, at clock
+func (s *FileServer) stampKey(key string, clock hlc.Timestamp, deleted bool) {
+	s.stampsMu.Lock()
+	defer s.stampsMu.Unlock()
+	s.stamps[key] = keyStamp{Clock: clock, Deleted: deleted}
+	if err := s.saveStamps(); err != nil {
+		s.Logger.Warn("failed to persist key stamps", "err", err)
+	}
+}
+
+// KeyStamp returns when the stored copy of key was written, in HLC time.
+// It is zero for files stored before the node had a clock.
+func (s *FileServer) KeyStamp(key string) hlc.Timestamp {
+	s.stampsMu.Lock()
+	defer s.stampsMu.Unlock()
+	if stamp, ok := s.stamps[key]; ok && !stamp.Deleted {
+		return stamp.Clock
+	}
+	return hlc.Timestamp{}
+}
+
+// keyStamps returns the stamps of all stored keys
+func (s *FileServer) keyStamps() map[string]hlc.Timestamp {
+	s.stampsMu.Lock()
+	defer s.stampsMu.Unlock()
+	stamps := make(map[string]hlc.Timestamp, len(s.stamps))
+	for key, stamp := range s.stamps {
+		if !stamp.Deleted {
+			stamps[key] = stamp.Clock
+		}
+	}
+	return stamps
+}
+
+// supersedes reports whether a copy of key stamped clock should replace
+// what this node holds: nothing, an earlier version, or a deletion before
+// clock. A stamped copy also replaces a file stored before stamps existed,
+// while an unstamped one only fills a gap.
+func (s *FileServer) supersedes(key string, clock hlc.Timestamp) bool {
+	s.stampsMu.Lock()
+	stamp, ok := s.stamps[key]
+	s.stampsMu.Unlock()
+	if !ok {
+		return !clock.IsZero() || !s.store.Has(s.ID, key)
+	}
+	if !stamp.Deleted && !s.store.Has(s.ID, key) {
+		return true // lost since, e.g. removed as corrupted
+	}
+	return stamp.Clock.Before(clock)
+}
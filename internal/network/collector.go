@@ -0,0 +1,60 @@
+package network
+
+import (
+	"context"
+	"time"
+)
+
+// collectMetrics keeps the gauges that nothing else updates current:
+// storage usage and quota, disks, connected peers and discovered peers. It
+// runs once right away and then every MetricsInterval.
+func (s *FileServer) collectMetrics(ctx context.Context) {
+	ticker := time.NewTicker(s.MetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		s.updateMetrics()
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateMetrics refreshes the collected gauges. Usage comes from the quota
+// manager's cache, so the storage root is walked at most once per interval
+// however often quotas are checked in between.
+func (s *FileServer) updateMetrics() {
+	used, err := s.QuotaManager.CachedUsage(s.StorageRoot, s.MetricsInterval)
+	if err != nil {
+		s.Logger.Warn("failed to measure storage usage", "err", err)
+	} else {
+		s.Metrics.UpdateStorageMetrics(used, s.QuotaManager.GetMaxStorage())
+		s.checkQuotaWarning(used, s.QuotaManager.GetMaxStorage())
+	}
+
+	for _, disk := range s.store.DiskUsage() {
+		s.Metrics.SetDisk(disk.Path, string(disk.State), disk.Used, disk.Quota)
+	}
+
+	s.PeerLock.Lock()
+	s.Metrics.SetPeersConnected(len(s.Peers))
+	s.PeerLock.Unlock()
+
+	// A peer found by both mDNS and PEX counts once
+	discovered := make(map[string]struct{})
+	if s.Discovery != nil {
+		for _, addr := range s.Discovery.GetDiscoveredPeers() {
+			discovered[addr] = struct{}{}
+		}
+	}
+	if s.Pex != nil && s.Pex.Enabled() {
+		for _, peer := range s.Pex.ExportPeerList() {
+			discovered[peer.Address] = struct{}{}
+		}
+	}
+	s.Metrics.SetPeersDiscovered(len(discovered))
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// DedupGroup is content stored under more than one key
+type DedupGroup struct {
+	Hash string // SHA-256 of the plaintext
+	Size int64
+	Keys []string
+}
+
+// Wasted is the space taken by the extra copies of the content
+func (g DedupGroup) Wasted() int64 {
+	return g.Size * int64(len(g.Keys)-1)
+}
+
+// DedupReport compares the bytes stored on this node with the bytes of its
+// distinct content. Every file is encrypted with its own IV, so duplicates
+// are found by hashing the decrypted content.
+type DedupReport struct {
+	Files         int
+	LogicalBytes  int64        // plaintext size of every stored file
+	PhysicalBytes int64        // plaintext size of the distinct content
+	Duplicates    []DedupGroup // most wasted space first
+}
+
+// Ratio is the logical size over the physical size, 1 without duplicates
+func (r DedupReport) Ratio() float64 {
+	if r.PhysicalBytes == 0 {
+		return 1
+	}
+	return float64(r.LogicalBytes) / float64(r.PhysicalBytes)
+}
+
+// Savings is the space storing each content once would reclaim
+func (r DedupReport) Savings() int64 {
+	return r.LogicalBytes - r.PhysicalBytes
+}
+
+// DedupStats reads every file stored on this node and reports how much of
+// it is duplicated content, listing at most top groups of duplicates (all
+// of them if top is 0). The totals are also exported as metrics.
+func (s *FileServer) DedupStats(ctx context.Context, top int) (DedupReport, error) {
+	files, err := s.store.List(s.ID)
+	if err != nil {
+		return DedupReport{}, err
+	}
+
+	var report DedupReport
+	groups := make(map[string]*DedupGroup)
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return DedupReport{}, err
+		}
+		hash, size, err := s.plaintextHash(f.Key)
+		if err != nil {
+			s.Logger.Warn("skipping file in dedup report", "key", f.Key, "err", err)
+			continue
+		}
+
+		report.Files++
+		report.LogicalBytes += size
+		g, ok := groups[hash]
+		if !ok {
+			g = &DedupGroup{Hash: hash, Size: size}
+			groups[hash] = g
+			report.PhysicalBytes += size
+		}
+		g.Keys = append(g.Keys, f.Key)
+	}
+
+	for _, g := range groups {
+		if len(g.Keys) > 1 {
+			sort.Strings(g.Keys)
+			report.Duplicates = append(report.Duplicates, *g)
+		}
+	}
+	sort.Slice(report.Duplicates, func(i, j int) bool {
+		a, b := report.Duplicates[i], report.Duplicates[j]
+		if a.Wasted() != b.Wasted() {
+			return a.Wasted() > b.Wasted()
+		}
+		return a.Hash < b.Hash
+	})
+	if top > 0 && len(report.Duplicates) > top {
+		report.Duplicates = report.Duplicates[:top]
+	}
+
+	s.Metrics.SetDedupStats(report.LogicalBytes, report.PhysicalBytes)
+	return report, nil
+}
+
+// plaintextHash decrypts a stored file and returns the hash and size of its
+// content
+func (s *FileServer) plaintextHash(key string) (string, int64, error) {
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot open data key: %w", err)
+	}
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return "", 0, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	h := sha256.New()
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := crypto.CopyDecrypt(encKey, r, pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	n, err := io.Copy(h, storage.Decompress(pr))
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
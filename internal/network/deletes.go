@@ -0,0 +1,223 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// pendingDeleteMaxAge is how long a delete is kept for the peers that have
+// not been told yet, in case some of them never come back
+const pendingDeleteMaxAge = 30 * 24 * time.Hour
+
+// MessageFileDeleted tells peers that a file was deleted at Clock. Peers
+// remove a replica written before then, and refuse older copies from now on.
+type MessageFileDeleted struct {
+	ID    string        `wire:"1"`
+	Key   string        `wire:"2"`
+	Clock hlc.Timestamp `wire:"3"` // when the file was deleted
+}
+
+// pendingDelete is a delete not yet delivered to enough peers. Deletes are
+// journaled like replica pushes, so a node deleting files while offline
+// tells its peers once they reconnect.
+type pendingDelete struct {
+	Clock  hlc.Timestamp `json:"hlc"`
+	Queued time.Time     `json:"queued"`
+	Sent   []string      `json:"sent,omitempty"` // nodes told, by fingerprint
+}
+
+// pendingDeletesPath is where deletes not delivered yet are journaled
+func (s *FileServer) pendingDeletesPath() string {
+	return filepath.Join(s.StorageRoot, "pending_deletes.json")
+}
+
+// loadPendingDeletes reads the deletes journaled before the node went
+// down, dropping those for keys stored again since
+func (s *FileServer) loadPendingDeletes() error {
+	data, err := os.ReadFile(s.pendingDeletesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.OpenRecord(data); err != nil {
+		return fmt.Errorf("failed to open pending deletes: %w", err)
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if err := json.Unmarshal(data, &s.pendingDeletes); err != nil {
+		return err
+	}
+	for key := range s.pendingDeletes {
+		if s.store.Has(s.ID, key) {
+			delete(s.pendingDeletes, key)
+		}
+	}
+	if n := len(s.pendingDeletes); n > 0 {
+		s.Logger.Info("resuming pending deletes", "count", n)
+	}
+	return nil
+}
+
+// savePendingDeletes persists the pending deletes. Callers hold pendingMu.
+func (s *FileServer) savePendingDeletes() error {
+	if len(s.pendingDeletes) == 0 {
+		if err := os.Remove(s.pendingDeletesPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(s.pendingDeletes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.SealRecord(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.pendingDeletesPath(), data, 0644)
+}
+
+// deleteTargets returns how many nodes a delete is delivered to before it
+// leaves the journal: every other holder of a full set of replicas
+func (s *FileServer) deleteTargets() int {
+	return max(s.replicationFactor()-1, 1)
+}
+
+// propagateDelete journals the delete of key and tells the connected peers
+func (s *FileServer) propagateDelete(key string, clock hlc.Timestamp) {
+	s.pendingMu.Lock()
+	s.pendingDeletes[key] = &pendingDelete{Clock: clock, Queued: time.Now()}
+	if err := s.savePendingDeletes(); err != nil {
+		s.Logger.Warn("failed to persist pending deletes", "err", err)
+	}
+	s.pendingMu.Unlock()
+
+	for _, p := range s.replicaPeers() {
+		s.sendPendingDeletes(p)
+	}
+}
+
+// clearPendingDelete forgets the delete of key, once it was stored again
+func (s *FileServer) clearPendingDelete(key string) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if _, ok := s.pendingDeletes[key]; !ok {
+		return
+	}
+	delete(s.pendingDeletes, key)
+	if err := s.savePendingDeletes(); err != nil {
+		s.Logger.Warn("failed to persist pending deletes", "err", err)
+	}
+}
+
+// PendingDeletes returns how many deletes have not been delivered to enough
+// peers yet
+func (s *FileServer) PendingDeletes() int {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pendingDeletes)
+}
+
+// sendPendingDeletes tells a peer about the deletes it has not been told
+// about. It runs once the peer said hello, so the deletes it was sent are
+// recorded under its node rather than the address of one connection.
+func (s *FileServer) sendPendingDeletes(p p2p.Peer) {
+	addr := p.RemoteAddr().String()
+	if s.isGuestPeer(addr) {
+		return
+	}
+	node := s.scoreKey(addr)
+
+	s.pendingMu.Lock()
+	var msgs []MessageFileDeleted
+	expired := false
+	for key, d := range s.pendingDeletes {
+		if time.Since(d.Queued) > pendingDeleteMaxAge {
+			s.Logger.Warn("dropped pending delete not delivered in time", "key", key, "sent", len(d.Sent))
+			delete(s.pendingDeletes, key)
+			expired = true
+			continue
+		}
+		if !slices.Contains(d.Sent, node) {
+			msgs = append(msgs, MessageFileDeleted{ID: s.ID, Key: key, Clock: d.Clock})
+		}
+	}
+	if expired {
+		if err := s.savePendingDeletes(); err != nil {
+			s.Logger.Warn("failed to persist pending deletes", "err", err)
+		}
+	}
+	s.pendingMu.Unlock()
+
+	var sent []string
+	for _, msg := range msgs {
+		if err := s.sendMessage(p, &Message{Payload: msg}); err != nil {
+			s.Logger.Warn("failed to send delete to peer", "peer", addr, "key", msg.Key, "err", err)
+			break
+		}
+		sent = append(sent, msg.Key)
+	}
+	if len(sent) == 0 {
+		return
+	}
+	s.Logger.Info("sent pending deletes to peer", "peer", addr, "count", len(sent))
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for _, key := range sent {
+		d, ok := s.pendingDeletes[key]
+		if !ok {
+			continue
+		}
+		if !slices.Contains(d.Sent, node) {
+			d.Sent = append(d.Sent, node)
+		}
+		if len(d.Sent) >= s.deleteTargets() {
+			delete(s.pendingDeletes, key)
+		}
+	}
+	if err := s.savePendingDeletes(); err != nil {
+		s.Logger.Warn("failed to persist pending deletes", "err", err)
+	}
+}
+
+// handleMessageFileDeleted removes the local replica of a file deleted on a
+// peer, unless this node stored a newer version since, and remembers the
+// delete so older copies offered later are refused
+func (s *FileServer) handleMessageFileDeleted(from string, msg MessageFileDeleted) error {
+	if s.isGuestPeer(from) {
+		return nil
+	}
+	s.Clock.Update(msg.Clock)
+	if !s.supersedes(msg.Key, msg.Clock) {
+		return nil
+	}
+	if !s.store.Has(s.ID, msg.Key) {
+		s.stampKey(msg.Key, msg.Clock, true)
+		return nil
+	}
+	if err := s.checkHold(msg.Key, "delete"); err != nil {
+		return err
+	}
+	if err := s.store.Delete(s.ID, msg.Key); err != nil {
+		return fmt.Errorf("failed to remove deleted replica of %s: %w", msg.Key, err)
+	}
+	s.stampKey(msg.Key, msg.Clock, true)
+	s.clearPendingPush(msg.Key)
+	s.Logger.Info("removed deleted replica", "peer", from, "key", msg.Key)
+	s.Events.Publish(events.Event{Type: events.FileDeleted, Key: msg.Key, Peer: from, Detail: "deleted on peer"})
+	return nil
+}
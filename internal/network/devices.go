@@ -0,0 +1,365 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// AuthorizedDevice is a device allowed to read the files stored by this node
+type AuthorizedDevice struct {
+	Name      string    `json:"name" wire:"1"`
+	PublicKey []byte    `json:"public_key" wire:"2"`
+	Added     time.Time `json:"added" wire:"3"`
+}
+
+// MessageDeviceGrant shares the sender's authorized devices with one of
+// them, together with file data keys wrapped for the recipient, keyed by
+// hashed file key
+type MessageDeviceGrant struct {
+	ID      string             `wire:"1"`
+	Devices []AuthorizedDevice `wire:"2"`
+	Keys    map[string][]byte  `wire:"3"`
+}
+
+// deviceState is what devices.json holds: the authorized devices and the
+// data key of every readable file, wrapped for this device
+type deviceState struct {
+	Devices []AuthorizedDevice `json:"devices"`
+	Keys    map[string][]byte  `json:"keys"`
+}
+
+// devicesPath is where device state is persisted, next to the key metadata
+func (s *FileServer) devicesPath() string {
+	return filepath.Join(s.StorageRoot, "devices.json")
+}
+
+// loadDevices reads the device key and the persisted device state. The
+// device itself is always authorized.
+func (s *FileServer) loadDevices() error {
+	dk, err := crypto.LoadOrCreateDeviceKey(filepath.Join(s.StorageRoot, "device.key"))
+	if err != nil {
+		return err
+	}
+	s.deviceKey = dk
+
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+
+	data, err := os.ReadFile(s.devicesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var state deviceState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+		s.devices = state.Devices
+		if state.Keys != nil {
+			s.fileKeys = state.Keys
+		}
+	}
+	if !s.isAuthorizedLocked(dk.PublicKey) {
+		s.devices = append(s.devices, AuthorizedDevice{Name: "this device", PublicKey: dk.PublicKey, Added: time.Now()})
+		return s.saveDevices()
+	}
+	return nil
+}
+
+// saveDevices persists the device state. Callers hold devicesMu.
+func (s *FileServer) saveDevices() error {
+	data, err := json.MarshalIndent(deviceState{Devices: s.devices, Keys: s.fileKeys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.devicesPath(), data, 0600)
+}
+
+// isAuthorizedLocked reports whether a device public key is authorized.
+// Callers hold devicesMu.
+func (s *FileServer) isAuthorizedLocked(publicKey []byte) bool {
+	for _, d := range s.devices {
+		if bytes.Equal(d.PublicKey, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOtherDevice reports whether a device key belongs to another authorized
+// device of this user
+func (s *FileServer) isOtherDevice(publicKey []byte) bool {
+	if s.deviceKey == nil || len(publicKey) == 0 || bytes.Equal(publicKey, s.deviceKey.PublicKey) {
+		return false
+	}
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	return s.isAuthorizedLocked(publicKey)
+}
+
+// DevicePublicKey returns the public key of this device, or nil if device
+// keys are disabled
+func (s *FileServer) DevicePublicKey() []byte {
+	if s.deviceKey == nil {
+		return nil
+	}
+	return s.deviceKey.PublicKey
+}
+
+// Devices lists the devices authorized to read the files stored here
+func (s *FileServer) Devices() []AuthorizedDevice {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	return append([]AuthorizedDevice(nil), s.devices...)
+}
+
+// AuthorizeDevice allows another device to read the files stored by this
+// node. Their data keys are wrapped for it and handed over as soon as it is
+// connected; the raw keys never leave this device.
+func (s *FileServer) AuthorizeDevice(publicKey []byte, name string) error {
+	if s.deviceKey == nil {
+		return errors.New("device keys are disabled")
+	}
+	if _, err := crypto.WrapKey(publicKey, make([]byte, 32)); err != nil {
+		return err
+	}
+
+	s.devicesMu.Lock()
+	if s.isAuthorizedLocked(publicKey) {
+		s.devicesMu.Unlock()
+		return fmt.Errorf("device %s is already authorized", crypto.Fingerprint(publicKey))
+	}
+	s.devices = append(s.devices, AuthorizedDevice{Name: name, PublicKey: publicKey, Added: time.Now()})
+	err := s.saveDevices()
+	s.devicesMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Info("device authorized", "device", crypto.Fingerprint(publicKey), "name", name)
+	s.grantConnectedDevices(s.wrapFileKeys)
+	return nil
+}
+
+// sealFileKey generates the data key of a file being stored, keeping it
+// wrapped for this device. Without device keys the network key is used. A
+// file stored again keeps its data key, so its earlier versions stay
+// readable.
+func (s *FileServer) sealFileKey(key string) ([]byte, error) {
+	if s.deviceKey == nil {
+		return s.EncKey, nil
+	}
+	s.devicesMu.Lock()
+	wrapped, ok := s.fileKeys[crypto.HashKey(key)]
+	s.devicesMu.Unlock()
+	if ok {
+		if dataKey, err := s.deviceKey.UnwrapKey(wrapped); err == nil {
+			return dataKey, nil
+		}
+	}
+
+	dataKey, err := crypto.NewEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err = crypto.WrapKey(s.deviceKey.PublicKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	s.fileKeys[crypto.HashKey(key)] = wrapped
+	if err := s.saveDevices(); err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+// openFileKey returns the key a file was encrypted with: its data key if
+// this device holds one for it, the network key otherwise
+func (s *FileServer) openFileKey(key string) ([]byte, error) {
+	if s.deviceKey == nil {
+		return s.EncKey, nil
+	}
+
+	s.devicesMu.Lock()
+	wrapped, ok := s.fileKeys[crypto.HashKey(key)]
+	s.devicesMu.Unlock()
+	if !ok {
+		return s.EncKey, nil
+	}
+	return s.deviceKey.UnwrapKey(wrapped)
+}
+
+// wrapFileKeys rewraps every data key this device holds for another device
+func (s *FileServer) wrapFileKeys(publicKey []byte) map[string][]byte {
+	s.devicesMu.Lock()
+	own := make(map[string][]byte, len(s.fileKeys))
+	for hash, wrapped := range s.fileKeys {
+		own[hash] = wrapped
+	}
+	s.devicesMu.Unlock()
+
+	keys := make(map[string][]byte, len(own))
+	for hash, wrapped := range own {
+		dataKey, err := s.deviceKey.UnwrapKey(wrapped)
+		if err != nil {
+			s.Logger.Warn("cannot unwrap file key", "key", hash, "err", err)
+			continue
+		}
+		rewrapped, err := crypto.WrapKey(publicKey, dataKey)
+		if err != nil {
+			s.Logger.Warn("cannot wrap file key", "key", hash, "err", err)
+			continue
+		}
+		keys[hash] = rewrapped
+	}
+	return keys
+}
+
+// shareFileKey wraps the data key of a newly stored file for every
+// connected authorized device
+func (s *FileServer) shareFileKey(key string, dataKey []byte) {
+	hash := crypto.HashKey(key)
+	s.grantConnectedDevices(func(publicKey []byte) map[string][]byte {
+		wrapped, err := crypto.WrapKey(publicKey, dataKey)
+		if err != nil {
+			s.Logger.Warn("cannot wrap file key", "key", key, "err", err)
+			return nil
+		}
+		return map[string][]byte{hash: wrapped}
+	})
+}
+
+// grantDevice sends an authorized device the device list and the data
+// keys returned by keysFor, wrapped for it
+func (s *FileServer) grantDevice(peer p2p.Peer, publicKey []byte, keysFor func([]byte) map[string][]byte) {
+	grant := MessageDeviceGrant{
+		ID:      s.ID,
+		Devices: s.Devices(),
+		Keys:    keysFor(publicKey),
+	}
+	if err := s.sendMessage(peer, &Message{Payload: grant}); err != nil {
+		s.Logger.Warn("failed to send device grant", "peer", peer.RemoteAddr().String(), "err", err)
+		return
+	}
+	s.Logger.Info("granted file keys to device", "peer", peer.RemoteAddr().String(),
+		"device", crypto.Fingerprint(publicKey), "keys", len(grant.Keys))
+}
+
+// grantConnectedDevices sends a grant to every connected authorized device
+func (s *FileServer) grantConnectedDevices(keysFor func([]byte) map[string][]byte) {
+	if s.deviceKey == nil {
+		return
+	}
+
+	type target struct {
+		peer      p2p.Peer
+		publicKey []byte
+	}
+	var targets []target
+
+	s.pathsMu.Lock()
+	for node, publicKey := range s.nodeDevices {
+		if !s.isOtherDevice(publicKey) {
+			continue
+		}
+		if best := s.bestPath(node, nil); best != nil {
+			targets = append(targets, target{best.peer, publicKey})
+		}
+	}
+	s.pathsMu.Unlock()
+
+	for _, t := range targets {
+		go s.grantDevice(t.peer, t.publicKey, keysFor)
+	}
+}
+
+// handleMessageDeviceGrant accepts data keys and devices from another
+// device. Grants are only taken from authorized devices, except for the
+// first one: a device that has not been paired yet trusts the first device
+// that authorizes it.
+func (s *FileServer) handleMessageDeviceGrant(from string, msg MessageDeviceGrant) error {
+	if s.deviceKey == nil {
+		return nil
+	}
+
+	s.pathsMu.Lock()
+	sender := s.nodeDevices[s.pathNode[from]]
+	s.pathsMu.Unlock()
+	if sender == nil {
+		return fmt.Errorf("device grant from %s before its hello", from)
+	}
+
+	s.devicesMu.Lock()
+	paired := len(s.devices) > 1
+	if !s.isAuthorizedLocked(sender) {
+		listed := false
+		for _, d := range msg.Devices {
+			listed = listed || bytes.Equal(d.PublicKey, s.deviceKey.PublicKey)
+		}
+		if paired || !listed {
+			s.devicesMu.Unlock()
+			return fmt.Errorf("ignoring device grant from unauthorized device %s", crypto.Fingerprint(sender))
+		}
+	}
+
+	added := 0
+	for _, d := range msg.Devices {
+		if !s.isAuthorizedLocked(d.PublicKey) {
+			s.devices = append(s.devices, d)
+			added++
+		}
+	}
+	accepted := 0
+	for hash, wrapped := range msg.Keys {
+		if _, err := s.deviceKey.UnwrapKey(wrapped); err != nil {
+			continue // not for this device
+		}
+		if !bytes.Equal(s.fileKeys[hash], wrapped) {
+			s.fileKeys[hash] = wrapped
+			accepted++
+		}
+	}
+	var err error
+	if added > 0 || accepted > 0 {
+		err = s.saveDevices()
+	}
+	s.devicesMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if added > 0 || accepted > 0 {
+		s.Logger.Info("accepted device grant", "peer", from, "devices", added, "keys", accepted)
+	}
+	if added > 0 {
+		// Devices learned here get the keys of files stored on this device
+		s.grantConnectedDevices(s.wrapFileKeys)
+	}
+	return nil
+}
+
+// devicesInUse reports whether a connected node announced a device key
+func (s *FileServer) devicesInUse() bool {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	for _, publicKey := range s.nodeDevices {
+		if len(publicKey) > 0 {
+			return true
+		}
+	}
+	return false
+}
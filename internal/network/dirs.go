@@ -0,0 +1,175 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// dirManifestFormat identifies a directory manifest among stored files
+const dirManifestFormat = "peervault-dir/1"
+
+// DirEntry is a file or directory inside a stored directory tree
+type DirEntry struct {
+	Path string      `json:"path"` // Slash-separated, relative to the tree root
+	Mode fs.FileMode `json:"mode"` // Permission bits
+	Size int64       `json:"size,omitempty"`
+	Dir  bool        `json:"dir,omitempty"`
+}
+
+// DirManifest describes a stored directory tree. It is stored under the
+// tree's key; every file is stored separately under key/path, so files are
+// replicated and fetched like any other.
+type DirManifest struct {
+	Format  string     `json:"format"`
+	Entries []DirEntry `json:"entries"`
+}
+
+// dirFileKey is the key a file of a stored tree is kept under
+func dirFileKey(key, path string) string {
+	return key + "/" + path
+}
+
+// StoreDir stores every regular file under root, then a manifest recording
+// the relative paths and permissions, under key. Symlinks and other special
+// files are skipped.
+func (s *FileServer) StoreDir(ctx context.Context, key string, root string) (*DirManifest, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	manifest := &DirManifest{Format: dirManifestFormat}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			manifest.Entries = append(manifest.Entries, DirEntry{Path: rel, Mode: info.Mode().Perm(), Dir: true})
+		case d.Type().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			err = s.Store(ctx, dirFileKey(key, rel), f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to store %s: %w", rel, err)
+			}
+			manifest.Entries = append(manifest.Entries, DirEntry{Path: rel, Mode: info.Mode().Perm(), Size: info.Size()})
+		default:
+			s.Logger.Warn("skipping special file", "path", path, "type", d.Type().String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store(ctx, key, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to store manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// GetDir recreates the tree stored under key in dest, fetching files from
+// peers as needed
+func (s *FileServer) GetDir(ctx context.Context, key string, dest string) (*DirManifest, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// Read to the end, so the manifest is authenticated before it is used
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var manifest DirManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Format != dirManifestFormat {
+		return nil, fmt.Errorf("%s is not a stored directory", key)
+	}
+	for _, e := range manifest.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return nil, fmt.Errorf("manifest of %s has an invalid path %q", key, e.Path)
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+
+	// Directories stay writable until their files are in place
+	var dirs []DirEntry
+	for _, e := range manifest.Entries {
+		path := filepath.Join(dest, filepath.FromSlash(e.Path))
+		if e.Dir {
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, e)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := s.getDirFile(ctx, dirFileKey(key, e.Path), path, e.Mode); err != nil {
+			return nil, fmt.Errorf("failed to retrieve %s: %w", e.Path, err)
+		}
+	}
+
+	// Deepest first, so a read-only parent does not block its children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dest, filepath.FromSlash(dirs[i].Path))
+		if err := os.Chmod(path, dirs[i].Mode); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, nil
+}
+
+func (s *FileServer) getDirFile(ctx context.Context, key string, path string, mode fs.FileMode) error {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Set explicitly, the umask would otherwise apply
+	return os.Chmod(path, mode)
+}
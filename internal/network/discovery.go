@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,8 +24,10 @@ const (
 // DiscoveryService handles peer discovery via mDNS
 type DiscoveryService struct {
 	serviceName     string
-	port            int
-	advertiseAddr   string
+	port            int    // port this node listens on
+	advertiseAddr   string // announced as addr= for peers to connect to
+	nodeID          string // announced as id=, so a node skips its own advertisement
+	networkID       string // announced as net=, so nodes of other networks are skipped
 	server          *mdns.Server
 	onPeerFound     func(string) error
 	discoveredPeers map[string]time.Time
@@ -35,8 +38,9 @@ type DiscoveryService struct {
 	logger          *slog.Logger
 }
 
-// NewDiscoveryService creates a new mDNS discovery service
-func NewDiscoveryService(serviceName string, port int, advertiseAddr string, logger *slog.Logger) *DiscoveryService {
+// NewDiscoveryService creates a new mDNS discovery service advertising a
+// node listening on port
+func NewDiscoveryService(serviceName string, port int, advertiseAddr, nodeID, networkID string, logger *slog.Logger) *DiscoveryService {
 	if logger == nil {
 		logger = slog.Default()
 	}
@@ -45,6 +49,8 @@ func NewDiscoveryService(serviceName string, port int, advertiseAddr string, log
 		serviceName:     serviceName,
 		port:            port,
 		advertiseAddr:   advertiseAddr,
+		nodeID:          nodeID,
+		networkID:       networkID,
 		discoveredPeers: make(map[string]time.Time),
 		stopCh:          make(chan struct{}),
 		ctx:             ctx,
@@ -82,6 +88,17 @@ func (ds *DiscoveryService) SetPeerFoundCallback(callback func(string) error) {
 	ds.onPeerFound = callback
 }
 
+// SetAdvertiseAddr announces a new address for this node, replacing the
+// running advertisement
+func (ds *DiscoveryService) SetAdvertiseAddr(addr string) error {
+	if ds.server != nil {
+		ds.server.Shutdown()
+		ds.server = nil
+	}
+	ds.advertiseAddr = addr
+	return ds.startAdvertising()
+}
+
 // startAdvertising advertises this node on the local network
 func (ds *DiscoveryService) startAdvertising() error {
 	// Get hostname
@@ -104,7 +121,7 @@ func (ds *DiscoveryService) startAdvertising() error {
 		"",
 		ds.port,
 		ips,
-		[]string{"version=1.0", fmt.Sprintf("addr=%s", ds.advertiseAddr)},
+		[]string{"version=1.0", "addr=" + ds.advertiseAddr, "id=" + ds.nodeID, "net=" + ds.networkID},
 	)
 	if err != nil {
 		return err
@@ -173,11 +190,58 @@ func (ds *DiscoveryService) discoverPeers(ctx context.Context) {
 	}
 }
 
+// listenPort returns the port of an address such as ":3000", or 0 if it
+// has none
+func listenPort(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// txtValue returns the value of key in the TXT records of an entry
+func txtValue(entry *mdns.ServiceEntry, key string) string {
+	for _, field := range entry.InfoFields {
+		if k, v, ok := strings.Cut(field, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// advertisedAddr returns the addr= TXT value of an entry. A node listening
+// on all interfaces advertises no host; it is reachable at the host its
+// advertisement was heard from.
+func advertisedAddr(entry *mdns.ServiceEntry, heard string) string {
+	addr := txtValue(entry, "addr")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		from, _, err := net.SplitHostPort(heard)
+		if err != nil {
+			return ""
+		}
+		return net.JoinHostPort(from, port)
+	}
+	return addr
+}
+
 // handleDiscoveredPeer processes a discovered peer
 func (ds *DiscoveryService) handleDiscoveredPeer(ctx context.Context, entry *mdns.ServiceEntry) {
-	// Skip if it's our own service
-	if entry.Port == ds.port {
-		// Additional check: compare IPs
+	// Skip if it's our own service: by node ID, or by port and IP for
+	// nodes that do not announce one
+	if id := txtValue(entry, "id"); id != "" {
+		if id == ds.nodeID {
+			return
+		}
+	} else if entry.Port == ds.port {
 		localIPs, _ := ds.getLocalIPs()
 		for _, localIP := range localIPs {
 			if entry.AddrV4 != nil && entry.AddrV4.Equal(localIP) {
@@ -188,16 +252,31 @@ func (ds *DiscoveryService) handleDiscoveredPeer(ctx context.Context, entry *mdn
 			}
 		}
 	}
+	// Another deployment on the same LAN; its handshake would fail anyway
+	if network := txtValue(entry, "net"); network != "" && network != ds.networkID {
+		ds.logger.Debug("Ignoring node of another network", "name", entry.Name, "network", network)
+		return
+	}
 
-	// Determine peer address
-	var peerAddr string
+	// Connect to the address the node advertises, falling back to the one
+	// its advertisement came from
+	var heard string
 	if entry.AddrV4 != nil {
-		peerAddr = fmt.Sprintf("%s:%d", entry.AddrV4.String(), entry.Port)
+		heard = net.JoinHostPort(entry.AddrV4.String(), strconv.Itoa(entry.Port))
 	} else if entry.AddrV6 != nil {
-		peerAddr = fmt.Sprintf("[%s]:%d", entry.AddrV6.String(), entry.Port)
-	} else {
+		heard = net.JoinHostPort(entry.AddrV6.String(), strconv.Itoa(entry.Port))
+	}
+	peerAddr := heard
+	if advertised := advertisedAddr(entry, heard); advertised != "" {
+		peerAddr = advertised
+	}
+	if peerAddr == "" {
 		return
 	}
+	candidates := []string{peerAddr}
+	if heard != "" && heard != peerAddr {
+		candidates = append(candidates, heard)
+	}
 
 	// Check if we've already discovered this peer recently
 	ds.peerLock.Lock()
@@ -217,10 +296,13 @@ func (ds *DiscoveryService) handleDiscoveredPeer(ctx context.Context, entry *mdn
 			if ctx.Err() != nil {
 				return
 			}
-			if err := ds.onPeerFound(peerAddr); err != nil {
-				ds.logger.Debug("Failed to connect to discovered peer", "peer", peerAddr, "err", err)
-			} else {
-				ds.logger.Info("Successfully connected to peer discovered via mDNS", "peer", peerAddr)
+			for _, addr := range candidates {
+				if err := ds.onPeerFound(addr); err != nil {
+					ds.logger.Debug("Failed to connect to discovered peer", "peer", addr, "err", err)
+					continue
+				}
+				ds.logger.Info("Successfully connected to peer discovered via mDNS", "peer", addr)
+				return
 			}
 		}()
 	}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveryUsesAdvertisedAddress(t *testing.T) {
+	ds := NewDiscoveryService("peervault", 5000, ":5000", "self", "office", nil)
+	dialed := make(chan string, 4)
+	ds.SetPeerFoundCallback(func(addr string) error {
+		dialed <- addr
+		if addr == "203.0.113.7:4000" {
+			return fmt.Errorf("unreachable from the LAN")
+		}
+		return nil
+	})
+	next := func() string {
+		select {
+		case addr := <-dialed:
+			return addr
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+	entry := func(ip string, port int, txt ...string) *mdns.ServiceEntry {
+		return &mdns.ServiceEntry{AddrV4: net.ParseIP(ip), Port: port, InfoFields: txt}
+	}
+
+	// Its own advertisement, recognized by node ID whatever the port
+	ds.handleDiscoveredPeer(context.Background(), entry("192.168.1.10", 5000, "addr=:5000", "id=self"))
+	assert.Empty(t, ds.GetDiscoveredPeers())
+
+	// Listening on all interfaces: the advertised port at the sender's IP
+	ds.handleDiscoveredPeer(context.Background(), entry("192.168.1.20", 4000, "addr=0.0.0.0:4100", "id=other"))
+	assert.Equal(t, "192.168.1.20:4100", next())
+
+	// An advertised address that cannot be reached falls back to the sender
+	ds.handleDiscoveredPeer(context.Background(), entry("192.168.1.30", 4000, "addr=203.0.113.7:4000", "id=third"))
+	assert.Equal(t, "203.0.113.7:4000", next())
+	assert.Equal(t, "192.168.1.30:4000", next())
+
+	// Nodes of other networks are never dialed
+	ds.handleDiscoveredPeer(context.Background(), entry("192.168.1.50", 3000, "addr=:3000", "id=lab", "net=lab"))
+	assert.Equal(t, "", next())
+
+	// Nodes announcing no address are dialed where they were heard from
+	ds.handleDiscoveredPeer(context.Background(), entry("192.168.1.40", 3000, "version=1.0"))
+	assert.Equal(t, "192.168.1.40:3000", next())
+}
+
+func TestListenPort(t *testing.T) {
+	assert.Equal(t, 3000, listenPort(":3000"))
+	assert.Equal(t, 5100, listenPort("192.168.1.5:5100"))
+	assert.Equal(t, 0, listenPort("localhost"))
+	assert.Equal(t, 0, listenPort(""))
+}
@@ -0,0 +1,787 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/internal/tracing"
+)
+
+const (
+	// defaultDownloadChunkSize is the size of the byte ranges requested from peers
+	defaultDownloadChunkSize = 1024 * 1024
+	// maxInflightPerPeer bounds how many ranges a single peer serves at a time
+	maxInflightPerPeer = 2
+)
+
+// chunkState is the state of one byte range of a parallel download. It
+// takes a byte per range, so the chunk table of a 100GB file stays small.
+type chunkState uint8
+
+const (
+	chunkPending chunkState = iota
+	chunkInflight
+	chunkDone
+)
+
+// inflightChunk tracks a range while it is requested from peers
+type inflightChunk struct {
+	owners      []string // peers the range is currently requested from
+	requestedAt time.Time
+}
+
+// peerRate tracks how fast a peer delivered ranges during one download
+type peerRate struct {
+	bytes    int64
+	elapsed  time.Duration
+	inflight int
+}
+
+func (r *peerRate) bytesPerSec() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+// rangeRequest is a byte range to request from one peer
+type rangeRequest struct {
+	peer   string
+	offset int64
+	length int64
+}
+
+// download tracks a parallel fetch of one key from every peer that holds it.
+//
+// Connected peers are first asked whether they hold the key (MessageHasFile).
+// Every peer that answers yes is a holder and is handed the next missing
+// range as soon as it finishes one. Faster peers therefore pull more ranges, peers
+// far slower than the fastest one are limited to a single range in flight,
+// and once nothing is left to hand out, ranges still stuck on a slow peer are
+// duplicated to a faster one so the tail of the transfer does not stall.
+//
+// Which ranges are on disk is recorded next to the partial file (see
+// storage.PartialRanges), so a download cut short by a timeout, a restart or
+// a crash resumes in a later session without fetching them again.
+type download struct {
+	mu           sync.Mutex
+	key          string
+	base         int64 // bytes already on disk from an earlier, interrupted transfer
+	size         int64 // total size, -1 until the first holder answers
+	chunkSize    int64
+	chunks       []chunkState
+	inflight     map[int]*inflightChunk // chunks being fetched, by index
+	done         int                    // number of chunks on disk
+	nextHint     int                    // no chunk before this index is pending
+	resume       *storage.PartialRanges // chunks already on disk when the download started
+	recorded     int                    // done when the chunk record was last saved, -1 before the first save
+	recordMu     sync.Mutex             // serializes saves of the chunk record
+	peers        map[string]*peerRate
+	dropped      map[string]bool // holders that failed or stalled
+	queried      int             // peers asked whether they hold the key
+	asked        []string        // addresses of the queried peers, for the not-found error
+	missing      int             // queried peers that answered they do not
+	noHolders    chan struct{}   // closed once every queried peer answered it does not hold the key
+	lastProgress time.Time
+	trace        map[string]string                       // trace context of the Get that started the download
+	expires      time.Time                               // expiry of the file, as sent by the holders
+	score        func(peer string) float64               // reputation of a holder, nil to rank by speed only
+	latency      func(peer string) (time.Duration, bool) // round trip to a holder and whether it is suspect, nil if unknown
+	sources      map[string]bool                         // holders that delivered ranges
+}
+
+func newDownload(key string, base int64, chunkSize int64) *download {
+	return &download{
+		key:          key,
+		base:         base,
+		size:         -1,
+		chunkSize:    chunkSize,
+		inflight:     make(map[int]*inflightChunk),
+		recorded:     -1,
+		peers:        make(map[string]*peerRate),
+		dropped:      make(map[string]bool),
+		sources:      make(map[string]bool),
+		noHolders:    make(chan struct{}),
+		lastProgress: time.Now(),
+	}
+}
+
+// bounds returns the byte range covered by chunk i
+func (d *download) bounds(i int) (int64, int64) {
+	offset := d.base + int64(i)*d.chunkSize
+	length := d.chunkSize
+	if offset+length > d.size {
+		length = d.size - offset
+	}
+	return offset, length
+}
+
+// init builds the chunk table once the total size is known. Chunks an
+// earlier session recorded for a file of the same size are already done.
+func (d *download) init(size int64) {
+	d.size = size
+	count := int((size - d.base + d.chunkSize - 1) / d.chunkSize)
+	d.chunks = make([]chunkState, count)
+	if d.resume == nil || d.resume.Size != size {
+		return
+	}
+	for i := range d.chunks {
+		if d.resume.Has(i) {
+			d.chunks[i] = chunkDone
+			d.done++
+		}
+	}
+	d.recorded = d.done
+}
+
+// ranges returns the record of the chunks on disk
+func (d *download) ranges() storage.PartialRanges {
+	r := storage.NewPartialRanges(d.size, d.base, d.chunkSize)
+	for i, state := range d.chunks {
+		if state == chunkDone {
+			r.Set(i)
+		}
+	}
+	return r
+}
+
+// chunkAt returns the index of the chunk starting at offset, or -1
+func (d *download) chunkAt(offset int64) int {
+	rel := offset - d.base
+	if rel < 0 || rel%d.chunkSize != 0 {
+		return -1
+	}
+	i := int(rel / d.chunkSize)
+	if i >= len(d.chunks) {
+		return -1
+	}
+	return i
+}
+
+// wants reports whether the range starting at offset is still missing
+func (d *download) wants(offset int64, size int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size != d.size {
+		return false
+	}
+	i := d.chunkAt(offset)
+	return i >= 0 && d.chunks[i] != chunkDone
+}
+
+// found records the answer of a peer to the existence query. A peer holding
+// the key becomes a holder and is handed ranges right away. Like received,
+// it reports whether the download is complete.
+func (d *download) found(peer string, has bool, size int64) ([]rangeRequest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !has {
+		d.miss()
+		return nil, false
+	}
+	if d.size < 0 {
+		if d.resume != nil && d.resume.Size != size {
+			// The chunks on disk belong to another version of the file
+			d.resume, d.base, d.recorded = nil, 0, -1
+		}
+		if size < d.base {
+			// Smaller than what we already have, so not the same file
+			d.miss()
+			return nil, false
+		}
+		d.init(size)
+		d.lastProgress = time.Now()
+	}
+	if size != d.size {
+		d.miss()
+		return nil, false
+	}
+
+	if _, ok := d.peers[peer]; !ok {
+		d.peers[peer] = &peerRate{}
+	}
+	if d.complete() {
+		return nil, true
+	}
+	return d.schedule(), false
+}
+
+// unavailable reports whether every queried peer said it does not hold the key
+func (d *download) unavailable() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size < 0 && d.missing >= d.queried
+}
+
+// notFound returns the error of a download no queried peer holds the key of
+func (d *download) notFound() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fmt.Errorf("file %s %w, asked %s", d.key, ErrNotFound, strings.Join(d.asked, ", "))
+}
+
+// miss counts a queried peer that does not hold the key, closing noHolders
+// once none does. Callers hold mu.
+func (d *download) miss() {
+	d.missing++
+	d.checkHolders()
+}
+
+// checkHolders closes noHolders if every queried peer answered it does not
+// hold the key. Callers hold mu.
+func (d *download) checkHolders() {
+	if d.size >= 0 || d.missing < d.queried {
+		return
+	}
+	select {
+	case <-d.noHolders:
+	default:
+		close(d.noHolders)
+	}
+}
+
+// received records a range delivered by a peer. It returns the next ranges to
+// request and whether the download is complete.
+func (d *download) received(peer string, offset int64, n int64, elapsed time.Duration) ([]rangeRequest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rate, ok := d.peers[peer]
+	if !ok {
+		rate = &peerRate{}
+		d.peers[peer] = rate
+	}
+	rate.bytes += n
+	rate.elapsed += elapsed
+	d.sources[peer] = true
+
+	if i := d.chunkAt(offset); i >= 0 && d.chunks[i] != chunkDone {
+		d.releaseOwners(i)
+		d.chunks[i] = chunkDone
+		delete(d.inflight, i)
+		d.done++
+		d.lastProgress = time.Now()
+	}
+
+	if d.complete() {
+		return nil, true
+	}
+	return d.schedule(), false
+}
+
+// failed stops using a peer and puts its ranges back into the queue
+func (d *download) failed(peer string) []rangeRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dropPeer(peer)
+	return d.schedule()
+}
+
+// reapStalled requeues ranges that have been in flight longer than timeout and
+// drops the peers that were serving them, which it returns.
+func (d *download) reapStalled(timeout time.Duration) ([]rangeRequest, []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var stalled []string
+	for _, i := range d.inflightChunks() {
+		c, ok := d.inflight[i]
+		if !ok || time.Since(c.requestedAt) < timeout {
+			continue
+		}
+		for _, owner := range append([]string(nil), c.owners...) {
+			d.dropPeer(owner)
+			stalled = append(stalled, owner)
+		}
+		if d.chunks[i] == chunkInflight {
+			d.requeue(i)
+		}
+	}
+	return d.schedule(), stalled
+}
+
+// rebind replaces a holder by another connection to the same node. Ranges
+// in flight on the old connection are requeued and handed out again.
+func (d *download) rebind(old, new string) []rangeRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.peers[old]; !ok && !d.dropped[old] {
+		return nil
+	}
+	d.dropPeer(old)
+	if _, ok := d.peers[new]; !ok {
+		d.peers[new] = &peerRate{}
+	}
+	if d.size < 0 {
+		return nil
+	}
+	return d.schedule()
+}
+
+// dropPeer forgets a peer and requeues every range only it was fetching
+func (d *download) dropPeer(peer string) {
+	delete(d.peers, peer)
+	d.dropped[peer] = true
+	for _, i := range d.inflightChunks() {
+		c := d.inflight[i]
+		owners := c.owners[:0]
+		for _, owner := range c.owners {
+			if owner != peer {
+				owners = append(owners, owner)
+			}
+		}
+		c.owners = owners
+		if len(owners) == 0 {
+			d.requeue(i)
+		}
+	}
+}
+
+// requeue marks chunk i as missing so the scheduler hands it out again
+func (d *download) requeue(i int) {
+	d.chunks[i] = chunkPending
+	delete(d.inflight, i)
+	if i < d.nextHint {
+		d.nextHint = i
+	}
+}
+
+// inflightChunks returns the indexes of the chunks being fetched, in order.
+// Only these are scanned when peers fail or stall, not the whole table.
+func (d *download) inflightChunks() []int {
+	indexes := make([]int, 0, len(d.inflight))
+	for i := range d.inflight {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// releaseOwners frees the in-flight slot a chunk occupies on each of its owners
+func (d *download) releaseOwners(i int) {
+	c, ok := d.inflight[i]
+	if !ok {
+		return
+	}
+	for _, owner := range c.owners {
+		if rate, ok := d.peers[owner]; ok && rate.inflight > 0 {
+			rate.inflight--
+		}
+	}
+}
+
+// peerScore returns the reputation of a holder, neutralScore without a
+// score function
+func (d *download) peerScore(peer string) float64 {
+	if d.score == nil {
+		return neutralScore
+	}
+	return d.score(peer)
+}
+
+// peerLatency returns the round trip to a holder, zero if unknown, and
+// whether its last heartbeat went unanswered
+func (d *download) peerLatency(peer string) (time.Duration, bool) {
+	if d.latency == nil {
+		return 0, false
+	}
+	return d.latency(peer)
+}
+
+// schedule hands out missing ranges to holders, fastest peers first, among
+// equally fast ones the best scored and then the closest. Holders scored
+// below neutralScore or suspect get a single range in flight, like slow
+// ones.
+func (d *download) schedule() []rangeRequest {
+	if d.size < 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(d.peers))
+	scores := make(map[string]float64, len(d.peers))
+	rtts := make(map[string]time.Duration, len(d.peers))
+	suspect := make(map[string]bool, len(d.peers))
+	for name := range d.peers {
+		names = append(names, name)
+		scores[name] = d.peerScore(name)
+		rtts[name], suspect[name] = d.peerLatency(name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := d.peers[names[i]].bytesPerSec(), d.peers[names[j]].bytesPerSec()
+		if a != b {
+			return a > b
+		}
+		if scores[names[i]] != scores[names[j]] {
+			return scores[names[i]] > scores[names[j]]
+		}
+		ra, rb := rtts[names[i]], rtts[names[j]]
+		if (ra > 0) != (rb > 0) {
+			return ra > 0 // measured before unknown
+		}
+		return ra < rb
+	})
+
+	var fastest float64
+	if len(names) > 0 {
+		fastest = d.peers[names[0]].bytesPerSec()
+	}
+
+	var reqs []rangeRequest
+	for _, name := range names {
+		rate := d.peers[name]
+		limit := maxInflightPerPeer
+		if (fastest > 0 && rate.bytesPerSec() < fastest/4) || scores[name] < neutralScore || suspect[name] {
+			limit = 1
+		}
+		for rate.inflight < limit {
+			i := d.nextPending()
+			if i < 0 {
+				i = d.stealable(name)
+			}
+			if i < 0 {
+				break
+			}
+			c, ok := d.inflight[i]
+			if !ok {
+				c = &inflightChunk{}
+				d.inflight[i] = c
+			}
+			d.chunks[i] = chunkInflight
+			c.owners = append(c.owners, name)
+			c.requestedAt = time.Now()
+			rate.inflight++
+
+			offset, length := d.bounds(i)
+			reqs = append(reqs, rangeRequest{peer: name, offset: offset, length: length})
+		}
+	}
+	return reqs
+}
+
+// nextPending returns the first range nobody is fetching, or -1
+func (d *download) nextPending() int {
+	for ; d.nextHint < len(d.chunks); d.nextHint++ {
+		if d.chunks[d.nextHint] == chunkPending {
+			return d.nextHint
+		}
+	}
+	return -1
+}
+
+// stealable returns an in-flight range worth duplicating to peer, or -1.
+// Only ranges held by a single peer less than half as fast are considered.
+func (d *download) stealable(peer string) int {
+	rate := d.peers[peer].bytesPerSec()
+	if rate == 0 {
+		return -1
+	}
+	for _, i := range d.inflightChunks() {
+		c := d.inflight[i]
+		if len(c.owners) != 1 || c.owners[0] == peer {
+			continue
+		}
+		owner, ok := d.peers[c.owners[0]]
+		if !ok || owner.bytesPerSec() < rate/2 {
+			return i
+		}
+	}
+	return -1
+}
+
+// complete reports whether every range is on disk
+func (d *download) complete() bool {
+	return d.size >= 0 && d.done == len(d.chunks)
+}
+
+// contiguous returns the length of the fully received prefix of the file
+func (d *download) contiguous() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := d.base
+	for i := range d.chunks {
+		if d.chunks[i] != chunkDone {
+			break
+		}
+		_, length := d.bounds(i)
+		n += length
+	}
+	return n
+}
+
+// unrecorded reports whether the chunk record was not saved yet
+func (d *download) unrecorded() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.recorded < 0
+}
+
+// idle returns how long the download has gone without receiving a range
+func (d *download) idle() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Since(d.lastProgress)
+}
+
+// answered reports whether any peer has responded yet
+func (d *download) answered() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size >= 0
+}
+
+// startDownload registers a parallel download for key and asks every peer
+// whether it holds the key. If a download of the key is already running it is reused.
+func (s *FileServer) startDownload(ctx context.Context, key string) *download {
+	s.downloadsMu.Lock()
+	hashedKey := crypto.HashKey(key)
+	if d, ok := s.downloads[hashedKey]; ok {
+		s.downloadsMu.Unlock()
+		return d
+	}
+
+	// A partial copy left by an interrupted transfer is resumed: a sparse one
+	// from the chunks it recorded, one received in a single stream from its
+	// last byte
+	var d *download
+	if ranges, ok := s.store.LoadPartialRanges(s.ID, key); ok {
+		d = newDownload(key, ranges.Base, ranges.ChunkSize)
+		d.resume = &ranges
+		s.Logger.Info("resuming interrupted transfer", "key", key, "size", ranges.Size, "chunks", ranges.Count())
+	} else {
+		offset := s.store.PartialSize(s.ID, key)
+		d = newDownload(key, offset, s.DownloadChunkSize)
+		if offset > 0 {
+			s.Logger.Info("resuming interrupted transfer", "key", key, "offset", offset)
+		}
+	}
+	d.trace = tracing.Inject(ctx)
+	d.score = s.peerScore
+	d.latency = s.peerLatency
+	s.downloads[hashedKey] = d
+	s.downloadsMu.Unlock()
+
+	peers := s.broadcastPeers()
+	asked := make([]string, 0, len(peers))
+	for addr := range peers {
+		asked = append(asked, addr)
+	}
+	sort.Strings(asked)
+	d.mu.Lock()
+	d.queried = len(asked)
+	d.asked = asked
+	d.checkHolders()
+	d.mu.Unlock()
+
+	msg := Message{
+		Payload: MessageHasFile{
+			ID:  s.ID,
+			Key: hashedKey,
+		},
+	}
+	if err := s.broadcast(ctx, &msg); err != nil {
+		s.Logger.Warn("file query broadcast encountered errors", "err", err)
+	}
+	return d
+}
+
+// getDownload returns the running download of a hashed key, if any
+func (s *FileServer) getDownload(hashedKey string) *download {
+	s.downloadsMu.Lock()
+	defer s.downloadsMu.Unlock()
+	return s.downloads[hashedKey]
+}
+
+// removeDownload unregisters d, returning false if it was already removed
+func (s *FileServer) removeDownload(d *download) bool {
+	s.downloadsMu.Lock()
+	defer s.downloadsMu.Unlock()
+	hashedKey := crypto.HashKey(d.key)
+	if s.downloads[hashedKey] != d {
+		return false
+	}
+	delete(s.downloads, hashedKey)
+	return true
+}
+
+// abortDownload gives up on d. The chunks on disk are recorded so a later
+// Get resumes from there. If that fails, the partial file is cut back to its
+// fully received prefix instead.
+func (s *FileServer) abortDownload(d *download) {
+	if !s.removeDownload(d) {
+		return
+	}
+	if !d.answered() {
+		return
+	}
+	if err := s.recordRanges(d, true); err == nil {
+		return
+	}
+	if err := s.store.TruncatePartial(s.ID, d.key, d.contiguous()); err != nil {
+		s.Logger.Warn("failed to truncate partial download", "key", d.key, "err", err)
+	}
+	if err := s.store.DiscardPartialRanges(s.ID, d.key); err != nil {
+		s.Logger.Warn("failed to discard partial download record", "key", d.key, "err", err)
+	}
+}
+
+// recordRanges saves which chunks of d are on disk. Unless force is set it
+// only writes when chunks arrived since the last save.
+func (s *FileServer) recordRanges(d *download, force bool) error {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	d.mu.Lock()
+	if d.size < 0 || (!force && d.recorded == d.done) {
+		d.mu.Unlock()
+		return nil
+	}
+	ranges, done := d.ranges(), d.done
+	d.mu.Unlock()
+
+	if err := s.store.SavePartialRanges(s.ID, d.key, ranges); err != nil {
+		s.Logger.Warn("failed to record partial download", "key", d.key, "err", err)
+		return err
+	}
+	d.mu.Lock()
+	d.recorded = done
+	d.mu.Unlock()
+	return nil
+}
+
+// finishDownload commits a completed download and wakes up waiting Gets
+func (s *FileServer) finishDownload(d *download) {
+	if !s.removeDownload(d) {
+		return
+	}
+	// A partial file left by another version of the file may be longer
+	if err := s.store.TruncatePartial(s.ID, d.key, d.size); err != nil {
+		s.Logger.Error("failed to commit download", "key", d.key, "err", err)
+		return
+	}
+	if err := s.verifyDownload(d); err != nil {
+		s.Logger.Error("discarding corrupted download", "key", d.key, "err", err)
+		if err := s.store.DiscardPartial(s.ID, d.key); err != nil {
+			s.Logger.Warn("failed to discard partial download", "key", d.key, "err", err)
+		}
+		return
+	}
+	if err := s.store.CommitPartial(s.ID, d.key); err != nil {
+		s.Logger.Error("failed to commit download", "key", d.key, "err", err)
+		return
+	}
+	d.mu.Lock()
+	expires := d.expires
+	d.mu.Unlock()
+	if err := s.store.SetExpiry(s.ID, d.key, expires); err != nil {
+		s.Logger.Warn("failed to set expiry of download", "key", d.key, "err", err)
+	}
+	s.notifyFileWaiter(crypto.HashKey(d.key))
+}
+
+// verifyDownload checks the HMAC of a completed download (see
+// verifyPartial), scoring every holder that delivered ranges of a corrupted
+// one
+func (s *FileServer) verifyDownload(d *download) error {
+	if err := s.verifyPartial(d.key, d.size); err == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	sources := make([]string, 0, len(d.sources))
+	for peer := range d.sources {
+		sources = append(sources, peer)
+	}
+	d.mu.Unlock()
+	sort.Strings(sources)
+	for _, peer := range sources {
+		s.recordCorrupt(peer)
+	}
+	return fmt.Errorf("%w, delivered by %s", ErrCorrupted, strings.Join(sources, ", "))
+}
+
+// requestRanges sends range requests to the peers they were assigned to.
+// The chunk record is saved before the first request, so holes in the
+// partial file are never taken for data after a crash.
+func (s *FileServer) requestRanges(d *download, reqs []rangeRequest) {
+	if len(reqs) > 0 && d.unrecorded() {
+		if err := s.recordRanges(d, true); err != nil {
+			s.abortDownload(d)
+			return
+		}
+	}
+	for _, req := range reqs {
+		s.PeerLock.Lock()
+		peer, ok := s.conns[req.peer]
+		s.PeerLock.Unlock()
+
+		msg := Message{
+			Payload: MessageGetFile{
+				ID:     s.ID,
+				Key:    crypto.HashKey(d.key),
+				Offset: req.offset,
+				Length: req.length,
+			},
+			Trace: d.trace,
+		}
+		if !ok {
+			s.requestRanges(d, d.failed(req.peer))
+			continue
+		}
+		if err := s.sendMessage(peer, &msg); err != nil {
+			s.Logger.Warn("failed to request range", "peer", req.peer, "key", d.key, "err", err)
+			s.requestRanges(d, d.failed(req.peer))
+		}
+	}
+}
+
+// handleRangeStream writes one range of a parallel download to the partial file
+func (s *FileServer) handleRangeStream(from string, stream io.Reader, header StreamHeader) error {
+	body := io.LimitReader(stream, header.Length)
+
+	d := s.getDownload(crypto.HashKey(header.Key))
+	if d == nil {
+		_, err := io.Copy(io.Discard, body)
+		return err
+	}
+	if !d.wants(header.Offset, header.Size) {
+		// Duplicate of a range that was also requested from a faster peer
+		_, err := io.Copy(io.Discard, body)
+		return err
+	}
+
+	start := time.Now()
+	n, err := s.store.WritePartialAt(s.ID, header.Key, header.Offset, body)
+	s.Metrics.AddPeerBytesReceived(from, n)
+	if err == nil && n < header.Length {
+		err = fmt.Errorf("range %d+%d of %s interrupted after %d bytes: %w", header.Offset, header.Length, header.Key, n, io.ErrUnexpectedEOF)
+	}
+	s.recordTransfer(from, err)
+	if err != nil {
+		io.Copy(io.Discard, body)
+		s.requestRanges(d, d.failed(from))
+		return err
+	}
+
+	d.mu.Lock()
+	d.expires = header.Expires
+	d.mu.Unlock()
+	reqs, done := d.received(from, header.Offset, n, time.Since(start))
+	if done {
+		s.finishDownload(d)
+		return nil
+	}
+	s.requestRanges(d, reqs)
+	return nil
+}
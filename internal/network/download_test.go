@@ -0,0 +1,173 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+func TestDownloadSchedulesAcrossHolders(t *testing.T) {
+	d := newDownload("key", 0, 10)
+	d.queried = 3
+
+	// A peer without the file is never handed a range
+	reqs, done := d.found("empty", false, 0)
+	assert.False(t, done)
+	assert.Empty(t, reqs)
+	assert.False(t, d.unavailable())
+
+	// Every holder is handed ranges as soon as it answers
+	reqs, _ = d.found("fast", true, 50)
+	assert.Equal(t, []rangeRequest{{peer: "fast", offset: 0, length: 10}, {peer: "fast", offset: 10, length: 10}}, reqs)
+	reqs, _ = d.found("slow", true, 50)
+	assert.Equal(t, []rangeRequest{{peer: "slow", offset: 20, length: 10}, {peer: "slow", offset: 30, length: 10}}, reqs)
+
+	// Losing a peer puts its ranges back in the queue for the others
+	assert.Empty(t, d.failed("slow"))
+	reqs, _ = d.received("fast", 0, 10, 10*time.Millisecond)
+	assert.Equal(t, []rangeRequest{{peer: "fast", offset: 20, length: 10}}, reqs)
+}
+
+func TestDownloadUnavailable(t *testing.T) {
+	d := newDownload("key", 0, 10)
+	d.queried = 2
+
+	d.found("a", false, 0)
+	assert.False(t, d.unavailable())
+	// A copy smaller than the partial file on disk cannot be the same file
+	d.base = 20
+	d.found("b", true, 10)
+	assert.True(t, d.unavailable())
+	select {
+	case <-d.noHolders:
+	default:
+		t.Fatal("noHolders not closed once every peer answered")
+	}
+}
+
+func TestDownloadStealsFromSlowPeer(t *testing.T) {
+	d := newDownload("key", 0, 10)
+	d.queried = 2
+
+	d.found("fast", true, 40)
+	reqs, _ := d.found("slow", true, 40)
+	assert.Equal(t, []rangeRequest{{peer: "slow", offset: 20, length: 10}, {peer: "slow", offset: 30, length: 10}}, reqs)
+
+	// Once nothing is left to hand out, ranges stuck on the slow peer
+	// are duplicated to the fast one
+	reqs, _ = d.received("fast", 0, 10, 10*time.Millisecond)
+	assert.Equal(t, []rangeRequest{{peer: "fast", offset: 20, length: 10}}, reqs)
+	reqs, _ = d.received("fast", 10, 10, 10*time.Millisecond)
+	assert.Equal(t, []rangeRequest{{peer: "fast", offset: 30, length: 10}}, reqs)
+	reqs, _ = d.received("fast", 20, 10, 10*time.Millisecond)
+	assert.Empty(t, reqs)
+
+	// The slow copy of a range that already arrived is not wanted
+	assert.False(t, d.wants(20, 40))
+
+	_, done := d.received("fast", 30, 10, 10*time.Millisecond)
+	assert.True(t, done)
+	assert.Equal(t, int64(40), d.contiguous())
+}
+
+func TestDownloadRebindMovesRangesToNewPath(t *testing.T) {
+	d := newDownload("key", 0, 10)
+	d.queried = 1
+
+	reqs, _ := d.found("lan", true, 30)
+	assert.Len(t, reqs, 2)
+
+	// The stream on the closed path fails before the path is rebound
+	assert.Empty(t, d.failed("lan"))
+	reqs = d.rebind("lan", "wan")
+	assert.Equal(t, []rangeRequest{{peer: "wan", offset: 0, length: 10}, {peer: "wan", offset: 10, length: 10}}, reqs)
+
+	// Connections that never held the key are not rebound
+	assert.Empty(t, d.rebind("other", "wan2"))
+}
+
+func TestDownloadResumesRecordedChunksOfLargeFile(t *testing.T) {
+	const size, chunk = int64(100 << 30), int64(1 << 20)
+
+	// An earlier session got the first and last chunk of a 100GB file
+	ranges := storage.NewPartialRanges(size, 0, chunk)
+	ranges.Set(0)
+	ranges.Set(ranges.Count() - 1)
+
+	d := newDownload("key", ranges.Base, ranges.ChunkSize)
+	d.resume = &ranges
+	d.queried = 2
+
+	reqs, _ := d.found("a", true, size)
+	assert.Equal(t, []rangeRequest{{peer: "a", offset: chunk, length: chunk}, {peer: "a", offset: 2 * chunk, length: chunk}}, reqs)
+	assert.Equal(t, 2, d.done)
+	assert.False(t, d.wants(0, size))
+
+	// Every other chunk is fetched once, and the last one stops short of
+	// the recorded tail
+	more, _ := d.found("b", true, size)
+	requested := map[int64]int{}
+	for reqs = append(reqs, more...); len(reqs) > 0; {
+		req := reqs[0]
+		reqs = reqs[1:]
+		requested[req.offset]++
+		next, _ := d.received(req.peer, req.offset, req.length, time.Millisecond)
+		reqs = append(reqs, next...)
+	}
+	assert.Len(t, requested, ranges.Count()-2)
+	assert.Equal(t, 1, requested[size-2*chunk])
+	assert.True(t, d.complete())
+	assert.Equal(t, size, d.contiguous())
+	assert.Empty(t, d.inflight)
+
+	// A record of another version of the file is not used
+	d = newDownload("key", ranges.Base, ranges.ChunkSize)
+	d.resume = &ranges
+	d.queried = 1
+	reqs, _ = d.found("a", true, size-1)
+	assert.Equal(t, int64(0), reqs[0].offset)
+	assert.Equal(t, 0, d.done)
+}
+
+func TestDownloadLimitsPoorlyScoredPeer(t *testing.T) {
+	d := newDownload("key", 0, 10)
+	d.queried = 2
+	d.score = func(peer string) float64 {
+		if peer == "poor" {
+			return 20
+		}
+		return neutralScore
+	}
+
+	// A holder scored below neutral gets a single range in flight
+	reqs, _ := d.found("poor", true, 50)
+	assert.Equal(t, []rangeRequest{{peer: "poor", offset: 0, length: 10}}, reqs)
+	reqs, _ = d.found("good", true, 50)
+	assert.Equal(t, []rangeRequest{{peer: "good", offset: 10, length: 10}, {peer: "good", offset: 20, length: 10}}, reqs)
+}
+
+func TestDownloadPrefersResponsivePeers(t *testing.T) {
+	d := newDownload("key", 0, 10)
+	d.queried = 3
+	d.latency = func(peer string) (time.Duration, bool) {
+		switch peer {
+		case "near":
+			return time.Millisecond, false
+		case "far":
+			return 100 * time.Millisecond, false
+		}
+		return time.Millisecond, true
+	}
+
+	// A suspect holder gets a single range in flight
+	reqs, _ := d.found("suspect", true, 60)
+	assert.Equal(t, []rangeRequest{{peer: "suspect", offset: 0, length: 10}}, reqs)
+
+	// Among holders nothing was received from yet, the closest goes first
+	d.peers["far"], d.peers["near"] = &peerRate{}, &peerRate{}
+	reqs = d.schedule()
+	assert.Equal(t, rangeRequest{peer: "near", offset: 10, length: 10}, reqs[0])
+}
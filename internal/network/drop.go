@@ -0,0 +1,403 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/metrics"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// Outbox entry states
+const (
+	DropPending   = "pending"   // Waiting for the recipient to answer
+	DropSending   = "sending"   // Accepted, being streamed
+	DropDelivered = "delivered" // Stored in the recipient's inbox
+	DropRejected  = "rejected"  // Declined by the recipient
+	DropFailed    = "failed"    // Could not be offered or streamed
+)
+
+// MessageDropOffer asks a peer to accept a file sent to it directly. The
+// file is only streamed once the peer accepts it.
+type MessageDropOffer struct {
+	ID   string `wire:"1"`
+	Key  string `wire:"2"`
+	Size int64  `wire:"3"`
+}
+
+// MessageDropReply accepts or rejects a MessageDropOffer
+type MessageDropReply struct {
+	ID       string `wire:"1"`
+	Key      string `wire:"2"`
+	Accepted bool   `wire:"3"`
+	Reason   string `wire:"4"`
+}
+
+// InboxOffer is a file a peer wants to send to this node, waiting for the
+// user to accept or reject it
+type InboxOffer struct {
+	ID      string // Short ID used to accept or reject the offer
+	Peer    string // Address of the sending peer
+	Node    string // Node ID of the sender
+	Key     string
+	Size    int64
+	Offered time.Time
+}
+
+// OutboxEntry is a file this node offered to a peer
+type OutboxEntry struct {
+	Peer    string
+	Key     string
+	Size    int64
+	Offered time.Time
+	Status  string
+	Reason  string // Why the file was rejected or not delivered
+}
+
+// offerID identifies an offer by its sender and key
+func offerID(node, key string) string {
+	return crypto.HashKey(node + "/" + key)[:8]
+}
+
+// SendTo offers a locally stored file to one connected peer only, whatever
+// the placement policy. The file is streamed once the peer accepts it, and
+// the peer keeps it in its inbox, under the ID of this node, rather than as
+// a replica. Progress is tracked in the outbox.
+func (s *FileServer) SendTo(addr string, key string) error {
+	if s.IsGuest() {
+		return fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	peer, ok := s.peerFor(addr)
+	if !ok {
+		return fmt.Errorf("peer %s %w", addr, ErrPeerUnreachable)
+	}
+	size, err := s.store.Size(s.ID, key)
+	if err != nil {
+		return fmt.Errorf("file %s not stored on this node", key)
+	}
+
+	s.inboxMu.Lock()
+	entry := s.outboxEntryLocked(addr, key)
+	if entry == nil {
+		entry = &OutboxEntry{Peer: addr, Key: key}
+		s.outbox = append(s.outbox, entry)
+	}
+	entry.Size, entry.Offered, entry.Status, entry.Reason = size, time.Now(), DropPending, ""
+	s.inboxMu.Unlock()
+
+	msg := Message{Payload: MessageDropOffer{ID: s.ID, Key: key, Size: size}}
+	if err := s.sendMessage(peer, &msg); err != nil {
+		s.setDropStatus(addr, key, DropFailed, err.Error())
+		return fmt.Errorf("failed to offer %s to %s: %w", key, addr, err)
+	}
+	s.Logger.Info("offered file to peer", "peer", addr, "key", key)
+	return nil
+}
+
+// Outbox lists the files this node offered to peers, oldest first
+func (s *FileServer) Outbox() []OutboxEntry {
+	s.inboxMu.Lock()
+	defer s.inboxMu.Unlock()
+	entries := make([]OutboxEntry, len(s.outbox))
+	for i, e := range s.outbox {
+		entries[i] = *e
+	}
+	return entries
+}
+
+// outboxEntryLocked finds the entry of a file offered to a peer. Callers
+// hold inboxMu.
+func (s *FileServer) outboxEntryLocked(addr, key string) *OutboxEntry {
+	for _, e := range s.outbox {
+		if e.Peer == addr && e.Key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) setDropStatus(addr, key, status, reason string) {
+	s.inboxMu.Lock()
+	defer s.inboxMu.Unlock()
+	if e := s.outboxEntryLocked(addr, key); e != nil {
+		e.Status, e.Reason = status, reason
+	}
+}
+
+// handleMessageDropReply streams a file the recipient accepted
+func (s *FileServer) handleMessageDropReply(from string, msg MessageDropReply) error {
+	s.inboxMu.Lock()
+	e := s.outboxEntryLocked(from, msg.Key)
+	pending := e != nil && e.Status == DropPending
+	s.inboxMu.Unlock()
+	if !pending {
+		return fmt.Errorf("unexpected drop reply for %s from %s", msg.Key, from)
+	}
+
+	if !msg.Accepted {
+		s.Logger.Info("peer rejected file", "peer", from, "key", msg.Key, "reason", msg.Reason)
+		s.setDropStatus(from, msg.Key, DropRejected, msg.Reason)
+		return nil
+	}
+
+	s.setDropStatus(from, msg.Key, DropSending, "")
+	go func() {
+		if err := s.sendDrop(from, msg.Key); err != nil {
+			s.Logger.Error("failed to send file to peer", "peer", from, "key", msg.Key, "err", err)
+			s.setDropStatus(from, msg.Key, DropFailed, err.Error())
+			return
+		}
+		s.Logger.Info("sent file to peer", "peer", from, "key", msg.Key)
+		s.setDropStatus(from, msg.Key, DropDelivered, "")
+	}()
+	return nil
+}
+
+// sendDrop streams an accepted file to the peer at addr
+func (s *FileServer) sendDrop(addr, key string) error {
+	peer, ok := s.peerFor(addr)
+	if !ok {
+		return fmt.Errorf("peer %s %w", addr, ErrPeerUnreachable)
+	}
+	release, err := s.beginOutbound(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	fileKey, err := s.openFileKey(key)
+	if err != nil {
+		return fmt.Errorf("cannot open data key of %s: %w", key, err)
+	}
+	size, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// The recipient reads drops with the network key. Files sealed with a
+	// per-device data key are re-encrypted on the way, which keeps the size.
+	body := r
+	if !bytes.Equal(fileKey, s.EncKey) {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			plain := s.decryptOnTheFly(context.Background(), fileKey, r)
+			_, err := s.Cipher.CopyEncrypt(s.EncKey, plain, pw)
+			pw.CloseWithError(err)
+		}()
+		body = pr
+	}
+
+	return s.sendStream(context.Background(), peer, StreamHeader{Key: key, Size: size, Drop: true}, body)
+}
+
+// handleMessageDropOffer records a file a peer wants to send. Files up to
+// InboxAutoAccept bytes are accepted right away, others wait for the user.
+func (s *FileServer) handleMessageDropOffer(from string, msg MessageDropOffer) error {
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found in map", from)
+	}
+	reject := func(reason string) error {
+		reply := Message{Payload: MessageDropReply{ID: s.ID, Key: msg.Key, Reason: reason}}
+		return s.sendMessage(peer, &reply)
+	}
+
+	if s.IsGuest() || s.isGuestPeer(from) {
+		return reject("guest access is read-only")
+	}
+	if msg.ID == s.ID || storage.ValidateNodeID(msg.ID) != nil {
+		return reject("invalid sender ID")
+	}
+
+	offer := &InboxOffer{
+		ID:      offerID(msg.ID, msg.Key),
+		Peer:    from,
+		Node:    msg.ID,
+		Key:     msg.Key,
+		Size:    msg.Size,
+		Offered: time.Now(),
+	}
+	if msg.Size <= s.InboxAutoAccept {
+		if err := s.acceptOffer(offer); err != nil {
+			return reject(err.Error())
+		}
+		s.Logger.Info("accepted file offer", "peer", from, "key", msg.Key, "size", msg.Size)
+		return nil
+	}
+
+	s.inboxMu.Lock()
+	s.offers[offer.ID] = offer
+	s.inboxMu.Unlock()
+
+	s.Logger.Info("file offered", "peer", from, "key", msg.Key, "size", msg.Size, "offer", offer.ID)
+	s.Events.Publish(events.Event{
+		Type:   events.FileOffered,
+		Key:    msg.Key,
+		Peer:   from,
+		Detail: fmt.Sprintf("%s, offer %s", metrics.FormatBytes(msg.Size), offer.ID),
+	})
+	return nil
+}
+
+// acceptOffer asks the sender to stream an offered file, if it fits in the
+// storage quota
+func (s *FileServer) acceptOffer(offer *InboxOffer) error {
+	if s.QuotaManager.GetMaxStorage() > 0 {
+		ok, available, err := s.QuotaManager.CheckQuota(s.StorageRoot, offer.Size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s exceeds the %s left", ErrQuotaExceeded, metrics.FormatBytes(offer.Size), metrics.FormatBytes(available))
+		}
+	}
+	peer, ok := s.peerFor(offer.Peer)
+	if !ok {
+		return fmt.Errorf("peer %s %w", offer.Peer, ErrPeerUnreachable)
+	}
+
+	s.inboxMu.Lock()
+	s.accepted[offer.Node+"/"+offer.Key] = true
+	s.inboxMu.Unlock()
+
+	msg := Message{Payload: MessageDropReply{ID: s.ID, Key: offer.Key, Accepted: true}}
+	if err := s.sendMessage(peer, &msg); err != nil {
+		s.inboxMu.Lock()
+		delete(s.accepted, offer.Node+"/"+offer.Key)
+		s.inboxMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Offers lists the files peers want to send, oldest first
+func (s *FileServer) Offers() []InboxOffer {
+	s.inboxMu.Lock()
+	defer s.inboxMu.Unlock()
+	offers := make([]InboxOffer, 0, len(s.offers))
+	for _, o := range s.offers {
+		offers = append(offers, *o)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Offered.Before(offers[j].Offered) })
+	return offers
+}
+
+func (s *FileServer) takeOffer(id string) (*InboxOffer, error) {
+	s.inboxMu.Lock()
+	defer s.inboxMu.Unlock()
+	offer, ok := s.offers[id]
+	if !ok {
+		return nil, fmt.Errorf("no pending offer %s", id)
+	}
+	delete(s.offers, id)
+	return offer, nil
+}
+
+// AcceptOffer lets a peer send the file it offered
+func (s *FileServer) AcceptOffer(id string) error {
+	offer, err := s.takeOffer(id)
+	if err != nil {
+		return err
+	}
+	if err := s.acceptOffer(offer); err != nil {
+		// Keep the offer, space may be freed or the peer come back
+		s.inboxMu.Lock()
+		s.offers[id] = offer
+		s.inboxMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// RejectOffer declines a file a peer offered
+func (s *FileServer) RejectOffer(id string) error {
+	offer, err := s.takeOffer(id)
+	if err != nil {
+		return err
+	}
+	peer, ok := s.peerFor(offer.Peer)
+	if !ok {
+		return nil // The sender is gone, there is no one to tell
+	}
+	msg := Message{Payload: MessageDropReply{ID: s.ID, Key: offer.Key, Reason: "rejected by recipient"}}
+	return s.sendMessage(peer, &msg)
+}
+
+// handleDropStream stores an accepted file sent directly to this node in
+// its inbox. Drops are not replicated, acknowledged or offered to other
+// peers; streams nobody accepted are discarded.
+func (s *FileServer) handleDropStream(from string, stream io.Reader, header StreamHeader) error {
+	body := io.LimitReader(stream, header.Size)
+
+	s.inboxMu.Lock()
+	accepted := s.accepted[header.ID+"/"+header.Key]
+	delete(s.accepted, header.ID+"/"+header.Key)
+	s.inboxMu.Unlock()
+	if !accepted || header.Offset != 0 {
+		_, err := io.Copy(io.Discard, body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("rejected file drop of %s from %s: not accepted", header.Key, from)
+	}
+
+	n, err := s.store.WritePartial(header.ID, header.Key, 0, body)
+	s.Metrics.AddPeerBytesReceived(from, n)
+	if err != nil {
+		io.Copy(io.Discard, body)
+		return err
+	}
+	if n < header.Size {
+		return fmt.Errorf("file drop of %s interrupted at %d/%d bytes: %w", header.Key, n, header.Size, io.ErrUnexpectedEOF)
+	}
+	if err := s.store.CommitPartial(header.ID, header.Key); err != nil {
+		return err
+	}
+
+	s.Logger.Info("received file drop", "peer", from, "key", header.Key, "from", header.ID)
+	s.Events.Publish(events.Event{Type: events.FileDropped, Key: header.Key, Peer: from, Detail: metrics.FormatBytes(header.Size)})
+	return nil
+}
+
+// Inbox lists the files peers sent to this node, grouped by sender
+func (s *FileServer) Inbox() ([]storage.FileInfo, error) {
+	all, err := s.store.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var files []storage.FileInfo
+	for id, list := range all {
+		if id != s.ID {
+			files = append(files, list...)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].NodeID != files[j].NodeID {
+			return files[i].NodeID < files[j].NodeID
+		}
+		return files[i].Key < files[j].Key
+	})
+	return files, nil
+}
+
+// GetDropped reads a file a peer sent to this node. from is the sender's
+// node ID, as listed by Inbox.
+func (s *FileServer) GetDropped(ctx context.Context, from string, key string) (io.Reader, error) {
+	if from == s.ID || !s.store.Has(from, key) {
+		return nil, fmt.Errorf("no file %s from %s in the inbox", key, from)
+	}
+	_, r, err := s.store.Read(from, key)
+	if err != nil {
+		return nil, err
+	}
+	return storage.Decompress(s.decryptOnTheFly(ctx, s.EncKey, r)), nil
+}
@@ -3,16 +3,24 @@ package network
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
 	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
 	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestE2EReplicationAndRetrieval(t *testing.T) {
@@ -37,7 +45,8 @@ func TestE2EReplicationAndRetrieval(t *testing.T) {
 		ID:                id1,
 		EncKey:            encKey,
 	}
-	server1 := NewFileServer(opts1)
+	server1, err := NewFileServer(opts1)
+	assert.Nil(t, err)
 	tr1 := p2p.NewTCPTransport(p2p.TCPTransportOpts{
 		ListenAddr:    ":5000",
 		HandshakeFunc: p2p.NOPHandshakeFunc,
@@ -54,7 +63,8 @@ func TestE2EReplicationAndRetrieval(t *testing.T) {
 		ID:                id2,
 		EncKey:            encKey,
 	}
-	server2 := NewFileServer(opts2)
+	server2, err := NewFileServer(opts2)
+	assert.Nil(t, err)
 	tr2 := p2p.NewTCPTransport(p2p.TCPTransportOpts{
 		ListenAddr:    ":6000",
 		HandshakeFunc: p2p.NOPHandshakeFunc,
@@ -100,4 +110,3094 @@ func TestE2EReplicationAndRetrieval(t *testing.T) {
 	retrievedContent, err := io.ReadAll(reader)
 	assert.Nil(t, err)
 	assert.Equal(t, string(fileContent), string(retrievedContent))
+
+	// Latency histograms and per-peer transfer counters are exported
+	metrics1 := server1.Metrics.ToPrometheusFormat()
+	assert.Contains(t, metrics1, "peervault_files_stored_total 1\n")
+	assert.Contains(t, metrics1, "peervault_store_duration_seconds_count 1\n")
+	assert.Contains(t, metrics1, "peervault_peer_bytes_sent_total{peer=")
+	metrics2 := server2.Metrics.ToPrometheusFormat()
+	assert.Contains(t, metrics2, "peervault_get_duration_seconds_count 1\n")
+	assert.Contains(t, metrics2, "peervault_peer_bytes_received_total{peer=")
+}
+
+func TestE2EResumeInterruptedGet(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_resume_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_resume_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5100", encKey)
+	server2 := makeTestServer(t, root2, ":6100", encKey)
+
+	go server1.Start(context.Background())
+	go server2.Start(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	defer server1.Stop()
+	defer server2.Stop()
+
+	// Store on Node 1 before any peer is connected, so nothing is replicated
+	fileKey := "large_video.bin"
+	fileContent := bytes.Repeat([]byte("resumable transfer payload "), 100)
+	err := server1.Store(context.Background(), fileKey, bytes.NewReader(fileContent))
+	assert.Nil(t, err)
+
+	// Simulate an interrupted transfer: Node 2 already holds the first half
+	_, r, err := server1.store.Read(server1.ID, fileKey)
+	assert.Nil(t, err)
+	blob, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Nil(t, err)
+	half := int64(len(blob) / 2)
+	_, err = server2.store.WritePartial(server2.ID, fileKey, 0, bytes.NewReader(blob[:half]))
+	assert.Nil(t, err)
+
+	err = server2.Transport.Dial("127.0.0.1:5100")
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+
+	reader, err := server2.Get(context.Background(), fileKey)
+	assert.Nil(t, err)
+	retrievedContent, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(fileContent), string(retrievedContent))
+	assert.Equal(t, int64(0), server2.store.PartialSize(server2.ID, fileKey))
+}
+
+// makeTestServer builds a file server listening on addr with a fresh node ID
+func makeTestServer(t *testing.T, root, addr string, encKey []byte) *FileServer {
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+
+	server, err := NewFileServer(FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+	})
+	assert.Nil(t, err)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	tr.OnPeer = server.OnPeer
+	tr.OnPeerClose = server.OnPeerClose
+	server.Transport = tr
+	return server
+}
+
+func TestE2EParallelMultiPeerGet(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_parallel_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_parallel_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_parallel_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5200", encKey)
+	server2 := makeTestServer(t, roots[1], ":6200", encKey)
+	server3 := makeTestServer(t, roots[2], ":7200", encKey)
+	// Small ranges so the file is split across many requests
+	server3.DownloadChunkSize = 512
+
+	for _, s := range []*FileServer{server1, server2, server3} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Node 1 and Node 2 both hold the file
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5200"))
+	time.Sleep(200 * time.Millisecond)
+
+	fileKey := "dataset.csv"
+	fileContent := bytes.Repeat([]byte("id,name,value\n1,parallel,42\n"), 400)
+	assert.Nil(t, server1.Store(context.Background(), fileKey, bytes.NewReader(fileContent)))
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, server2.store.Has(server2.ID, fileKey))
+
+	// Node 3 fetches from both holders
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5200"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:6200"))
+	time.Sleep(200 * time.Millisecond)
+
+	reader, err := server3.Get(context.Background(), fileKey)
+	assert.Nil(t, err)
+	retrievedContent, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(fileContent), string(retrievedContent))
+}
+
+func TestE2EResumeSparseDownload(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_sparse_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_sparse_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5910", encKey)
+	server2 := makeTestServer(t, root2, ":6910", encKey)
+	server2.DownloadChunkSize = 512
+
+	go server1.Start(context.Background())
+	defer server1.Stop()
+	go server2.Start(context.Background())
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fileKey := "disk_image.img"
+	fileContent := bytes.Repeat([]byte("sparse resume payload "), 200)
+	assert.Nil(t, server1.Store(context.Background(), fileKey, bytes.NewReader(fileContent)))
+
+	// An earlier session of Node 2 got every other range before it stopped,
+	// leaving holes in its partial file
+	_, r, err := server1.store.Read(server1.ID, fileKey)
+	assert.Nil(t, err)
+	blob, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Nil(t, err)
+	size := int64(len(blob))
+	ranges := storage.NewPartialRanges(size, 0, 512)
+	assert.Nil(t, server2.store.SavePartialRanges(server2.ID, fileKey, ranges))
+	var have int64
+	for i := 0; i < ranges.Count(); i += 2 {
+		offset := int64(i) * 512
+		chunk := blob[offset:min(offset+512, size)]
+		_, err := server2.store.WritePartialAt(server2.ID, fileKey, offset, bytes.NewReader(chunk))
+		assert.Nil(t, err)
+		ranges.Set(i)
+		have += int64(len(chunk))
+	}
+	assert.Nil(t, server2.store.SavePartialRanges(server2.ID, fileKey, ranges))
+	assert.Equal(t, int64(512), server2.store.PartialSize(server2.ID, fileKey))
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5910"))
+	time.Sleep(200 * time.Millisecond)
+
+	// Only the holes are fetched
+	reader, err := server2.Get(context.Background(), fileKey)
+	assert.Nil(t, err)
+	retrievedContent, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(fileContent), string(retrievedContent))
+	assert.Equal(t, size-have, server2.Metrics.Snapshot().BytesReceived)
+	_, ok := server2.store.LoadPartialRanges(server2.ID, fileKey)
+	assert.False(t, ok)
+}
+
+func TestE2EGetMissingFileFailsFast(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_missing_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_missing_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5300", encKey)
+	server2 := makeTestServer(t, root2, ":6300", encKey)
+
+	go server1.Start(context.Background())
+	defer server1.Stop()
+	go server2.Start(context.Background())
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5300"))
+	time.Sleep(200 * time.Millisecond)
+
+	// Every peer answers the existence query, so Get does not wait for FetchTimeout
+	start := time.Now()
+	_, err := server2.Get(context.Background(), "missing.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Contains(t, err.Error(), "asked 127.0.0.1:5300")
+	assert.Less(t, time.Since(start), server2.FetchTimeout/4)
+
+	// Nothing is left behind for the missing key
+	assert.False(t, server2.store.Has(server2.ID, "missing.txt"))
+	assert.Zero(t, server2.store.PartialSize(server2.ID, "missing.txt"))
+	_, ok := server2.store.LoadPartialRanges(server2.ID, "missing.txt")
+	assert.False(t, ok)
+}
+
+func TestE2EKickPeerPropagatesBan(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_kick_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_kick_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_kick_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	// Bans apply to a whole host, so the kicked node gets its own loopback address
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], "127.0.0.1:5400", encKey)
+	server2 := makeTestServer(t, roots[1], "127.0.0.2:6400", encKey)
+	server3 := makeTestServer(t, roots[2], "127.0.0.1:7400", encKey)
+	server3.TrustedPeers = []string{server1.Identity.Fingerprint()}
+
+	for _, s := range []*FileServer{server1, server2, server3} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server1.Transport.Dial("127.0.0.2:6400"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5400"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.2:6400"))
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Nil(t, server1.KickPeer("127.0.0.2:6400", time.Hour))
+	time.Sleep(200 * time.Millisecond)
+
+	hasPeer := func(s *FileServer, addr string) bool {
+		s.PeerLock.Lock()
+		defer s.PeerLock.Unlock()
+		_, ok := s.conns[addr]
+		return ok
+	}
+	assert.False(t, hasPeer(server1, "127.0.0.2:6400"))
+	assert.True(t, server1.IsBanned("127.0.0.2:6400"))
+
+	// The disconnect shows up in the activity feed
+	var types []events.Type
+	for _, e := range server1.Events.Recent(0) {
+		if e.Peer == "127.0.0.2:6400" {
+			types = append(types, e.Type)
+		}
+	}
+	assert.Equal(t, []events.Type{events.PeerJoined, events.PeerLeft}, types)
+
+	// Node 3 trusts node 1, so it applies the ban too
+	assert.False(t, hasPeer(server3, "127.0.0.2:6400"))
+	assert.True(t, server3.IsBanned("127.0.0.2:1234"))
+	assert.True(t, hasPeer(server3, "127.0.0.1:5400"))
+
+	// Banned peers are refused when they reconnect
+	server1.Transport.Dial("127.0.0.2:6400")
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, hasPeer(server1, "127.0.0.2:6400"))
+
+	server1.UnbanPeer("127.0.0.2")
+	assert.False(t, server1.IsBanned("127.0.0.2:6400"))
+}
+
+func TestPeerRevokedNeedsTrustedIdentity(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_revoke_identity")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5991", encKey)
+	trusted, err := crypto.NewIdentity()
+	assert.Nil(t, err)
+	server.TrustedPeers = []string{trusted.Fingerprint()}
+
+	sign := func(id *crypto.Identity, host string, issued time.Time) MessagePeerRevoked {
+		msg := MessagePeerRevoked{Host: host, BanFor: time.Hour, Issued: issued, PublicKey: id.PublicKey}
+		payload, err := msg.signingPayload()
+		assert.Nil(t, err)
+		msg.Signature = id.Sign(payload)
+		return msg
+	}
+
+	// Another identity on the trusted node's host is not trusted
+	other, err := crypto.NewIdentity()
+	assert.Nil(t, err)
+	assert.Nil(t, server.handleMessagePeerRevoked("127.0.0.1:5400", sign(other, "10.0.0.1", time.Now())))
+	assert.False(t, server.IsBanned("10.0.0.1"))
+
+	// Neither is an unsigned revocation, or one claiming the trusted key
+	assert.Nil(t, server.handleMessagePeerRevoked("127.0.0.1:5400", MessagePeerRevoked{Host: "10.0.0.2", BanFor: time.Hour}))
+	forged := sign(other, "10.0.0.3", time.Now())
+	forged.PublicKey = trusted.PublicKey
+	assert.NotNil(t, server.handleMessagePeerRevoked("127.0.0.1:5400", forged))
+	assert.False(t, server.IsBanned("10.0.0.2"))
+	assert.False(t, server.IsBanned("10.0.0.3"))
+
+	// The trusted identity is honored from any address, until the ban it issued ends
+	assert.Nil(t, server.handleMessagePeerRevoked("192.0.2.1:3000", sign(trusted, "10.0.0.4", time.Now())))
+	assert.True(t, server.IsBanned("10.0.0.4"))
+	assert.Nil(t, server.handleMessagePeerRevoked("192.0.2.1:3000", sign(trusted, "10.0.0.5", time.Now().Add(-2*time.Hour))))
+	assert.False(t, server.IsBanned("10.0.0.5"))
+}
+
+func TestE2EListNetworkFiles(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_list_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_list_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5500", encKey)
+	server2 := makeTestServer(t, root2, ":6500", encKey)
+
+	go server1.Start(context.Background())
+	defer server1.Stop()
+	go server2.Start(context.Background())
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Stored before the nodes connect, so each file exists on one node only
+	assert.Nil(t, server1.Store(context.Background(), "only_on_1.txt", bytes.NewReader([]byte("one"))))
+	assert.Nil(t, server2.Store(context.Background(), "only_on_2.txt", bytes.NewReader([]byte("two"))))
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5500"))
+	time.Sleep(200 * time.Millisecond)
+
+	// Stored after connecting, so it is replicated to both
+	assert.Nil(t, server1.Store(context.Background(), "shared.txt", bytes.NewReader([]byte("shared"))))
+	time.Sleep(300 * time.Millisecond)
+
+	files, err := server2.ListNetworkFiles(context.Background())
+	assert.Nil(t, err)
+
+	holders := make(map[string]int)
+	for _, f := range files {
+		holders[f.Key] = len(f.Holders)
+	}
+	assert.Equal(t, map[string]int{"only_on_1.txt": 1, "only_on_2.txt": 1, "shared.txt": 2}, holders)
+}
+
+func TestE2EStoreReceipt(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_receipt_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_receipt_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_receipt_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5600", encKey)
+	server2 := makeTestServer(t, roots[1], ":6600", encKey)
+	server3 := makeTestServer(t, roots[2], ":7600", encKey)
+
+	for _, s := range []*FileServer{server1, server2, server3} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5600"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5600"))
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Nil(t, server1.Store(context.Background(), "contract.pdf", bytes.NewReader([]byte("signed contract"))))
+	time.Sleep(300 * time.Millisecond)
+
+	receipt, ok := server1.Receipt("contract.pdf")
+	assert.True(t, ok)
+	assert.Len(t, receipt.Confirmations, 2)
+	assert.Nil(t, VerifyReceipt(receipt))
+
+	// Receipts survive a restart of the storing node
+	reloaded := makeTestServer(t, roots[0], ":5601", encKey)
+	fromDisk, ok := reloaded.Receipt("contract.pdf")
+	assert.True(t, ok)
+	assert.Nil(t, VerifyReceipt(fromDisk))
+
+	// Any change to the receipt breaks its signature
+	receipt.Confirmations = receipt.Confirmations[:1]
+	assert.NotNil(t, VerifyReceipt(receipt))
+}
+
+func TestE2EAntiEntropyRepairsAfterPartition(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_antientropy_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_antientropy_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5700", encKey)
+	server2 := makeTestServer(t, roots[1], ":6700", encKey)
+	server1.AntiEntropyInterval = 200 * time.Millisecond
+	server2.AntiEntropyInterval = 200 * time.Millisecond
+
+	// Written while the nodes are partitioned, so nothing is replicated
+	assert.Nil(t, server1.Store(context.Background(), "written_on_1.txt", bytes.NewReader([]byte("from node 1"))))
+	assert.Nil(t, server2.Store(context.Background(), "written_on_2.txt", bytes.NewReader([]byte("from node 2"))))
+
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5700"))
+
+	// Either node's digest exchange repairs both directions
+	assert.Eventually(t, func() bool {
+		return server1.store.Has(server1.ID, "written_on_2.txt") &&
+			server2.store.Has(server2.ID, "written_on_1.txt")
+	}, 3*time.Second, 50*time.Millisecond)
+
+	d1, err := server1.localDigest()
+	assert.Nil(t, err)
+	d2, err := server2.localDigest()
+	assert.Nil(t, err)
+	assert.Equal(t, d1.root, d2.root)
+
+	reader, err := server1.Get(context.Background(), "written_on_2.txt")
+	assert.Nil(t, err)
+	content, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "from node 2", string(content))
+}
+
+func TestE2EMultiPathFailover(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_multipath_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_multipath_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5800", encKey)
+	server2 := makeTestServer(t, roots[1], ":6800", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Two paths to the same node, as over a LAN and a WAN address
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5800"))
+	assert.Nil(t, server2.Transport.Dial("127.0.0.2:5800"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 2 && len(server2.PeerPaths()) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	paths := server2.PeerPaths()
+	assert.Equal(t, paths[0].Node, paths[1].Node)
+	assert.True(t, paths[0].Preferred)
+	assert.False(t, paths[1].Preferred)
+	assert.Len(t, server2.broadcastPeers(), 1)
+
+	// The node has one entry in the peer table, under its ID
+	server2.PeerLock.Lock()
+	assert.Len(t, server2.Peers, 1)
+	assert.Contains(t, server2.Peers, paths[0].Node)
+	server2.PeerLock.Unlock()
+	assert.Equal(t, 1, server1.peerCount())
+
+	// and is asked once for a file no node holds
+	_, err := server2.Get(context.Background(), "nowhere.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, 1, strings.Count(err.Error(), ":5800"))
+
+	// Stored once per node, not once per path
+	assert.Nil(t, server1.Store(context.Background(), "multipath.txt", bytes.NewReader([]byte("one copy"))))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "multipath.txt")
+	}, 2*time.Second, 20*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	receipt, ok := server1.Receipt("multipath.txt")
+	assert.True(t, ok)
+	assert.Len(t, receipt.Confirmations, 1)
+
+	// Dropping the preferred path keeps the node reachable over the other one
+	server2.PeerLock.Lock()
+	preferred := server2.conns[paths[0].Addr]
+	server2.PeerLock.Unlock()
+	preferred.Close()
+	assert.Eventually(t, func() bool {
+		return len(server2.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Control messages addressed to the closed path fail over
+	msg := Message{Payload: MessageListFiles{ID: server2.ID, RequestID: "failover"}}
+	assert.Nil(t, server2.sendMessage(preferred, &msg))
+
+	// A replica push interrupted by the closed path is pulled over the other one
+	assert.Nil(t, server1.Store(context.Background(), "after_failover.txt", bytes.NewReader([]byte("still here"))))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "after_failover.txt")
+	}, 2*time.Second, 20*time.Millisecond)
+	reader, err := server2.Get(context.Background(), "after_failover.txt")
+	assert.Nil(t, err)
+	content, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "still here", string(content))
+}
+
+func TestE2EDuplicateConnections(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_dedup_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_dedup_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5967", encKey)
+	server2 := makeTestServer(t, roots[1], ":6967", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Both nodes dial each other, and node 2 dials twice
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6967"))
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5967"))
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5967"))
+	time.Sleep(500 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1 && len(server2.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Both nodes kept the connection the node with the higher ID dialed
+	higher := server1
+	if server2.Identity.Fingerprint() > server1.Identity.Fingerprint() {
+		higher = server2
+	}
+	higher.PeerLock.Lock()
+	for _, p := range higher.Peers {
+		assert.True(t, p.(*p2p.TCPPeer).Outbound())
+	}
+	higher.PeerLock.Unlock()
+
+	assert.Nil(t, server1.Store(context.Background(), "dedup.txt", bytes.NewReader([]byte("one connection"))))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "dedup.txt")
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestE2EStorageBackend(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_backend_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_backend_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	backend := storage.NewMemoryBackend()
+	server1, err := NewFileServer(FileServerOpts{
+		StorageRoot:       roots[0],
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+		Backend:           backend,
+	})
+	assert.Nil(t, err)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5969",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	tr.OnPeer = server1.OnPeer
+	tr.OnPeerClose = server1.OnPeerClose
+	server1.Transport = tr
+	server2 := makeTestServer(t, roots[1], ":6969", encKey)
+
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5969"))
+	time.Sleep(200 * time.Millisecond)
+
+	// Stored and replicated files both end up in the backend
+	assert.Nil(t, server1.Store(context.Background(), "mine.txt", bytes.NewReader([]byte("stored here"))))
+	assert.Nil(t, server2.Store(context.Background(), "theirs.txt", bytes.NewReader([]byte("replicated here"))))
+	assert.Eventually(t, func() bool {
+		files, _ := backend.List("")
+		return len(files) == 2 && server2.store.Has(server2.ID, "mine.txt")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// A file fetched from a peer is moved there once complete
+	assert.Nil(t, server2.store.Delete(server2.ID, "mine.txt"))
+	assert.Nil(t, server1.store.Delete(server1.ID, "theirs.txt"))
+	for key, want := range map[string]string{"mine.txt": "stored here", "theirs.txt": "replicated here"} {
+		r, err := server1.Get(context.Background(), key)
+		assert.Nil(t, err)
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(got))
+	}
+	assert.True(t, backend.Has(server1.ID, storage.CASPathTransformFunc("theirs.txt").Filename))
+
+	// Backend readers cannot seek, yet the node serves ranges past the first chunk
+	large := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	server2.DownloadChunkSize = 512
+	assert.Nil(t, server1.Store(context.Background(), "large.bin", bytes.NewReader(large)))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "large.bin")
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Nil(t, server2.store.Delete(server2.ID, "large.bin"))
+	r, err := server2.Get(context.Background(), "large.bin")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, large, got)
+
+	// Metadata records stay on local disk next to the key map
+	assert.Nil(t, server1.SetTags("mine.txt", map[string]string{"owner": "node1"}))
+	info, err := server1.Stat("mine.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", info.ContentType)
+	assert.Equal(t, "node1", info.Tags["owner"])
+	assert.NotEmpty(t, info.ContentHash)
+	_, err = server1.Stat("missing.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestE2EFileVersions(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_versions_node1")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	// Device keys give every file its own data key, which a new version keeps
+	server, err := NewFileServer(FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+		DeviceKeys:        true,
+		Versions:          &storage.VersionRetention{Keep: 5},
+	})
+	assert.Nil(t, err)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5971",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	tr.OnPeer = server.OnPeer
+	tr.OnPeerClose = server.OnPeerClose
+	server.Transport = tr
+	go server.Start(context.Background())
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, content := range []string{"first draft", "second draft", "final"} {
+		assert.Nil(t, server.Store(context.Background(), "essay.txt", bytes.NewReader([]byte(content))))
+	}
+	versions, err := server.ListVersions("essay.txt")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.True(t, versions[2].Current)
+
+	for n, want := range map[int]string{1: "first draft", 2: "second draft", 3: "final"} {
+		r, err := server.GetVersion(context.Background(), "essay.txt", n)
+		assert.Nil(t, err)
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(got))
+	}
+	_, err = server.GetVersion(context.Background(), "essay.txt", 7)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestE2EFileExpiry(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_expiry_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_expiry_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5972", encKey)
+	server2 := makeTestServer(t, root2, ":6972", encKey)
+	go server1.Start(context.Background())
+	go server2.Start(context.Background())
+	defer server1.Stop()
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5972"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	expires := time.Now().Add(300 * time.Millisecond)
+	assert.Nil(t, server1.StoreWithExpiry(context.Background(), "share.zip", bytes.NewReader([]byte("temporary")), expires))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "share.zip")
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.True(t, server2.Expiry("share.zip").Equal(expires), "replica keeps the expiry")
+
+	// Nothing expired yet
+	stats, _ := server1.GC.RunNow(nil)
+	assert.Equal(t, 0, stats.ExpiredFiles)
+
+	time.Sleep(time.Until(expires))
+	stats, _ = server1.GC.RunNow(nil)
+	assert.Equal(t, 1, stats.ExpiredFiles)
+	assert.False(t, server1.store.Has(server1.ID, "share.zip"))
+	assert.Eventually(t, func() bool {
+		return !server2.store.Has(server2.ID, "share.zip")
+	}, 2*time.Second, 20*time.Millisecond, "replica removed on notification")
+}
+
+func TestE2EReadRange(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_range_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_range_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5973", encKey)
+	server2 := makeTestServer(t, root2, ":6973", encKey)
+	go server1.Start(context.Background())
+	go server2.Start(context.Background())
+	defer server1.Stop()
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5973"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	content := make([]byte, 3*maxRangeRead+1000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	assert.Nil(t, server1.Store(context.Background(), "movie.mkv", bytes.NewReader(content)))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "movie.mkv")
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Nil(t, server2.store.Delete(server2.ID, "movie.mkv"))
+
+	// Read locally on server1, and from server1 on server2, across several
+	// messages and past the end of the file
+	for _, s := range []*FileServer{server1, server2} {
+		data, err := s.ReadRange(context.Background(), "movie.mkv", 1000, 2*maxRangeRead)
+		assert.Nil(t, err)
+		assert.Equal(t, content[1000:1000+2*maxRangeRead], data)
+
+		data, err = s.ReadRange(context.Background(), "movie.mkv", int64(len(content))-10, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, content[len(content)-10:], data)
+	}
+	assert.False(t, server2.store.Has(server2.ID, "movie.mkv"), "range reads do not fetch the whole file")
+
+	_, err := server2.ReadRange(context.Background(), "missing.mkv", 0, 10)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestE2EReadAhead(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_readahead_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_readahead_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5993", encKey)
+	server2 := makeTestServer(t, root2, ":6993", encKey)
+	server2.Readahead = 256 * 1024
+	go server1.Start(context.Background())
+	go server2.Start(context.Background())
+	defer server1.Stop()
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5993"))
+	assert.Eventually(t, func() bool {
+		return len(server2.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	content := make([]byte, maxRangeRead)
+	for i := range content {
+		content[i] = byte(i * 13)
+	}
+	assert.Nil(t, server1.Store(context.Background(), "movie.mkv", bytes.NewReader(content)))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "movie.mkv")
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Nil(t, server2.store.Delete(server2.ID, "movie.mkv"))
+
+	// The second read continues the first, so what follows is read ahead
+	const chunk = 64 * 1024
+	for i := int64(0); i < 2; i++ {
+		data, err := server2.ReadRange(context.Background(), "movie.mkv", i*chunk, chunk)
+		assert.Nil(t, err)
+		assert.Equal(t, content[i*chunk:(i+1)*chunk], data)
+	}
+	assert.Eventually(t, func() bool {
+		server2.readaheadMu.Lock()
+		defer server2.readaheadMu.Unlock()
+		ra := server2.readaheads["movie.mkv"]
+		if ra == nil || len(ra.windows) == 0 {
+			return false
+		}
+		select {
+		case <-ra.windows[0].done:
+			return ra.windows[0].err == nil
+		default:
+			return false
+		}
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// so the next reads are served without the holder
+	server2.PeerLock.Lock()
+	for _, p := range server2.conns {
+		p.Close()
+	}
+	server2.PeerLock.Unlock()
+	assert.Eventually(t, func() bool {
+		return len(server2.PeerPaths()) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+
+	data, err := server2.ReadRange(context.Background(), "movie.mkv", 2*chunk, chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, content[2*chunk:3*chunk], data)
+	_, err = server2.ReadRange(context.Background(), "movie.mkv", 12*chunk, chunk)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestE2EReReplicationAfterPeerLoss(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_repair_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_repair_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_repair_node3"),
+		filepath.Join(os.TempDir(), "pv_e2e_repair_node4"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5900", encKey)
+	server2 := makeTestServer(t, roots[1], ":6900", encKey)
+	server3 := makeTestServer(t, roots[2], ":7900", encKey)
+	server4 := makeTestServer(t, roots[3], ":8900", encKey)
+	server1.ReplicaTimeout = 200 * time.Millisecond
+
+	for _, s := range []*FileServer{server1, server2, server3, server4} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5900"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5900"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	assert.Nil(t, server1.Store(context.Background(), "precious.db", bytes.NewReader([]byte("keep three copies"))))
+	assert.Eventually(t, func() bool {
+		r, _ := server1.Receipt("precious.db")
+		return r != nil && len(r.Confirmations) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Node 4 joins after the store, then node 3 goes away for good
+	assert.Nil(t, server4.Transport.Dial("127.0.0.1:5900"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 3
+	}, 2*time.Second, 20*time.Millisecond)
+	server3.PeerLock.Lock()
+	for _, p := range server3.conns {
+		p.Close()
+	}
+	server3.PeerLock.Unlock()
+
+	assert.Eventually(t, func() bool {
+		return server4.store.Has(server4.ID, "precious.db")
+	}, 3*time.Second, 20*time.Millisecond)
+
+	metrics := server1.Metrics.ToPrometheusFormat()
+	assert.Contains(t, metrics, "peervault_replicas_lost_total 1\n")
+	assert.Contains(t, metrics, "peervault_replica_repairs_total 1\n")
+	assert.Contains(t, metrics, "peervault_under_replicated_files 0\n")
+}
+
+func TestE2EContextCancellation(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_context_node1")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5950", encKey)
+
+	// A cancelled store leaves no truncated file behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := server.Store(ctx, "cancelled.bin", bytes.NewReader(bytes.Repeat([]byte("x"), 1<<20)))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, server.store.Has(server.ID, "cancelled.bin"))
+
+	assert.Nil(t, server.Store(context.Background(), "kept.txt", bytes.NewReader([]byte("kept"))))
+	assert.ErrorIs(t, server.DeleteContext(ctx, "kept.txt"), context.Canceled)
+	assert.True(t, server.store.Has(server.ID, "kept.txt"))
+
+	runCtx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Start(runCtx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Cancelling the run context stops the server like Stop does
+	stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not stop after its context was cancelled")
+	}
+	select {
+	case <-server.quitch:
+	default:
+		t.Fatal("background work was not signalled to stop")
+	}
+}
+
+func TestE2EGuestAccess(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_guest_member"),
+		filepath.Join(os.TempDir(), "pv_e2e_guest_guest"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	member := makeTestServer(t, roots[0], ":5970", encKey)
+	identity, err := crypto.LoadOrCreateIdentity(filepath.Join(roots[1], "identity.key"))
+	assert.Nil(t, err)
+	token, err := member.IssueGuestToken(identity.Fingerprint(), 700*time.Millisecond)
+	assert.Nil(t, err)
+
+	// The guest never gets the network key, only a data key of its own
+	grant, err := ParseGuestToken(token)
+	assert.Nil(t, err)
+	assert.NotEqual(t, encKey, grant.Key)
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	guestOpts := FileServerOpts{
+		StorageRoot:       roots[1],
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            grant.Key,
+		NetworkID:         grant.NetworkID,
+		GuestToken:        token,
+		DownloadChunkSize: 512,
+	}
+	guest, err := NewFileServer(guestOpts)
+	assert.Nil(t, err)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":6970",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	tr.OnPeer = guest.OnPeer
+	tr.OnPeerClose = guest.OnPeerClose
+	guest.Transport = tr
+	assert.True(t, guest.IsGuest())
+
+	go member.Start(context.Background())
+	defer member.Stop()
+	go guest.Start(context.Background())
+	defer guest.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, guest.Transport.Dial("127.0.0.1:5970"))
+	assert.Eventually(t, func() bool {
+		member.guestsMu.Lock()
+		defer member.guestsMu.Unlock()
+		return len(member.guests) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Members do not replicate to guests, and guests cannot store
+	assert.Nil(t, member.Store(context.Background(), "dataset.csv", bytes.NewReader([]byte("a,b,c"))))
+	assert.NotNil(t, guest.Store(context.Background(), "upload.txt", bytes.NewReader([]byte("nope"))))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, guest.store.Has(guest.ID, "dataset.csv"))
+
+	// Guests can pull files, re-encrypted for them, which are cached
+	// locally. Larger files come in ranges of the same re-encrypted copy.
+	large := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	assert.Nil(t, member.Store(context.Background(), "large.bin", bytes.NewReader(large)))
+	for key, want := range map[string][]byte{"dataset.csv": []byte("a,b,c"), "large.bin": large} {
+		reader, err := guest.Get(context.Background(), key)
+		assert.Nil(t, err)
+		content, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, want, content)
+		assert.True(t, guest.store.Has(guest.ID, key))
+	}
+
+	// When the grant expires the guest is disconnected and its cache
+	// purged, but it keeps its identity
+	select {
+	case <-guest.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("guest did not stop when its access expired")
+	}
+	assert.False(t, guest.store.Has(guest.ID, "dataset.csv"))
+	_, err = os.Stat(filepath.Join(roots[1], "identity.key"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		member.PeerLock.Lock()
+		defer member.PeerLock.Unlock()
+		return len(member.Peers) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Restarting with the expired token fails with an error, not an exit
+	_, err = NewFileServer(guestOpts)
+	assert.ErrorIs(t, err, ErrGuestExpired)
+	_, err = os.Stat(filepath.Join(roots[1], "identity.key"))
+	assert.Nil(t, err)
+}
+
+func TestE2EGracefulShutdown(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_shutdown_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_shutdown_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5980", encKey)
+	server2 := makeTestServer(t, roots[1], ":6980", encKey)
+	server2.BootstrapNodes = []string{":5980"}
+
+	go server1.Start(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	go server2.Start(context.Background())
+	time.Sleep(300 * time.Millisecond)
+
+	assert.Nil(t, server1.Store(context.Background(), "shutdown.txt", bytes.NewReader([]byte("flushed"))))
+
+	// An incoming transfer is still running when shutdown begins
+	done, err := server1.beginTransfer(false)
+	assert.Nil(t, err)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server1.Shutdown(context.Background()) }()
+
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the transfer finished")
+	case <-time.After(200 * time.Millisecond):
+	}
+	_, err = server1.beginTransfer(true)
+	assert.ErrorIs(t, err, ErrServerClosed)
+
+	done()
+	select {
+	case err := <-shutdown:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not finish after the transfer drained")
+	}
+	<-server1.Done()
+	_, err = os.Stat(filepath.Join(roots[0], "metadata.json"))
+	assert.Nil(t, err)
+
+	// The remote side sees the connection go away
+	assert.Eventually(t, func() bool {
+		server2.PeerLock.Lock()
+		defer server2.PeerLock.Unlock()
+		return len(server2.Peers) == 0
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// Transfers that outlast the deadline are cut off
+	_, err = server2.beginTransfer(false)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server2.Shutdown(ctx), context.DeadlineExceeded)
+	<-server2.Done()
+}
+
+func TestE2EReplicaPlacement(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_placement_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_placement_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_placement_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5990", encKey)
+	server2 := makeTestServer(t, roots[1], ":6990", encKey)
+	server3 := makeTestServer(t, roots[2], ":7990", encKey)
+	server2.Labels = map[string]string{"zone": "eu"}
+	server3.Labels = map[string]string{"zone": "us"}
+
+	// Keys under pii/ stay in the EU zone
+	server1.Placement = func(key string, candidates []ReplicaCandidate) []ReplicaCandidate {
+		if !strings.HasPrefix(key, "pii/") {
+			return candidates
+		}
+		var eu []ReplicaCandidate
+		for _, c := range candidates {
+			if c.Labels["zone"] == "eu" {
+				eu = append(eu, c)
+			}
+		}
+		return eu
+	}
+
+	for _, s := range []*FileServer{server1, server2, server3} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5990"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5990"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	assert.Nil(t, server1.Store(context.Background(), "pii/alice.json", bytes.NewReader([]byte(`{"name":"alice"}`))))
+	assert.Nil(t, server1.Store(context.Background(), "public.txt", bytes.NewReader([]byte("anyone"))))
+
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "pii/alice.json") &&
+			server2.store.Has(server2.ID, "public.txt") &&
+			server3.store.Has(server3.ID, "public.txt")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Anti-entropy does not leak the key to the other zone either
+	assert.Nil(t, server3.antiEntropyRound())
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, server1.antiEntropyRound())
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, server3.store.Has(server3.ID, "pii/alice.json"))
+}
+
+func TestE2EDeviceKeys(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_devices_laptop"),
+		filepath.Join(os.TempDir(), "pv_e2e_devices_phone"),
+		filepath.Join(os.TempDir(), "pv_e2e_devices_other"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	var servers []*FileServer
+	for i, addr := range []string{":5995", ":6995", ":7995"} {
+		id, err := crypto.GenerateID()
+		assert.Nil(t, err)
+		s, err := NewFileServer(FileServerOpts{
+			StorageRoot:       roots[i],
+			PathTransformFunc: storage.CASPathTransformFunc,
+			ID:                id,
+			EncKey:            encKey,
+			DeviceKeys:        true,
+		})
+		assert.Nil(t, err)
+		tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		})
+		tr.OnPeer = s.OnPeer
+		tr.OnPeerClose = s.OnPeerClose
+		s.Transport = tr
+		servers = append(servers, s)
+
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	laptop, phone, other := servers[0], servers[1], servers[2]
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, phone.Transport.Dial("127.0.0.1:5995"))
+	assert.Nil(t, other.Transport.Dial("127.0.0.1:5995"))
+	assert.Eventually(t, func() bool {
+		return len(laptop.PeerPaths()) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	assert.Nil(t, laptop.Store(context.Background(), "diary.txt", bytes.NewReader([]byte("dear diary"))))
+	assert.Eventually(t, func() bool {
+		return phone.store.Has(phone.ID, "diary.txt") && other.store.Has(other.ID, "diary.txt")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Holding a replica and the network key is not enough to read it
+	readAll := func(s *FileServer) (string, error) {
+		r, err := s.Get(context.Background(), "diary.txt")
+		if err != nil {
+			return "", err
+		}
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+	_, err := readAll(phone)
+	assert.NotNil(t, err)
+
+	// Authorizing the phone hands it the wrapped data key
+	assert.Nil(t, laptop.AuthorizeDevice(phone.DevicePublicKey(), "phone"))
+	assert.Eventually(t, func() bool {
+		data, err := readAll(phone)
+		return err == nil && data == "dear diary"
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Len(t, phone.Devices(), 2)
+
+	// Files stored later are shared with the phone right away
+	assert.Nil(t, laptop.Store(context.Background(), "diary.txt", bytes.NewReader([]byte("second entry"))))
+	assert.Eventually(t, func() bool {
+		data, err := readAll(phone)
+		return err == nil && data == "second entry"
+	}, 2*time.Second, 50*time.Millisecond)
+
+	_, err = readAll(other)
+	assert.NotNil(t, err)
+}
+
+// memPinner is a pinning service keeping pinned files in memory
+type memPinner struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (p *memPinner) Pin(ctx context.Context, hash string, size int64, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files[hash] = data
+	return nil
+}
+
+func (p *memPinner) Fetch(ctx context.Context, hash string) (io.ReadCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.files[hash]
+	if !ok {
+		return nil, fmt.Errorf("pinned file %s %w", hash, ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (p *memPinner) pinned(hash string) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.files[hash]
+}
+
+func TestE2EPinning(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_pin_laptop")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_pin_new")
+	for _, root := range []string{root1, root2} {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	pinner := &memPinner{files: make(map[string][]byte)}
+
+	laptop := makeTestServer(t, root1, ":5965", encKey)
+	laptop.Pinner = pinner
+	go laptop.Start(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("survives while every device is offline")
+	assert.Nil(t, laptop.Store(context.Background(), "pinned_file", bytes.NewReader(data)))
+
+	// The service gets the encrypted file under its hashed key
+	hash := crypto.HashKey("pinned_file")
+	assert.Eventually(t, func() bool { return pinner.pinned(hash) != nil }, 5*time.Second, 20*time.Millisecond)
+	assert.False(t, bytes.Contains(pinner.pinned(hash), data))
+	laptop.Stop()
+
+	// A new device with no peers restores it from the service
+	fresh := makeTestServer(t, root2, ":6965", encKey)
+	fresh.Pinner = pinner
+	fresh.FetchTimeout = 500 * time.Millisecond
+	go fresh.Start(context.Background())
+	defer fresh.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	r, err := fresh.Get(context.Background(), "pinned_file")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = fresh.Get(context.Background(), "never_stored")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, err, ErrNoPeers)
+}
+
+func TestE2ESendToPeer(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_drop_sender")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_drop_recipient")
+	for _, root := range []string{root1, root2} {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	sender := makeTestServer(t, root1, ":5955", encKey)
+	// No replicas at all: the drop has to bypass placement. Device keys make
+	// the sender re-encrypt the file for the recipient.
+	sender.Placement = func(key string, candidates []ReplicaCandidate) []ReplicaCandidate { return nil }
+	sender.DeviceKeys = true
+	recipient := makeTestServer(t, root2, ":6955", encKey)
+
+	for _, s := range []*FileServer{sender, recipient} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("for your eyes only")
+	assert.Nil(t, sender.Store(context.Background(), "drop_file", bytes.NewReader(data)))
+	assert.ErrorIs(t, sender.SendTo("127.0.0.1:6955", "drop_file"), ErrPeerUnreachable)
+	assert.Nil(t, sender.Transport.Dial("127.0.0.1:6955"))
+	time.Sleep(200 * time.Millisecond)
+
+	arrivals, cancel := recipient.Events.Subscribe(16)
+	defer cancel()
+	waitFor := func(typ events.Type, key string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-arrivals:
+				if e.Type == typ && e.Key == key {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("recipient got no %s event for %s", typ, key)
+			}
+		}
+	}
+	outboxStatus := func(key string) string {
+		for _, e := range sender.Outbox() {
+			if e.Key == key {
+				return e.Status
+			}
+		}
+		return ""
+	}
+
+	// Nothing is transferred until the recipient accepts the offer
+	assert.Nil(t, sender.SendTo("127.0.0.1:6955", "drop_file"))
+	waitFor(events.FileOffered, "drop_file")
+	offers := recipient.Offers()
+	assert.Len(t, offers, 1)
+	assert.Equal(t, sender.ID, offers[0].Node)
+	size, _ := sender.store.Size(sender.ID, "drop_file")
+	assert.Equal(t, size, offers[0].Size)
+	assert.Equal(t, DropPending, outboxStatus("drop_file"))
+	assert.False(t, recipient.store.Has(sender.ID, "drop_file"))
+
+	assert.Nil(t, recipient.AcceptOffer(offers[0].ID))
+	waitFor(events.FileDropped, "drop_file")
+	assert.Empty(t, recipient.Offers())
+
+	// It lands in the inbox, not among the recipient's own files
+	assert.False(t, recipient.store.Has(recipient.ID, "drop_file"))
+	inbox, err := recipient.Inbox()
+	assert.Nil(t, err)
+	assert.Len(t, inbox, 1)
+	assert.Equal(t, sender.ID, inbox[0].NodeID)
+
+	r, err := recipient.GetDropped(context.Background(), sender.ID, "drop_file")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	for i := 0; i < 50 && outboxStatus("drop_file") != DropDelivered; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, DropDelivered, outboxStatus("drop_file"))
+
+	// A rejected offer is reported back and never stored
+	assert.Nil(t, sender.Store(context.Background(), "unwanted", bytes.NewReader(data)))
+	assert.Nil(t, sender.SendTo("127.0.0.1:6955", "unwanted"))
+	waitFor(events.FileOffered, "unwanted")
+	assert.Nil(t, recipient.RejectOffer(recipient.Offers()[0].ID))
+	for i := 0; i < 50 && outboxStatus("unwanted") != DropRejected; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, DropRejected, outboxStatus("unwanted"))
+	assert.False(t, recipient.store.Has(sender.ID, "unwanted"))
+	assert.NotNil(t, recipient.AcceptOffer("missing"))
+
+	// Small files are accepted without asking
+	recipient.InboxAutoAccept = 1024
+	assert.Nil(t, sender.Store(context.Background(), "small", bytes.NewReader(data)))
+	assert.Nil(t, sender.SendTo("127.0.0.1:6955", "small"))
+	waitFor(events.FileDropped, "small")
+	assert.Empty(t, recipient.Offers())
+
+	assert.NotNil(t, sender.SendTo("127.0.0.1:9999", "drop_file"))
+}
+
+func TestE2EMetadataOnlyIndex(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_index_storer")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_index_indexer")
+	for _, root := range []string{root1, root2} {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	storer := makeTestServer(t, root1, ":5935", encKey)
+	indexer := makeTestServer(t, root2, ":6935", encKey)
+	indexer.MetadataOnly = true
+
+	for _, s := range []*FileServer{storer, indexer} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("indexed, not stored")
+	assert.Nil(t, storer.Store(context.Background(), "reports/q1.pdf", bytes.NewReader(data)))
+	assert.Nil(t, indexer.Transport.Dial("127.0.0.1:5935"))
+	time.Sleep(300 * time.Millisecond)
+
+	// The indexer is never picked for replicas
+	assert.Empty(t, storer.replicaPeers())
+	assert.Nil(t, storer.Store(context.Background(), "reports/q2.pdf", bytes.NewReader(data)))
+	time.Sleep(300 * time.Millisecond)
+
+	// Catalogs collected on connect and announced stores are both indexed
+	files, err := indexer.ListNetworkFiles(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		assert.Len(t, f.Holders, 1)
+	}
+	found, err := indexer.SearchNetworkFiles(context.Background(), "Q2")
+	assert.Nil(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, "reports/q2.pdf", found[0].Key)
+
+	local, err := indexer.store.List(indexer.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, local)
+	assert.NotNil(t, indexer.Store(context.Background(), "mine", bytes.NewReader(data)))
+
+	indexed, peers, _ := indexer.IndexStats()
+	assert.Equal(t, 2, indexed)
+	assert.Equal(t, 1, peers)
+}
+
+func TestE2EStoreAndGetDir(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_dir_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_dir_node2")
+	for _, root := range []string{root1, root2} {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	src := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "docs", "drafts"), 0755))
+	assert.Nil(t, os.Mkdir(filepath.Join(src, "empty"), 0700))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "README"), []byte("top level"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "docs", "drafts", "plan.txt"), []byte("nested"), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0750))
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5945", encKey)
+	server2 := makeTestServer(t, root2, ":6945", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5945"))
+	time.Sleep(200 * time.Millisecond)
+
+	manifest, err := server1.StoreDir(context.Background(), "project", src)
+	assert.Nil(t, err)
+	assert.Len(t, manifest.Entries, 6)
+	time.Sleep(500 * time.Millisecond)
+
+	// The other node rebuilds the tree from replicas
+	dest := filepath.Join(t.TempDir(), "restored")
+	_, err = server2.GetDir(context.Background(), "project", dest)
+	assert.Nil(t, err)
+
+	for path, want := range map[string]string{"README": "top level", "docs/drafts/plan.txt": "nested", "run.sh": "#!/bin/sh\n"} {
+		got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(path)))
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(got))
+	}
+	info, err := os.Stat(filepath.Join(dest, "run.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dest, "empty"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Manifests cannot write outside the destination
+	evil := `{"format":"peervault-dir/1","entries":[{"path":"../escaped","mode":420}]}`
+	assert.Nil(t, server1.Store(context.Background(), "evil", strings.NewReader(evil)))
+	_, err = server1.GetDir(context.Background(), "evil", dest)
+	assert.NotNil(t, err)
+
+	_, err = server1.GetDir(context.Background(), "project/README", dest)
+	assert.NotNil(t, err)
+}
+
+func TestE2EDedupStats(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_dedup")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5925", encKey)
+	go server.Start(context.Background())
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	same := bytes.Repeat([]byte("duplicated content "), 100)
+	for _, key := range []string{"a.txt", "copy/a.txt", "b.txt"} {
+		assert.Nil(t, server.Store(context.Background(), key, bytes.NewReader(same)))
+	}
+	assert.Nil(t, server.Store(context.Background(), "unique.txt", bytes.NewReader([]byte("only once"))))
+
+	report, err := server.DedupStats(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Files)
+	assert.Equal(t, int64(3*len(same)+9), report.LogicalBytes)
+	assert.Equal(t, int64(len(same)+9), report.PhysicalBytes)
+	assert.Equal(t, int64(2*len(same)), report.Savings())
+	assert.Len(t, report.Duplicates, 1)
+	assert.Equal(t, []string{"a.txt", "b.txt", "copy/a.txt"}, report.Duplicates[0].Keys)
+
+	assert.Contains(t, server.Metrics.ToPrometheusFormat(), fmt.Sprintf("peervault_dedup_logical_bytes %d", report.LogicalBytes))
+}
+
+func TestE2ETracingAcrossNodes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_tracing_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_tracing_node2")
+	for _, root := range []string{root1, root2} {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5915", encKey)
+	server2 := makeTestServer(t, root2, ":6915", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("traced from end to end")
+	assert.Nil(t, server1.Store(context.Background(), "traced.txt", bytes.NewReader(data)))
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5915"))
+	time.Sleep(200 * time.Millisecond)
+
+	r, err := server2.Get(context.Background(), "traced.txt")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	time.Sleep(100 * time.Millisecond)
+
+	// The spans of the serving node belong to the trace of the Get
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		byName[span.Name()] = span
+	}
+	get, ok := byName["Get"]
+	assert.True(t, ok)
+	for _, name := range []string{"broadcast", "handle network.MessageHasFile", "handle network.MessageGetFile", "stream copy", "receive stream", "decrypt"} {
+		span, ok := byName[name]
+		if assert.True(t, ok, "missing span %q", name) {
+			assert.Equal(t, get.SpanContext().TraceID(), span.SpanContext().TraceID(), name)
+		}
+	}
+	_, ok = byName["p2p.Dial"]
+	assert.True(t, ok)
+}
+
+func TestE2ELegalHold(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_hold")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5905", encKey)
+	go server.Start(context.Background())
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, key := range []string{"case-42/mail.eml", "case-42/notes.txt", "scratch.txt"} {
+		assert.Nil(t, server.Store(context.Background(), key, bytes.NewReader([]byte(key))))
+	}
+
+	assert.Nil(t, server.PlaceHold("case-42/", "alice", "litigation"))
+	assert.NotNil(t, server.PlaceHold("case-42/", "bob", ""))
+
+	// Every key in the namespace is held, others are not
+	err := server.Delete("case-42/mail.eml")
+	assert.ErrorIs(t, err, ErrLegalHold)
+	assert.True(t, server.store.Has(server.ID, "case-42/mail.eml"))
+	assert.ErrorIs(t, server.ClearStorage(ClearFiles, false), ErrLegalHold)
+	assert.Nil(t, server.Delete("scratch.txt"))
+
+	// Holds survive a restart
+	reopened := makeTestServer(t, root, ":5906", encKey)
+	assert.Len(t, reopened.Holds(), 1)
+	hold, ok := reopened.HoldOn("case-42/notes.txt")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", hold.By)
+
+	assert.Nil(t, server.ReleaseHold("case-42/", "alice"))
+	assert.Nil(t, server.Delete("case-42/mail.eml"))
+
+	entries, err := server.AuditLog(0)
+	assert.Nil(t, err)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	assert.Equal(t, []string{"hold", "blocked", "blocked", "release"}, actions)
+	assert.Equal(t, "alice", entries[0].By)
+	assert.Equal(t, "case-42/mail.eml", entries[1].Key)
+	assert.Equal(t, "delete", entries[1].Reason)
+}
+
+func TestE2ESharedPolicy(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_policy_admin"),
+		filepath.Join(os.TempDir(), "pv_e2e_policy_member"),
+		filepath.Join(os.TempDir(), "pv_e2e_policy_late"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	admin := makeTestServer(t, roots[0], "127.0.0.1:5975", encKey)
+	member := makeTestServer(t, roots[1], "127.0.0.1:6975", encKey)
+	late := makeTestServer(t, roots[2], "127.0.0.1:7975", encKey)
+	member.PolicyAdmins = []string{admin.Identity.Fingerprint()}
+	member.PolicyOverrides = []string{PolicyReplicationFactor}
+	late.PolicyAdmins = []string{admin.Identity.Fingerprint()}
+
+	for _, s := range []*FileServer{admin, member, late} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, admin.Transport.Dial("127.0.0.1:6975"))
+	time.Sleep(200 * time.Millisecond)
+
+	published, err := admin.PublishPolicy(Policy{
+		ReplicationFactor: 5,
+		Denylist:          []string{"127.0.0.3"},
+		Retention:         []RetentionRule{{Prefix: "records/", MinAge: time.Hour}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), published.Version)
+	time.Sleep(200 * time.Millisecond)
+
+	p, ok := member.CurrentPolicy()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), p.Version)
+	assert.True(t, member.denied("127.0.0.3:4000"))
+
+	// The member keeps its own replication factor
+	assert.Equal(t, 3, member.replicationFactor())
+
+	// Retention rules block deletion of young files under the prefix
+	assert.Nil(t, member.Store(context.Background(), "records/q3.csv", bytes.NewReader([]byte("q3"))))
+	assert.Nil(t, member.Store(context.Background(), "tmp.txt", bytes.NewReader([]byte("tmp"))))
+	assert.ErrorIs(t, member.Delete("records/q3.csv"), ErrRetention)
+	assert.Nil(t, member.Delete("tmp.txt"))
+
+	// A node joining later gets the policy from the peer it connects to
+	assert.Nil(t, late.Transport.Dial("127.0.0.1:6975"))
+	time.Sleep(200 * time.Millisecond)
+	p, ok = late.CurrentPolicy()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), p.Version)
+	assert.Equal(t, 5, late.replicationFactor())
+
+	// Policies from nodes that are not admins are ignored
+	_, err = late.PublishPolicy(Policy{ReplicationFactor: 1})
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	p, _ = member.CurrentPolicy()
+	assert.Equal(t, uint64(1), p.Version)
+	assert.Equal(t, admin.Identity.Fingerprint(), p.Publisher())
+
+	// The applied policy survives a restart
+	reopened := makeTestServer(t, roots[1], "127.0.0.1:6976", encKey)
+	p, ok = reopened.CurrentPolicy()
+	assert.True(t, ok)
+	assert.Equal(t, []string{"127.0.0.3"}, p.Denylist)
+}
+
+func TestE2ETopology(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_topology_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_topology_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5930", encKey)
+	server2 := makeTestServer(t, roots[1], ":6930", encKey)
+	server1.Labels = map[string]string{"zone": "eu"}
+	server2.Labels = map[string]string{"zone": "us"}
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5930"))
+	assert.Eventually(t, func() bool {
+		links := server1.Topology().Links
+		return len(links) == 1 && links[0].RTTMillis > 0
+	}, 2*time.Second, 20*time.Millisecond)
+
+	topology := server1.Topology()
+	node2 := crypto.Fingerprint(server2.Identity.PublicKey)
+	assert.Equal(t, "eu", topology.Node.Zone)
+	assert.Len(t, topology.Peers, 1)
+	assert.Equal(t, node2, topology.Peers[0].ID)
+	assert.Equal(t, "us", topology.Peers[0].Zone)
+	assert.Equal(t, topology.Node.ID, topology.Links[0].From)
+	assert.Equal(t, node2, topology.Links[0].To)
+	assert.True(t, topology.Links[0].Preferred)
+
+	dot := topology.DOT()
+	assert.Contains(t, dot, `subgraph "cluster_us"`)
+	assert.Contains(t, dot, fmt.Sprintf("%q -- %q", topology.Node.ID, node2))
+}
+
+func TestE2EAdvertiseAddrChange(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_advertise_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_advertise_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5944", encKey)
+	server2 := makeTestServer(t, roots[1], ":6944", encKey)
+	server1.SetAdvertiseAddr("198.51.100.4:5944")
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The address arrives with the hello
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5944"))
+	peerAddr := func() string {
+		peers := server2.Topology().Peers
+		if len(peers) != 1 {
+			return ""
+		}
+		return peers[0].Addr
+	}
+	assert.Eventually(t, func() bool {
+		return peerAddr() == "198.51.100.4:5944"
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// A changed public IP is announced to connected peers
+	server1.SetAdvertiseAddr("203.0.113.9:5944")
+	assert.Eventually(t, func() bool {
+		return peerAddr() == "203.0.113.9:5944"
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "203.0.113.9:5944", server1.Topology().Node.Addr)
+}
+
+// startIntroduced starts an introducer and two nodes connected only to it,
+// and waits until the introducer knows where both nodes listen
+func startIntroduced(t *testing.T, name string, ports [3]int, reusePort bool) (introducer, a, b *FileServer) {
+	encKey, _ := crypto.NewEncryptionKey()
+	servers := make([]*FileServer, 3)
+	for i, port := range ports {
+		root := filepath.Join(os.TempDir(), fmt.Sprintf("pv_e2e_%s_node%d", name, i+1))
+		os.RemoveAll(root)
+		t.Cleanup(func() { os.RemoveAll(root) })
+
+		servers[i] = makeTestServer(t, root, fmt.Sprintf(":%d", port), encKey)
+		servers[i].SetAdvertiseAddr(fmt.Sprintf("127.0.0.1:%d", port))
+		servers[i].Transport.(*p2p.TCPTransport).ReusePort = reusePort
+	}
+	introducer, a, b = servers[0], servers[1], servers[2]
+	introducer.RelayAddr = fmt.Sprintf("127.0.0.1:%d", ports[0]+1)
+	for _, s := range servers {
+		go s.Start(context.Background())
+		t.Cleanup(s.Stop)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	introducerAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	assert.Nil(t, a.Transport.Dial(introducerAddr))
+	assert.Nil(t, b.Transport.Dial(introducerAddr))
+	assert.Eventually(t, func() bool {
+		return introducer.nodeAt(a.AdvertiseAddr()) != "" && introducer.nodeAt(b.AdvertiseAddr()) != ""
+	}, 2*time.Second, 20*time.Millisecond)
+	return introducer, a, b
+}
+
+func TestE2EHolePunch(t *testing.T) {
+	_, a, b := startIntroduced(t, "punch", [3]int{5946, 6946, 7946}, true)
+
+	assert.Nil(t, a.Rendezvous(context.Background(), b.AdvertiseAddr()))
+	node := a.nodeAt(b.AdvertiseAddr())
+	assert.Equal(t, crypto.Fingerprint(b.Identity.PublicKey), node)
+	for _, path := range a.PeerPaths() {
+		if path.Node == node {
+			assert.NotContains(t, path.Addr, "/relay/")
+		}
+	}
+}
+
+func TestE2ERelayFallback(t *testing.T) {
+	// Without shared ports neither node can punch, so the relay is used
+	_, a, b := startIntroduced(t, "relay", [3]int{5948, 6948, 7948}, false)
+
+	assert.Nil(t, a.Rendezvous(context.Background(), b.AdvertiseAddr()))
+	node := crypto.Fingerprint(b.Identity.PublicKey)
+	var relayed *PeerPath
+	assert.Eventually(t, func() bool {
+		for _, path := range a.PeerPaths() {
+			if path.Node == node && path.RTT > 0 {
+				relayed = &path
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Contains(t, relayed.Addr, "127.0.0.1:5949/relay/")
+}
+
+func TestE2EProbeReachability(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_probe_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_probe_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5942", encKey)
+	server2 := makeTestServer(t, roots[1], ":6942", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5942"))
+	assert.Eventually(t, func() bool {
+		paths := server2.PeerPaths()
+		return len(paths) == 1 && paths[0].RTT > 0
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Both clocks are this machine's
+	assert.Less(t, server2.PeerPaths()[0].ClockSkew.Abs(), 100*time.Millisecond)
+
+	results, err := server2.ProbeReachability(context.Background(), 6942)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.True(t, results[0].Reachable)
+	assert.Equal(t, "127.0.0.1:6942", results[0].Addr)
+
+	results, err = server2.ProbeReachability(context.Background(), 6943)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.False(t, results[0].Reachable)
+	assert.NotEmpty(t, results[0].Err)
+}
+
+func TestE2EResolvePeer(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_resolve_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_resolve_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_resolve_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5952", encKey)
+	server2 := makeTestServer(t, roots[1], ":6952", encKey)
+	server3 := makeTestServer(t, roots[2], ":7952", encKey)
+	server2.Labels = map[string]string{"name": "laptop", "zone": "eu"}
+	server3.Labels = map[string]string{"name": "nas", "zone": "us"}
+	server2.SetAdvertiseAddr("127.0.0.1:6952")
+
+	for _, s := range []*FileServer{server1, server2, server3} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5952"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5952"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	var laptop, nas PeerMatch
+	for _, m := range server1.MatchPeers("") {
+		switch m.Node {
+		case server2.Identity.Fingerprint():
+			laptop = m
+		case server3.Identity.Fingerprint():
+			nas = m
+		}
+	}
+	assert.NotEmpty(t, laptop.Addr)
+	assert.NotEmpty(t, nas.Addr)
+
+	for query, want := range map[string]string{
+		laptop.Addr:      laptop.Addr,
+		"127.0.0.1:6952": laptop.Addr, // advertised address
+		"laptop":         laptop.Addr,
+		"zone=us":        nas.Addr,
+		"NAS":            nas.Addr,
+		nas.Node[:6]:     nas.Addr,
+		laptop.Addr[10:]: laptop.Addr, // just the port
+	} {
+		got, err := server1.ResolvePeer(query)
+		assert.Nil(t, err, query)
+		assert.Equal(t, want, got, query)
+	}
+
+	_, err := server1.ResolvePeer("127.0.0.1")
+	assert.ErrorContains(t, err, "matches several peers")
+	_, err = server1.ResolvePeer("zone=asia")
+	assert.ErrorIs(t, err, ErrNoPeerMatch)
+	assert.Len(t, server1.MatchPeers("zone=eu"), 1)
+}
+
+func TestE2EMetricsCollector(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_collector_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_collector_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5953", encKey)
+	server2 := makeTestServer(t, roots[1], ":6953", encKey)
+	server1.MetricsInterval = 50 * time.Millisecond
+	server1.QuotaManager.SetMaxStorage(1 << 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server1.Pex.Start(ctx)
+	server1.Pex.AddKnownPeer("192.0.2.10:3000", "bootstrap")
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(ctx)
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5953"))
+	assert.Nil(t, server1.Store(context.Background(), "collected.txt", bytes.NewReader(bytes.Repeat([]byte("x"), 4096))))
+
+	// Nothing but the collector sets the storage and discovery gauges
+	assert.Eventually(t, func() bool {
+		snap := server1.Metrics.Snapshot()
+		return snap.StorageUsed >= 4096 && snap.StorageTotal == 1<<20 &&
+			snap.PeersConnected == 1 && snap.PeersDiscovered == 1
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestE2ECollectorDuringPexStop(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_collectorstop")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5990", encKey)
+	server.MetricsInterval = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server.Pex.Start(ctx)
+	go server.collectMetrics(ctx)
+
+	// Shutdown stops PEX while the collector is reading its state; run
+	// with -race to catch unsynchronized access
+	time.Sleep(20 * time.Millisecond)
+	server.Pex.Stop()
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, server.Pex.Enabled())
+}
+
+func TestE2EPexDelta(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_pexdelta_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_pexdelta_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5956", encKey)
+	server2 := makeTestServer(t, roots[1], ":6956", encKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, s := range []*FileServer{server1, server2} {
+		s.Pex.Start(ctx)
+		go s.Start(ctx)
+		defer s.Stop()
+	}
+	// Nothing listens on these, so dialing them fails right away
+	server1.Pex.AddKnownPeer("127.0.0.1:1", "bootstrap")
+	server1.Pex.AddKnownPeer("127.0.0.1:2", "bootstrap")
+	time.Sleep(100 * time.Millisecond)
+
+	// A new connection gets the full list without waiting for the interval
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5956"))
+	known := func(addr string) bool {
+		for _, p := range server2.Pex.ExportPeerList() {
+			if p.Address == addr {
+				return true
+			}
+		}
+		return false
+	}
+	assert.Eventually(t, func() bool {
+		return known("127.0.0.1:1") && known("127.0.0.1:2")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Later exchanges only carry what changed
+	server1.Pex.peerLock.RLock()
+	since := MessagePexRequest{Epoch: server1.Pex.epoch, Since: server1.Pex.version}
+	server1.Pex.peerLock.RUnlock()
+	server1.Pex.RemoveKnownPeer("127.0.0.1:1")
+	server1.Pex.AddKnownPeer("127.0.0.1:3", "bootstrap")
+
+	delta := server1.Pex.response(since)
+	assert.False(t, delta.Full)
+	if assert.Len(t, delta.Added, 1) {
+		assert.Equal(t, "127.0.0.1:3", delta.Added[0].Address)
+	}
+	assert.Equal(t, []string{"127.0.0.1:1"}, delta.Removed)
+	assert.True(t, server1.Pex.response(MessagePexRequest{Epoch: "other", Since: since.Since}).Full)
+
+	server2.Pex.exchangePeerLists()
+	assert.Eventually(t, func() bool {
+		return known("127.0.0.1:3") && !known("127.0.0.1:1") && known("127.0.0.1:2")
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestE2EHybridLogicalClock(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_hlc_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_hlc_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5957", encKey)
+	server2 := makeTestServer(t, roots[1], ":6957", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5957"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1 && len(server2.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Replicas keep the stamp of the version they copy
+	assert.Nil(t, server1.Store(context.Background(), "doc.txt", bytes.NewReader([]byte("v1"))))
+	v1 := server1.KeyStamp("doc.txt")
+	assert.False(t, v1.IsZero())
+	assert.Eventually(t, func() bool {
+		return server2.KeyStamp("doc.txt") == v1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// A later store on the other node replaces the first version everywhere
+	assert.Nil(t, server2.Store(context.Background(), "doc.txt", bytes.NewReader([]byte("v2"))))
+	v2 := server2.KeyStamp("doc.txt")
+	assert.True(t, v1.Before(v2))
+	assert.Eventually(t, func() bool {
+		return server1.KeyStamp("doc.txt") == v2
+	}, 2*time.Second, 20*time.Millisecond)
+	reader, err := server1.Get(context.Background(), "doc.txt")
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(reader)
+	assert.Equal(t, "v2", string(content))
+	assert.False(t, server1.supersedes("doc.txt", v1))
+
+	// A deletion is later than the copy the peer still holds, so
+	// anti-entropy does not bring the file back
+	assert.Nil(t, server1.Delete("doc.txt"))
+	assert.Nil(t, server2.antiEntropyRound())
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, server1.store.Has(server1.ID, "doc.txt"))
+	assert.True(t, server2.store.Has(server2.ID, "doc.txt"))
+
+	// Audit entries are stamped after everything the node has seen
+	server1.Audit(AuditEntry{Action: "api", Pattern: "doc.txt"})
+	entries, err := server1.AuditLog(1)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.True(t, v2.Before(entries[0].Clock))
+	}
+}
+
+func TestClearStorageScopes(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_clear_storage")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5958", encKey)
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, name))
+		return err == nil
+	}
+	store := func() {
+		assert.Nil(t, server.Store(context.Background(), "notes.txt", bytes.NewReader([]byte("notes"))))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, "quota.json"), []byte("{}"), 0644))
+	}
+
+	_, err := loadOrCreateNodeID(filepath.Join(root, "node.id"))
+	assert.Nil(t, err)
+	store()
+	assert.True(t, exists("identity.key"))
+	assert.NotNil(t, server.ClearStorage(ClearFiles, true))
+	assert.True(t, server.store.Has(server.ID, "notes.txt"))
+
+	// Files and what describes them go, settings stay
+	assert.Nil(t, server.ClearStorage(ClearFiles, false))
+	assert.False(t, server.store.Has(server.ID, "notes.txt"))
+	assert.False(t, exists("stamps.json"))
+	assert.False(t, exists("metadata.json"))
+	assert.True(t, exists("quota.json"))
+	assert.True(t, exists("identity.key"))
+
+	// Everything goes but the keys, unless they are asked for
+	store()
+	assert.Nil(t, server.ClearStorage(ClearAll, false))
+	assert.False(t, exists("quota.json"))
+	assert.True(t, exists("identity.key"))
+	assert.True(t, exists("node.id"))
+	assert.Nil(t, server.ClearStorage(ClearAll, true))
+	assert.False(t, exists("identity.key"))
+	assert.False(t, exists("node.id"))
+}
+
+func TestE2ENetworkIsolation(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_netid_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_netid_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_netid_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	otherKey, _ := crypto.NewEncryptionKey()
+	var servers []*FileServer
+	for i, addr := range []string{":5959", ":6959", ":7959"} {
+		key := encKey
+		if i == 2 {
+			key = otherKey // an unrelated deployment
+		}
+		s := makeTestServer(t, roots[i], addr, key)
+		s.NetworkID = NetworkIDFromKey(key)
+		tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.NetworkHandshakeFunc(s.NetworkID),
+			Decoder:       p2p.DefaultDecoder{},
+		})
+		tr.OnPeer = s.OnPeer
+		tr.OnPeerClose = s.OnPeerClose
+		s.Transport = tr
+		servers = append(servers, s)
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, NetworkIDFromKey(encKey), servers[1].NetworkID)
+	assert.NotEqual(t, servers[0].NetworkID, servers[2].NetworkID)
+
+	assert.Nil(t, servers[1].Transport.Dial("127.0.0.1:5959"))
+	assert.Nil(t, servers[2].Transport.Dial("127.0.0.1:5959"))
+	assert.Eventually(t, func() bool {
+		return len(servers[0].PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// The node of the other network never gets past the handshake
+	time.Sleep(200 * time.Millisecond)
+	servers[0].PeerLock.Lock()
+	assert.Len(t, servers[0].Peers, 1)
+	servers[0].PeerLock.Unlock()
+	servers[2].PeerLock.Lock()
+	assert.Empty(t, servers[2].Peers)
+	servers[2].PeerLock.Unlock()
+}
+
+func TestE2EResumePendingPushes(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_resume_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_resume_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	// No ID is given, so the node keeps the one it generated across restarts
+	open := func() *FileServer {
+		s, err := NewFileServer(FileServerOpts{
+			StorageRoot:       roots[0],
+			PathTransformFunc: storage.CASPathTransformFunc,
+			EncKey:            encKey,
+		})
+		assert.Nil(t, err)
+		tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":5961",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		})
+		tr.OnPeer = s.OnPeer
+		tr.OnPeerClose = s.OnPeerClose
+		s.Transport = tr
+		return s
+	}
+
+	// The node goes down while a push is in flight
+	crashed := open()
+	assert.Nil(t, crashed.Store(context.Background(), "report.txt", bytes.NewReader([]byte("quarterly report"))))
+	crashed.addPendingPush("report.txt", 16)
+	assert.Equal(t, 1, crashed.PendingPushes())
+
+	server1 := open()
+	assert.Equal(t, crashed.ID, server1.ID)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, server1.PendingPushes())
+	snapshot := server1.Metrics.Snapshot()
+	assert.Equal(t, int64(1), snapshot.PendingReplicas)
+	assert.Equal(t, int64(1), snapshot.ReplicasResumed)
+
+	server2 := makeTestServer(t, roots[1], ":6961", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The push is resumed once a peer connects, and forgotten when it is done
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5961"))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "report.txt") && server1.PendingPushes() == 0
+	}, 3*time.Second, 20*time.Millisecond)
+	_, err := os.Stat(server1.pendingPath())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestE2EProtocolNegotiation(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_protocol_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_protocol_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5962", encKey)
+	server2 := makeTestServer(t, roots[1], ":6962", encKey)
+	server2.RelayAddr = ":7962"
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6962"))
+	assert.Eventually(t, func() bool {
+		paths := server1.PeerPaths()
+		return len(paths) == 1 && paths[0].Version == ProtocolVersion
+	}, 2*time.Second, 20*time.Millisecond)
+	addr := server1.PeerPaths()[0].Addr
+	assert.True(t, server1.PeerSupports(addr, CapRanges))
+	assert.True(t, server1.PeerSupports(addr, CapRelay))
+	assert.True(t, server1.PeerSupports(addr, CapProtobuf))
+	assert.True(t, server1.PeerSupports(addr, CapMux))
+	assert.True(t, server1.PeerSupports(addr, CapHeartbeat))
+
+	server1.PeerLock.Lock()
+	peer := server1.conns[addr]
+	server1.PeerLock.Unlock()
+	assert.Nil(t, server1.sendMessage(peer, &Message{Payload: MessagePexRequest{}}))
+
+	// A peer that does not decode a message type is not sent it
+	server1.protoMu.Lock()
+	delete(server1.protocols[addr].messages, messageName(MessagePolicy{}))
+	server1.protoMu.Unlock()
+	assert.ErrorIs(t, server1.sendMessage(peer, &Message{Payload: MessagePolicy{}}), ErrUnsupported)
+	assert.Nil(t, server1.broadcast(context.Background(), &Message{Payload: MessagePolicy{}}))
+
+	// Nodes that predate negotiation are sent everything and serve ranges
+	server1.recordProtocol(addr, MessageHello{})
+	assert.Nil(t, server1.sendMessage(peer, &Message{Payload: MessagePolicy{}}))
+	assert.True(t, server1.PeerSupports(addr, CapRanges))
+	assert.False(t, server1.PeerSupports(addr, CapRelay))
+	assert.False(t, server1.PeerSupports(addr, CapProtobuf))
+	assert.False(t, server1.PeerSupports(addr, CapMux))
+	assert.Equal(t, 1, server1.PeerPaths()[0].Version)
+}
+
+func TestE2EGobFallback(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_gob_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_gob_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5964", encKey)
+	server2 := makeTestServer(t, roots[1], ":6964", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6964"))
+	servers := []*FileServer{server1, server2}
+	assert.Eventually(t, func() bool {
+		for _, s := range servers {
+			paths := s.PeerPaths()
+			if len(paths) != 1 || paths[0].Version != ProtocolVersion {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Both nodes take the other for one of the previous release, which
+	// decodes gob only
+	for _, s := range servers {
+		addr := s.PeerPaths()[0].Addr
+		s.recordProtocol(addr, MessageHello{Version: 2, Caps: []string{CapRanges}})
+		assert.False(t, s.PeerSupports(addr, CapProtobuf))
+	}
+
+	// Offers, range requests and streams all still arrive
+	data := []byte("sent the old way")
+	assert.Nil(t, server1.Store(context.Background(), "legacy.txt", bytes.NewReader(data)))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "legacy.txt")
+	}, 3*time.Second, 20*time.Millisecond)
+	assert.Nil(t, server1.Delete("legacy.txt"))
+	r, err := server1.Get(context.Background(), "legacy.txt")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestE2ECompression(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_compress_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_compress_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5989", encKey)
+	server1.store.Compression = storage.CompressionZstd
+	server2 := makeTestServer(t, roots[1], ":6989", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5989"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1 && len(server2.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	text := strings.Repeat("GET /index.html 200 1520 bytes in 3ms\n", 2000)
+	assert.Nil(t, server1.Store(context.Background(), "access.log", strings.NewReader(text)))
+	size, err := server1.store.Size(server1.ID, "access.log")
+	assert.Nil(t, err)
+	assert.Less(t, size, int64(len(text)/10))
+
+	// A node that does not compress reads the file from one that does. A
+	// range of it is read from the whole file, which is fetched.
+	part, err := server2.ReadRange(context.Background(), "access.log", 38*1000, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, "GET /index.html ", string(part))
+	r, err := server2.Get(context.Background(), "access.log")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, text, string(data))
+
+	f, err := server2.Open(context.Background(), "access.log")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(text)), f.Size())
+	buf := make([]byte, 16)
+	_, err = f.ReadAt(buf, 38*1000)
+	assert.Nil(t, err)
+	assert.Equal(t, "GET /index.html ", string(buf))
+	assert.Nil(t, f.Close())
+
+	// Content that looks compressed already is stored as it is
+	photo := make([]byte, 8192)
+	copy(photo, []byte{0xff, 0xd8, 0xff})
+	assert.Nil(t, server1.Store(context.Background(), "photo.jpg", bytes.NewReader(photo)))
+	size, err = server1.store.Size(server1.ID, "photo.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(photo)+crypto.Overhead), size)
+}
+
+func TestE2ECoalescedGets(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_coalesce_node1")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, ":5963", encKey)
+
+	// A fetch of the key is running, as if started by an earlier Get
+	cancelled := make(chan struct{})
+	running := &fetch{done: make(chan struct{}), source: "network", cancel: func() { close(cancelled) }}
+	server.fetchesMu.Lock()
+	server.fetches[crypto.HashKey("shared.txt")] = running
+	server.fetchesMu.Unlock()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	get := func(ctx context.Context, key string) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			r, err := server.Get(ctx, key)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			data, err := io.ReadAll(r)
+			ch <- result{data: data, err: err}
+		}()
+		return ch
+	}
+
+	quitter, quit := context.WithCancel(context.Background())
+	results := []chan result{get(quitter, "shared.txt")}
+	for range 4 {
+		results = append(results, get(context.Background(), "shared.txt"))
+	}
+	assert.Eventually(t, func() bool {
+		return server.Metrics.Snapshot().GetsCoalesced == 5
+	}, time.Second, 10*time.Millisecond)
+
+	// One caller giving up leaves the fetch running for the others
+	quit()
+	assert.ErrorIs(t, (<-results[0]).err, context.Canceled)
+	select {
+	case <-cancelled:
+		t.Fatal("fetch cancelled while Gets still wait for it")
+	default:
+	}
+
+	// Every remaining caller is served by the one fetch
+	assert.Nil(t, server.Store(context.Background(), "shared.txt", bytes.NewReader([]byte("one transfer"))))
+	close(running.done)
+	for _, ch := range results[1:] {
+		res := <-ch
+		assert.Nil(t, res.err)
+		assert.Equal(t, "one transfer", string(res.data))
+	}
+
+	// The fetch is cancelled once its last caller gives up
+	dropped := make(chan struct{})
+	abandoned := &fetch{done: make(chan struct{}), cancel: func() { close(dropped) }}
+	server.fetchesMu.Lock()
+	server.fetches[crypto.HashKey("abandoned.txt")] = abandoned
+	server.fetchesMu.Unlock()
+	quitter, quit = context.WithCancel(context.Background())
+	res := get(quitter, "abandoned.txt")
+	assert.Eventually(t, func() bool {
+		return server.Metrics.Snapshot().GetsCoalesced == 6
+	}, time.Second, 10*time.Millisecond)
+	quit()
+	assert.ErrorIs(t, (<-res).err, context.Canceled)
+	<-dropped
+	server.fetchesMu.Lock()
+	_, ok := server.fetches[crypto.HashKey("abandoned.txt")]
+	server.fetchesMu.Unlock()
+	assert.False(t, ok)
+}
+
+func TestE2EDowngradeProtection(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_downgrade_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_downgrade_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5965", encKey)
+	server2 := makeTestServer(t, roots[1], ":6965", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6965"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+	addr := server1.PeerPaths()[0].Addr
+	node := crypto.Fingerprint(server2.Identity.PublicKey)
+	server1.securityMu.Lock()
+	pin := server1.security[node]
+	server1.securityMu.Unlock()
+	assert.Equal(t, ProtocolVersion, pin.Version)
+	assert.True(t, pin.Protobuf)
+
+	// A hello rewritten to an older protocol closes the connection
+	err := server1.handleMessageHello(addr, MessageHello{PublicKey: server2.Identity.PublicKey, Version: 2, Caps: []string{CapRanges}})
+	assert.ErrorIs(t, err, ErrDowngrade)
+	assert.Equal(t, int64(1), server1.Metrics.Snapshot().Downgrades)
+	alerted := false
+	for _, e := range server1.Events.Recent(0) {
+		alerted = alerted || (e.Type == events.PeerDowngrade && e.Peer == addr)
+	}
+	assert.True(t, alerted)
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// The pin survives a restart, and is lowered only when allowed
+	restarted := makeTestServer(t, roots[0], ":5966", encKey)
+	old := MessageHello{PublicKey: server2.Identity.PublicKey}
+	assert.ErrorIs(t, restarted.checkDowngrade(addr, old), ErrDowngrade)
+	restarted.AllowDowngrade = true
+	assert.Nil(t, restarted.checkDowngrade(addr, old))
+	restarted.AllowDowngrade = false
+	assert.Nil(t, restarted.checkDowngrade(addr, old))
+	assert.Equal(t, 1, restarted.security[node].Version)
+}
+
+func TestE2EGCRepairsMissingFile(t *testing.T) {
+	root1 := filepath.Join(os.TempDir(), "pv_e2e_repair_node1")
+	root2 := filepath.Join(os.TempDir(), "pv_e2e_repair_node2")
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	defer os.RemoveAll(root1)
+	defer os.RemoveAll(root2)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, root1, ":5974", encKey)
+	server2 := makeTestServer(t, root2, ":6974", encKey)
+	go server1.Start(context.Background())
+	go server2.Start(context.Background())
+	defer server1.Stop()
+	defer server2.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5974"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	assert.Nil(t, server1.Store(context.Background(), "photo.jpg", bytes.NewReader([]byte("holiday photo"))))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "photo.jpg")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Lost from disk without being deleted
+	assert.Nil(t, server1.store.Delete(server1.ID, "photo.jpg"))
+
+	stats, err := server1.GC.RunNow(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.MissingFiles)
+	assert.Equal(t, 1, stats.RepairedFiles)
+	assert.True(t, server1.store.Has(server1.ID, "photo.jpg"))
+	assert.Equal(t, int64(1), server1.Metrics.Snapshot().FilesRepaired)
+
+	r, err := server1.Get(context.Background(), "photo.jpg")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "holiday photo", string(data))
+}
+
+func TestE2EBlockedPeers(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_block_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_block_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], "127.0.0.1:5981", encKey)
+	server2 := makeTestServer(t, roots[1], "127.0.0.1:6981", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	hasPeer := func(s *FileServer, addr string) bool {
+		s.PeerLock.Lock()
+		defer s.PeerLock.Unlock()
+		_, ok := s.conns[addr]
+		return ok
+	}
+	connected := func(s *FileServer) int {
+		s.PeerLock.Lock()
+		defer s.PeerLock.Unlock()
+		return len(s.Peers)
+	}
+
+	// A blocked node is dropped once its hello says which node it is, and
+	// the address it advertises is kept out of peer exchange
+	node1 := server1.Identity.Fingerprint()
+	server1.SetAdvertiseAddr("127.0.0.1:5981")
+	assert.Nil(t, server2.BlockPeer(strings.ToUpper(node1)))
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6981"))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, connected(server2))
+	assert.Equal(t, []string{node1}, server2.PeerLists().Block)
+	assert.True(t, server2.isBlocked("127.0.0.1:5981"))
+
+	// Blocked hosts are neither accepted nor dialed
+	assert.Nil(t, server2.UnblockPeer(node1))
+	assert.False(t, server2.isBlocked("127.0.0.1:5981"))
+	assert.Nil(t, server1.BlockPeer("127.0.0.1:6981"))
+	assert.NotNil(t, server1.dial("127.0.0.1:6981"))
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5981"))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, connected(server1))
+
+	// The lists changed at runtime survive a restart; configured entries
+	// cannot be removed at runtime
+	assert.Nil(t, server1.UnblockPeer("127.0.0.1"))
+	assert.Nil(t, server1.AllowPeer(node1))
+	reopened, err := NewFileServer(FileServerOpts{
+		StorageRoot:       roots[0],
+		PathTransformFunc: storage.CASPathTransformFunc,
+		EncKey:            encKey,
+		BlockPeers:        []string{"10.0.0.1:3000", ""},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, PeerLists{Allow: []string{node1}, Block: []string{"10.0.0.1"}}, reopened.PeerLists())
+	assert.NotNil(t, reopened.UnblockPeer("10.0.0.1"))
+
+	// With an allowlist, other hosts are refused once they say hello
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6981"))
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, hasPeer(server1, "127.0.0.1:6981"))
+	assert.Nil(t, server1.DisallowPeer(node1))
+	assert.Nil(t, server1.Transport.Dial("127.0.0.1:6981"))
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, hasPeer(server1, "127.0.0.1:6981"))
+}
+
+func TestE2EMaxPeers(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_maxpeers_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_maxpeers_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_maxpeers_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	full := makeTestServer(t, roots[0], "127.0.0.1:5982", encKey)
+	full.MaxPeers = 1
+	first := makeTestServer(t, roots[1], "127.0.0.1:6982", encKey)
+	first.SetAdvertiseAddr("127.0.0.1:6982")
+	late := makeTestServer(t, roots[2], "127.0.0.1:7982", encKey)
+	for _, s := range []*FileServer{full, first, late} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	connected := func(s *FileServer) int {
+		s.PeerLock.Lock()
+		defer s.PeerLock.Unlock()
+		return len(s.Peers)
+	}
+
+	assert.Nil(t, first.Transport.Dial("127.0.0.1:5982"))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, connected(full))
+
+	// Beyond the limit the connection is declined with other peers to try
+	assert.Nil(t, late.Transport.Dial("127.0.0.1:5982"))
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 1, connected(full))
+	assert.Equal(t, 0, connected(late))
+	assert.Equal(t, int64(1), full.Metrics.Snapshot().PeersDeclined)
+	assert.True(t, late.declinedRecently("127.0.0.1:5982"))
+	assert.ErrorContains(t, late.dial("127.0.0.1:5982"), "declined")
+	assert.Equal(t, []PeerInfo{{Address: "127.0.0.1:6982", Source: "pex"}}, hintAddrs(full.peerHints("")))
+
+	// A full node does not dial either
+	assert.ErrorContains(t, full.dial("127.0.0.1:7982"), "peers full")
+}
+
+// hintAddrs keeps the address and source of peer hints, for comparison
+func hintAddrs(hints []PeerInfo) []PeerInfo {
+	for i := range hints {
+		hints[i].LastSeen = time.Time{}
+	}
+	return hints
+}
+
+func TestE2EWriteConcern(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_concern_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_concern_node2"),
+		filepath.Join(os.TempDir(), "pv_e2e_concern_node3"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], "127.0.0.1:5983", encKey)
+	server1.WriteConcern = 2
+	server2 := makeTestServer(t, roots[1], "127.0.0.1:6983", encKey)
+	server3 := makeTestServer(t, roots[2], "127.0.0.1:7983", encKey)
+	for _, s := range []*FileServer{server1, server2, server3} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5983"))
+	assert.Nil(t, server3.Transport.Dial("127.0.0.1:5983"))
+	time.Sleep(200 * time.Millisecond)
+
+	// Store returns once both peers acknowledged their replica
+	assert.Nil(t, server1.Store(context.Background(), "ledger.db", bytes.NewReader([]byte("balanced books"))))
+	receipt, ok := server1.Receipt("ledger.db")
+	assert.True(t, ok)
+	assert.Len(t, receipt.Confirmations, 2)
+
+	// More acknowledgments than replica peers fail right away, keeping the
+	// file locally with its replicas pending
+	server1.WriteConcern = 3
+	err := server1.Store(context.Background(), "audit.log", bytes.NewReader([]byte("entries")))
+	assert.ErrorIs(t, err, ErrWriteConcern)
+	assert.True(t, server1.store.Has(server1.ID, "audit.log"))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, server1.PendingPushes())
+}
+
+func TestE2EOfflineQueue(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_offline_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_offline_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	laptop := makeTestServer(t, roots[0], "127.0.0.1:5984", encKey)
+	laptop.OfflineQueue = true
+	desktop := makeTestServer(t, roots[1], "127.0.0.1:6984", encKey)
+	for _, s := range []*FileServer{laptop, desktop} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	connected := func(s *FileServer) int {
+		s.PeerLock.Lock()
+		defer s.PeerLock.Unlock()
+		return len(s.Peers)
+	}
+
+	// A file stored without peers is queued and replicated once one connects
+	assert.Nil(t, laptop.Store(context.Background(), "notes.txt", bytes.NewReader([]byte("written on a train"))))
+	assert.Equal(t, 1, laptop.PendingPushes())
+	assert.Nil(t, desktop.Transport.Dial("127.0.0.1:5984"))
+	assert.Eventually(t, func() bool {
+		return desktop.store.Has(desktop.ID, "notes.txt") && laptop.PendingPushes() == 0
+	}, 3*time.Second, 20*time.Millisecond)
+
+	// A delete made offline is delivered when the peer is back
+	laptop.disconnectHost("127.0.0.1:6984", true)
+	assert.Eventually(t, func() bool { return connected(laptop) == 0 && connected(desktop) == 0 }, 3*time.Second, 20*time.Millisecond)
+	stored := laptop.KeyStamp("notes.txt")
+	assert.Nil(t, laptop.Delete("notes.txt"))
+	assert.Equal(t, 1, laptop.PendingDeletes())
+	_, err := os.Stat(laptop.pendingDeletesPath())
+	assert.Nil(t, err)
+
+	assert.Nil(t, desktop.Transport.Dial("127.0.0.1:5984"))
+	assert.Eventually(t, func() bool { return !desktop.store.Has(desktop.ID, "notes.txt") }, 3*time.Second, 20*time.Millisecond)
+
+	// The desktop refuses the deleted version from now on
+	assert.False(t, desktop.supersedes("notes.txt", stored))
+}
+
+func TestE2ERejectCorruptedReplica(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_nack_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_nack_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	sender := makeTestServer(t, roots[0], "127.0.0.1:5985", encKey)
+	sender.OfflineQueue = true
+	receiver := makeTestServer(t, roots[1], "127.0.0.1:6985", encKey)
+	for _, s := range []*FileServer{sender, receiver} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The sender's copy rots on disk before it is replicated
+	assert.Nil(t, sender.Store(context.Background(), "scan.pdf", bytes.NewReader([]byte("scanned pages"))))
+	hash := storage.CASPathTransformFunc("scan.pdf").Filename
+	filepath.Walk(roots[0], func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == hash {
+			data, _ := os.ReadFile(path)
+			data[len(data)-1] ^= 1
+			assert.Nil(t, os.WriteFile(path, data, 0644))
+		}
+		return nil
+	})
+
+	// The receiver rejects every copy, and the sender gives up after its retries
+	assert.Nil(t, receiver.Transport.Dial("127.0.0.1:5985"))
+	assert.Eventually(t, func() bool {
+		return receiver.Metrics.Snapshot().ReplicasBad == maxReplicaRetries+1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.False(t, receiver.store.Has(receiver.ID, "scan.pdf"))
+	assert.Equal(t, int64(0), receiver.store.PartialSize(receiver.ID, "scan.pdf"))
+	assert.Less(t, receiver.peerScore("127.0.0.1:5985"), float64(neutralScore))
+}
+
+func TestE2EFramedReadRange(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_e2e_framed_node1"),
+		filepath.Join(os.TempDir(), "pv_e2e_framed_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], "127.0.0.1:5986", encKey)
+	server1.store.Cipher = crypto.ChaCha20Poly1305Frames
+	server2 := makeTestServer(t, roots[1], "127.0.0.1:6986", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5986"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+
+	content := make([]byte, 2*maxRangeRead+1000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	assert.Nil(t, server1.Store(context.Background(), "movie.mkv", bytes.NewReader(content)))
+	assert.Eventually(t, func() bool {
+		return server2.store.Has(server2.ID, "movie.mkv")
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Nil(t, server2.store.Delete(server2.ID, "movie.mkv"))
+
+	// Remote ranges arrive in whole frames and are cut to what was asked
+	data, err := server2.ReadRange(context.Background(), "movie.mkv", 1000, maxRangeRead+500)
+	assert.Nil(t, err)
+	assert.Equal(t, content[1000:maxRangeRead+1500], data)
+
+	// Frames that rot on disk fail range reads over them, not elsewhere
+	hash := storage.CASPathTransformFunc("movie.mkv").Filename
+	filepath.Walk(roots[0], func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == hash {
+			stored, _ := os.ReadFile(path)
+			stored[len(stored)-100] ^= 1
+			assert.Nil(t, os.WriteFile(path, stored, 0644))
+		}
+		return nil
+	})
+	_, err = server2.ReadRange(context.Background(), "movie.mkv", int64(len(content))-10, 10)
+	assert.NotNil(t, err)
+	data, err = server2.ReadRange(context.Background(), "movie.mkv", 0, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, content[:100], data)
+}
+
+func TestE2EVerifyPeer(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_verify_node1")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	networkID := NetworkIDFromKey(encKey)
+	server := makeTestServer(t, root, "127.0.0.1:5987", encKey)
+	server.Transport.(*p2p.TCPTransport).HandshakeFunc = p2p.NetworkHandshakeFunc(networkID)
+	go server.Start(context.Background())
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// On the same network the node introduces itself
+	node, err := VerifyPeer(ctx, "127.0.0.1:5987", networkID)
+	assert.Nil(t, err)
+	assert.Equal(t, networkID, node.NetworkID)
+	assert.Equal(t, server.ID, node.ID)
+	assert.Equal(t, []byte(server.Identity.PublicKey), node.PublicKey)
+
+	// From another network only its network is seen
+	node, err = VerifyPeer(ctx, "127.0.0.1:5987", "another-network")
+	assert.Nil(t, err)
+	assert.Equal(t, networkID, node.NetworkID)
+	assert.Nil(t, node.PublicKey)
+}
+
+func TestE2EReadyChecks(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_e2e_ready_node1")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server := makeTestServer(t, root, "127.0.0.1:5988", encKey)
+	failing := func(minPeers int) []string {
+		var failed []string
+		for name, check := range server.ReadyChecks(minPeers) {
+			if check() != nil {
+				failed = append(failed, name)
+			}
+		}
+		sort.Strings(failed)
+		return failed
+	}
+
+	// Not ready before listening and loading the quota
+	assert.Equal(t, []string{"quota", "transport"}, failing(0))
+
+	server.QuotaManager.SetMaxStorage(1 << 30)
+	go server.Start(context.Background())
+	defer server.Stop()
+	assert.Eventually(t, func() bool { return len(failing(0)) == 0 }, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{"peers"}, failing(1))
+
+	// Not ready once shutting down
+	assert.Nil(t, server.Shutdown(context.Background()))
+	assert.Equal(t, []string{"transport"}, failing(0))
 }
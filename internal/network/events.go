@@ -0,0 +1,50 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/metrics"
+)
+
+const (
+	// subscriptionBuffer is how many events a subscriber may fall behind
+	// before it misses some
+	subscriptionBuffer = 64
+	// defaultQuotaWarning is the percentage of the storage quota in use
+	// that publishes a warning if FileServerOpts.QuotaWarning is not set
+	defaultQuotaWarning = 90
+)
+
+// Subscribe returns a channel receiving the events of the given types from
+// now on, of every type if none are given, and a function that ends the
+// subscription and closes the channel. Events are dropped for a subscriber
+// that falls behind rather than holding up the server, so applications
+// building notifications, audit logs or user interfaces on it should read
+// promptly.
+func (s *FileServer) Subscribe(types ...events.Type) (<-chan events.Event, func()) {
+	return s.Events.Subscribe(subscriptionBuffer, types...)
+}
+
+// checkQuotaWarning publishes events.QuotaWarning when storage use crosses
+// QuotaWarning percent of the quota, and again only after it fell below
+func (s *FileServer) checkQuotaWarning(used, quota int64) {
+	threshold := s.QuotaWarning
+	if threshold == 0 {
+		threshold = defaultQuotaWarning
+	}
+	if threshold < 0 || quota <= 0 {
+		return
+	}
+	percent := float64(used) / float64(quota) * 100
+	if percent < threshold {
+		s.quotaWarned.Store(false)
+		return
+	}
+	if s.quotaWarned.Swap(true) {
+		return
+	}
+	detail := fmt.Sprintf("%.0f%% of %s used", percent, metrics.FormatBytes(quota))
+	s.Logger.Warn("storage nearly full", "used", metrics.FormatBytes(used), "quota", metrics.FormatBytes(quota), "percent", percent)
+	s.Events.Publish(events.Event{Type: events.QuotaWarning, Detail: detail})
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaWarningEvents(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_events_node")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	server := makeTestServer(t, root, ":0", make([]byte, 32))
+
+	ch, cancel := server.Subscribe(events.QuotaWarning)
+	defer cancel()
+	server.Events.Publish(events.Event{Type: events.FileStored, Key: "ignored"})
+
+	// Published once when usage crosses the threshold, not on every check
+	server.checkQuotaWarning(80, 100)
+	server.checkQuotaWarning(95, 100)
+	server.checkQuotaWarning(97, 100)
+	assert.Len(t, ch, 1)
+	e := <-ch
+	assert.Equal(t, events.QuotaWarning, e.Type)
+	assert.Contains(t, e.Detail, "95%")
+
+	// And again after usage fell below it
+	server.checkQuotaWarning(50, 100)
+	server.checkQuotaWarning(91, 100)
+	assert.Len(t, ch, 1)
+
+	// Not at all when turned off or without a quota
+	<-ch
+	server.checkQuotaWarning(0, 100)
+	server.QuotaWarning = -1
+	server.checkQuotaWarning(99, 100)
+	server.QuotaWarning = 0
+	server.checkQuotaWarning(99, 0)
+	assert.Empty(t, ch)
+}
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+)
+
+// MessageFileExpired tells peers that a file expired on the node that
+// stored it. Peers holding a replica written no later than Clock remove it.
+type MessageFileExpired struct {
+	ID    string        `wire:"1"`
+	Key   string        `wire:"2"`
+	Clock hlc.Timestamp `wire:"3"` // when the expired version was stored
+}
+
+// StoreWithExpiry stores a file like Store and has the garbage collectors
+// of this node and of the peers holding replicas remove it once expires
+// has passed. A zero expires stores the file for good, clearing an expiry
+// set on an earlier version.
+func (s *FileServer) StoreWithExpiry(ctx context.Context, key string, r io.Reader, expires time.Time) error {
+	return s.storeFile(ctx, key, r, expires)
+}
+
+// Expiry returns when a file this node stores expires, zero if it does not
+func (s *FileServer) Expiry(key string) time.Time {
+	return s.store.Expiry(s.ID, key)
+}
+
+// expireFile removes a file whose expiry has passed and tells the peers,
+// so their replicas go too. It is the garbage collector's Expire hook.
+func (s *FileServer) expireFile(key string) error {
+	if err := s.checkHold(key, "expire"); err != nil {
+		return err
+	}
+	if err := s.checkRetention(key); err != nil {
+		return err
+	}
+	clock := s.KeyStamp(key)
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	s.stampKey(key, s.Clock.Now(), true)
+	s.Events.Publish(events.Event{Type: events.FileDeleted, Key: key, Detail: "expired"})
+
+	msg := Message{Payload: MessageFileExpired{ID: s.ID, Key: key, Clock: clock}}
+	if err := s.broadcast(context.Background(), &msg); err != nil {
+		s.Logger.Warn("failed to announce expired file", "key", key, "err", err)
+	}
+	return nil
+}
+
+// handleMessageFileExpired removes the local replica of a file that expired
+// on a peer, unless this node stored a newer version since
+func (s *FileServer) handleMessageFileExpired(from string, msg MessageFileExpired) error {
+	if s.isGuestPeer(from) {
+		return nil
+	}
+	s.Clock.Update(msg.Clock)
+	if !s.store.Has(s.ID, msg.Key) || msg.Clock.Before(s.KeyStamp(msg.Key)) {
+		return nil
+	}
+	if err := s.checkHold(msg.Key, "expire"); err != nil {
+		return err
+	}
+	if err := s.store.Delete(s.ID, msg.Key); err != nil {
+		return fmt.Errorf("failed to remove expired replica of %s: %w", msg.Key, err)
+	}
+	s.stampKey(msg.Key, s.Clock.Now(), true)
+	s.Logger.Info("removed expired replica", "peer", from, "key", msg.Key)
+	s.Events.Publish(events.Event{Type: events.FileDeleted, Key: msg.Key, Peer: from, Detail: "expired"})
+	return nil
+}
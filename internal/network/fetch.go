@@ -0,0 +1,141 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// fetch is a network fetch of one key, shared by every Get of the key that
+// arrives while it runs
+type fetch struct {
+	done   chan struct{} // closed once the file is stored locally or the fetch failed
+	err    error
+	source string // where the file came from, "network" or "pinning service"
+
+	waiters int // Gets waiting for the fetch, guarded by fetchesMu
+	cancel  context.CancelFunc
+}
+
+// fetchShared fetches a file no local copy exists of, returning where it came
+// from. Concurrent calls for the same key share one fetch, so the file is
+// transferred once. A caller that gives up only stops waiting; the fetch is
+// cancelled once every caller has.
+func (s *FileServer) fetchShared(ctx context.Context, key string) (string, error) {
+	hashedKey := crypto.HashKey(key)
+
+	s.fetchesMu.Lock()
+	f, ok := s.fetches[hashedKey]
+	if ok {
+		f.waiters++
+		waiters := f.waiters
+		s.fetchesMu.Unlock()
+		s.Metrics.IncGetsCoalesced()
+		s.Logger.Debug("joining running fetch", "key", key, "waiters", waiters)
+	} else {
+		// The fetch outlives the caller that started it, as long as others wait
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &fetch{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		s.fetches[hashedKey] = f
+		s.Metrics.SetFetchesInFlight(len(s.fetches))
+		s.fetchesMu.Unlock()
+
+		go func() {
+			defer cancel()
+			f.source, f.err = s.fetchFromNetwork(fetchCtx, key)
+
+			s.fetchesMu.Lock()
+			if s.fetches[hashedKey] == f {
+				delete(s.fetches, hashedKey)
+			}
+			s.Metrics.SetFetchesInFlight(len(s.fetches))
+			s.fetchesMu.Unlock()
+			close(f.done)
+		}()
+	}
+
+	select {
+	case <-f.done:
+		return f.source, f.err
+	case <-ctx.Done():
+		s.fetchesMu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody waits anymore. The fetch is dropped right away so a new
+			// Get starts afresh instead of joining one being cancelled.
+			f.cancel()
+			if s.fetches[hashedKey] == f {
+				delete(s.fetches, hashedKey)
+			}
+			s.Metrics.SetFetchesInFlight(len(s.fetches))
+		}
+		s.fetchesMu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// fetchFromNetwork downloads a file from the peers holding it, falling back
+// to the pinning service when none does
+func (s *FileServer) fetchFromNetwork(ctx context.Context, key string) (string, error) {
+	s.Logger.Info("fetching file from network", "peer", s.Transport.Addr(), "key", key)
+
+	if len(s.broadcastPeers()) == 0 {
+		return s.fetchFromPinner(ctx, key, fmt.Errorf("file %s %w: %w", key, ErrNotFound, ErrNoPeers))
+	}
+
+	ch, err := s.registerFileWaiter(key)
+	if err != nil {
+		return "", err
+	}
+
+	// Fetch byte ranges in parallel from every peer that holds the file
+	d := s.startDownload(ctx, key)
+
+	// Wait until the file is complete. The download fails only once no range
+	// has arrived for FetchTimeout, so large transfers are not cut short.
+	ticker := time.NewTicker(s.FetchTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch:
+			// File was successfully received and written to disk
+			return "network", nil
+		case <-ctx.Done():
+			s.abortDownload(d)
+			return "", ctx.Err()
+		case <-d.noHolders:
+			// Every peer answered, there is no point waiting for the timeout
+			s.abortDownload(d)
+			return s.fetchFromPinner(ctx, key, d.notFound())
+		case <-ticker.C:
+			if d.idle() >= s.FetchTimeout {
+				s.abortDownload(d)
+				return s.fetchFromPinner(ctx, key, fmt.Errorf("file %s %w (timeout)", key, ErrNotFound))
+			}
+			reqs, stalled := d.reapStalled(s.FetchTimeout)
+			for _, peer := range stalled {
+				s.recordTransfer(peer, ErrPeerUnreachable)
+			}
+			s.requestRanges(d, reqs)
+			s.recordRanges(d, false)
+		}
+	}
+}
+
+// fetchFromPinner falls back to the pinning service for a file no peer holds,
+// returning notFound if there is none or it does not have the file either
+func (s *FileServer) fetchFromPinner(ctx context.Context, key string, notFound error) (string, error) {
+	if s.Pinner == nil {
+		return "", notFound
+	}
+	if err := s.fetchPinned(ctx, key); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return "", notFound
+		}
+		return "", err
+	}
+	return "pinning service", nil
+}
@@ -0,0 +1,372 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+)
+
+// ErrGuestExpired is returned for guest tokens past their expiry
+var ErrGuestExpired = errors.New("guest token expired")
+
+// guestProofWindow is how far the time a guest signed its hello may be
+// from the member's clock
+const guestProofWindow = 5 * time.Minute
+
+// GuestGrant is a time-limited invitation for one node to join the network
+// read-only. It does not carry the network key: members re-encrypt the
+// files they serve the guest with Key, which they derive from the network
+// key and the grant, and refuse the guest's writes and expired grants.
+// It is signed by the member that issued it, which members only accept if
+// they trust its key (FileServerOpts.GuestIssuers).
+type GuestGrant struct {
+	NetworkID string    `json:"network_id"`
+	Guest     string    `json:"guest"` // identity fingerprint of the guest node
+	Key       []byte    `json:"key"`   // data key of the files served to the guest
+	Expires   time.Time `json:"expires"`
+	Issuer    []byte    `json:"issuer"`
+	Signature []byte    `json:"signature"`
+}
+
+// signingPayload is the message the grant signature covers. Key is left
+// out: members derive it from the network key instead of trusting it.
+func (g *GuestGrant) signingPayload() []byte {
+	return []byte(fmt.Sprintf("peervault-guest-v2|%s|%s|%s",
+		g.NetworkID, g.Guest, g.Expires.UTC().Format(time.RFC3339Nano)))
+}
+
+// dataKey derives the key files are re-encrypted with for the guest
+func (g *GuestGrant) dataKey(networkKey []byte) []byte {
+	return crypto.DeriveKey(networkKey, "guest|"+string(g.signingPayload()))
+}
+
+// IssueGuestToken creates a token that lets the node with the identity
+// fingerprint guest join the network networkID read-only until ttl passes
+func IssueGuestToken(identity *crypto.Identity, networkKey []byte, networkID string, guest string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("guest access duration must be positive")
+	}
+	if guest == "" {
+		return "", errors.New("guest identity fingerprint is required")
+	}
+
+	grant := GuestGrant{
+		NetworkID: networkID,
+		Guest:     guest,
+		Expires:   time.Now().Add(ttl).UTC(),
+		Issuer:    identity.PublicKey,
+	}
+	grant.Key = grant.dataKey(networkKey)
+	grant.Signature = identity.Sign(grant.signingPayload())
+
+	data, err := json.Marshal(&grant)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ParseGuestToken decodes a guest token and checks its signature and
+// expiry. An expired grant is returned along with ErrGuestExpired.
+func ParseGuestToken(token string) (*GuestGrant, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed guest token: %w", err)
+	}
+
+	var grant GuestGrant
+	if err := json.Unmarshal(data, &grant); err != nil {
+		return nil, fmt.Errorf("malformed guest token: %w", err)
+	}
+	if !crypto.VerifySignature(grant.Issuer, grant.signingPayload(), grant.Signature) {
+		return nil, errors.New("guest token has an invalid signature")
+	}
+	if !time.Now().Before(grant.Expires) {
+		return &grant, fmt.Errorf("%w at %s", ErrGuestExpired, grant.Expires.Format(time.RFC3339))
+	}
+	return &grant, nil
+}
+
+// helloToken is a guest token without its data key, as it is sent to
+// members: they derive the key themselves, and connections may be read
+func helloToken(token string) string {
+	grant, _ := ParseGuestToken(token)
+	if grant == nil {
+		return token
+	}
+	grant.Key = nil
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return token
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// guestProofPayload is what a guest signs in its hello to show it holds
+// the identity its token was issued for
+func guestProofPayload(token string, sentAt time.Time) []byte {
+	return []byte("peervault-guest-hello|" + token + "|" + sentAt.UTC().Format(time.RFC3339Nano))
+}
+
+// IsGuest reports whether this node joined the network with a guest token
+func (s *FileServer) IsGuest() bool {
+	return !s.guestUntil.IsZero()
+}
+
+// GuestUntil returns when the guest access of this node ends
+func (s *FileServer) GuestUntil() time.Time {
+	return s.guestUntil
+}
+
+// IssueGuestToken creates a token for the node with the identity
+// fingerprint guest, see the IssueGuestToken function
+func (s *FileServer) IssueGuestToken(guest string, ttl time.Duration) (string, error) {
+	if s.IsGuest() {
+		return "", errors.New("guests cannot invite other guests")
+	}
+	return IssueGuestToken(s.Identity, s.EncKey, s.networkID(), guest, ttl)
+}
+
+// networkID is the network this node belongs to, derived from the network
+// key unless configured
+func (s *FileServer) networkID() string {
+	if s.NetworkID != "" {
+		return s.NetworkID
+	}
+	return NetworkIDFromKey(s.EncKey)
+}
+
+// isGuestIssuer reports whether guest tokens signed by publicKey are honored
+func (s *FileServer) isGuestIssuer(publicKey []byte) bool {
+	if len(publicKey) == 0 {
+		return false
+	}
+	node := crypto.Fingerprint(publicKey)
+	return node == s.Identity.Fingerprint() || slices.Contains(s.GuestIssuers, node)
+}
+
+// guestSession is a guest connected to this node
+type guestSession struct {
+	grant *GuestGrant
+
+	// The last file served to the guest, re-encrypted for it, so a file
+	// fetched in ranges is only re-encrypted once
+	mu   sync.Mutex
+	last *guestCopy
+}
+
+// guestCopy is a stored file re-encrypted with a guest's data key, in an
+// unnamed temporary file. It is closed once it is replaced and unused.
+type guestCopy struct {
+	key     string
+	modTime time.Time
+	file    *os.File
+	size    int64
+	hash    string
+	refs    int
+	stale   bool
+}
+
+// release ends one use of the copy, closing it if it was replaced
+func (s *guestSession) release(c *guestCopy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.refs--
+	if c.stale && c.refs == 0 {
+		c.file.Close()
+	}
+}
+
+// drop closes the cached copy once it is no longer used
+func (s *guestSession) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil {
+		s.last.stale = true
+		if s.last.refs == 0 {
+			s.last.file.Close()
+		}
+		s.last = nil
+	}
+}
+
+// guestFor returns the session of a guest connection, or nil for members
+func (s *FileServer) guestFor(addr string) *guestSession {
+	s.guestsMu.Lock()
+	defer s.guestsMu.Unlock()
+	return s.guests[addr]
+}
+
+// isGuestPeer reports whether a connection belongs to a guest
+func (s *FileServer) isGuestPeer(addr string) bool {
+	return s.guestFor(addr) != nil
+}
+
+// admitGuest accepts the guest token presented in a hello. The grant must
+// be signed by a trusted issuer for this network, and the hello signed by
+// the identity the grant names. The connection is closed when the grant
+// expires.
+func (s *FileServer) admitGuest(from string, msg MessageHello) error {
+	grant, err := ParseGuestToken(msg.GuestToken)
+	switch {
+	case err != nil:
+	case grant.NetworkID != s.networkID():
+		err = errors.New("guest token was issued for another network")
+	case !s.isGuestIssuer(grant.Issuer):
+		err = fmt.Errorf("guest token was issued by untrusted key %s", crypto.Fingerprint(grant.Issuer))
+	case crypto.Fingerprint(msg.PublicKey) != grant.Guest:
+		err = errors.New("guest token was issued for another node")
+	case time.Since(msg.SentAt).Abs() > guestProofWindow ||
+		!crypto.VerifySignature(msg.PublicKey, guestProofPayload(msg.GuestToken, msg.SentAt), msg.GuestProof):
+		err = errors.New("guest did not prove its identity")
+	}
+	if err != nil {
+		s.disconnectHost(from, false)
+		return fmt.Errorf("rejected guest %s: %w", from, err)
+	}
+
+	s.guestsMu.Lock()
+	s.guests[from] = &guestSession{grant: grant}
+	s.guestsMu.Unlock()
+
+	s.Logger.Info("guest joined", "peer", from, "guest", grant.Guest, "until", grant.Expires.Format(time.RFC3339))
+	time.AfterFunc(time.Until(grant.Expires), func() {
+		if s.isGuestPeer(from) {
+			s.Logger.Info("guest access expired", "peer", from)
+			s.disconnectHost(from, false)
+			s.forgetGuest(from)
+		}
+	})
+	return nil
+}
+
+// forgetGuest drops a closed guest connection
+func (s *FileServer) forgetGuest(addr string) {
+	s.guestsMu.Lock()
+	guest := s.guests[addr]
+	delete(s.guests, addr)
+	s.guestsMu.Unlock()
+	if guest != nil {
+		guest.drop()
+	}
+}
+
+// guestCopyOf returns key re-encrypted for a guest. The IV is derived from
+// the content, so every member holding the file produces the same bytes,
+// and the copy keeps the stored file's suite and so its size: a guest can
+// fetch ranges of it from several members. The caller releases the copy.
+func (s *FileServer) guestCopyOf(guest *guestSession, key string) (*guestCopy, error) {
+	modTime, err := s.store.ModTime(s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	guest.mu.Lock()
+	defer guest.mu.Unlock()
+	if c := guest.last; c != nil && c.key == key && c.modTime.Equal(modTime) {
+		c.refs++
+		return c, nil
+	}
+
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open data key: %w", err)
+	}
+	header, err := s.readStored(key, 0, crypto.Overhead)
+	if err != nil {
+		return nil, err
+	}
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp("", "peervault-guest-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays readable through f until it is closed
+	os.Remove(f.Name())
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := crypto.CopyDecrypt(encKey, r, pw)
+		pw.CloseWithError(err)
+	}()
+	size, err := crypto.SuiteOf(header).CopyEncryptConvergent(guest.grant.dataKey(s.EncKey), pr, f)
+	pr.Close()
+	h := sha256.New()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(h, f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := &guestCopy{key: key, modTime: modTime, file: f, size: size, hash: hex.EncodeToString(h.Sum(nil)), refs: 1}
+	if guest.last != nil {
+		guest.last.stale = true
+		if guest.last.refs == 0 {
+			guest.last.file.Close()
+		}
+	}
+	guest.last = c
+	return c, nil
+}
+
+// guestRange returns length bytes at offset of key re-encrypted for a
+// guest, and the hash of the whole copy. Closing the reader releases it.
+func (s *FileServer) guestRange(guest *guestSession, key string, offset int64, length int64) (io.ReadCloser, string, error) {
+	c, err := s.guestCopyOf(guest, key)
+	if err != nil {
+		return nil, "", err
+	}
+	r := io.NewSectionReader(c.file, offset, max(min(length, c.size-offset), 0))
+	return guestRangeReader{Reader: r, release: func() { guest.release(c) }}, c.hash, nil
+}
+
+// guestRangeReader releases its guest copy when closed
+type guestRangeReader struct {
+	io.Reader
+	release func()
+}
+
+func (r guestRangeReader) Close() error {
+	r.release()
+	return nil
+}
+
+// expireGuestAccess ends the guest access of this node: every connection
+// is closed, everything pulled while visiting is purged and the server
+// stops. The node ID and keys are kept, like with ClearStorage.
+func (s *FileServer) expireGuestAccess() {
+	s.Logger.Warn("guest access expired, purging cached data", "until", s.guestUntil.Format(time.RFC3339))
+
+	s.PeerLock.Lock()
+	for _, peer := range s.conns {
+		peer.Close()
+	}
+	s.PeerLock.Unlock()
+
+	if err := s.ClearStorage(ClearAll, false); err != nil {
+		s.Logger.Error("failed to purge guest storage", "err", err)
+	}
+	s.Events.Publish(events.Event{Type: events.FileDeleted, Detail: "guest access expired, cache purged"})
+	s.Stop()
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuestToken(t *testing.T) {
+	identity, err := crypto.NewIdentity()
+	assert.Nil(t, err)
+	networkKey, _ := crypto.NewEncryptionKey()
+	networkID := NetworkIDFromKey(networkKey)
+
+	token, err := IssueGuestToken(identity, networkKey, networkID, "3f9a1c0b7e2d4a58", time.Hour)
+	assert.Nil(t, err)
+
+	grant, err := ParseGuestToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, networkID, grant.NetworkID)
+	assert.Equal(t, "3f9a1c0b7e2d4a58", grant.Guest)
+	assert.Equal(t, grant.dataKey(networkKey), grant.Key)
+	assert.NotEqual(t, networkKey, grant.Key)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), grant.Expires, time.Minute)
+
+	// Any change to the token breaks its signature
+	tampered := []byte(token)
+	tampered[len(tampered)/2] ^= 1
+	_, err = ParseGuestToken(string(tampered))
+	assert.NotNil(t, err)
+
+	_, err = IssueGuestToken(identity, networkKey, networkID, "3f9a1c0b7e2d4a58", 0)
+	assert.NotNil(t, err)
+	_, err = IssueGuestToken(identity, networkKey, networkID, "", time.Hour)
+	assert.NotNil(t, err)
+
+	// The token sent to members leaves the data key out
+	sent, err := ParseGuestToken(helloToken(token))
+	assert.Nil(t, err)
+	assert.Nil(t, sent.Key)
+
+	expired, err := IssueGuestToken(identity, networkKey, networkID, "3f9a1c0b7e2d4a58", time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = ParseGuestToken(expired)
+	assert.ErrorIs(t, err, ErrGuestExpired)
+}
+
+func TestAdmitGuest(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_admit_guest")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	encKey, _ := crypto.NewEncryptionKey()
+	member := makeTestServer(t, root, ":5992", encKey)
+	guest, err := crypto.NewIdentity()
+	assert.Nil(t, err)
+	other, err := crypto.NewIdentity()
+	assert.Nil(t, err)
+
+	hello := func(id *crypto.Identity, token string) MessageHello {
+		now := time.Now()
+		token = helloToken(token)
+		return MessageHello{
+			PublicKey:  id.PublicKey,
+			SentAt:     now,
+			GuestToken: token,
+			GuestProof: id.Sign(guestProofPayload(token, now)),
+		}
+	}
+	issue := func(issuer *crypto.Identity, networkKey []byte, ttl time.Duration) string {
+		token, err := IssueGuestToken(issuer, networkKey, NetworkIDFromKey(networkKey), guest.Fingerprint(), ttl)
+		assert.Nil(t, err)
+		return token
+	}
+
+	token := issue(member.Identity, encKey, time.Hour)
+	assert.Nil(t, member.admitGuest("127.0.0.1:7001", hello(guest, token)))
+	assert.True(t, member.isGuestPeer("127.0.0.1:7001"))
+
+	// Another node cannot use the guest's token, even with a copy of it
+	assert.NotNil(t, member.admitGuest("127.0.0.1:7002", hello(other, token)))
+	stolen := hello(other, token)
+	stolen.PublicKey = guest.PublicKey
+	assert.NotNil(t, member.admitGuest("127.0.0.1:7002", stolen))
+	assert.False(t, member.isGuestPeer("127.0.0.1:7002"))
+
+	// A token signed by a key the member does not trust certifies nothing
+	untrusted := issue(other, encKey, time.Hour)
+	assert.NotNil(t, member.admitGuest("127.0.0.1:7003", hello(guest, untrusted)))
+	member.GuestIssuers = []string{other.Fingerprint()}
+	assert.Nil(t, member.admitGuest("127.0.0.1:7003", hello(guest, untrusted)))
+
+	// Nor does one for another network, or one that expired
+	otherKey, _ := crypto.NewEncryptionKey()
+	assert.NotNil(t, member.admitGuest("127.0.0.1:7004", hello(guest, issue(member.Identity, otherKey, time.Hour))))
+	expired := issue(member.Identity, encKey, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	assert.ErrorIs(t, member.admitGuest("127.0.0.1:7005", hello(guest, expired)), ErrGuestExpired)
+}
@@ -0,0 +1,254 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+)
+
+// ErrLegalHold is returned when removing a file under legal hold
+var ErrLegalHold = errors.New("file is under legal hold")
+
+// LegalHold keeps files from being removed until it is released. Pattern is
+// either a key, or a namespace ending in "/" that covers every key below it.
+// Holds block Delete, clearing the storage and removal by the garbage
+// collector, and are kept across restarts.
+type LegalHold struct {
+	Pattern string    `json:"pattern"`
+	By      string    `json:"by"`
+	Reason  string    `json:"reason,omitempty"`
+	Placed  time.Time `json:"placed"`
+}
+
+// covers reports whether the hold applies to key
+func (h LegalHold) covers(key string) bool {
+	if strings.HasSuffix(h.Pattern, "/") {
+		return strings.HasPrefix(key, h.Pattern)
+	}
+	return key == h.Pattern
+}
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // e.g. "hold", "release", "blocked", or "api" for API calls
+	Pattern string    `json:"pattern"`
+	Key     string    `json:"key,omitempty"`
+	By      string    `json:"by,omitempty"`
+	Reason  string    `json:"reason,omitempty"` // why a hold was placed, or the blocked operation
+
+	// Orders entries across nodes whose wall clocks disagree; set by the log
+	Clock hlc.Timestamp `json:"hlc,omitzero"`
+}
+
+// PlaceHold puts a key or namespace under legal hold on behalf of by
+func (s *FileServer) PlaceHold(pattern, by, reason string) error {
+	if s.IsGuest() {
+		return fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	if pattern == "" || pattern == "/" {
+		return fmt.Errorf("hold needs a key or namespace")
+	}
+
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	if _, ok := s.holds[pattern]; ok {
+		return fmt.Errorf("%s is already under legal hold", pattern)
+	}
+	hold := LegalHold{Pattern: pattern, By: by, Reason: reason, Placed: time.Now().UTC()}
+	s.holds[pattern] = hold
+	if err := s.saveHolds(); err != nil {
+		delete(s.holds, pattern)
+		return fmt.Errorf("failed to persist legal hold: %w", err)
+	}
+
+	s.audit(AuditEntry{Time: hold.Placed, Action: "hold", Pattern: pattern, By: by, Reason: reason})
+	s.Events.Publish(events.Event{Type: events.HoldPlaced, Key: pattern, Detail: "by " + by})
+	return nil
+}
+
+// ReleaseHold lifts the legal hold on a key or namespace on behalf of by
+func (s *FileServer) ReleaseHold(pattern, by string) error {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	hold, ok := s.holds[pattern]
+	if !ok {
+		return fmt.Errorf("%s is not under legal hold", pattern)
+	}
+	delete(s.holds, pattern)
+	if err := s.saveHolds(); err != nil {
+		s.holds[pattern] = hold
+		return fmt.Errorf("failed to persist legal hold: %w", err)
+	}
+
+	s.audit(AuditEntry{Time: time.Now().UTC(), Action: "release", Pattern: pattern, By: by})
+	s.Events.Publish(events.Event{Type: events.HoldReleased, Key: pattern, Detail: "by " + by})
+	return nil
+}
+
+// Holds lists the legal holds in place, sorted by pattern
+func (s *FileServer) Holds() []LegalHold {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	holds := make([]LegalHold, 0, len(s.holds))
+	for _, h := range s.holds {
+		holds = append(holds, h)
+	}
+	sort.Slice(holds, func(i, j int) bool {
+		return holds[i].Pattern < holds[j].Pattern
+	})
+	return holds
+}
+
+// HoldOn returns the legal hold covering key, if any
+func (s *FileServer) HoldOn(key string) (LegalHold, bool) {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	if h, ok := s.holds[key]; ok {
+		return h, true
+	}
+	for _, h := range s.holds {
+		if h.covers(key) {
+			return h, true
+		}
+	}
+	return LegalHold{}, false
+}
+
+// checkHold refuses an operation removing a held key, recording the
+// attempt in the audit log
+func (s *FileServer) checkHold(key, op string) error {
+	hold, ok := s.HoldOn(key)
+	if !ok {
+		return nil
+	}
+	s.audit(AuditEntry{Time: time.Now().UTC(), Action: "blocked", Pattern: hold.Pattern, Key: key, Reason: op})
+	return fmt.Errorf("%s: %w (%s, placed by %s)", key, ErrLegalHold, hold.Pattern, hold.By)
+}
+
+// heldHash reports whether the stored file with the given hashed name is
+// under legal hold. The garbage collector keeps such files.
+func (s *FileServer) heldHash(hash string) bool {
+	key, ok := s.store.GetOriginalKey(hash)
+	if !ok {
+		return false
+	}
+	_, held := s.HoldOn(key)
+	return held
+}
+
+// holdsPath is where legal holds are persisted
+func (s *FileServer) holdsPath() string {
+	return filepath.Join(s.StorageRoot, "holds.json")
+}
+
+// auditPath is the append-only audit log
+func (s *FileServer) auditPath() string {
+	return filepath.Join(s.StorageRoot, "audit.log")
+}
+
+// loadHolds reads persisted legal holds, if any
+func (s *FileServer) loadHolds() error {
+	data, err := os.ReadFile(s.holdsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	return json.Unmarshal(data, &s.holds)
+}
+
+// saveHolds persists all legal holds. Callers hold holdsMu.
+func (s *FileServer) saveHolds() error {
+	data, err := json.MarshalIndent(s.holds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.holdsPath(), data, 0644)
+}
+
+// audit appends an entry to the audit log
+func (s *FileServer) audit(entry AuditEntry) {
+	if entry.Clock.IsZero() {
+		entry.Clock = s.Clock.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		s.Logger.Error("failed to encode audit entry", "err", err)
+		return
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		s.Logger.Error("failed to write audit log", "err", err)
+		return
+	}
+	f, err := os.OpenFile(s.auditPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		s.Logger.Error("failed to write audit log", "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		s.Logger.Error("failed to write audit log", "err", err)
+	}
+}
+
+// Audit records an action taken outside the file server, such as an API
+// call, in the audit log
+func (s *FileServer) Audit(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	s.audit(entry)
+}
+
+// AuditLog returns the last n entries of the audit log, oldest first, or
+// all of them if n is 0
+func (s *FileServer) AuditLog(n int) ([]AuditEntry, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	f, err := os.Open(s.auditPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt audit log: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,264 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// Hole punching timing: how long both nodes try to punch through before
+// falling back to the relay, and how long an introduction may take overall
+const (
+	punchTimeout      = 5 * time.Second
+	rendezvousTimeout = punchTimeout + relayCircuitTTL
+)
+
+// MessageRendezvous asks a peer to introduce this node to the node that
+// advertises Addr, because Addr cannot be dialed, e.g. it is behind a NAT
+type MessageRendezvous struct {
+	RequestID string `wire:"1"`
+	Addr      string `wire:"2"`
+}
+
+// MessagePunch is sent by the introducing peer to both nodes. Each punches
+// a hole to Addr, the other node's address as the introducer sees it, at
+// the same time; if that fails and RelayPort is set they both connect to
+// the introducer's relay on that port, naming the circuit RequestID.
+type MessagePunch struct {
+	RequestID string `wire:"1"`
+	Node      string `wire:"2"` // the other node
+	Addr      string `wire:"3"`
+	RelayPort int    `wire:"4"`
+}
+
+// holePuncher is implemented by transports that can dial from their
+// listening port, see p2p.TCPTransport.Punch
+type holePuncher interface {
+	Punch(ctx context.Context, addr string) error
+}
+
+// connAdopter is implemented by transports that can take over connections
+// opened elsewhere, see p2p.TCPTransport.AddConn
+type connAdopter interface {
+	AddConn(conn net.Conn, outbound bool)
+}
+
+// Rendezvous connects to the node advertising addr when dialing it failed.
+// Connected peers that are also connected to that node introduce the two,
+// which then punch a hole through their NATs or, failing that, connect
+// through the introducer's relay.
+func (s *FileServer) Rendezvous(ctx context.Context, addr string) error {
+	requestID, err := crypto.GenerateID()
+	if err != nil {
+		return err
+	}
+	msg := Message{Payload: MessageRendezvous{RequestID: requestID, Addr: addr}}
+	if err := s.broadcast(ctx, &msg); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rendezvousTimeout)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.nodeAt(addr) != "" {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("could not connect to %s through any peer: %w", addr, ctx.Err())
+		}
+	}
+}
+
+// nodeAt returns the connected node advertising addr, if any
+func (s *FileServer) nodeAt(addr string) string {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	for node, a := range s.nodeAddrs {
+		if a == addr && len(s.nodePaths[node]) > 0 {
+			return node
+		}
+	}
+	return ""
+}
+
+// connectedTo reports whether there is a connection to node
+func (s *FileServer) connectedTo(node string) bool {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	return len(s.nodePaths[node]) > 0
+}
+
+// handleMessageRendezvous introduces the sender to the node it asks for,
+// if this node is connected to it
+func (s *FileServer) handleMessageRendezvous(from string, msg MessageRendezvous) error {
+	s.pathsMu.Lock()
+	requester, ok := s.pathNode[from]
+	target := ""
+	for node, addr := range s.nodeAddrs {
+		if addr == msg.Addr && node != requester && len(s.nodePaths[node]) > 0 {
+			target = node
+			break
+		}
+	}
+	var targetPath *peerPath
+	if target != "" {
+		targetPath = s.bestPath(target, nil)
+	}
+	requesterAddr, targetAddr := s.nodeAddrs[requester], s.nodeAddrs[target]
+	s.pathsMu.Unlock()
+	if !ok || targetPath == nil {
+		return nil // not connected to either of them
+	}
+	requesterPeer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	relayPort := 0
+	if s.relay != nil {
+		s.relay.expect(msg.RequestID)
+		relayPort = s.relay.port()
+	}
+	s.Logger.Info("introducing peers", "node", requester, "target", target, "relay", relayPort != 0)
+
+	toRequester := Message{Payload: MessagePunch{
+		RequestID: msg.RequestID,
+		Node:      target,
+		Addr:      observedAddr(targetPath.addr, targetAddr),
+		RelayPort: relayPort,
+	}}
+	toTarget := Message{Payload: MessagePunch{
+		RequestID: msg.RequestID,
+		Node:      requester,
+		Addr:      observedAddr(from, requesterAddr),
+		RelayPort: relayPort,
+	}}
+	if err := s.sendMessage(targetPath.peer, &toTarget); err != nil {
+		return err
+	}
+	return s.sendMessage(requesterPeer, &toRequester)
+}
+
+// observedAddr is where a node can be reached from outside its NAT: the
+// public IP its connection to this node comes from, with the port it
+// listens on. Without an advertised port the connection's own port is the
+// best guess.
+func observedAddr(connAddr, advertised string) string {
+	host, port, err := net.SplitHostPort(connAddr)
+	if err != nil {
+		return connAddr
+	}
+	if _, p, err := net.SplitHostPort(advertised); err == nil {
+		port = p
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// handleMessagePunch starts connecting to the node an introducer put this
+// node in touch with
+func (s *FileServer) handleMessagePunch(from string, msg MessagePunch) error {
+	s.punchMu.Lock()
+	now := time.Now()
+	for id, at := range s.punches {
+		if now.Sub(at) > rendezvousTimeout {
+			delete(s.punches, id)
+		}
+	}
+	_, seen := s.punches[msg.RequestID]
+	s.punches[msg.RequestID] = now
+	s.punchMu.Unlock()
+	if seen {
+		return nil // several peers introduced the same pair
+	}
+
+	relayAddr := ""
+	if msg.RelayPort != 0 {
+		relayAddr = net.JoinHostPort(hostOf(from), strconv.Itoa(msg.RelayPort))
+	}
+	go s.punch(msg, relayAddr)
+	return nil
+}
+
+// punch connects to the node of an introduction by TCP simultaneous open,
+// and through the relay at relayAddr if that fails
+func (s *FileServer) punch(msg MessagePunch, relayAddr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+	defer cancel()
+
+	punched := make(chan error, 1)
+	if p, ok := s.Transport.(holePuncher); ok {
+		go func() { punched <- p.Punch(ctx, msg.Addr) }()
+	} else {
+		punched <- fmt.Errorf("transport cannot punch holes")
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case err := <-punched:
+			if err != nil {
+				s.Logger.Debug("hole punching failed", "node", msg.Node, "addr", msg.Addr, "err", err)
+				waiting = false
+			}
+			// Otherwise the connection is up, wait for the node's hello
+		case <-ticker.C:
+			if s.connectedTo(msg.Node) {
+				s.Logger.Info("punched through to node", "node", msg.Node, "addr", msg.Addr)
+				return
+			}
+		case <-ctx.Done():
+			waiting = false
+		}
+	}
+	if s.connectedTo(msg.Node) {
+		return
+	}
+
+	if relayAddr == "" {
+		s.Logger.Warn("could not connect to introduced node and no relay offered", "node", msg.Node, "addr", msg.Addr)
+		return
+	}
+	if err := s.connectRelayed(msg, relayAddr); err != nil {
+		s.Logger.Warn("failed to connect through relay", "node", msg.Node, "relay", relayAddr, "err", err)
+		return
+	}
+	s.Logger.Info("connected to node through relay", "node", msg.Node, "relay", relayAddr)
+}
+
+// connectRelayed joins the relay circuit of an introduction and hands the
+// connection to the transport once the other node is on the line
+func (s *FileServer) connectRelayed(msg MessagePunch, relayAddr string) error {
+	adopter, ok := s.Transport.(connAdopter)
+	if !ok {
+		return fmt.Errorf("transport cannot take relayed connections")
+	}
+	conn, err := net.DialTimeout("tcp", relayAddr, probeDialTimeout)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(msg.RequestID)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	ready := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(relayCircuitTTL))
+	if _, err := conn.Read(ready); err != nil || ready[0] != relayReady {
+		conn.Close()
+		return fmt.Errorf("the other node did not join the circuit: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	addr := relayAddr + "/relay/" + msg.RequestID[:16]
+	adopter.AddConn(&relayedConn{Conn: conn, addr: circuitAddr(addr)}, true)
+	return nil
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"context"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// A metadata-only node keeps an index of the files on the network, their
+// sizes and holders, without storing any of them. It announces itself in
+// its hello so peers never pick it for replicas, collects the catalog of
+// every peer when it connects and then every AntiEntropyInterval, and adds
+// files as storing nodes announce them. Listing the network on such a node
+// answers from the index, without asking peers.
+
+// startIndexing refreshes the index until the server stops
+func (s *FileServer) startIndexing(ctx context.Context) {
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peer := range s.broadcastPeers() {
+				s.requestCatalog(peer)
+			}
+		case <-s.quitch:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// announceFile tells connected metadata-only nodes about a file stored
+// here, so their index is current without waiting for a refresh
+func (s *FileServer) announceFile(key string, size int64) {
+	msg := Message{Payload: MessageStoreFile{ID: s.ID, Key: key, Size: size, Clock: s.KeyStamp(key)}}
+	for addr, peer := range s.broadcastPeers() {
+		if !s.isIndexPeer(addr) {
+			continue
+		}
+		if err := s.sendMessage(peer, &msg); err != nil {
+			s.Logger.Warn("failed to announce file to index", "peer", addr, "key", key, "err", err)
+		}
+	}
+}
+
+// requestCatalog asks a peer for its file list. The answer carries no
+// request ID and goes to the index.
+func (s *FileServer) requestCatalog(peer p2p.Peer) {
+	msg := Message{Payload: MessageListFiles{ID: s.ID}}
+	if err := s.sendMessage(peer, &msg); err != nil {
+		s.Logger.Warn("failed to request catalog", "peer", peer.RemoteAddr().String(), "err", err)
+	}
+}
+
+// indexCatalog replaces the indexed files of a peer
+func (s *FileServer) indexCatalog(from string, files []storage.FileInfo) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.catalogs[from] = files
+	s.indexUpdated = time.Now()
+	s.Logger.Debug("indexed peer catalog", "peer", from, "files", len(files))
+}
+
+// indexFile adds a file a peer offered to store here to its catalog
+func (s *FileServer) indexFile(from string, msg MessageStoreFile) {
+	hash := crypto.HashKey(msg.Key)
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	for _, f := range s.catalogs[from] {
+		if f.Hash == hash {
+			return
+		}
+	}
+	s.catalogs[from] = append(s.catalogs[from], storage.FileInfo{
+		Key:    msg.Key,
+		Hash:   hash,
+		Size:   msg.Size,
+		NodeID: msg.ID,
+	})
+	s.indexUpdated = time.Now()
+}
+
+// forgetCatalog drops the indexed files of a closed connection
+func (s *FileServer) forgetCatalog(addr string) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	delete(s.catalogs, addr)
+}
+
+// indexedFiles lists the indexed files together with the local ones
+func (s *FileServer) indexedFiles() ([]NetworkFile, error) {
+	local, err := s.store.List(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.indexMu.Lock()
+	catalogs := make(map[string][]storage.FileInfo, len(s.catalogs)+1)
+	for addr, files := range s.catalogs {
+		catalogs[addr] = files
+	}
+	s.indexMu.Unlock()
+	catalogs["local"] = local
+
+	return mergeCatalogs(catalogs), nil
+}
+
+// IndexStats reports how many files the index of a metadata-only node
+// holds, from how many peers, and when it last changed
+func (s *FileServer) IndexStats() (files int, peers int, updated time.Time) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	hashes := make(map[string]bool)
+	for _, list := range s.catalogs {
+		for _, f := range list {
+			hashes[f.Hash] = true
+		}
+	}
+	return len(hashes), len(s.catalogs), s.indexUpdated
+}
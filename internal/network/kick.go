@@ -0,0 +1,193 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// MessagePeerRevoked tells peers that a host was kicked and banned. It is
+// signed with the sender's identity, and receivers only honor it when that
+// key's fingerprint is one of their TrustedPeers: the source address of
+// the connection proves nothing, as peers are not authenticated.
+type MessagePeerRevoked struct {
+	ID        string        `wire:"1"`
+	Host      string        `wire:"2"`
+	BanFor    time.Duration `wire:"3"`
+	Issued    time.Time     `wire:"4"`
+	PublicKey []byte        `wire:"5"`
+	Signature []byte        `wire:"6"`
+}
+
+// signingPayload is the serialized revocation without its signature
+func (m *MessagePeerRevoked) signingPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// verify checks the revocation's signature
+func (m *MessagePeerRevoked) verify() error {
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+	if !crypto.VerifySignature(m.PublicKey, payload, m.Signature) {
+		return fmt.Errorf("invalid revocation signature")
+	}
+	return nil
+}
+
+// hostOf returns the host part of a peer address, or the address itself
+// if it has no port
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// KickPeer disconnects the peer at addr. A positive banFor also bans the
+// peer's host for that long and tells connected peers to do the same.
+// A host can be banned without being connected.
+func (s *FileServer) KickPeer(addr string, banFor time.Duration) error {
+	disconnected := s.disconnectHost(addr, false)
+	if disconnected == 0 && banFor <= 0 {
+		return fmt.Errorf("peer %s %w", addr, ErrPeerUnreachable)
+	}
+	if banFor <= 0 {
+		return nil
+	}
+
+	host := hostOf(addr)
+	s.banHost(host, banFor)
+	s.Logger.Info("banned peer", "host", host, "for", banFor)
+
+	revoked := MessagePeerRevoked{
+		ID:        s.ID,
+		Host:      host,
+		BanFor:    banFor,
+		Issued:    time.Now().UTC(),
+		PublicKey: s.Identity.PublicKey,
+	}
+	payload, err := revoked.signingPayload()
+	if err != nil {
+		return err
+	}
+	revoked.Signature = s.Identity.Sign(payload)
+
+	msg := Message{Payload: revoked}
+	if err := s.broadcast(context.Background(), &msg); err != nil {
+		s.Logger.Warn("revocation broadcast encountered errors", "err", err)
+	}
+	return nil
+}
+
+// disconnectHost closes the connection to addr. With wholeHost set, every
+// peer on the same host is disconnected. It returns how many were closed.
+func (s *FileServer) disconnectHost(addr string, wholeHost bool) int {
+	s.PeerLock.Lock()
+	defer s.PeerLock.Unlock()
+
+	closed := 0
+	for peerAddr, peer := range s.conns {
+		if peerAddr != addr && !(wholeHost && hostOf(peerAddr) == hostOf(addr)) {
+			continue
+		}
+		peer.Close()
+		delete(s.conns, peerAddr)
+		s.writeLocks.Delete(peer)
+		s.Logger.Info("disconnected peer", "peer", peerAddr)
+		closed++
+	}
+	return closed
+}
+
+// banHost rejects connections from host until the ban expires
+func (s *FileServer) banHost(host string, banFor time.Duration) {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	s.bans[host] = time.Now().Add(banFor)
+}
+
+// UnbanPeer lifts the ban on the host of addr
+func (s *FileServer) UnbanPeer(addr string) {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	delete(s.bans, hostOf(addr))
+}
+
+// IsBanned reports whether the host of addr is currently banned
+func (s *FileServer) IsBanned(addr string) bool {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+
+	host := hostOf(addr)
+	until, ok := s.bans[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(s.bans, host)
+		return false
+	}
+	return true
+}
+
+// Bans returns the banned hosts and when their bans expire
+func (s *FileServer) Bans() map[string]time.Time {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+
+	bans := make(map[string]time.Time, len(s.bans))
+	now := time.Now()
+	for host, until := range s.bans {
+		if now.After(until) {
+			delete(s.bans, host)
+			continue
+		}
+		bans[host] = until
+	}
+	return bans
+}
+
+// isTrusted reports whether revocations signed by publicKey are honored
+func (s *FileServer) isTrusted(publicKey []byte) bool {
+	if len(publicKey) == 0 {
+		return false
+	}
+	return slices.Contains(s.TrustedPeers, crypto.Fingerprint(publicKey))
+}
+
+// handleMessagePeerRevoked applies a ban announced by a trusted peer. The
+// ban lasts until BanFor after it was issued, so a replayed revocation
+// cannot extend it. It is not forwarded again, so revocations do not loop.
+func (s *FileServer) handleMessagePeerRevoked(from string, msg MessagePeerRevoked) error {
+	if !s.isTrusted(msg.PublicKey) {
+		s.Logger.Warn("ignoring revocation from untrusted peer", "peer", from, "host", msg.Host)
+		return nil
+	}
+	if err := msg.verify(); err != nil {
+		return fmt.Errorf("revocation from %s: %w", from, err)
+	}
+	if msg.BanFor <= 0 || msg.Host == "" {
+		return fmt.Errorf("invalid revocation from %s", from)
+	}
+	banFor := min(time.Until(msg.Issued.Add(msg.BanFor)), msg.BanFor)
+	if banFor <= 0 {
+		s.Logger.Warn("ignoring expired revocation", "peer", from, "host", msg.Host)
+		return nil
+	}
+
+	s.banHost(msg.Host, banFor)
+	s.disconnectHost(msg.Host, true)
+	s.Logger.Info("applied revocation from trusted peer", "peer", from,
+		"signer", crypto.Fingerprint(msg.PublicKey), "host", msg.Host, "for", banFor)
+	return nil
+}
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// defaultMaxStreams bounds the streams running at once in each direction
+// when FileServerOpts leaves the limit at zero
+const defaultMaxStreams = 64
+
+// ErrBusy is returned when a stream is refused because the node already
+// runs as many streams as it allows
+var ErrBusy = errors.New("too many concurrent transfers")
+
+// streamLimit is a semaphore bounding the streams running at once in one
+// direction. A nil limit admits every stream.
+type streamLimit chan struct{}
+
+// newStreamLimit returns a limit of n streams, or nil for no limit when n is
+// negative. Zero selects defaultMaxStreams.
+func newStreamLimit(n int) streamLimit {
+	switch {
+	case n < 0:
+		return nil
+	case n == 0:
+		n = defaultMaxStreams
+	}
+	return make(streamLimit, n)
+}
+
+// acquire takes a slot for a stream and returns the func that frees it.
+// Without wait it fails right away with ErrBusy when every slot is taken;
+// with wait it queues until a slot frees up or ctx ends.
+func (l streamLimit) acquire(ctx context.Context, wait bool) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l }
+	select {
+	case l <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if !wait {
+		return nil, ErrBusy
+	}
+	select {
+	case l <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrBusy, ctx.Err())
+	}
+}
+
+// beginOutbound takes a slot for a stream to a peer, see streamLimit.acquire
+func (s *FileServer) beginOutbound(ctx context.Context, wait bool) (func(), error) {
+	release, err := s.outbound.acquire(ctx, wait)
+	if err != nil {
+		s.Metrics.IncStreamsBusy()
+	}
+	return release, err
+}
+
+// beginInbound takes a slot for a stream from a peer, waiting for one. The
+// stream is left unread meanwhile, which makes the sender's writes block,
+// so a busy node slows its peers down instead of refusing their data.
+func (s *FileServer) beginInbound(ctx context.Context) (func(), error) {
+	release, err := s.inbound.acquire(ctx, false)
+	if err == nil {
+		return release, nil
+	}
+	s.Metrics.IncStreamsBusy()
+	return s.inbound.acquire(ctx, true)
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLimit(t *testing.T) {
+	limit := newStreamLimit(2)
+	first, err := limit.acquire(context.Background(), false)
+	assert.Nil(t, err)
+	_, err = limit.acquire(context.Background(), false)
+	assert.Nil(t, err)
+
+	// Full: refused right away, or queued until a slot frees up
+	_, err = limit.acquire(context.Background(), false)
+	assert.ErrorIs(t, err, ErrBusy)
+
+	time.AfterFunc(50*time.Millisecond, first)
+	release, err := limit.acquire(context.Background(), true)
+	assert.Nil(t, err)
+	release()
+
+	// A queued stream gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	limit <- struct{}{}
+	_, err = limit.acquire(ctx, true)
+	assert.ErrorIs(t, err, ErrBusy)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestStreamLimitDefaults(t *testing.T) {
+	assert.Equal(t, defaultMaxStreams, cap(newStreamLimit(0)))
+	assert.Nil(t, newStreamLimit(-1))
+
+	var unlimited streamLimit
+	for range 3 * defaultMaxStreams {
+		_, err := unlimited.acquire(context.Background(), false)
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// MessageListFiles asks a peer for the catalog of files it stores
+type MessageListFiles struct {
+	ID        string `wire:"1"`
+	RequestID string `wire:"2"`
+}
+
+// MessageListFilesResponse carries a peer's catalog back to the requester
+type MessageListFilesResponse struct {
+	ID        string             `wire:"1"`
+	RequestID string             `wire:"2"`
+	Files     []storage.FileInfo `wire:"3"`
+}
+
+// NetworkFile is a file available somewhere on the network together with
+// the peers holding it. The local node is listed as "local".
+type NetworkFile struct {
+	Key     string
+	Hash    string
+	Size    int64
+	Holders []string
+}
+
+// catalogReply is a catalog received from one peer
+type catalogReply struct {
+	from  string
+	files []storage.FileInfo
+}
+
+// ListNetworkFiles asks every connected peer for its catalog and merges it
+// with the local one. Peers that do not answer within FetchTimeout are left
+// out of the result. Metadata-only nodes answer from their index instead.
+func (s *FileServer) ListNetworkFiles(ctx context.Context) ([]NetworkFile, error) {
+	if s.MetadataOnly {
+		return s.indexedFiles()
+	}
+
+	local, err := s.store.List(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	requestID, err := crypto.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+
+	expected := len(s.broadcastPeers())
+
+	replies := make(chan catalogReply, expected)
+	s.catalogMu.Lock()
+	s.catalogRequests[requestID] = replies
+	s.catalogMu.Unlock()
+	defer func() {
+		s.catalogMu.Lock()
+		delete(s.catalogRequests, requestID)
+		s.catalogMu.Unlock()
+	}()
+
+	if expected > 0 {
+		msg := Message{Payload: MessageListFiles{ID: s.ID, RequestID: requestID}}
+		if err := s.broadcast(ctx, &msg); err != nil {
+			s.Logger.Warn("file listing broadcast encountered errors", "err", err)
+		}
+	}
+
+	catalogs := map[string][]storage.FileInfo{"local": local}
+
+	timeout := time.NewTimer(s.FetchTimeout)
+	defer timeout.Stop()
+	for received := 0; received < expected; {
+		select {
+		case reply := <-replies:
+			catalogs[reply.from] = reply.files
+			received++
+		case <-timeout.C:
+			s.Logger.Warn("some peers did not answer the file listing", "answered", received, "peers", expected)
+			received = expected
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return mergeCatalogs(catalogs), nil
+}
+
+// SearchNetworkFiles lists the files on the network whose key contains
+// query, ignoring case
+func (s *FileServer) SearchNetworkFiles(ctx context.Context, query string) ([]NetworkFile, error) {
+	files, err := s.ListNetworkFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	var matches []NetworkFile
+	for _, f := range files {
+		if strings.Contains(strings.ToLower(f.Key), query) {
+			matches = append(matches, f)
+		}
+	}
+	return matches, nil
+}
+
+// mergeCatalogs groups the catalogs of several holders by file, sorted by key
+func mergeCatalogs(catalogs map[string][]storage.FileInfo) []NetworkFile {
+	merged := make(map[string]*NetworkFile)
+	for holder, list := range catalogs {
+		for _, f := range list {
+			nf, ok := merged[f.Hash]
+			if !ok {
+				nf = &NetworkFile{Key: f.Key, Hash: f.Hash, Size: f.Size}
+				merged[f.Hash] = nf
+			}
+			nf.Holders = append(nf.Holders, holder)
+		}
+	}
+
+	files := make([]NetworkFile, 0, len(merged))
+	for _, nf := range merged {
+		sort.Strings(nf.Holders)
+		files = append(files, *nf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Key < files[j].Key
+	})
+	return files
+}
+
+// handleMessageListFiles answers a catalog request with the local file list
+func (s *FileServer) handleMessageListFiles(from string, msg MessageListFiles) error {
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	files, err := s.store.List(s.ID)
+	if err != nil {
+		return err
+	}
+
+	resp := Message{
+		Payload: MessageListFilesResponse{
+			ID:        s.ID,
+			RequestID: msg.RequestID,
+			Files:     files,
+		},
+	}
+	return s.sendMessage(peer, &resp)
+}
+
+// handleMessageListFilesResponse hands a catalog to the listing waiting for it
+func (s *FileServer) handleMessageListFilesResponse(from string, msg MessageListFilesResponse) error {
+	if s.MetadataOnly {
+		s.indexCatalog(from, msg.Files)
+		return nil
+	}
+
+	s.catalogMu.Lock()
+	defer s.catalogMu.Unlock()
+
+	replies, ok := s.catalogRequests[msg.RequestID]
+	if !ok {
+		return nil // listing already finished
+	}
+	select {
+	case replies <- catalogReply{from: from, files: msg.Files}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+)
+
+// maintenanceHistory is how many finished runs are kept for reports
+const maintenanceHistory = 100
+
+// Maintenance operations that can be run on demand
+const (
+	MaintenanceGC        = "gc"        // full garbage collection: integrity check and orphan cleanup
+	MaintenanceScrub     = "scrub"     // integrity check only
+	MaintenanceRepair    = "repair"    // top every stored file up to the replication factor
+	MaintenanceRebalance = "rebalance" // anti-entropy with every peer instead of a random one
+)
+
+// Statuses of a maintenance run
+const (
+	MaintenanceRunning = "running"
+	MaintenanceDone    = "done"
+	MaintenanceFailed  = "failed"
+)
+
+// ErrMaintenanceRunning is returned when an operation is started while
+// another run of it has not finished
+var ErrMaintenanceRunning = errors.New("operation already running")
+
+// MaintenanceRun is the progress and report of one maintenance operation
+type MaintenanceRun struct {
+	ID       string         `json:"id"`
+	Op       string         `json:"op"`
+	Status   string         `json:"status"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished,omitzero"`
+	Done     int            `json:"done"`  // files or peers processed so far
+	Total    int            `json:"total"` // files or peers to process, 0 if not known up front
+	Result   map[string]int `json:"result,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// maintenanceOp runs an operation, reporting progress as it goes, and
+// returns the counts that make up its report
+type maintenanceOp func(s *FileServer, progress func(done, total int)) (map[string]int, error)
+
+var maintenanceOps = map[string]maintenanceOp{
+	MaintenanceGC:        (*FileServer).maintainGC,
+	MaintenanceScrub:     (*FileServer).maintainScrub,
+	MaintenanceRepair:    (*FileServer).maintainRepair,
+	MaintenanceRebalance: (*FileServer).maintainRebalance,
+}
+
+// StartMaintenance starts op in the background and returns its run, whose
+// progress MaintenanceRuns reports. Each operation runs once at a time.
+func (s *FileServer) StartMaintenance(op string) (MaintenanceRun, error) {
+	run, ok := maintenanceOps[op]
+	if !ok {
+		return MaintenanceRun{}, fmt.Errorf("unknown maintenance operation %q", op)
+	}
+	id, err := crypto.GenerateID()
+	if err != nil {
+		return MaintenanceRun{}, err
+	}
+
+	s.maintenanceMu.Lock()
+	for _, r := range s.maintenance {
+		if r.Op == op && r.Status == MaintenanceRunning {
+			s.maintenanceMu.Unlock()
+			return MaintenanceRun{}, fmt.Errorf("%s: %w as %s", op, ErrMaintenanceRunning, r.ID)
+		}
+	}
+	r := &MaintenanceRun{ID: id[:8], Op: op, Status: MaintenanceRunning, Started: time.Now()}
+	s.maintenance = append(s.maintenance, r)
+	if len(s.maintenance) > maintenanceHistory {
+		s.maintenance = s.maintenance[len(s.maintenance)-maintenanceHistory:]
+	}
+	started := *r
+	s.maintenanceMu.Unlock()
+
+	s.Logger.Info("maintenance started", "op", op, "run", r.ID)
+	go func() {
+		result, err := run(s, func(done, total int) {
+			s.maintenanceMu.Lock()
+			r.Done, r.Total = done, total
+			s.maintenanceMu.Unlock()
+		})
+
+		s.maintenanceMu.Lock()
+		r.Finished, r.Result, r.Status = time.Now(), result, MaintenanceDone
+		if err != nil {
+			r.Status, r.Error = MaintenanceFailed, err.Error()
+		}
+		elapsed := r.Finished.Sub(r.Started)
+		s.maintenanceMu.Unlock()
+
+		if err != nil {
+			s.Logger.Warn("maintenance failed", "op", op, "run", r.ID, "err", err)
+		} else {
+			s.Logger.Info("maintenance finished", "op", op, "run", r.ID, "duration", elapsed)
+		}
+		s.Events.Publish(events.Event{Type: events.Maintenance, Key: op, Detail: r.ID + " " + r.Status})
+	}()
+	return started, nil
+}
+
+// MaintenanceRuns returns the last n maintenance runs, newest first,
+// including the ones still running. n <= 0 returns all that are kept.
+func (s *FileServer) MaintenanceRuns(n int) []MaintenanceRun {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	if n <= 0 || n > len(s.maintenance) {
+		n = len(s.maintenance)
+	}
+	runs := make([]MaintenanceRun, 0, n)
+	for i := len(s.maintenance) - 1; i >= len(s.maintenance)-n; i-- {
+		runs = append(runs, *s.maintenance[i])
+	}
+	return runs
+}
+
+// MaintenanceRunByID returns the maintenance run with the given ID
+func (s *FileServer) MaintenanceRunByID(id string) (MaintenanceRun, bool) {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+	for _, r := range s.maintenance {
+		if r.ID == id {
+			return *r, true
+		}
+	}
+	return MaintenanceRun{}, false
+}
+
+func (s *FileServer) maintainGC(progress func(done, total int)) (map[string]int, error) {
+	return s.collectGarbage(progress, false)
+}
+
+func (s *FileServer) maintainScrub(progress func(done, total int)) (map[string]int, error) {
+	return s.collectGarbage(progress, true)
+}
+
+// collectGarbage runs the garbage collector now, counting verified files
+// against the files stored here
+func (s *FileServer) collectGarbage(progress func(done, total int), scrubOnly bool) (map[string]int, error) {
+	if s.GC == nil {
+		return nil, fmt.Errorf("garbage collection is disabled")
+	}
+	files, err := s.store.List(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	total, checked := len(files), 0
+	progress(0, total)
+	count := func() {
+		checked++
+		progress(checked, max(total, checked))
+	}
+
+	run := s.GC.RunNow
+	if scrubOnly {
+		run = s.GC.Scrub
+	}
+	stats, err := run(count)
+	if !scrubOnly {
+		return stats.Counts(), err
+	}
+	return map[string]int{
+		"checked":   stats.CheckedFiles,
+		"unchecked": stats.UncheckedFiles,
+		"corrupted": stats.CorruptedFiles,
+		"removed":   stats.RemovedFiles,
+	}, err
+}
+
+// maintainRepair offers every stored file that is short of replicas to
+// peers that lack it, as repairs after a node went offline do
+func (s *FileServer) maintainRepair(progress func(done, total int)) (map[string]int, error) {
+	if s.IsGuest() || s.MetadataOnly {
+		return nil, fmt.Errorf("this node holds no replicas to repair")
+	}
+	d, err := s.localDigest()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, bucket := range d.files {
+		for _, f := range bucket {
+			keys = append(keys, f.Key)
+		}
+	}
+	sort.Strings(keys)
+
+	repairsBefore := s.Metrics.Snapshot().ReplicaRepairs
+	progress(0, len(keys))
+	for i, key := range keys {
+		s.topUpReplicas(key)
+		progress(i+1, len(keys))
+	}
+
+	s.replicasMu.Lock()
+	short := len(s.underReplicated)
+	s.replicasMu.Unlock()
+	return map[string]int{
+		"files":            len(keys),
+		"replicas_offered": int(s.Metrics.Snapshot().ReplicaRepairs - repairsBefore),
+		"under_replicated": short,
+	}, nil
+}
+
+// maintainRebalance runs an anti-entropy round with every peer that takes
+// replicas, instead of the one random peer of a scheduled round
+func (s *FileServer) maintainRebalance(progress func(done, total int)) (map[string]int, error) {
+	if s.IsGuest() || s.MetadataOnly {
+		return nil, fmt.Errorf("this node takes no part in anti-entropy")
+	}
+	peers := s.replicaPeers()
+	d, err := s.localDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(peers))
+	for addr := range peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	msg := Message{Payload: MessageDigest{ID: s.ID, Root: d.root, Buckets: d.buckets}}
+	var errs []error
+	progress(0, len(addrs))
+	for i, addr := range addrs {
+		if err := s.sendMessage(peers[addr], &msg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		}
+		progress(i+1, len(addrs))
+	}
+	return map[string]int{
+		"peers":  len(addrs),
+		"failed": len(errs),
+	}, errors.Join(errs...)
+}
+
+// MaintenanceHandler serves the maintenance operations for automation:
+//
+//	POST /admin/{op}       starts gc, scrub, repair or rebalance
+//	GET  /admin/runs?n=N   reports the last N runs, newest first
+//	GET  /admin/runs/{id}  reports one run, with its progress while running
+//
+// Every response is JSON. The handler has no authentication of its own.
+func (s *FileServer) MaintenanceHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/{op}", func(w http.ResponseWriter, r *http.Request) {
+		run, err := s.StartMaintenance(r.PathValue("op"))
+		switch {
+		case errors.Is(err, ErrMaintenanceRunning):
+			writeJSONError(w, http.StatusConflict, err)
+		case err != nil:
+			writeJSONError(w, http.StatusBadRequest, err)
+		default:
+			writeJSON(w, http.StatusAccepted, run)
+		}
+	})
+	mux.HandleFunc("GET /admin/runs", func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if v := r.URL.Query().Get("n"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid n %q", v))
+				return
+			}
+			n = parsed
+		}
+		writeJSON(w, http.StatusOK, s.MaintenanceRuns(n))
+	})
+	mux.HandleFunc("GET /admin/runs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		run, ok := s.MaintenanceRunByID(r.PathValue("id"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("no run %s", r.PathValue("id")))
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceHandler(t *testing.T) {
+	roots := []string{
+		filepath.Join(os.TempDir(), "pv_maintenance_node1"),
+		filepath.Join(os.TempDir(), "pv_maintenance_node2"),
+	}
+	for _, root := range roots {
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+	}
+
+	encKey, _ := crypto.NewEncryptionKey()
+	server1 := makeTestServer(t, roots[0], ":5954", encKey)
+	server2 := makeTestServer(t, roots[1], ":6954", encKey)
+	for _, s := range []*FileServer{server1, server2} {
+		go s.Start(context.Background())
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Nil(t, server2.Transport.Dial("127.0.0.1:5954"))
+	assert.Eventually(t, func() bool {
+		return len(server1.PeerPaths()) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+	for _, key := range []string{"a.txt", "b.txt"} {
+		assert.Nil(t, server1.Store(context.Background(), key, bytes.NewReader([]byte("maintained "+key))))
+	}
+
+	admin := httptest.NewServer(server1.MaintenanceHandler())
+	defer admin.Close()
+
+	start := func(op string) (MaintenanceRun, int) {
+		resp, err := http.Post(admin.URL+"/admin/"+op, "", nil)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		var run MaintenanceRun
+		json.NewDecoder(resp.Body).Decode(&run)
+		return run, resp.StatusCode
+	}
+	wait := func(id string) MaintenanceRun {
+		var run MaintenanceRun
+		assert.Eventually(t, func() bool {
+			resp, err := http.Get(admin.URL + "/admin/runs/" + id)
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+			json.NewDecoder(resp.Body).Decode(&run)
+			return run.Status != MaintenanceRunning
+		}, 5*time.Second, 20*time.Millisecond)
+		return run
+	}
+
+	run, code := start(MaintenanceScrub)
+	assert.Equal(t, http.StatusAccepted, code)
+	run = wait(run.ID)
+	assert.Equal(t, MaintenanceDone, run.Status)
+	assert.Equal(t, 2, run.Result["checked"])
+	assert.Equal(t, 0, run.Result["corrupted"])
+	assert.Equal(t, run.Total, run.Done)
+
+	run, _ = start(MaintenanceRebalance)
+	run = wait(run.ID)
+	assert.Equal(t, MaintenanceDone, run.Status)
+	assert.Equal(t, 1, run.Result["peers"])
+
+	// A damaged replica could also be a file encrypted with a device data
+	// key, so it is reported but kept
+	hash := storage.CASPathTransformFunc("a.txt").Filename
+	filepath.Walk(roots[0], func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == hash {
+			assert.Nil(t, os.WriteFile(path, []byte("damaged"), 0644))
+		}
+		return nil
+	})
+	run, _ = start(MaintenanceGC)
+	run = wait(run.ID)
+	assert.Equal(t, 1, run.Result["checked"])
+	assert.Equal(t, 1, run.Result["unchecked"])
+	assert.True(t, server1.store.Has(server1.ID, "a.txt"))
+
+	_, code = start("defrag")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	resp, err := http.Get(admin.URL + "/admin/runs?n=1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var runs []MaintenanceRun
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&runs))
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, MaintenanceGC, runs[0].Op)
+	}
+	assert.Len(t, server1.MaintenanceRuns(0), 3)
+}
@@ -1,62 +1,30 @@
 package network
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
-	"time"
 )
 
+// NetworkIDFromKey derives a network ID from the shared network key, so
+// nodes configured with the same key recognize each other without further
+// setup. The ID reveals nothing about the key.
+func NetworkIDFromKey(key []byte) string {
+	sum := sha256.Sum256(append([]byte("peervault network id:"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
 // PublicIPResponse represents the response from IP detection services
 type PublicIPResponse struct {
 	IP string `json:"ip"`
 }
 
-// GetPublicIP attempts to detect the public IP address using multiple methods
+// GetPublicIP attempts to detect the public IP address using the default
+// services, without caching
 func GetPublicIP() (string, error) {
-	// Try multiple services for redundancy
-	services := []string{
-		"https://api.ipify.org?format=json",
-		"https://api.myip.com",
-		"https://ifconfig.me/ip",
-	}
-
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-
-	for _, service := range services {
-		resp, err := client.Get(service)
-		if err != nil {
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			continue
-		}
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			continue
-		}
-
-		// Try to parse as JSON first
-		var ipResp PublicIPResponse
-		if err := json.Unmarshal(body, &ipResp); err == nil && ipResp.IP != "" {
-			return ipResp.IP, nil
-		}
-
-		// If not JSON, treat as plain text IP
-		ip := string(body)
-		if net.ParseIP(ip) != nil {
-			return ip, nil
-		}
-	}
-
-	return "", fmt.Errorf("failed to detect public IP from all services")
+	return NewPublicIPDetector(PublicIPOpts{}).Refresh(context.Background())
 }
 
 // GetLocalIP returns the local network IP address
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// fileVersion identifies the content of a stored file on disk
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// File is random access to the content of a stored file, see Open
+type File struct {
+	*io.SectionReader
+	ModTime time.Time // when the stored file was last written
+
+	f    *os.File
+	temp bool // f is a decompressed copy, removed on Close
+}
+
+// Close releases the stored file
+func (f *File) Close() error {
+	err := f.f.Close()
+	if f.temp {
+		os.Remove(f.f.Name())
+	}
+	return err
+}
+
+// Open returns random access to the content of key, for partial reads of
+// large files. A file this node does not hold is fetched with Get first.
+// Unlike Get, reads start anywhere without decrypting what comes before.
+// The HMAC of a stored file is checked the first time it is opened and
+// again whenever it changes on disk. Framed files are checked frame by
+// frame as they are read instead.
+func (s *FileServer) Open(ctx context.Context, key string) (*File, error) {
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open data key of %s: %w", key, err)
+	}
+
+	if !s.store.Has(s.ID, key) {
+		// Reading the file to its end checks its HMAC
+		r, err := s.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		if err := s.markVerified(key); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := s.store.Open(s.ID, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("file %s %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	version := fileVersion{size: info.Size(), modTime: info.ModTime()}
+
+	r, err := crypto.NewReaderAt(encKey, f, version.size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Framed files are checked frame by frame as they are read instead
+	if !r.Authenticated() && !s.isVerified(key, version) {
+		if err := crypto.Verify(encKey, f, version.size); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("file %s: %w: %w", key, ErrCorrupted, err)
+		}
+		s.verifiedMu.Lock()
+		s.verified[key] = version
+		s.verifiedMu.Unlock()
+	}
+
+	head := make([]byte, storage.CompressHeaderSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	c, offset, err := storage.CompressionOf(head[:n])
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("file %s: %w", key, err)
+	}
+	if c != storage.CompressionNone {
+		return decompressToTemp(r, f, version.modTime)
+	}
+	size := r.Size() - int64(offset)
+	return &File{SectionReader: io.NewSectionReader(r, int64(offset), size), ModTime: version.modTime, f: f}, nil
+}
+
+// decompressToTemp returns random access to a compressed file, which cannot
+// be read from the middle, through a temporary copy of its content that is
+// removed when the File is closed. stored is closed.
+func decompressToTemp(r *crypto.ReaderAt, stored *os.File, modTime time.Time) (*File, error) {
+	defer stored.Close()
+	tmp, err := os.CreateTemp("", "peervault-open-*")
+	if err != nil {
+		return nil, err
+	}
+	file := &File{ModTime: modTime, f: tmp, temp: true}
+	n, err := io.Copy(tmp, storage.Decompress(io.NewSectionReader(r, 0, r.Size())))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	file.SectionReader = io.NewSectionReader(tmp, 0, n)
+	return file, nil
+}
+
+// isVerified reports whether the HMAC of key was checked for version
+func (s *FileServer) isVerified(key string, version fileVersion) bool {
+	s.verifiedMu.Lock()
+	defer s.verifiedMu.Unlock()
+	v, ok := s.verified[key]
+	return ok && v.size == version.size && v.modTime.Equal(version.modTime)
+}
+
+// markVerified records that the stored file of key, as it is on disk now,
+// passed its HMAC check
+func (s *FileServer) markVerified(key string) error {
+	size, err := s.store.Size(s.ID, key)
+	if err != nil {
+		return err
+	}
+	modTime, err := s.store.ModTime(s.ID, key)
+	if err != nil {
+		return err
+	}
+	s.verifiedMu.Lock()
+	defer s.verifiedMu.Unlock()
+	s.verified[key] = fileVersion{size: size, modTime: modTime}
+	return nil
+}
+
+// verifyStored checks a stored file for the garbage collector. Files are
+// named after the hash of their key, not of their content, so the content
+// is checked by its HMAC instead. Only a file this device holds the data
+// key of is reported corrupted: one that fails the check with the network
+// key may be a replica another device encrypted with its own data key,
+// which cannot be told from corruption, so it is left unchecked.
+func (s *FileServer) verifyStored(hash string, path string) (bool, error) {
+	key, ok := s.store.GetOriginalKey(hash)
+	if !ok {
+		return false, fmt.Errorf("original key of %s unknown", hash)
+	}
+	s.devicesMu.Lock()
+	_, own := s.fileKeys[crypto.HashKey(key)]
+	s.devicesMu.Unlock()
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if err := crypto.Verify(encKey, f, info.Size()); err != nil {
+		if !own {
+			return false, fmt.Errorf("%s: %w, possibly encrypted with a device data key", key, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
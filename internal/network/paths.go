@@ -0,0 +1,490 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// MessageHello introduces a node on a new connection. A node reachable over
+// several connections (transports, LAN and WAN addresses) sends the same
+// public key on each of them, which is how its paths are grouped. The
+// receiver echoes SentAt back so the sender can measure the round trip,
+// and its own clock in EchoAt so the sender can tell how far apart the
+// two clocks are.
+type MessageHello struct {
+	ID         string            `wire:"1"`
+	PublicKey  []byte            `wire:"2"`
+	SentAt     time.Time         `wire:"3"`
+	Echo       bool              `wire:"4"`
+	EchoAt     time.Time         `wire:"5"`
+	GuestToken string            `wire:"6"`  // set by nodes that joined as guests
+	Labels     map[string]string `wire:"7"`  // operator-assigned metadata, e.g. zone=eu
+	DeviceKey  []byte            `wire:"8"`  // device public key, set when device keys are enabled
+	Metadata   bool              `wire:"9"`  // the node only indexes the network and takes no replicas
+	Addr       string            `wire:"10"` // address the node advertises for new connections
+	Clock      hlc.Timestamp     `wire:"11"` // the sender's clock, merged so later stamps order after it
+	Version    int               `wire:"12"` // protocol version, see protocol.go; 0 for nodes older than version 2
+	Messages   []string          `wire:"13"` // message types the sender decodes
+	Caps       []string          `wire:"14"` // capabilities of the sender, e.g. CapRanges
+	GuestProof []byte            `wire:"15"` // GuestToken and SentAt signed by a guest's identity
+}
+
+// PeerPath is one connection to a remote node
+type PeerPath struct {
+	Node      string // fingerprint of the node's public key
+	Addr      string
+	RTT       time.Duration // zero until measured
+	ClockSkew time.Duration // the node's clock minus this node's, zero until measured
+	Suspect   bool          // a heartbeat went unanswered
+	Preferred bool
+	Version   int      // protocol version the node speaks, 0 until its hello
+	Caps      []string // capabilities the node announced
+}
+
+// peerPath is a tracked connection to a remote node
+type peerPath struct {
+	peer      p2p.Peer
+	addr      string
+	rtt       time.Duration
+	skew      time.Duration
+	connected time.Time
+}
+
+// latency returns the round trip of the path, from its heartbeats once
+// they were answered and from the hello before, and whether the last
+// heartbeat went unanswered
+func (p *peerPath) latency() (time.Duration, bool) {
+	if l, ok := p.peer.(liveness); ok {
+		if rtt := l.RTT(); rtt > 0 {
+			return rtt, l.Suspect()
+		}
+		return p.rtt, l.Suspect()
+	}
+	return p.rtt, false
+}
+
+// better reports whether path a should be preferred over b. Responsive
+// paths win over suspect ones, measured over unmeasured ones, then the
+// lower round trip, then the older connection.
+func (a *peerPath) better(b *peerPath) bool {
+	rttA, suspectA := a.latency()
+	rttB, suspectB := b.latency()
+	if suspectA != suspectB {
+		return suspectB
+	}
+	if (rttA > 0) != (rttB > 0) {
+		return rttA > 0
+	}
+	if rttA != rttB {
+		return rttA < rttB
+	}
+	return a.connected.Before(b.connected)
+}
+
+// sendHello introduces this node on a new connection
+func (s *FileServer) sendHello(p p2p.Peer) {
+	now := time.Now()
+	var token string
+	var proof []byte
+	if s.GuestToken != "" {
+		token = helloToken(s.GuestToken)
+		proof = s.Identity.Sign(guestProofPayload(token, now))
+	}
+	msg := Message{
+		Payload: MessageHello{
+			ID:         s.ID,
+			PublicKey:  s.Identity.PublicKey,
+			SentAt:     now,
+			GuestToken: token,
+			Labels:     s.Labels,
+			DeviceKey:  s.DevicePublicKey(),
+			Metadata:   s.MetadataOnly,
+			Addr:       s.AdvertiseAddr(),
+			Clock:      s.Clock.Now(),
+			Version:    ProtocolVersion,
+			Messages:   messageTypes,
+			Caps:       s.capabilities(),
+			GuestProof: proof,
+		},
+	}
+	if err := s.sendMessage(p, &msg); err != nil {
+		s.Logger.Warn("failed to send hello", "peer", p.RemoteAddr().String(), "err", err)
+	}
+}
+
+// handleMessageHello records the connection as a path to the sending node
+// and answers with an echo, or measures the round trip if it is one
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	peer, ok := s.peerFor(from)
+	if !ok || peer.RemoteAddr().String() != from {
+		return nil // connection already gone
+	}
+	if msg.GuestToken != "" && !msg.Echo {
+		if err := s.admitGuest(from, msg); err != nil {
+			return err
+		}
+	}
+	node := crypto.Fingerprint(msg.PublicKey)
+	s.Clock.Update(msg.Clock)
+	if err := s.checkPeerLists(from, node); err != nil {
+		if s.blockedNode(node) {
+			s.blockNode(node, from, msg.Addr)
+		}
+		peer.Close()
+		return err
+	}
+	if !msg.Echo {
+		if err := s.checkDowngrade(from, msg); err != nil {
+			peer.Close()
+			return err
+		}
+		s.recordProtocol(from, msg)
+		if hb, ok := peer.(heartbeater); ok && s.PeerSupports(from, CapHeartbeat) {
+			hb.StartHeartbeat()
+		}
+	}
+
+	s.pathsMu.Lock()
+	path := s.addPath(node, peer)
+	var duplicates []p2p.Peer
+	if !msg.Echo {
+		duplicates = s.duplicatePaths(node)
+	}
+	if msg.Echo {
+		path.rtt = time.Since(msg.SentAt)
+		if !msg.EchoAt.IsZero() {
+			path.skew = msg.EchoAt.Sub(msg.SentAt.Add(path.rtt / 2))
+		}
+	} else {
+		s.nodeLabels[node] = msg.Labels
+		s.nodeDevices[node] = msg.DeviceKey
+		s.indexNodes[node] = msg.Metadata
+	}
+	rtt := path.rtt
+	count := len(s.nodePaths[node])
+	s.pathsMu.Unlock()
+
+	if msg.Echo {
+		if count > 1 {
+			s.Logger.Info("measured path to multi-path peer", "peer", from, "node", node, "rtt", rtt, "paths", count)
+		}
+		return nil
+	}
+
+	closed := false
+	for _, dup := range duplicates {
+		s.Logger.Info("closing duplicate connection", "peer", dup.RemoteAddr().String(), "node", node)
+		dup.Close()
+		closed = closed || dup == peer
+	}
+	if closed {
+		return nil
+	}
+
+	s.nodeOnline(node)
+	s.setNodeAddr(node, msg.Addr)
+	go s.sendPendingDeletes(peer)
+	if s.MetadataOnly {
+		go s.requestCatalog(peer)
+	}
+	if s.isOtherDevice(msg.DeviceKey) {
+		go s.grantDevice(peer, msg.DeviceKey, s.wrapFileKeys)
+	}
+	echo := Message{
+		Payload: MessageHello{
+			ID:        s.ID,
+			PublicKey: s.Identity.PublicKey,
+			SentAt:    msg.SentAt,
+			Echo:      true,
+			EchoAt:    time.Now(),
+		},
+	}
+	return s.sendMessage(peer, &echo)
+}
+
+// addPath tracks a connection to node, returning its path. Callers hold pathsMu.
+func (s *FileServer) addPath(node string, peer p2p.Peer) *peerPath {
+	addr := peer.RemoteAddr().String()
+	for _, path := range s.nodePaths[node] {
+		if path.peer == peer {
+			return path
+		}
+	}
+
+	path := &peerPath{peer: peer, addr: addr, connected: time.Now()}
+	s.nodePaths[node] = append(s.nodePaths[node], path)
+	s.pathNode[addr] = node
+	s.updatePeer(node)
+	return path
+}
+
+// updatePeer points the entry of node in the peer table to its preferred
+// path, or removes it once no path is left. Callers hold pathsMu.
+func (s *FileServer) updatePeer(node string) {
+	best := s.bestPath(node, nil)
+
+	s.PeerLock.Lock()
+	defer s.PeerLock.Unlock()
+	if best == nil {
+		delete(s.Peers, node)
+	} else {
+		s.Peers[node] = best.peer
+	}
+	s.Metrics.SetPeersConnected(len(s.Peers))
+}
+
+// dialedPeer is implemented by connections that know which end dialed them
+type dialedPeer interface {
+	Outbound() bool
+}
+
+// duplicatePaths returns the connections to node that duplicate another
+// one. When both nodes dialed each other from the same host, the node with
+// the lower ID keeps the connection it accepted and the other node the one
+// it dialed, so both close the same connection. Connections over different
+// addresses are separate paths and stay open. Callers hold pathsMu.
+func (s *FileServer) duplicatePaths(node string) []p2p.Peer {
+	keepInbound := s.Identity.Fingerprint() < node
+	var duplicates []p2p.Peer
+	for _, a := range s.nodePaths[node] {
+		da, ok := a.peer.(dialedPeer)
+		if !ok || da.Outbound() != keepInbound {
+			continue
+		}
+		for _, b := range s.nodePaths[node] {
+			if db, ok := b.peer.(dialedPeer); ok && db.Outbound() != da.Outbound() && sameHost(a.addr, b.addr) {
+				duplicates = append(duplicates, a.peer)
+				break
+			}
+		}
+	}
+	return duplicates
+}
+
+// sameHost reports whether two connection addresses are on the same host
+func sameHost(a, b string) bool {
+	hostA, _, errA := net.SplitHostPort(a)
+	hostB, _, errB := net.SplitHostPort(b)
+	return errA == nil && errB == nil && hostA == hostB
+}
+
+// removePath stops tracking a closed connection. It returns the node the
+// connection led to, or "" if it never introduced itself, and the preferred
+// remaining path to that node, if there is one.
+func (s *FileServer) removePath(p p2p.Peer) (string, *peerPath) {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+
+	addr := p.RemoteAddr().String()
+	node, ok := s.pathNode[addr]
+	if !ok {
+		return "", nil
+	}
+
+	var kept []*peerPath
+	for _, path := range s.nodePaths[node] {
+		if path.peer != p {
+			kept = append(kept, path)
+		}
+	}
+	if len(kept) == 0 {
+		// Closed addresses keep pointing to their node while it is still
+		// reachable, so answers to them can fail over. Forget them now.
+		for a, n := range s.pathNode {
+			if n == node {
+				delete(s.pathNode, a)
+			}
+		}
+		delete(s.nodePaths, node)
+		delete(s.nodeLabels, node)
+		delete(s.nodeDevices, node)
+		delete(s.indexNodes, node)
+		s.updatePeer(node)
+		return node, nil
+	}
+	s.nodePaths[node] = kept
+	s.updatePeer(node)
+	return node, s.bestPath(node, nil)
+}
+
+// bestPath returns the preferred path to node, skipping the given
+// connection. Callers hold pathsMu.
+func (s *FileServer) bestPath(node string, skip p2p.Peer) *peerPath {
+	var best *peerPath
+	for _, path := range s.nodePaths[node] {
+		if path.peer == skip {
+			continue
+		}
+		if best == nil || path.better(best) {
+			best = path
+		}
+	}
+	return best
+}
+
+// peerFor returns the connection to answer a message received from addr.
+// Answers go back on the same connection while it is open, and on the
+// preferred remaining path to the same node once it is gone.
+func (s *FileServer) peerFor(addr string) (p2p.Peer, bool) {
+	s.PeerLock.Lock()
+	peer, ok := s.conns[addr]
+	s.PeerLock.Unlock()
+	if ok {
+		return peer, true
+	}
+
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	node, ok := s.pathNode[addr]
+	if !ok {
+		return nil, false
+	}
+	if best := s.bestPath(node, nil); best != nil {
+		return best.peer, true
+	}
+	return nil, false
+}
+
+// failoverPeer returns another connection to the node peer belongs to
+func (s *FileServer) failoverPeer(peer p2p.Peer) (p2p.Peer, bool) {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+
+	node, ok := s.pathNode[peer.RemoteAddr().String()]
+	if !ok {
+		return nil, false
+	}
+	if best := s.bestPath(node, peer); best != nil {
+		return best.peer, true
+	}
+	return nil, false
+}
+
+// broadcastPeers snapshots the connections a broadcast goes to, by
+// address: the preferred path of every node in the peer table, plus
+// connections that have not introduced themselves yet.
+func (s *FileServer) broadcastPeers() map[string]p2p.Peer {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	s.PeerLock.Lock()
+	defer s.PeerLock.Unlock()
+
+	peers := make(map[string]p2p.Peer, len(s.Peers))
+	for node := range s.Peers {
+		if best := s.bestPath(node, nil); best != nil {
+			peers[best.addr] = best.peer
+		}
+	}
+	for addr, peer := range s.conns {
+		if _, ok := s.pathNode[addr]; !ok {
+			peers[addr] = peer
+		}
+	}
+	return peers
+}
+
+// peerCount returns how many peers are connected: each node once, however
+// many paths lead to it, and each connection that has not introduced
+// itself yet
+func (s *FileServer) peerCount() int {
+	return len(s.broadcastPeers())
+}
+
+// replicaPeers is broadcastPeers without guests and metadata-only nodes,
+// which never hold replicas
+func (s *FileServer) replicaPeers() map[string]p2p.Peer {
+	peers := s.broadcastPeers()
+	for addr := range peers {
+		if s.isGuestPeer(addr) || s.isIndexPeer(addr) {
+			delete(peers, addr)
+		}
+	}
+	return peers
+}
+
+// isIndexPeer reports whether a connection belongs to a metadata-only node
+func (s *FileServer) isIndexPeer(addr string) bool {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	return s.indexNodes[s.pathNode[addr]]
+}
+
+// failoverDownloads moves the ranges a closed connection was serving to
+// another path of the same node and requests them again there
+func (s *FileServer) failoverDownloads(from, to string) {
+	s.downloadsMu.Lock()
+	downloads := make([]*download, 0, len(s.downloads))
+	for _, d := range s.downloads {
+		downloads = append(downloads, d)
+	}
+	s.downloadsMu.Unlock()
+
+	for _, d := range downloads {
+		s.requestRanges(d, d.rebind(from, to))
+	}
+}
+
+// peerLatency returns the round trip to the peer at addr, zero if it is
+// unknown, and whether its last heartbeat went unanswered
+func (s *FileServer) peerLatency(addr string) (time.Duration, bool) {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	for _, path := range s.nodePaths[s.pathNode[addr]] {
+		if path.addr == addr {
+			return path.latency()
+		}
+	}
+	return 0, false
+}
+
+// peerRTTs returns the measured round trip in seconds of every connection,
+// by address, for the peervault_peer_rtt_seconds metric
+func (s *FileServer) peerRTTs() map[string]float64 {
+	rtts := make(map[string]float64)
+	for _, p := range s.PeerPaths() {
+		if p.RTT > 0 {
+			rtts[p.Addr] = p.RTT.Seconds()
+		}
+	}
+	return rtts
+}
+
+// PeerPaths lists the connections to every node that introduced itself,
+// with the preferred path of each node first
+func (s *FileServer) PeerPaths() []PeerPath {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+
+	var paths []PeerPath
+	for node, nodePaths := range s.nodePaths {
+		best := s.bestPath(node, nil)
+		sorted := append([]*peerPath(nil), nodePaths...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].better(sorted[j])
+		})
+		for _, path := range sorted {
+			rtt, suspect := path.latency()
+			pp := PeerPath{
+				Node:      node,
+				Addr:      path.addr,
+				RTT:       rtt,
+				ClockSkew: path.skew,
+				Suspect:   suspect,
+				Preferred: path == best,
+			}
+			if proto := s.peerProtocolOf(path.addr); proto != nil {
+				pp.Version, pp.Caps = proto.version, proto.caps
+			}
+			paths = append(paths, pp)
+		}
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return paths[i].Node < paths[j].Node
+	})
+	return paths
+}
@@ -0,0 +1,289 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// PeerLists are the peers this node always refuses and, when Allow is not
+// empty, the only peers it accepts. Entries are hosts, as in bans, or node
+// IDs (public key fingerprints), which are only known once a connection
+// introduced itself.
+type PeerLists struct {
+	Allow []string `json:"allow,omitempty"`
+	Block []string `json:"block,omitempty"`
+}
+
+// peerListsPath is where the lists changed at runtime are kept. Entries
+// from FileServerOpts.AllowPeers and BlockPeers are not written there.
+func (s *FileServer) peerListsPath() string {
+	return filepath.Join(s.StorageRoot, "peers.json")
+}
+
+// isNodeID reports whether a list entry is a node ID rather than a host
+func isNodeID(entry string) bool {
+	if len(entry) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(entry)
+	return err == nil
+}
+
+// normalizePeer turns an address or node ID into a list entry: node IDs in
+// lower case and addresses reduced to their host
+func normalizePeer(peer string) (string, error) {
+	peer = strings.TrimSpace(peer)
+	if isNodeID(strings.ToLower(peer)) {
+		return strings.ToLower(peer), nil
+	}
+	host := hostOf(peer)
+	if host == "" {
+		return "", fmt.Errorf("invalid peer %q, expected an address or node ID", peer)
+	}
+	return host, nil
+}
+
+// loadPeerLists reads the lists changed at runtime before the node
+// restarted and adds the configured ones
+func (s *FileServer) loadPeerLists(allow, block []string) error {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+
+	for _, list := range []struct {
+		entries []string
+		into    *[]string
+	}{{allow, &s.configLists.Allow}, {block, &s.configLists.Block}} {
+		for _, peer := range list.entries {
+			if strings.TrimSpace(peer) == "" {
+				continue
+			}
+			entry, err := normalizePeer(peer)
+			if err != nil {
+				return err
+			}
+			*list.into = append(*list.into, entry)
+		}
+	}
+
+	data, err := os.ReadFile(s.peerListsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.lists)
+}
+
+// savePeerLists persists the lists changed at runtime. Callers hold listsMu.
+func (s *FileServer) savePeerLists() error {
+	data, err := json.MarshalIndent(s.lists, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.peerListsPath(), data, 0644)
+}
+
+// PeerLists returns the configured lists merged with the ones changed at
+// runtime
+func (s *FileServer) PeerLists() PeerLists {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	merge := func(a, b []string) []string {
+		merged := slices.Concat(a, b)
+		slices.Sort(merged)
+		return slices.Compact(merged)
+	}
+	return PeerLists{
+		Allow: merge(s.configLists.Allow, s.lists.Allow),
+		Block: merge(s.configLists.Block, s.lists.Block),
+	}
+}
+
+// BlockPeer refuses a host or node for good, disconnecting it, and keeps
+// it off the allowlist
+func (s *FileServer) BlockPeer(peer string) error {
+	entry, err := normalizePeer(peer)
+	if err != nil {
+		return err
+	}
+	s.listsMu.Lock()
+	s.lists.Allow = slices.DeleteFunc(s.lists.Allow, func(e string) bool { return e == entry })
+	if !slices.Contains(s.lists.Block, entry) {
+		s.lists.Block = append(s.lists.Block, entry)
+	}
+	err = s.savePeerLists()
+	s.listsMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save peer lists: %w", err)
+	}
+
+	s.Logger.Info("blocked peer", "peer", entry)
+	s.disconnectBlocked()
+	return nil
+}
+
+// UnblockPeer takes a host or node off the blocklist and lifts a temporary
+// ban of the host. Entries of FileServerOpts.BlockPeers stay until they are
+// removed from the configuration.
+func (s *FileServer) UnblockPeer(peer string) error {
+	entry, err := normalizePeer(peer)
+	if err != nil {
+		return err
+	}
+	if !isNodeID(entry) {
+		s.UnbanPeer(entry)
+	}
+
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	if slices.Contains(s.configLists.Block, entry) {
+		return fmt.Errorf("%s is blocked by the configuration", entry)
+	}
+	s.lists.Block = slices.DeleteFunc(s.lists.Block, func(e string) bool { return e == entry })
+	for addr, node := range s.blockedAddrs {
+		if node == entry || hostOf(addr) == entry {
+			delete(s.blockedAddrs, addr)
+		}
+	}
+	if err := s.savePeerLists(); err != nil {
+		return fmt.Errorf("failed to save peer lists: %w", err)
+	}
+	return nil
+}
+
+// AllowPeer adds a host or node to the allowlist. Once it is not empty,
+// only the peers on it are accepted.
+func (s *FileServer) AllowPeer(peer string) error {
+	entry, err := normalizePeer(peer)
+	if err != nil {
+		return err
+	}
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	if slices.Contains(s.configLists.Block, entry) || slices.Contains(s.lists.Block, entry) {
+		return fmt.Errorf("%s is blocked", entry)
+	}
+	if !slices.Contains(s.lists.Allow, entry) {
+		s.lists.Allow = append(s.lists.Allow, entry)
+	}
+	if err := s.savePeerLists(); err != nil {
+		return fmt.Errorf("failed to save peer lists: %w", err)
+	}
+	return nil
+}
+
+// DisallowPeer takes a host or node off the allowlist, disconnecting it if
+// the allowlist still has entries
+func (s *FileServer) DisallowPeer(peer string) error {
+	entry, err := normalizePeer(peer)
+	if err != nil {
+		return err
+	}
+	s.listsMu.Lock()
+	if slices.Contains(s.configLists.Allow, entry) {
+		s.listsMu.Unlock()
+		return fmt.Errorf("%s is allowed by the configuration", entry)
+	}
+	s.lists.Allow = slices.DeleteFunc(s.lists.Allow, func(e string) bool { return e == entry })
+	err = s.savePeerLists()
+	s.listsMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save peer lists: %w", err)
+	}
+	s.disconnectBlocked()
+	return nil
+}
+
+// checkPeerLists refuses a connection from addr, of node once it said
+// hello, that is blocked or not on a non-empty allowlist. Before the hello
+// a connection is only refused for its host, unless the allowlist names no
+// node that could still admit it.
+func (s *FileServer) checkPeerLists(addr string, node string) error {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+
+	host := hostOf(addr)
+	listed := func(list []string) bool {
+		return slices.Contains(list, host) || (node != "" && slices.Contains(list, node))
+	}
+	if listed(s.configLists.Block) || listed(s.lists.Block) || s.blockedAddrs[addr] != "" {
+		return fmt.Errorf("peer %s is blocked", addr)
+	}
+	allow := slices.Concat(s.configLists.Allow, s.lists.Allow)
+	if len(allow) == 0 || listed(allow) {
+		return nil
+	}
+	if node == "" && slices.ContainsFunc(allow, isNodeID) {
+		return nil // decided once it says which node it is
+	}
+	return fmt.Errorf("peer %s is not on the allowlist", addr)
+}
+
+// blockedNode reports whether node is on the blocklist
+func (s *FileServer) blockedNode(node string) bool {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	return node != "" && (slices.Contains(s.configLists.Block, node) || slices.Contains(s.lists.Block, node))
+}
+
+// blockNode remembers the addresses of a blocked node, so peer exchange
+// neither dials them nor passes them on
+func (s *FileServer) blockNode(node string, addrs ...string) {
+	s.listsMu.Lock()
+	for _, addr := range addrs {
+		if addr != "" {
+			s.blockedAddrs[addr] = node
+		}
+	}
+	s.listsMu.Unlock()
+	if s.Pex != nil {
+		for _, addr := range addrs {
+			s.Pex.RemoveKnownPeer(addr)
+		}
+	}
+}
+
+// isBlocked reports whether peer exchange should skip addr: a blocked host,
+// or an address of a blocked node
+func (s *FileServer) isBlocked(addr string) bool {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	host := hostOf(addr)
+	return slices.Contains(s.configLists.Block, host) || slices.Contains(s.lists.Block, host) || s.blockedAddrs[addr] != ""
+}
+
+// disconnectBlocked closes the connections the lists no longer admit
+func (s *FileServer) disconnectBlocked() {
+	s.pathsMu.Lock()
+	nodes := make(map[string]string, len(s.pathNode))
+	for addr, node := range s.pathNode {
+		nodes[addr] = node
+	}
+	s.pathsMu.Unlock()
+
+	s.PeerLock.Lock()
+	addrs := make([]string, 0, len(s.conns))
+	for addr := range s.conns {
+		addrs = append(addrs, addr)
+	}
+	s.PeerLock.Unlock()
+
+	for _, addr := range addrs {
+		if err := s.checkPeerLists(addr, nodes[addr]); err != nil {
+			if s.blockedNode(nodes[addr]) {
+				s.blockNode(nodes[addr], addr)
+			}
+			s.disconnectHost(addr, false)
+			s.Logger.Info("disconnected peer refused by peer lists", "peer", addr, "err", err)
+		}
+	}
+}
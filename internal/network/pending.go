@@ -0,0 +1,134 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// pendingPath is where replica pushes that have not completed are
+// journaled, so they survive a crash or restart
+func (s *FileServer) pendingPath() string {
+	return filepath.Join(s.StorageRoot, "pending.json")
+}
+
+// loadPendingPushes reads the pushes journaled before the node went down.
+// They are resumed as peers connect, like pushes that failed while running.
+// Keys no longer stored locally have nothing left to push and are dropped.
+func (s *FileServer) loadPendingPushes() error {
+	data, err := os.ReadFile(s.pendingPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.OpenRecord(data); err != nil {
+		return fmt.Errorf("failed to open pending pushes: %w", err)
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	var pending map[string]int64
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return err
+	}
+	for key, size := range pending {
+		if s.store.Has(s.ID, key) {
+			s.pendingPushes[key] = size
+		}
+	}
+	if len(s.pendingPushes) != len(pending) {
+		if err := s.savePendingPushes(); err != nil {
+			return err
+		}
+	}
+	if n := len(s.pendingPushes); n > 0 {
+		s.Logger.Info("resuming pending replica pushes", "count", n)
+		s.Metrics.AddReplicasResumed(n)
+	}
+	s.Metrics.SetPendingReplicas(len(s.pendingPushes))
+	return nil
+}
+
+// savePendingPushes persists the pending pushes. Callers hold pendingMu.
+func (s *FileServer) savePendingPushes() error {
+	if len(s.pendingPushes) == 0 {
+		if err := os.Remove(s.pendingPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(s.pendingPushes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.SealRecord(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.pendingPath(), data, 0644)
+}
+
+// addPendingPush remembers a replica push that has not completed
+func (s *FileServer) addPendingPush(key string, size int64) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if old, ok := s.pendingPushes[key]; ok && old == size {
+		return
+	}
+	s.pendingPushes[key] = size
+	s.Metrics.SetPendingReplicas(len(s.pendingPushes))
+	if err := s.savePendingPushes(); err != nil {
+		s.Logger.Warn("failed to persist pending replica pushes", "err", err)
+	}
+}
+
+// clearPendingPush forgets a replica push once every peer got the file,
+// or a peer has pulled the whole file
+func (s *FileServer) clearPendingPush(key string) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if _, ok := s.pendingPushes[key]; !ok {
+		return
+	}
+	delete(s.pendingPushes, key)
+	s.Metrics.SetPendingReplicas(len(s.pendingPushes))
+	if err := s.savePendingPushes(); err != nil {
+		s.Logger.Warn("failed to persist pending replica pushes", "err", err)
+	}
+}
+
+// PendingPushes returns how many replica pushes have not completed yet
+func (s *FileServer) PendingPushes() int {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pendingPushes)
+}
+
+// offerPendingPushes announces interrupted replica pushes to a newly connected peer.
+// The peer pulls each file it is missing, resuming from any partial copy it holds.
+func (s *FileServer) offerPendingPushes(p p2p.Peer) {
+	s.pendingMu.Lock()
+	offers := make([]MessageStoreFile, 0, len(s.pendingPushes))
+	for key, size := range s.pendingPushes {
+		offers = append(offers, MessageStoreFile{ID: s.ID, Key: key, Size: size, Clock: s.KeyStamp(key)})
+	}
+	s.pendingMu.Unlock()
+
+	for _, offer := range offers {
+		if !s.allowReplica(offer.Key, p) {
+			continue
+		}
+		if err := s.sendMessage(p, &Message{Payload: offer}); err != nil {
+			s.Logger.Warn("failed to offer pending replica", "peer", p.RemoteAddr().String(), "key", offer.Key, "err", err)
+			return
+		}
+		s.Logger.Info("offered pending replica to peer", "peer", p.RemoteAddr().String(), "key", offer.Key)
+	}
+}
@@ -1,27 +1,66 @@
 package network
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
 	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
 )
 
 // PeerInfo represents information about a peer
 type PeerInfo struct {
-	Address  string    `json:"address"`
-	LastSeen time.Time `json:"last_seen"`
-	Source   string    `json:"source"` // "bootstrap", "mdns", "pex"
+	Address  string    `json:"address" wire:"1"`
+	LastSeen time.Time `json:"last_seen" wire:"2"`
+	Source   string    `json:"source" wire:"3"` // "bootstrap", "mdns", "pex"
 }
 
-// MessagePeerExchange contains a list of known peers
+// MessagePeerExchange pushes a list of known peers. Nodes now pull peer
+// lists with MessagePexRequest, but pushed lists are still learned from.
 type MessagePeerExchange struct {
-	Peers []PeerInfo `json:"peers"`
+	Peers []PeerInfo `json:"peers" wire:"1"`
+}
+
+// MessagePexRequest asks a peer for the peers it knows. A node that got a
+// response from the same peer before sends that response's Epoch and
+// Version as Since, and gets only what changed after it.
+type MessagePexRequest struct {
+	Epoch string `wire:"1"`
+	Since uint64 `wire:"2"`
+}
+
+// MessagePexResponse answers a MessagePexRequest. A full response lists
+// every known peer in Added; a delta lists the peers added and the
+// addresses removed after the requested version. Epoch changes when the
+// responder restarts, which makes versions of the old epoch meaningless.
+type MessagePexResponse struct {
+	Epoch   string     `wire:"1"`
+	Version uint64     `wire:"2"`
+	Full    bool       `wire:"3"`
+	Added   []PeerInfo `wire:"4"`
+	Removed []string   `wire:"5"`
+}
+
+// pexChangeLog is how many changes to the known peers are kept for delta
+// responses. A requester further behind gets the full list.
+const pexChangeLog = 1024
+
+// pexChange is a peer added to or removed from the known peers
+type pexChange struct {
+	version uint64
+	addr    string
+	removed bool
+}
+
+// pexVersion is the last response received from a peer
+type pexVersion struct {
+	epoch   string
+	version uint64
 }
 
 // PeerExchangeService manages peer discovery via peer exchange
@@ -29,10 +68,17 @@ type PeerExchangeService struct {
 	knownPeers       map[string]*PeerInfo
 	peerLock         sync.RWMutex
 	server           *FileServer
-	Enabled          bool
+	enabled          atomic.Bool // set by Start and Stop, read from any goroutine
 	exchangeInterval time.Duration
 	stopCh           chan struct{}
 	logger           *slog.Logger
+
+	// Changes to knownPeers, numbered by version, and the version last
+	// received from each connected peer, all under peerLock
+	epoch   string
+	version uint64
+	changes []pexChange
+	remote  map[string]pexVersion
 }
 
 // NewPeerExchangeService creates a new PEX service
@@ -40,19 +86,24 @@ func NewPeerExchangeService(server *FileServer, pexInterval time.Duration, logge
 	if logger == nil {
 		logger = slog.Default()
 	}
+	epoch, err := crypto.GenerateID()
+	if err != nil {
+		epoch = strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
 	return &PeerExchangeService{
 		knownPeers:       make(map[string]*PeerInfo),
 		server:           server,
-		Enabled:          false,
 		exchangeInterval: pexInterval,
 		stopCh:           make(chan struct{}),
 		logger:           logger,
+		epoch:            epoch[:16],
+		remote:           make(map[string]pexVersion),
 	}
 }
 
 // Start enables peer exchange
 func (pex *PeerExchangeService) Start(ctx context.Context) {
-	pex.Enabled = true
+	pex.enabled.Store(true)
 	pex.logger.Info("Peer exchange (PEX) enabled")
 
 	// Start periodic peer list exchange
@@ -62,16 +113,21 @@ func (pex *PeerExchangeService) Start(ctx context.Context) {
 	go pex.periodicCleanup(ctx)
 }
 
+// Enabled reports whether peer exchange is running, between Start and Stop
+func (pex *PeerExchangeService) Enabled() bool {
+	return pex.enabled.Load()
+}
+
 // Stop disables peer exchange
 func (pex *PeerExchangeService) Stop() {
-	pex.Enabled = false
+	pex.enabled.Store(false)
 	close(pex.stopCh)
 	pex.logger.Info("Peer exchange (PEX) disabled")
 }
 
 // AddKnownPeer adds a peer to the known peers list
 func (pex *PeerExchangeService) AddKnownPeer(address string, source string) {
-	if !pex.Enabled {
+	if !pex.Enabled() {
 		return
 	}
 
@@ -87,16 +143,36 @@ func (pex *PeerExchangeService) AddKnownPeer(address string, source string) {
 			LastSeen: time.Now(),
 			Source:   source,
 		}
+		pex.recordLocked(address, false)
 		pex.logger.Debug("Added peer to PEX cache", "peer", address, "source", source)
 	}
 }
 
+// RemoveKnownPeer forgets a peer address, e.g. one its node no longer uses
+func (pex *PeerExchangeService) RemoveKnownPeer(address string) {
+	pex.peerLock.Lock()
+	defer pex.peerLock.Unlock()
+	if _, ok := pex.knownPeers[address]; ok {
+		delete(pex.knownPeers, address)
+		pex.recordLocked(address, true)
+	}
+}
+
+// recordLocked numbers a change to the known peers for delta responses
+func (pex *PeerExchangeService) recordLocked(address string, removed bool) {
+	pex.version++
+	pex.changes = append(pex.changes, pexChange{version: pex.version, addr: address, removed: removed})
+	if len(pex.changes) > pexChangeLog {
+		pex.changes = append([]pexChange(nil), pex.changes[len(pex.changes)-pexChangeLog:]...)
+	}
+}
+
 // GetKnownPeers returns a list of known peers (excluding self and currently connected)
 func (pex *PeerExchangeService) GetKnownPeers() []PeerInfo {
 	// Snapshot connected peers first with no PEX lock held
 	pex.server.PeerLock.Lock()
-	connectedPeers := make(map[string]bool, len(pex.server.Peers))
-	for addr := range pex.server.Peers {
+	connectedPeers := make(map[string]bool, len(pex.server.conns))
+	for addr := range pex.server.conns {
 		connectedPeers[addr] = true
 	}
 	pex.server.PeerLock.Unlock()
@@ -115,21 +191,12 @@ func (pex *PeerExchangeService) GetKnownPeers() []PeerInfo {
 	return peers
 }
 
-// periodicExchange periodically exchanges peer lists with connected peers
+// periodicExchange periodically asks connected peers what changed in
+// their peer lists. Peers are asked for their full list when they connect.
 func (pex *PeerExchangeService) periodicExchange(ctx context.Context) {
 	ticker := time.NewTicker(pex.exchangeInterval)
 	defer ticker.Stop()
 
-	// Do initial exchange after 30 seconds (cancellable)
-	select {
-	case <-time.After(30 * time.Second):
-		pex.exchangePeerLists()
-	case <-ctx.Done():
-		return
-	case <-pex.stopCh:
-		return
-	}
-
 	for {
 		select {
 		case <-ticker.C:
@@ -142,58 +209,146 @@ func (pex *PeerExchangeService) periodicExchange(ctx context.Context) {
 	}
 }
 
-// exchangePeerLists sends our peer list to all connected peers
+// exchangePeerLists asks every connected peer for the changes to its peer
+// list since its last response
 func (pex *PeerExchangeService) exchangePeerLists() {
-	if !pex.Enabled {
+	if !pex.Enabled() {
 		return
 	}
 
-	// Get our list of known peers
-	knownPeers := pex.GetKnownPeers()
-
-	// Limit to 20 peers to avoid large messages
-	if len(knownPeers) > 20 {
-		knownPeers = knownPeers[:20]
+	for _, peer := range pex.server.broadcastPeers() {
+		if err := pex.request(peer); err != nil {
+			pex.logger.Debug("Failed to request peer list", "peer", peer.RemoteAddr().String(), "err", err)
+		}
 	}
+}
+
+// request asks peer for its peer list, or what changed in it since the
+// last response from the same connection
+func (pex *PeerExchangeService) request(peer p2p.Peer) error {
+	pex.peerLock.RLock()
+	last := pex.remote[peer.RemoteAddr().String()]
+	pex.peerLock.RUnlock()
+
+	msg := Message{Payload: MessagePexRequest{Epoch: last.epoch, Since: last.version}}
+	return pex.server.sendMessage(peer, &msg)
+}
 
-	if len(knownPeers) == 0 {
+// peerConnected asks a new peer for its full peer list right away
+func (pex *PeerExchangeService) peerConnected(peer p2p.Peer) {
+	if !pex.Enabled() {
 		return
 	}
+	if err := pex.request(peer); err != nil {
+		pex.logger.Debug("Failed to request peer list", "peer", peer.RemoteAddr().String(), "err", err)
+	}
+}
+
+// peerClosed forgets the last response from a closed connection
+func (pex *PeerExchangeService) peerClosed(addr string) {
+	pex.peerLock.Lock()
+	defer pex.peerLock.Unlock()
+	delete(pex.remote, addr)
+}
+
+// response builds the answer to req: the changes after req.Since if they
+// are all still in the change log, and the full list otherwise
+func (pex *PeerExchangeService) response(req MessagePexRequest) MessagePexResponse {
+	pex.peerLock.RLock()
+	defer pex.peerLock.RUnlock()
+
+	resp := MessagePexResponse{Epoch: pex.epoch, Version: pex.version}
+	oldest := pex.version - uint64(len(pex.changes)) // changes after this are logged
+	if req.Epoch != pex.epoch || req.Since > pex.version || req.Since < oldest {
+		resp.Full = true
+		for _, peer := range pex.knownPeers {
+			if !pex.server.isBlocked(peer.Address) {
+				resp.Added = append(resp.Added, *peer)
+			}
+		}
+		return resp
+	}
 
-	// Create peer exchange message
-	msg := Message{
-		Payload: MessagePeerExchange{
-			Peers: knownPeers,
-		},
+	// Only the last change to each address matters
+	latest := make(map[string]bool)
+	for _, c := range pex.changes {
+		if c.version > req.Since {
+			latest[c.addr] = c.removed
+		}
+	}
+	for addr, removed := range latest {
+		if removed {
+			resp.Removed = append(resp.Removed, addr)
+		} else if peer, ok := pex.knownPeers[addr]; ok && !pex.server.isBlocked(addr) {
+			resp.Added = append(resp.Added, *peer)
+		}
 	}
+	return resp
+}
 
-	// Broadcast to all connected peers
-	if err := pex.server.broadcast(&msg); err != nil {
-		pex.logger.Debug("Failed to broadcast peer list", "err", err)
-	} else {
-		pex.logger.Debug("Exchanged peer list", "count", len(knownPeers))
+// HandlePexRequest answers a peer list request right away
+func (pex *PeerExchangeService) HandlePexRequest(from string, msg MessagePexRequest) error {
+	if !pex.Enabled() {
+		return nil
 	}
+	peer, ok := pex.server.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	resp := pex.response(msg)
+	pex.logger.Debug("Answering peer list request", "peer", from, "full", resp.Full, "added", len(resp.Added), "removed", len(resp.Removed))
+	return pex.server.sendMessage(peer, &Message{Payload: resp})
 }
 
-// HandlePeerExchange processes a peer exchange message from another peer
+// HandlePexResponse learns the peers of a response and remembers its
+// version for the next request. Removed addresses are only forgotten if
+// they were learned through peer exchange in the first place.
+func (pex *PeerExchangeService) HandlePexResponse(ctx context.Context, from string, msg MessagePexResponse) error {
+	if !pex.Enabled() {
+		return nil
+	}
+
+	pex.peerLock.Lock()
+	pex.remote[from] = pexVersion{epoch: msg.Epoch, version: msg.Version}
+	for _, addr := range msg.Removed {
+		if peer, ok := pex.knownPeers[addr]; ok && peer.Source == "pex" {
+			delete(pex.knownPeers, addr)
+			pex.recordLocked(addr, true)
+		}
+	}
+	pex.peerLock.Unlock()
+
+	return pex.learnPeers(ctx, from, msg.Added)
+}
+
+// HandlePeerExchange processes a pushed peer list from another peer
 func (pex *PeerExchangeService) HandlePeerExchange(ctx context.Context, from string, msg MessagePeerExchange) error {
-	if !pex.Enabled {
+	if !pex.Enabled() {
 		return nil
 	}
+	return pex.learnPeers(ctx, from, msg.Peers)
+}
 
-	pex.logger.Debug("Received peers via PEX", "count", len(msg.Peers), "from", from)
+// learnPeers adds the peers it did not know yet and connects to them
+func (pex *PeerExchangeService) learnPeers(ctx context.Context, from string, peers []PeerInfo) error {
+	pex.logger.Debug("Received peers via PEX", "count", len(peers), "from", from)
 
 	newPeersFound := 0
 
-	for _, peer := range msg.Peers {
+	for _, peer := range peers {
 		// Skip if it's our own address
 		if peer.Address == pex.server.Transport.Addr() {
 			continue
 		}
 
+		// Skip banned and blocked peers
+		if pex.server.IsBanned(peer.Address) || pex.server.isBlocked(peer.Address) {
+			continue
+		}
+
 		// Skip if we're already connected
 		pex.server.PeerLock.Lock()
-		_, alreadyConnected := pex.server.Peers[peer.Address]
+		_, alreadyConnected := pex.server.conns[peer.Address]
 		pex.server.PeerLock.Unlock()
 
 		if alreadyConnected {
@@ -219,8 +374,12 @@ func (pex *PeerExchangeService) HandlePeerExchange(ctx context.Context, from str
 				return
 			}
 			pex.logger.Info("Attempting to connect to peer learned via PEX", "peer", addr)
-			if err := pex.server.Transport.Dial(addr); err != nil {
-				pex.logger.Debug("Failed to connect to PEX peer", "peer", addr, "err", err)
+			if err := pex.server.dial(addr); err != nil {
+				pex.logger.Debug("Failed to connect to PEX peer, asking peers for an introduction", "peer", addr, "err", err)
+				// The peer may be behind a NAT that drops incoming connections
+				if err := pex.server.Rendezvous(ctx, addr); err != nil {
+					pex.logger.Debug("Failed to connect to PEX peer", "peer", addr, "err", err)
+				}
 			} else {
 				pex.logger.Info("Successfully connected to peer learned via PEX", "peer", addr)
 			}
@@ -262,6 +421,7 @@ func (pex *PeerExchangeService) cleanupOldPeers() {
 	for addr, peer := range pex.knownPeers {
 		if peer.LastSeen.Before(cutoff) {
 			delete(pex.knownPeers, addr)
+			pex.recordLocked(addr, true)
 			removed++
 		}
 	}
@@ -310,37 +470,35 @@ func (s *FileServer) handleMessagePeerExchange(ctx context.Context, from string,
 	return nil
 }
 
+func (s *FileServer) handleMessagePexRequest(from string, msg MessagePexRequest) error {
+	if s.Pex != nil {
+		return s.Pex.HandlePexRequest(from, msg)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessagePexResponse(ctx context.Context, from string, msg MessagePexResponse) error {
+	if s.Pex != nil {
+		return s.Pex.HandlePexResponse(ctx, from, msg)
+	}
+	return nil
+}
+
 // RequestPeerList explicitly requests a peer list from a specific peer
 func (pex *PeerExchangeService) RequestPeerList(peerAddr string) error {
-	if !pex.Enabled {
+	if !pex.Enabled() {
 		return fmt.Errorf("PEX is not enabled")
 	}
 
 	pex.server.PeerLock.Lock()
-	peer, exists := pex.server.Peers[peerAddr]
+	peer, exists := pex.server.conns[peerAddr]
 	pex.server.PeerLock.Unlock()
 
 	if !exists {
 		return fmt.Errorf("peer %s not found", peerAddr)
 	}
 
-	// Send request message (we'll just send an empty PEX message as a request)
-	msg := Message{
-		Payload: MessagePeerExchange{
-			Peers: []PeerInfo{},
-		},
-	}
-
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(&msg); err != nil {
-		return err
-	}
-
-	if err := peer.Send([]byte{p2p.IncomingMessage}); err != nil {
-		return err
-	}
-
-	if err := peer.Send(buf.Bytes()); err != nil {
+	if err := pex.request(peer); err != nil {
 		return err
 	}
 
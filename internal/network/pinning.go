@@ -0,0 +1,98 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// pinAttempts is how many times a file is offered to the pinning service
+// before giving up
+const pinAttempts = 5
+
+// Pinner keeps a copy of every stored file on a remote, always-on service,
+// so files survive while all of the user's nodes are offline. Files are
+// pinned encrypted and under their hashed key: the service learns neither
+// names nor contents.
+type Pinner interface {
+	// Pin uploads size bytes of an encrypted file
+	Pin(ctx context.Context, hash string, size int64, r io.Reader) error
+	// Fetch downloads a pinned file, returning an error wrapping ErrNotFound
+	// if the service does not have it
+	Fetch(ctx context.Context, hash string) (io.ReadCloser, error)
+}
+
+// pinFile uploads a stored file to the pinning service, retrying with
+// backoff while the service cannot be reached
+func (s *FileServer) pinFile(key string) {
+	hash := crypto.HashKey(key)
+	delay := 2 * time.Second
+
+	for attempt := 1; ; attempt++ {
+		err := s.pinOnce(key, hash)
+		if err == nil {
+			s.Logger.Info("pinned file", "key", key)
+			return
+		}
+		if errors.Is(err, ErrServerClosed) {
+			s.Logger.Warn("shutting down, file not pinned", "key", key)
+			return
+		}
+		if attempt == pinAttempts {
+			s.Logger.Error("failed to pin file", "key", key, "attempts", attempt, "err", err)
+			return
+		}
+		s.Logger.Warn("failed to pin file, retrying", "key", key, "in", delay, "err", err)
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-s.quitch:
+			return
+		case <-s.drainch:
+			return
+		}
+	}
+}
+
+func (s *FileServer) pinOnce(key, hash string) error {
+	// Shutdown waits for a pin in progress, like for any upload
+	done, err := s.beginTransfer(true)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	size, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	return s.Pinner.Pin(ctx, hash, size, r)
+}
+
+// fetchPinned restores a file from the pinning service into local storage
+func (s *FileServer) fetchPinned(ctx context.Context, key string) error {
+	s.Logger.Info("fetching file from pinning service", "key", key)
+
+	rc, err := s.Pinner.Fetch(ctx, crypto.HashKey(key))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := s.store.Write(s.ID, key, contextReader{ctx: ctx, r: rc}); err != nil {
+		s.store.Delete(s.ID, key)
+		return fmt.Errorf("failed to restore %s from pinning service: %w", key, err)
+	}
+	return nil
+}
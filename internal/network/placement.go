@@ -0,0 +1,75 @@
+package network
+
+import (
+	"sort"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// ReplicaCandidate is a peer a file may be replicated to, as seen by a
+// PlacementFunc
+type ReplicaCandidate struct {
+	Node   string // fingerprint of the node's public key, empty until it said hello
+	Addr   string
+	RTT    time.Duration     // zero until measured
+	Labels map[string]string // labels the node announced, e.g. zone=eu
+}
+
+// PlacementFunc lets an embedding application control where a key is
+// replicated. It receives the peers replication would use and returns the
+// ones to use instead: a subset redirects the key, an empty result vetoes
+// replication. Candidates that were not offered are ignored.
+type PlacementFunc func(key string, candidates []ReplicaCandidate) []ReplicaCandidate
+
+// placeReplicas filters the peers a key would be replicated to through the
+// Placement callback
+func (s *FileServer) placeReplicas(key string, peers map[string]p2p.Peer) map[string]p2p.Peer {
+	if s.Placement == nil || len(peers) == 0 {
+		return peers
+	}
+
+	addrs := make([]string, 0, len(peers))
+	for addr := range peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	candidates := make([]ReplicaCandidate, 0, len(addrs))
+	s.pathsMu.Lock()
+	for _, addr := range addrs {
+		c := ReplicaCandidate{Addr: addr}
+		if node, ok := s.pathNode[addr]; ok {
+			c.Node = node
+			c.Labels = s.nodeLabels[node]
+			for _, path := range s.nodePaths[node] {
+				if path.addr == addr {
+					c.RTT, _ = path.latency()
+				}
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	s.pathsMu.Unlock()
+
+	placed := make(map[string]p2p.Peer)
+	for _, c := range s.Placement(key, candidates) {
+		if peer, ok := peers[c.Addr]; ok {
+			placed[c.Addr] = peer
+		}
+	}
+	if len(placed) < len(peers) {
+		s.Logger.Debug("placement restricted replicas", "key", key, "candidates", len(peers), "placed", len(placed))
+	}
+	return placed
+}
+
+// allowReplica reports whether the Placement callback lets key be
+// replicated to peer
+func (s *FileServer) allowReplica(key string, peer p2p.Peer) bool {
+	if s.Placement == nil {
+		return true
+	}
+	addr := peer.RemoteAddr().String()
+	return len(s.placeReplicas(key, map[string]p2p.Peer{addr: peer})) == 1
+}
@@ -0,0 +1,308 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// ErrRetention is returned when removing a file its retention rule still keeps
+var ErrRetention = errors.New("file is under retention")
+
+// Settings of a shared policy a node can keep from its own configuration,
+// see FileServerOpts.PolicyOverrides
+const (
+	PolicyReplicationFactor = "replication_factor"
+	PolicyDenylist          = "denylist"
+	PolicyRetention         = "retention"
+)
+
+// RetentionRule keeps files whose key starts with Prefix from being deleted
+// until they are MinAge old. An empty prefix covers every file.
+type RetentionRule struct {
+	Prefix string        `json:"prefix" wire:"1"`
+	MinAge time.Duration `json:"min_age" wire:"2"`
+}
+
+// Policy is a set of settings an admin node shares with the whole network.
+// Each published policy gets a higher Version and replaces the previous one
+// on every node that trusts its signer (FileServerOpts.PolicyAdmins).
+type Policy struct {
+	Version           uint64          `json:"version" wire:"1"`
+	ReplicationFactor int             `json:"replication_factor,omitempty" wire:"2"` // 0 keeps each node's own setting
+	Denylist          []string        `json:"denylist,omitempty" wire:"3"`           // Hosts refused as peers
+	Retention         []RetentionRule `json:"retention,omitempty" wire:"4"`
+	Published         time.Time       `json:"published" wire:"5"`
+	PublicKey         []byte          `json:"public_key" wire:"6"`
+	Signature         []byte          `json:"signature" wire:"7"`
+}
+
+// Publisher is the fingerprint of the key that signed the policy
+func (p *Policy) Publisher() string {
+	return crypto.Fingerprint(p.PublicKey)
+}
+
+// signingPayload is the serialized policy without its signature
+func (p *Policy) signingPayload() ([]byte, error) {
+	unsigned := *p
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// verify checks the policy's signature
+func (p *Policy) verify() error {
+	payload, err := p.signingPayload()
+	if err != nil {
+		return err
+	}
+	if !crypto.VerifySignature(p.PublicKey, payload, p.Signature) {
+		return fmt.Errorf("invalid policy signature")
+	}
+	return nil
+}
+
+// MessagePolicy carries the current shared policy. Nodes send it to every
+// peer that connects and forward newer versions they accept, so a policy
+// reaches nodes that were offline when it was published.
+type MessagePolicy struct {
+	Policy Policy `wire:"1"`
+}
+
+// PublishPolicy signs p with this node's identity as the next version of the
+// shared policy, applies it and sends it to the network. Other nodes only
+// apply it if this node's fingerprint is one of their PolicyAdmins.
+func (s *FileServer) PublishPolicy(p Policy) (Policy, error) {
+	if s.IsGuest() {
+		return Policy{}, fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	if p.ReplicationFactor < 0 {
+		return Policy{}, fmt.Errorf("invalid replication factor %d", p.ReplicationFactor)
+	}
+	for _, r := range p.Retention {
+		if r.MinAge <= 0 {
+			return Policy{}, fmt.Errorf("retention for %q needs a positive minimum age", r.Prefix)
+		}
+	}
+
+	s.policyMu.Lock()
+	if s.policy != nil {
+		p.Version = s.policy.Version + 1
+	} else {
+		p.Version = 1
+	}
+	p.Published = time.Now().UTC()
+	p.PublicKey = s.Identity.PublicKey
+	p.Signature = nil
+	payload, err := p.signingPayload()
+	if err != nil {
+		s.policyMu.Unlock()
+		return Policy{}, err
+	}
+	p.Signature = s.Identity.Sign(payload)
+
+	prev := s.policy
+	s.policy = &p
+	if err := s.savePolicy(); err != nil {
+		s.policy = prev
+		s.policyMu.Unlock()
+		return Policy{}, fmt.Errorf("failed to persist policy: %w", err)
+	}
+	s.policyMu.Unlock()
+
+	s.applyPolicy(&p)
+	msg := Message{Payload: MessagePolicy{Policy: p}}
+	if err := s.broadcast(context.Background(), &msg); err != nil {
+		s.Logger.Warn("policy broadcast encountered errors", "err", err)
+	}
+	return p, nil
+}
+
+// CurrentPolicy returns the shared policy in effect, if any
+func (s *FileServer) CurrentPolicy() (Policy, bool) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if s.policy == nil {
+		return Policy{}, false
+	}
+	return *s.policy, true
+}
+
+// overrides reports whether this node keeps its own value for a policy setting
+func (s *FileServer) overrides(setting string) bool {
+	return slices.Contains(s.PolicyOverrides, setting)
+}
+
+// isPolicyAdmin reports whether policies signed by publicKey are applied
+func (s *FileServer) isPolicyAdmin(publicKey []byte) bool {
+	if len(publicKey) == 0 {
+		return false
+	}
+	return slices.Contains(s.PolicyAdmins, crypto.Fingerprint(publicKey))
+}
+
+// replicationFactor is the number of copies to keep of every file, from the
+// shared policy unless this node overrides it
+func (s *FileServer) replicationFactor() int {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if s.policy != nil && s.policy.ReplicationFactor > 0 && !s.overrides(PolicyReplicationFactor) {
+		return s.policy.ReplicationFactor
+	}
+	return s.ReplicationFactor
+}
+
+// denied reports whether the shared policy refuses the host of addr
+func (s *FileServer) denied(addr string) bool {
+	if s.overrides(PolicyDenylist) {
+		return false
+	}
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if s.policy == nil {
+		return false
+	}
+	return slices.Contains(s.policy.Denylist, hostOf(addr))
+}
+
+// checkRetention refuses to remove a file that a retention rule of the
+// shared policy still keeps
+func (s *FileServer) checkRetention(key string) error {
+	if s.overrides(PolicyRetention) {
+		return nil
+	}
+	s.policyMu.Lock()
+	var rules []RetentionRule
+	if s.policy != nil {
+		rules = s.policy.Retention
+	}
+	s.policyMu.Unlock()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	stored, err := s.store.ModTime(s.ID, key)
+	if err != nil {
+		return err
+	}
+	age := time.Since(stored)
+	for _, r := range rules {
+		if strings.HasPrefix(key, r.Prefix) && age < r.MinAge {
+			return fmt.Errorf("%s: %w until %s", key, ErrRetention, stored.Add(r.MinAge).Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// applyPolicy enforces the parts of a policy that act immediately: peers on
+// denied hosts are disconnected. The replication factor and retention rules
+// are read from the policy whenever they are used.
+func (s *FileServer) applyPolicy(p *Policy) {
+	if !s.overrides(PolicyDenylist) {
+		for _, host := range p.Denylist {
+			if n := s.disconnectHost(host, true); n > 0 {
+				s.Logger.Info("disconnected denied host", "host", host, "peers", n)
+			}
+		}
+	}
+	s.Logger.Info("applied shared policy", "version", p.Version, "publisher", p.Publisher())
+	s.Events.Publish(events.Event{
+		Type:   events.PolicyApplied,
+		Detail: fmt.Sprintf("version %d from %s", p.Version, p.Publisher()),
+	})
+}
+
+// sendPolicy offers the current policy to a peer that just connected
+func (s *FileServer) sendPolicy(peer p2p.Peer) {
+	p, ok := s.CurrentPolicy()
+	if !ok {
+		return
+	}
+	msg := Message{Payload: MessagePolicy{Policy: p}}
+	if err := s.sendMessage(peer, &msg); err != nil {
+		s.Logger.Warn("failed to send policy", "peer", peer.RemoteAddr().String(), "err", err)
+	}
+}
+
+// handleMessagePolicy applies a policy signed by one of this node's policy
+// admins if it is newer than the current one, and passes it on
+func (s *FileServer) handleMessagePolicy(from string, msg MessagePolicy) error {
+	p := msg.Policy
+	if err := p.verify(); err != nil {
+		return fmt.Errorf("policy from %s: %w", from, err)
+	}
+	if !s.isPolicyAdmin(p.PublicKey) {
+		s.Logger.Debug("ignoring policy from unknown publisher", "peer", from, "publisher", p.Publisher())
+		return nil
+	}
+
+	s.policyMu.Lock()
+	if s.policy != nil && s.policy.Version >= p.Version {
+		s.policyMu.Unlock()
+		return nil
+	}
+	prev := s.policy
+	s.policy = &p
+	if err := s.savePolicy(); err != nil {
+		s.policy = prev
+		s.policyMu.Unlock()
+		return fmt.Errorf("failed to persist policy: %w", err)
+	}
+	s.policyMu.Unlock()
+
+	s.applyPolicy(&p)
+	fwd := Message{Payload: MessagePolicy{Policy: p}}
+	if err := s.broadcast(context.Background(), &fwd); err != nil {
+		s.Logger.Warn("policy forward encountered errors", "err", err)
+	}
+	return nil
+}
+
+// policyPath is where the shared policy is persisted
+func (s *FileServer) policyPath() string {
+	return filepath.Join(s.StorageRoot, "policy.json")
+}
+
+// loadPolicy reads the persisted shared policy, if any
+func (s *FileServer) loadPolicy() error {
+	data, err := os.ReadFile(s.policyPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	if err := p.verify(); err != nil {
+		return err
+	}
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.policy = &p
+	return nil
+}
+
+// savePolicy persists the shared policy. Callers hold policyMu.
+func (s *FileServer) savePolicy() error {
+	data, err := json.MarshalIndent(s.policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.policyPath(), data, 0644)
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// defaultReadahead is how far sequential range reads of remote files
+	// are read ahead
+	defaultReadahead = 4 * 1024 * 1024
+	// readaheadIdle is how long the read-ahead of a file is kept after
+	// its last range read
+	readaheadIdle = 30 * time.Second
+)
+
+// prefetch is a range of a remote file read ahead of a sequential reader
+type prefetch struct {
+	at     int64
+	length int64
+	done   chan struct{} // closed once data or err is set
+	data   []byte        // shorter than length if the file ends first
+	err    error
+}
+
+// end returns the offset after the data read ahead
+func (p *prefetch) end() int64 {
+	return p.at + int64(len(p.data))
+}
+
+// readahead tracks the range reads of one remote file. Reads that start
+// where the previous one ended are sequential, as with media playback,
+// and the ranges after them are fetched in the background.
+type readahead struct {
+	next    int64       // offset a sequential read continues at
+	skip    int64       // bytes of the compression header before the content
+	windows []*prefetch // contiguous, from next on
+	used    time.Time
+}
+
+// readaheadSkip returns the bytes before the content of key if it was read
+// in ranges recently
+func (s *FileServer) readaheadSkip(key string) (int64, bool) {
+	s.readaheadMu.Lock()
+	defer s.readaheadMu.Unlock()
+	ra, ok := s.readaheads[key]
+	if !ok || time.Since(ra.used) > readaheadIdle {
+		return 0, false
+	}
+	return ra.skip, true
+}
+
+// readAhead reads a range of the plaintext of key from peers, from the
+// ranges already read ahead where it can, and reads further ahead if the
+// reads of key are sequential. The content of key starts after skip bytes.
+func (s *FileServer) readAhead(ctx context.Context, encKey []byte, key string, skip int64, offset int64, length int64) ([]byte, error) {
+	if s.Readahead < 0 {
+		return s.readRemoteRange(ctx, encKey, key, offset, length)
+	}
+
+	s.readaheadMu.Lock()
+	for k, ra := range s.readaheads {
+		if time.Since(ra.used) > readaheadIdle {
+			delete(s.readaheads, k)
+		}
+	}
+	ra, sequential := s.readaheads[key]
+	if !sequential || ra.next != offset {
+		ra = &readahead{skip: skip}
+		s.readaheads[key] = ra
+		sequential = false
+	}
+	ra.used = time.Now()
+	windows := ra.windows
+	s.readaheadMu.Unlock()
+
+	data, ended, err := readWindows(ctx, windows, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < length && !ended {
+		rest, err := s.readRemoteRange(ctx, encKey, key, offset+int64(len(data)), length-int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, rest...)
+		ended = int64(len(data)) < length
+	}
+
+	s.readaheadMu.Lock()
+	defer s.readaheadMu.Unlock()
+	if s.readaheads[key] != ra {
+		return data, nil // another read of key started over
+	}
+	ra.next = offset + int64(len(data))
+	for len(ra.windows) > 0 && ra.windows[0].at+ra.windows[0].length <= ra.next {
+		ra.windows = ra.windows[1:]
+	}
+	if sequential && !ended {
+		s.extendReadahead(encKey, key, ra)
+	}
+	return data, nil
+}
+
+// readWindows copies the range at offset from windows, stopping at the
+// first one that is missing or failed. It reports whether the file ended
+// within the range.
+func readWindows(ctx context.Context, windows []*prefetch, offset int64, length int64) ([]byte, bool, error) {
+	var data []byte
+	for _, w := range windows {
+		pos := offset + int64(len(data))
+		if pos >= offset+length || w.at > pos {
+			break
+		}
+		if pos >= w.at+w.length {
+			continue
+		}
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if w.err != nil {
+			break
+		}
+		if pos < w.end() {
+			data = append(data, w.data[pos-w.at:min(w.end(), offset+length)-w.at]...)
+		}
+		if int64(len(w.data)) < w.length {
+			return data, true, nil
+		}
+	}
+	return data, false, nil
+}
+
+// extendReadahead starts fetching the ranges after ra.next, unless at
+// least half of the read-ahead window is fetched or being fetched.
+// Callers hold readaheadMu.
+func (s *FileServer) extendReadahead(encKey []byte, key string, ra *readahead) {
+	window := s.Readahead
+	if window == 0 {
+		window = defaultReadahead
+	}
+	from := ra.next
+	if n := len(ra.windows); n > 0 {
+		last := ra.windows[n-1]
+		select {
+		case <-last.done:
+			if last.err != nil || int64(len(last.data)) < last.length {
+				return // nothing more to read ahead until reads catch up
+			}
+		default:
+		}
+		from = last.at + last.length
+	}
+	if ahead := from - ra.next; ahead >= window/2 {
+		return
+	}
+
+	p := &prefetch{at: from, length: window - (from - ra.next), done: make(chan struct{})}
+	ra.windows = append(ra.windows, p)
+	go func() {
+		defer close(p.done)
+		p.data, p.err = s.readRemoteRange(context.Background(), encKey, key, p.at, p.length)
+		if p.err != nil {
+			s.Logger.Debug("failed to read ahead", "key", key, "offset", p.at, "err", p.err)
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// probeDialTimeout bounds how long a peer tries to connect back to a prober
+const probeDialTimeout = 3 * time.Second
+
+// MessageProbe asks a peer to connect back to the sender on Port, at the IP
+// address the peer sees the sender's connection come from. Only the port is
+// sent, so a node cannot be used to connect to anyone but the sender.
+type MessageProbe struct {
+	RequestID string `wire:"1"`
+	Port      int    `wire:"2"`
+}
+
+// MessageProbeResult tells a prober whether its port could be reached
+type MessageProbeResult struct {
+	RequestID string `wire:"1"`
+	Addr      string `wire:"2"` // address the peer connected to
+	Reachable bool   `wire:"3"`
+	Err       string `wire:"4"`
+}
+
+// ProbeResult is the answer of one peer to ProbeReachability
+type ProbeResult struct {
+	Peer      string
+	Addr      string // this node's address as the peer sees it
+	Reachable bool
+	Err       string
+}
+
+// ProbeReachability asks every connected node to open a TCP connection to
+// port on this node, from the outside. Nodes that do not answer in time are
+// left out of the result.
+func (s *FileServer) ProbeReachability(ctx context.Context, port int) ([]ProbeResult, error) {
+	requestID, err := crypto.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	peers := s.broadcastPeers()
+
+	replies := make(chan ProbeResult, len(peers))
+	s.probeMu.Lock()
+	s.probes[requestID] = replies
+	s.probeMu.Unlock()
+	defer func() {
+		s.probeMu.Lock()
+		delete(s.probes, requestID)
+		s.probeMu.Unlock()
+	}()
+
+	msg := Message{Payload: MessageProbe{RequestID: requestID, Port: port}}
+	for _, peer := range peers {
+		if err := s.sendMessage(peer, &msg); err != nil {
+			s.Logger.Warn("failed to send reachability probe", "peer", peer.RemoteAddr().String(), "err", err)
+		}
+	}
+
+	var results []ProbeResult
+	timeout := time.NewTimer(s.FetchTimeout + probeDialTimeout)
+	defer timeout.Stop()
+	for expected := len(peers); len(results) < expected; {
+		select {
+		case r := <-replies:
+			results = append(results, r)
+		case <-timeout.C:
+			s.Logger.Warn("some peers did not answer the reachability probe", "answered", len(results), "peers", expected)
+			expected = len(results)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Peer < results[j].Peer
+	})
+	return results, nil
+}
+
+// handleMessageProbe connects back to the sender and reports the outcome.
+// Dialing takes a while, so it does not hold up the connection's messages.
+func (s *FileServer) handleMessageProbe(from string, msg MessageProbe) error {
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return err
+	}
+	if msg.Port <= 0 || msg.Port > 65535 {
+		return fmt.Errorf("invalid probe port %d", msg.Port)
+	}
+
+	go func() {
+		result := MessageProbeResult{RequestID: msg.RequestID, Addr: net.JoinHostPort(host, fmt.Sprint(msg.Port))}
+		conn, err := net.DialTimeout("tcp", result.Addr, probeDialTimeout)
+		if err != nil {
+			result.Err = err.Error()
+		} else {
+			conn.Close()
+			result.Reachable = true
+		}
+		reply := Message{Payload: result}
+		if err := s.sendMessage(peer, &reply); err != nil {
+			s.Logger.Debug("failed to answer reachability probe", "peer", from, "err", err)
+		}
+	}()
+	return nil
+}
+
+// handleMessageProbeResult hands a probe result to the prober waiting for it
+func (s *FileServer) handleMessageProbeResult(from string, msg MessageProbeResult) error {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	replies, ok := s.probes[msg.RequestID]
+	if !ok {
+		return nil // probe already finished
+	}
+	select {
+	case replies <- ProbeResult{Peer: from, Addr: msg.Addr, Reachable: msg.Reachable, Err: msg.Err}:
+	default:
+	}
+	return nil
+}
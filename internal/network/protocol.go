@@ -0,0 +1,164 @@
+package network
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtocolVersion is the version of the message protocol this node speaks.
+// Nodes that announce no version in their hello speak version 1. Version 2
+// added capabilities, version 3 the protobuf encoding (see wire.go).
+const ProtocolVersion = 3
+
+// Capabilities announced in the hello. A feature that changes what is sent
+// on the wire checks that the peer announced it, so older peers keep
+// working without it.
+const (
+	CapRanges = "ranges" // serves byte ranges of a file for parallel downloads
+	CapRelay  = "relay"  // relays connections between peers it introduces
+
+	CapProtobuf  = "protobuf"  // decodes messages encoded as in wire.proto
+	CapMux       = "mux"       // takes several streams at once over one connection
+	CapHeartbeat = "heartbeat" // answers pings, so a connection to it that goes silent is closed
+)
+
+// ErrUnsupported is returned when sending a message a peer announced it
+// cannot decode
+var ErrUnsupported = errors.New("message not supported by peer")
+
+// messageTypes are the names of the message payloads this node decodes,
+// announced in the hello so newer nodes do not send it types it does not
+// know. Sending an unknown type only makes the receiver drop it, but the
+// error it logs for every such message hides real decoding problems.
+var messageTypes []string
+
+// registerMessage registers a message payload under its type number in
+// wire.proto, and with gob for peers that predate the protobuf encoding
+func registerMessage(num protowire.Number, payload any) {
+	registerWireType(num, payload)
+	gob.Register(payload)
+	messageTypes = append(messageTypes, messageName(payload))
+}
+
+// messageName is how a payload type is named in the hello
+func messageName(payload any) string {
+	return fmt.Sprintf("%T", payload)
+}
+
+// peerProtocol is what a connected peer announced in its hello
+type peerProtocol struct {
+	version  int
+	messages map[string]bool // nil for nodes that announce no message types
+	caps     []string
+}
+
+// capabilities returns the capabilities this node announces
+func (s *FileServer) capabilities() []string {
+	caps := []string{CapRanges, CapProtobuf}
+	if _, ok := s.Transport.(multiplexer); ok {
+		caps = append(caps, CapMux)
+	}
+	if _, ok := s.Transport.(heartbeatTransport); ok {
+		caps = append(caps, CapHeartbeat)
+	}
+	if s.RelayAddr != "" {
+		caps = append(caps, CapRelay)
+	}
+	return caps
+}
+
+// multiplexer is implemented by transports that carry several streams over
+// one connection, see p2p.TCPTransport.Multiplexed
+type multiplexer interface {
+	Multiplexed() bool
+}
+
+// heartbeatTransport is implemented by transports that answer pings, see
+// p2p.TCPTransport.Heartbeats
+type heartbeatTransport interface {
+	Heartbeats() bool
+}
+
+// heartbeater is implemented by peers that can ping the remote node to
+// find out the connection went dead, see p2p.TCPPeer.StartHeartbeat
+type heartbeater interface {
+	StartHeartbeat()
+}
+
+// liveness is implemented by peers that measure the round trip of their
+// heartbeats, see p2p.TCPPeer.RTT
+type liveness interface {
+	RTT() time.Duration
+	Suspect() bool
+}
+
+// speaksMux reports whether streams to a peer are multiplexed, so they run
+// alongside other streams and messages to it
+func (s *FileServer) speaksMux(peer p2p.Peer) bool {
+	_, ok := peer.(p2p.StreamOpener)
+	return ok && s.PeerSupports(peer.RemoteAddr().String(), CapMux)
+}
+
+// recordProtocol keeps the protocol a peer announced in its hello
+func (s *FileServer) recordProtocol(addr string, msg MessageHello) {
+	proto := &peerProtocol{version: max(msg.Version, 1), caps: msg.Caps}
+	if msg.Messages != nil {
+		proto.messages = make(map[string]bool, len(msg.Messages))
+		for _, name := range msg.Messages {
+			proto.messages[name] = true
+		}
+	}
+	switch {
+	case proto.version < ProtocolVersion:
+		s.Logger.Info("peer speaks an older protocol, newer features are not used with it", "peer", addr, "version", proto.version)
+	case proto.version > ProtocolVersion:
+		s.Logger.Info("peer speaks a newer protocol", "peer", addr, "version", proto.version)
+	}
+
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+	s.protocols[addr] = proto
+}
+
+// forgetProtocol drops what a disconnected peer announced
+func (s *FileServer) forgetProtocol(addr string) {
+	s.protoMu.Lock()
+	defer s.protoMu.Unlock()
+	delete(s.protocols, addr)
+}
+
+// peerProtocolOf returns what a peer announced, or nil before its hello
+func (s *FileServer) peerProtocolOf(addr string) *peerProtocol {
+	s.protoMu.RLock()
+	defer s.protoMu.RUnlock()
+	return s.protocols[addr]
+}
+
+// accepts reports whether a peer can decode a message payload. Peers that
+// have not said which types they decode, because their hello is yet to
+// come or they predate it, are sent everything.
+func (s *FileServer) accepts(peer p2p.Peer, payload any) bool {
+	proto := s.peerProtocolOf(peer.RemoteAddr().String())
+	if proto == nil || proto.messages == nil {
+		return true
+	}
+	return proto.messages[messageName(payload)]
+}
+
+// PeerSupports reports whether the peer at addr announced a capability.
+// Peers that announced none, because their hello is yet to come or they
+// predate capabilities, are assumed to serve ranges, as every node did
+// before capabilities were announced.
+func (s *FileServer) PeerSupports(addr string, capability string) bool {
+	proto := s.peerProtocolOf(addr)
+	if proto == nil || proto.version < 2 {
+		return capability == CapRanges
+	}
+	return slices.Contains(proto.caps, capability)
+}
@@ -0,0 +1,290 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPublicIPServices answer with the caller's public IP, as JSON with
+// an "ip" field or as plain text
+var DefaultPublicIPServices = []string{
+	"https://api.ipify.org?format=json",
+	"https://api.myip.com",
+	"https://ifconfig.me/ip",
+}
+
+// publicIPCheckInterval is how often the node looks for network changes
+// that may have changed its public IP
+const publicIPCheckInterval = 30 * time.Second
+
+// PublicIPOpts configures public IP detection
+type PublicIPOpts struct {
+	Services   []string      // URLs answering with the caller's IP, DefaultPublicIPServices if empty
+	Timeout    time.Duration // Per request, 5s if zero
+	Retries    int           // Extra rounds over every service when all of them fail
+	RetryDelay time.Duration // Wait before the first retry, doubled for each next one, 1s if zero
+	TTL        time.Duration // How long a detected IP is used before detecting again, 1h if zero
+	CachePath  string        // File the IP is kept in across restarts, none if empty
+}
+
+// PublicIPDetector finds the public IP of the node and caches it
+type PublicIPDetector struct {
+	opts   PublicIPOpts
+	client *http.Client
+
+	mu       sync.Mutex
+	ip       string
+	detected time.Time
+}
+
+// publicIPCache is the content of PublicIPOpts.CachePath
+type publicIPCache struct {
+	IP       string    `json:"ip"`
+	Detected time.Time `json:"detected"`
+}
+
+// NewPublicIPDetector creates a detector, loading the cached IP if any
+func NewPublicIPDetector(opts PublicIPOpts) *PublicIPDetector {
+	if len(opts.Services) == 0 {
+		opts.Services = DefaultPublicIPServices
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = time.Second
+	}
+	if opts.TTL == 0 {
+		opts.TTL = time.Hour
+	}
+	d := &PublicIPDetector{opts: opts, client: &http.Client{Timeout: opts.Timeout}}
+
+	if opts.CachePath != "" {
+		var cached publicIPCache
+		if data, err := os.ReadFile(opts.CachePath); err == nil && json.Unmarshal(data, &cached) == nil {
+			d.ip, d.detected = cached.IP, cached.Detected
+		}
+	}
+	return d
+}
+
+// Get returns the public IP, detecting it again once the cached one is
+// older than the TTL
+func (d *PublicIPDetector) Get(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	ip, detected := d.ip, d.detected
+	d.mu.Unlock()
+	if ip != "" && time.Since(detected) < d.opts.TTL {
+		return ip, nil
+	}
+	return d.Refresh(ctx)
+}
+
+// Refresh detects the public IP, ignoring the cache. Services are tried in
+// order; if none answers, every service is tried again up to Retries times.
+func (d *PublicIPDetector) Refresh(ctx context.Context) (string, error) {
+	delay := d.opts.RetryDelay
+	var errs []error
+	for round := 0; round <= d.opts.Retries; round++ {
+		if round > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			delay *= 2
+		}
+		for _, service := range d.opts.Services {
+			ip, err := d.query(ctx, service)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", service, err))
+				continue
+			}
+			d.store(ip)
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("failed to detect public IP from all services: %w", errors.Join(errs...))
+}
+
+// query asks one service for the public IP
+func (d *PublicIPDetector) query(ctx context.Context, service string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, service, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+
+	// Try to parse as JSON first, then as plain text
+	var ipResp PublicIPResponse
+	ip := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &ipResp); err == nil && ipResp.IP != "" {
+		ip = ipResp.IP
+	}
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("not an IP address: %q", ip)
+	}
+	return ip, nil
+}
+
+// store caches a detected IP, on disk if configured
+func (d *PublicIPDetector) store(ip string) {
+	d.mu.Lock()
+	d.ip, d.detected = ip, time.Now()
+	cached := publicIPCache{IP: d.ip, Detected: d.detected}
+	d.mu.Unlock()
+
+	if d.opts.CachePath == "" {
+		return
+	}
+	// The file only saves a lookup at the next start, so failing to write
+	// it is not worth reporting
+	data, _ := json.Marshal(cached)
+	if err := os.MkdirAll(filepath.Dir(d.opts.CachePath), 0755); err == nil {
+		os.WriteFile(d.opts.CachePath, data, 0644)
+	}
+}
+
+// MessageAdvertise tells peers the node is now reachable at a new address,
+// after its public IP changed
+type MessageAdvertise struct {
+	Addr string `wire:"1"`
+}
+
+// AdvertiseAddr returns the address peers are told to connect to
+func (s *FileServer) AdvertiseAddr() string {
+	s.advertiseMu.Lock()
+	defer s.advertiseMu.Unlock()
+	return s.advertiseAddr
+}
+
+// SetAdvertiseAddr changes the address peers are told to connect to, and
+// tells the connected peers and the local network about it
+func (s *FileServer) SetAdvertiseAddr(addr string) {
+	s.advertiseMu.Lock()
+	old := s.advertiseAddr
+	s.advertiseAddr = addr
+	s.advertiseMu.Unlock()
+	if old == addr {
+		return
+	}
+	s.Logger.Info("advertise address changed", "old", old, "new", addr)
+
+	if s.Discovery != nil {
+		if err := s.Discovery.SetAdvertiseAddr(addr); err != nil {
+			s.Logger.Warn("failed to update mDNS advertisement", "err", err)
+		}
+	}
+	msg := Message{Payload: MessageAdvertise{Addr: addr}}
+	if err := s.broadcast(context.Background(), &msg); err != nil {
+		s.Logger.Warn("failed to announce new advertise address", "err", err)
+	}
+}
+
+// watchPublicIP keeps the advertise address on the node's public IP. The
+// IP is detected again when the cached one expires, and right away when
+// the machine's own addresses change, e.g. after moving to another network.
+func (s *FileServer) watchPublicIP(ctx context.Context) {
+	ticker := time.NewTicker(publicIPCheckInterval)
+	defer ticker.Stop()
+
+	local := localAddrs()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-s.quitch:
+			return
+		}
+
+		detect := s.PublicIP.Get
+		if current := localAddrs(); current != local {
+			s.Logger.Info("network addresses changed, detecting public IP", "addrs", current)
+			local = current
+			detect = s.PublicIP.Refresh
+		}
+		ip, err := detect(ctx)
+		if err != nil {
+			s.Logger.Warn("failed to detect public IP", "err", err)
+			continue
+		}
+
+		_, port, err := net.SplitHostPort(s.AdvertiseAddr())
+		if err != nil {
+			continue
+		}
+		s.SetAdvertiseAddr(net.JoinHostPort(ip, port))
+	}
+}
+
+// localAddrs lists the machine's non-loopback addresses, to notice when it
+// moves to another network
+func localAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	sort.Strings(ips)
+	return strings.Join(ips, ",")
+}
+
+// handleMessageAdvertise records the new address of a peer
+func (s *FileServer) handleMessageAdvertise(from string, msg MessageAdvertise) error {
+	s.pathsMu.Lock()
+	node, ok := s.pathNode[from]
+	s.pathsMu.Unlock()
+	if !ok {
+		return nil // the peer has not said hello yet
+	}
+	s.setNodeAddr(node, msg.Addr)
+	return nil
+}
+
+// setNodeAddr records the address a node advertises, replacing the old one
+// in the peer exchange so other nodes learn the new address
+func (s *FileServer) setNodeAddr(node, addr string) {
+	if addr == "" {
+		return
+	}
+	s.pathsMu.Lock()
+	old := s.nodeAddrs[node]
+	s.nodeAddrs[node] = addr
+	s.pathsMu.Unlock()
+	if old == addr {
+		return
+	}
+	if old != "" {
+		s.Logger.Info("peer advertises a new address", "node", node, "old", old, "new", addr)
+		s.Pex.RemoveKnownPeer(old)
+	}
+	s.Pex.AddKnownPeer(addr, "advertised")
+}
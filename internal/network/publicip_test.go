@@ -0,0 +1,84 @@
+package network
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicIPDetectorFallsBackAndRetries(t *testing.T) {
+	var calls atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fails the first round, answers in plain text afterwards
+		if calls.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("198.51.100.4\n"))
+	}))
+	defer flaky.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>rate limited</html>"))
+	}))
+	defer garbage.Close()
+
+	d := NewPublicIPDetector(PublicIPOpts{
+		Services:   []string{flaky.URL, garbage.URL},
+		RetryDelay: 10 * time.Millisecond,
+	})
+	_, err := d.Refresh(context.Background())
+	assert.NotNil(t, err)
+
+	d = NewPublicIPDetector(PublicIPOpts{
+		Services:   []string{flaky.URL, garbage.URL},
+		Retries:    1,
+		RetryDelay: 10 * time.Millisecond,
+	})
+	calls.Store(0)
+	ip, err := d.Refresh(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "198.51.100.4", ip)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestPublicIPDetectorCache(t *testing.T) {
+	var calls atomic.Int32
+	ip := atomic.Value{}
+	ip.Store("203.0.113.1")
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"ip":"` + ip.Load().(string) + `"}`))
+	}))
+	defer service.Close()
+
+	opts := PublicIPOpts{
+		Services:  []string{service.URL},
+		TTL:       time.Hour,
+		CachePath: filepath.Join(t.TempDir(), "publicip.json"),
+	}
+	d := NewPublicIPDetector(opts)
+	got, err := d.Get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.1", got)
+
+	// Cached within the TTL, also across restarts
+	ip.Store("203.0.113.2")
+	got, _ = NewPublicIPDetector(opts).Get(context.Background())
+	assert.Equal(t, "203.0.113.1", got)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Refresh ignores the cache, and an expired cache is detected again
+	got, _ = d.Refresh(context.Background())
+	assert.Equal(t, "203.0.113.2", got)
+	ip.Store("203.0.113.3")
+	opts.TTL = time.Nanosecond
+	got, _ = NewPublicIPDetector(opts).Get(context.Background())
+	assert.Equal(t, "203.0.113.3", got)
+	assert.Equal(t, int32(3), calls.Load())
+}
@@ -0,0 +1,47 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// Quarantined returns the corrupted files the garbage collector moved aside
+// on this node and has not yet repaired or given up on
+func (s *FileServer) Quarantined() ([]storage.QuarantineEntry, error) {
+	return s.store.ListQuarantine(s.ID)
+}
+
+// repairFile fetches a good copy of a file the garbage collector found
+// corrupted or missing from the peers, checking its HMAC, and stores it
+// again. It is the garbage collector's Repair hook.
+func (s *FileServer) repairFile(key string) error {
+	if s.MetadataOnly {
+		return fmt.Errorf("metadata-only node does not store files: %w", ErrReadOnly)
+	}
+	// The fetch gives up on its own when no peer sends the file
+	f, err := s.Open(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// expectedFiles returns the keys this node stored or received and has not
+// deleted since, by their stamps. It is the garbage collector's Expected
+// hook: a missing one is fetched again with repairFile, from the peers
+// the existence query of the fetch finds holding it.
+func (s *FileServer) expectedFiles() []string {
+	if s.MetadataOnly || s.IsGuest() {
+		return nil
+	}
+	stamps := s.keyStamps()
+	keys := make([]string, 0, len(stamps))
+	for key := range stamps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
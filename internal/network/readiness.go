@@ -0,0 +1,65 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ReadyChecks returns the checks a node passes once it can take traffic,
+// by name: the transport accepting connections, every disk writable, the
+// storage quota loaded and at least minPeers peers connected. Each returns
+// why the node is not ready, or nil.
+func (s *FileServer) ReadyChecks(minPeers int) map[string]func() error {
+	return map[string]func() error{
+		"transport": s.checkListening,
+		"store":     s.checkWritable,
+		"quota": func() error {
+			if !s.QuotaManager.Loaded() {
+				return errors.New("storage quota not loaded yet")
+			}
+			return nil
+		},
+		"peers": func() error {
+			n := s.peerCount()
+			if n < minPeers {
+				return fmt.Errorf("%d peers connected, want at least %d", n, minPeers)
+			}
+			return nil
+		},
+	}
+}
+
+// checkListening fails until the transport listens, and once the node
+// shuts down
+func (s *FileServer) checkListening() error {
+	select {
+	case <-s.drainch:
+		return errors.New("shutting down")
+	case <-s.quitch:
+		return errors.New("stopped")
+	default:
+	}
+	if !s.listening.Load() {
+		return errors.New("transport not listening yet")
+	}
+	return nil
+}
+
+// checkWritable creates and removes a file on every disk, so a disk gone
+// read-only or full is caught before a store fails on it
+func (s *FileServer) checkWritable() error {
+	dirs := s.store.DiskPaths()
+	if len(dirs) == 0 {
+		dirs = []string{s.StorageRoot}
+	}
+	for _, dir := range dirs {
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("%s not writable: %w", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// maxRangeRead bounds the bytes one MessageRangeData carries, well below
+// the message size limit. Longer reads are split.
+const maxRangeRead = 1 << 20
+
+// MessageReadRange asks peers for a byte range of a file's content without
+// transferring the whole file. Offset and Length are in the plaintext.
+type MessageReadRange struct {
+	RequestID string `wire:"1"`
+	Key       string `wire:"2"` // hashed key
+	Offset    int64  `wire:"3"`
+	Length    int64  `wire:"4"`
+}
+
+// MessageRangeData answers MessageReadRange with the encrypted bytes of the
+// range and the header they are decrypted with, or with Err. Holders need
+// not have the data key of the file.
+type MessageRangeData struct {
+	RequestID string `wire:"1"`
+	Size      int64  `wire:"2"` // size of the whole plaintext
+	Header    []byte `wire:"3"` // first crypto.Overhead bytes of the stored file
+	Data      []byte `wire:"4"`
+	Err       string `wire:"5"`
+	Offset    int64  `wire:"6"` // of Data in the stored file, 0 from older nodes
+}
+
+// rangeReply is the answer of one peer to a range read
+type rangeReply struct {
+	from string
+	msg  MessageRangeData
+}
+
+// ReadRange returns length bytes of the content of key starting at offset,
+// or fewer if the file ends first. Unlike Get and Open, a file this node
+// does not hold is not fetched whole: only the range is asked of the peers,
+// for clients such as media players that read a little of large files.
+// Reads that continue where the previous one ended are read ahead of, see
+// readAhead.
+// The HMAC of a remote file covers all of it, so ranges read from peers
+// are not checked against it, unless the file is sealed in frames: then
+// the frames of the range are. A compressed file cannot be read from the
+// middle, so it is fetched whole like with Open.
+func (s *FileServer) ReadRange(ctx context.Context, key string, offset int64, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	if s.store.Has(s.ID, key) {
+		return s.readOpened(ctx, key, offset, length)
+	}
+
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open data key of %s: %w", key, err)
+	}
+	// The compression header, if any, starts the plaintext. It is only
+	// read again once the reads of the file stopped for a while.
+	skip, ok := s.readaheadSkip(key)
+	if !ok {
+		head, err := s.readRemoteRange(ctx, encKey, key, 0, int64(storage.CompressHeaderSize))
+		if err != nil {
+			return nil, err
+		}
+		c, n, err := storage.CompressionOf(head)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", key, err)
+		}
+		if c != storage.CompressionNone {
+			return s.readOpened(ctx, key, offset, length)
+		}
+		skip = int64(n)
+	}
+	return s.readAhead(ctx, encKey, key, skip, offset+skip, length)
+}
+
+// readOpened reads a range of key with Open
+func (s *FileServer) readOpened(ctx context.Context, key string, offset int64, length int64) ([]byte, error) {
+	f, err := s.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if offset > f.Size() {
+		return nil, fmt.Errorf("range %d+%d of %s beyond its size %d", offset, length, key, f.Size())
+	}
+	buf := make([]byte, min(length, f.Size()-offset))
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readRemoteRange reads a range of the plaintext of key from peers
+func (s *FileServer) readRemoteRange(ctx context.Context, encKey []byte, key string, offset int64, length int64) ([]byte, error) {
+	var data []byte
+	for int64(len(data)) < length {
+		at := offset + int64(len(data))
+		want := min(length-int64(len(data)), maxRangeRead)
+		reply, err := s.requestRange(ctx, key, at, want)
+		if err != nil {
+			return nil, err
+		}
+		if len(reply.Header) != crypto.Overhead {
+			return nil, fmt.Errorf("invalid answer to range read of %s: header of %d bytes", key, len(reply.Header))
+		}
+		if at > reply.Size {
+			return nil, fmt.Errorf("range %d+%d of %s beyond its size %d", offset, length, key, reply.Size)
+		}
+		stored := reply.Offset
+		if stored == 0 {
+			stored = crypto.Overhead + at
+		}
+		r, err := crypto.NewReaderAt(encKey, &rangeData{header: reply.Header, data: reply.Data, offset: stored}, crypto.EncryptedSize(reply.Header, reply.Size))
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, min(int64(len(reply.Data)), want))
+		n, err := r.ReadAt(chunk, at)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+		if n == 0 || at+int64(n) >= reply.Size {
+			break
+		}
+	}
+	return data, nil
+}
+
+// requestRange asks for a range of key, of the peer that answered the last
+// range read of it if it is still connected and of every peer otherwise or
+// if that peer fails, and returns the first answer with data
+func (s *FileServer) requestRange(ctx context.Context, key string, offset int64, length int64) (MessageRangeData, error) {
+	requestID, err := crypto.GenerateID()
+	if err != nil {
+		return MessageRangeData{}, err
+	}
+
+	peers := s.broadcastPeers()
+	s.rangeMu.Lock()
+	source, narrowed := peers[s.rangeSources[key]]
+	if narrowed {
+		peers = map[string]p2p.Peer{s.rangeSources[key]: source}
+	}
+	replies := make(chan rangeReply, len(peers))
+	s.rangeReads[requestID] = replies
+	s.rangeMu.Unlock()
+	defer func() {
+		s.rangeMu.Lock()
+		delete(s.rangeReads, requestID)
+		s.rangeMu.Unlock()
+	}()
+
+	msg := Message{Payload: MessageReadRange{RequestID: requestID, Key: crypto.HashKey(key), Offset: offset, Length: length}}
+	expected := 0
+	for addr, peer := range peers {
+		if err := s.sendMessage(peer, &msg); err != nil {
+			s.Logger.Debug("failed to request range", "peer", addr, "key", key, "err", err)
+			continue
+		}
+		expected++
+	}
+
+	timeout := time.NewTimer(s.FetchTimeout)
+	defer timeout.Stop()
+	for answered := 0; answered < expected; {
+		select {
+		case reply := <-replies:
+			answered++
+			if reply.msg.Err != "" {
+				s.Logger.Debug("peer could not serve range", "peer", reply.from, "key", key, "err", reply.msg.Err)
+				continue
+			}
+			s.rangeMu.Lock()
+			s.rangeSources[key] = reply.from
+			s.rangeMu.Unlock()
+			return reply.msg, nil
+		case <-timeout.C:
+			answered = expected
+		case <-ctx.Done():
+			return MessageRangeData{}, ctx.Err()
+		}
+	}
+
+	s.rangeMu.Lock()
+	delete(s.rangeSources, key)
+	s.rangeMu.Unlock()
+	if narrowed {
+		return s.requestRange(ctx, key, offset, length)
+	}
+	return MessageRangeData{}, fmt.Errorf("file %s %w", key, ErrNotFound)
+}
+
+// handleMessageReadRange answers a range read with the encrypted bytes of
+// the range, read straight from the stored file, or from its copy
+// encrypted for the guest asking
+func (s *FileServer) handleMessageReadRange(from string, msg MessageReadRange) error {
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	reply := MessageRangeData{RequestID: msg.RequestID}
+	if err := s.readRange(from, msg, &reply); err != nil {
+		reply = MessageRangeData{RequestID: msg.RequestID, Err: err.Error()}
+	}
+	answer := Message{Payload: reply}
+	return s.sendMessage(peer, &answer)
+}
+
+// readRange fills reply with the header and the range msg asks for
+func (s *FileServer) readRange(from string, msg MessageReadRange, reply *MessageRangeData) error {
+	key, ok := s.store.GetOriginalKey(msg.Key)
+	if !ok || !s.store.Has(s.ID, key) {
+		return os.ErrNotExist
+	}
+	size, err := s.store.Size(s.ID, key)
+	if err != nil {
+		return err
+	}
+	if size < crypto.Overhead {
+		return errors.New("stored file is shorter than its header")
+	}
+	guest := s.guestFor(from)
+	read := s.readStored
+	if guest != nil {
+		read = func(key string, offset int64, length int64) ([]byte, error) {
+			r, _, err := s.guestRange(guest, key, offset, length)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		}
+	}
+	if reply.Header, err = read(key, 0, crypto.Overhead); err != nil {
+		return err
+	}
+	if reply.Size, err = crypto.PlainSize(reply.Header, size); err != nil {
+		return err
+	}
+	if msg.Offset > reply.Size {
+		return nil // nothing to send, the requester reports the range
+	}
+	// Framed files are sent in whole frames, which the requester checks
+	at, length := crypto.EncryptedRange(reply.Header, msg.Offset, min(msg.Length, maxRangeRead))
+	reply.Offset = at
+	reply.Data, err = read(key, at, max(min(length, size-at), 0))
+	return err
+}
+
+// readStored reads a range of the stored bytes of key
+func (s *FileServer) readStored(key string, offset int64, length int64) ([]byte, error) {
+	n, r, err := s.store.ReadRange(s.ID, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// handleMessageRangeData hands a range to the read waiting for it
+func (s *FileServer) handleMessageRangeData(from string, msg MessageRangeData) error {
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+
+	replies, ok := s.rangeReads[msg.RequestID]
+	if !ok {
+		return nil // answered by another peer already
+	}
+	select {
+	case replies <- rangeReply{from: from, msg: msg}:
+	default:
+	}
+	return nil
+}
+
+// rangeData is the part of a stored file received for a range read, the
+// header and the data at offset in the stored file, as an io.ReaderAt for
+// crypto.NewReaderAt
+type rangeData struct {
+	header []byte
+	data   []byte
+	offset int64
+}
+
+func (r *rangeData) ReadAt(p []byte, off int64) (int, error) {
+	if off < crypto.Overhead {
+		n := copy(p, r.header[min(off, int64(len(r.header))):])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	at := off - r.offset
+	if at < 0 || at > int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[at:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// MessageReplicaAck confirms that a peer stored a complete replica of Key,
+// of Size bytes hashing to ContentHash. The signature covers the key, the
+// content hash, the node ID and SignedAt.
+type MessageReplicaAck struct {
+	ID          string    `wire:"1"`
+	Key         string    `wire:"2"`
+	ContentHash string    `wire:"3"`
+	SignedAt    time.Time `wire:"4"`
+	PublicKey   []byte    `wire:"5"`
+	Signature   []byte    `wire:"6"`
+	Size        int64     `wire:"7"` // bytes written, 0 from nodes that predate it
+}
+
+// Confirmation is a replica acknowledgment recorded in a receipt
+type Confirmation struct {
+	NodeID    string    `json:"node_id"`
+	PublicKey []byte    `json:"public_key"`
+	SignedAt  time.Time `json:"signed_at"`
+	Signature []byte    `json:"signature"`
+}
+
+// Receipt proves that a stored file was replicated. It lists every peer
+// that confirmed holding the exact same bytes, and is signed by the node
+// that stored the file.
+type Receipt struct {
+	Key           string         `json:"key"`
+	ContentHash   string         `json:"content_hash"`
+	Size          int64          `json:"size"`
+	StoredAt      time.Time      `json:"stored_at"`
+	NodeID        string         `json:"node_id"`
+	PublicKey     []byte         `json:"public_key"`
+	Confirmations []Confirmation `json:"confirmations"`
+	Signature     []byte         `json:"signature"`
+}
+
+// replicaAckPayload is the message a replica acknowledgment signs
+func replicaAckPayload(key, contentHash, nodeID string, signedAt time.Time) []byte {
+	return []byte(fmt.Sprintf("peervault-replica-ack-v1|%s|%s|%s|%s",
+		key, contentHash, nodeID, signedAt.UTC().Format(time.RFC3339Nano)))
+}
+
+// signingPayload is the message the receipt signature covers:
+// the receipt itself without its signature
+func (r *Receipt) signingPayload() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// VerifyReceipt checks the signature of the receipt and of every confirmation in it
+func VerifyReceipt(r *Receipt) error {
+	payload, err := r.signingPayload()
+	if err != nil {
+		return err
+	}
+	if !crypto.VerifySignature(r.PublicKey, payload, r.Signature) {
+		return fmt.Errorf("receipt for %s has an invalid signature", r.Key)
+	}
+	for _, c := range r.Confirmations {
+		ack := replicaAckPayload(r.Key, r.ContentHash, c.NodeID, c.SignedAt)
+		if !crypto.VerifySignature(c.PublicKey, ack, c.Signature) {
+			return fmt.Errorf("confirmation from node %s has an invalid signature", c.NodeID)
+		}
+	}
+	return nil
+}
+
+// receiptsPath is where receipts are persisted, next to the key metadata
+func (s *FileServer) receiptsPath() string {
+	return filepath.Join(s.StorageRoot, "receipts.json")
+}
+
+// loadReceipts reads persisted receipts, if any
+func (s *FileServer) loadReceipts() error {
+	data, err := os.ReadFile(s.receiptsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.OpenRecord(data); err != nil {
+		return fmt.Errorf("failed to open receipts: %w", err)
+	}
+
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	return json.Unmarshal(data, &s.receipts)
+}
+
+// saveReceipts persists all receipts. Callers hold receiptsMu.
+func (s *FileServer) saveReceipts() error {
+	data, err := json.MarshalIndent(s.receipts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = s.store.SealRecord(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.receiptsPath(), data, 0644)
+}
+
+// signReceipt (re)signs a receipt with the node's identity
+func (s *FileServer) signReceipt(r *Receipt) error {
+	payload, err := r.signingPayload()
+	if err != nil {
+		return err
+	}
+	r.Signature = s.Identity.Sign(payload)
+	return nil
+}
+
+// startReceipt records a new receipt for a file this node just stored,
+// replacing any receipt of an earlier version of the key
+func (s *FileServer) startReceipt(key string, size int64) error {
+	contentHash, err := s.store.ContentHash(s.ID, key)
+	if err != nil {
+		return err
+	}
+
+	r := &Receipt{
+		Key:           key,
+		ContentHash:   contentHash,
+		Size:          size,
+		StoredAt:      time.Now().UTC(),
+		NodeID:        s.ID,
+		PublicKey:     s.Identity.PublicKey,
+		Confirmations: []Confirmation{},
+	}
+	if err := s.signReceipt(r); err != nil {
+		return err
+	}
+
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	s.receipts[key] = r
+	return s.saveReceipts()
+}
+
+// Receipt returns the replication receipt of a key stored by this node
+func (s *FileServer) Receipt(key string) (*Receipt, bool) {
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+
+	r, ok := s.receipts[key]
+	if !ok {
+		return nil, false
+	}
+	cp := *r
+	cp.Confirmations = append([]Confirmation(nil), r.Confirmations...)
+	return &cp, true
+}
+
+// sendReplicaAck confirms to the sender that a complete replica of key, of
+// size bytes, was stored
+func (s *FileServer) sendReplicaAck(peer p2p.Peer, key string, size int64) error {
+	contentHash, err := s.store.ContentHash(s.ID, key)
+	if err != nil {
+		return err
+	}
+
+	signedAt := time.Now().UTC()
+	msg := Message{
+		Payload: MessageReplicaAck{
+			ID:          s.ID,
+			Key:         key,
+			ContentHash: contentHash,
+			SignedAt:    signedAt,
+			PublicKey:   s.Identity.PublicKey,
+			Signature:   s.Identity.Sign(replicaAckPayload(key, contentHash, s.ID, signedAt)),
+			Size:        size,
+		},
+	}
+	return s.sendMessage(peer, &msg)
+}
+
+// handleMessageReplicaAck adds a verified confirmation to the receipt of a key
+func (s *FileServer) handleMessageReplicaAck(from string, msg MessageReplicaAck) error {
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+
+	r, ok := s.receipts[msg.Key]
+	if !ok {
+		return nil // not stored by this node
+	}
+	if msg.ContentHash != r.ContentHash || (msg.Size != 0 && msg.Size != r.Size) {
+		return fmt.Errorf("replica ack from %s for %s does not match the stored content", from, msg.Key)
+	}
+	ack := replicaAckPayload(msg.Key, msg.ContentHash, msg.ID, msg.SignedAt)
+	if !crypto.VerifySignature(msg.PublicKey, ack, msg.Signature) {
+		return fmt.Errorf("replica ack from %s for %s has an invalid signature", from, msg.Key)
+	}
+
+	fingerprint := crypto.Fingerprint(msg.PublicKey)
+	s.trackHolder(msg.Key, fingerprint)
+	delete(s.replicaNacks, fingerprint+"/"+msg.Key)
+	for _, c := range r.Confirmations {
+		if crypto.Fingerprint(c.PublicKey) == fingerprint {
+			return nil // already confirmed by this node
+		}
+	}
+
+	r.Confirmations = append(r.Confirmations, Confirmation{
+		NodeID:    msg.ID,
+		PublicKey: msg.PublicKey,
+		SignedAt:  msg.SignedAt,
+		Signature: msg.Signature,
+	})
+	if err := s.signReceipt(r); err != nil {
+		return err
+	}
+	if ch, ok := s.ackSignals[msg.Key]; ok {
+		close(ch) // wakes Stores waiting for their write concern
+		delete(s.ackSignals, msg.Key)
+	}
+
+	s.Logger.Info("replica confirmed", "peer", from, "key", msg.Key, "confirmations", len(r.Confirmations))
+	return s.saveReceipts()
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Relay timing: how long an introduction waits for both nodes to connect,
+// and how long a connection may take to name its circuit
+const (
+	relayCircuitTTL   = 30 * time.Second
+	relayTokenTimeout = 10 * time.Second
+)
+
+// relayTokenSize is the length of the hex request ID that names a circuit
+const relayTokenSize = 64
+
+// relayReady is written to both ends of a circuit once they are spliced
+const relayReady = 0x1
+
+// relay joins pairs of connections from nodes that cannot reach each
+// other. Both nodes connect out to the relay and name the circuit their
+// introduction set up; once both are there the relay copies bytes between
+// them, so the nodes talk to each other as if directly connected.
+type relay struct {
+	listener net.Listener
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	circuits map[string]*relayCircuit
+}
+
+// relayCircuit is an expected pair of connections, keyed by request ID
+type relayCircuit struct {
+	expires time.Time
+	waiting net.Conn // the first node to arrive, nil until then
+}
+
+// listenRelay starts a relay on addr
+func listenRelay(addr string, logger *slog.Logger) (*relay, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &relay{
+		listener: listener,
+		logger:   logger,
+		circuits: make(map[string]*relayCircuit),
+	}
+	go r.acceptLoop()
+	return r, nil
+}
+
+// port returns the port the relay listens on
+func (r *relay) port() int {
+	return r.listener.Addr().(*net.TCPAddr).Port
+}
+
+// close stops the relay. Spliced circuits stay up until either end closes.
+func (r *relay) close() error {
+	r.mu.Lock()
+	for token, c := range r.circuits {
+		if c.waiting != nil {
+			c.waiting.Close()
+		}
+		delete(r.circuits, token)
+	}
+	r.mu.Unlock()
+	return r.listener.Close()
+}
+
+// expect allows one circuit named token. Circuits nobody completed in time
+// are dropped.
+func (r *relay) expect(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for t, c := range r.circuits {
+		if now.After(c.expires) {
+			if c.waiting != nil {
+				c.waiting.Close()
+			}
+			delete(r.circuits, t)
+		}
+	}
+	r.circuits[token] = &relayCircuit{expires: now.Add(relayCircuitTTL)}
+}
+
+func (r *relay) acceptLoop() {
+	for {
+		conn, err := r.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			r.logger.Warn("relay accept error", "err", err)
+			continue
+		}
+		go r.join(conn)
+	}
+}
+
+// join reads the circuit a connection asks for and splices it with the
+// other end once that arrives
+func (r *relay) join(conn net.Conn) {
+	buf := make([]byte, relayTokenSize)
+	conn.SetReadDeadline(time.Now().Add(relayTokenTimeout))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	token := string(buf)
+	if _, err := hex.DecodeString(token); err != nil {
+		conn.Close()
+		return
+	}
+
+	r.mu.Lock()
+	c, ok := r.circuits[token]
+	if !ok || time.Now().After(c.expires) {
+		r.mu.Unlock()
+		r.logger.Debug("rejected relay connection for unknown circuit", "from", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	if c.waiting == nil {
+		c.waiting = conn
+		r.mu.Unlock()
+		return
+	}
+	other := c.waiting
+	delete(r.circuits, token)
+	r.mu.Unlock()
+
+	r.logger.Info("relaying connection", "a", other.RemoteAddr().String(), "b", conn.RemoteAddr().String())
+	splice(other, conn)
+}
+
+// splice tells both ends the circuit is up and copies between them until
+// either side closes
+func splice(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	if _, err := a.Write([]byte{relayReady}); err != nil {
+		return
+	}
+	if _, err := b.Write([]byte{relayReady}); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		close(done)
+	}()
+	io.Copy(b, a)
+	b.Close()
+	<-done
+}
+
+// relayedConn is a connection to a node through a relay. Every circuit
+// through a relay has the same TCP address, so the remote address names
+// the circuit instead, keeping peers apart.
+type relayedConn struct {
+	net.Conn
+	addr circuitAddr
+}
+
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// circuitAddr is the address of a relayed connection: the relay's address
+// followed by the circuit
+type circuitAddr string
+
+func (a circuitAddr) Network() string { return "relay" }
+func (a circuitAddr) String() string  { return string(a) }
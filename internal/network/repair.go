@@ -0,0 +1,210 @@
+package network
+
+import (
+	"sort"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// loadHolders seeds replica holders from the confirmations in persisted receipts
+func (s *FileServer) loadHolders() {
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+
+	for key, r := range s.receipts {
+		for _, c := range r.Confirmations {
+			s.trackHolder(key, crypto.Fingerprint(c.PublicKey))
+		}
+	}
+}
+
+// trackHolder records that node (a public key fingerprint) holds a replica of key
+func (s *FileServer) trackHolder(key, node string) {
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+
+	holders, ok := s.holders[key]
+	if !ok {
+		holders = make(map[string]bool)
+		s.holders[key] = holders
+	}
+	holders[node] = true
+}
+
+// forgetHolders drops the holders of an earlier version of key
+func (s *FileServer) forgetHolders(key string) {
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+	delete(s.holders, key)
+}
+
+// nodeOnline cancels a pending repair for a node that came back. Files
+// that could not be fully re-replicated earlier are offered again, since
+// the node may be a new candidate.
+func (s *FileServer) nodeOnline(node string) {
+	s.replicasMu.Lock()
+	delete(s.offline, node)
+	keys := make([]string, 0, len(s.underReplicated))
+	for key := range s.underReplicated {
+		keys = append(keys, key)
+	}
+	s.replicasMu.Unlock()
+
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	go func() {
+		for _, key := range keys {
+			s.topUpReplicas(key)
+		}
+	}()
+}
+
+// nodeOffline is called when the last path to a node closes. If the node
+// is still gone after ReplicaTimeout, the files it held are re-replicated.
+func (s *FileServer) nodeOffline(node string) {
+	s.replicasMu.Lock()
+	s.offline[node] = time.Now()
+	s.replicasMu.Unlock()
+
+	time.AfterFunc(s.ReplicaTimeout, func() { s.repairReplicas(node) })
+}
+
+// repairReplicas forgets a node that stayed offline past ReplicaTimeout
+// and tops up every file it held back to the replication factor
+func (s *FileServer) repairReplicas(node string) {
+	select {
+	case <-s.quitch:
+		return
+	default:
+	}
+
+	s.replicasMu.Lock()
+	since, ok := s.offline[node]
+	if !ok || time.Since(since) < s.ReplicaTimeout {
+		// Came back, or went offline again and has a newer timer
+		s.replicasMu.Unlock()
+		return
+	}
+	delete(s.offline, node)
+
+	var affected []string
+	for key, holders := range s.holders {
+		if holders[node] {
+			delete(holders, node)
+			affected = append(affected, key)
+		}
+	}
+	s.replicasMu.Unlock()
+
+	if len(affected) == 0 {
+		return
+	}
+	s.Metrics.AddReplicasLost(int64(len(affected)))
+	s.Logger.Warn("peer offline past replica timeout, re-replicating its files", "node", node, "files", len(affected))
+
+	sort.Strings(affected)
+	for _, key := range affected {
+		s.topUpReplicas(key)
+	}
+}
+
+// topUpReplicas offers key to healthy peers that do not hold it until the
+// replication factor is met. The peers pull the file and confirm it with a
+// replica ack, which adds them to the holders.
+func (s *FileServer) topUpReplicas(key string) {
+	size, err := s.store.Size(s.ID, key)
+	if err != nil {
+		s.setUnderReplicated(key, false)
+		return // no longer stored here
+	}
+
+	s.replicasMu.Lock()
+	holders := make(map[string]bool, len(s.holders[key]))
+	for node := range s.holders[key] {
+		holders[node] = true
+	}
+	offline := make(map[string]bool, len(s.offline))
+	for node := range s.offline {
+		offline[node] = true
+	}
+	s.replicasMu.Unlock()
+
+	// The local copy counts towards the replication factor
+	need := s.replicationFactor() - 1 - len(holders)
+	if need <= 0 {
+		s.setUnderReplicated(key, false)
+		return
+	}
+
+	s.pathsMu.Lock()
+	nodes := make([]string, 0, len(s.nodePaths))
+	candidates := make(map[string]p2p.Peer)
+	nodeAddr := make(map[string]string)
+	for node := range s.nodePaths {
+		if holders[node] || offline[node] || s.indexNodes[node] {
+			continue
+		}
+		if best := s.bestPath(node, nil); best != nil && !s.isGuestPeer(best.addr) {
+			nodes = append(nodes, node)
+			candidates[best.addr] = best.peer
+			nodeAddr[node] = best.addr
+		}
+	}
+	s.pathsMu.Unlock()
+
+	// Best scored nodes first, so replicas go to the most reliable peers
+	placed := s.placeReplicas(key, candidates)
+	scores := make(map[string]float64, len(nodes))
+	for _, node := range nodes {
+		scores[node] = s.peerScore(nodeAddr[node])
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if scores[nodes[i]] != scores[nodes[j]] {
+			return scores[nodes[i]] > scores[nodes[j]]
+		}
+		return nodes[i] < nodes[j]
+	})
+	var targets []p2p.Peer
+	for _, node := range nodes {
+		if len(targets) == need {
+			break
+		}
+		if peer, ok := placed[nodeAddr[node]]; ok {
+			targets = append(targets, peer)
+		}
+	}
+
+	offer := Message{Payload: MessageStoreFile{ID: s.ID, Key: key, Size: size, Clock: s.KeyStamp(key)}}
+	for _, peer := range targets {
+		if err := s.sendMessage(peer, &offer); err != nil {
+			s.Logger.Warn("failed to offer replica for repair", "peer", peer.RemoteAddr().String(), "key", key, "err", err)
+			continue
+		}
+		s.Metrics.IncReplicaRepairs()
+		s.Logger.Info("re-replicating file", "peer", peer.RemoteAddr().String(), "key", key)
+	}
+
+	s.setUnderReplicated(key, len(targets) < need)
+	if len(targets) < need {
+		s.Logger.Warn("not enough healthy peers to restore replication factor",
+			"key", key, "holders", len(holders)+len(targets), "factor", s.replicationFactor())
+	}
+}
+
+// setUnderReplicated records whether key is still short of replicas and
+// updates the matching gauge
+func (s *FileServer) setUnderReplicated(key string, short bool) {
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+
+	if short {
+		s.underReplicated[key] = true
+	} else {
+		delete(s.underReplicated, key)
+	}
+	s.Metrics.SetUnderReplicated(len(s.underReplicated))
+}
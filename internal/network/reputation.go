@@ -0,0 +1,181 @@
+package network
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// Failed outcomes count against a peer with these weights, so a corrupted
+// delivery outweighs ten completed transfers
+const (
+	dialFailureWeight     = 1
+	transferFailureWeight = 2
+	corruptWeight         = 10
+)
+
+const (
+	// neutralScore is the score of a peer nothing is known about
+	neutralScore = 50
+	// minScoredOutcomes is how many outcomes a peer needs before it is
+	// banned for a low score, so one failed dial does not ban it
+	minScoredOutcomes = 5
+	// defaultPeerScoreBan is how long a peer is banned for a low score if
+	// FileServerOpts.PeerScoreBan is not set
+	defaultPeerScoreBan = time.Hour
+)
+
+// PeerScore is the reputation of a peer, built from how its dials and
+// transfers went and whether the data it delivered was intact
+type PeerScore struct {
+	Peer             string    `json:"peer"` // node fingerprint, or address until it said hello
+	Addr             string    `json:"addr"` // last address seen
+	Dials            int       `json:"dials"`
+	DialFailures     int       `json:"dial_failures"`
+	Transfers        int       `json:"transfers"`
+	TransferFailures int       `json:"transfer_failures"`
+	Corrupt          int       `json:"corrupt"` // deliveries that failed the integrity check
+	Score            float64   `json:"score"`   // 0 to 100
+	Updated          time.Time `json:"updated"`
+}
+
+// outcomes returns how many outcomes the score is built from
+func (p *PeerScore) outcomes() int {
+	return p.Dials + p.Transfers + p.Corrupt
+}
+
+// rescore computes Score from the weighted good and bad outcomes, starting
+// at neutralScore with none
+func (p *PeerScore) rescore() {
+	bad := float64(p.DialFailures*dialFailureWeight + p.TransferFailures*transferFailureWeight + p.Corrupt*corruptWeight)
+	good := float64(p.Dials-p.DialFailures) + float64(p.Transfers-p.TransferFailures)
+	p.Score = 100 * (good + 1) / (good + bad + 2)
+}
+
+// scoreKey returns the key a peer's score is kept under: its node once it
+// said hello, so every path to it shares one score, and its address before
+func (s *FileServer) scoreKey(addr string) string {
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	if node, ok := s.pathNode[addr]; ok {
+		return node
+	}
+	return addr
+}
+
+// scorePeer applies an outcome to the score of the peer at addr and bans
+// the peer if its score fell below MinPeerScore
+func (s *FileServer) scorePeer(addr string, apply func(*PeerScore)) {
+	key := s.scoreKey(addr)
+
+	s.scoresMu.Lock()
+	score, ok := s.scores[key]
+	if !ok {
+		score = &PeerScore{Peer: key}
+		s.scores[key] = score
+	}
+	apply(score)
+	score.Addr = addr
+	score.Updated = time.Now()
+	score.rescore()
+	banned := s.MinPeerScore > 0 && score.outcomes() >= minScoredOutcomes && score.Score < s.MinPeerScore
+	current := *score
+	if banned {
+		// The peer starts over once its ban expires
+		delete(s.scores, key)
+	}
+	s.scoresMu.Unlock()
+
+	if !banned {
+		return
+	}
+	banFor := s.PeerScoreBan
+	if banFor <= 0 {
+		banFor = defaultPeerScoreBan
+	}
+	s.banHost(hostOf(addr), banFor)
+	s.disconnectHost(addr, false)
+	s.Logger.Warn("banned peer for low score", "peer", addr, "score", current.Score, "threshold", s.MinPeerScore, "for", banFor)
+}
+
+// recordDial scores a dial of addr
+func (s *FileServer) recordDial(addr string, err error) {
+	s.scorePeer(addr, func(p *PeerScore) {
+		p.Dials++
+		if err != nil {
+			p.DialFailures++
+		}
+	})
+}
+
+// recordTransfer scores a transfer to or from the peer at addr
+func (s *FileServer) recordTransfer(addr string, err error) {
+	s.scorePeer(addr, func(p *PeerScore) {
+		p.Transfers++
+		if err != nil {
+			p.TransferFailures++
+		}
+	})
+}
+
+// recordCorrupt scores data from the peer at addr that failed the integrity
+// check
+func (s *FileServer) recordCorrupt(addr string) {
+	s.scorePeer(addr, func(p *PeerScore) { p.Corrupt++ })
+}
+
+// peerScore returns the score of the peer at addr, neutralScore if nothing
+// is known about it
+func (s *FileServer) peerScore(addr string) float64 {
+	key := s.scoreKey(addr)
+	s.scoresMu.Lock()
+	defer s.scoresMu.Unlock()
+	if score, ok := s.scores[key]; ok {
+		return score.Score
+	}
+	return neutralScore
+}
+
+// PeerScores returns the scores of the peers this node dialed or exchanged
+// data with, best first
+func (s *FileServer) PeerScores() []PeerScore {
+	s.scoresMu.Lock()
+	scores := make([]PeerScore, 0, len(s.scores))
+	for _, score := range s.scores {
+		scores = append(scores, *score)
+	}
+	s.scoresMu.Unlock()
+
+	slices.SortFunc(scores, func(a, b PeerScore) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Peer, b.Peer)
+	})
+	return scores
+}
+
+// dial connects to addr and scores the attempt. Blocked peers are not
+// dialed, nor is anyone while the node has MaxPeers connections, nor a
+// full node that declined a connection recently.
+func (s *FileServer) dial(addr string) error {
+	if s.isBlocked(addr) {
+		return fmt.Errorf("peer %s is blocked", addr)
+	}
+	if s.peersFull() {
+		return fmt.Errorf("not dialing %s, peers full", addr)
+	}
+	if s.declinedRecently(addr) {
+		return fmt.Errorf("not dialing %s, it declined a connection for being full", addr)
+	}
+	err := s.Transport.Dial(addr)
+	if errors.Is(err, p2p.ErrCircuitOpen) {
+		return err // not dialed, so nothing to score
+	}
+	s.recordDial(addr, err)
+	return err
+}
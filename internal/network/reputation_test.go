@@ -0,0 +1,43 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerScores(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_reputation_node")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	server := makeTestServer(t, root, ":0", make([]byte, 32))
+	server.MinPeerScore = 20
+
+	// Unknown peers are neutral and good outcomes raise the score
+	assert.Equal(t, float64(neutralScore), server.peerScore("10.0.0.1:3000"))
+	server.recordDial("10.0.0.1:3000", nil)
+	server.recordTransfer("10.0.0.1:3000", nil)
+	assert.Greater(t, server.peerScore("10.0.0.1:3000"), float64(neutralScore))
+
+	// A peer is not banned before it has enough outcomes
+	failed := errors.New("connection refused")
+	for range minScoredOutcomes - 1 {
+		server.recordTransfer("10.0.0.2:3000", failed)
+	}
+	assert.Less(t, server.peerScore("10.0.0.2:3000"), server.MinPeerScore)
+	assert.False(t, server.IsBanned("10.0.0.2:3000"))
+
+	scores := server.PeerScores()
+	assert.Len(t, scores, 2)
+	assert.Equal(t, "10.0.0.1:3000", scores[0].Peer)
+	assert.Equal(t, minScoredOutcomes-1, scores[1].TransferFailures)
+
+	// Corrupted data pushes it below the threshold: banned and forgotten
+	server.recordCorrupt("10.0.0.2:3000")
+	assert.True(t, server.IsBanned("10.0.0.2:4000"))
+	assert.Len(t, server.PeerScores(), 1)
+	assert.Equal(t, float64(neutralScore), server.peerScore("10.0.0.2:3000"))
+}
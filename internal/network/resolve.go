@@ -0,0 +1,140 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrNoPeerMatch is returned by ResolvePeer when no connected peer matches
+var ErrNoPeerMatch = errors.New("no connected peer matches")
+
+// PeerMatch is a connected peer a query can refer to
+type PeerMatch struct {
+	Addr       string // connection to use, the node's preferred path
+	Node       string // empty until the peer introduced itself
+	Advertised string // address the node advertises, if any
+	Labels     map[string]string
+}
+
+func (m PeerMatch) String() string {
+	if m.Node == "" {
+		return m.Addr
+	}
+	return m.Addr + " (" + m.Node + ")"
+}
+
+// peerMatches lists every connected peer once: a node by its preferred
+// path, and connections that have not introduced themselves on their own
+func (s *FileServer) peerMatches() []PeerMatch {
+	s.PeerLock.Lock()
+	addrs := make([]string, 0, len(s.conns))
+	for addr := range s.conns {
+		addrs = append(addrs, addr)
+	}
+	s.PeerLock.Unlock()
+
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	var matches []PeerMatch
+	for node := range s.nodePaths {
+		best := s.bestPath(node, nil)
+		if best == nil {
+			continue
+		}
+		matches = append(matches, PeerMatch{
+			Addr:       best.addr,
+			Node:       node,
+			Advertised: s.nodeAddrs[node],
+			Labels:     s.nodeLabels[node],
+		})
+	}
+	for _, addr := range addrs {
+		if _, ok := s.pathNode[addr]; !ok {
+			matches = append(matches, PeerMatch{Addr: addr})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Addr < matches[j].Addr
+	})
+	return matches
+}
+
+// matchesName reports whether query names the peer: a prefix of its node
+// ID, a label as key=value, or the value of any of its labels
+func (m PeerMatch) matchesName(query string) bool {
+	if m.Node != "" && strings.HasPrefix(m.Node, strings.ToLower(query)) {
+		return true
+	}
+	if key, value, ok := strings.Cut(query, "="); ok {
+		v, found := m.Labels[key]
+		return found && strings.EqualFold(v, value)
+	}
+	for _, v := range m.Labels {
+		if strings.EqualFold(v, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAddr reports whether query is part of the peer's connection or
+// advertised address, e.g. just its host or ":3000"
+func (m PeerMatch) matchesAddr(query string) bool {
+	query = strings.ToLower(query)
+	return strings.Contains(strings.ToLower(m.Addr), query) ||
+		(m.Advertised != "" && strings.Contains(strings.ToLower(m.Advertised), query))
+}
+
+// MatchPeers lists the connected peers query could refer to, by node ID
+// prefix, label or part of an address. An empty query lists them all.
+func (s *FileServer) MatchPeers(query string) []PeerMatch {
+	var matches []PeerMatch
+	for _, m := range s.peerMatches() {
+		if query == "" || m.matchesName(query) || m.matchesAddr(query) {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// ResolvePeer turns what the user typed for a peer into the address of a
+// connection to it. An exact address wins, then node ID prefixes and labels,
+// then partial addresses; a query matching several peers at the same step
+// is an error listing them.
+func (s *FileServer) ResolvePeer(query string) (string, error) {
+	if query == "" {
+		return "", fmt.Errorf("no peer given")
+	}
+	if _, ok := s.peerFor(query); ok {
+		return query, nil
+	}
+
+	candidates := s.peerMatches()
+	for _, m := range candidates {
+		if m.Advertised == query {
+			return m.Addr, nil
+		}
+	}
+	for _, match := range []func(PeerMatch, string) bool{PeerMatch.matchesName, PeerMatch.matchesAddr} {
+		var found []PeerMatch
+		for _, m := range candidates {
+			if match(m, query) {
+				found = append(found, m)
+			}
+		}
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0].Addr, nil
+		}
+		names := make([]string, len(found))
+		for i, m := range found {
+			names[i] = m.String()
+		}
+		return "", fmt.Errorf("%q matches several peers: %s", query, strings.Join(names, ", "))
+	}
+	return "", fmt.Errorf("%w %q", ErrNoPeerMatch, query)
+}
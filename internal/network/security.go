@@ -0,0 +1,113 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+)
+
+// ErrDowngrade is returned when a node announces a weaker protocol than it
+// did before
+var ErrDowngrade = errors.New("peer downgraded its protocol")
+
+// pinnedSecurity is the strongest protocol a node has announced. It is
+// kept across restarts, so whoever sits between two nodes cannot make them
+// fall back to an older protocol by rewriting the hello on a reconnect.
+type pinnedSecurity struct {
+	Version  int       `json:"version"`
+	Protobuf bool      `json:"protobuf"` // announced CapProtobuf, so is never sent gob again
+	Seen     time.Time `json:"seen"`
+}
+
+// weakerThan describes how p falls short of pin, or returns "" if it does not
+func (p pinnedSecurity) weakerThan(pin pinnedSecurity) string {
+	switch {
+	case p.Version < pin.Version:
+		return fmt.Sprintf("protocol version %d, pinned %d", p.Version, pin.Version)
+	case pin.Protobuf && !p.Protobuf:
+		return "gob encoding, pinned protobuf"
+	}
+	return ""
+}
+
+// securityPath is where the pinned protocols of known nodes are kept
+func (s *FileServer) securityPath() string {
+	return filepath.Join(s.StorageRoot, "security.json")
+}
+
+// loadSecurity reads the protocols pinned before the node restarted
+func (s *FileServer) loadSecurity() error {
+	data, err := os.ReadFile(s.securityPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var pinned map[string]pinnedSecurity
+	if err := json.Unmarshal(data, &pinned); err != nil {
+		return err
+	}
+	s.securityMu.Lock()
+	defer s.securityMu.Unlock()
+	maps.Copy(s.security, pinned)
+	return nil
+}
+
+// saveSecurity persists the pinned protocols. Callers hold securityMu.
+func (s *FileServer) saveSecurity() error {
+	data, err := json.MarshalIndent(s.security, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.securityPath(), data, 0644)
+}
+
+// checkDowngrade pins the protocol a node announces in its hello, and
+// refuses the connection if it is weaker than the one pinned for the node.
+// With AllowDowngrade the weaker protocol is pinned instead, for networks
+// that roll a node back to an older release on purpose.
+func (s *FileServer) checkDowngrade(from string, msg MessageHello) error {
+	node := crypto.Fingerprint(msg.PublicKey)
+	announced := pinnedSecurity{
+		Version:  max(msg.Version, 1),
+		Protobuf: slices.Contains(msg.Caps, CapProtobuf),
+		Seen:     time.Now().UTC(),
+	}
+
+	s.securityMu.Lock()
+	defer s.securityMu.Unlock()
+	pin, ok := s.security[node]
+	if ok {
+		if weaker := announced.weakerThan(pin); weaker != "" {
+			if !s.AllowDowngrade {
+				s.Logger.Warn("refusing peer that downgraded its protocol", "peer", from, "node", node, "announced", weaker)
+				s.Metrics.IncDowngradesRefused()
+				s.Events.Publish(events.Event{Type: events.PeerDowngrade, Peer: from, Detail: weaker})
+				return fmt.Errorf("%w: %s announced %s", ErrDowngrade, from, weaker)
+			}
+			s.Logger.Warn("peer downgraded its protocol, allowed by configuration", "peer", from, "node", node, "announced", weaker)
+		} else if pin.weakerThan(announced) == "" {
+			// Nothing changed, the pin is not rewritten on every connection
+			return nil
+		}
+	}
+
+	s.security[node] = announced
+	if err := s.saveSecurity(); err != nil {
+		s.Logger.Warn("failed to save pinned peer protocols", "err", err)
+	}
+	return nil
+}
@@ -1,52 +1,223 @@
 package network
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
 	"github.com/AdityaKrSingh26/PeerVault/internal/metrics"
 	"github.com/AdityaKrSingh26/PeerVault/internal/quota"
 	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/internal/tracing"
 	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// activityHistory is how many recent events the activity feed keeps
+const activityHistory = 500
+
+// ErrNotFound is returned by Get when no node holds the file
+var ErrNotFound = errors.New("not found on the network")
+
+// ErrNoPeers is returned, along with ErrNotFound, by Get when the file is
+// not stored locally and no peer is connected to ask for it
+var ErrNoPeers = errors.New("no connected peers")
+
+// ErrPeerUnreachable is returned by operations addressed to a peer that is
+// not connected
+var ErrPeerUnreachable = errors.New("not connected")
+
+// ErrQuotaExceeded is returned when a file does not fit in the storage
+// quota or on any disk. It is storage.ErrQuotaExceeded, so errors from the
+// store match it too.
+var ErrQuotaExceeded = storage.ErrQuotaExceeded
+
+// ErrCorrupted is returned when a stored file fails its integrity check,
+// because its content changed on disk or it was encrypted with another key
+var ErrCorrupted = errors.New("integrity check failed")
+
+// ErrReadOnly is returned by writes to a node that does not take them: a
+// guest, or a metadata-only node storing a file
+var ErrReadOnly = errors.New("read-only")
+
+// tracer records spans of file operations. It does nothing unless tracing
+// was set up with tracing.Setup.
+var tracer = otel.Tracer("github.com/AdityaKrSingh26/PeerVault/internal/network")
+
+// startChildSpan starts a span only within a traced operation, so that
+// background traffic such as peer exchange does not start traces of its own
+func startChildSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 // configuration options
 type FileServerOpts struct {
-	ID                string
-	EncKey            []byte
-	StorageRoot       string
-	PathTransformFunc storage.PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
-	Logger            *slog.Logger
-	FetchTimeout      time.Duration
-	PexInterval       time.Duration
-	GCInterval        time.Duration
-	GCDelay           time.Duration
+	ID                  string
+	EncKey              []byte
+	StorageRoot         string
+	PathTransformFunc   storage.PathTransformFunc
+	Transport           p2p.Transport
+	BootstrapNodes      []string
+	Logger              *slog.Logger
+	FetchTimeout        time.Duration
+	PexInterval         time.Duration
+	GCInterval          time.Duration
+	GCDelay             time.Duration
+	AntiEntropyInterval time.Duration     // How often file sets are compared with a random peer
+	MetricsInterval     time.Duration     // How often storage and peer gauges are refreshed
+	ReplicationFactor   int               // Copies of every stored file to keep, including the local one
+	ReplicaTimeout      time.Duration     // How long a holder may stay offline before its files are re-replicated
+	DownloadChunkSize   int64             // Size of the byte ranges fetched in parallel from peers
+	Readahead           int64             // Bytes read ahead of sequential range reads of remote files, 0 for the default and negative for none
+	TrustedPeers        []string          // Identity fingerprints whose revocations (MessagePeerRevoked) are honored
+	Identity            *crypto.Identity  // Signing key, loaded from StorageRoot if nil
+	GuestToken          string            // Joins the network read-only until the grant expires
+	GuestIssuers        []string          // Identity fingerprints whose guest tokens are honored, besides this node's own
+	Labels              map[string]string // Announced to peers, available to their Placement callbacks
+	Placement           PlacementFunc     // Vetoes or redirects replication of individual keys
+	DeviceKeys          bool              // Encrypts every file with its own data key, wrapped per authorized device
+	InboxAutoAccept     int64             // Files sent directly to this node up to this size are accepted without asking
+	MaxUpload           int64             // Bytes per second streamed to all peers together, 0 for no limit
+	MaxDownload         int64             // Bytes per second received from all peers together, 0 for no limit
+	PeerMaxUpload       int64             // Bytes per second streamed to each peer, 0 for no limit
+	PeerMaxDownload     int64             // Bytes per second received from each peer, 0 for no limit
+	MaxInboundStreams   int               // Streams received at once, 0 for the default and negative for no limit
+	MaxOutboundStreams  int               // Streams sent at once, 0 for the default and negative for no limit
+	AllowDowngrade      bool              // Accepts nodes that announce a weaker protocol than they did before
+	Pinner              Pinner            // Keeps a copy of every stored file on a remote archival service
+	MetadataOnly        bool              // Indexes the network's files without storing or replicating any
+	PolicyAdmins        []string          // Identity fingerprints whose shared policies are applied
+	PolicyOverrides     []string          // Policy settings kept from this node's own configuration
+	AdvertiseAddr       string            // Address peers are told to connect to this node at
+	PublicIP            *PublicIPDetector // Keeps AdvertiseAddr on the public IP as it changes, nil to keep it fixed
+	RelayAddr           string            // Relays connections between introduced peers that cannot punch through, empty to not relay
+	NetworkID           string            // Network the node belongs to, announced over mDNS; the transport handshake enforces it
+	Disks               []storage.Disk    // Disks files are spread over, files are stored in StorageRoot if empty
+	ShardFunc           storage.ShardFunc // Picks the disk of each file, rendezvous hashing if nil
+	Backend             storage.Backend   // Holds stored files instead of the disks, e.g. S3, if set
+
+	// Compresses files stored on this node before encrypting them
+	Compression storage.Compression
+	// Keeps earlier versions of files stored again, nil to overwrite them
+	Versions *storage.VersionRetention
+
+	// How long deleted files are kept in the trash, 0 to delete them at once
+	Trash time.Duration
+
+	// Failed repairs of a quarantined corrupted file before it is removed,
+	// storage.GarbageCollector's default if 0
+	QuarantineRetries int
+
+	// Derives the IV of stored files from their content, so identical files
+	// encrypted with the network key are identical on every node. Only the
+	// IV is content-derived: the key stays the network key. Network members
+	// can then confirm a node holds content they guess. Not supported with
+	// DeviceKeys.
+	Convergent bool
+
+	// The cipher files are encrypted with, crypto.AES256CTR if zero.
+	// ChaCha20-Poly1305 is faster on CPUs without AES instructions. Files
+	// are read back whichever cipher encrypted them, so nodes of a network
+	// may use different ones. A framed suite (see crypto.Suite.Framed)
+	// suits large files, which are then checked as they are read.
+	Cipher crypto.Suite
+
+	// Encrypts the records naming stored files, the key map, metadata,
+	// stamps, receipts and pending pushes, with a key derived from EncKey,
+	// so the disk of a node reveals neither file names nor tags
+	EncryptMetadata bool
+
+	// Bans peers whose reputation falls below this score, out of 100, for
+	// PeerScoreBan, an hour if 0. 0 only ranks peers without banning them.
+	MinPeerScore float64
+	PeerScoreBan time.Duration
+
+	// Hosts or node IDs always refused, and when not empty the only ones
+	// accepted. Entries added at runtime are kept in the storage root.
+	AllowPeers []string
+	BlockPeers []string
+
+	// Connections beyond which inbound ones are declined and discovery and
+	// peer exchange stop dialing, 0 for no limit
+	MaxPeers int
+
+	// Percentage of the storage quota in use that publishes
+	// events.QuotaWarning, 90 if 0. A negative value turns the warning off.
+	QuotaWarning float64
+
+	// Peers that must acknowledge a verified replica before Store returns,
+	// 0 to return once the file is stored locally. See writeconcern.go.
+	WriteConcern int
+
+	// Journal the replication of files stored while the node has no peers,
+	// and deletes, which peers are told about so they remove their replicas
+	// too. Both are handed to peers as they (re)connect, see deletes.go.
+	OfflineQueue bool
 }
 
 // StreamHeader represents the header of a file stream sent over the network.
+// Offset is non-zero when the stream resumes an interrupted transfer; the stream
+// then carries only the bytes from Offset up to Size. Range streams answer a
+// ranged MessageGetFile and carry exactly Length bytes starting at Offset.
 type StreamHeader struct {
-	ID   string
-	Key  string
-	Size int64
+	ID     string            `wire:"1"`
+	Key    string            `wire:"2"`
+	Size   int64             `wire:"3"`
+	Offset int64             `wire:"4"`
+	Length int64             `wire:"5"`
+	Range  bool              `wire:"6"`
+	Drop   bool              `wire:"7"` // Sent to this node only, stored in the recipient's inbox
+	Trace  map[string]string `wire:"8"` // Trace context of the operation that sent the stream
+	Clock  hlc.Timestamp     `wire:"9"` // When the streamed version was stored, zero if unknown
+
+	// When the file expires, zero for never
+	Expires time.Time `wire:"10"`
+
+	// Hex SHA-256 of the complete stored file, empty if unknown. Receivers
+	// of a replica check it before keeping the file.
+	Hash string `wire:"11"`
 }
 
 // Manages file storage, peer connections, and network communication.
 type FileServer struct {
 	FileServerOpts
 
+	// Peers holds the connected nodes by node ID, the fingerprint of the
+	// key they introduced themselves with, each with its preferred
+	// connection. A node reached over several addresses has one entry; its
+	// connections are its paths, see PeerPaths.
 	PeerLock sync.Mutex
 	Peers    map[string]p2p.Peer
+	conns    map[string]p2p.Peer // every open connection by remote address, introduced or not
 
 	store        *storage.Store
 	QuotaManager *quota.QuotaManager
@@ -54,14 +225,191 @@ type FileServer struct {
 	Metrics      *metrics.Metrics
 	Discovery    *DiscoveryService
 	Pex          *PeerExchangeService
+	Events       *events.Bus
+	Clock        *hlc.Clock // orders stores and deletes across nodes, see clock.go
 	quitch       chan struct{}
+	stopOnce     sync.Once
+	listening    atomic.Bool // the transport accepts connections, see readiness.go
+
+	// In-flight streams, drained by Shutdown. See shutdown.go.
+	transfersMu  sync.Mutex
+	transfers    int
+	draining     bool
+	drained      chan struct{}
+	drainch      chan struct{}
+	shutdownOnce sync.Once
 
 	waitersMu sync.Mutex
 	waiters   map[string][]chan struct{}
+
+	// Replica pushes not completed yet, keyed by original key, see pending.go.
+	// They are offered again to peers when they (re)connect. Deletes not
+	// delivered to enough peers yet are kept alike, see deletes.go.
+	pendingMu      sync.Mutex
+	pendingPushes  map[string]int64
+	pendingDeletes map[string]*pendingDelete
+
+	// Strongest protocol each node announced, keyed by node fingerprint (security.go)
+	securityMu sync.Mutex
+	security   map[string]pinnedSecurity
+
+	// Per-peer write locks, see lockPeerWrites
+	writeLocks sync.Map
+
+	// Parallel downloads in progress, keyed by original key
+	downloadsMu sync.Mutex
+	downloads   map[string]*download
+
+	// Bandwidth limits: total buckets and per-peer buckets keyed by address (bandwidth.go)
+	upload        *tokenBucket
+	download      *tokenBucket
+	bandwidthMu   sync.Mutex
+	peerBandwidth map[string]*peerBandwidth
+
+	// Slots for the streams running at once in each direction (limits.go)
+	inbound  streamLimit
+	outbound streamLimit
+
+	// Network fetches shared by concurrent Gets, keyed by hashed key (fetch.go)
+	fetchesMu sync.Mutex
+	fetches   map[string]*fetch
+
+	// Banned hosts and when their bans expire
+	bansMu sync.Mutex
+	bans   map[string]time.Time
+
+	// Replication receipts of files stored by this node, keyed by original key
+	receiptsMu sync.Mutex
+	receipts   map[string]*Receipt
+	ackSignals map[string]chan struct{} // closed at the next confirmation of a key, see writeconcern.go
+	// Rejections of replicas by node and key, see verify.go
+	replicaNacks map[string]int
+
+	// When every key was last stored or deleted. See clock.go.
+	stampsMu sync.Mutex
+	stamps   map[string]keyStamp
+
+	// Network file listings waiting for peer catalogs, keyed by request ID
+	catalogMu       sync.Mutex
+	catalogRequests map[string]chan catalogReply
+
+	// Reachability probes waiting for peers to connect back, keyed by
+	// request ID. See probe.go.
+	probeMu sync.Mutex
+	probes  map[string]chan ProbeResult
+
+	// Range reads waiting for peers to answer, keyed by request ID, and the
+	// peer that answered the last range read of each key. See readrange.go.
+	rangeMu      sync.Mutex
+	rangeReads   map[string]chan rangeReply
+	rangeSources map[string]string
+	readaheadMu  sync.Mutex
+	readaheads   map[string]*readahead
+
+	// Address peers are told to connect to, kept current by watchPublicIP.
+	// See publicip.go.
+	advertiseMu   sync.Mutex
+	advertiseAddr string
+
+	// Introductions already acted on, keyed by request ID, and the relay
+	// offered to introduced peers. See holepunch.go and relay.go.
+	punchMu sync.Mutex
+	punches map[string]time.Time
+	relay   *relay
+
+	// Connections grouped by remote node (public key fingerprint), and the
+	// node every known connection address belongs to. See paths.go.
+	pathsMu     sync.Mutex
+	nodePaths   map[string][]*peerPath
+	pathNode    map[string]string
+	nodeLabels  map[string]map[string]string
+	nodeDevices map[string][]byte
+	indexNodes  map[string]bool   // nodes running metadata-only, never given replicas
+	nodeAddrs   map[string]string // addresses nodes advertise for new connections
+
+	// Protocol versions, message types and capabilities peers announced in
+	// their hello, keyed by connection address. See protocol.go.
+	protoMu   sync.RWMutex
+	protocols map[string]*peerProtocol
+
+	// Nodes holding replicas of files stored by this node, keyed by original
+	// key, and holders that went offline. See repair.go.
+	replicasMu      sync.Mutex
+	holders         map[string]map[string]bool
+	offline         map[string]time.Time
+	underReplicated map[string]bool
+
+	// Guest access: when this node's own grant ends (zero for members),
+	// and the guests connected to this node with their grants
+	guestUntil time.Time
+	guestsMu   sync.Mutex
+	guests     map[string]*guestSession
+
+	// Device keys: this device's key pair, the devices allowed to read its
+	// files and the data key of every readable file. See devices.go.
+	deviceKey *crypto.DeviceKey
+	devicesMu sync.Mutex
+	devices   []AuthorizedDevice
+	fileKeys  map[string][]byte
+
+	// Files peers offered to send to this node, the accepted ones still to
+	// arrive, and the files this node offered to peers. See drop.go.
+	inboxMu  sync.Mutex
+	offers   map[string]*InboxOffer
+	accepted map[string]bool
+	outbox   []*OutboxEntry
+
+	// Metadata-only mode: the catalog of every connected peer, keyed by
+	// address, and when it was last refreshed. See index.go.
+	indexMu      sync.Mutex
+	catalogs     map[string][]storage.FileInfo
+	indexUpdated time.Time
+
+	// Legal holds by key or namespace, and the audit log recording them.
+	// See hold.go.
+	holdsMu sync.Mutex
+	holds   map[string]LegalHold
+	auditMu sync.Mutex
+
+	// Shared policy published by an admin node. See policy.go.
+	policyMu sync.Mutex
+	policy   *Policy
+
+	// Maintenance runs started on demand, oldest first. See maintenance.go.
+	maintenanceMu sync.Mutex
+	maintenance   []*MaintenanceRun
+
+	// Stored files whose HMAC was checked, with the size and modification
+	// time they had then. See open.go.
+	verifiedMu sync.Mutex
+	verified   map[string]fileVersion
+
+	// Reputation of peers, keyed by node or by address until they said
+	// hello. See reputation.go.
+	scoresMu sync.Mutex
+	scores   map[string]*PeerScore
+
+	// Allowlist and blocklist, the configured entries apart from the ones
+	// changed at runtime, and the addresses of blocked nodes seen. See
+	// peerlists.go.
+	listsMu      sync.Mutex
+	lists        PeerLists
+	configLists  PeerLists
+	blockedAddrs map[string]string // address to node
+
+	// Full nodes that declined a connection, and until when they are not
+	// dialed again. See admission.go.
+	admitMu   sync.Mutex
+	fullPeers map[string]time.Time
+
+	// Whether storage use is above QuotaWarning, so the warning is
+	// published once per crossing. See events.go.
+	quotaWarned atomic.Bool
 }
 
-// Initializes a new "FileServer" instance.
-func NewFileServer(opts FileServerOpts) *FileServer {
+// Initializes a new "FileServer" instance. It fails when opts are invalid
+// or the node's identity and state cannot be loaded from its storage root.
+func NewFileServer(opts FileServerOpts) (*FileServer, error) {
 	if opts.Logger == nil {
 		opts.Logger = slog.Default()
 	}
@@ -78,60 +426,275 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 	if opts.GCDelay == 0 {
 		opts.GCDelay = 5 * time.Minute
 	}
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = 2 * time.Minute
+	}
+	if opts.MetricsInterval == 0 {
+		opts.MetricsInterval = 15 * time.Second
+	}
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = 3
+	}
+	if opts.ReplicaTimeout == 0 {
+		opts.ReplicaTimeout = 10 * time.Minute
+	}
+	if opts.DownloadChunkSize == 0 {
+		opts.DownloadChunkSize = defaultDownloadChunkSize
+	}
+	// Files sealed with a device key get a random data key each, so they
+	// would never converge; refuse rather than silently not deduplicate
+	if opts.Convergent && opts.DeviceKeys {
+		return nil, fmt.Errorf("convergent encryption cannot be combined with device keys")
+	}
 
 	storeOpts := storage.StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Disks:             opts.Disks,
+		ShardFunc:         opts.ShardFunc,
+		Backend:           opts.Backend,
+		Compression:       opts.Compression,
+		Versions:          opts.Versions,
+		Trash:             opts.Trash,
+		Convergent:        opts.Convergent,
+		Cipher:            opts.Cipher,
+	}
+	if opts.EncryptMetadata && opts.EncKey != nil {
+		storeOpts.MetaKey = crypto.DeriveKey(opts.EncKey, "metadata")
 	}
 
 	if len(opts.ID) == 0 {
-		id, err := crypto.GenerateID()
+		id, err := loadOrCreateNodeID(filepath.Join(opts.StorageRoot, "node.id"))
 		if err != nil {
-			opts.Logger.Error("failed to generate secure node ID", "err", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("failed to generate secure node ID: %w", err)
 		}
 		opts.ID = id
 	}
 
 	if err := storage.ValidateNodeID(opts.ID); err != nil {
-		opts.Logger.Error("invalid node ID", "node", opts.ID, "err", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("invalid node ID %q: %w", opts.ID, err)
+	}
+
+	if opts.Identity == nil {
+		identity, err := crypto.LoadOrCreateIdentity(filepath.Join(opts.StorageRoot, "identity.key"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load node identity: %w", err)
+		}
+		opts.Identity = identity
+	}
+
+	var guestUntil time.Time
+	var guestExpired error
+	if opts.GuestToken != "" {
+		grant, err := ParseGuestToken(opts.GuestToken)
+		switch {
+		case errors.Is(err, ErrGuestExpired):
+			guestExpired = err
+		case err != nil:
+			return nil, fmt.Errorf("invalid guest token: %w", err)
+		case grant.Guest != opts.Identity.Fingerprint():
+			return nil, fmt.Errorf("invalid guest token: issued for node %s, this node is %s", grant.Guest, opts.Identity.Fingerprint())
+		default:
+			guestUntil = grant.Expires
+		}
 	}
 
 	store := storage.NewStore(storeOpts)
 	quotaManager := quota.NewQuotaManager(opts.StorageRoot, opts.Logger)
+	quotaManager.SetDataDirs(store.DiskPaths())
 	gc := storage.NewGarbageCollector(store, opts.ID, opts.GCInterval, opts.GCDelay, opts.Logger)
 	metricsObj := metrics.NewMetrics()
+	bus := events.NewBus(activityHistory)
+	gc.OnFinding = func(kind string, path string) {
+		bus.Publish(events.Event{Type: events.GCFinding, Key: path, Detail: kind})
+		metricsObj.IncGCFinding(kind)
+		if kind == "repaired" {
+			metricsObj.IncFilesRepaired()
+		}
+	}
 
 	server := &FileServer{
-		FileServerOpts: opts,
-		store:          store,
-		QuotaManager:   quotaManager,
-		GC:             gc,
-		Metrics:        metricsObj,
-		quitch:         make(chan struct{}),
-		Peers:          make(map[string]p2p.Peer),
-		waiters:        make(map[string][]chan struct{}),
+		FileServerOpts:  opts,
+		store:           store,
+		QuotaManager:    quotaManager,
+		GC:              gc,
+		Metrics:         metricsObj,
+		Events:          bus,
+		Clock:           hlc.NewClock(),
+		quitch:          make(chan struct{}),
+		drainch:         make(chan struct{}),
+		Peers:           make(map[string]p2p.Peer),
+		conns:           make(map[string]p2p.Peer),
+		waiters:         make(map[string][]chan struct{}),
+		pendingPushes:   make(map[string]int64),
+		pendingDeletes:  make(map[string]*pendingDelete),
+		security:        make(map[string]pinnedSecurity),
+		downloads:       make(map[string]*download),
+		fetches:         make(map[string]*fetch),
+		upload:          newTokenBucket(opts.MaxUpload),
+		download:        newTokenBucket(opts.MaxDownload),
+		peerBandwidth:   make(map[string]*peerBandwidth),
+		inbound:         newStreamLimit(opts.MaxInboundStreams),
+		outbound:        newStreamLimit(opts.MaxOutboundStreams),
+		bans:            make(map[string]time.Time),
+		scores:          make(map[string]*PeerScore),
+		blockedAddrs:    make(map[string]string),
+		fullPeers:       make(map[string]time.Time),
+		catalogRequests: make(map[string]chan catalogReply),
+		probes:          make(map[string]chan ProbeResult),
+		rangeReads:      make(map[string]chan rangeReply),
+		rangeSources:    make(map[string]string),
+		readaheads:      make(map[string]*readahead),
+		advertiseAddr:   opts.AdvertiseAddr,
+		punches:         make(map[string]time.Time),
+		receipts:        make(map[string]*Receipt),
+		ackSignals:      make(map[string]chan struct{}),
+		replicaNacks:    make(map[string]int),
+		stamps:          make(map[string]keyStamp),
+		nodePaths:       make(map[string][]*peerPath),
+		pathNode:        make(map[string]string),
+		nodeLabels:      make(map[string]map[string]string),
+		nodeDevices:     make(map[string][]byte),
+		indexNodes:      make(map[string]bool),
+		nodeAddrs:       make(map[string]string),
+		protocols:       make(map[string]*peerProtocol),
+		holders:         make(map[string]map[string]bool),
+		offline:         make(map[string]time.Time),
+		underReplicated: make(map[string]bool),
+		guestUntil:      guestUntil,
+		guests:          make(map[string]*guestSession),
+		fileKeys:        make(map[string][]byte),
+		offers:          make(map[string]*InboxOffer),
+		accepted:        make(map[string]bool),
+		catalogs:        make(map[string][]storage.FileInfo),
+		holds:           make(map[string]LegalHold),
+		verified:        make(map[string]fileVersion),
+	}
+	gc.Held = server.heldHash
+	gc.Verify = server.verifyStored
+	gc.Expire = server.expireFile
+	gc.Repair = server.repairFile
+	gc.Expected = server.expectedFiles
+	gc.RepairAttempts = opts.QuarantineRetries
+
+	// Publish the counts of every run, and refresh the dedup metrics along
+	// with the integrity check, which reads every file as well
+	gc.OnRun = func(elapsed time.Duration) {
+		metricsObj.ObserveGCRun(elapsed)
+		if report, ok := gc.LastRun(); ok {
+			metricsObj.SetGCLastRun(report.Started, report.Stats.Counts())
+		}
+		if _, err := server.DedupStats(context.Background(), 0); err != nil {
+			opts.Logger.Warn("failed to update dedup stats", "err", err)
+		}
 	}
 
 	server.Pex = NewPeerExchangeService(server, opts.PexInterval, opts.Logger)
-	return server
+	if err := metricsObj.RegisterKnownPeers(server.Pex.GetPeersBySource); err != nil {
+		opts.Logger.Warn("failed to register discovery metrics", "err", err)
+	}
+	if err := metricsObj.RegisterPeerRTT(server.peerRTTs); err != nil {
+		opts.Logger.Warn("failed to register peer round trip metrics", "err", err)
+	}
+	if err := server.loadReceipts(); err != nil {
+		opts.Logger.Warn("failed to load receipts", "err", err)
+	}
+	if err := server.loadStamps(); err != nil {
+		opts.Logger.Warn("failed to load key stamps", "err", err)
+	}
+	if err := server.loadPendingPushes(); err != nil {
+		opts.Logger.Warn("failed to load pending replica pushes", "err", err)
+	}
+	if err := server.loadPendingDeletes(); err != nil {
+		opts.Logger.Warn("failed to load pending deletes", "err", err)
+	}
+	if err := server.loadSecurity(); err != nil {
+		opts.Logger.Warn("failed to load pinned peer protocols", "err", err)
+	}
+	if err := server.loadPeerLists(opts.AllowPeers, opts.BlockPeers); err != nil {
+		return nil, fmt.Errorf("failed to load peer lists: %w", err)
+	}
+	server.loadHolders()
+	if err := server.loadHolds(); err != nil {
+		return nil, fmt.Errorf("failed to load legal holds: %w", err)
+	}
+	if err := server.loadPolicy(); err != nil {
+		opts.Logger.Warn("failed to load shared policy", "err", err)
+	}
+	if opts.DeviceKeys {
+		if err := server.loadDevices(); err != nil {
+			return nil, fmt.Errorf("failed to load device keys: %w", err)
+		}
+	}
+	if guestExpired != nil {
+		// Data cached during the visit must not outlive the grant
+		if err := server.ClearStorage(ClearAll, false); err != nil {
+			return nil, fmt.Errorf("failed to purge guest storage: %w", err)
+		}
+		return nil, fmt.Errorf("invalid guest token: %w", guestExpired)
+	}
+	return server, nil
 }
 
-// Sends a message to all connected peers.
-func (s *FileServer) broadcast(msg *Message) error {
-	s.PeerLock.Lock()
-	defer s.PeerLock.Unlock()
+// loadOrCreateNodeID reads the node ID kept at path, generating it on first
+// start. Files are stored under the node ID, so it has to survive restarts
+// for the node to find them again.
+func loadOrCreateNodeID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
 
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+	id, err := crypto.GenerateID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return id, os.WriteFile(path, []byte(id+"\n"), 0600)
+}
+
+// Sends a message to all connected peers.
+func (s *FileServer) broadcast(ctx context.Context, msg *Message) (err error) {
+	ctx, span := startChildSpan(ctx, "broadcast", trace.WithAttributes(attribute.String("message", fmt.Sprintf("%T", msg.Payload))))
+	defer func() { endSpan(span, err) }()
+	msg.Trace = tracing.Inject(ctx)
+
+	// Encoded once per encoding the peers need
+	frames := make(map[bool][]byte)
+	frameFor := func(wire bool) ([]byte, error) {
+		if frame, ok := frames[wire]; ok {
+			return frame, nil
+		}
+		payload, err := encodeMessage(msg, wire)
+		if err != nil {
+			return nil, err
+		}
+		frames[wire] = p2p.EncodeMessage(payload)
+		return frames[wire], nil
 	}
 
+	// Snapshot peers so a slow peer does not hold the peer map locked.
+	// Nodes reachable over several connections get the message once.
+	peers := s.broadcastPeers()
+	span.SetAttributes(attribute.Int("peers", len(peers)))
+
 	var failed []string
-	for addr, peer := range s.Peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+	for addr, peer := range peers {
+		if !s.accepts(peer, msg.Payload) {
+			s.Logger.Debug("peer does not support broadcast message", "peer", addr, "message", messageName(msg.Payload))
+			continue
+		}
+		frame, err := frameFor(s.speaksWire(peer))
+		if err != nil {
+			return err
+		}
+		err = s.sendFrame(peer, frame)
+		if err != nil {
 			failed = append(failed, addr)
 			s.Logger.Warn("broadcast failed to peer", "peer", addr, "err", err)
 		}
@@ -142,26 +705,106 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
-// Generic message wrapper
+// sendMessage sends a single framed message to one peer
+func (s *FileServer) sendMessage(peer p2p.Peer, msg *Message) error {
+	if !s.accepts(peer, msg.Payload) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, messageName(msg.Payload))
+	}
+	payload, err := encodeMessage(msg, s.speaksWire(peer))
+	if err != nil {
+		return err
+	}
+	return s.sendFrame(peer, p2p.EncodeMessage(payload))
+}
+
+// speaksWire reports whether a peer is sent the protobuf encoding rather
+// than gob
+func (s *FileServer) speaksWire(peer p2p.Peer) bool {
+	return s.PeerSupports(peer.RemoteAddr().String(), CapProtobuf)
+}
+
+// sendFrame writes a framed message to a peer. If the connection is broken
+// and the node is reachable over another path, the frame is sent there.
+func (s *FileServer) sendFrame(peer p2p.Peer, frame []byte) error {
+	unlock := s.lockPeerWrites(peer)
+	err := peer.Send(frame)
+	unlock()
+	if err == nil {
+		return nil
+	}
+
+	alt, ok := s.failoverPeer(peer)
+	if !ok {
+		return err
+	}
+	s.Logger.Info("failing over to another path", "peer", peer.RemoteAddr().String(), "path", alt.RemoteAddr().String(), "err", err)
+	unlock = s.lockPeerWrites(alt)
+	defer unlock()
+	return alt.Send(frame)
+}
+
+// lockPeerWrites serializes writes to a peer connection so that messages
+// and streams sent from different goroutines never interleave on the wire.
+func (s *FileServer) lockPeerWrites(peer p2p.Peer) func() {
+	mu, _ := s.writeLocks.LoadOrStore(peer, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Generic message wrapper. Trace carries the trace context of the
+// operation that sent the message, so the receiver's spans join its trace.
 type Message struct {
 	Payload any
+	Trace   map[string]string
 }
 
-// Notifies peers about a file being stored
+// Notifies peers about a file being stored.
+// Receivers that miss the file (or hold a partial copy) pull it with MessageGetFile.
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	ID    string        `wire:"1"`
+	Key   string        `wire:"2"`
+	Size  int64         `wire:"3"`
+	Clock hlc.Timestamp `wire:"4"` // when the offered version was stored, zero if unknown
 }
 
-// Requests a file from peers
+// Requests a file from peers, starting at Offset for resumed transfers.
+// A non-zero Length asks for just that byte range.
 type MessageGetFile struct {
-	ID  string
-	Key string
+	ID     string `wire:"1"`
+	Key    string `wire:"2"`
+	Offset int64  `wire:"3"`
+	Length int64  `wire:"4"`
+}
+
+// Asks peers whether they hold a file before any range is requested
+type MessageHasFile struct {
+	ID  string `wire:"1"`
+	Key string `wire:"2"` // hashed key
+}
+
+// Answers a MessageHasFile. Size is the stored size of the file when Has is true.
+type MessageHasFileResponse struct {
+	ID   string `wire:"1"`
+	Key  string `wire:"2"` // hashed key
+	Has  bool   `wire:"3"`
+	Size int64  `wire:"4"`
+}
+
+// contextReader stops a read loop once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
 }
 
 // decryptOnTheFly decrypts an encrypted reader stream on-the-fly using io.Pipe
-func (s *FileServer) decryptOnTheFly(ctx context.Context, r io.Reader) io.Reader {
+func (s *FileServer) decryptOnTheFly(ctx context.Context, encKey []byte, r io.Reader) io.Reader {
 	pr, pw := io.Pipe()
 	go func() {
 		defer func() {
@@ -172,7 +815,10 @@ func (s *FileServer) decryptOnTheFly(ctx context.Context, r io.Reader) io.Reader
 
 		errChan := make(chan error, 1)
 		go func() {
-			_, err := crypto.CopyDecrypt(s.EncKey, r, pw)
+			_, span := startChildSpan(ctx, "decrypt")
+			n, err := crypto.CopyDecrypt(encKey, r, pw)
+			span.SetAttributes(attribute.Int64("bytes", n))
+			endSpan(span, err)
 			errChan <- err
 		}()
 
@@ -192,6 +838,23 @@ func (s *FileServer) decryptOnTheFly(ctx context.Context, r io.Reader) io.Reader
 
 // Retrieves a file from the local store or fetches it from the network.
 func (s *FileServer) Get(ctx context.Context, key string) (io.Reader, error) {
+	ctx, span := tracer.Start(ctx, "Get", trace.WithAttributes(attribute.String("key", key)))
+	start := time.Now()
+	r, err := s.get(ctx, key)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	s.Metrics.IncFilesRetrieved()
+	s.Metrics.ObserveGet(time.Since(start))
+	return r, nil
+}
+
+func (s *FileServer) get(ctx context.Context, key string) (io.Reader, error) {
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open data key of %s: %w", key, err)
+	}
 
 	// Checks if the file exists locally.
 	if s.store.Has(s.ID, key) {
@@ -200,64 +863,98 @@ func (s *FileServer) Get(ctx context.Context, key string) (io.Reader, error) {
 		if err != nil {
 			return nil, err
 		}
-		return s.decryptOnTheFly(ctx, r), nil
+		s.Events.Publish(events.Event{Type: events.FileRetrieved, Key: key, Detail: "local"})
+		return storage.Decompress(s.decryptOnTheFly(ctx, encKey, r)), nil
 	}
 
-	s.Logger.Info("fetching file from network", "peer", s.Transport.Addr(), "key", key)
-
-	ch, err := s.registerFileWaiter(key)
+	source, err := s.fetchShared(ctx, key)
 	if err != nil {
 		return nil, err
 	}
 
-	// If not, broadcasts a MessageGetFile request to peers.
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: crypto.HashKey(key),
-		},
-	}
-	if err := s.broadcast(&msg); err != nil {
-		s.Logger.Warn("file request broadcast encountered errors", "err", err)
-	}
-
-	// Wait for notification or timeout
-	select {
-	case <-ch:
-		// File was successfully received and written to disk
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-time.After(s.FetchTimeout):
-		return nil, fmt.Errorf("file %s not found on the network (timeout)", key)
-	}
-
 	_, r, err := s.store.Read(s.ID, key)
 	if err != nil {
 		return nil, err
 	}
-	return s.decryptOnTheFly(ctx, r), nil
+	s.Events.Publish(events.Event{Type: events.FileRetrieved, Key: key, Detail: source})
+	return storage.Decompress(s.decryptOnTheFly(ctx, encKey, r)), nil
 }
 
-// Stores a file locally and notifies peers.
+// Stores a file locally and notifies peers. Cancelling ctx aborts the local
+// write, removing the incomplete file, and skips replicas not yet started.
 func (s *FileServer) Store(ctx context.Context, key string, r io.Reader) error {
+	return s.storeFile(ctx, key, r, time.Time{})
+}
+
+// storeFile stores a file that expires at expires, or never if it is zero
+func (s *FileServer) storeFile(ctx context.Context, key string, r io.Reader, expires time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "Store", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	if s.IsGuest() {
+		return fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	if s.MetadataOnly {
+		return fmt.Errorf("metadata-only node does not store files: %w", ErrReadOnly)
+	}
+
+	start := time.Now()
+	dataKey, err := s.sealFileKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to create data key: %w", err)
+	}
+
 	// Store encrypted locally (streaming / constant memory)
-	size, err := s.store.WriteEncrypt(s.EncKey, s.ID, key, r)
+	size, err := s.store.WriteEncrypt(dataKey, s.ID, key, contextReader{ctx: ctx, r: r})
 	if err != nil {
+		if ctx.Err() != nil {
+			s.store.Delete(s.ID, key)
+		}
 		return err
 	}
+	span.SetAttributes(attribute.Int64("bytes", size))
+	if err := s.store.SetExpiry(s.ID, key, expires); err != nil {
+		return fmt.Errorf("failed to set expiry: %w", err)
+	}
+	clock := s.Clock.Now()
+	s.stampKey(key, clock, false)
+	s.Events.Publish(events.Event{Type: events.FileStored, Key: key, Detail: metrics.FormatBytes(size)})
+	s.Metrics.IncFilesStored()
+	defer func() { s.Metrics.ObserveStore(time.Since(start)) }()
+	if s.deviceKey != nil {
+		s.shareFileKey(key, dataKey)
+	}
 
-	s.PeerLock.Lock()
-	defer s.PeerLock.Unlock()
+	// Replicas confirm with signed acks that are collected into a receipt
+	s.forgetHolders(key)
+	if err := s.startReceipt(key, size); err != nil {
+		s.Logger.Warn("failed to create store receipt", "key", key, "err", err)
+	}
 
-	// Stream to all connected peers concurrently
-	for _, peer := range s.Peers {
+	// Stream to all connected peers concurrently. The push stays journaled
+	// until every peer has the file, so a crash midway resumes it on restart.
+	// With OfflineQueue a file stored without any peer is journaled too,
+	// until one connects.
+	s.clearPendingDelete(key)
+	peers := s.replicaPeers()
+	targets := s.placeReplicas(key, peers)
+	if len(targets) > 0 || (len(peers) == 0 && s.OfflineQueue) || s.WriteConcern > 0 {
+		s.addPendingPush(key, size)
+	}
+	var pushes sync.WaitGroup
+	var failed atomic.Bool
+	for _, peer := range targets {
+		pushes.Add(1)
 		go func(p p2p.Peer) {
+			defer pushes.Done()
 			if ctx.Err() != nil {
+				failed.Store(true)
 				return
 			}
 			_, fileReader, err := s.store.Read(s.ID, key)
 			if err != nil {
 				s.Logger.Error("failed to read local file for streaming", "key", key, "err", err)
+				failed.Store(true)
 				return
 			}
 			defer func() {
@@ -266,32 +963,148 @@ func (s *FileServer) Store(ctx context.Context, key string, r io.Reader) error {
 				}
 			}()
 
-			if err := s.sendStream(p, key, size, fileReader); err != nil {
+			release, err := s.beginOutbound(ctx, true)
+			if err != nil {
+				s.Logger.Error("failed to send stream to peer", "peer", p.RemoteAddr().String(), "key", key, "err", err)
+				failed.Store(true)
+				return
+			}
+			defer release()
+
+			err = s.sendStream(ctx, p, StreamHeader{Key: key, Size: size, Clock: clock, Expires: expires, Hash: s.contentHash(key)}, fileReader)
+			if ctx.Err() == nil {
+				s.recordTransfer(p.RemoteAddr().String(), err)
+			}
+			if err != nil {
 				s.Logger.Error("failed to send stream to peer", "peer", p.RemoteAddr().String(), "key", key, "err", err)
+				failed.Store(true)
+
+				// A node still reachable over another path pulls the rest there
+				if alt, ok := s.failoverPeer(p); ok {
+					offer := Message{Payload: MessageStoreFile{ID: s.ID, Key: key, Size: size, Clock: clock}}
+					if err := s.sendMessage(alt, &offer); err != nil {
+						s.Logger.Warn("failed to offer replica on another path", "peer", alt.RemoteAddr().String(), "key", key, "err", err)
+					}
+				}
 			}
 		}(peer)
 	}
+	pushed := make(chan struct{})
+	go func() {
+		pushes.Wait()
+		if len(targets) > 0 && len(targets) >= s.WriteConcern && !failed.Load() {
+			s.clearPendingPush(key)
+		}
+		close(pushed)
+	}()
+
+	go s.announceFile(key, size)
+
+	if s.Pinner != nil {
+		go s.pinFile(key)
+	}
 
+	if s.WriteConcern <= 0 {
+		return nil
+	}
+	if len(targets) < s.WriteConcern {
+		return fmt.Errorf("%w: %d replica peers for %d acknowledgments", ErrWriteConcern, len(targets), s.WriteConcern)
+	}
+	if err := s.awaitWriteConcern(ctx, key, pushed); err != nil {
+		s.addPendingPush(key, size) // offered again until the replicas are acknowledged
+		return err
+	}
 	return nil
 }
 
 func (s *FileServer) Stop() {
-	close(s.quitch)
+	s.stopOnce.Do(func() { close(s.quitch) })
+}
+
+// Done is closed once the server stops
+func (s *FileServer) Done() <-chan struct{} {
+	return s.quitch
 }
 
 // Handles new peer connections.
 func (s *FileServer) OnPeer(p p2p.Peer) error {
+	if s.IsBanned(p.RemoteAddr().String()) {
+		s.Logger.Info("rejected banned peer", "peer", p.RemoteAddr().String())
+		return fmt.Errorf("peer %s is banned", p.RemoteAddr())
+	}
+	if err := s.checkPeerLists(p.RemoteAddr().String(), ""); err != nil {
+		s.Logger.Info("rejected peer", "peer", p.RemoteAddr().String(), "err", err)
+		return err
+	}
+	if s.denied(p.RemoteAddr().String()) {
+		s.Logger.Info("rejected peer denied by policy", "peer", p.RemoteAddr().String())
+		return fmt.Errorf("peer %s is denied by policy", p.RemoteAddr())
+	}
+	if err := s.admit(p); err != nil {
+		return err
+	}
+
 	s.PeerLock.Lock()
 	defer s.PeerLock.Unlock()
 
-	// Adds the peer to the peers map.
-	s.Peers[p.RemoteAddr().String()] = p
+	// A second connection dialed to the same address is refused. The node
+	// is only known once it introduced itself, see handleMessageHello.
+	if _, ok := s.conns[p.RemoteAddr().String()]; ok {
+		s.Logger.Info("rejected duplicate connection", "peer", p.RemoteAddr().String())
+		return fmt.Errorf("already connected to %s", p.RemoteAddr())
+	}
+	s.conns[p.RemoteAddr().String()] = p
 
 	s.Logger.Info("connected with remote peer", "peer", p.RemoteAddr().String())
+	s.Events.Publish(events.Event{Type: events.PeerJoined, Peer: p.RemoteAddr().String()})
+
+	go s.sendHello(p)
+	go s.offerPendingPushes(p)
+	go s.sendPolicy(p)
+	if s.Pex != nil {
+		go s.Pex.peerConnected(p)
+	}
 
 	return nil
 }
 
+// OnPeerClose forgets a peer once its connection is closed
+func (s *FileServer) OnPeerClose(p p2p.Peer) {
+	addr := p.RemoteAddr().String()
+
+	s.PeerLock.Lock()
+	if s.conns[addr] == p {
+		delete(s.conns, addr)
+	}
+	s.PeerLock.Unlock()
+	s.Metrics.ForgetPeer(addr)
+	s.writeLocks.Delete(p)
+	s.forgetGuest(addr)
+	s.forgetCatalog(addr)
+	s.forgetProtocol(addr)
+	s.forgetBandwidth(addr)
+	if s.Pex != nil {
+		s.Pex.peerClosed(addr)
+	}
+
+	// Transfers from a node that is still reachable continue on another path
+	node, next := s.removePath(p)
+	if next != nil {
+		s.Logger.Info("path closed, node still reachable", "peer", addr, "path", next.addr)
+		s.failoverDownloads(addr, next.addr)
+		if s.MetadataOnly {
+			go s.requestCatalog(next.peer)
+		}
+		return
+	}
+
+	s.Logger.Info("peer disconnected", "peer", addr)
+	s.Events.Publish(events.Event{Type: events.PeerLeft, Peer: addr})
+	if node != "" {
+		s.nodeOffline(node)
+	}
+}
+
 const maxWaitersPerKey = 100
 
 func (s *FileServer) registerFileWaiter(key string) (chan struct{}, error) {
@@ -308,6 +1121,13 @@ func (s *FileServer) registerFileWaiter(key string) (chan struct{}, error) {
 	return ch, nil
 }
 
+// hasFileWaiter reports whether a Get is waiting for a file
+func (s *FileServer) hasFileWaiter(hashedKey string) bool {
+	s.waitersMu.Lock()
+	defer s.waitersMu.Unlock()
+	return len(s.waiters[hashedKey]) > 0
+}
+
 func (s *FileServer) notifyFileWaiter(hashedKey string) {
 	s.waitersMu.Lock()
 	defer s.waitersMu.Unlock()
@@ -326,65 +1146,186 @@ func (s *FileServer) notifyFileWaiter(hashedKey string) {
 	delete(s.waiters, hashedKey)
 }
 
-func (s *FileServer) sendStream(peer p2p.Peer, key string, size int64, r io.Reader) error {
-	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+// sendStream streams a stored file to a peer. When header.Offset is non-zero, r
+// must already be positioned at that offset. Range streams carry exactly
+// header.Length bytes, all others carry the file up to header.Size.
+func (s *FileServer) sendStream(ctx context.Context, peer p2p.Peer, header StreamHeader, r io.Reader) (err error) {
+	ctx, span := startChildSpan(ctx, "stream copy", trace.WithAttributes(
+		attribute.String("peer", peer.RemoteAddr().String()),
+		attribute.String("key", header.Key),
+		attribute.Int64("offset", header.Offset),
+	))
+	defer func() { endSpan(span, err) }()
+
+	// A stream that is not multiplexed has the connection to itself. Hold
+	// the peer's write lock until it ends so no other message lands in the
+	// middle of the file bytes.
+	mux := s.speaksMux(peer)
+	if !mux {
+		unlock := s.lockPeerWrites(peer)
+		defer unlock()
+	}
+
+	done, err := s.beginTransfer(true)
+	if err != nil {
 		return err
 	}
+	defer done()
 
-	header := StreamHeader{
-		ID:   s.ID,
-		Key:  key,
-		Size: size,
+	w, err := p2p.OpenStream(peer, mux)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(&header); err != nil {
+	header.ID = s.ID
+	header.Trace = tracing.Inject(ctx)
+
+	headerBuf, err := encodeStreamHeader(&header, s.speaksWire(peer))
+	if err != nil {
 		return err
 	}
 
-	headerSize := int16(buf.Len())
-	if err := binary.Write(peer, binary.LittleEndian, headerSize); err != nil {
+	headerSize := int16(len(headerBuf))
+	if err := binary.Write(w, binary.LittleEndian, headerSize); err != nil {
 		return err
 	}
-	if err := peer.Send(buf.Bytes()); err != nil {
+	if _, err := w.Write(headerBuf); err != nil {
 		return err
 	}
 
-	_, err := io.Copy(peer, r)
+	r = s.throttleUpload(ctx, peer.RemoteAddr().String(), r)
+	var n int64
+	if header.Range {
+		n, err = io.CopyN(w, r, header.Length)
+	} else {
+		n, err = io.Copy(w, r)
+	}
+	s.Metrics.AddPeerBytesSent(peer.RemoteAddr().String(), n)
+	span.SetAttributes(attribute.Int64("bytes", n))
 	return err
 }
 
-func (s *FileServer) handleStream(from string) error {
+// handleStream receives a stream from a peer. A multiplexed stream is read
+// from muxed, any other from the peer's connection until CloseStream.
+func (s *FileServer) handleStream(from string, muxed io.ReadCloser) (err error) {
 	s.PeerLock.Lock()
-	peer, ok := s.Peers[from]
+	peer, ok := s.conns[from]
 	s.PeerLock.Unlock()
 	if !ok {
+		if muxed != nil {
+			muxed.Close()
+		}
 		return fmt.Errorf("peer %s not found in map", from)
 	}
 
-	defer peer.CloseStream()
+	var conn io.Reader = muxed
+	if muxed != nil {
+		defer muxed.Close()
+	} else {
+		conn = peer
+		defer peer.CloseStream()
+	}
 
 	var headerSize int16
-	if err := binary.Read(peer, binary.LittleEndian, &headerSize); err != nil {
+	if err := binary.Read(conn, binary.LittleEndian, &headerSize); err != nil {
 		return err
 	}
 
 	headerBuf := make([]byte, headerSize)
-	if _, err := io.ReadFull(peer, headerBuf); err != nil {
+	if _, err := io.ReadFull(conn, headerBuf); err != nil {
 		return err
 	}
 
 	var header StreamHeader
-	if err := gob.NewDecoder(bytes.NewReader(headerBuf)).Decode(&header); err != nil {
+	if err := decodeStreamHeader(headerBuf, &header); err != nil {
+		return err
+	}
+
+	_, span := startChildSpan(tracing.Extract(context.Background(), header.Trace), "receive stream", trace.WithAttributes(
+		attribute.String("peer", from),
+		attribute.String("key", header.Key),
+		attribute.Int64("offset", header.Offset),
+	))
+	defer func() { endSpan(span, err) }()
+
+	stream := s.throttleDownload(from, conn)
+	if header.Range {
+		return s.handleRangeStream(from, stream, header)
+	}
+
+	if s.IsGuest() || s.isGuestPeer(from) {
+		// Guests neither receive nor push replicas
+		_, err := io.Copy(io.Discard, io.LimitReader(stream, header.Size-header.Offset))
+		return errors.Join(fmt.Errorf("rejected replica of %s from %s: guest access is %w", header.Key, from, ErrReadOnly), err)
+	}
+
+	if header.Drop {
+		return s.handleDropStream(from, stream, header)
+	}
+
+	if s.MetadataOnly && !s.hasFileWaiter(crypto.HashKey(header.Key)) {
+		// Only files fetched with Get are kept, never replicas
+		_, err := io.Copy(io.Discard, io.LimitReader(stream, header.Size-header.Offset))
+		return errors.Join(fmt.Errorf("rejected replica of %s from %s: metadata-only node: %w", header.Key, from, ErrReadOnly), err)
+	}
+
+	remaining := header.Size - header.Offset
+	if remaining < 0 {
+		return fmt.Errorf("invalid stream header for %s: offset %d beyond size %d", header.Key, header.Offset, header.Size)
+	}
+
+	s.Clock.Update(header.Clock)
+	if !s.supersedes(header.Key, header.Clock) {
+		// This node stored or deleted the key later than the sender
+		s.Logger.Debug("ignoring replica older than the local version", "peer", from, "key", header.Key, "hlc", header.Clock)
+		_, err := io.Copy(io.Discard, io.LimitReader(stream, remaining))
 		return err
 	}
 
-	_, err := s.store.Write(s.ID, header.Key, io.LimitReader(peer, header.Size))
+	// Received bytes go to a partial file first, so an interrupted transfer
+	// can be resumed later and never shows up as a complete file.
+	body := io.LimitReader(stream, remaining)
+	if s.getDownload(crypto.HashKey(header.Key)) != nil {
+		// A parallel download owns the partial file; it will complete on its own
+		_, err := io.Copy(io.Discard, body)
+		return err
+	}
+	n, err := s.store.WritePartial(s.ID, header.Key, header.Offset, body)
+	s.Metrics.AddPeerBytesReceived(from, n)
 	if err != nil {
+		// Drain the rest of the stream to keep the connection usable
+		io.Copy(io.Discard, body)
+		return err
+	}
+	if n < remaining {
+		return fmt.Errorf("transfer of %s interrupted at %d/%d bytes: %w", header.Key, header.Offset+n, header.Size, io.ErrUnexpectedEOF)
+	}
+	if err := s.verifyReplica(header); err != nil {
+		s.rejectReplica(from, header.Key, err)
+		return fmt.Errorf("replica of %s from %s: %w", header.Key, from, err)
+	}
+
+	if err := s.store.CommitPartial(s.ID, header.Key); err != nil {
 		return err
 	}
+	if !header.Clock.IsZero() {
+		s.stampKey(header.Key, header.Clock, false)
+	}
+	if err := s.store.SetExpiry(s.ID, header.Key, header.Expires); err != nil {
+		s.Logger.Warn("failed to set expiry of replica", "key", header.Key, "err", err)
+	}
+
+	s.Events.Publish(events.Event{Type: events.FileReplicated, Key: header.Key, Peer: from, Detail: metrics.FormatBytes(header.Size)})
+	s.notifyFileWaiter(crypto.HashKey(header.Key))
 
-	s.notifyFileWaiter(header.Key)
+	if err := s.sendReplicaAck(peer, header.Key, header.Size); err != nil {
+		s.Logger.Warn("failed to acknowledge replica", "peer", from, "key", header.Key, "err", err)
+	}
 
 	return nil
 }
@@ -393,6 +1334,8 @@ func (s *FileServer) handleStream(from string) error {
 func (s *FileServer) loop(ctx context.Context) {
 	defer func() {
 		s.Logger.Info("file server stopped", "node", s.ID)
+		// Background work waiting on Stop also ends when ctx is cancelled
+		s.Stop()
 		s.Transport.Close()
 	}()
 
@@ -400,18 +1343,33 @@ func (s *FileServer) loop(ctx context.Context) {
 		select {
 		case rpc := <-s.Transport.Consume():
 			if rpc.Stream {
-				if err := s.handleStream(rpc.From); err != nil {
-					s.Logger.Error("handle stream error", "node", s.ID, "err", err)
-				}
+				// The peer's read loop stays blocked until the stream is consumed,
+				// so streams from different peers can be handled concurrently.
+				done, _ := s.beginTransfer(false)
+				go func(rpc p2p.RPC) {
+					defer done()
+					release, err := s.beginInbound(ctx)
+					if err != nil {
+						s.Logger.Error("handle stream error", "node", s.ID, "err", err)
+						s.Metrics.IncErrors()
+						return
+					}
+					defer release()
+					if err := s.handleStream(rpc.From, rpc.Body); err != nil {
+						s.Logger.Error("handle stream error", "node", s.ID, "err", err)
+						s.Metrics.IncErrors()
+					}
+				}(rpc)
 				continue
 			}
 
 			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
+			if err := decodeMessage(rpc.Payload, &msg); err != nil {
 				s.Logger.Error("decoding message error", "node", s.ID, "err", err)
 			}
 			if err := s.handleMessage(ctx, rpc.From, &msg); err != nil {
 				s.Logger.Error("handle message error", "node", s.ID, "err", err)
+				s.Metrics.IncErrors()
 			}
 
 		case <-s.quitch:
@@ -423,37 +1381,218 @@ func (s *FileServer) loop(ctx context.Context) {
 }
 
 // Processes incoming messages.
-func (s *FileServer) handleMessage(ctx context.Context, from string, msg *Message) error {
+func (s *FileServer) handleMessage(ctx context.Context, from string, msg *Message) (err error) {
+	if msg.Trace != nil {
+		var span trace.Span
+		ctx, span = tracer.Start(tracing.Extract(ctx, msg.Trace), fmt.Sprintf("handle %T", msg.Payload),
+			trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attribute.String("peer", from)))
+		defer func() { endSpan(span, err) }()
+	}
+
 	switch v := msg.Payload.(type) {
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(ctx, from, v)
+	case MessageStoreFile:
+		return s.handleMessageStoreFile(from, v)
+	case MessageHasFile:
+		return s.handleMessageHasFile(from, v)
+	case MessageHasFileResponse:
+		return s.handleMessageHasFileResponse(from, v)
+	case MessageListFiles:
+		return s.handleMessageListFiles(from, v)
+	case MessageListFilesResponse:
+		return s.handleMessageListFilesResponse(from, v)
+	case MessageReplicaAck:
+		return s.handleMessageReplicaAck(from, v)
+	case MessagePeerRevoked:
+		return s.handleMessagePeerRevoked(from, v)
 	case MessagePeerExchange:
 		return s.handleMessagePeerExchange(ctx, from, v)
+	case MessagePexRequest:
+		return s.handleMessagePexRequest(from, v)
+	case MessagePexResponse:
+		return s.handleMessagePexResponse(ctx, from, v)
+	case MessageDigest:
+		return s.handleMessageDigest(from, v)
+	case MessageDigestEntries:
+		return s.handleMessageDigestEntries(from, v)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessageDeviceGrant:
+		return s.handleMessageDeviceGrant(from, v)
+	case MessageDropOffer:
+		return s.handleMessageDropOffer(from, v)
+	case MessageDropReply:
+		return s.handleMessageDropReply(from, v)
+	case MessagePolicy:
+		return s.handleMessagePolicy(from, v)
+	case MessageProbe:
+		return s.handleMessageProbe(from, v)
+	case MessageProbeResult:
+		return s.handleMessageProbeResult(from, v)
+	case MessageAdvertise:
+		return s.handleMessageAdvertise(from, v)
+	case MessageRendezvous:
+		return s.handleMessageRendezvous(from, v)
+	case MessagePunch:
+		return s.handleMessagePunch(from, v)
+	case MessageFileExpired:
+		return s.handleMessageFileExpired(from, v)
+	case MessageReadRange:
+		return s.handleMessageReadRange(from, v)
+	case MessageRangeData:
+		return s.handleMessageRangeData(from, v)
+	case MessagePeersFull:
+		return s.handleMessagePeersFull(ctx, from, v)
+	case MessageFileDeleted:
+		return s.handleMessageFileDeleted(from, v)
+	case MessageReplicaNack:
+		return s.handleMessageReplicaNack(from, v)
 	}
 
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+func (s *FileServer) handleMessageGetFile(ctx context.Context, from string, msg MessageGetFile) error {
 	originalKey, exists := s.store.GetOriginalKey(msg.Key)
 	if !exists || !s.store.Has(s.ID, originalKey) {
 		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
 	}
 
+	// Serving runs in the message loop, so a node that is busy refuses the
+	// request rather than stalling every other message behind it
+	release, err := s.beginOutbound(ctx, false)
+	if err != nil {
+		return fmt.Errorf("serving %s to %s: %w", originalKey, from, err)
+	}
+	defer release()
+
 	s.Logger.Info("serving file over the network", "peer", s.Transport.Addr(), "key", originalKey)
 
-	fileSize, r, err := s.store.Read(s.ID, originalKey)
+	fileSize, err := s.store.Size(s.ID, originalKey)
+	if err != nil {
+		return err
+	}
+	if msg.Offset < 0 || msg.Offset > fileSize || msg.Length < 0 {
+		return fmt.Errorf("invalid range %d+%d for %s (size %d)", msg.Offset, msg.Length, originalKey, fileSize)
+	}
+	// ReadRange skips to the offset in files that cannot seek, such as
+	// those in a storage backend. Guests get a copy encrypted for them.
+	length := fileSize - msg.Offset
+	if msg.Length > 0 {
+		length = min(msg.Length, length)
+	}
+	var r io.ReadCloser
+	var guestHash string
+	if guest := s.guestFor(from); guest != nil {
+		r, guestHash, err = s.guestRange(guest, originalKey, msg.Offset, length)
+	} else {
+		_, r, err = s.store.ReadRange(s.ID, originalKey, msg.Offset, length)
+	}
 	if err != nil {
 		return err
 	}
-	defer r.(io.Closer).Close()
+	defer r.Close()
+	if msg.Offset > 0 && msg.Length == 0 {
+		s.Logger.Info("resuming transfer for peer", "peer", from, "key", originalKey, "offset", msg.Offset)
+	}
 
-	peer, ok := s.Peers[from]
+	peer, ok := s.peerFor(from)
 	if !ok {
 		return fmt.Errorf("peer %s not in map", from)
 	}
 
-	return s.sendStream(peer, originalKey, fileSize, r)
+	header := StreamHeader{
+		Key:    originalKey,
+		Size:   fileSize,
+		Offset: msg.Offset,
+		Clock:  s.KeyStamp(originalKey),
+	}
+	header.Expires = s.store.Expiry(s.ID, originalKey)
+	if msg.Length > 0 {
+		header.Range = true
+		header.Length = min(msg.Length, fileSize-msg.Offset)
+	} else if guestHash != "" {
+		header.Hash = guestHash
+	} else {
+		header.Hash = s.contentHash(originalKey)
+	}
+
+	if err := s.sendStream(ctx, peer, header, r); err != nil {
+		return err
+	}
+	if header.Offset+header.Length == fileSize || !header.Range {
+		s.clearPendingPush(originalKey)
+	}
+	return nil
+}
+
+// handleMessageHasFile tells the sender whether the file is stored locally
+func (s *FileServer) handleMessageHasFile(from string, msg MessageHasFile) error {
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageHasFileResponse{ID: s.ID, Key: msg.Key}
+	if originalKey, exists := s.store.GetOriginalKey(msg.Key); exists {
+		if size, err := s.store.Size(s.ID, originalKey); err == nil {
+			resp.Has = true
+			resp.Size = size
+		}
+	}
+
+	return s.sendMessage(peer, &Message{Payload: resp})
+}
+
+// handleMessageHasFileResponse adds a peer that holds the file to its download
+func (s *FileServer) handleMessageHasFileResponse(from string, msg MessageHasFileResponse) error {
+	d := s.getDownload(msg.Key)
+	if d == nil {
+		return nil
+	}
+
+	// Ranges are only requested from peers that serve them
+	has := msg.Has && s.PeerSupports(from, CapRanges)
+	reqs, done := d.found(from, has, msg.Size)
+	if done {
+		s.finishDownload(d)
+		return nil
+	}
+	s.requestRanges(d, reqs)
+	return nil
+}
+
+// handleMessageStoreFile pulls an announced file unless the same or a later
+// version of it is stored locally, or it was deleted here later
+func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
+	if s.MetadataOnly {
+		// Offered before the peer learned this node takes no replicas
+		s.indexFile(from, msg)
+		return nil
+	}
+	s.Clock.Update(msg.Clock)
+	if s.IsGuest() || s.isGuestPeer(from) || !s.supersedes(msg.Key, msg.Clock) {
+		return nil
+	}
+	offset := s.store.PartialSize(s.ID, msg.Key)
+	if s.store.Has(s.ID, msg.Key) {
+		offset = 0 // a newer version, not the rest of this one
+	}
+
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	req := Message{
+		Payload: MessageGetFile{
+			ID:     s.ID,
+			Key:    crypto.HashKey(msg.Key),
+			Offset: offset,
+		},
+	}
+	return s.sendMessage(peer, &req)
 }
 
 func (s *FileServer) bootstrapNetwork() error {
@@ -464,7 +1603,7 @@ func (s *FileServer) bootstrapNetwork() error {
 
 		go func(addr string) {
 			s.Logger.Info("attempting to connect with bootstrap node", "peer", s.Transport.Addr(), "bootstrap", addr)
-			if err := s.Transport.Dial(addr); err != nil {
+			if err := s.dial(addr); err != nil {
 				s.Logger.Error("bootstrap node dial error", "err", err)
 			}
 		}(addr)
@@ -479,40 +1618,133 @@ func (s *FileServer) Start(ctx context.Context) error {
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
+	s.listening.Store(true)
 
 	s.bootstrapNetwork()
 
+	if s.RelayAddr != "" {
+		relay, err := listenRelay(s.RelayAddr, s.Logger)
+		if err != nil {
+			return fmt.Errorf("failed to start relay: %w", err)
+		}
+		s.relay = relay
+		s.Logger.Info("relaying connections for peers", "addr", s.RelayAddr)
+		go func() {
+			<-s.quitch
+			relay.close()
+		}()
+	}
+
 	if s.GC != nil {
 		s.GC.Start(ctx)
 	}
 
+	if s.IsGuest() {
+		time.AfterFunc(time.Until(s.guestUntil), s.expireGuestAccess)
+	} else if s.MetadataOnly {
+		go s.startIndexing(ctx)
+	} else {
+		go s.startAntiEntropy(ctx)
+	}
+
+	if s.PublicIP != nil {
+		go s.watchPublicIP(ctx)
+	}
+
+	go s.collectMetrics(ctx)
+	go s.retryPendingPushes(ctx)
+
 	s.loop(ctx)
 
 	return nil
 }
 
+// Type numbers of the message payloads, as in wire.proto. A number is never
+// reused, even after its message is removed.
 func init() {
-	gob.Register(MessageGetFile{})
-	gob.Register(StreamHeader{})
-	gob.Register(MessagePeerExchange{})
+	registerMessage(1, MessageGetFile{})
+	registerMessage(2, MessageStoreFile{})
+	registerMessage(3, MessageHasFile{})
+	registerMessage(4, MessageHasFileResponse{})
+	registerMessage(5, StreamHeader{})
+	registerMessage(6, MessageListFiles{})
+	registerMessage(7, MessageListFilesResponse{})
+	registerMessage(8, MessageReplicaAck{})
+	registerMessage(9, MessagePeerRevoked{})
+	registerMessage(10, MessagePeerExchange{})
+	registerMessage(11, MessagePexRequest{})
+	registerMessage(12, MessagePexResponse{})
 	gob.Register(PeerInfo{})
+	registerMessage(13, MessageDigest{})
+	registerMessage(14, MessageDigestEntries{})
+	registerMessage(15, MessageHello{})
+	registerMessage(16, MessageDeviceGrant{})
+	registerMessage(17, MessageDropOffer{})
+	registerMessage(18, MessageDropReply{})
+	registerMessage(19, MessagePolicy{})
+	registerMessage(20, MessageProbe{})
+	registerMessage(21, MessageProbeResult{})
+	registerMessage(22, MessageAdvertise{})
+	registerMessage(23, MessageRendezvous{})
+	registerMessage(24, MessagePunch{})
+	registerMessage(25, MessageFileExpired{})
+	registerMessage(26, MessageReadRange{})
+	registerMessage(27, MessageRangeData{})
+	registerMessage(28, MessagePeersFull{})
+	registerMessage(29, MessageFileDeleted{})
+	registerMessage(30, MessageReplicaNack{})
 }
 
-// Delete removes a file from local storage and broadcasts deletion to peers
-
-// Delete removes a file
+// Delete removes a file from local storage
 func (s *FileServer) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes a file from local storage unless ctx is already
+// done, and from the peers too with OfflineQueue
+func (s *FileServer) DeleteContext(ctx context.Context, key string) (err error) {
+	_, span := tracer.Start(ctx, "Delete", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if !s.store.Has(s.ID, key) {
 		return fmt.Errorf("file not found")
 	}
-	return s.store.Delete(s.ID, key)
+	if err := s.checkHold(key, "delete"); err != nil {
+		return err
+	}
+	if err := s.checkRetention(key); err != nil {
+		return err
+	}
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	// Keeps older copies offered by peers from bringing the file back
+	clock := s.Clock.Now()
+	s.stampKey(key, clock, true)
+	s.clearPendingPush(key)
+	s.Events.Publish(events.Event{Type: events.FileDeleted, Key: key})
+	if s.OfflineQueue {
+		s.propagateDelete(key, clock)
+	}
+	return nil
 }
 
-// EnableLocalDiscovery enables mDNS discovery
+// EnableLocalDiscovery enables mDNS discovery, advertising the port the
+// transport listens on
 func (s *FileServer) EnableLocalDiscovery(ctx context.Context, advertiseAddr string) error {
-	s.Discovery = NewDiscoveryService("peervault", 3000, advertiseAddr, s.Logger)
+	port := listenPort(s.Transport.Addr())
+	if port == 0 {
+		port = listenPort(advertiseAddr)
+	}
+	if port == 0 {
+		return fmt.Errorf("no port to advertise in listen address %q", s.Transport.Addr())
+	}
+	s.Discovery = NewDiscoveryService("peervault", port, advertiseAddr, crypto.Fingerprint(s.Identity.PublicKey), s.NetworkID, s.Logger)
 	s.Discovery.SetPeerFoundCallback(func(peerAddr string) error {
-		return s.Transport.Dial(peerAddr)
+		return s.dial(peerAddr)
 	})
 	return s.Discovery.Start(ctx)
 }
@@ -537,8 +1769,80 @@ func (s *FileServer) ReadFile(id, key string) (int64, io.Reader, error) {
 	return s.store.Read(id, key)
 }
 
-func (s *FileServer) ClearStorage() error {
-	return s.store.Clear()
+// DiskUsage returns the state and usage of each disk, nil without disks
+func (s *FileServer) DiskUsage() []storage.DiskUsage {
+	return s.store.DiskUsage()
+}
+
+// ClearScope selects what ClearStorage deletes
+type ClearScope int
+
+const (
+	// ClearFiles deletes the stored files and the state describing them:
+	// the key map, receipts, clock stamps and directory sync progress
+	ClearFiles ClearScope = iota
+	// ClearAll deletes everything in the storage root but key material
+	ClearAll
+)
+
+// keyFiles hold the node's identity and keys. ClearStorage only deletes
+// them when asked to explicitly.
+var keyFiles = []string{"node.id", "identity.key", "device.key", "apikeys.json"}
+
+// ClearStorage deletes what scope covers from the storage root, unless some
+// stored files are under legal hold. The node ID and identity, device key
+// and API keys are kept unless withKeys is set, which requires ClearAll.
+func (s *FileServer) ClearStorage(scope ClearScope, withKeys bool) error {
+	if withKeys && scope != ClearAll {
+		return fmt.Errorf("keys are only deleted along with everything else")
+	}
+	files, err := s.store.List(s.ID)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := s.checkHold(f.Key, "clean"); err != nil {
+			return err
+		}
+	}
+
+	if err := s.store.ClearFiles(); err != nil {
+		return err
+	}
+	s.receiptsMu.Lock()
+	s.receipts = make(map[string]*Receipt)
+	s.receiptsMu.Unlock()
+	s.stampsMu.Lock()
+	s.stamps = make(map[string]keyStamp)
+	s.stampsMu.Unlock()
+	s.pendingMu.Lock()
+	s.pendingPushes = make(map[string]int64)
+	s.pendingDeletes = make(map[string]*pendingDelete)
+	s.Metrics.SetPendingReplicas(0)
+	s.pendingMu.Unlock()
+
+	entries, err := os.ReadDir(s.StorageRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case scope == ClearFiles && name != filepath.Base(s.receiptsPath()) &&
+			name != filepath.Base(s.stampsPath()) && name != filepath.Base(s.pendingPath()) &&
+			name != filepath.Base(s.pendingDeletesPath()) && !strings.HasPrefix(name, "sync-"):
+			continue
+		case slices.Contains(keyFiles, name) && !withKeys:
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.StorageRoot, name)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *FileServer) ClearKeyMapping() {
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrServerClosed is returned for transfers started after Shutdown began
+var ErrServerClosed = errors.New("file server is shutting down")
+
+// beginTransfer counts a stream until the returned func is called, so
+// Shutdown can wait for it. New outgoing streams are refused once shutdown
+// has begun; incoming ones are already on the wire and are always counted.
+func (s *FileServer) beginTransfer(outgoing bool) (func(), error) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+
+	if outgoing && s.draining {
+		return nil, ErrServerClosed
+	}
+	s.transfers++
+	return s.endTransfer, nil
+}
+
+// endTransfer releases a stream counted by beginTransfer
+func (s *FileServer) endTransfer() {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+
+	s.transfers--
+	if s.transfers == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// Shutdown stops the server gracefully. It stops accepting connections and
+// all background work (discovery, peer exchange, garbage collection and
+// anti-entropy), waits for in-flight transfers, persists the key map and
+// receipts, and closes every peer connection. If ctx ends before the
+// transfers drain they are cut off and the context's error is returned.
+func (s *FileServer) Shutdown(ctx context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() { err = s.shutdown(ctx) })
+	return err
+}
+
+func (s *FileServer) shutdown(ctx context.Context) error {
+	s.Logger.Info("shutting down file server", "node", s.ID)
+
+	s.transfersMu.Lock()
+	s.draining = true
+	active := s.transfers
+	var drained chan struct{}
+	if active > 0 {
+		drained = make(chan struct{})
+		s.drained = drained
+	}
+	s.transfersMu.Unlock()
+	close(s.drainch)
+
+	// Stop accepting new connections; established ones stay up while
+	// transfers drain
+	s.listening.Store(false)
+	s.Transport.Close()
+
+	if s.Discovery != nil {
+		s.Discovery.Stop()
+	}
+	if s.Pex != nil {
+		s.Pex.Stop()
+	}
+	if s.GC != nil {
+		s.GC.Stop()
+	}
+
+	var drainErr error
+	if drained != nil {
+		s.Logger.Info("waiting for in-flight transfers", "transfers", active)
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			drainErr = ctx.Err()
+			s.Logger.Warn("shutdown deadline reached, aborting transfers", "err", drainErr)
+		}
+	}
+
+	// A guest whose access ended has purged its storage, keep it that way
+	if !s.IsGuest() || time.Now().Before(s.GuestUntil()) {
+		if err := s.flushMetadata(); err != nil {
+			s.Logger.Error("failed to persist metadata", "err", err)
+		}
+	}
+
+	s.Stop()
+
+	s.PeerLock.Lock()
+	for _, peer := range s.conns {
+		peer.Close()
+	}
+	s.PeerLock.Unlock()
+
+	return drainErr
+}
+
+// flushMetadata writes the key map and the receipts to disk
+func (s *FileServer) flushMetadata() error {
+	if err := s.store.Flush(); err != nil {
+		return err
+	}
+
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	if len(s.receipts) == 0 {
+		return nil
+	}
+	return s.saveReceipts()
+}
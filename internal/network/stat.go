@@ -0,0 +1,32 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// Stat returns the size, timestamps, content type, content hash and tags
+// of a file this node stores
+func (s *FileServer) Stat(key string) (storage.FileInfo, error) {
+	info, err := s.store.Stat(s.ID, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, fmt.Errorf("file %s %w", key, ErrNotFound)
+	}
+	return info, err
+}
+
+// SetTags replaces the user-defined tags of a file this node stores. Tags
+// are local to this node and are listed with the file.
+func (s *FileServer) SetTags(key string, tags map[string]string) error {
+	if s.IsGuest() {
+		return fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	err := s.store.SetTags(s.ID, key, tags)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("file %s %w", key, ErrNotFound)
+	}
+	return err
+}
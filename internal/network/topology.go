@@ -0,0 +1,143 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// Topology is the peer graph as seen from this node: the nodes it is
+// connected to and every path to them. Nodes are identified by the
+// fingerprint of their public key.
+type Topology struct {
+	Node  TopologyNode   `json:"node"`
+	Peers []TopologyNode `json:"peers"`
+	Links []TopologyLink `json:"links"`
+	Known []string       `json:"known,omitempty"` // addresses learned through discovery that are not connected
+}
+
+// TopologyNode is a node of the peer graph
+type TopologyNode struct {
+	ID           string            `json:"id"`
+	Addr         string            `json:"addr,omitempty"` // address the node advertises for new connections
+	Zone         string            `json:"zone,omitempty"` // the node's "zone" label
+	Labels       map[string]string `json:"labels,omitempty"`
+	MetadataOnly bool              `json:"metadata_only,omitempty"`
+}
+
+// TopologyLink is a connection from this node to a peer
+type TopologyLink struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Addr      string  `json:"addr"`
+	RTTMillis float64 `json:"rtt_ms"` // zero until measured
+	Preferred bool    `json:"preferred"`
+	Version   int     `json:"version,omitempty"` // protocol version of the peer, zero until its hello
+}
+
+// Topology returns the peer graph as known locally
+func (s *FileServer) Topology() Topology {
+	self := crypto.Fingerprint(s.Identity.PublicKey)
+	t := Topology{
+		Node:  TopologyNode{ID: self, Addr: s.AdvertiseAddr(), Zone: s.Labels["zone"], Labels: s.Labels, MetadataOnly: s.MetadataOnly},
+		Peers: []TopologyNode{},
+		Links: []TopologyLink{},
+	}
+
+	for _, path := range s.PeerPaths() {
+		t.Links = append(t.Links, TopologyLink{
+			From:      self,
+			To:        path.Node,
+			Addr:      path.Addr,
+			RTTMillis: float64(path.RTT.Microseconds()) / 1000,
+			Preferred: path.Preferred,
+			Version:   path.Version,
+		})
+	}
+
+	connected := make(map[string]bool)
+	s.pathsMu.Lock()
+	for node := range s.nodePaths {
+		labels := s.nodeLabels[node]
+		addr := s.nodeAddrs[node]
+		connected[addr] = true
+		t.Peers = append(t.Peers, TopologyNode{ID: node, Addr: addr, Zone: labels["zone"], Labels: labels, MetadataOnly: s.indexNodes[node]})
+	}
+	s.pathsMu.Unlock()
+	sort.Slice(t.Peers, func(i, j int) bool {
+		return t.Peers[i].ID < t.Peers[j].ID
+	})
+
+	for _, p := range s.Pex.GetKnownPeers() {
+		if !connected[p.Address] {
+			t.Known = append(t.Known, p.Address)
+		}
+	}
+	sort.Strings(t.Known)
+	return t
+}
+
+// DOT renders the graph in Graphviz format. Nodes are grouped by zone,
+// links are labelled with their round trip and preferred paths drawn bold.
+func (t Topology) DOT() string {
+	var b strings.Builder
+	b.WriteString("graph peervault {\n")
+
+	zones := make(map[string][]TopologyNode)
+	for _, n := range append([]TopologyNode{t.Node}, t.Peers...) {
+		zones[n.Zone] = append(zones[n.Zone], n)
+	}
+	names := make([]string, 0, len(zones))
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+	for _, zone := range names {
+		indent := "  "
+		if zone != "" {
+			fmt.Fprintf(&b, "  subgraph %q {\n    label=%q;\n", "cluster_"+zone, zone)
+			indent = "    "
+		}
+		for _, n := range zones[zone] {
+			attrs := fmt.Sprintf("label=%q", shortID(n.ID))
+			if n.ID == t.Node.ID {
+				attrs += ", shape=doublecircle"
+			}
+			if n.MetadataOnly {
+				attrs += ", style=dashed"
+			}
+			fmt.Fprintf(&b, "%s%q [%s];\n", indent, n.ID, attrs)
+		}
+		if zone != "" {
+			b.WriteString("  }\n")
+		}
+	}
+
+	for _, l := range t.Links {
+		label := "unmeasured"
+		if l.RTTMillis > 0 {
+			label = fmt.Sprintf("%.2fms", l.RTTMillis)
+		}
+		style := "solid"
+		if l.Preferred {
+			style = "bold"
+		}
+		fmt.Fprintf(&b, "  %q -- %q [label=%q, tooltip=%q, style=%s];\n", l.From, l.To, label, l.Addr, style)
+	}
+	for _, addr := range t.Known {
+		fmt.Fprintf(&b, "  %q [shape=box, style=dotted];\n  %q -- %q [style=dotted];\n", addr, t.Node.ID, addr)
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// shortID abbreviates a fingerprint for display
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
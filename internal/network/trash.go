@@ -0,0 +1,45 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// Trash returns the files deleted from this node that are kept in its
+// trash, most recently deleted first. Files are kept when the node is
+// configured with FileServerOpts.Trash.
+func (s *FileServer) Trash() ([]storage.TrashEntry, error) {
+	return s.store.ListTrash(s.ID)
+}
+
+// Restore brings back the most recently deleted file of a key from the
+// trash. Replicas deleted on peers are not restored.
+func (s *FileServer) Restore(key string) error {
+	if s.IsGuest() {
+		return fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	entry, err := s.store.Restore(s.ID, key)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("file %s was stored again since it was deleted", key)
+	}
+	if err != nil {
+		return err
+	}
+	// Keeps the deletion from winning over the restored file
+	s.stampKey(key, s.Clock.Now(), false)
+	s.Events.Publish(events.Event{Type: events.FileRestored, Key: key, Detail: entry.Deleted.Format("2006-01-02 15:04:05")})
+	return nil
+}
+
+// EmptyTrash removes every file from the trash for good and returns how
+// many there were
+func (s *FileServer) EmptyTrash() (int, error) {
+	if s.IsGuest() {
+		return 0, fmt.Errorf("guest access is %w", ErrReadOnly)
+	}
+	return s.store.EmptyTrash(s.ID)
+}
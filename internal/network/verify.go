@@ -0,0 +1,131 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// maxReplicaRetries is how many times a replica a peer rejected is offered
+// to it again before it is left to anti-entropy
+const maxReplicaRetries = 3
+
+// MessageReplicaNack tells the sender of a replica that it failed
+// verification and was discarded, so the sender can offer it again
+type MessageReplicaNack struct {
+	ID     string `wire:"1"`
+	Key    string `wire:"2"`
+	Reason string `wire:"3"`
+}
+
+// contentHash returns the hex SHA-256 of the stored bytes of key, empty if
+// it cannot be read
+func (s *FileServer) contentHash(key string) string {
+	info, err := s.store.Stat(s.ID, key)
+	if err != nil {
+		return ""
+	}
+	return info.ContentHash
+}
+
+// verifyPartial checks the HMAC of the complete partial file of key. As
+// for stored files (see verifyStored), a file that fails the check with the
+// network key may have been encrypted with a device data key, so once this
+// node or a connected one uses device keys only the files this device
+// encrypted are checked.
+func (s *FileServer) verifyPartial(key string, size int64) error {
+	s.devicesMu.Lock()
+	_, own := s.fileKeys[crypto.HashKey(key)]
+	s.devicesMu.Unlock()
+	if !own && (s.deviceKey != nil || s.devicesInUse()) {
+		return nil
+	}
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return nil // reported when the file is opened
+	}
+	f, err := s.store.OpenPartial(s.ID, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return crypto.Verify(encKey, f, size)
+}
+
+// verifyReplica checks a replica received in a stream before it is
+// committed: its bytes must hash to the hash the sender announced, if it
+// announced one, and pass the HMAC check
+func (s *FileServer) verifyReplica(header StreamHeader) error {
+	if header.Hash != "" {
+		f, err := s.store.OpenPartial(s.ID, header.Key)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != header.Hash {
+			return fmt.Errorf("%w: content hash %.12s, announced %.12s", ErrCorrupted, got, header.Hash)
+		}
+	}
+	if err := s.verifyPartial(header.Key, header.Size); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	return nil
+}
+
+// rejectReplica discards a replica that failed verification, scores the
+// peer that sent it and tells it so
+func (s *FileServer) rejectReplica(from string, key string, reason error) {
+	if err := s.store.DiscardPartial(s.ID, key); err != nil {
+		s.Logger.Warn("failed to discard rejected replica", "key", key, "err", err)
+	}
+	s.Metrics.IncReplicasRejected()
+	s.recordCorrupt(from)
+	s.Logger.Warn("rejected replica failing verification", "peer", from, "key", key, "err", reason)
+
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return
+	}
+	nack := Message{Payload: MessageReplicaNack{ID: s.ID, Key: key, Reason: reason.Error()}}
+	if err := s.sendMessage(peer, &nack); err != nil {
+		s.Logger.Warn("failed to tell peer its replica was rejected", "peer", from, "key", key, "err", err)
+	}
+}
+
+// handleMessageReplicaNack offers a replica a peer rejected to it again,
+// up to maxReplicaRetries times, and keeps the push pending until then
+func (s *FileServer) handleMessageReplicaNack(from string, msg MessageReplicaNack) error {
+	s.Logger.Warn("peer rejected replica", "peer", from, "key", msg.Key, "reason", msg.Reason)
+	info, err := s.store.Stat(s.ID, msg.Key)
+	if err != nil {
+		return nil // no longer stored here
+	}
+
+	retry := s.scoreKey(from) + "/" + msg.Key
+	s.receiptsMu.Lock()
+	s.replicaNacks[retry]++
+	attempts := s.replicaNacks[retry]
+	if attempts > maxReplicaRetries {
+		delete(s.replicaNacks, retry)
+	}
+	s.receiptsMu.Unlock()
+	if attempts > maxReplicaRetries {
+		return fmt.Errorf("replica of %s rejected by %s %d times, giving up", msg.Key, from, attempts)
+	}
+
+	s.addPendingPush(msg.Key, info.Size)
+	peer, ok := s.peerFor(from)
+	if !ok {
+		return nil // offered again when it reconnects
+	}
+	offer := Message{Payload: MessageStoreFile{ID: s.ID, Key: msg.Key, Size: info.Size, Clock: s.KeyStamp(msg.Key)}}
+	return s.sendMessage(peer, &offer)
+}
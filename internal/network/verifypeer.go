@@ -0,0 +1,80 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// RemoteNode is what VerifyPeer learns of a node
+type RemoteNode struct {
+	Addr      string
+	NetworkID string // the network the node is on
+	ID        string // set only if it is on the network asked about
+	PublicKey []byte // its identity key, set only if it is on the network asked about
+	Version   int    // its protocol version
+}
+
+// VerifyPeer connects to the node listening at addr, without joining it,
+// and returns the network it is on. If that is networkID, the node
+// introduces itself, and its ID and identity key are returned too.
+// Operators compare the fingerprints of both out of band, e.g. over the
+// phone, to detect a node set up with the wrong key or one posing as
+// another.
+func VerifyPeer(ctx context.Context, addr string, networkID string) (*RemoteNode, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	remote, err := p2p.ExchangeNetworkID(p2p.NewTCPPeer(conn, true), networkID)
+	if err != nil {
+		return nil, fmt.Errorf("network handshake with %s: %w", addr, err)
+	}
+	node := &RemoteNode{Addr: addr, NetworkID: remote}
+	if remote != networkID {
+		// Nodes hang up on other networks before introducing themselves
+		return node, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	marker := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, marker); err != nil {
+			return nil, fmt.Errorf("%s hung up before introducing itself, it may ban or not allow this host: %w", addr, err)
+		}
+		switch marker[0] {
+		case p2p.IncomingPing, p2p.IncomingPong:
+			continue
+		case p2p.IncomingMessage:
+		default:
+			return nil, fmt.Errorf("%s sent a stream before introducing itself", addr)
+		}
+
+		var rpc p2p.RPC
+		if err := (p2p.DefaultDecoder{}).Decode(io.MultiReader(bytes.NewReader(marker), conn), &rpc); err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := decodeMessage(rpc.Payload, &msg); err != nil {
+			return nil, fmt.Errorf("invalid message from %s: %w", addr, err)
+		}
+		switch payload := msg.Payload.(type) {
+		case MessageHello:
+			node.ID = payload.ID
+			node.PublicKey = payload.PublicKey
+			node.Version = payload.Version
+			return node, nil
+		case MessagePeersFull:
+			return nil, fmt.Errorf("%s declined the connection, it has all the peers it takes", addr)
+		}
+	}
+}
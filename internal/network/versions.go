@@ -0,0 +1,40 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+)
+
+// ListVersions returns the versions of a file this node stores, oldest
+// first and the current one last. Earlier versions are kept when the node
+// is configured with FileServerOpts.Versions.
+func (s *FileServer) ListVersions(key string) ([]storage.Version, error) {
+	versions, err := s.store.ListVersions(s.ID, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("file %s %w", key, ErrNotFound)
+	}
+	return versions, err
+}
+
+// GetVersion returns the content of version n of a file this node stores,
+// as numbered by ListVersions. Earlier versions are only kept locally, so
+// unlike Get it never asks peers.
+func (s *FileServer) GetVersion(ctx context.Context, key string, n int) (io.Reader, error) {
+	encKey, err := s.openFileKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open data key of %s: %w", key, err)
+	}
+	_, r, err := s.store.ReadVersion(s.ID, key, n)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("version %d of file %s %w", n, key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storage.Decompress(s.decryptOnTheFly(ctx, encKey, r)), nil
+}
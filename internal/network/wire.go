@@ -0,0 +1,485 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Messages are encoded in the protobuf wire format described by wire.proto.
+// Each field of a message struct carries its field number in a wire tag,
+// fields are never renumbered, and a decoder skips fields it does not know,
+// so messages can gain fields without breaking older nodes or clients in
+// other languages.
+//
+// Peers that do not announce CapProtobuf are still sent gob. That fallback
+// lets nodes of the previous release join the network and is removed in the
+// next one. Received payloads are told apart by their first byte: gob never
+// starts with a zero byte, which would announce an empty message.
+const (
+	wireMagic   = 0x00
+	wireVersion = 1 // version of the envelope, bumped when it changes incompatibly
+)
+
+// Field numbers of the envelope, see Envelope in wire.proto
+const (
+	envelopeType    protowire.Number = 1
+	envelopePayload protowire.Number = 2
+	envelopeTrace   protowire.Number = 3
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var (
+	wireTypes   = map[reflect.Type]protowire.Number{} // payload type to type number
+	wirePayload = map[protowire.Number]reflect.Type{} // type number to payload type
+	wireSchemas sync.Map                              // reflect.Type to *wireSchema
+)
+
+// wireSchema is the field numbers of a struct type
+type wireSchema struct {
+	fields []wireField
+	byNum  map[protowire.Number]int // field number to struct field index
+}
+
+type wireField struct {
+	num   protowire.Number
+	index int
+}
+
+// registerWireType assigns a payload type its type number in the envelope.
+// It panics on a reused number or a field without a wire tag, so a message
+// that is not fully numbered never ships.
+func registerWireType(num protowire.Number, payload any) {
+	t := reflect.TypeOf(payload)
+	if other, ok := wirePayload[num]; ok {
+		panic(fmt.Sprintf("wire type %d of %s already used by %s", num, t, other))
+	}
+	checkWireType(t)
+	wireTypes[t] = num
+	wirePayload[num] = t
+}
+
+// checkWireType panics if a field of t, or of a struct t contains, has no
+// valid wire tag or a type the encoding does not support
+func checkWireType(t reflect.Type) {
+	switch {
+	case t == timeType:
+	case t.Kind() == reflect.Struct:
+		for _, field := range schemaOf(t).fields {
+			checkWireType(t.Field(field.index).Type)
+		}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Pointer:
+		checkWireType(t.Elem())
+	case t.Kind() == reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			panic(fmt.Sprintf("wire encoding does not support map key type %s", t.Key()))
+		}
+		checkWireType(t.Elem())
+	default:
+		switch t.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64,
+			reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		default:
+			panic(fmt.Sprintf("wire encoding does not support type %s", t))
+		}
+	}
+}
+
+// schemaOf returns the field numbers of a struct type from its wire tags
+func schemaOf(t reflect.Type) *wireSchema {
+	if schema, ok := wireSchemas.Load(t); ok {
+		return schema.(*wireSchema)
+	}
+	schema := &wireSchema{byNum: make(map[protowire.Number]int)}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		num, err := strconv.Atoi(field.Tag.Get("wire"))
+		if err != nil || num <= 0 || num > int(protowire.MaxValidNumber) {
+			panic(fmt.Sprintf("field %s.%s has no valid wire tag", t, field.Name))
+		}
+		if _, ok := schema.byNum[protowire.Number(num)]; ok {
+			panic(fmt.Sprintf("field %s.%s reuses wire number %d", t, field.Name, num))
+		}
+		schema.fields = append(schema.fields, wireField{num: protowire.Number(num), index: i})
+		schema.byNum[protowire.Number(num)] = i
+	}
+	wireSchemas.Store(t, schema)
+	return schema
+}
+
+// encodeMessage encodes msg as protobuf, or as gob when wire is false
+func encodeMessage(msg *Message, wire bool) ([]byte, error) {
+	if !wire {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	num, ok := wireTypes[reflect.TypeOf(msg.Payload)]
+	if !ok {
+		return nil, fmt.Errorf("message %T has no wire type", msg.Payload)
+	}
+	b := []byte{wireMagic, wireVersion}
+	b = protowire.AppendTag(b, envelopeType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(num))
+	b = protowire.AppendTag(b, envelopePayload, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendWireStruct(nil, reflect.ValueOf(msg.Payload)))
+	if len(msg.Trace) > 0 {
+		b = appendWireValue(b, envelopeTrace, reflect.ValueOf(msg.Trace))
+	}
+	return b, nil
+}
+
+// decodeMessage decodes a message in either encoding
+func decodeMessage(b []byte, msg *Message) error {
+	if len(b) == 0 || b[0] != wireMagic {
+		return gob.NewDecoder(bytes.NewReader(b)).Decode(msg)
+	}
+	b, err := wireBody(b)
+	if err != nil {
+		return err
+	}
+
+	// The payload may come before its type, so it is decoded last
+	var num protowire.Number
+	var payload []byte
+	for len(b) > 0 {
+		field, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case field == envelopeType && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			num, b = protowire.Number(v), b[n:]
+		case field == envelopePayload && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			payload, b = v, b[n:]
+		case field == envelopeTrace:
+			n, err := consumeWireValue(b, typ, reflect.ValueOf(&msg.Trace).Elem())
+			if err != nil {
+				return fmt.Errorf("trace: %w", err)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(field, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+
+	t, ok := wirePayload[num]
+	if !ok {
+		return fmt.Errorf("unknown message type %d", num)
+	}
+	v := reflect.New(t).Elem()
+	if err := consumeWireStruct(payload, v); err != nil {
+		return fmt.Errorf("%s: %w", t.Name(), err)
+	}
+	msg.Payload = v.Interface()
+	return nil
+}
+
+// encodeStreamHeader encodes a stream header as protobuf, or as gob when
+// wire is false
+func encodeStreamHeader(header *StreamHeader, wire bool) ([]byte, error) {
+	if !wire {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(header); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return appendWireStruct([]byte{wireMagic, wireVersion}, reflect.ValueOf(header).Elem()), nil
+}
+
+// decodeStreamHeader decodes a stream header in either encoding
+func decodeStreamHeader(b []byte, header *StreamHeader) error {
+	if len(b) == 0 || b[0] != wireMagic {
+		return gob.NewDecoder(bytes.NewReader(b)).Decode(header)
+	}
+	b, err := wireBody(b)
+	if err != nil {
+		return err
+	}
+	return consumeWireStruct(b, reflect.ValueOf(header).Elem())
+}
+
+// wireBody strips the magic byte and version off a protobuf payload
+func wireBody(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("truncated wire message")
+	}
+	if b[1] != wireVersion {
+		return nil, fmt.Errorf("unsupported wire version %d", b[1])
+	}
+	return b[2:], nil
+}
+
+// appendWireStruct appends the fields of a struct that are not zero
+func appendWireStruct(b []byte, v reflect.Value) []byte {
+	for _, field := range schemaOf(v.Type()).fields {
+		if fv := v.Field(field.index); !fv.IsZero() {
+			b = appendWireValue(b, field.num, fv)
+		}
+	}
+	return b
+}
+
+// appendWireValue appends v as field num. Slices become repeated fields and
+// maps repeated entries with the key as field 1 and the value as field 2,
+// as protobuf maps are encoded. Times are google.protobuf.Timestamp.
+func appendWireValue(b []byte, num protowire.Number, v reflect.Value) []byte {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		var ts []byte
+		if secs := t.Unix(); secs != 0 {
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(secs))
+		}
+		if nanos := t.Nanosecond(); nanos != 0 {
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(nanos))
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, ts)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, v.String())
+	case reflect.Bool:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v.Bool()))
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(v.Int()))
+	case reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, v.Uint())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			return protowire.AppendBytes(b, v.Bytes())
+		}
+		for i := range v.Len() {
+			b = appendWireValue(b, num, v.Index(i))
+		}
+		return b
+	case reflect.Map:
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(a.String(), b.String())
+		})
+		for _, key := range keys {
+			entry := appendWireValue(nil, 1, key)
+			entry = appendWireValue(entry, 2, v.MapIndex(key))
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+		return b
+	case reflect.Pointer:
+		if v.IsNil() {
+			return b
+		}
+		return appendWireValue(b, num, v.Elem())
+	case reflect.Struct:
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, appendWireStruct(nil, v))
+	}
+	panic(fmt.Sprintf("wire encoding does not support type %s", v.Type()))
+}
+
+// consumeWireStruct decodes the fields of a struct, skipping unknown ones
+func consumeWireStruct(b []byte, v reflect.Value) error {
+	schema := schemaOf(v.Type())
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		index, ok := schema.byNum[num]
+		if !ok {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		n, err := consumeWireValue(b, typ, v.Field(index))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", v.Type().Field(index).Name, err)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeWireValue decodes one field value of wire type typ into v,
+// appending to slices and adding to maps, and returns its length
+func consumeWireValue(b []byte, typ protowire.Type, v reflect.Value) (int, error) {
+	if v.Type() == timeType {
+		ts, n := protowire.ConsumeBytes(b)
+		if n < 0 || typ != protowire.BytesType {
+			return 0, errWireType(typ, n)
+		}
+		var t struct {
+			Seconds int64 `wire:"1"`
+			Nanos   int32 `wire:"2"`
+		}
+		if err := consumeWireStruct(ts, reflect.ValueOf(&t).Elem()); err != nil {
+			return 0, err
+		}
+		v.Set(reflect.ValueOf(time.Unix(t.Seconds, int64(t.Nanos)).UTC()))
+		return n, nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, n := protowire.ConsumeString(b)
+		if n < 0 || typ != protowire.BytesType {
+			return 0, errWireType(typ, n)
+		}
+		v.SetString(s)
+		return n, nil
+	case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		x, n := protowire.ConsumeVarint(b)
+		if n < 0 || typ != protowire.VarintType {
+			return 0, errWireType(typ, n)
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(protowire.DecodeBool(x))
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			v.SetInt(int64(x))
+		default:
+			v.SetUint(x)
+		}
+		return n, nil
+	case reflect.Slice:
+		elemType := v.Type().Elem()
+		if elemType.Kind() == reflect.Uint8 {
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 || typ != protowire.BytesType {
+				return 0, errWireType(typ, n)
+			}
+			v.SetBytes(bytes.Clone(data))
+			return n, nil
+		}
+		if typ == protowire.BytesType && isWireVarint(elemType) {
+			// Packed repeated numbers, as other protobuf encoders write them
+			packed, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			for len(packed) > 0 {
+				elem := reflect.New(elemType).Elem()
+				m, err := consumeWireValue(packed, protowire.VarintType, elem)
+				if err != nil {
+					return 0, err
+				}
+				v.Set(reflect.Append(v, elem))
+				packed = packed[m:]
+			}
+			return n, nil
+		}
+		elem := reflect.New(elemType).Elem()
+		n, err := consumeWireValue(b, typ, elem)
+		if err != nil {
+			return 0, err
+		}
+		v.Set(reflect.Append(v, elem))
+		return n, nil
+	case reflect.Map:
+		entry, n := protowire.ConsumeBytes(b)
+		if n < 0 || typ != protowire.BytesType {
+			return 0, errWireType(typ, n)
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		value := reflect.New(v.Type().Elem()).Elem()
+		for len(entry) > 0 {
+			num, typ, m := protowire.ConsumeTag(entry)
+			if m < 0 {
+				return 0, protowire.ParseError(m)
+			}
+			entry = entry[m:]
+			var err error
+			switch num {
+			case 1:
+				m, err = consumeWireValue(entry, typ, key)
+			case 2:
+				m, err = consumeWireValue(entry, typ, value)
+			default:
+				m = protowire.ConsumeFieldValue(num, typ, entry)
+				if m < 0 {
+					err = protowire.ParseError(m)
+				}
+			}
+			if err != nil {
+				return 0, err
+			}
+			entry = entry[m:]
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(key, value)
+		return n, nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return consumeWireValue(b, typ, v.Elem())
+	case reflect.Struct:
+		data, n := protowire.ConsumeBytes(b)
+		if n < 0 || typ != protowire.BytesType {
+			return 0, errWireType(typ, n)
+		}
+		return n, consumeWireStruct(data, v)
+	}
+	return 0, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// isWireVarint reports whether values of t are encoded as varints
+func isWireVarint(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// errWireType is the error for a value that could not be consumed
+func errWireType(typ protowire.Type, n int) error {
+	if n < 0 {
+		return protowire.ParseError(n)
+	}
+	return fmt.Errorf("unexpected wire type %d", typ)
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/hlc"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestWireRoundTrip(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	clock := hlc.Timestamp{Wall: now.UnixNano(), Logical: 7}
+	payloads := []any{
+		MessageHello{
+			ID:        "node1",
+			PublicKey: []byte{1, 2, 3},
+			SentAt:    now,
+			Labels:    map[string]string{"zone": "eu", "rack": ""},
+			Clock:     clock,
+			Version:   ProtocolVersion,
+			Messages:  []string{"network.MessageGetFile", ""},
+			Caps:      []string{CapRanges, CapProtobuf},
+		},
+		MessageListFilesResponse{
+			ID:    "node1",
+			Files: []storage.FileInfo{{Key: "a.txt", Hash: "abc", Size: 42, ModTime: now}, {}},
+		},
+		MessageDigestEntries{Buckets: []int{0, 3, -1}, Files: []DigestEntry{{Key: "k", Size: 1, Clock: clock}}},
+		MessageDeviceGrant{Devices: []AuthorizedDevice{{Name: "laptop", Added: now}}, Keys: map[string][]byte{"h": {9}}},
+		MessagePolicy{Policy: Policy{Version: 2, Retention: []RetentionRule{{Prefix: "logs/", MinAge: time.Hour}}, Published: now}},
+		MessagePeerRevoked{Host: "10.0.0.1", BanFor: -time.Minute},
+		MessagePexResponse{Epoch: "e", Version: 1 << 40, Full: true, Removed: []string{"x"}},
+		MessageFileExpired{ID: "node1", Key: "tmp.txt", Clock: clock},
+		MessageRangeData{RequestID: "r", Size: 1 << 30, Header: []byte{1, 2}, Data: []byte("range"), Offset: 48},
+		MessagePeersFull{ID: "node1", Peers: []PeerInfo{{Address: "10.0.0.1:3000", LastSeen: now, Source: "pex"}}},
+		MessageReplicaAck{ID: "node1", Key: "a.txt", ContentHash: "abc", SignedAt: now, Size: 42},
+		MessageFileDeleted{ID: "node1", Key: "old.txt", Clock: clock},
+		MessageReplicaNack{ID: "node1", Key: "a.txt", Reason: "integrity check failed"},
+	}
+	for _, payload := range payloads {
+		msg := Message{Payload: payload, Trace: map[string]string{"traceparent": "00-abc"}}
+		b, err := encodeMessage(&msg, true)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(wireMagic), b[0])
+
+		var got Message
+		assert.Nil(t, decodeMessage(b, &got))
+		assert.Equal(t, msg, got, "%T", payload)
+	}
+}
+
+func TestWireStreamHeader(t *testing.T) {
+	header := StreamHeader{ID: "node1", Key: "abc", Size: 100, Offset: 50, Length: 25, Range: true, Clock: hlc.Timestamp{Wall: 1}, Expires: time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC), Hash: "abc"}
+	for _, wire := range []bool{true, false} {
+		b, err := encodeStreamHeader(&header, wire)
+		assert.Nil(t, err)
+
+		var got StreamHeader
+		assert.Nil(t, decodeStreamHeader(b, &got))
+		assert.Equal(t, header, got)
+	}
+}
+
+func TestWireGobCompatibility(t *testing.T) {
+	msg := Message{Payload: MessageHasFile{ID: "node1", Key: "abc"}}
+	b, err := encodeMessage(&msg, false)
+	assert.Nil(t, err)
+	assert.NotEqual(t, byte(wireMagic), b[0])
+
+	var got Message
+	assert.Nil(t, decodeMessage(b, &got))
+	assert.Equal(t, msg.Payload, got.Payload)
+}
+
+func TestWireForwardCompatibility(t *testing.T) {
+	// A newer node sends a field this one does not know, and packs repeated
+	// numbers as other protobuf encoders do
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.BytesType)
+	payload = protowire.AppendString(payload, "node1")
+	payload = protowire.AppendTag(payload, 99, protowire.BytesType)
+	payload = protowire.AppendString(payload, "from the future")
+	var packed []byte
+	for _, n := range []uint64{4, 8, 15} {
+		packed = protowire.AppendVarint(packed, n)
+	}
+	payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, packed)
+
+	b := []byte{wireMagic, wireVersion}
+	b = protowire.AppendTag(b, envelopePayload, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	b = protowire.AppendTag(b, envelopeType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(wireTypes[reflect.TypeOf(MessageDigestEntries{})]))
+
+	var got Message
+	assert.Nil(t, decodeMessage(b, &got))
+	assert.Equal(t, MessageDigestEntries{ID: "node1", Buckets: []int{4, 8, 15}}, got.Payload)
+
+	// Unknown message types and envelope versions are rejected
+	assert.Error(t, decodeMessage([]byte{wireMagic, wireVersion, 0x08, 0x7f}, &got))
+	assert.Error(t, decodeMessage([]byte{wireMagic, wireVersion + 1}, &got))
+}
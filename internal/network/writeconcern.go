@@ -0,0 +1,89 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrWriteConcern is returned by Store when fewer peers than
+// FileServerOpts.WriteConcern acknowledged their replica. The file stays
+// stored locally and the missing replicas are retried in the background.
+var ErrWriteConcern = errors.New("write concern not met")
+
+// pendingRetryInterval is how often replica pushes that have not completed
+// are offered again to the connected peers
+const pendingRetryInterval = time.Minute
+
+// confirmations returns how many peers acknowledged a replica of key, and
+// a channel closed at the next acknowledgment
+func (s *FileServer) confirmations(key string) (int, <-chan struct{}) {
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	n := 0
+	if r, ok := s.receipts[key]; ok {
+		n = len(r.Confirmations)
+	}
+	ch, ok := s.ackSignals[key]
+	if !ok {
+		ch = make(chan struct{})
+		s.ackSignals[key] = ch
+	}
+	return n, ch
+}
+
+// awaitWriteConcern waits until WriteConcern peers acknowledged a replica
+// of key. Acks are sent once a replica was written and its hash verified,
+// so they may trail the pushes; after pushed is closed they are waited for
+// FetchTimeout at most.
+func (s *FileServer) awaitWriteConcern(ctx context.Context, key string, pushed <-chan struct{}) error {
+	var grace <-chan time.Time
+	for {
+		n, acked := s.confirmations(key)
+		if n >= s.WriteConcern {
+			return nil
+		}
+		select {
+		case <-acked:
+		case <-pushed:
+			pushed = nil
+			timer := time.NewTimer(s.FetchTimeout)
+			defer timer.Stop()
+			grace = timer.C
+		case <-grace:
+			return fmt.Errorf("%w: %d of %d replicas of %s acknowledged", ErrWriteConcern, n, s.WriteConcern, key)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.quitch:
+			return ErrServerClosed
+		}
+	}
+}
+
+// retryPendingPushes periodically offers the replica pushes that have not
+// completed to the connected peers, which pull the files they are missing,
+// and sends them the deletes they were not told about. Replicas a Store
+// gave up waiting for are completed this way rather than only when a peer
+// reconnects.
+func (s *FileServer) retryPendingPushes(ctx context.Context) {
+	ticker := time.NewTicker(pendingRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if s.PendingPushes() == 0 && s.PendingDeletes() == 0 {
+			continue
+		}
+		for _, p := range s.replicaPeers() {
+			s.offerPendingPushes(p)
+			s.sendPendingDeletes(p)
+		}
+	}
+}
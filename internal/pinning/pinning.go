@@ -0,0 +1,184 @@
+// Package pinning connects a node to the remote services it pins stored
+// files to: another always-on PeerVault node, reached over its gRPC API, or
+// any service implementing the HTTP pinning API.
+package pinning
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/api"
+)
+
+// chunkSize is the size of the chunks uploaded to a PeerVault node
+const chunkSize = 64 * 1024
+
+// New returns the pinner for target: an http:// or https:// URL for the
+// HTTP pinning API, or the gRPC address of a PeerVault node. The token, if
+// any, is sent as a bearer token to HTTP services.
+func New(target, token string) (network.Pinner, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		if _, err := url.Parse(target); err != nil {
+			return nil, fmt.Errorf("invalid pinning service URL %q: %w", target, err)
+		}
+		return &HTTPPinner{URL: strings.TrimSuffix(target, "/"), Token: token, Client: http.DefaultClient}, nil
+	}
+	return NewNodePinner(target)
+}
+
+// HTTPPinner pins files with a service implementing the HTTP pinning API:
+// PUT {URL}/{hash} stores the request body, GET {URL}/{hash} returns it and
+// answers 404 for files the service does not have.
+type HTTPPinner struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (p *HTTPPinner) request(ctx context.Context, method, hash string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.URL+"/"+hash, body)
+	if err != nil {
+		return nil, err
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	return req, nil
+}
+
+// Pin uploads an encrypted file
+func (p *HTTPPinner) Pin(ctx context.Context, hash string, size int64, r io.Reader) error {
+	req, err := p.request(ctx, http.MethodPut, hash, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pinning service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Fetch downloads a pinned file
+func (p *HTTPPinner) Fetch(ctx context.Context, hash string) (io.ReadCloser, error) {
+	req, err := p.request(ctx, http.MethodGet, hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("pinned file %s %w", hash, network.ErrNotFound)
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("pinning service answered %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// NodePinner pins files on another PeerVault node through its gRPC API. The
+// node stores them as opaque files named after their hash, so it need not
+// share the network key.
+type NodePinner struct {
+	client api.PeerVaultClient
+}
+
+// NewNodePinner connects lazily to the node serving the API on addr
+func NewNodePinner(addr string) (*NodePinner, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &NodePinner{client: api.NewPeerVaultClient(conn)}, nil
+}
+
+// Pin uploads an encrypted file
+func (p *NodePinner) Pin(ctx context.Context, hash string, size int64, r io.Reader) error {
+	stream, err := p.client.StoreFile(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Key{Key: hash}}); err != nil {
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&api.StoreFileRequest{Data: &api.StoreFileRequest_Chunk{Chunk: buf[:n]}}); err != nil {
+				// The real error comes with the response
+				_, err = stream.CloseAndRecv()
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// Fetch downloads a pinned file
+func (p *NodePinner) Fetch(ctx context.Context, hash string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := p.client.GetFile(ctx, &api.GetFileRequest{Key: hash})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The first message tells a missing file apart from a stream
+	first, recvErr := stream.Recv()
+	if recvErr != nil && recvErr != io.EOF {
+		cancel()
+		if status.Code(recvErr) == codes.NotFound {
+			return nil, fmt.Errorf("pinned file %s %w", hash, network.ErrNotFound)
+		}
+		return nil, recvErr
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer cancel()
+		resp, err := first, recvErr
+		for err == nil {
+			if _, werr := pw.Write(resp.Chunk); werr != nil {
+				return // closed by the reader
+			}
+			resp, err = stream.Recv()
+		}
+		if err == io.EOF {
+			pw.Close()
+		} else {
+			pw.CloseWithError(err)
+		}
+	}()
+	return pr, nil
+}
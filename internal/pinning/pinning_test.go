@@ -0,0 +1,109 @@
+package pinning
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/grpcapi"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+func TestHTTPPinner(t *testing.T) {
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		hash := strings.TrimPrefix(r.URL.Path, "/v1/")
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			files[hash], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := files[hash]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	pinner, err := New(srv.URL+"/v1/", "secret")
+	assert.Nil(t, err)
+	testPinner(t, pinner)
+
+	unauthorized, _ := New(srv.URL+"/v1", "")
+	assert.NotNil(t, unauthorized.Pin(context.Background(), "abc", 1, strings.NewReader("x")))
+}
+
+func TestNodePinner(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "pv_pinning_node")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	id, err := crypto.GenerateID()
+	assert.Nil(t, err)
+	encKey, _ := crypto.NewEncryptionKey()
+	fs, err := network.NewFileServer(network.FileServerOpts{
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		ID:                id,
+		EncKey:            encKey,
+		FetchTimeout:      200 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	fs.Transport = p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":5975",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	api := grpcapi.NewServer(fs, nil)
+	go api.Serve(lis)
+	defer api.Stop(context.Background())
+
+	pinner, err := New(lis.Addr().String(), "")
+	assert.Nil(t, err)
+	testPinner(t, pinner)
+}
+
+// testPinner pins a file, fetches it back and checks a missing file is
+// reported as not found
+func testPinner(t *testing.T, pinner network.Pinner) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("ciphertext"), 20000)
+
+	assert.Nil(t, pinner.Pin(ctx, "hash1", int64(len(data)), bytes.NewReader(data)))
+
+	rc, err := pinner.Fetch(ctx, "hash1")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = pinner.Fetch(ctx, "missing")
+	assert.ErrorIs(t, err, network.ErrNotFound)
+}
@@ -3,13 +3,17 @@ package quota
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/AdityaKrSingh26/PeerVault/internal/metrics"
 	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
@@ -28,6 +32,12 @@ type QuotaManager struct {
 	config      *QuotaConfig
 	mu          sync.RWMutex
 	logger      *slog.Logger
+	dataDirs    []string // disks outside the storage root, see SetDataDirs
+	loaded      atomic.Bool
+
+	// Usage as of the last walk of the storage root, see CachedUsage
+	usage   int64
+	usageAt time.Time
 }
 
 // NewQuotaManager creates a new quota manager
@@ -39,47 +49,26 @@ func NewQuotaManager(storageRoot string, logger *slog.Logger) *QuotaManager {
 		storageRoot: storageRoot,
 		configPath:  filepath.Join(storageRoot, "quota.json"),
 		config: &QuotaConfig{
-			MaxStorageBytes: 10 * 1024 * 1024 * 1024, // Default 10GB
+			MaxStorageBytes: DefaultMaxStorage,
 		},
 		logger: logger,
 	}
 }
 
-// LoadOrCreate loads existing quota config or creates a new one interactively
-func (qm *QuotaManager) LoadOrCreate() error {
-	// Try to load existing config
-	if _, err := os.Stat(qm.configPath); err == nil {
-		return qm.load()
-	}
-
-	// Config doesn't exist, create interactively
-	fmt.Println("\n=== Storage Quota Configuration ===")
-	fmt.Println("This is the first time running PeerVault with this storage location.")
-	fmt.Println("Please configure the maximum storage quota for this node.")
-	fmt.Println()
-
-	scanner := bufio.NewScanner(os.Stdin)
-
-	for {
-		fmt.Print("Enter maximum storage size (e.g., 1GB, 500MB, 10GB): ")
-		if !scanner.Scan() {
-			return fmt.Errorf("failed to read input")
-		}
+// ErrNotConfigured is returned by Load when no quota has been saved for the
+// storage root yet
+var ErrNotConfigured = errors.New("storage quota not configured")
 
-		input := strings.TrimSpace(scanner.Text())
-		bytes, err := ParseStorageSize(input)
-		if err != nil {
-			fmt.Printf("Invalid format: %v. Please try again.\n", err)
-			continue
-		}
+// DefaultMaxStorage is the quota of nodes that were never given one
+const DefaultMaxStorage = 10 * 1024 * 1024 * 1024 // 10GB
 
-		qm.config.MaxStorageBytes = bytes
-		fmt.Printf("Storage quota set to: %s (%d bytes)\n", metrics.FormatBytes(bytes), bytes)
-		break
+// Load loads the saved quota config. It never prompts: a storage root
+// without one returns ErrNotConfigured, and the caller picks the quota.
+func (qm *QuotaManager) Load() error {
+	if _, err := os.Stat(qm.configPath); errors.Is(err, os.ErrNotExist) {
+		return ErrNotConfigured
 	}
-
-	// Save configuration
-	return qm.Save()
+	return qm.load()
 }
 
 // load loads quota config from file
@@ -93,9 +82,16 @@ func (qm *QuotaManager) load() error {
 		return fmt.Errorf("failed to parse quota config: %w", err)
 	}
 
+	qm.loaded.Store(true)
 	return nil
 }
 
+// Loaded reports whether the quota was loaded or set, rather than being
+// the default of a manager just created
+func (qm *QuotaManager) Loaded() bool {
+	return qm.loaded.Load()
+}
+
 // Save saves quota config to file
 func (qm *QuotaManager) Save() error {
 	// Ensure directory exists
@@ -121,28 +117,53 @@ func (qm *QuotaManager) GetMaxStorage() int64 {
 	return qm.config.MaxStorageBytes
 }
 
-// GetCurrentUsage calculates current storage usage
+// GetCurrentUsage calculates current storage usage, on the storage root
+// and the disks set with SetDataDirs
 func (qm *QuotaManager) GetCurrentUsage(storageRoot string) (int64, error) {
 	var totalSize int64
 
-	err := filepath.Walk(storageRoot, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			qm.logger.Warn("walk error", "path", path, "err", err)
-			return nil // Skip errors
+	qm.mu.RLock()
+	dirs := append([]string{storageRoot}, qm.dataDirs...)
+	qm.mu.RUnlock()
+	for i, dir := range dirs {
+		if _, err := os.Stat(dir); i > 0 && err != nil {
+			continue // a missing disk holds nothing
 		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-		}
-		return nil
-	})
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				qm.logger.Warn("walk error", "path", path, "err", err)
+				return nil // Skip errors
+			}
+			if !info.IsDir() {
+				totalSize += info.Size()
+			}
+			return nil
+		})
 
-	if err != nil {
-		return 0, fmt.Errorf("failed to calculate storage usage: %w", err)
+		if err != nil {
+			return 0, fmt.Errorf("failed to calculate storage usage: %w", err)
+		}
 	}
 
+	qm.mu.Lock()
+	qm.usage, qm.usageAt = totalSize, time.Now()
+	qm.mu.Unlock()
 	return totalSize, nil
 }
 
+// CachedUsage returns the usage found by the last calculation if it is
+// younger than maxAge, and calculates it again otherwise. Walking a large
+// storage root is slow, so periodic readers use this instead.
+func (qm *QuotaManager) CachedUsage(storageRoot string, maxAge time.Duration) (int64, error) {
+	qm.mu.RLock()
+	usage, at := qm.usage, qm.usageAt
+	qm.mu.RUnlock()
+	if !at.IsZero() && time.Since(at) < maxAge {
+		return usage, nil
+	}
+	return qm.GetCurrentUsage(storageRoot)
+}
+
 // CheckQuota checks if there's enough space for a new file
 func (qm *QuotaManager) CheckQuota(storageRoot string, newFileSize int64) (bool, int64, error) {
 	currentUsage, err := qm.GetCurrentUsage(storageRoot)
@@ -213,11 +234,17 @@ func ParseStorageSize(input string) (int64, error) {
 		multiplier = 1024 * 1024 * 1024
 	case "TB", "T":
 		multiplier = 1024 * 1024 * 1024 * 1024
+	case "PB", "P":
+		multiplier = 1024 * 1024 * 1024 * 1024 * 1024
 	default:
-		return 0, fmt.Errorf("unknown unit: %s (use B, KB, MB, GB, or TB)", unit)
+		return 0, fmt.Errorf("unknown unit: %s (use B, KB, MB, GB, TB or PB)", unit)
 	}
 
-	return int64(num * float64(multiplier)), nil
+	size := num * float64(multiplier)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("%s is too large", input)
+	}
+	return int64(size), nil
 }
 
 // PromptDeleteFiles shows list of files and asks user which to delete
@@ -308,6 +335,23 @@ func PromptDeleteFiles(store *storage.Store, nodeID string, requiredSpace int64)
 // SetMaxStorage sets the maximum storage limit (useful for testing)
 func (qm *QuotaManager) SetMaxStorage(bytes int64) {
 	qm.config.MaxStorageBytes = bytes
+	qm.loaded.Store(true)
+}
+
+// SetDataDirs sets the disks files are stored on besides the storage root,
+// so they count toward the quota. Disks inside the storage root are
+// already counted and skipped.
+func (qm *QuotaManager) SetDataDirs(dirs []string) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	qm.dataDirs = nil
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(qm.storageRoot, dir)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			continue
+		}
+		qm.dataDirs = append(qm.dataDirs, dir)
+	}
 }
 
 // SetStorageRoot sets the storage root path
@@ -0,0 +1,202 @@
+// Package spool keeps store operations on disk until the node they are
+// meant for can be reached
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned by a send function when the node cannot be
+// reached. It stops a replay, leaving the rest of the queue in order.
+var ErrUnreachable = errors.New("node unreachable")
+
+// Entry is a queued store operation
+type Entry struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// SendFunc stores a queued file on the node
+type SendFunc func(ctx context.Context, key string, r io.Reader) error
+
+// Queue is a directory of spooled files. Each entry is a data file holding
+// a copy of the contents and a JSON file describing it; the JSON file is
+// written last, so an entry only exists once its data is complete.
+type Queue struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// Open opens the queue in dir, creating it if needed
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Queue{dir: dir}, nil
+}
+
+func (q *Queue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".data")
+}
+
+func (q *Queue) entryPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// Enqueue copies r into the queue, to be stored under key on replay
+func (q *Queue) Enqueue(key string, r io.Reader) (Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Nanosecond IDs keep entries in the order they were queued
+	now := time.Now()
+	id := fmt.Sprintf("%019d", now.UnixNano())
+	for {
+		if _, err := os.Stat(q.entryPath(id)); os.IsNotExist(err) {
+			break
+		}
+		now = now.Add(time.Nanosecond)
+		id = fmt.Sprintf("%019d", now.UnixNano())
+	}
+
+	f, err := os.OpenFile(q.dataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return Entry{}, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(q.dataPath(id))
+		return Entry{}, err
+	}
+
+	e := Entry{ID: id, Key: key, Size: n, Queued: now}
+	if err := q.writeEntry(e); err != nil {
+		os.Remove(q.dataPath(id))
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// writeEntry replaces the description of an entry. Callers hold mu.
+func (q *Queue) writeEntry(e Entry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.entryPath(e.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.entryPath(e.ID))
+}
+
+// List returns the queued entries, oldest first
+func (q *Queue) List() ([]Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.list()
+}
+
+func (q *Queue) list() ([]Entry, error) {
+	names, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, name := range names {
+		if !strings.HasSuffix(name.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.dir, name.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("corrupt queue entry %s: %w", name.Name(), err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// Remove drops an entry from the queue
+func (q *Queue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.remove(id)
+}
+
+func (q *Queue) remove(id string) error {
+	if err := os.Remove(q.entryPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no queued operation %s", id)
+		}
+		return err
+	}
+	return os.Remove(q.dataPath(id))
+}
+
+// Replay sends the queued entries in order, removing each one that is
+// stored. An entry that fails is kept with its error and skipped, unless the
+// node is unreachable, in which case the replay stops. It returns the number
+// of entries sent.
+func (q *Queue) Replay(ctx context.Context, send SendFunc) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.list()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+
+		f, err := os.Open(q.dataPath(e.ID))
+		if err != nil {
+			return sent, err
+		}
+		err = send(ctx, e.Key, f)
+		f.Close()
+
+		if err == nil {
+			if err := q.remove(e.ID); err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+
+		e.Attempts++
+		e.LastError = err.Error()
+		if werr := q.writeEntry(e); werr != nil {
+			return sent, werr
+		}
+		if errors.Is(err, ErrUnreachable) {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
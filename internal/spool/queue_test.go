@@ -0,0 +1,68 @@
+package spool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestQueueReplay(t *testing.T) {
+	q, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := q.Enqueue(key, strings.NewReader("data of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The node is down: the replay stops at the first entry
+	down := func(ctx context.Context, key string, r io.Reader) error {
+		return fmt.Errorf("%w: connection refused", ErrUnreachable)
+	}
+	sent, err := q.Replay(context.Background(), down)
+	if !errors.Is(err, ErrUnreachable) || sent != 0 {
+		t.Fatalf("have %d, %v want 0, %v", sent, err, ErrUnreachable)
+	}
+	entries, _ := q.List()
+	if len(entries) != 3 || entries[0].Attempts != 1 || entries[1].Attempts != 0 {
+		t.Fatalf("unexpected queue after failed replay: %+v", entries)
+	}
+
+	// The node is back but rejects "b": it stays queued, the others are sent in order
+	var stored []string
+	up := func(ctx context.Context, key string, r io.Reader) error {
+		if key == "b" {
+			return errors.New("quota exceeded")
+		}
+		data, _ := io.ReadAll(r)
+		if !bytes.Equal(data, []byte("data of "+key)) {
+			t.Errorf("have %q for %s", data, key)
+		}
+		stored = append(stored, key)
+		return nil
+	}
+	sent, err = q.Replay(context.Background(), up)
+	if err != nil || sent != 2 {
+		t.Fatalf("have %d, %v want 2, nil", sent, err)
+	}
+	if strings.Join(stored, ",") != "a,c" {
+		t.Errorf("have %v want [a c]", stored)
+	}
+
+	entries, _ = q.List()
+	if len(entries) != 1 || entries[0].Key != "b" || entries[0].LastError != "quota exceeded" {
+		t.Fatalf("unexpected queue after replay: %+v", entries)
+	}
+	if err := q.Remove(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = q.List(); len(entries) != 0 {
+		t.Errorf("have %d entries want 0", len(entries))
+	}
+}
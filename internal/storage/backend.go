@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Backend holds the content of stored files by node ID and key. The Store
+// is the filesystem backend: it keeps files on its own disks. Configured
+// with another backend, the Store still keeps the key map, transfers in
+// progress and writes being staged on local disk, and moves each file to
+// the backend once it is complete.
+type Backend interface {
+	// Write stores the content of r under key, replacing any earlier content
+	Write(id string, key string, r io.Reader) (int64, error)
+	// Read returns the size and content of a stored file. The caller closes
+	// the reader. It need not be an io.Seeker.
+	Read(id string, key string) (int64, io.ReadCloser, error)
+	// Delete removes a stored file. Deleting a missing file is not an error.
+	Delete(id string, key string) error
+	Has(id string, key string) bool
+	// List returns the files stored for a node ID, or for every node if id
+	// is empty. Key is the key the file was written under.
+	List(id string) ([]FileInfo, error)
+	// Stat returns the size and modification time of a stored file, and an
+	// error wrapping os.ErrNotExist if there is none
+	Stat(id string, key string) (FileInfo, error)
+}
+
+var (
+	_ Backend = (*Store)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+	_ Backend = (*S3Backend)(nil)
+)
+
+// OpenBackend returns the backend described by spec:
+//   - "" for none, files stay on the Store's own disks
+//   - "memory" for a MemoryBackend, lost when the node stops
+//   - "s3://bucket/prefix?endpoint=https://host&region=name" for an
+//     S3Backend. The endpoint defaults to AWS; credentials are read from
+//     AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func OpenBackend(spec string) (Backend, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "memory":
+		return NewMemoryBackend(), nil
+	case strings.HasPrefix(spec, "s3://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage backend %q: %w", spec, err)
+		}
+		return NewS3Backend(S3Options{
+			Endpoint:  u.Query().Get("endpoint"),
+			Region:    u.Query().Get("region"),
+			Bucket:    u.Host,
+			Prefix:    strings.TrimPrefix(u.Path, "/"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, want memory or s3://bucket", spec)
+}
+
+// backendKey is the key a file is stored under in the backend: the hashed
+// name it has on disk, so the backend never sees the original key
+func (s *Store) backendKey(key string) string {
+	return s.PathTransformFunc(key).Filename
+}
+
+// Stat returns the size, modification time and metadata record of a
+// stored file
+func (s *Store) Stat(id string, key string) (FileInfo, error) {
+	info, err := s.statFile(id, key)
+	if err != nil {
+		return info, err
+	}
+	return s.withMeta(id, key, info)
+}
+
+// statFile returns the size and modification time of a stored file
+func (s *Store) statFile(id string, key string) (FileInfo, error) {
+	if s.Backend != nil {
+		info, err := s.Backend.Stat(id, s.backendKey(key))
+		return s.fromBackend(info), err
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(fullPathWithRoot)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Key:     key,
+		Hash:    s.backendKey(key),
+		Size:    info.Size(),
+		NodeID:  id,
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+// fromBackend turns a file listed by the backend into one listed by the
+// Store, with the original key from the key map
+func (s *Store) fromBackend(info FileInfo) FileInfo {
+	info.Hash = info.Key
+	s.keyMapMu.RLock()
+	originalKey, exists := s.keyMap[info.Hash]
+	s.keyMapMu.RUnlock()
+	if !exists {
+		originalKey = fmt.Sprintf("file_%s", info.Hash[:min(8, len(info.Hash))])
+	}
+	info.Key = originalKey
+	return info
+}
+
+// listBackend lists the files of a node ID in the backend, with the
+// metadata records kept on local disk
+func (s *Store) listBackend(id string) ([]FileInfo, error) {
+	files, err := s.Backend.List(id)
+	for i := range files {
+		files[i] = s.fromBackend(files[i])
+		var meta objectMeta
+		if _, known := s.GetOriginalKey(files[i].Hash); known {
+			if path, err := s.metaPath(files[i].NodeID, files[i].Key); err == nil {
+				meta, _ = s.readMeta(path)
+			}
+		}
+		files[i] = meta.apply(files[i])
+	}
+	return files, err
+}
+
+// clearBackend deletes every file in the backend
+func (s *Store) clearBackend() error {
+	if s.Backend == nil {
+		return nil
+	}
+	files, err := s.Backend.List("")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := s.Backend.Delete(f.NodeID, f.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload moves the complete file at path to the backend
+func (s *Store) upload(id string, key string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	_, err = s.Backend.Write(id, s.backendKey(key), f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// download copies a file from the backend to an unnamed temporary file,
+// for callers that need random access
+func (s *Store) download(id string, key string) (*os.File, error) {
+	_, r, err := s.Backend.Read(id, s.backendKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp("", "peervault-*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// The file stays readable through f until it is closed
+	os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// hashBackend returns the hex SHA-256 of a file in the backend
+func (s *Store) hashBackend(id string, key string) (string, error) {
+	_, r, err := s.Backend.Read(id, s.backendKey(key))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm WriteEncrypt compresses files with before
+// encrypting them
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+// ParseCompression returns the compression called name: none (or empty),
+// gzip or zstd
+func ParseCompression(name string) (Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %q, want none, gzip or zstd", name)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// A compressed file starts with compressMagic and the Compression byte,
+// inside the encryption, so peers and backends see neither. Files stored
+// uncompressed have no header, unless their content starts with
+// compressMagic itself, in which case a CompressionNone header tells it
+// apart from one.
+const compressMagic = "\x00PVZ"
+
+// CompressHeaderSize is the size of the header of a compressed file
+const CompressHeaderSize = len(compressMagic) + 1
+
+// sniffSize is how much of a file is looked at to decide whether it is
+// worth compressing
+const sniffSize = 4096
+
+// minCompressSize is the size below which files are stored as they are,
+// since the header and the compression framing would outweigh the gain
+const minCompressSize = 256
+
+// maxCompressEntropy is the entropy, in bits per byte, above which the
+// start of a file looks compressed or encrypted already
+const maxCompressEntropy = 7.5
+
+// CompressionOf returns the compression of a file whose content starts
+// with head, and the size of its header, 0 if it has none. head holds at
+// least CompressHeaderSize bytes unless the file is smaller.
+func CompressionOf(head []byte) (Compression, int, error) {
+	if len(head) < CompressHeaderSize || !bytes.HasPrefix(head, []byte(compressMagic)) {
+		return CompressionNone, 0, nil
+	}
+	c := Compression(head[len(compressMagic)])
+	if c > CompressionZstd {
+		return c, 0, fmt.Errorf("file compressed with unknown %s", c)
+	}
+	return c, CompressHeaderSize, nil
+}
+
+// compress returns the content of r as it is stored: compressed with c
+// and a header, unless c is CompressionNone or the content looks
+// incompressible. key is the file's key, whose extension also tells
+// compressed formats. The caller closes the reader, which stops the
+// compression if it is not read to its end.
+func compress(c Compression, key string, r io.Reader) io.ReadCloser {
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		pr, pw := io.Pipe()
+		pw.CloseWithError(err)
+		return pr
+	}
+	head = head[:n]
+	content := io.MultiReader(bytes.NewReader(head), r)
+
+	if c == CompressionNone || incompressible(key, head) {
+		if bytes.HasPrefix(head, []byte(compressMagic)) {
+			content = io.MultiReader(bytes.NewReader(compressHeader(CompressionNone)), content)
+		}
+		return io.NopCloser(content)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(compressTo(c, pw, content))
+	}()
+	return pr
+}
+
+func compressHeader(c Compression) []byte {
+	return append([]byte(compressMagic), byte(c))
+}
+
+// compressTo writes the header and the content of r compressed with c to
+// w. The output only depends on the content, which convergent encryption
+// relies on.
+func compressTo(c Compression, w io.Writer, r io.Reader) error {
+	if _, err := w.Write(compressHeader(c)); err != nil {
+		return err
+	}
+	var cw io.WriteCloser
+	switch c {
+	case CompressionGzip:
+		cw = gzip.NewWriter(w)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		cw = zw
+	default:
+		return fmt.Errorf("cannot compress with %s", c)
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// Decompress returns the content of a file from its stored plaintext,
+// decompressing it if it was stored compressed. Nothing is read from r
+// before the first Read.
+func Decompress(r io.Reader) io.Reader {
+	return &decompressor{r: r}
+}
+
+type decompressor struct {
+	r   io.Reader
+	out io.Reader
+	zr  *zstd.Decoder // the decoder of out, closed at its end
+	err error
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.out == nil && d.err == nil {
+		d.out, d.err = d.open()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.out.Read(p)
+	if err != nil && d.zr != nil {
+		d.zr.Close()
+		d.err = err
+	}
+	return n, err
+}
+
+// open reads the header of the file, if it has one, and returns a reader
+// of its content
+func (d *decompressor) open() (io.Reader, error) {
+	br := bufio.NewReader(d.r)
+	head, err := br.Peek(CompressHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	c, size, err := CompressionOf(head)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return br, nil
+	}
+	br.Discard(size)
+
+	switch c {
+	case CompressionGzip:
+		return gzip.NewReader(br)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		d.zr = zr
+		return zr, nil
+	}
+	return br, nil
+}
+
+// compressedExtensions are formats that are compressed already
+var compressedExtensions = map[string]bool{
+	".7z": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz4": true, ".mkv": true, ".mov": true,
+	".mp3": true, ".mp4": true, ".odt": true, ".ogg": true, ".opus": true,
+	".png": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true,
+	".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// compressedMagics start files in formats that are compressed already
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},               // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},   // zstd
+	[]byte("PK\x03\x04"),       // zip, and the office formats built on it
+	[]byte("\x89PNG"),          // png
+	{0xff, 0xd8, 0xff},         // jpeg
+	[]byte("GIF8"),             // gif
+	[]byte("BZh"),              // bzip2
+	{0xfd, '7', 'z', 'X', 'Z'}, // xz
+	[]byte("7z\xbc\xaf"),       // 7z
+	[]byte("Rar!"),             // rar
+	[]byte("OggS"),             // ogg
+	[]byte("fLaC"),             // flac
+	[]byte("ID3"),              // mp3
+}
+
+// incompressible reports whether a file with the given key, whose content
+// starts with head, is not worth compressing: it is small, in a compressed
+// format, or looks random
+func incompressible(key string, head []byte) bool {
+	if len(head) < minCompressSize {
+		return true
+	}
+	if compressedExtensions[strings.ToLower(filepath.Ext(key))] {
+		return true
+	}
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	// mp4, mov and heic have their signature after a size
+	if len(head) >= 8 && string(head[4:8]) == "ftyp" {
+		return true
+	}
+	return entropy(head) > maxCompressEntropy
+}
+
+// entropy returns the Shannon entropy of data in bits per byte
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var e float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
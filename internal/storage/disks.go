@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Disk is a directory files are spread over, usually the mount point of one
+// drive. A node with several drives (JBOD) lists each of them as a disk.
+type Disk struct {
+	Path  string
+	Quota int64 // bytes the disk may hold, 0 for no limit
+}
+
+// DiskState tells whether a disk can be read and written
+type DiskState string
+
+const (
+	DiskOK       DiskState = "ok"
+	DiskReadOnly DiskState = "read-only" // files are read, new files go to other disks
+	DiskMissing  DiskState = "missing"   // not mounted, its files are unavailable
+)
+
+// DiskUsage describes one disk of a store
+type DiskUsage struct {
+	Path  string
+	State DiskState
+	Used  int64
+	Quota int64
+}
+
+// ShardFunc orders the disks a file may be stored on, most preferred first.
+// It is given the hashed name of the file and the paths of the disks, and
+// returns the index of every disk once. It must always return the same
+// order for the same arguments.
+type ShardFunc func(hash string, disks []string) []int
+
+// RendezvousShardFunc ranks disks by rendezvous (highest random weight)
+// hashing of the disk path and the file hash. Adding a disk only moves the
+// files that rank it first, and the order of the disks does not matter.
+func RendezvousShardFunc(hash string, disks []string) []int {
+	weights := make([]uint64, len(disks))
+	order := make([]int, len(disks))
+	for i, path := range disks {
+		sum := sha256.Sum256([]byte(path + "\x00" + hash))
+		weights[i] = binary.BigEndian.Uint64(sum[:8])
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		switch {
+		case weights[a] > weights[b]:
+			return -1
+		case weights[a] < weights[b]:
+			return 1
+		}
+		return a - b
+	})
+	return order
+}
+
+// ErrQuotaExceeded is returned when no disk can take a new file, because
+// each one is at its quota, read-only or missing
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// disk is a Disk as the store tracks it
+type disk struct {
+	Disk
+	used atomic.Int64 // bytes on the disk, measured by refresh, plus writes since
+
+	mu    sync.Mutex
+	state DiskState
+}
+
+// State returns the state of the disk as of the last refresh
+func (d *disk) State() DiskState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// openDisks checks every configured disk. A missing or read-only disk is
+// logged and kept, so the node starts with the remaining ones. Without
+// configured disks, files are stored in the root folder as one disk.
+func openDisks(opts StoreOpts) []*disk {
+	if len(opts.Disks) == 0 {
+		return []*disk{{Disk: Disk{Path: opts.Root}, state: DiskOK}}
+	}
+
+	disks := make([]*disk, 0, len(opts.Disks))
+	for _, cfg := range opts.Disks {
+		d := &disk{Disk: cfg}
+		d.refresh()
+		switch d.State() {
+		case DiskMissing:
+			log.Printf("disk %s is missing, its files are unavailable", d.Path)
+		case DiskReadOnly:
+			log.Printf("disk %s is read-only, new files go to other disks", d.Path)
+		}
+		disks = append(disks, d)
+	}
+	return disks
+}
+
+// refresh probes the state of the disk and measures its usage. A disk
+// whose directory does not exist is missing rather than created, so an
+// unmounted drive does not fill the file system below its mount point.
+func (d *disk) refresh() {
+	state := DiskOK
+	defer func() {
+		d.mu.Lock()
+		d.state = state
+		d.mu.Unlock()
+	}()
+
+	info, err := os.Stat(d.Path)
+	if err != nil || !info.IsDir() {
+		state = DiskMissing
+		d.used.Store(0)
+		return
+	}
+	if probe, err := os.CreateTemp(d.Path, ".peervault-probe-*"); err != nil {
+		state = DiskReadOnly
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+
+	var used int64
+	filepath.Walk(d.Path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			used += info.Size()
+		}
+		return nil
+	})
+	d.used.Store(used)
+}
+
+// hasRoom reports whether a new file may be placed on the disk
+func (d *disk) hasRoom() bool {
+	return d.State() == DiskOK && (d.Quota <= 0 || d.used.Load() < d.Quota)
+}
+
+// candidates returns the disks a file may be on, in the order they are
+// searched: by ShardFunc, with read-only disks last so a copy written
+// elsewhere after the disk turned read-only wins. Missing disks are left out.
+func (s *Store) candidates(hash string) []*disk {
+	if len(s.disks) == 1 {
+		if s.disks[0].State() == DiskMissing {
+			return nil
+		}
+		return s.disks
+	}
+
+	paths := make([]string, len(s.disks))
+	for i, d := range s.disks {
+		paths[i] = d.Path
+	}
+	shard := s.ShardFunc
+	if shard == nil {
+		shard = RendezvousShardFunc
+	}
+	var writable, readOnly []*disk
+	for _, i := range shard(hash, paths) {
+		switch d := s.disks[i]; d.State() {
+		case DiskOK:
+			writable = append(writable, d)
+		case DiskReadOnly:
+			readOnly = append(readOnly, d)
+		}
+	}
+	return append(writable, readOnly...)
+}
+
+// keyPath returns the path of a key's file, with suffix appended for its
+// partial file and chunk record, and the disk it is on. An existing file is
+// found on whichever disk holds it. Otherwise, and for writes to a file on
+// a read-only disk, it is placed on the first disk in shard order with room,
+// next to the key's other files if any.
+func (s *Store) keyPath(id string, key string, suffix string, write bool) (*disk, string, error) {
+	pathKey := s.PathTransformFunc(key)
+	candidates := s.candidates(pathKey.Filename)
+
+	names := []string{pathKey.FullPath() + suffix}
+	if suffix != "" {
+		names = append(names, pathKey.FullPath())
+	}
+	for _, name := range names {
+		for _, d := range candidates {
+			if write && d.State() != DiskOK {
+				continue
+			}
+			path, err := s.resolveIn(d.Path, id, name)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := os.Stat(path); err == nil {
+				return d, filepath.Join(filepath.Dir(path), pathKey.Filename+suffix), nil
+			}
+		}
+	}
+
+	// A file that does not exist is looked for where it would be written
+	for _, d := range candidates {
+		if !write || d.hasRoom() {
+			path, err := s.resolveIn(d.Path, id, pathKey.FullPath()+suffix)
+			return d, path, err
+		}
+	}
+	return nil, "", fmt.Errorf("%w: no writable disk with free space for %s", ErrQuotaExceeded, pathKey.Filename)
+}
+
+// nodeDirs returns the directory of a node ID on every disk that is not missing
+func (s *Store) nodeDirs(id string) ([]string, error) {
+	var dirs []string
+	for _, d := range s.disks {
+		if d.State() == DiskMissing {
+			continue
+		}
+		dir, err := s.resolveIn(d.Path, id, "")
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// DiskUsage returns the state and usage of every configured disk, measured
+// afresh. Disks that were missing or read-only are checked again, so a
+// drive mounted while the node runs is picked up. It returns nil when files
+// are stored in the root folder.
+func (s *Store) DiskUsage() []DiskUsage {
+	if len(s.Disks) == 0 {
+		return nil
+	}
+	usage := make([]DiskUsage, 0, len(s.disks))
+	for _, d := range s.disks {
+		d.refresh()
+		usage = append(usage, DiskUsage{Path: d.Path, State: d.State(), Used: d.used.Load(), Quota: d.Quota})
+	}
+	return usage
+}
+
+// DiskPaths returns the paths of the configured disks
+func (s *Store) DiskPaths() []string {
+	paths := make([]string, len(s.Disks))
+	for i, d := range s.Disks {
+		paths[i] = d.Path
+	}
+	return paths
+}
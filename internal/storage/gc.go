@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +25,55 @@ type GarbageCollector struct {
 	integrityEnabled bool
 	stopChan         chan struct{}
 	logger           *slog.Logger
+	runMu            sync.Mutex // one run at a time, scheduled or on demand
+	lastMu           sync.Mutex
+	last             *RunReport     // report of the last full run, nil before the first
+	missing          map[string]int // failed repairs of each missing key
+
+	// OnFinding, if set, is called for every corrupted file, orphaned
+	// directory or abandoned temporary file the collector finds, with kind
+	// "corrupted" or "orphaned", with kind "held" for a corrupted file
+	// kept under legal hold, with kind "repaired" for a corrupted or
+	// missing file replaced by a good copy, "discarded" for a corrupted one
+	// given up on after RepairAttempts failed repairs and "missing" for a
+	// file Expected lists that is not stored, with kind "pruned" for every earlier
+	// version removed past its retention, with kind "expired" for every
+	// file removed because it expired, and with kind "purged" for every
+	// deleted file removed from the trash
+	OnFinding func(kind string, path string)
+
+	// OnRun, if set, is called with the duration of every completed run
+	OnRun func(elapsed time.Duration)
+
+	// Held, if set, reports files under legal hold by their hashed name.
+	// The collector reports such files but never removes them.
+	Held func(hash string) bool
+
+	// Repair, if set, fetches a good copy of a corrupted file by its
+	// original key, e.g. from peers. Corrupted files are quarantined, see
+	// quarantine.go, and only removed once RepairAttempts repairs failed.
+	Repair func(key string) error
+
+	// Failed repairs before a quarantined file is removed, or a missing
+	// file is no longer tried, 3 if not set
+	RepairAttempts int
+
+	// Expected, if set, returns the original keys of the files the node
+	// should store, e.g. those it stored or received as replicas. Any not
+	// stored, lost with a disk or removed by hand, are fetched through Repair.
+	Expected func() []string
+
+	// Expire, if set, removes an expired file by its original key instead
+	// of the collector, e.g. to tell the peers holding replicas. An error
+	// leaves the file for the next run.
+	Expire func(key string) error
+
+	// Verify, if set, checks the content of the file at path, stored under
+	// the hashed name hash, instead of comparing the hash of its content
+	// with the name. Stores that name files after their key rather than
+	// their content need it. An error means the file could not be checked
+	// and leaves it alone.
+	Verify func(hash string, path string) (bool, error)
 }
 
 // NewGarbageCollector creates a new garbage collector
@@ -32,7 +85,7 @@ func NewGarbageCollector(store *Store, nodeID string, gcInterval time.Duration,
 		logger.Error("invalid node ID for garbage collector", "node", nodeID, "err", err)
 		os.Exit(1)
 	}
-	return &GarbageCollector{
+	gc := &GarbageCollector{
 		store:            store,
 		nodeID:           nodeID,
 		cleanupInterval:  gcInterval,
@@ -40,7 +93,74 @@ func NewGarbageCollector(store *Store, nodeID string, gcInterval time.Duration,
 		integrityEnabled: true,
 		stopChan:         make(chan struct{}),
 		logger:           logger,
+		missing:          make(map[string]int),
 	}
+	gc.loadReport()
+	return gc
+}
+
+// gcReportFile keeps the report of the last full run in the storage root,
+// so it survives restarts
+const gcReportFile = "gc-report.json"
+
+// RunReport is the outcome of one full garbage collection run
+type RunReport struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Stats    CleanupStats  `json:"stats"`
+	Err      string        `json:"err,omitempty"`
+}
+
+// LastRun returns the report of the last full run, persisted across
+// restarts, and false if the collector never ran
+func (gc *GarbageCollector) LastRun() (RunReport, bool) {
+	gc.lastMu.Lock()
+	defer gc.lastMu.Unlock()
+	if gc.last == nil {
+		return RunReport{}, false
+	}
+	return *gc.last, true
+}
+
+// Schedule returns how often the collector runs and how long after it is
+// started it runs first
+func (gc *GarbageCollector) Schedule() (interval time.Duration, initialDelay time.Duration) {
+	return gc.cleanupInterval, gc.initialDelay
+}
+
+// loadReport reads the report of the last run before a restart
+func (gc *GarbageCollector) loadReport() {
+	data, err := os.ReadFile(filepath.Join(gc.store.Root, gcReportFile))
+	if err != nil {
+		return
+	}
+	var report RunReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		gc.logger.Warn("Ignoring unreadable garbage collection report", "node", gc.nodeID, "err", err)
+		return
+	}
+	gc.last = &report
+}
+
+// saveReport records the report of a run and persists it
+func (gc *GarbageCollector) saveReport(report RunReport) error {
+	gc.lastMu.Lock()
+	gc.last = &report
+	gc.lastMu.Unlock()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(gc.store.Root, 0755); err != nil {
+		return err
+	}
+	f, err := createTemp(filepath.Join(gc.store.Root, gcReportFile))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return f.finish(err)
 }
 
 // Start begins the periodic garbage collection routine
@@ -81,6 +201,15 @@ func (gc *GarbageCollector) run(ctx context.Context) {
 
 // performCleanup runs integrity checks and cleanup operations
 func (gc *GarbageCollector) performCleanup() {
+	gc.RunNow(nil)
+}
+
+// RunNow runs a full collection right away, after any run in progress.
+// checked, if set, is called after every file whose integrity was verified.
+func (gc *GarbageCollector) RunNow(checked func()) (CleanupStats, error) {
+	gc.runMu.Lock()
+	defer gc.runMu.Unlock()
+
 	gc.logger.Info("Running garbage collection", "node", gc.nodeID)
 	start := time.Now()
 
@@ -90,48 +219,153 @@ func (gc *GarbageCollector) performCleanup() {
 		RemovedFiles:   0,
 	}
 
+	var errs []error
 	if gc.integrityEnabled {
 		// Verify file integrity
-		if err := gc.verifyIntegrity(&stats); err != nil {
+		if err := gc.verifyIntegrity(&stats, checked); err != nil {
 			gc.logger.Error("Error during integrity verification", "node", gc.nodeID, "err", err)
+			errs = append(errs, err)
 		}
 	}
 
+	if err := gc.repairQuarantined(&stats); err != nil {
+		gc.logger.Error("Error during repair of quarantined files", "node", gc.nodeID, "err", err)
+		errs = append(errs, err)
+	}
+
+	if err := gc.repairMissing(&stats); err != nil {
+		gc.logger.Error("Error during repair of missing files", "node", gc.nodeID, "err", err)
+		errs = append(errs, err)
+	}
+
+	if err := gc.expireFiles(&stats); err != nil {
+		gc.logger.Error("Error during expiry", "node", gc.nodeID, "err", err)
+		errs = append(errs, err)
+	}
+
+	if err := gc.purgeTrash(&stats); err != nil {
+		gc.logger.Error("Error during trash purge", "node", gc.nodeID, "err", err)
+		errs = append(errs, err)
+	}
+
+	if err := gc.pruneVersions(&stats); err != nil {
+		gc.logger.Error("Error during version pruning", "node", gc.nodeID, "err", err)
+		errs = append(errs, err)
+	}
+
 	// Clean up orphaned files
 	if err := gc.cleanOrphanedFiles(&stats); err != nil {
 		gc.logger.Error("Error during orphan cleanup", "node", gc.nodeID, "err", err)
+		errs = append(errs, err)
 	}
 
 	elapsed := time.Since(start)
+	report := RunReport{Started: start, Duration: elapsed, Stats: stats}
+	if err := errors.Join(errs...); err != nil {
+		report.Err = err.Error()
+	}
+	if err := gc.saveReport(report); err != nil {
+		gc.logger.Warn("Failed to save garbage collection report", "node", gc.nodeID, "err", err)
+	}
+	if gc.OnRun != nil {
+		gc.OnRun(elapsed)
+	}
 	gc.logger.Info("Garbage collection completed",
 		"node", gc.nodeID,
 		"duration", elapsed,
 		"corrupted", stats.CorruptedFiles,
+		"missing", stats.MissingFiles,
+		"repaired", stats.RepairedFiles,
 		"orphaned", stats.OrphanedFiles,
+		"pruned", stats.PrunedVersions,
+		"expired", stats.ExpiredFiles,
+		"purged", stats.PurgedTrash,
+		"removed", stats.RemovedFiles,
+	)
+	return stats, errors.Join(errs...)
+}
+
+// Scrub verifies the integrity of every stored file right away, and
+// quarantines and repairs corrupted ones and fetches missing ones like a
+// full run does, but leaves directories alone.
+// checked, if set, is called after every verified file.
+func (gc *GarbageCollector) Scrub(checked func()) (CleanupStats, error) {
+	gc.runMu.Lock()
+	defer gc.runMu.Unlock()
+
+	gc.logger.Info("Scrubbing stored files", "node", gc.nodeID)
+	var stats CleanupStats
+	err := gc.verifyIntegrity(&stats, checked)
+	if err == nil {
+		err = gc.repairQuarantined(&stats)
+	}
+	if err == nil {
+		err = gc.repairMissing(&stats)
+	}
+	gc.logger.Info("Scrub completed",
+		"node", gc.nodeID,
+		"checked", stats.CheckedFiles,
+		"corrupted", stats.CorruptedFiles,
+		"missing", stats.MissingFiles,
+		"repaired", stats.RepairedFiles,
 		"removed", stats.RemovedFiles,
 	)
+	return stats, err
 }
 
 // CleanupStats tracks garbage collection statistics
 type CleanupStats struct {
-	CorruptedFiles int
-	OrphanedFiles  int
-	RemovedFiles   int
+	CheckedFiles   int `json:"checked"`
+	UncheckedFiles int `json:"unchecked"` // files that could not be verified and were left alone
+	CorruptedFiles int `json:"corrupted"`
+	MissingFiles   int `json:"missing"`  // expected files not stored
+	RepairedFiles  int `json:"repaired"` // corrupted or missing files replaced by a good copy
+	OrphanedFiles  int `json:"orphaned"`
+	PrunedVersions int `json:"pruned"` // earlier versions past their retention
+	ExpiredFiles   int `json:"expired"`
+	PurgedTrash    int `json:"purged"` // deleted files kept in the trash past its age
+	RemovedFiles   int `json:"removed"`
+}
+
+// Counts returns the statistics by the names of their JSON fields
+func (c CleanupStats) Counts() map[string]int {
+	return map[string]int{
+		"checked":   c.CheckedFiles,
+		"unchecked": c.UncheckedFiles,
+		"corrupted": c.CorruptedFiles,
+		"missing":   c.MissingFiles,
+		"repaired":  c.RepairedFiles,
+		"orphaned":  c.OrphanedFiles,
+		"pruned":    c.PrunedVersions,
+		"expired":   c.ExpiredFiles,
+		"purged":    c.PurgedTrash,
+		"removed":   c.RemovedFiles,
+	}
 }
 
 // verifyIntegrity checks if stored files have valid hashes
-func (gc *GarbageCollector) verifyIntegrity(stats *CleanupStats) error {
+func (gc *GarbageCollector) verifyIntegrity(stats *CleanupStats, checked func()) error {
 	gc.logger.Info("Verifying file integrity", "node", gc.nodeID)
 
-	nodeDir, err := gc.store.resolvePath(gc.nodeID, "")
+	nodeDirs, err := gc.store.nodeDirs(gc.nodeID)
 	if err != nil {
 		return err
 	}
+	for _, nodeDir := range nodeDirs {
+		if err := gc.verifyDir(nodeDir, stats, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDir checks the files in the directory of the node on one disk
+func (gc *GarbageCollector) verifyDir(nodeDir string, stats *CleanupStats, checked func()) error {
 	if _, err := os.Stat(nodeDir); os.IsNotExist(err) {
 		return nil // No files to check
 	}
 
-	err = filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			gc.logger.Warn("walk error", "node", gc.nodeID, "path", path, "err", err)
 			return nil // Skip errors
@@ -149,29 +383,38 @@ func (gc *GarbageCollector) verifyIntegrity(stats *CleanupStats) error {
 			return nil
 		}
 
-		// Calculate actual hash of file content
-		actualHash, err := calculateFileHash(path)
+		intact, err := gc.verify(expectedHash, path)
 		if err != nil {
-			gc.logger.Warn("Failed to calculate hash", "node", gc.nodeID, "path", path, "err", err)
+			gc.logger.Warn("Failed to verify file", "node", gc.nodeID, "path", path, "err", err)
+			stats.UncheckedFiles++
 			return nil
 		}
 
-		// Compare hashes
-		if actualHash != expectedHash {
-			gc.logger.Error("INTEGRITY VIOLATION: File has incorrect hash",
+		stats.CheckedFiles++
+		if checked != nil {
+			checked()
+		}
+
+		if !intact {
+			gc.logger.Error("INTEGRITY VIOLATION: File content does not match",
 				"node", gc.nodeID,
 				"path", path,
-				"expected", expectedHash,
-				"actual", actualHash,
+				"hash", expectedHash,
 			)
 			stats.CorruptedFiles++
+			gc.report("corrupted", path)
 
-			// Remove corrupted file
-			if err := os.RemoveAll(filepath.Dir(path)); err != nil {
-				gc.logger.Error("Failed to remove corrupted file", "node", gc.nodeID, "path", path, "err", err)
+			if gc.Held != nil && gc.Held(expectedHash) {
+				gc.logger.Warn("Keeping corrupted file under legal hold", "node", gc.nodeID, "path", path)
+				gc.report("held", path)
+				return nil
+			}
+
+			// Kept aside until a good copy replaces it
+			if err := gc.quarantine(filepath.Dir(nodeDir), expectedHash, path); err != nil {
+				gc.logger.Error("Failed to quarantine corrupted file", "node", gc.nodeID, "path", path, "err", err)
 			} else {
-				gc.logger.Info("Removed corrupted file", "node", gc.nodeID, "path", path)
-				stats.RemovedFiles++
+				gc.logger.Info("Quarantined corrupted file", "node", gc.nodeID, "path", path)
 			}
 		}
 
@@ -181,25 +424,95 @@ func (gc *GarbageCollector) verifyIntegrity(stats *CleanupStats) error {
 	return err
 }
 
+// expireFiles removes the files whose expiry has passed, except files under
+// legal hold
+func (gc *GarbageCollector) expireFiles(stats *CleanupStats) error {
+	files, err := gc.store.List(gc.nodeID)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Expires.IsZero() || time.Now().Before(f.Expires) {
+			continue
+		}
+		key, ok := gc.store.GetOriginalKey(f.Hash)
+		if !ok || gc.Held != nil && gc.Held(f.Hash) {
+			continue
+		}
+
+		if gc.Expire != nil {
+			err = gc.Expire(key)
+		} else {
+			err = gc.store.Delete(gc.nodeID, key)
+		}
+		if err != nil {
+			gc.logger.Warn("Failed to remove expired file", "node", gc.nodeID, "key", key, "err", err)
+			continue
+		}
+		gc.logger.Info("Removed expired file", "node", gc.nodeID, "key", key, "expired", f.Expires)
+		gc.report("expired", key)
+		stats.ExpiredFiles++
+		stats.RemovedFiles++
+	}
+	return nil
+}
+
 // cleanOrphanedFiles removes empty directories and temporary files
 func (gc *GarbageCollector) cleanOrphanedFiles(stats *CleanupStats) error {
 	gc.logger.Info("Cleaning orphaned files", "node", gc.nodeID)
 
-	nodeDir, err := gc.store.resolvePath(gc.nodeID, "")
+	nodeDirs, err := gc.store.nodeDirs(gc.nodeID)
 	if err != nil {
 		return err
 	}
+	for _, nodeDir := range nodeDirs {
+		if err := gc.cleanDir(nodeDir, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanDir removes the empty directories and abandoned temporary files of
+// the node on one disk
+func (gc *GarbageCollector) cleanDir(nodeDir string, stats *CleanupStats) error {
 	if _, err := os.Stat(nodeDir); os.IsNotExist(err) {
 		return nil
 	}
 
 	// Find and remove empty directories
-	err = filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			gc.logger.Warn("walk error", "node", gc.nodeID, "path", path, "err", err)
 			return nil
 		}
 
+		if !info.IsDir() && IsTempFile(info.Name()) && time.Since(info.ModTime()) > tempFileMaxAge {
+			gc.logger.Info("Removing abandoned temporary file", "node", gc.nodeID, "path", path)
+			if err := os.Remove(path); err != nil {
+				gc.logger.Error("Failed to remove abandoned temporary file", "node", gc.nodeID, "path", path, "err", err)
+			} else {
+				gc.report("orphaned", path)
+				stats.OrphanedFiles++
+				stats.RemovedFiles++
+			}
+			return nil
+		}
+
+		// A record written for a replica that never arrived
+		if !info.IsDir() && IsMetaFile(info.Name()) && gc.store.Backend == nil && time.Since(info.ModTime()) > tempFileMaxAge {
+			stored := strings.TrimSuffix(path, metaSuffix)
+			if !fileExists(stored) && !fileExists(stored+partialSuffix) {
+				gc.logger.Info("Removing orphaned metadata record", "node", gc.nodeID, "path", path)
+				if err := os.Remove(path); err == nil {
+					gc.report("orphaned", path)
+					stats.OrphanedFiles++
+					stats.RemovedFiles++
+				}
+			}
+			return nil
+		}
+
 		if info.IsDir() && path != nodeDir {
 			// Check if directory is empty
 			entries, err := os.ReadDir(path)
@@ -212,6 +525,7 @@ func (gc *GarbageCollector) cleanOrphanedFiles(stats *CleanupStats) error {
 				if err := os.Remove(path); err != nil {
 					gc.logger.Error("Failed to remove empty directory", "node", gc.nodeID, "path", path, "err", err)
 				} else {
+					gc.report("orphaned", path)
 					stats.OrphanedFiles++
 					stats.RemovedFiles++
 				}
@@ -224,6 +538,26 @@ func (gc *GarbageCollector) cleanOrphanedFiles(stats *CleanupStats) error {
 	return err
 }
 
+// verify checks the file at path, stored under the hashed name hash, with
+// Verify if set, or else by hashing its content
+func (gc *GarbageCollector) verify(hash string, path string) (bool, error) {
+	if gc.Verify != nil {
+		return gc.Verify(hash, path)
+	}
+	actualHash, err := calculateFileHash(path)
+	if err != nil {
+		return false, err
+	}
+	return actualHash == hash, nil
+}
+
+// report passes a finding to OnFinding, if set
+func (gc *GarbageCollector) report(kind string, path string) {
+	if gc.OnFinding != nil {
+		gc.OnFinding(kind, path)
+	}
+}
+
 // calculateFileHash computes the SHA-256 hash of a file
 func calculateFileHash(filePath string) (string, error) {
 	file, err := os.Open(filePath)
@@ -243,7 +577,7 @@ func calculateFileHash(filePath string) (string, error) {
 // VerifyFile checks if a specific file has valid integrity
 func (gc *GarbageCollector) VerifyFile(key string) (bool, error) {
 	pathKey := gc.store.PathTransformFunc(key)
-	fullPath, err := gc.store.resolvePath(gc.nodeID, pathKey.FullPath())
+	_, fullPath, err := gc.store.keyPath(gc.nodeID, key, "", false)
 	if err != nil {
 		return false, err
 	}
@@ -265,8 +599,15 @@ func (gc *GarbageCollector) VerifyFile(key string) (bool, error) {
 	return actualHash == expectedHash, nil
 }
 
-// GetStats returns current garbage collection statistics
+// GetStats returns the corrupted and orphaned files found by the last full
+// run and when it started, zero if the collector never ran
 func (gc *GarbageCollector) GetStats() (corrupted int, orphaned int, lastRun time.Time) {
-	// This is a simple implementation - in a real system you'd track these
-	return 0, 0, time.Now()
+	report, _ := gc.LastRun()
+	return report.Stats.CorruptedFiles, report.Stats.OrphanedFiles, report.Started
+}
+
+// fileExists reports whether there is a file at path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps stored files in memory. It suits tests and nodes
+// that only relay files for a while; everything is lost when it stops.
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile // by node ID and key
+}
+
+type memoryFile struct {
+	id      string
+	key     string
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryBackend returns an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{files: make(map[string]memoryFile)}
+}
+
+func memoryName(id string, key string) string {
+	return id + "/" + key
+}
+
+func (m *MemoryBackend) Write(id string, key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[memoryName(id, key)] = memoryFile{id: id, key: key, data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (m *MemoryBackend) Read(id string, key string) (int64, io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[memoryName(id, key)]
+	if !ok {
+		return 0, nil, fmt.Errorf("read %s: %w", key, os.ErrNotExist)
+	}
+	// Written files are replaced, never changed, so the data can be shared
+	return int64(len(f.data)), io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (m *MemoryBackend) Delete(id string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, memoryName(id, key))
+	return nil
+}
+
+func (m *MemoryBackend) Has(id string, key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.files[memoryName(id, key)]
+	return ok
+}
+
+func (m *MemoryBackend) List(id string) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var files []FileInfo
+	for _, f := range m.files {
+		if id == "" || f.id == id {
+			files = append(files, f.info())
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return memoryName(files[i].NodeID, files[i].Key) < memoryName(files[j].NodeID, files[j].Key)
+	})
+	return files, nil
+}
+
+func (m *MemoryBackend) Stat(id string, key string) (FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[memoryName(id, key)]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
+	}
+	return f.info(), nil
+}
+
+func (f memoryFile) info() FileInfo {
+	return FileInfo{Key: f.key, Size: int64(len(f.data)), NodeID: f.id, ModTime: f.modTime}
+}
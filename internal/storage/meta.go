@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metaSuffix marks the metadata record kept next to each stored file. It
+// holds what cannot be read off the file itself: when it was first stored,
+// its content type and the tags set on it. With a backend, the records stay
+// on local disk like the key map.
+const metaSuffix = ".meta"
+
+// defaultContentType is the content type of files nothing more is known of
+const defaultContentType = "application/octet-stream"
+
+// IsMetaFile reports whether a file name belongs to a metadata record
+func IsMetaFile(name string) bool {
+	return strings.HasSuffix(name, metaSuffix)
+}
+
+// objectMeta is the metadata record of a stored file
+type objectMeta struct {
+	Created     time.Time         `json:"created"`
+	ContentType string            `json:"content_type,omitempty"`
+	ContentHash string            `json:"content_hash,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Version     int               `json:"version,omitempty"` // number of the current version, see versions.go
+	Expires     time.Time         `json:"expires,omitzero"`  // when the garbage collector removes the file, zero for never
+}
+
+// apply copies the record into info
+func (m objectMeta) apply(info FileInfo) FileInfo {
+	info.Created = m.Created
+	info.ContentType = m.ContentType
+	info.ContentHash = m.ContentHash
+	info.Tags = m.Tags
+	info.Expires = m.Expires
+	if info.Created.IsZero() {
+		info.Created = info.ModTime // stored before records were kept
+	}
+	if info.ContentType == "" {
+		info.ContentType = contentTypeOf(info.Key, nil)
+	}
+	return info
+}
+
+// contentTypeOf guesses the content type of a key from its extension, or
+// from the first bytes of its content if the extension is unknown
+func contentTypeOf(key string, head []byte) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	if len(head) > 0 {
+		return http.DetectContentType(head)
+	}
+	return defaultContentType
+}
+
+// readMeta reads the metadata record of the stored file at path
+func (s *Store) readMeta(path string) (objectMeta, bool) {
+	data, err := os.ReadFile(path + metaSuffix)
+	if err != nil {
+		return objectMeta{}, false
+	}
+	if data, err = s.OpenRecord(data); err != nil {
+		return objectMeta{}, false
+	}
+	var m objectMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return objectMeta{}, false
+	}
+	return m, true
+}
+
+// writeMeta replaces the metadata record of the stored file at path
+// atomically, so a crash leaves either the old or the new one
+func (s *Store) writeMeta(path string, m objectMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if data, err = s.SealRecord(data); err != nil {
+		return err
+	}
+	f, err := createTemp(path + metaSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return f.finish(err)
+}
+
+// metaPath returns the path of the stored file of a key, which its record
+// is kept next to
+func (s *Store) metaPath(id string, key string) (string, error) {
+	_, path, err := s.keyPath(id, key, metaSuffix, false)
+	return strings.TrimSuffix(path, metaSuffix), err
+}
+
+// recordWrite updates the metadata record of a file just written to path
+// as its version number version, keeping when it was first stored and its
+// tags. An empty contentType is guessed from the key.
+func (s *Store) recordWrite(key string, path string, contentHash string, contentType string, version int) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	m, ok := s.readMeta(path)
+	if !ok {
+		m.Created = time.Now()
+	}
+	if contentType == "" {
+		contentType = contentTypeOf(key, nil)
+	}
+	m.ContentType = contentType
+	m.ContentHash = contentHash
+	m.Version = version
+	return s.writeMeta(path, m)
+}
+
+// SetTags replaces the user-defined tags of a stored file. Tags are kept
+// by this node only; they are not sent along with replicas.
+func (s *Store) SetTags(id string, key string, tags map[string]string) error {
+	info, err := s.statFile(id, key)
+	if err != nil {
+		return err
+	}
+	path, err := s.metaPath(id, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	m, ok := s.readMeta(path)
+	if !ok {
+		m.Created = info.ModTime
+	}
+	m.Tags = nil
+	if len(tags) > 0 {
+		m.Tags = maps.Clone(tags)
+	}
+	return s.writeMeta(path, m)
+}
+
+// SetExpiry sets when the garbage collector removes a stored file, or
+// clears it if expires is zero. The record may be written before the file
+// is, so a replica being fetched expires with the original.
+func (s *Store) SetExpiry(id string, key string, expires time.Time) error {
+	path, err := s.metaPath(id, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	m, ok := s.readMeta(path)
+	if !ok && expires.IsZero() {
+		return nil
+	}
+	if !ok {
+		m.Created = time.Now()
+	}
+	m.Expires = expires
+	return s.writeMeta(path, m)
+}
+
+// Expiry returns when a stored file expires, zero if it does not
+func (s *Store) Expiry(id string, key string) time.Time {
+	path, err := s.metaPath(id, key)
+	if err != nil {
+		return time.Time{}
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	m, _ := s.readMeta(path)
+	return m.Expires
+}
+
+// withMeta adds the metadata record of a key to info. A content hash the
+// record lacks, for files received in pieces or stored before records were
+// kept, is computed and recorded.
+func (s *Store) withMeta(id string, key string, info FileInfo) (FileInfo, error) {
+	path, err := s.metaPath(id, key)
+	if err != nil {
+		return info, err
+	}
+	s.metaMu.Lock()
+	m, _ := s.readMeta(path)
+	s.metaMu.Unlock()
+	info = m.apply(info)
+	if info.ContentHash != "" {
+		return info, nil
+	}
+
+	if info.ContentHash, err = s.ContentHash(id, key); err != nil {
+		return info, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return info, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	// Tags may have been set meanwhile
+	m, ok := s.readMeta(path)
+	if !ok {
+		m.Created = info.Created
+	}
+	m.ContentHash = info.ContentHash
+	return info, s.writeMeta(path, m)
+}
+
+// sniffer keeps the first bytes read through it, for detecting the content
+// type of files whose key has no known extension
+type sniffer struct {
+	r    io.Reader
+	head []byte
+}
+
+func (s *sniffer) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if room := 512 - len(s.head); room > 0 {
+		s.head = append(s.head, p[:min(n, room)]...)
+	}
+	return n, err
+}
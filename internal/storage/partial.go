@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partialSuffix marks a file that is still being received from a peer.
+// Partial files live next to their final path so a rename commits them.
+const partialSuffix = ".part"
+
+// rangesSuffix marks the record of which chunks of a sparse partial file
+// are on disk
+const rangesSuffix = ".ranges"
+
+// IsPartialFile reports whether a file name belongs to an unfinished transfer
+func IsPartialFile(name string) bool {
+	return strings.HasSuffix(name, partialSuffix) ||
+		strings.HasSuffix(name, partialSuffix+rangesSuffix) ||
+		strings.HasSuffix(name, partialSuffix+rangesSuffix+".tmp")
+}
+
+// PartialRanges records which chunks of a partial file written with
+// WritePartialAt are on disk, so a download interrupted at any point, even
+// by a crash, resumes without fetching them again. It takes one bit per
+// chunk, about 12KB for a 100GB file in 1MB chunks.
+type PartialRanges struct {
+	Size      int64  `json:"size"`       // total size of the file
+	Base      int64  `json:"base"`       // bytes before the first chunk, received in one piece
+	ChunkSize int64  `json:"chunk_size"` // size of every chunk but the last
+	Done      []byte `json:"done"`       // bitmap of the chunks on disk
+}
+
+// NewPartialRanges returns ranges with no chunk on disk yet
+func NewPartialRanges(size, base, chunkSize int64) PartialRanges {
+	r := PartialRanges{Size: size, Base: base, ChunkSize: chunkSize}
+	r.Done = make([]byte, (r.Count()+7)/8)
+	return r
+}
+
+// Count returns the number of chunks after Base
+func (r PartialRanges) Count() int {
+	if r.ChunkSize <= 0 || r.Size <= r.Base {
+		return 0
+	}
+	return int((r.Size - r.Base + r.ChunkSize - 1) / r.ChunkSize)
+}
+
+// Has reports whether chunk i is on disk
+func (r PartialRanges) Has(i int) bool {
+	return i >= 0 && i/8 < len(r.Done) && r.Done[i/8]&(1<<(i%8)) != 0
+}
+
+// Set marks chunk i as on disk
+func (r PartialRanges) Set(i int) {
+	r.Done[i/8] |= 1 << (i % 8)
+}
+
+// Contiguous returns the length of the prefix of the file that is on disk
+func (r PartialRanges) Contiguous() int64 {
+	n := r.Base
+	for i := 0; i < r.Count() && r.Has(i); i++ {
+		n += r.ChunkSize
+	}
+	return min(n, r.Size)
+}
+
+// valid reports whether the ranges are consistent with themselves
+func (r PartialRanges) valid() bool {
+	return r.ChunkSize > 0 && r.Base >= 0 && r.Size >= r.Base && len(r.Done) == (r.Count()+7)/8
+}
+
+// partialPath returns the on-disk path of the partial file for a key
+func (s *Store) partialPath(id string, key string) (string, error) {
+	_, path, err := s.keyPath(id, key, partialSuffix, false)
+	return path, err
+}
+
+// PartialSize returns how many bytes of an interrupted transfer are already on disk.
+// It returns 0 if no partial file exists for the key. For a sparse partial
+// file only the prefix without holes counts.
+func (s *Store) PartialSize(id string, key string) int64 {
+	path, err := s.partialPath(id, key)
+	if err != nil {
+		return 0
+	}
+	if r, ok := s.LoadPartialRanges(id, key); ok {
+		return r.Contiguous()
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// WritePartial appends data received at the given offset to the partial file of a key.
+// An offset of 0 starts a fresh transfer. Any other offset must match the size of the
+// existing partial file, otherwise the data would leave a gap or overlap.
+func (s *Store) WritePartial(id string, key string, offset int64, r io.Reader) (int64, error) {
+	d, path, err := s.keyPath(id, key, partialSuffix, true)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	} else if have := s.PartialSize(id, key); have != offset {
+		return 0, fmt.Errorf("resume offset %d does not match partial size %d", offset, have)
+	} else {
+		flags |= os.O_APPEND
+		// Chunks past the prefix of a sparse file would end up before the
+		// appended data, so they are dropped
+		if _, ok := s.LoadPartialRanges(id, key); ok {
+			if err := os.Truncate(path, offset); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := s.DiscardPartialRanges(id, key); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s.rememberKey(key)
+
+	n, err := io.Copy(f, r)
+	d.used.Add(n)
+	return n, err
+}
+
+// CommitPartial promotes a completed partial file to its final location
+func (s *Store) CommitPartial(id string, key string) error {
+	path, err := s.partialPath(id, key)
+	if err != nil {
+		return err
+	}
+	// The final file goes on the same disk, so the rename does not copy
+	finalPath := strings.TrimSuffix(path, partialSuffix)
+	current := s.currentVersion(finalPath)
+	if s.Backend != nil {
+		err = s.upload(id, key, path)
+	} else {
+		var version string
+		if version, err = s.keepVersion(finalPath, current); err == nil {
+			if err = os.Rename(path, finalPath); err != nil && version != "" {
+				os.Remove(version)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// The content hash is computed when it is first asked for
+	_ = s.recordWrite(key, finalPath, "", "", current+1)
+	return s.DiscardPartialRanges(id, key)
+}
+
+// OpenPartial opens the partial file of a key for reading, e.g. to check a
+// completed transfer before CommitPartial
+func (s *Store) OpenPartial(id string, key string) (*os.File, error) {
+	path, err := s.partialPath(id, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// DiscardPartial removes the partial file of a key, if any
+func (s *Store) DiscardPartial(id string, key string) error {
+	path, err := s.partialPath(id, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.DiscardPartialRanges(id, key)
+}
+
+// WritePartialAt writes a byte range of a key at offset into its partial file.
+// Unlike WritePartial it may leave holes, so ranges received from several
+// peers can land in any order. Callers track which ranges are complete and
+// record them with SavePartialRanges before the first write, otherwise a
+// restart would take the holes for data.
+func (s *Store) WritePartialAt(id string, key string, offset int64, r io.Reader) (int64, error) {
+	d, path, err := s.keyPath(id, key, partialSuffix, true)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s.rememberKey(key)
+
+	n, err := io.Copy(io.NewOffsetWriter(f, offset), r)
+	d.used.Add(n)
+	return n, err
+}
+
+// TruncatePartial cuts the partial file of a key down to size bytes.
+// It is used to drop a sparse tail so that PartialSize again marks
+// the first missing byte.
+func (s *Store) TruncatePartial(id string, key string, size int64) error {
+	path, err := s.partialPath(id, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(path, size); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rangesPath returns the on-disk path of the chunk record of a partial file
+func (s *Store) rangesPath(id string, key string) (string, error) {
+	path, err := s.partialPath(id, key)
+	if err != nil {
+		return "", err
+	}
+	return path + rangesSuffix, nil
+}
+
+// SavePartialRanges records which chunks of the partial file of a key are
+// on disk. The record is replaced atomically, so a crash leaves either the
+// old or the new one.
+func (s *Store) SavePartialRanges(id string, key string, r PartialRanges) error {
+	_, path, err := s.keyPath(id, key, partialSuffix, true)
+	if err != nil {
+		return err
+	}
+	path += rangesSuffix
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadPartialRanges returns the chunks recorded for the partial file of a
+// key. It returns false if there is no usable record or no partial file.
+func (s *Store) LoadPartialRanges(id string, key string) (PartialRanges, bool) {
+	path, err := s.rangesPath(id, key)
+	if err != nil {
+		return PartialRanges{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PartialRanges{}, false
+	}
+	var r PartialRanges
+	if err := json.Unmarshal(data, &r); err != nil || !r.valid() {
+		return PartialRanges{}, false
+	}
+	if _, err := os.Stat(strings.TrimSuffix(path, rangesSuffix)); err != nil {
+		return PartialRanges{}, false
+	}
+	return r, true
+}
+
+// DiscardPartialRanges deletes the chunk record of a key, if any
+func (s *Store) DiscardPartialRanges(id string, key string) error {
+	path, err := s.rangesPath(id, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
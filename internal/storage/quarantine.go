@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// quarantineDir is the directory on each disk corrupted files are moved to
+// by the garbage collector, next to the directories of the node IDs, until
+// a good copy is fetched or they are given up on. Each file gets an entry
+// directory named after its hash, holding the file and an entry record.
+const quarantineDir = ".quarantine"
+
+// quarantineRecord names the entry record in an entry directory
+const quarantineRecord = "entry.json"
+
+// defaultRepairAttempts is how many times a quarantined file is repaired
+// before it is given up on, if GarbageCollector.RepairAttempts is not set
+const defaultRepairAttempts = 3
+
+// QuarantineEntry describes a corrupted file kept in quarantine
+type QuarantineEntry struct {
+	Hash        string    `json:"hash"`
+	Key         string    `json:"key,omitempty"` // empty if the original key is unknown
+	Quarantined time.Time `json:"quarantined"`
+	Attempts    int       `json:"attempts"` // failed repairs
+	LastError   string    `json:"last_error,omitempty"`
+	dir         string
+}
+
+// saveQuarantineEntry writes the record of an entry
+func (s *Store) saveQuarantineEntry(e QuarantineEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if data, err = s.SealRecord(data); err != nil {
+		return err
+	}
+	f, err := createTemp(filepath.Join(e.dir, quarantineRecord))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return f.finish(err)
+}
+
+// quarantine moves the corrupted file at path, in the directory of the
+// node on the disk at root, into quarantine. A file quarantined before
+// keeps its failed repairs.
+func (gc *GarbageCollector) quarantine(root string, hash string, path string) error {
+	dir, err := gc.store.resolveIn(filepath.Join(root, quarantineDir), gc.nodeID, hash)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	entry, ok := gc.store.readQuarantineEntry(dir)
+	if !ok {
+		entry = QuarantineEntry{Hash: hash, dir: dir}
+	}
+	entry.Key, _ = gc.store.GetOriginalKey(hash)
+	entry.Quarantined = time.Now()
+	if err := os.Rename(path, filepath.Join(dir, hash)); err != nil {
+		return err
+	}
+	return gc.store.saveQuarantineEntry(entry)
+}
+
+// readQuarantineEntry reads the entry record in an entry directory
+func (s *Store) readQuarantineEntry(dir string) (QuarantineEntry, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, quarantineRecord))
+	if err != nil {
+		return QuarantineEntry{}, false
+	}
+	if data, err = s.OpenRecord(data); err != nil {
+		return QuarantineEntry{}, false
+	}
+	var entry QuarantineEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return QuarantineEntry{}, false
+	}
+	entry.dir = dir
+	return entry, true
+}
+
+// ListQuarantine returns the corrupted files of a node ID in quarantine,
+// most recently quarantined first
+func (s *Store) ListQuarantine(id string) ([]QuarantineEntry, error) {
+	var entries []QuarantineEntry
+	for _, d := range s.disks {
+		if d.State() == DiskMissing {
+			continue
+		}
+		dir, err := s.resolveIn(filepath.Join(d.Path, quarantineDir), id, "")
+		if err != nil {
+			return nil, err
+		}
+		dirEntries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range dirEntries {
+			if entry, ok := s.readQuarantineEntry(filepath.Join(dir, e.Name())); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	slices.SortFunc(entries, func(a, b QuarantineEntry) int { return b.Quarantined.Compare(a.Quarantined) })
+	return entries, nil
+}
+
+// repairQuarantined tries to replace every quarantined file with a good
+// copy through Repair. A file stored again meanwhile leaves quarantine; one
+// whose repair failed RepairAttempts times is removed for good.
+func (gc *GarbageCollector) repairQuarantined(stats *CleanupStats) error {
+	entries, err := gc.store.ListQuarantine(gc.nodeID)
+	if err != nil {
+		return err
+	}
+	attempts := gc.RepairAttempts
+	if attempts <= 0 {
+		attempts = defaultRepairAttempts
+	}
+
+	for _, entry := range entries {
+		if entry.Key != "" && gc.store.Has(gc.nodeID, entry.Key) {
+			// Stored again, e.g. by a replica; the next run checks the new copy
+			gc.release(entry, stats)
+			continue
+		}
+
+		err := os.ErrNotExist // no key to fetch the file by
+		if entry.Key != "" && gc.Repair != nil {
+			err = gc.Repair(entry.Key)
+		}
+		if err == nil {
+			gc.logger.Info("Repaired corrupted file", "node", gc.nodeID, "key", entry.Key)
+			gc.report("repaired", entry.Key)
+			stats.RepairedFiles++
+			gc.release(entry, stats)
+			continue
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if entry.Attempts < attempts {
+			gc.logger.Warn("Failed to repair quarantined file", "node", gc.nodeID, "hash", entry.Hash, "key", entry.Key, "attempt", entry.Attempts, "err", err)
+			if err := gc.store.saveQuarantineEntry(entry); err != nil {
+				gc.logger.Error("Failed to update quarantine entry", "node", gc.nodeID, "hash", entry.Hash, "err", err)
+			}
+			continue
+		}
+		gc.logger.Error("Giving up on quarantined file", "node", gc.nodeID, "hash", entry.Hash, "key", entry.Key, "attempts", entry.Attempts, "err", err)
+		if err := os.RemoveAll(entry.dir); err != nil {
+			gc.logger.Error("Failed to remove quarantined file", "node", gc.nodeID, "hash", entry.Hash, "err", err)
+			continue
+		}
+		gc.report("discarded", filepath.Join(entry.dir, entry.Hash))
+		stats.RemovedFiles++
+	}
+	return nil
+}
+
+// release removes a quarantine entry whose file was replaced
+func (gc *GarbageCollector) release(entry QuarantineEntry, stats *CleanupStats) {
+	if err := os.RemoveAll(entry.dir); err != nil {
+		gc.logger.Error("Failed to remove quarantined file", "node", gc.nodeID, "hash", entry.Hash, "err", err)
+		return
+	}
+	stats.RemovedFiles++
+}
+
+// repairMissing fetches the files Expected lists that are not stored
+// through Repair, leaving quarantined ones to repairQuarantined. A file
+// whose repair failed RepairAttempts times is not tried again until the
+// node restarts.
+func (gc *GarbageCollector) repairMissing(stats *CleanupStats) error {
+	if gc.Expected == nil || gc.Repair == nil {
+		return nil
+	}
+	attempts := gc.RepairAttempts
+	if attempts <= 0 {
+		attempts = defaultRepairAttempts
+	}
+	entries, err := gc.store.ListQuarantine(gc.nodeID)
+	if err != nil {
+		return err
+	}
+	quarantined := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		quarantined[entry.Key] = true
+	}
+
+	for _, key := range gc.Expected() {
+		if gc.store.Has(gc.nodeID, key) {
+			delete(gc.missing, key)
+			continue
+		}
+		if quarantined[key] || gc.missing[key] >= attempts {
+			continue
+		}
+		stats.MissingFiles++
+		gc.report("missing", key)
+
+		if err := gc.Repair(key); err != nil {
+			gc.missing[key]++
+			if gc.missing[key] < attempts {
+				gc.logger.Warn("Failed to repair missing file", "node", gc.nodeID, "key", key, "attempt", gc.missing[key], "err", err)
+			} else {
+				gc.logger.Error("Giving up on missing file", "node", gc.nodeID, "key", key, "attempts", gc.missing[key], "err", err)
+			}
+			continue
+		}
+		gc.logger.Info("Repaired missing file", "node", gc.nodeID, "key", key)
+		gc.report("repaired", key)
+		stats.RepairedFiles++
+		delete(gc.missing, key)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+)
+
+// sealedPrefix starts every record sealed with the metadata key, telling
+// it from the plain JSON records written without one
+var sealedPrefix = []byte("pvsealed1:")
+
+// SealRecord encrypts a record naming stored files, such as the key map, a
+// metadata record or a trash entry, with the metadata key of the store.
+// Without a metadata key it is returned as it is.
+func (s *Store) SealRecord(data []byte) ([]byte, error) {
+	if s.MetaKey == nil {
+		return data, nil
+	}
+	sealed, err := crypto.Seal(s.MetaKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes.Clone(sealedPrefix), sealed...), nil
+}
+
+// OpenRecord decrypts a record written by SealRecord. Plain records,
+// written without a metadata key or before one was set, are returned as
+// they are and sealed when next written.
+func (s *Store) OpenRecord(data []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(data, sealedPrefix)
+	if !ok {
+		return data, nil
+	}
+	if s.MetaKey == nil {
+		return nil, errors.New("record is sealed but the store has no metadata key")
+	}
+	return crypto.Unseal(s.MetaKey, sealed)
+}
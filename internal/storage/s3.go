@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// S3Options configures an S3Backend
+type S3Options struct {
+	Endpoint  string // e.g. http://localhost:9000 for minio, AWS in Region if empty
+	Region    string // us-east-1 if empty
+	Bucket    string
+	Prefix    string // prepended to every object name, so nodes can share a bucket
+	AccessKey string
+	SecretKey string
+	Client    *http.Client // http.DefaultClient if nil
+}
+
+// S3Backend keeps stored files as objects in an S3 bucket, or in any
+// service speaking the S3 API such as minio, for nodes that want more
+// capacity than their disks have. Objects are named prefix/<node ID>/<key>
+// and addressed path-style, which every S3-compatible service supports.
+// Requests are signed with AWS Signature Version 4.
+type S3Backend struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Backend returns a backend storing files in opts.Bucket
+func NewS3Backend(opts S3Options) (*S3Backend, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("S3 backend needs a bucket")
+	}
+	if opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, errors.New("S3 backend needs an access key and a secret key")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = "https://s3." + opts.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", opts.Endpoint, err)
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Backend{opts: opts, endpoint: endpoint, client: client}, nil
+}
+
+// object returns the name of the object of a key
+func (b *S3Backend) object(id string, key string) string {
+	return path.Join(b.opts.Prefix, id, key)
+}
+
+func (b *S3Backend) Write(id string, key string, r io.Reader) (int64, error) {
+	// A PUT needs the length up front
+	f, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "peervault-s3-*"+tempSuffix)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return 0, err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		f = tmp
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.do(http.MethodPut, b.object(id, key), nil, f, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return info.Size(), nil
+}
+
+func (b *S3Backend) Read(id string, key string) (int64, io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, b.object(id, key), nil, nil, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.ContentLength, resp.Body, nil
+}
+
+func (b *S3Backend) Delete(id string, key string) error {
+	resp, err := b.do(http.MethodDelete, b.object(id, key), nil, nil, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) Has(id string, key string) bool {
+	_, err := b.Stat(id, key)
+	return err == nil
+}
+
+func (b *S3Backend) Stat(id string, key string) (FileInfo, error) {
+	resp, err := b.do(http.MethodHead, b.object(id, key), nil, nil, 0)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Key: key, Size: resp.ContentLength, NodeID: id, ModTime: modTime}, nil
+}
+
+// listResult is the part of a ListObjectsV2 response the backend reads
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (b *S3Backend) List(id string) ([]FileInfo, error) {
+	prefix := b.object(id, "") + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	var files []FileInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := b.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return files, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return files, fmt.Errorf("invalid S3 listing: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, b.opts.Prefix+"/")
+			if b.opts.Prefix == "" {
+				name = obj.Key
+			}
+			nodeID, key, ok := strings.Cut(name, "/")
+			if !ok {
+				continue // not written by a backend
+			}
+			files = append(files, FileInfo{Key: key, Size: obj.Size, NodeID: nodeID, ModTime: obj.LastModified})
+		}
+		if !result.IsTruncated {
+			return files, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for an object, or for the bucket if object is
+// empty. A missing object is reported as an error wrapping os.ErrNotExist.
+func (b *S3Backend) do(method string, object string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.opts.Bucket + "/" + object
+	// S3 expects spaces encoded as %20 in the signed query
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	b.sign(req, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %w", method, object, os.ErrNotExist)
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, object, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 to req. The payload is not part of
+// the signature, so bodies are streamed without hashing them first.
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + b.opts.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + b.opts.SecretKey)
+	for _, part := range []string{date, b.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.opts.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves the few S3 requests the backend sends, from memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // by object name, without the bucket
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") || r.Header.Get("x-amz-date") == "" {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		type object struct {
+			Key          string
+			Size         int
+			LastModified time.Time
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []object
+		}
+		for key, data := range f.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, object{Key: key, Size: len(data), LastModified: time.Now()})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			http.Error(w, "length mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = data
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		data, ok := f.objects[name]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	b, err := NewS3Backend(S3Options{Endpoint: server.URL, Bucket: "bucket", Prefix: "vault", AccessKey: "AK", SecretKey: "SK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write("node1", "hash1", strings.NewReader("hello s3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["vault/node1/hash1"]; !ok {
+		t.Fatalf("expected object vault/node1/hash1, have %v", fake.objects)
+	}
+	if _, err := b.Write("node2", "hash2", strings.NewReader("other node")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, r, err := b.Read("node1", "hash1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if n != 8 || string(data) != "hello s3" {
+		t.Errorf("want 8 bytes of hello s3, have %d of %q", n, data)
+	}
+	info, err := b.Stat("node1", "hash1")
+	if err != nil || info.Size != 8 || info.ModTime.IsZero() {
+		t.Errorf("unexpected stat %+v (%v)", info, err)
+	}
+
+	files, err := b.List("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Key != "hash1" || files[0].NodeID != "node1" || files[0].Size != 8 {
+		t.Errorf("unexpected listing %+v", files)
+	}
+	if files, _ := b.List(""); len(files) != 2 {
+		t.Errorf("want 2 files across nodes, have %d", len(files))
+	}
+
+	if err := b.Delete("node1", "hash1"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Has("node1", "hash1") {
+		t.Errorf("expected the object to be deleted")
+	}
+	if _, _, err := b.Read("node1", "hash1"); err == nil {
+		t.Errorf("expected reading a deleted object to fail")
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -10,8 +11,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
 )
@@ -30,12 +33,42 @@ type PathTransformFunc func(string) PathKey
 type StoreOpts struct {
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// Disks files are spread over, see disks.go. The key map stays in Root.
+	// Without disks, files are stored in Root.
+	Disks []Disk
+	// Picks the disk of each file, RendezvousShardFunc if nil
+	ShardFunc ShardFunc
+	// Holds completed files instead of the disks, see backend.go. The
+	// disks still hold transfers in progress and writes being staged.
+	Backend Backend
+	// Compresses files written with WriteEncrypt before they are
+	// encrypted, see compress.go
+	Compression Compression
+	// Keeps earlier versions of files written again, see versions.go.
+	// Without it files are overwritten. Not supported with a Backend.
+	Versions *VersionRetention
+	// How long deleted files are kept in the trash, see trash.go. Without
+	// it files are deleted at once. Not supported with a Backend.
+	Trash time.Duration
+	// Encrypts in WriteEncrypt with crypto.CopyEncryptConvergent, so files
+	// of the same content under the same key are stored as the same bytes.
+	// Only the IV is derived from the content, not the key.
+	Convergent bool
+	// The cipher WriteEncrypt encrypts with, crypto.AES256CTR if zero. Files
+	// of every cipher are read back, whichever this is.
+	Cipher crypto.Suite
+	// Encrypts the records naming stored files, see records.go: the key
+	// map and the metadata, trash and quarantine records. Without it they
+	// are plain JSON.
+	MetaKey []byte
 }
 
 type Store struct {
 	StoreOpts                   // Embeds StoreOpts (inherits its fields)
 	keyMap    map[string]string // Maps hash -> original key
 	keyMapMu  sync.RWMutex      // Protects keyMap access
+	metaMu    sync.Mutex        // Serializes updates of metadata records
+	disks     []*disk
 }
 
 // Generates a unique directory structure and filename for a given key using a SHA-256 hash.
@@ -95,6 +128,7 @@ func NewStore(opts StoreOpts) *Store {
 	s := &Store{
 		StoreOpts: opts,
 		keyMap:    make(map[string]string),
+		disks:     openDisks(opts),
 	}
 
 	// Load keys if they exist on disk
@@ -117,11 +151,13 @@ func ValidateNodeID(id string) error {
 	return nil
 }
 
-func (s *Store) resolvePath(id string, subpath string) (string, error) {
+// resolveIn returns the path of subpath in the directory of a node ID on
+// the disk at root
+func (s *Store) resolveIn(root string, id string, subpath string) (string, error) {
 	if err := ValidateNodeID(id); err != nil {
 		return "", err
 	}
-	cleanRoot := filepath.Clean(s.Root)
+	cleanRoot := filepath.Clean(root)
 	resolved := filepath.Join(cleanRoot, id, subpath)
 
 	// Ensure resolved path is under cleanRoot
@@ -134,8 +170,10 @@ func (s *Store) resolvePath(id string, subpath string) (string, error) {
 
 // checks if a file exists in the store
 func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot, err := s.resolvePath(id, pathKey.FullPath())
+	if s.Backend != nil {
+		return s.Backend.Has(id, s.backendKey(key))
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
 	if err != nil {
 		return false
 	}
@@ -144,12 +182,123 @@ func (s *Store) Has(id string, key string) bool {
 	return !errors.Is(err, os.ErrNotExist)
 }
 
-// Clear deletes the entire storage root folder and its contents
+// Size returns the stored size of a file
+func (s *Store) Size(id string, key string) (int64, error) {
+	if s.Backend != nil {
+		info, err := s.Stat(id, key)
+		return info.Size, err
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(fullPathWithRoot)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ModTime returns when a file was last written
+func (s *Store) ModTime(id string, key string) (time.Time, error) {
+	if s.Backend != nil {
+		info, err := s.Stat(id, key)
+		return info.ModTime, err
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := os.Stat(fullPathWithRoot)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// ContentHash returns the hex SHA-256 of a file's stored bytes
+func (s *Store) ContentHash(id string, key string) (string, error) {
+	if s.Backend != nil {
+		return s.hashBackend(id, key)
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return "", err
+	}
+	return calculateFileHash(fullPathWithRoot)
+}
+
+// Clear deletes the entire storage root folder and its contents, and the
+// stored files on every disk
 func (s *Store) Clear() error {
+	if err := s.clearBackend(); err != nil {
+		return err
+	}
+	if err := s.clearDisks(); err != nil {
+		return err
+	}
 	return os.RemoveAll(s.Root)
 }
 
-// Delete removes a specific file and its associated directories
+// ClearFiles deletes the stored files of every node ID and the key map,
+// leaving the other files in the root folder, such as keys, in place
+func (s *Store) ClearFiles() error {
+	if err := s.clearBackend(); err != nil {
+		return err
+	}
+	if err := s.clearDisks(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.Root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := os.RemoveAll(filepath.Join(s.Root, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.keyMapMu.Lock()
+	s.keyMap = make(map[string]string)
+	s.keyMapMu.Unlock()
+	if err := os.Remove(filepath.Join(s.Root, "metadata.json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// clearDisks deletes the node directories on the configured disks. Other
+// directories on a disk, such as lost+found, are left alone.
+func (s *Store) clearDisks() error {
+	for _, d := range s.disks {
+		if len(s.Disks) == 0 || d.State() == DiskMissing {
+			continue
+		}
+		entries, err := os.ReadDir(d.Path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && (ValidateNodeID(entry.Name()) == nil || entry.Name() == trashDir || entry.Name() == quarantineDir) {
+				if err := os.RemoveAll(filepath.Join(d.Path, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Delete removes a specific file and its associated directories, on
+// whichever disks hold them, and from the backend
 func (s *Store) Delete(id string, key string) error {
 	pathKey := s.PathTransformFunc(key)
 
@@ -157,101 +306,202 @@ func (s *Store) Delete(id string, key string) error {
 		log.Printf("deleted [%s] from disk", pathKey.Filename)
 	}()
 
-	firstPathNameWithRoot, err := s.resolvePath(id, pathKey.FirstPathName())
-	if err != nil {
-		return err
+	if s.Backend != nil {
+		if err := s.Backend.Delete(id, pathKey.Filename); err != nil {
+			return err
+		}
 	}
 
-	return os.RemoveAll(firstPathNameWithRoot)
+	for _, d := range s.candidates(pathKey.Filename) {
+		if s.Trash > 0 && s.Backend == nil {
+			path, err := s.resolveIn(d.Path, id, pathKey.FullPath())
+			if err != nil {
+				return err
+			}
+			if err := s.moveToTrash(d.Path, id, key, path); err != nil {
+				return err
+			}
+		}
+		firstPathNameWithRoot, err := s.resolveIn(d.Path, id, pathKey.FirstPathName())
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(firstPathNameWithRoot); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	// Store the key mapping
+	s.rememberKey(key)
+
+	return s.writeStream(id, key, r)
+}
+
+// rememberKey records the hash -> original key mapping and persists it
+func (s *Store) rememberKey(key string) {
 	pathKey := s.PathTransformFunc(key)
 
 	s.keyMapMu.Lock()
+	if known, ok := s.keyMap[pathKey.Filename]; ok && known == key {
+		s.keyMapMu.Unlock()
+		return
+	}
 	s.keyMap[pathKey.Filename] = key
 	s.keyMapMu.Unlock()
 
 	_ = s.saveKeyMap()
-
-	return s.writeStream(id, key, r)
 }
 
 // writes encrypted data to a file
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	d, f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
 
 	n, err := crypto.CopyDecrypt(encKey, r, f)
-
-	return int64(n), err
+	return n, s.commitWrite(id, key, d, f, n, err, "")
 }
 
-// writes encrypted data to a file (encrypting on-the-fly)
+// writes encrypted data to a file (encrypting on-the-fly). The content is
+// compressed first if the store compresses files; readers of the
+// decrypted file get it back with Decompress.
 func (s *Store) WriteEncrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
 	// Store the key mapping
-	pathKey := s.PathTransformFunc(key)
-
-	s.keyMapMu.Lock()
-	s.keyMap[pathKey.Filename] = key
-	s.keyMapMu.Unlock()
-
-	_ = s.saveKeyMap()
+	s.rememberKey(key)
 
-	f, err := s.openFileForWriting(id, key)
+	d, f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
 
-	n, err := crypto.CopyEncrypt(encKey, r, f)
-
-	return int64(n), err
+	// The content type is detected before compression and encryption
+	sniff := &sniffer{r: r}
+	plain := compress(s.Compression, key, sniff)
+	defer plain.Close()
+	encrypt := s.Cipher.CopyEncrypt
+	if s.Convergent {
+		encrypt = s.Cipher.CopyEncryptConvergent
+	}
+	n, err := encrypt(encKey, plain, f)
+	return n, s.commitWrite(id, key, d, f, n, err, contentTypeOf(key, sniff.head))
 }
 
-// openFileForWriting ensures the necessary directories exist and opens the file
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot, err := s.resolvePath(id, pathKey.PathName)
+// openFileForWriting ensures the necessary directories exist and opens a
+// temporary file for the key on the disk it belongs on, moved to its final
+// path by finish
+func (s *Store) openFileForWriting(id string, key string) (*disk, *tempFile, error) {
+	d, fullPathWithRoot, err := s.keyPath(id, key, "", true)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+	if err := os.MkdirAll(filepath.Dir(fullPathWithRoot), os.ModePerm); err != nil {
+		return nil, nil, err
 	}
 
-	fullPathWithRoot, err := s.resolvePath(id, pathKey.FullPath())
-	if err != nil {
-		return nil, err
-	}
+	f, err := createTemp(fullPathWithRoot)
+	return d, f, err
+}
 
-	return os.Create(fullPathWithRoot)
+// commitWrite finishes the write of n bytes to f, which failed if err is
+// set. A complete file is moved to its final path, or to the backend, and
+// its metadata record is updated.
+func (s *Store) commitWrite(id string, key string, d *disk, f *tempFile, n int64, err error, contentType string) error {
+	current := s.currentVersion(f.path)
+	var version string
+	if err == nil {
+		version, err = s.keepVersion(f.path, current)
+	}
+	if err = f.finish(err); err != nil {
+		if version != "" {
+			os.Remove(version)
+		}
+		return err
+	}
+	_ = s.recordWrite(key, f.path, f.sum(), contentType, current+1)
+	if s.Backend != nil {
+		return s.upload(id, key, f.path)
+	}
+	d.used.Add(n)
+	return nil
 }
 
 // writes data from an io.Reader to the file
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	d, f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
 
-	return io.Copy(f, r)
+	sniff := &sniffer{r: r}
+	n, err := io.Copy(f, sniff)
+	return n, s.commitWrite(id, key, d, f, n, err, contentTypeOf(key, sniff.head))
 }
 
-func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
+func (s *Store) Read(id string, key string) (int64, io.ReadCloser, error) {
 	return s.readStream(id, key)
 }
 
+// Open opens a stored file for random access
+func (s *Store) Open(id string, key string) (*os.File, error) {
+	if s.Backend != nil {
+		return s.download(id, key)
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fullPathWithRoot)
+}
+
+// ReadRange returns length bytes of a stored file starting at offset, or
+// fewer if the file ends first, and how many bytes that is. The caller
+// closes the reader.
+func (s *Store) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return 0, nil, fmt.Errorf("invalid range %d+%d of %s", offset, length, key)
+	}
+	size, r, err := s.readStream(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset > size {
+		r.Close()
+		return 0, nil, fmt.Errorf("range %d+%d of %s beyond its size %d", offset, length, key, size)
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, r, offset)
+	}
+	if err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	n := min(length, size-offset)
+	return n, rangeReader{Reader: io.LimitReader(r, n), Closer: r}, nil
+}
+
+// rangeReader reads a range of a stored file and closes the whole file
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
 // readStream opens a file and returns its reader
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot, err := s.resolvePath(id, pathKey.FullPath())
+	if s.Backend != nil {
+		n, r, err := s.Backend.Read(id, s.backendKey(key))
+		if err != nil {
+			return 0, nil, err
+		}
+		return n, r, nil
+	}
+	_, fullPathWithRoot, err := s.keyPath(id, key, "", false)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -270,36 +520,74 @@ func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error)
 	return fileInfo.Size(), file, nil
 }
 
-// FileInfo represents information about a stored file
+// FileInfo represents information about a stored file. The fields from
+// Created on come from the file's metadata record, see meta.go.
 type FileInfo struct {
-	Key    string // Original file key
-	Hash   string // File hash (filename)
-	Size   int64  // File size in bytes
-	NodeID string // ID of the node that stored it
+	Key         string            `wire:"1"`  // Original file key
+	Hash        string            `wire:"2"`  // File hash (filename)
+	Size        int64             `wire:"3"`  // File size in bytes
+	NodeID      string            `wire:"4"`  // ID of the node that stored it
+	ModTime     time.Time         `wire:"5"`  // When the file was last written
+	Created     time.Time         `wire:"6"`  // When the file was first stored
+	ContentType string            `wire:"7"`  // MIME type, from the key or the content
+	ContentHash string            `wire:"8"`  // Hex SHA-256 of the stored bytes, if known
+	Tags        map[string]string `wire:"9"`  // User-defined tags
+	Expires     time.Time         `wire:"10"` // When the file is removed, zero for never
 }
 
-// List returns information about all files stored for a given node ID
+// List returns information about all files stored for a given node ID, or
+// for every node if id is empty
 func (s *Store) List(id string) ([]FileInfo, error) {
+	if s.Backend != nil {
+		return s.listBackend(id)
+	}
 	var files []FileInfo
+	if id == "" {
+		all, err := s.ListAll()
+		for _, nodeFiles := range all {
+			files = append(files, nodeFiles...)
+		}
+		return files, err
+	}
 
-	nodeDir, err := s.resolvePath(id, "")
+	nodeDirs, err := s.nodeDirs(id)
 	if err != nil {
 		return nil, err
 	}
+	for _, nodeDir := range nodeDirs {
+		if files, err = s.listDir(nodeDir, id, files); err != nil {
+			return files, err
+		}
+	}
 
+	// A file written again after its disk turned read-only is on two disks
+	if len(nodeDirs) > 1 {
+		seen := make(map[string]bool)
+		files = slices.DeleteFunc(files, func(f FileInfo) bool {
+			dup := seen[f.Hash]
+			seen[f.Hash] = true
+			return dup
+		})
+	}
+	return files, nil
+}
+
+// listDir appends the files in the directory of a node ID on one disk to files
+func (s *Store) listDir(nodeDir string, id string, files []FileInfo) ([]FileInfo, error) {
 	// Check if node directory exists
 	if _, err := os.Stat(nodeDir); os.IsNotExist(err) {
 		return files, nil // Return empty list if no files stored yet
 	}
 
 	// Walk through all files in the node's directory
-	err = filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// Skip directories, only process files
-		if info.IsDir() {
+		// Skip directories, unfinished transfers and writes, metadata
+		// records and earlier versions, only process files
+		if info.IsDir() || IsPartialFile(info.Name()) || IsTempFile(info.Name()) || IsMetaFile(info.Name()) || IsVersionFile(info.Name()) {
 			return nil
 		}
 
@@ -316,12 +604,14 @@ func (s *Store) List(id string) ([]FileInfo, error) {
 			originalKey = fmt.Sprintf("file_%s", hash[:8])
 		}
 
-		fileInfo := FileInfo{
-			Key:    originalKey,
-			Hash:   hash,
-			Size:   info.Size(),
-			NodeID: id,
-		}
+		meta, _ := s.readMeta(path)
+		fileInfo := meta.apply(FileInfo{
+			Key:     originalKey,
+			Hash:    hash,
+			Size:    info.Size(),
+			NodeID:  id,
+			ModTime: info.ModTime(),
+		})
 
 		files = append(files, fileInfo)
 		return nil
@@ -333,21 +623,36 @@ func (s *Store) List(id string) ([]FileInfo, error) {
 // ListAll returns information about all files stored across all nodes
 func (s *Store) ListAll() (map[string][]FileInfo, error) {
 	allFiles := make(map[string][]FileInfo)
-
-	// Check if root directory exists
-	if _, err := os.Stat(s.Root); os.IsNotExist(err) {
-		return allFiles, nil
+	if s.Backend != nil {
+		files, err := s.listBackend("")
+		for _, f := range files {
+			allFiles[f.NodeID] = append(allFiles[f.NodeID], f)
+		}
+		return allFiles, err
 	}
 
-	// Read all node directories
-	entries, err := os.ReadDir(s.Root)
-	if err != nil {
-		return allFiles, err
+	// Read all node directories, on every disk
+	var entries []os.DirEntry
+	for _, d := range s.disks {
+		if d.State() == DiskMissing {
+			continue
+		}
+		dirEntries, err := os.ReadDir(d.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return allFiles, err
+		}
+		entries = append(entries, dirEntries...)
 	}
 
 	for _, entry := range entries {
 		if entry.IsDir() {
 			nodeID := entry.Name()
+			if _, ok := allFiles[nodeID]; ok {
+				continue
+			}
 			files, err := s.List(nodeID)
 			if err != nil {
 				continue // Skip problematic directories
@@ -378,6 +683,11 @@ func (s *Store) ClearKeyMap() {
 	_ = s.saveKeyMap()
 }
 
+// Flush persists the key mapping
+func (s *Store) Flush() error {
+	return s.saveKeyMap()
+}
+
 func (s *Store) saveKeyMap() error {
 	s.keyMapMu.RLock()
 	defer s.keyMapMu.RUnlock()
@@ -391,6 +701,9 @@ func (s *Store) saveKeyMap() error {
 	if err != nil {
 		return err
 	}
+	if data, err = s.SealRecord(data); err != nil {
+		return err
+	}
 
 	return os.WriteFile(metadataPath, data, 0644)
 }
@@ -405,6 +718,13 @@ func (s *Store) loadKeyMap() error {
 	if err != nil {
 		return err
 	}
+	if s.MetaKey != nil && !bytes.HasPrefix(data, sealedPrefix) {
+		// Seals a key map written before the store had a metadata key
+		defer s.saveKeyMap()
+	}
+	if data, err = s.OpenRecord(data); err != nil {
+		return fmt.Errorf("failed to open key map: %w", err)
+	}
 
 	s.keyMapMu.Lock()
 	defer s.keyMapMu.Unlock()
@@ -2,9 +2,17 @@ package storage
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
 )
@@ -87,3 +95,999 @@ func teardown(t *testing.T, s *Store) {
 		t.Error(err)
 	}
 }
+
+func TestWritePartialResume(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	key := "resumable"
+	data := []byte("the first half|the second half")
+
+	if _, err := s.WritePartial(id, key, 0, bytes.NewReader(data[:15])); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, key) {
+		t.Errorf("partial transfer must not be visible as a stored file")
+	}
+	if have := s.PartialSize(id, key); have != 15 {
+		t.Fatalf("want partial size 15 have %d", have)
+	}
+
+	// A mismatched offset would leave a gap in the file
+	if _, err := s.WritePartial(id, key, 3, bytes.NewReader(data[3:])); err == nil {
+		t.Errorf("expected error for mismatched resume offset")
+	}
+
+	if _, err := s.WritePartial(id, key, 15, bytes.NewReader(data[15:])); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitPartial(id, key); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(b) != string(data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+	if have := s.PartialSize(id, key); have != 0 {
+		t.Errorf("expected partial file to be gone after commit, have %d bytes", have)
+	}
+}
+
+func TestGCKeepsHeldFiles(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	// Content never matches the hashed name, so both files look corrupted
+	for _, key := range []string{"held", "unheld"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("contents of "+key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc := NewGarbageCollector(s, id, time.Hour, time.Hour, nil)
+	held := CASPathTransformFunc("held").Filename
+	gc.Held = func(hash string) bool { return hash == held }
+	var findings []string
+	gc.OnFinding = func(kind string, path string) { findings = append(findings, kind) }
+	gc.performCleanup()
+
+	if !s.Has(id, "held") {
+		t.Errorf("garbage collector removed a file under legal hold")
+	}
+	if s.Has(id, "unheld") {
+		t.Errorf("expected corrupted file without hold to be removed")
+	}
+	if !slices.Contains(findings, "held") {
+		t.Errorf("expected a held finding, have %v", findings)
+	}
+}
+
+// failingReader returns an error after its data, like a dropped connection
+type failingReader struct{ r io.Reader }
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestAtomicWrite(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	// A write cut off midway leaves nothing under the key
+	if _, err := s.Write(id, "cut", failingReader{bytes.NewReader([]byte("half"))}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if s.Has(id, "cut") {
+		t.Errorf("failed write left a file under its key")
+	}
+
+	// and does not replace an earlier version
+	if _, err := s.Write(id, "kept", bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "kept", failingReader{bytes.NewReader([]byte("new"))}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	_, r, err := s.Read(id, "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(data) != "old" {
+		t.Errorf("want old, have %s", data)
+	}
+
+	// Temporary files left by a crash are collected once abandoned
+	_, path, err := s.keyPath(id, "kept", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, fresh := path+".1"+tempSuffix, path+".2"+tempSuffix
+	for _, p := range []string{abandoned, fresh} {
+		if err := os.WriteFile(p, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * tempFileMaxAge)
+	if err := os.Chtimes(abandoned, old, old); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("want 1 file listed, have %d", len(files))
+	}
+
+	gc := NewGarbageCollector(s, id, time.Hour, time.Hour, nil)
+	gc.integrityEnabled = false
+	if _, err := gc.RunNow(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Errorf("expected the abandoned temporary file to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("expected a write in progress to be left alone: %v", err)
+	}
+}
+
+func TestSparsePartialResume(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	// A 100GB file in 1MB chunks, of which only a few are on disk. The
+	// partial file is sparse, so the holes take no space.
+	const size, chunk = int64(100 << 30), int64(1 << 20)
+	key := "huge"
+	ranges := NewPartialRanges(size, 0, chunk)
+	if ranges.Count() != 102400 || len(ranges.Done) != 12800 {
+		t.Fatalf("want 102400 chunks in 12800 bytes, have %d in %d", ranges.Count(), len(ranges.Done))
+	}
+	if err := s.SavePartialRanges(id, key, ranges); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, 2, ranges.Count() - 1} {
+		offset := int64(i) * chunk
+		length := min(chunk, size-offset)
+		if _, err := s.WritePartialAt(id, key, offset, io.LimitReader(zeroReader{}, length)); err != nil {
+			t.Fatal(err)
+		}
+		ranges.Set(i)
+	}
+	if err := s.SavePartialRanges(id, key, ranges); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, ok := s.LoadPartialRanges(id, key)
+	if !ok {
+		t.Fatal("expected recorded ranges")
+	}
+	if !loaded.Has(ranges.Count()-1) || loaded.Has(3) {
+		t.Errorf("recorded chunks do not match the ones written")
+	}
+	// Only the prefix without holes counts for single stream resumes
+	if have := s.PartialSize(id, key); have != 3*chunk {
+		t.Errorf("want partial size %d have %d", 3*chunk, have)
+	}
+	for _, f := range mustList(t, s, id) {
+		t.Errorf("partial files must not be listed, have %s", f.Key)
+	}
+
+	// Resuming in a single stream drops the chunks past the prefix
+	if _, err := s.WritePartial(id, key, 3*chunk, bytes.NewReader([]byte("tail"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.LoadPartialRanges(id, key); ok {
+		t.Errorf("expected the chunk record to be gone after a single stream resume")
+	}
+	if have := s.PartialSize(id, key); have != 3*chunk+4 {
+		t.Errorf("want partial size %d have %d", 3*chunk+4, have)
+	}
+	if err := s.DiscardPartial(id, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// zeroReader returns endless zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func mustList(t *testing.T, s *Store, id string) []FileInfo {
+	files, err := s.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestClearFilesKeepsOtherFiles(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	if _, err := s.Write(id, "stored", bytes.NewReader([]byte("contents"))); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(s.Root, "identity.key")
+	if err := os.WriteFile(keyPath, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ClearFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "stored") {
+		t.Errorf("expected stored file to be gone")
+	}
+	if _, ok := s.GetOriginalKey(CASPathTransformFunc("stored").Filename); ok {
+		t.Errorf("expected key map to be cleared")
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		t.Errorf("expected files outside node directories to be kept: %v", err)
+	}
+}
+
+func TestStoreDisks(t *testing.T) {
+	root := t.TempDir()
+	disks := []Disk{
+		{Path: filepath.Join(root, "disk1")},
+		{Path: filepath.Join(root, "disk2")},
+		{Path: filepath.Join(root, "disk3")},
+	}
+	for _, d := range disks {
+		if err := os.Mkdir(d.Path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := StoreOpts{
+		Root:              filepath.Join(root, "meta"),
+		PathTransformFunc: CASPathTransformFunc,
+		Disks:             disks,
+	}
+	s := NewStore(opts)
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every disk gets a share of the files, and none is kept in the root
+	for _, d := range s.DiskUsage() {
+		if d.State != DiskOK || d.Used == 0 {
+			t.Errorf("expected files on disk %s, have %d bytes (%s)", d.Path, d.Used, d.State)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(opts.Root, id)); !os.IsNotExist(err) {
+		t.Errorf("expected no files in the root folder")
+	}
+	if files := mustList(t, s, id); len(files) != 30 {
+		t.Errorf("want 30 files listed, have %d", len(files))
+	}
+
+	// Partial files are committed on the disk they were received on
+	if _, err := s.WritePartial(id, "partial", 0, bytes.NewReader([]byte("received"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitPartial(id, "partial"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, "partial") {
+		t.Errorf("expected the committed file")
+	}
+
+	// A disk missing at startup takes its files along, the others still work
+	if err := os.Rename(disks[0].Path, disks[0].Path+".unmounted"); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStore(opts)
+	if state := s.DiskUsage()[0].State; state != DiskMissing {
+		t.Errorf("want disk state %s, have %s", DiskMissing, state)
+	}
+	available := 0
+	for i := 0; i < 30; i++ {
+		if s.Has(id, fmt.Sprintf("file_%d", i)) {
+			available++
+		}
+	}
+	if available == 0 || available == 30 {
+		t.Errorf("expected the files of the remaining disks only, have %d of 30", available)
+	}
+	if _, err := s.Write(id, "while_missing", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, "while_missing") {
+		t.Errorf("expected new files to go to the remaining disks")
+	}
+
+	// Full and read-only disks take no new files
+	s.disks[1].Quota = 1
+	s.disks[2].mu.Lock()
+	s.disks[2].state = DiskReadOnly
+	s.disks[2].mu.Unlock()
+	if _, err := s.Write(id, "no_room", bytes.NewReader([]byte("data"))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want %v, have %v", ErrQuotaExceeded, err)
+	}
+	if !s.Has(id, "while_missing") {
+		t.Errorf("expected files on a read-only disk to be readable")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc, Compression: CompressionGzip})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, err := crypto.NewEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 8192)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key        string
+		content    []byte
+		compressed bool
+	}{
+		{"notes.txt", bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 500), true},
+		{"short.txt", []byte("too short to compress"), false},
+		{"random.bin", random, false},
+		{"archive.zip", bytes.Repeat([]byte("stored zip entries\n"), 500), false},
+		// Content that starts like a compressed file is told apart
+		{"tricky.bin", []byte(compressMagic + "\x01 not gzip"), false},
+	}
+	for _, tt := range tests {
+		n, err := s.WriteEncrypt(encKey, id, tt.key, bytes.NewReader(tt.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := n < int64(len(tt.content)); compressed != tt.compressed {
+			t.Errorf("%s: want compressed %v, stored %d bytes of %d", tt.key, tt.compressed, n, len(tt.content))
+		}
+
+		_, r, err := s.Read(id, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plain bytes.Buffer
+		if _, err := crypto.CopyDecrypt(encKey, r, &plain); err != nil {
+			t.Fatal(err)
+		}
+		r.(io.Closer).Close()
+		data, err := io.ReadAll(Decompress(&plain))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.key, err)
+		}
+		if !bytes.Equal(data, tt.content) {
+			t.Errorf("%s: content changed by compression", tt.key)
+		}
+	}
+
+	// Compressing the same content again gives the same bytes, which
+	// convergent encryption needs
+	var a, b bytes.Buffer
+	for _, buf := range []*bytes.Buffer{&a, &b} {
+		r := compress(CompressionZstd, "notes.txt", bytes.NewReader(tests[0].content))
+		if _, err := io.Copy(buf, r); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("zstd output differs between runs")
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Errorf("expected an unknown compression to be refused")
+	}
+}
+
+func TestRendezvousShardFunc(t *testing.T) {
+	disks := []string{"/mnt/a", "/mnt/b", "/mnt/c"}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		hash := CASPathTransformFunc(fmt.Sprintf("key_%d", i)).Filename
+		order := RendezvousShardFunc(hash, disks)
+		if len(order) != 3 || slices.Sorted(slices.Values(order))[2] != 2 {
+			t.Fatalf("expected every disk once, have %v", order)
+		}
+
+		// Adding a disk only moves files to the new disk
+		grown := RendezvousShardFunc(hash, append(slices.Clone(disks), "/mnt/d"))
+		if grown[0] != order[0] {
+			if grown[0] != 3 {
+				t.Fatalf("file moved between existing disks: %v to %v", order, grown)
+			}
+			moved++
+		}
+	}
+	if moved < 150 || moved > 350 {
+		t.Errorf("expected about a quarter of the files to move, have %d of 1000", moved)
+	}
+}
+
+func TestStoreBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := NewStore(StoreOpts{
+		Root:              filepath.Join(t.TempDir(), "root"),
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           backend,
+	})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Write(id, "docs/a.txt", bytes.NewReader([]byte("in the backend"))); err != nil {
+		t.Fatal(err)
+	}
+	hash := CASPathTransformFunc("docs/a.txt").Filename
+	if !backend.Has(id, hash) {
+		t.Fatalf("expected the file in the backend under its hashed name")
+	}
+	if _, path, _ := s.keyPath(id, "docs/a.txt", "", false); fileExists(path) {
+		t.Errorf("expected no copy on local disk")
+	}
+
+	// Reads, random access and listings go to the backend
+	_, r, err := s.Read(id, "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(data) != "in the backend" {
+		t.Errorf("want %q, have %q", "in the backend", data)
+	}
+	f, err := s.Open(id, "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	if _, err := f.ReadAt(buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if string(buf) != "backend" {
+		t.Errorf("want backend, have %q", buf)
+	}
+	files, err := s.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Key != "docs/a.txt" || files[0].Hash != hash || files[0].Size != 14 {
+		t.Errorf("unexpected listing %+v", files)
+	}
+
+	// A transfer is received on local disk and moved once complete
+	if _, err := s.WritePartial(id, "b.txt", 0, bytes.NewReader([]byte("received"))); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "b.txt") {
+		t.Errorf("partial file reported as stored")
+	}
+	if err := s.CommitPartial(id, "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := s.Size(id, "b.txt"); err != nil || size != 8 {
+		t.Errorf("want size 8, have %d (%v)", size, err)
+	}
+
+	if err := s.Delete(id, "docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "docs/a.txt") || backend.Has(id, hash) {
+		t.Errorf("expected the file to be deleted from the backend")
+	}
+	if err := s.ClearFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := backend.List(""); len(files) != 0 {
+		t.Errorf("want an empty backend, have %d files", len(files))
+	}
+}
+
+func TestObjectMeta(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	if _, err := s.Write(id, "notes.txt", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat(id, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := s.ContentHash(id, "notes.txt")
+	if info.ContentType != "text/plain; charset=utf-8" || info.ContentHash != hash || info.Created.IsZero() {
+		t.Errorf("unexpected metadata %+v", info)
+	}
+
+	// A rewrite keeps the creation time and tags
+	if err := s.SetTags(id, "notes.txt", map[string]string{"project": "vault"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.Write(id, "notes.txt", strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.Stat(id, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Created.Equal(info.Created) || again.ContentHash == info.ContentHash || again.Tags["project"] != "vault" {
+		t.Errorf("unexpected metadata after rewrite %+v", again)
+	}
+
+	// Content without a known extension is sniffed
+	if _, err := s.Write(id, "page", strings.NewReader("<html><body>hi</body></html>")); err != nil {
+		t.Fatal(err)
+	}
+	files := mustList(t, s, id)
+	if len(files) != 2 {
+		t.Fatalf("want 2 files without the metadata records, have %+v", files)
+	}
+	for _, f := range files {
+		switch f.Key {
+		case "notes.txt":
+			if f.Tags["project"] != "vault" {
+				t.Errorf("expected the tags in the listing, have %+v", f)
+			}
+		case "page":
+			if f.ContentType != "text/html; charset=utf-8" {
+				t.Errorf("want text/html, have %q", f.ContentType)
+			}
+		}
+	}
+
+	// Files received in pieces get their content hash when it is asked for
+	if _, err := s.WritePartial(id, "data.bin", 0, strings.NewReader("pieces")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitPartial(id, "data.bin"); err != nil {
+		t.Fatal(err)
+	}
+	info, err = s.Stat(id, "data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := s.ContentHash(id, "data.bin"); info.ContentHash != hash || info.ContentType != "application/octet-stream" {
+		t.Errorf("unexpected metadata %+v", info)
+	}
+
+	if err := s.Delete(id, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTags(id, "notes.txt", nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want ErrNotExist tagging a deleted file, have %v", err)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              filepath.Join(t.TempDir(), "root"),
+		PathTransformFunc: CASPathTransformFunc,
+		Versions:          &VersionRetention{Keep: 2},
+	})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if _, err := s.Write(id, "doc", strings.NewReader(fmt.Sprintf("version %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := s.ListVersions(id, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 || !versions[3].Current || versions[3].Number != 4 {
+		t.Fatalf("want 4 versions with the current one last, have %+v", versions)
+	}
+	for _, n := range []int{1, 4} {
+		_, r, err := s.ReadVersion(id, "doc", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if want := fmt.Sprintf("version %d", n); string(data) != want {
+			t.Errorf("want %q, have %q", want, data)
+		}
+	}
+	if files := mustList(t, s, id); len(files) != 1 {
+		t.Errorf("want earlier versions left out of the listing, have %+v", files)
+	}
+
+	// Only the pruning is under test: every file here fails the integrity check
+	gc := NewGarbageCollector(s, id, time.Hour, time.Hour, nil)
+	gc.Verify = func(string, string) (bool, error) { return true, nil }
+	stats, err := gc.RunNow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, _ = s.ListVersions(id, "doc")
+	if stats.PrunedVersions != 1 || len(versions) != 3 || versions[0].Number != 2 {
+		t.Errorf("want version 1 pruned, have %d pruned and %+v", stats.PrunedVersions, versions)
+	}
+	if _, _, err := s.ReadVersion(id, "doc", 1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want ErrNotExist reading a pruned version, have %v", err)
+	}
+
+	// Versions replaced longer ago than MaxAge go too
+	s.Versions = &VersionRetention{MaxAge: time.Nanosecond}
+	if _, err := gc.RunNow(nil); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ = s.ListVersions(id, "doc"); len(versions) != 1 || versions[0].Number != 4 {
+		t.Errorf("want only the current version left, have %+v", versions)
+	}
+}
+
+func TestFileExpiry(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	for _, key := range []string{"tmp", "held", "kept"} {
+		if _, err := s.Write(id, key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Minute)
+	for _, key := range []string{"tmp", "held"} {
+		if err := s.SetExpiry(id, key, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetExpiry(id, "kept", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat(id, "tmp"); err != nil || !info.Expires.Equal(past) {
+		t.Errorf("want expiry %v, have %+v (%v)", past, info, err)
+	}
+
+	gc := NewGarbageCollector(s, id, time.Hour, time.Hour, nil)
+	gc.Verify = func(string, string) (bool, error) { return true, nil }
+	gc.Held = func(hash string) bool {
+		key, _ := s.GetOriginalKey(hash)
+		return key == "held"
+	}
+	stats, err := gc.RunNow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ExpiredFiles != 1 || s.Has(id, "tmp") {
+		t.Errorf("want the expired file removed, have %d expired", stats.ExpiredFiles)
+	}
+	if !s.Has(id, "held") || !s.Has(id, "kept") {
+		t.Errorf("want held and unexpired files kept")
+	}
+
+	// Clearing the expiry keeps the file for good
+	if err := s.SetExpiry(id, "kept", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Expiry(id, "kept").IsZero() {
+		t.Errorf("want the expiry cleared")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              filepath.Join(t.TempDir(), "root"),
+		PathTransformFunc: CASPathTransformFunc,
+		Trash:             time.Hour,
+	})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Write(id, "notes.txt", strings.NewReader("remember me")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTags(id, "notes.txt", map[string]string{"project": "apollo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "notes.txt") || len(mustList(t, s, id)) != 0 {
+		t.Fatalf("want the deleted file gone from the store")
+	}
+	entries, err := s.ListTrash(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "notes.txt" || entries[0].Size != 11 {
+		t.Fatalf("want the file in the trash, have %+v", entries)
+	}
+
+	if _, err := s.Restore(id, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s.Read(id, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(data) != "remember me" {
+		t.Errorf("want the restored content, have %q", data)
+	}
+	if info, _ := s.Stat(id, "notes.txt"); info.Tags["project"] != "apollo" {
+		t.Errorf("want the tags restored, have %v", info.Tags)
+	}
+	if _, err := s.Restore(id, "notes.txt"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("want ErrExist restoring a stored key, have %v", err)
+	}
+
+	// Entries older than the trash age are purged by the collector
+	if err := s.Delete(id, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	gc := NewGarbageCollector(s, id, time.Hour, time.Hour, nil)
+	if stats, _ := gc.RunNow(nil); stats.PurgedTrash != 0 {
+		t.Errorf("want recent entries kept, have %d purged", stats.PurgedTrash)
+	}
+	s.Trash = time.Nanosecond
+	if stats, _ := gc.RunNow(nil); stats.PurgedTrash != 1 {
+		t.Errorf("want the entry purged, have %d purged", stats.PurgedTrash)
+	}
+	if entries, _ := s.ListTrash(id); len(entries) != 0 {
+		t.Errorf("want an empty trash, have %+v", entries)
+	}
+	if _, err := s.Restore(id, "notes.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want ErrNotExist restoring a purged file, have %v", err)
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	s := newStore()
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, s)
+
+	if _, err := s.Write(id, "alphabet", strings.NewReader("abcdefghijklmnopqrstuvwxyz")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 3, "abc"},
+		{10, 5, "klmno"},
+		{23, 10, "xyz"},
+		{26, 4, ""},
+	} {
+		n, r, err := s.ReadRange(id, "alphabet", tc.offset, tc.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if string(data) != tc.want || n != int64(len(tc.want)) {
+			t.Errorf("range %d+%d: want %q, have %q (%d)", tc.offset, tc.length, tc.want, data, n)
+		}
+	}
+	if _, _, err := s.ReadRange(id, "alphabet", 27, 1); err == nil {
+		t.Errorf("want an error reading beyond the end")
+	}
+}
+
+func TestGarbageCollectorReport(t *testing.T) {
+	s := NewStore(StoreOpts{Root: filepath.Join(t.TempDir(), "root"), PathTransformFunc: CASPathTransformFunc})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gc := NewGarbageCollector(s, id, time.Hour, time.Minute, nil)
+	if _, ok := gc.LastRun(); ok {
+		t.Fatalf("want no report before the first run")
+	}
+	if _, err := s.Write(id, "file", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	gc.Verify = func(string, string) (bool, error) { return true, nil }
+	if _, err := gc.RunNow(nil); err != nil {
+		t.Fatal(err)
+	}
+	report, ok := gc.LastRun()
+	if !ok || report.Stats.CheckedFiles != 1 || report.Started.IsZero() {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// A new collector, as after a restart, reads the last report back
+	restarted := NewGarbageCollector(s, id, time.Hour, time.Minute, nil)
+	if again, ok := restarted.LastRun(); !ok || again.Stats != report.Stats || !again.Started.Equal(report.Started) {
+		t.Errorf("want the report %+v persisted, have %+v", report, again)
+	}
+	if _, _, lastRun := restarted.GetStats(); !lastRun.Equal(report.Started) {
+		t.Errorf("want GetStats to return the last run, have %v", lastRun)
+	}
+}
+
+func TestGCQuarantine(t *testing.T) {
+	s := NewStore(StoreOpts{Root: filepath.Join(t.TempDir(), "root"), PathTransformFunc: CASPathTransformFunc})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"fixable", "lost"} {
+		if _, err := s.Write(id, key, strings.NewReader("bad")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc := NewGarbageCollector(s, id, time.Hour, time.Hour, nil)
+	gc.Verify = func(hash string, path string) (bool, error) {
+		data, err := os.ReadFile(path)
+		return string(data) == "good", err
+	}
+	gc.Repair = func(key string) error {
+		if key != "fixable" {
+			return errors.New("no peer holds it")
+		}
+		_, err := s.Write(id, key, strings.NewReader("good"))
+		return err
+	}
+	gc.RepairAttempts = 2
+
+	stats, err := gc.RunNow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CorruptedFiles != 2 || stats.RepairedFiles != 1 || !s.Has(id, "fixable") {
+		t.Errorf("want the fixable file repaired, have %+v", stats)
+	}
+	entries, err := s.ListQuarantine(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "lost" || entries[0].Attempts != 1 || s.Has(id, "lost") {
+		t.Fatalf("want the lost file in quarantine after one attempt, have %+v", entries)
+	}
+
+	// The second failed attempt gives up on it
+	if _, err := gc.RunNow(nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := s.ListQuarantine(id); len(entries) != 0 {
+		t.Errorf("want the lost file discarded, have %+v", entries)
+	}
+	if !s.Has(id, "fixable") {
+		t.Errorf("want the repaired file kept")
+	}
+}
+
+func TestConvergentWrite(t *testing.T) {
+	s := NewStore(StoreOpts{Root: filepath.Join(t.TempDir(), "root"), PathTransformFunc: CASPathTransformFunc, Convergent: true})
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, _ := crypto.NewEncryptionKey()
+	for _, key := range []string{"a.txt", "copy-of-a.txt", "b.txt"} {
+		content := "same content"
+		if key == "b.txt" {
+			content = "other content"
+		}
+		if _, err := s.WriteEncrypt(encKey, id, key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, _ := s.ContentHash(id, "a.txt")
+	copyOfA, _ := s.ContentHash(id, "copy-of-a.txt")
+	b, _ := s.ContentHash(id, "b.txt")
+	if a != copyOfA {
+		t.Error("want the same content stored as the same bytes")
+	}
+	if a == b {
+		t.Error("want different content stored as different bytes")
+	}
+}
+
+func TestSealedRecords(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	metaKey, _ := crypto.NewEncryptionKey()
+	opts := StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc, MetaKey: metaKey}
+	s := NewStore(opts)
+	id, err := crypto.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "secret-plans.pdf", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTags(id, "secret-plans.pdf", map[string]string{"project": "apollo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing on disk names the file or its tags
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte("secret-plans")) || bytes.Contains(data, []byte("apollo")) {
+			t.Errorf("%s reveals the key or its tags", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A store opened again with the key reads them back
+	s = NewStore(opts)
+	if _, ok := s.GetOriginalKey(s.PathTransformFunc("secret-plans.pdf").Filename); !ok {
+		t.Error("want the key map read back")
+	}
+	info, err := s.Stat(id, "secret-plans.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tags["project"] != "apollo" {
+		t.Errorf("want the tags read back, have %v", info.Tags)
+	}
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempSuffix marks a file still being written. Stored files are written
+// under a temporary name next to their final path and renamed once they are
+// complete and on disk, so a crash mid-write never leaves a truncated file
+// that Has reports as stored.
+const tempSuffix = ".tmp"
+
+// tempFileMaxAge is how long a temporary file may go unmodified before the
+// garbage collector takes it for one abandoned by a crash
+const tempFileMaxAge = time.Hour
+
+// IsTempFile reports whether a file name belongs to a write in progress
+func IsTempFile(name string) bool {
+	return strings.HasSuffix(name, tempSuffix)
+}
+
+// tempFile is a file written under a temporary name until it is committed.
+// It hashes what is written to it on the way.
+type tempFile struct {
+	file *os.File
+	path string // final path
+	hash hash.Hash
+}
+
+// createTemp creates a temporary file next to path, with a random part in
+// its name so concurrent writes of the same key do not share it
+func createTemp(path string) (*tempFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &tempFile{file: f, path: path, hash: sha256.New()}, nil
+}
+
+func (f *tempFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.hash.Write(p[:n])
+	return n, err
+}
+
+// sum returns the hex SHA-256 of what was written
+func (f *tempFile) sum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// finish commits the file if writing it succeeded and removes it otherwise,
+// returning the first error
+func (f *tempFile) finish(err error) error {
+	if err == nil {
+		err = f.file.Sync()
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.file.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.file.Name())
+	}
+	return err
+}
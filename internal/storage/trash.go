@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// trashDir is the directory on each disk deleted files are moved to when
+// the store keeps a trash, next to the directories of the node IDs. Each
+// deletion gets its own entry directory holding the stored file with its
+// metadata record and earlier versions, and an entry record.
+const trashDir = ".trash"
+
+// trashRecord names the entry record in an entry directory
+const trashRecord = "entry.json"
+
+// TrashEntry describes a deleted file kept in the trash
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	dir     string
+}
+
+// trashPath returns the path of an entry in the trash of a node ID on the
+// disk at root
+func (s *Store) trashPath(root string, id string, entry string) (string, error) {
+	return s.resolveIn(filepath.Join(root, trashDir), id, entry)
+}
+
+// moveToTrash moves the stored file of a key at path, with its metadata
+// record and earlier versions, into a new trash entry on the same disk
+func (s *Store) moveToTrash(root string, id string, key string, path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hash := filepath.Base(path)
+	entry := TrashEntry{
+		ID:      fmt.Sprintf("%d-%s", time.Now().UnixNano(), hash[:min(len(hash), 16)]),
+		Key:     key,
+		Hash:    hash,
+		Size:    info.Size(),
+		Deleted: time.Now(),
+	}
+	dir, err := s.trashPath(root, id, entry.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	names, err := filesOf(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(filepath.Dir(path), name), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to move %s to the trash: %w", name, err)
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if data, err = s.SealRecord(data); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, trashRecord), data, 0644)
+}
+
+// filesOf returns the names of the stored file at path, its metadata
+// record and its earlier versions
+func filesOf(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(path)
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == base || name == base+metaSuffix {
+			names = append(names, name)
+		} else if b, _, ok := parseVersion(name); ok && b == base {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// ListTrash returns the files of a node ID in the trash, most recently
+// deleted first
+func (s *Store) ListTrash(id string) ([]TrashEntry, error) {
+	var entries []TrashEntry
+	for _, d := range s.disks {
+		if d.State() == DiskMissing {
+			continue
+		}
+		dir, err := s.trashPath(d.Path, id, "")
+		if err != nil {
+			return nil, err
+		}
+		dirEntries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range dirEntries {
+			data, err := os.ReadFile(filepath.Join(dir, e.Name(), trashRecord))
+			if err != nil {
+				continue // being moved in or purged
+			}
+			if data, err = s.OpenRecord(data); err != nil {
+				continue
+			}
+			var entry TrashEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				continue
+			}
+			entry.dir = filepath.Join(dir, e.Name())
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b TrashEntry) int { return b.Deleted.Compare(a.Deleted) })
+	return entries, nil
+}
+
+// Restore moves the most recently deleted file of a key back out of the
+// trash. It fails with os.ErrExist if the key was stored again meanwhile.
+func (s *Store) Restore(id string, key string) (TrashEntry, error) {
+	if s.Has(id, key) {
+		return TrashEntry{}, fmt.Errorf("%s: %w", key, os.ErrExist)
+	}
+	entries, err := s.ListTrash(id)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	i := slices.IndexFunc(entries, func(e TrashEntry) bool { return e.Key == key })
+	if i < 0 {
+		return TrashEntry{}, fmt.Errorf("%s not in the trash: %w", key, os.ErrNotExist)
+	}
+	entry := entries[i]
+
+	// Back onto the disk the entry is on, where the file was
+	pathKey := s.PathTransformFunc(key)
+	root := filepath.Dir(filepath.Dir(filepath.Dir(entry.dir)))
+	path, err := s.resolveIn(root, id, pathKey.FullPath())
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return TrashEntry{}, err
+	}
+	names, err := filesOf(filepath.Join(entry.dir, entry.Hash))
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(entry.dir, name), filepath.Join(filepath.Dir(path), name)); err != nil {
+			return TrashEntry{}, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	s.rememberKey(key)
+	return entry, os.RemoveAll(entry.dir)
+}
+
+// EmptyTrash removes every file of a node ID from the trash and returns
+// how many there were
+func (s *Store) EmptyTrash(id string) (int, error) {
+	entries, err := s.ListTrash(id)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := os.RemoveAll(entry.dir); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// purgeTrash removes the files deleted longer ago than the store keeps
+// them in the trash
+func (gc *GarbageCollector) purgeTrash(stats *CleanupStats) error {
+	if gc.store.Trash <= 0 {
+		return nil
+	}
+	entries, err := gc.store.ListTrash(gc.nodeID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Since(entry.Deleted) <= gc.store.Trash {
+			continue
+		}
+		if err := os.RemoveAll(entry.dir); err != nil {
+			gc.logger.Error("Failed to purge trash entry", "node", gc.nodeID, "key", entry.Key, "err", err)
+			continue
+		}
+		gc.report("purged", entry.dir)
+		stats.PurgedTrash++
+		stats.RemovedFiles++
+	}
+	return nil
+}
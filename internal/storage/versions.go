@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionSep separates the hashed name of a file from the number of one of
+// its earlier versions, as in <hash>.v3. Earlier versions live next to the
+// file, so deleting a key deletes its history too.
+const versionSep = ".v"
+
+// VersionRetention turns on versioning and decides how long earlier
+// versions are kept. Writing a key again then keeps the file it replaces
+// as a numbered version; the garbage collector removes the versions the
+// retention no longer covers.
+type VersionRetention struct {
+	Keep   int           // earlier versions kept per key, 0 for no limit
+	MaxAge time.Duration // how long a version is kept once replaced, 0 for no limit
+}
+
+// Version describes one version of a stored file. Versions are numbered
+// by the writes of their key from 1, so numbers stay the same when earlier
+// versions are pruned; the current file has the highest number.
+type Version struct {
+	Number  int       `json:"number"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"` // when the version was written
+	Current bool      `json:"current"`
+}
+
+// versionFile is an earlier version of a file on disk
+type versionFile struct {
+	Version
+	path string
+}
+
+// IsVersionFile reports whether a file name belongs to an earlier version
+func IsVersionFile(name string) bool {
+	_, _, ok := parseVersion(name)
+	return ok
+}
+
+// parseVersion splits the name of an earlier version into the name of the
+// file and the version number
+func parseVersion(name string) (string, int, bool) {
+	i := strings.LastIndex(name, versionSep)
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(name[i+len(versionSep):])
+	if err != nil || n <= 0 {
+		return "", 0, false
+	}
+	return name[:i], n, true
+}
+
+// versionsOf returns the earlier versions of the file at path, oldest first
+func versionsOf(path string) ([]versionFile, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []versionFile
+	for _, entry := range entries {
+		base, n, ok := parseVersion(entry.Name())
+		if !ok || base != filepath.Base(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+		versions = append(versions, versionFile{
+			Version: Version{Number: n, Size: info.Size(), ModTime: info.ModTime()},
+			path:    filepath.Join(filepath.Dir(path), entry.Name()),
+		})
+	}
+	slices.SortFunc(versions, func(a, b versionFile) int { return a.Number - b.Number })
+	return versions, nil
+}
+
+// currentVersion returns the number of the current version of the file at
+// path, 0 if there is none. Files stored before version numbers were
+// recorded follow their earlier versions.
+func (s *Store) currentVersion(path string) int {
+	if m, ok := s.readMeta(path); ok && m.Version > 0 {
+		return m.Version
+	}
+	if _, err := os.Stat(path); err != nil {
+		return 0
+	}
+	versions, _ := versionsOf(path)
+	if len(versions) == 0 {
+		return 1
+	}
+	return versions[len(versions)-1].Number + 1
+}
+
+// keepVersion keeps the file at path, version number current and about to
+// be replaced, as an earlier version, and returns the path of that version
+// or "" if nothing is kept. The version is a hard link, so the file stays
+// in place until the rename that replaces it.
+func (s *Store) keepVersion(path string, current int) (string, error) {
+	if s.Versions == nil || s.Backend != nil || current == 0 {
+		return "", nil
+	}
+	versionPath := fmt.Sprintf("%s%s%d", path, versionSep, current)
+	if err := os.Link(path, versionPath); err != nil {
+		// Not every filesystem has hard links
+		if err := copyFile(path, versionPath); err != nil {
+			return "", fmt.Errorf("failed to keep the previous version: %w", err)
+		}
+	}
+	return versionPath, nil
+}
+
+// copyFile copies the file at src to dst, keeping its modification time
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if err = f.finish(err); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// ListVersions returns every version of a stored file, oldest first and
+// the current file last
+func (s *Store) ListVersions(id string, key string) ([]Version, error) {
+	if s.Backend != nil {
+		info, err := s.statFile(id, key)
+		if err != nil {
+			return nil, err
+		}
+		return []Version{{Number: 1, Size: info.Size, ModTime: info.ModTime, Current: true}}, nil
+	}
+	_, path, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := versionsOf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(files)+1)
+	for _, f := range files {
+		versions = append(versions, f.Version)
+	}
+	s.metaMu.Lock()
+	current := s.currentVersion(path)
+	s.metaMu.Unlock()
+	return append(versions, Version{Number: current, Size: info.Size(), ModTime: info.ModTime(), Current: true}), nil
+}
+
+// ReadVersion returns the size and content of version n of a stored file.
+// The reader is an io.ReadCloser the caller closes.
+func (s *Store) ReadVersion(id string, key string, n int) (int64, io.Reader, error) {
+	versions, err := s.ListVersions(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	i := slices.IndexFunc(versions, func(v Version) bool { return v.Number == n })
+	if i < 0 {
+		return 0, nil, fmt.Errorf("version %d of %s: %w", n, key, os.ErrNotExist)
+	}
+	if versions[i].Current {
+		return s.readStream(id, key)
+	}
+
+	_, path, err := s.keyPath(id, key, "", false)
+	if err != nil {
+		return 0, nil, err
+	}
+	f, err := os.Open(fmt.Sprintf("%s%s%d", path, versionSep, n))
+	if err != nil {
+		return 0, nil, err
+	}
+	return versions[i].Size, f, nil
+}
+
+// pruneVersions removes the earlier versions the retention of the store no
+// longer covers
+func (gc *GarbageCollector) pruneVersions(stats *CleanupStats) error {
+	retention := gc.store.Versions
+	if retention == nil || (retention.Keep <= 0 && retention.MaxAge <= 0) {
+		return nil
+	}
+	gc.logger.Info("Pruning earlier versions", "node", gc.nodeID)
+
+	nodeDirs, err := gc.store.nodeDirs(gc.nodeID)
+	if err != nil {
+		return err
+	}
+	for _, nodeDir := range nodeDirs {
+		// The files with earlier versions, each listed once
+		var paths []string
+		seen := make(map[string]bool)
+		err := filepath.Walk(nodeDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil // the directory may not exist yet
+			}
+			if base, _, ok := parseVersion(info.Name()); ok && !info.IsDir() {
+				file := filepath.Join(filepath.Dir(path), base)
+				if !seen[file] {
+					seen[file] = true
+					paths = append(paths, file)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			gc.pruneVersionsOf(path, retention, stats)
+		}
+	}
+	return nil
+}
+
+// pruneVersionsOf removes the earlier versions of the file at path that
+// are beyond retention.Keep or were replaced more than retention.MaxAge ago
+func (gc *GarbageCollector) pruneVersionsOf(path string, retention *VersionRetention, stats *CleanupStats) {
+	hash := filepath.Base(path)
+	if gc.Held != nil && gc.Held(hash) {
+		return
+	}
+	versions, err := versionsOf(path)
+	if err != nil {
+		gc.logger.Warn("Failed to list versions", "node", gc.nodeID, "path", path, "err", err)
+		return
+	}
+
+	// A version was replaced when the one after it was written
+	replacedAt := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		replacedAt = info.ModTime()
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		expired := retention.MaxAge > 0 && time.Since(replacedAt) > retention.MaxAge
+		replacedAt = v.ModTime
+		if !expired && (retention.Keep <= 0 || len(versions)-i <= retention.Keep) {
+			continue
+		}
+		if err := os.Remove(v.path); err != nil {
+			gc.logger.Error("Failed to remove earlier version", "node", gc.nodeID, "path", v.path, "err", err)
+			continue
+		}
+		gc.report("pruned", v.path)
+		stats.PrunedVersions++
+		stats.RemovedFiles++
+	}
+}
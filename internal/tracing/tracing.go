@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// propagator carries span contexts between nodes as W3C trace context
+var propagator = propagation.TraceContext{}
+
+// Options configures trace export
+type Options struct {
+	Endpoint    string // OTLP/gRPC collector address (host:port)
+	Insecure    bool   // Connect to the collector without TLS
+	ServiceName string
+	NodeID      string
+}
+
+// Setup exports spans to an OTLP collector by installing a global tracer
+// provider. Without an endpoint tracing stays disabled and spans cost
+// nothing. The returned function flushes pending spans and stops export.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "peervault"
+	}
+
+	clientOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	resource, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+		attribute.String("peervault.node_id", opts.NodeID),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}
+
+// Inject returns the trace context of the span in ctx, to be sent along with
+// a message, or nil if ctx is not traced
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx with the remote span described by a received trace
+// context as parent
+func Extract(ctx context.Context, trace map[string]string) context.Context {
+	if len(trace) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(trace))
+}
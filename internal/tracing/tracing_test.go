@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectExtract(t *testing.T) {
+	assert.Nil(t, Inject(context.Background()))
+	assert.Equal(t, context.Background(), Extract(context.Background(), nil))
+
+	provider := sdktrace.NewTracerProvider()
+	defer provider.Shutdown(context.Background())
+	ctx, span := provider.Tracer("test").Start(context.Background(), "op")
+	defer span.End()
+
+	carrier := Inject(ctx)
+	assert.Contains(t, carrier, "traceparent")
+
+	remote := trace.SpanContextFromContext(Extract(context.Background(), carrier))
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), remote.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), remote.SpanID())
+}
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.Background()))
+}
@@ -0,0 +1,290 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: peervault.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	PeerVault_StoreFile_FullMethodName = "/peervault.v1.PeerVault/StoreFile"
+	PeerVault_GetFile_FullMethodName   = "/peervault.v1.PeerVault/GetFile"
+	PeerVault_ListFiles_FullMethodName = "/peervault.v1.PeerVault/ListFiles"
+	PeerVault_PeerInfo_FullMethodName  = "/peervault.v1.PeerVault/PeerInfo"
+	PeerVault_Metrics_FullMethodName   = "/peervault.v1.PeerVault/Metrics"
+)
+
+// PeerVaultClient is the client API for PeerVault service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// PeerVault is the control-plane API served by a node. File contents are
+// streamed in chunks, so neither side holds a whole file in memory.
+type PeerVaultClient interface {
+	// StoreFile stores a file on the node, which then replicates it. The
+	// first message names the key, every following message carries a chunk.
+	StoreFile(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StoreFileRequest, StoreFileResponse], error)
+	// GetFile streams a file, fetching it from peers if it is not stored
+	// on the node.
+	GetFile(ctx context.Context, in *GetFileRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetFileResponse], error)
+	// ListFiles lists the files stored on the node, or across the network.
+	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error)
+	// PeerInfo describes the node and its connections.
+	PeerInfo(ctx context.Context, in *PeerInfoRequest, opts ...grpc.CallOption) (*PeerInfoResponse, error)
+	// Metrics returns the node's counters and gauges.
+	Metrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (*MetricsResponse, error)
+}
+
+type peerVaultClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPeerVaultClient(cc grpc.ClientConnInterface) PeerVaultClient {
+	return &peerVaultClient{cc}
+}
+
+func (c *peerVaultClient) StoreFile(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StoreFileRequest, StoreFileResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &PeerVault_ServiceDesc.Streams[0], PeerVault_StoreFile_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StoreFileRequest, StoreFileResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PeerVault_StoreFileClient = grpc.ClientStreamingClient[StoreFileRequest, StoreFileResponse]
+
+func (c *peerVaultClient) GetFile(ctx context.Context, in *GetFileRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetFileResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &PeerVault_ServiceDesc.Streams[1], PeerVault_GetFile_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GetFileRequest, GetFileResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PeerVault_GetFileClient = grpc.ServerStreamingClient[GetFileResponse]
+
+func (c *peerVaultClient) ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListFilesResponse)
+	err := c.cc.Invoke(ctx, PeerVault_ListFiles_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerVaultClient) PeerInfo(ctx context.Context, in *PeerInfoRequest, opts ...grpc.CallOption) (*PeerInfoResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PeerInfoResponse)
+	err := c.cc.Invoke(ctx, PeerVault_PeerInfo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *peerVaultClient) Metrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (*MetricsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MetricsResponse)
+	err := c.cc.Invoke(ctx, PeerVault_Metrics_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PeerVaultServer is the server API for PeerVault service.
+// All implementations must embed UnimplementedPeerVaultServer
+// for forward compatibility.
+//
+// PeerVault is the control-plane API served by a node. File contents are
+// streamed in chunks, so neither side holds a whole file in memory.
+type PeerVaultServer interface {
+	// StoreFile stores a file on the node, which then replicates it. The
+	// first message names the key, every following message carries a chunk.
+	StoreFile(grpc.ClientStreamingServer[StoreFileRequest, StoreFileResponse]) error
+	// GetFile streams a file, fetching it from peers if it is not stored
+	// on the node.
+	GetFile(*GetFileRequest, grpc.ServerStreamingServer[GetFileResponse]) error
+	// ListFiles lists the files stored on the node, or across the network.
+	ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error)
+	// PeerInfo describes the node and its connections.
+	PeerInfo(context.Context, *PeerInfoRequest) (*PeerInfoResponse, error)
+	// Metrics returns the node's counters and gauges.
+	Metrics(context.Context, *MetricsRequest) (*MetricsResponse, error)
+	mustEmbedUnimplementedPeerVaultServer()
+}
+
+// UnimplementedPeerVaultServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPeerVaultServer struct{}
+
+func (UnimplementedPeerVaultServer) StoreFile(grpc.ClientStreamingServer[StoreFileRequest, StoreFileResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StoreFile not implemented")
+}
+func (UnimplementedPeerVaultServer) GetFile(*GetFileRequest, grpc.ServerStreamingServer[GetFileResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method GetFile not implemented")
+}
+func (UnimplementedPeerVaultServer) ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
+func (UnimplementedPeerVaultServer) PeerInfo(context.Context, *PeerInfoRequest) (*PeerInfoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PeerInfo not implemented")
+}
+func (UnimplementedPeerVaultServer) Metrics(context.Context, *MetricsRequest) (*MetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Metrics not implemented")
+}
+func (UnimplementedPeerVaultServer) mustEmbedUnimplementedPeerVaultServer() {}
+func (UnimplementedPeerVaultServer) testEmbeddedByValue()                   {}
+
+// UnsafePeerVaultServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PeerVaultServer will
+// result in compilation errors.
+type UnsafePeerVaultServer interface {
+	mustEmbedUnimplementedPeerVaultServer()
+}
+
+func RegisterPeerVaultServer(s grpc.ServiceRegistrar, srv PeerVaultServer) {
+	// If the following call pancis, it indicates UnimplementedPeerVaultServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&PeerVault_ServiceDesc, srv)
+}
+
+func _PeerVault_StoreFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PeerVaultServer).StoreFile(&grpc.GenericServerStream[StoreFileRequest, StoreFileResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PeerVault_StoreFileServer = grpc.ClientStreamingServer[StoreFileRequest, StoreFileResponse]
+
+func _PeerVault_GetFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetFileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PeerVaultServer).GetFile(m, &grpc.GenericServerStream[GetFileRequest, GetFileResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PeerVault_GetFileServer = grpc.ServerStreamingServer[GetFileResponse]
+
+func _PeerVault_ListFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerVaultServer).ListFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PeerVault_ListFiles_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerVaultServer).ListFiles(ctx, req.(*ListFilesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerVault_PeerInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerVaultServer).PeerInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PeerVault_PeerInfo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerVaultServer).PeerInfo(ctx, req.(*PeerInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PeerVault_Metrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PeerVaultServer).Metrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PeerVault_Metrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PeerVaultServer).Metrics(ctx, req.(*MetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PeerVault_ServiceDesc is the grpc.ServiceDesc for PeerVault service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PeerVault_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "peervault.v1.PeerVault",
+	HandlerType: (*PeerVaultServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListFiles",
+			Handler:    _PeerVault_ListFiles_Handler,
+		},
+		{
+			MethodName: "PeerInfo",
+			Handler:    _PeerVault_PeerInfo_Handler,
+		},
+		{
+			MethodName: "Metrics",
+			Handler:    _PeerVault_Metrics_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StoreFile",
+			Handler:       _PeerVault_StoreFile_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetFile",
+			Handler:       _PeerVault_GetFile_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "peervault.proto",
+}
@@ -0,0 +1,41 @@
+package p2p_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p/p2ptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPTransportConformance(t *testing.T) {
+	port := 3200
+	p2ptest.TestTransport(t, func(opts p2p.TransportOptions) (p2p.Transport, error) {
+		return p2p.NewTransport("tcp", opts)
+	}, func() string {
+		port++
+		return fmt.Sprintf("127.0.0.1:%d", port)
+	})
+}
+
+func TestTransportRegistry(t *testing.T) {
+	assert.Contains(t, p2p.Transports(), "tcp")
+
+	_, err := p2p.NewTransport("carrier-pigeon", p2p.TransportOptions{})
+	assert.NotNil(t, err)
+
+	_, err = p2p.NewTransport("tcp", p2p.TransportOptions{Params: map[string]string{"max_retries": "many"}})
+	assert.NotNil(t, err)
+
+	tr, err := p2p.NewTransport("tcp", p2p.TransportOptions{
+		ListenAddr: ":3300",
+		Params:     map[string]string{"dial_timeout": "1s", "max_retries": "5"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ":3300", tr.Addr())
+
+	assert.Panics(t, func() {
+		p2p.RegisterTransport("tcp", func(p2p.TransportOptions) (p2p.Transport, error) { return nil, nil })
+	})
+}
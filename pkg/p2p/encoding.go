@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -21,8 +23,8 @@ func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 	peekBuf := make([]byte, 1)
 
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+	if _, err := io.ReadFull(r, peekBuf); err != nil {
+		return err
 	}
 
 	stream := peekBuf[0] == IncomingStream
@@ -31,15 +33,24 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(lenBuf)
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d bytes", size, MaxMessageSize)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 	return nil
 }
 
-//  If the data is not a stream, it reads up to 1028 bytes from the io.Reader
+// If the data is not a stream, it reads a length-prefixed message (see EncodeMessage)
 // and stores the data in the Payload field of the RPC struct.
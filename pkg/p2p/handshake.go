@@ -1,5 +1,12 @@
 package p2p
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
 // create custom handshake logic
 // If the handshake succeeds, it returns nil
 // If it fails, it returns an error
@@ -11,3 +18,59 @@ type HandshakeFunc func(Peer) error
 func NOPHandshakeFunc(Peer) error {
 	return nil
 }
+
+// ErrNetworkMismatch is returned by a network handshake when the remote
+// node belongs to another network
+var ErrNetworkMismatch = errors.New("peer belongs to another network")
+
+// networkMagic starts every network handshake, so a remote node that does
+// not send one is told apart from one on another network
+const networkMagic = "PVNET1"
+
+// handshakeTimeout bounds how long a network handshake waits for the remote
+const handshakeTimeout = 10 * time.Second
+
+// NetworkHandshakeFunc returns a handshake that exchanges network IDs and
+// rejects nodes whose ID differs, so unrelated deployments that find each
+// other, e.g. over mDNS on one LAN, never connect. Both sides must use it.
+func NetworkHandshakeFunc(networkID string) HandshakeFunc {
+	return func(peer Peer) error {
+		remote, err := ExchangeNetworkID(peer, networkID)
+		if err != nil {
+			return err
+		}
+		if remote != networkID {
+			return fmt.Errorf("%w: %s is on network %q", ErrNetworkMismatch, peer.RemoteAddr(), remote)
+		}
+		return nil
+	}
+}
+
+// ExchangeNetworkID sends networkID to the remote node and returns the one
+// it sent back, without comparing them, for tools that report which
+// network a node is on
+func ExchangeNetworkID(peer Peer, networkID string) (string, error) {
+	if len(networkID) > 255 {
+		return "", fmt.Errorf("network ID longer than 255 bytes")
+	}
+	peer.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer peer.SetDeadline(time.Time{})
+
+	frame := append([]byte(networkMagic), byte(len(networkID)))
+	if _, err := peer.Write(append(frame, networkID...)); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, len(networkMagic)+1)
+	if _, err := io.ReadFull(peer, header); err != nil {
+		return "", err
+	}
+	if string(header[:len(networkMagic)]) != networkMagic {
+		return "", fmt.Errorf("%s sent no network handshake", peer.RemoteAddr())
+	}
+	remote := make([]byte, header[len(networkMagic)])
+	if _, err := io.ReadFull(peer, remote); err != nil {
+		return "", err
+	}
+	return string(remote), nil
+}
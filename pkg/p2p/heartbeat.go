@@ -0,0 +1,160 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Default connection liveness settings of the TCP transport
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultIdleMisses        = 3 // heartbeat intervals without a pong before a connection is idle
+)
+
+// A connection whose remote node stops responding, without closing it, is
+// half-open: reads on it wait forever. Three things bring it down instead:
+//   - every read and write has a deadline of IdleTimeout, extended each
+//     time, so a stream stalling mid-transfer fails
+//   - TCP keep-alives let the OS notice a peer that vanished
+//   - peers whose node answers heartbeats are pinged every
+//     HeartbeatInterval; the pongs keep the connection busy, so one that
+//     stays silent for IdleTimeout is closed
+//   - a peer is suspect while a ping went unanswered for a heartbeat
+//     interval, and its connection is closed once HeartbeatMisses pings in
+//     a row were, even if other traffic keeps it busy
+//
+// The pongs also measure the round trip to the peer, see RTT.
+//
+// Pings and pongs are a single IncomingPing or IncomingPong byte. Nodes that
+// predate them would take the byte for the start of a message, so pings are
+// only sent once the application knows the remote node answers them.
+
+// StartHeartbeat starts pinging the remote node, which must answer pings.
+// From then on the connection is closed once nothing arrives for the idle
+// timeout, even between messages, or once HeartbeatMisses pings in a row
+// went unanswered. Calling it again does nothing.
+func (p *TCPPeer) StartHeartbeat() {
+	if p.heartbeatInterval <= 0 || (p.idleTimeout <= 0 && p.heartbeatMisses <= 0) {
+		return
+	}
+	p.heartbeatOnce.Do(func() {
+		// The read loop may be waiting for a frame without a deadline
+		p.heartbeating.Store(true)
+		if p.idleTimeout > 0 {
+			p.Conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+		go func() {
+			ticker := time.NewTicker(p.heartbeatInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if !p.ping() {
+						return
+					}
+					if err := p.Send([]byte{IncomingPing}); err != nil {
+						return
+					}
+				case <-p.closed:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// ping notes a ping about to be sent, counting the previous one as missed
+// if it is still unanswered. It reports false once too many were missed,
+// after closing the connection.
+func (p *TCPPeer) ping() bool {
+	if p.pingSent.Load() == 0 {
+		p.pingSent.Store(time.Now().UnixNano())
+		return true
+	}
+	missed := p.missed.Add(1)
+	if missed == 1 {
+		log.Printf("[%s] heartbeat unanswered, peer suspect", p.RemoteAddr())
+	}
+	if p.heartbeatMisses > 0 && int(missed) >= p.heartbeatMisses {
+		log.Printf("[%s] %d heartbeats unanswered, closing connection", p.RemoteAddr(), missed)
+		p.Conn.Close()
+		return false
+	}
+	return true
+}
+
+// pong measures the round trip of the oldest unanswered ping, smoothed
+// like TCP does with 1/8 of each new sample
+func (p *TCPPeer) pong() {
+	sent := p.pingSent.Swap(0)
+	if sent == 0 {
+		return // answers a ping already measured
+	}
+	sample := time.Since(time.Unix(0, sent))
+	if old := time.Duration(p.rtt.Load()); old > 0 {
+		sample = old + (sample-old)/8
+	}
+	p.rtt.Store(int64(sample))
+	if p.missed.Swap(0) > 0 {
+		log.Printf("[%s] heartbeat answered again after %v", p.RemoteAddr(), sample)
+	}
+}
+
+// RTT returns the smoothed round trip of the heartbeat pings, zero until
+// one was answered
+func (p *TCPPeer) RTT() time.Duration {
+	return time.Duration(p.rtt.Load())
+}
+
+// Suspect reports whether the last ping went unanswered for a heartbeat
+// interval
+func (p *TCPPeer) Suspect() bool {
+	return p.missed.Load() > 0
+}
+
+// Read reads from the connection, failing once nothing arrives for the
+// idle timeout
+func (p *TCPPeer) Read(b []byte) (int, error) {
+	if p.idleTimeout > 0 {
+		p.Conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+	}
+	return p.Conn.Read(b)
+}
+
+// write writes to the connection, failing once the remote takes nothing
+// for the idle timeout. A write cut off midway leaves a partial frame, so
+// the connection is closed. Callers hold writeMu.
+func (p *TCPPeer) write(b []byte) (int, error) {
+	if p.idleTimeout > 0 {
+		p.Conn.SetWriteDeadline(time.Now().Add(p.idleTimeout))
+	}
+	n, err := p.Conn.Write(b)
+	if isTimeout(err) {
+		p.Conn.Close()
+	}
+	return n, err
+}
+
+// awaitFrame waits for the first byte of the next frame. Peers that are
+// not heartbeated may stay quiet for any time between frames.
+func (p *TCPPeer) awaitFrame(marker []byte) error {
+	if !p.heartbeating.Load() {
+		p.Conn.SetReadDeadline(time.Time{})
+		// Checked again, StartHeartbeat may have set a deadline meanwhile
+		if !p.heartbeating.Load() {
+			_, err := io.ReadFull(p.Conn, marker)
+			return err
+		}
+	}
+	_, err := io.ReadFull(p, marker)
+	return err
+}
+
+// isTimeout reports whether err is a deadline passing
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	joined := make(chan Peer, 4)
+	closed := make(chan Peer, 4)
+	newTransport := func(addr string) *TCPTransport {
+		tr := NewTCPTransport(TCPTransportOpts{
+			ListenAddr:        addr,
+			HandshakeFunc:     NOPHandshakeFunc,
+			Decoder:           DefaultDecoder{},
+			HeartbeatInterval: 50 * time.Millisecond,
+			IdleTimeout:       200 * time.Millisecond,
+			OnPeer: func(p Peer) error {
+				joined <- p
+				return nil
+			},
+			OnPeerClose: func(p Peer) { closed <- p },
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	a := newTransport("127.0.0.1:3180")
+	newTransport("127.0.0.1:3181")
+
+	// The pongs keep a quiet connection to a live node open
+	assert.Nil(t, a.Dial("127.0.0.1:3181"))
+	for range 2 {
+		(<-joined).(*TCPPeer).StartHeartbeat()
+	}
+	select {
+	case p := <-closed:
+		t.Fatalf("live connection to %s closed", p.RemoteAddr())
+	case <-time.After(time.Second):
+	}
+
+	// A node that stops answering is dropped after the idle timeout
+	conn, err := net.Dial("tcp", "127.0.0.1:3180")
+	assert.Nil(t, err)
+	defer conn.Close()
+	(<-joined).(*TCPPeer).StartHeartbeat()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent connection was not closed")
+	}
+
+	// A stream stalling midway fails instead of waiting forever
+	conn, err = net.Dial("tcp", "127.0.0.1:3180")
+	assert.Nil(t, err)
+	defer conn.Close()
+	peer := <-joined
+	conn.Write([]byte{IncomingStream, 1})
+	rpc := <-a.Consume()
+	assert.True(t, rpc.Stream)
+	buf := make([]byte, 2)
+	_, err = peer.Read(buf)
+	assert.Nil(t, err)
+	_, err = peer.Read(buf)
+	assert.True(t, isTimeout(err))
+	peer.CloseStream()
+}
+
+func TestHeartbeatMisses(t *testing.T) {
+	joined := make(chan Peer, 4)
+	closed := make(chan Peer, 4)
+	newTransport := func(addr string) *TCPTransport {
+		tr := NewTCPTransport(TCPTransportOpts{
+			ListenAddr:        addr,
+			HandshakeFunc:     NOPHandshakeFunc,
+			Decoder:           DefaultDecoder{},
+			HeartbeatInterval: 50 * time.Millisecond,
+			IdleTimeout:       -1,
+			HeartbeatMisses:   3,
+			OnPeer: func(p Peer) error {
+				joined <- p
+				return nil
+			},
+			OnPeerClose: func(p Peer) { closed <- p },
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	a := newTransport("127.0.0.1:3182")
+	newTransport("127.0.0.1:3183")
+
+	// Answered pings measure the round trip
+	assert.Nil(t, a.Dial("127.0.0.1:3183"))
+	var peers []*TCPPeer
+	for range 2 {
+		p := (<-joined).(*TCPPeer)
+		p.StartHeartbeat()
+		peers = append(peers, p)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, p := range peers {
+		assert.Greater(t, p.RTT(), time.Duration(0))
+		assert.False(t, p.Suspect())
+	}
+
+	// A node that stops answering turns suspect, then is dropped, even
+	// without an idle timeout
+	conn, err := net.Dial("tcp", "127.0.0.1:3182")
+	assert.Nil(t, err)
+	defer conn.Close()
+	silent := (<-joined).(*TCPPeer)
+	silent.StartHeartbeat()
+	assert.Eventually(t, silent.Suspect, time.Second, 10*time.Millisecond)
+	select {
+	case p := <-closed:
+		assert.Equal(t, silent, p)
+	case <-time.After(2 * time.Second):
+		t.Fatal("unanswering connection was not closed")
+	}
+	assert.Zero(t, silent.RTT())
+}
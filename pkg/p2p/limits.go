@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default connection limits of the TCP transport
+const (
+	defaultAcceptRate       = 10 // accepts per second from one source IP
+	defaultAcceptBurst      = 20
+	defaultBreakerThreshold = 5 // failed dials of an address before it is left alone
+	defaultBreakerCooldown  = 30 * time.Second
+	maxBreakerBackoff       = 16 // cooldowns a breaker opens for at most, doubling per failed trial
+	maxAcceptBuckets        = 1024
+)
+
+// ErrCircuitOpen is returned by Dial for an address that failed to connect
+// BreakerThreshold times in a row, until its cooldown is over
+var ErrCircuitOpen = errors.New("dialing suspended after repeated failures")
+
+// Discovery, peer exchange and bootstrap may all find the same address. A
+// dial of an address already being dialed waits for that dial instead of
+// opening a second connection, and an address whose dials keep failing is
+// not dialed again for BreakerCooldown, doubling each time the first dial
+// after the cooldown fails too. Inbound, each source IP may open
+// AcceptRate connections a second, in bursts of AcceptBurst; the ones over
+// the limit are closed before the handshake.
+
+// acceptBucket is the token bucket of one source IP
+type acceptBucket struct {
+	tokens  float64
+	updated time.Time
+	limited bool // connections were refused since the last one accepted
+}
+
+// breaker tracks the failed dials of one address
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// dialCall is a dial in progress others wait for
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// limits holds the per-address state of the connection limits
+type limits struct {
+	mu       sync.Mutex
+	buckets  map[string]*acceptBucket
+	breakers map[string]*breaker
+	dials    map[string]*dialCall
+}
+
+// allowAccept reports whether a connection from conn's source IP is within
+// the accept rate, logging when an IP starts being refused
+func (t *TCPTransport) allowAccept(conn net.Conn) bool {
+	if t.AcceptRate <= 0 {
+		return true
+	}
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	t.limits.mu.Lock()
+	defer t.limits.mu.Unlock()
+	now := time.Now()
+	burst := float64(t.AcceptBurst)
+	b, ok := t.limits.buckets[ip]
+	if !ok {
+		if len(t.limits.buckets) >= maxAcceptBuckets {
+			t.pruneBuckets(now)
+		}
+		b = &acceptBucket{tokens: burst, updated: now}
+		t.limits.buckets[ip] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.updated).Seconds()*t.AcceptRate)
+	b.updated = now
+	if b.tokens < 1 {
+		if !b.limited {
+			log.Printf("Refusing connections from %s, more than %v a second", ip, t.AcceptRate)
+		}
+		b.limited = true
+		return false
+	}
+	b.tokens--
+	b.limited = false
+	return true
+}
+
+// pruneBuckets forgets the source IPs whose buckets refilled, which are
+// the same as new ones. Callers hold limits.mu.
+func (t *TCPTransport) pruneBuckets(now time.Time) {
+	full := time.Duration(float64(t.AcceptBurst) / t.AcceptRate * float64(time.Second))
+	for ip, b := range t.limits.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(t.limits.buckets, ip)
+		}
+	}
+}
+
+// beginDial returns the dial of addr in progress, or registers a new one
+// if the breaker of addr lets it through
+func (t *TCPTransport) beginDial(addr string) (call *dialCall, leader bool, err error) {
+	t.limits.mu.Lock()
+	defer t.limits.mu.Unlock()
+	if call, ok := t.limits.dials[addr]; ok {
+		return call, false, nil
+	}
+	if b, ok := t.limits.breakers[addr]; ok && time.Now().Before(b.openUntil) {
+		return nil, false, ErrCircuitOpen
+	}
+	call = &dialCall{done: make(chan struct{})}
+	t.limits.dials[addr] = call
+	return call, true, nil
+}
+
+// endDial records the outcome of a dial of addr and hands it to the dials
+// that waited for it
+func (t *TCPTransport) endDial(addr string, call *dialCall, err error) {
+	t.limits.mu.Lock()
+	delete(t.limits.dials, addr)
+	if t.BreakerThreshold > 0 {
+		if err == nil {
+			delete(t.limits.breakers, addr)
+		} else {
+			b, ok := t.limits.breakers[addr]
+			if !ok {
+				b = &breaker{}
+				t.limits.breakers[addr] = b
+			}
+			b.failures++
+			if over := b.failures - t.BreakerThreshold; over >= 0 {
+				cooldown := t.BreakerCooldown * time.Duration(min(1<<over, maxBreakerBackoff))
+				b.openUntil = time.Now().Add(cooldown)
+				log.Printf("Not dialing %s for %v after %d failed dials", addr, cooldown, b.failures)
+			}
+		}
+	}
+	t.limits.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+}
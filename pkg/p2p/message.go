@@ -1,15 +1,40 @@
 package p2p
 
+import (
+	"encoding/binary"
+	"io"
+)
+
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+	IncomingMux     = 0x3 // a frame of a multiplexed stream, see TCPPeer.OpenStream
+	IncomingPing    = 0x4 // asks for a pong, see TCPPeer.StartHeartbeat
+	IncomingPong    = 0x5
 )
 
+// MaxMessageSize bounds the payload of a single framed message
+const MaxMessageSize = 16 * 1024 * 1024
+
+// EncodeMessage frames a payload as one message on the wire:
+// the IncomingMessage marker, a 4-byte big-endian length, then the payload.
+// The frame is returned as a single buffer so it can be written in one call.
+func EncodeMessage(payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = IncomingMessage
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
+
 // RPC (Remote Procedure Call) to encapsulate messages and streams sent over the network.
 type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	// Body carries a multiplexed stream, read from it instead of the Peer
+	// and closed when done. The transport keeps delivering RPCs meanwhile.
+	Body io.ReadCloser
 }
 
 // example : rpc := RPC{
@@ -0,0 +1,300 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Multiplexed streams share a connection with messages and with each other,
+// so a large transfer no longer holds up everything else sent to the peer.
+// Each frame starts with the IncomingMux marker, then the frame type, the
+// stream ID and a length, big-endian. Data frames carry length bytes of the
+// stream. The node that dialed the connection numbers its streams odd, the
+// one that accepted it even.
+//
+// A sender may be up to muxWindowSize bytes ahead of the receiver. The
+// receiver returns the window with muxWindow frames as it reads, so a slow
+// reader holds back its own stream and not the connection.
+const (
+	muxOpen   byte = iota + 1 // the sender starts a stream
+	muxData                   // bytes of a stream
+	muxClose                  // the sender is done, the receiver reads to EOF
+	muxReset                  // the receiver stopped reading, the sender gives up
+	muxWindow                 // the receiver read length bytes, the sender may send as many more
+)
+
+const (
+	muxHeaderSize = 9
+	muxFrameSize  = 32 * 1024 // most bytes in one data frame, so other streams get their turn
+	muxWindowSize = 256 * 1024
+)
+
+// ErrStreamReset is returned by writes to a stream the receiver stopped
+// reading
+var ErrStreamReset = errors.New("stream reset by peer")
+
+// muxStream is one multiplexed stream. The node that opened it writes, the
+// other reads.
+type muxStream struct {
+	peer     *TCPPeer
+	id       uint32
+	outbound bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer // received and not read yet
+	consumed int          // read since the window was last returned
+	window   int          // bytes the sender may send before the receiver reads
+	eof      bool
+	err      error // reset, or the connection closed
+	closed   bool
+}
+
+func newMuxStream(peer *TCPPeer, id uint32, outbound bool) *muxStream {
+	st := &muxStream{peer: peer, id: id, outbound: outbound, window: muxWindowSize}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		for st.window == 0 && st.err == nil && !st.closed {
+			st.cond.Wait()
+		}
+		if err := st.err; err != nil || st.closed {
+			st.mu.Unlock()
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+			return written, err
+		}
+		n := min(len(b), st.window, muxFrameSize)
+		st.window -= n
+		st.mu.Unlock()
+
+		if err := st.peer.writeFrame(muxData, st.id, uint32(n), b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 && !st.eof && st.err == nil && !st.closed {
+		st.cond.Wait()
+	}
+	if st.buf.Len() == 0 {
+		defer st.mu.Unlock()
+		switch {
+		case st.eof:
+			return 0, io.EOF
+		case st.err != nil:
+			return 0, st.err
+		}
+		return 0, io.ErrClosedPipe
+	}
+	n, _ := st.buf.Read(b)
+	st.consumed += n
+	var returned int
+	if st.consumed >= muxWindowSize/2 && !st.eof {
+		returned, st.consumed = st.consumed, 0
+	}
+	st.mu.Unlock()
+
+	if returned > 0 {
+		// A broken connection shows up on the next read
+		st.peer.writeFrame(muxWindow, st.id, uint32(returned), nil)
+	}
+	return n, nil
+}
+
+// Close ends the stream. The sender tells the receiver it reached the end;
+// a receiver that closes before the end makes the sender give up.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	finished := st.err != nil || (!st.outbound && st.eof)
+	st.buf.Reset()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.peer.removeStream(st.id)
+	switch {
+	case finished:
+		return nil
+	case st.outbound:
+		return st.peer.writeFrame(muxClose, st.id, 0, nil)
+	}
+	return st.peer.writeFrame(muxReset, st.id, 0, nil)
+}
+
+// receive queues bytes of the stream read off the connection
+func (st *muxStream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	if st.buf.Len()+st.consumed+len(data) > muxWindowSize {
+		return fmt.Errorf("stream %d overran its window", st.id)
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	return nil
+}
+
+// update applies a frame other than data from the remote end
+func (st *muxStream) update(typ byte, length uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch typ {
+	case muxClose:
+		st.eof = true
+	case muxReset:
+		st.fail(ErrStreamReset)
+	case muxWindow:
+		st.window += int(length)
+	}
+	st.cond.Broadcast()
+}
+
+// fail ends the stream with err. Callers hold mu.
+func (st *muxStream) fail(err error) {
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
+
+// rawStream is a stream sent the way nodes without multiplexing expect it:
+// the IncomingStream marker and then the bytes, with the connection to
+// itself until Close
+type rawStream struct {
+	peer *TCPPeer
+	once sync.Once
+}
+
+func (r *rawStream) Write(b []byte) (int, error) {
+	return r.peer.write(b)
+}
+
+func (r *rawStream) Close() error {
+	r.once.Do(r.peer.writeMu.Unlock)
+	return nil
+}
+
+// OpenStream starts a stream to the remote node and returns the writer for
+// its bytes. With mux the stream is multiplexed, which the remote node must
+// support. Without it no other frame is written to the connection until the
+// stream is closed.
+func (p *TCPPeer) OpenStream(mux bool) (io.WriteCloser, error) {
+	if !mux {
+		p.writeMu.Lock()
+		if _, err := p.write([]byte{IncomingStream}); err != nil {
+			p.writeMu.Unlock()
+			return nil, err
+		}
+		return &rawStream{peer: p}, nil
+	}
+
+	p.streamsMu.Lock()
+	id := p.nextStream
+	p.nextStream += 2
+	st := newMuxStream(p, id, true)
+	p.streams[id] = st
+	p.streamsMu.Unlock()
+
+	if err := p.writeFrame(muxOpen, id, 0, nil); err != nil {
+		p.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// writeFrame writes one mux frame in a single write
+func (p *TCPPeer) writeFrame(typ byte, id uint32, length uint32, data []byte) error {
+	frame := make([]byte, 1+muxHeaderSize, 1+muxHeaderSize+len(data))
+	frame[0] = IncomingMux
+	frame[1] = typ
+	binary.BigEndian.PutUint32(frame[2:6], id)
+	binary.BigEndian.PutUint32(frame[6:10], length)
+	return p.Send(append(frame, data...))
+}
+
+func (p *TCPPeer) removeStream(id uint32) {
+	p.streamsMu.Lock()
+	defer p.streamsMu.Unlock()
+	delete(p.streams, id)
+}
+
+// closeStreams fails every open stream once the connection is gone
+func (p *TCPPeer) closeStreams() {
+	p.streamsMu.Lock()
+	defer p.streamsMu.Unlock()
+	for id, st := range p.streams {
+		st.mu.Lock()
+		st.fail(io.ErrUnexpectedEOF)
+		st.mu.Unlock()
+		delete(p.streams, id)
+	}
+}
+
+// readFrame reads the mux frame that follows an IncomingMux marker. A
+// stream the remote opens is returned, to be delivered as an RPC.
+func (p *TCPPeer) readFrame() (*muxStream, error) {
+	header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(p, header); err != nil {
+		return nil, err
+	}
+	typ := header[0]
+	id := binary.BigEndian.Uint32(header[1:5])
+	length := binary.BigEndian.Uint32(header[5:9])
+
+	p.streamsMu.Lock()
+	st := p.streams[id]
+	p.streamsMu.Unlock()
+
+	switch typ {
+	case muxOpen:
+		if st != nil || id%2 == p.nextStream%2 {
+			return nil, fmt.Errorf("remote opened stream %d, which is taken", id)
+		}
+		st = newMuxStream(p, id, false)
+		p.streamsMu.Lock()
+		p.streams[id] = st
+		p.streamsMu.Unlock()
+		return st, nil
+	case muxData:
+		if length > muxFrameSize {
+			return nil, fmt.Errorf("data frame of %d bytes exceeds limit of %d bytes", length, muxFrameSize)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(p, data); err != nil {
+			return nil, err
+		}
+		if st == nil {
+			// Closed by this node, the remote learns of it from the reset
+			return nil, nil
+		}
+		return nil, st.receive(data)
+	case muxClose, muxReset, muxWindow:
+		if st != nil {
+			st.update(typ, length)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown mux frame type %d", typ)
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxStreams(t *testing.T) {
+	joined := make(chan Peer, 2)
+	newTransport := func(addr string) *TCPTransport {
+		tr := NewTCPTransport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				joined <- p
+				return nil
+			},
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	a := newTransport("127.0.0.1:3170")
+	b := newTransport("127.0.0.1:3171")
+	assert.Nil(t, a.Dial("127.0.0.1:3171"))
+	var toB *TCPPeer
+	for range 2 {
+		if p := (<-joined).(*TCPPeer); p.outbound {
+			toB = p
+		}
+	}
+
+	recv := func() RPC {
+		select {
+		case rpc := <-b.Consume():
+			return rpc
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an RPC")
+			return RPC{}
+		}
+	}
+
+	// Two streams, each larger than the window, written at once
+	bodies := [][]byte{bytes.Repeat([]byte{1}, 3*muxWindowSize), bytes.Repeat([]byte{2}, 2*muxWindowSize)}
+	errs := make(chan error, len(bodies))
+	for _, body := range bodies {
+		w, err := toB.OpenStream(true)
+		assert.Nil(t, err)
+		go func() {
+			_, err := w.Write(body)
+			errs <- errors.Join(err, w.Close())
+		}()
+	}
+	first, second := recv(), recv()
+	assert.True(t, first.Stream && second.Stream)
+
+	// A message gets through while both streams wait for their reader
+	assert.Nil(t, toB.Send(EncodeMessage([]byte("meanwhile"))))
+	assert.Equal(t, "meanwhile", string(recv().Payload))
+
+	// The second stream is read first, the first is not in its way
+	got, err := io.ReadAll(second.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, bodies[1], got)
+	got, err = io.ReadAll(first.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, bodies[0], got)
+	for range bodies {
+		assert.Nil(t, <-errs)
+	}
+	first.Body.Close()
+	second.Body.Close()
+
+	// A receiver that stops reading makes the sender give up
+	w, err := toB.OpenStream(true)
+	assert.Nil(t, err)
+	go func() {
+		_, err := w.Write(make([]byte, 4*muxWindowSize))
+		errs <- err
+	}()
+	rpc := recv()
+	rpc.Body.Close()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrStreamReset)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender kept writing to a reset stream")
+	}
+
+	// Streams not multiplexed still have the connection to themselves
+	w, err = toB.OpenStream(false)
+	assert.Nil(t, err)
+	go func() {
+		w.Write([]byte("raw"))
+		w.Close()
+	}()
+	rpc = recv()
+	assert.True(t, rpc.Stream)
+	assert.Nil(t, rpc.Body)
+}
@@ -0,0 +1,172 @@
+// Package p2ptest provides a conformance suite for p2p.Transport
+// implementations. Third-party transports run it from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		p2ptest.TestTransport(t, newMyTransport, func() string { return nextAddr() })
+//	}
+package p2ptest
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// timeout bounds every wait in the suite
+const timeout = 5 * time.Second
+
+// node is a transport under test together with the peers it reported
+type node struct {
+	tr     p2p.Transport
+	mu     sync.Mutex
+	peers  map[string]p2p.Peer
+	joined chan p2p.Peer
+	closed chan p2p.Peer
+}
+
+func newNode(t *testing.T, factory p2p.TransportFactory, addr string) *node {
+	t.Helper()
+
+	n := &node{
+		peers:  make(map[string]p2p.Peer),
+		joined: make(chan p2p.Peer, 16),
+		closed: make(chan p2p.Peer, 16),
+	}
+	tr, err := factory(p2p.TransportOptions{
+		ListenAddr:    addr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		OnPeer: func(p p2p.Peer) error {
+			n.mu.Lock()
+			n.peers[p.RemoteAddr().String()] = p
+			n.mu.Unlock()
+			n.joined <- p
+			return nil
+		},
+		OnPeerClose: func(p p2p.Peer) {
+			n.closed <- p
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating transport on %s: %v", addr, err)
+	}
+	if err := tr.ListenAndAccept(); err != nil {
+		t.Fatalf("listening on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { tr.Close() })
+
+	n.tr = tr
+	return n
+}
+
+func (n *node) peer(t *testing.T, addr string) p2p.Peer {
+	t.Helper()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p, ok := n.peers[addr]
+	if !ok {
+		t.Fatalf("RPC.From %s does not match any peer passed to OnPeer", addr)
+	}
+	return p
+}
+
+func waitPeer(t *testing.T, ch chan p2p.Peer, what string) p2p.Peer {
+	t.Helper()
+	select {
+	case p := <-ch:
+		return p
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for %s", what)
+		return nil
+	}
+}
+
+func waitRPC(t *testing.T, n *node) p2p.RPC {
+	t.Helper()
+	select {
+	case rpc := <-n.tr.Consume():
+		return rpc
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for an RPC")
+		return p2p.RPC{}
+	}
+}
+
+// TestTransport checks that transports built by factory follow the contract
+// documented on p2p.Transport and p2p.Peer. nextAddr must return a new
+// address the transport can listen on every time it is called.
+func TestTransport(t *testing.T, factory p2p.TransportFactory, nextAddr func() string) {
+	a := newNode(t, factory, nextAddr())
+	b := newNode(t, factory, nextAddr())
+
+	if err := a.tr.Dial(b.tr.Addr()); err != nil {
+		t.Fatalf("dial %s: %v", b.tr.Addr(), err)
+	}
+
+	// OnPeer runs on both ends of the connection
+	toB := waitPeer(t, a.joined, "OnPeer on the dialing side")
+	toA := waitPeer(t, b.joined, "OnPeer on the accepting side")
+
+	t.Run("Message", func(t *testing.T) {
+		payload := []byte("hello over the conformance suite")
+		if err := toB.Send(p2p.EncodeMessage(payload)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+
+		rpc := waitRPC(t, b)
+		if rpc.Stream {
+			t.Fatal("message delivered as a stream")
+		}
+		if !bytes.Equal(rpc.Payload, payload) {
+			t.Fatalf("payload = %q, want %q", rpc.Payload, payload)
+		}
+		if got := b.peer(t, rpc.From); got != toA {
+			t.Fatalf("RPC.From %s maps to a different peer", rpc.From)
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		body := bytes.Repeat([]byte("stream body "), 1024)
+		go func() {
+			toA.Send([]byte{p2p.IncomingStream})
+			toA.Send(body)
+			toA.Send(p2p.EncodeMessage([]byte("after stream")))
+		}()
+
+		rpc := waitRPC(t, a)
+		if !rpc.Stream {
+			t.Fatal("stream marker not delivered as a stream RPC")
+		}
+
+		// The transport must leave the stream bytes for the receiver
+		got := make([]byte, len(body))
+		if _, err := io.ReadFull(a.peer(t, rpc.From), got); err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatal("stream body corrupted")
+		}
+		a.peer(t, rpc.From).CloseStream()
+
+		// Message decoding resumes after CloseStream
+		rpc = waitRPC(t, a)
+		if rpc.Stream || string(rpc.Payload) != "after stream" {
+			t.Fatalf("unexpected RPC after stream: %+v", rpc)
+		}
+	})
+
+	t.Run("OnPeerClose", func(t *testing.T) {
+		toB.Close()
+		waitPeer(t, b.closed, "OnPeerClose on the remote side")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		if err := b.tr.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// TransportOptions configures a transport created through the registry
+type TransportOptions struct {
+	ListenAddr    string
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(Peer) error
+	OnPeerClose   func(Peer)
+	// Listener is an already-open listener, e.g. inherited across a restart.
+	// Transports that cannot use it ignore it.
+	Listener net.Listener
+	// Params holds transport specific settings from the configuration
+	Params map[string]string
+}
+
+// TransportFactory creates a transport from options
+type TransportFactory func(opts TransportOptions) (Transport, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = make(map[string]TransportFactory)
+)
+
+// RegisterTransport makes a transport available by name. Third-party
+// transports call it from an init function. It panics if the name is
+// already taken, like database/sql.Register.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if factory == nil {
+		panic("p2p: RegisterTransport factory is nil")
+	}
+	if _, dup := transports[name]; dup {
+		panic("p2p: RegisterTransport called twice for transport " + name)
+	}
+	transports[name] = factory
+}
+
+// NewTransport creates a transport registered under name
+func NewTransport(name string, opts TransportOptions) (Transport, error) {
+	transportsMu.RLock()
+	factory, ok := transports[name]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q (available: %v)", name, Transports())
+	}
+
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = NOPHandshakeFunc
+	}
+	if opts.Decoder == nil {
+		opts.Decoder = DefaultDecoder{}
+	}
+	return factory(opts)
+}
+
+// Transports returns the names of all registered transports
+func Transports() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
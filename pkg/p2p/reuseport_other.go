@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package p2p
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort is not available on this platform, so hole punching is not
+// either
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("sharing a port between sockets is not supported on this platform")
+}
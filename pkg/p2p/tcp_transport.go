@@ -1,28 +1,72 @@
 package p2p
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer records a span per dial, a no-op unless the application installs
+// a tracer provider
+var tracer = otel.Tracer("github.com/AdityaKrSingh26/PeerVault/pkg/p2p")
+
 // TCPPeer is a struct that implements the Peer interface and represents a connection to another node over TCP.
 type TCPPeer struct {
 	net.Conn
 	outbound bool
 	wg       *sync.WaitGroup
+	writeMu  sync.Mutex // one frame at a time, or the whole of a stream that is not multiplexed
+
+	// Multiplexed streams by ID (mux.go)
+	streamsMu  sync.Mutex
+	streams    map[uint32]*muxStream
+	nextStream uint32
+
+	// Liveness checks (heartbeat.go)
+	idleTimeout       time.Duration
+	heartbeatInterval time.Duration
+	heartbeatOnce     sync.Once
+	heartbeatMisses   int
+	heartbeating      atomic.Bool
+	pingSent          atomic.Int64 // when the oldest unanswered ping was sent, in Unix nanoseconds
+	missed            atomic.Int32 // pings in a row left unanswered for a heartbeat interval
+	rtt               atomic.Int64 // smoothed round trip of pings
+	closed            chan struct{}
 }
 
 // Creates a new TCPPeer instance.
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+	p := &TCPPeer{
+		Conn:       conn,
+		outbound:   outbound,
+		wg:         &sync.WaitGroup{},
+		streams:    make(map[uint32]*muxStream),
+		nextStream: 2,
+		closed:     make(chan struct{}),
+	}
+	if outbound {
+		p.nextStream = 1
 	}
+	return p
+}
+
+// Outbound reports whether this node dialed the connection
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
 }
 
 // Signals that a stream of data has finished.
@@ -32,18 +76,40 @@ func (p *TCPPeer) CloseStream() {
 
 // send data to remote node
 func (p *TCPPeer) Send(B []byte) error {
-	_, err := p.Conn.Write(B)
+	_, err := p.Write(B)
 	return err
 }
 
+// Write writes to the connection, never in the middle of another frame
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.write(b)
+}
+
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	OnPeerClose   func(Peer)    // Called when a peer accepted by OnPeer disconnects
 	DialTimeout   time.Duration // Timeout for dialing peers
 	MaxRetries    int           // Maximum connection retry attempts
 	RetryDelay    time.Duration // Delay between retries
+	Listener      net.Listener  // Already-open listener, e.g. inherited across a restart
+	ReusePort     bool          // Binds the listener so Punch can dial from the listening port
+
+	// Liveness checks, see heartbeat.go. A negative value turns one off.
+	IdleTimeout       time.Duration // Longest wait on a read or write, 3 heartbeat intervals by default
+	HeartbeatInterval time.Duration // Time between pings to peers that answer them, 15s by default
+	KeepAlive         time.Duration // TCP keep-alive period, the OS default if 0
+	HeartbeatMisses   int           // Unanswered pings in a row before a connection is closed, 3 by default
+
+	// Connection limits, see limits.go. A negative value turns one off.
+	AcceptRate       float64       // Connections accepted a second from one source IP, 10 by default
+	AcceptBurst      int           // Connections one source IP may open at once, 20 by default
+	BreakerThreshold int           // Failed dials of an address before it is not dialed for a while, 5 by default
+	BreakerCooldown  time.Duration // How long an address is not dialed after failing, 30s by default
 }
 
 // manage TCP connections and communication with other nodes.
@@ -51,13 +117,112 @@ type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+	limits   limits
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.HeartbeatMisses == 0 {
+		opts.HeartbeatMisses = defaultIdleMisses
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = defaultIdleMisses * defaultHeartbeatInterval
+		if opts.HeartbeatInterval > 0 {
+			opts.IdleTimeout = defaultIdleMisses * opts.HeartbeatInterval
+		}
+	}
+	if opts.AcceptRate == 0 {
+		opts.AcceptRate = defaultAcceptRate
+	}
+	if opts.AcceptBurst <= 0 {
+		opts.AcceptBurst = max(defaultAcceptBurst, int(opts.AcceptRate))
+	}
+	if opts.BreakerThreshold == 0 {
+		opts.BreakerThreshold = defaultBreakerThreshold
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = defaultBreakerCooldown
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
+		limits: limits{
+			buckets:  make(map[string]*acceptBucket),
+			breakers: make(map[string]*breaker),
+			dials:    make(map[string]*dialCall),
+		},
+	}
+}
+
+func init() {
+	RegisterTransport("tcp", newTCPTransportFromOptions)
+}
+
+// newTCPTransportFromOptions builds a TCP transport from registry options.
+// Supported params: dial_timeout, retry_delay, idle_timeout,
+// heartbeat_interval, keep_alive, breaker_cooldown (durations), max_retries,
+// heartbeat_misses, accept_burst, breaker_threshold (integers), accept_rate (per second) and
+// reuse_port (bool).
+func newTCPTransportFromOptions(opts TransportOptions) (Transport, error) {
+	tcpOpts := TCPTransportOpts{
+		ListenAddr:    opts.ListenAddr,
+		HandshakeFunc: opts.HandshakeFunc,
+		Decoder:       opts.Decoder,
+		OnPeer:        opts.OnPeer,
+		OnPeerClose:   opts.OnPeerClose,
+		Listener:      opts.Listener,
 	}
+
+	for name, value := range opts.Params {
+		var err error
+		switch name {
+		case "dial_timeout":
+			tcpOpts.DialTimeout, err = time.ParseDuration(value)
+		case "retry_delay":
+			tcpOpts.RetryDelay, err = time.ParseDuration(value)
+		case "max_retries":
+			tcpOpts.MaxRetries, err = strconv.Atoi(value)
+		case "reuse_port":
+			tcpOpts.ReusePort, err = strconv.ParseBool(value)
+		case "idle_timeout":
+			tcpOpts.IdleTimeout, err = time.ParseDuration(value)
+		case "heartbeat_interval":
+			tcpOpts.HeartbeatInterval, err = time.ParseDuration(value)
+		case "keep_alive":
+			tcpOpts.KeepAlive, err = time.ParseDuration(value)
+		case "heartbeat_misses":
+			tcpOpts.HeartbeatMisses, err = strconv.Atoi(value)
+		case "accept_rate":
+			tcpOpts.AcceptRate, err = strconv.ParseFloat(value, 64)
+		case "accept_burst":
+			tcpOpts.AcceptBurst, err = strconv.Atoi(value)
+		case "breaker_threshold":
+			tcpOpts.BreakerThreshold, err = strconv.Atoi(value)
+		case "breaker_cooldown":
+			tcpOpts.BreakerCooldown, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tcp transport option %s=%q: %w", name, value, err)
+		}
+	}
+
+	return NewTCPTransport(tcpOpts), nil
+}
+
+// Multiplexed reports that the peers of this transport carry several
+// streams at once, see TCPPeer.OpenStream
+func (t *TCPTransport) Multiplexed() bool {
+	return true
+}
+
+// Heartbeats reports that this transport answers pings, so the remote
+// node may call StartHeartbeat on its peer for the connection
+func (t *TCPTransport) Heartbeats() bool {
+	return true
 }
 
 // Return the address it’s listening on
@@ -71,11 +236,51 @@ func (t *TCPTransport) Consume() <-chan RPC {
 
 // close TCP listner and stop receiving new connections
 func (t *TCPTransport) Close() error {
+	if t.listener == nil {
+		// Never listened; a listener handed over is closed all the same
+		if t.Listener != nil {
+			return t.Listener.Close()
+		}
+		return nil
+	}
 	return t.listener.Close()
 }
 
-// implements the Transport interface with timeout and retry logic.
-func (t *TCPTransport) Dial(addr string) error {
+// ListenerFile returns a duplicate of the listening socket as a file.
+// The duplicate stays open after Close, so it can be handed to a new
+// process that keeps accepting connections on the same port.
+func (t *TCPTransport) ListenerFile() (*os.File, error) {
+	l, ok := t.listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("listener is not a TCP listener")
+	}
+	return l.File()
+}
+
+// implements the Transport interface with timeout and retry logic. A dial
+// of an address already being dialed waits for that one, and an address
+// that keeps failing is not dialed until its breaker closes (limits.go).
+func (t *TCPTransport) Dial(addr string) (err error) {
+	_, span := tracer.Start(context.Background(), "p2p.Dial",
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("peer", addr)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	call, leader, err := t.beginDial(addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	if !leader {
+		<-call.done
+		return call.err
+	}
+	defer func() { t.endDial(addr, call, err) }()
+
 	// Set default timeout if not configured
 	timeout := t.DialTimeout
 	if timeout == 0 {
@@ -95,7 +300,6 @@ func (t *TCPTransport) Dial(addr string) error {
 	}
 
 	var conn net.Conn
-	var err error
 
 	// Retry loop
 	for attempt := 1; attempt <= maxRetries; attempt++ {
@@ -103,6 +307,7 @@ func (t *TCPTransport) Dial(addr string) error {
 		if err == nil {
 			// Connection successful
 			go t.handleConn(conn, true)
+			span.SetAttributes(attribute.Int("attempts", attempt))
 			log.Printf("Connected to peer %s on attempt %d", addr, attempt)
 			return nil
 		}
@@ -119,12 +324,65 @@ func (t *TCPTransport) Dial(addr string) error {
 	return fmt.Errorf("failed to connect to %s after %d attempts: %w", addr, maxRetries, err)
 }
 
+// punchRetryDelay is the pause between attempts of a hole punch
+const punchRetryDelay = 200 * time.Millisecond
+
+// Punch connects to addr by TCP simultaneous open, for peers behind NATs
+// that drop unsolicited connections. The connection is opened from the
+// listening port while the remote node punches this node's address at the
+// same time, so each NAT sees outgoing packets and lets the other side's
+// in. Attempts repeat until one succeeds or ctx is done. A connection that
+// reaches the listener instead is accepted as usual, so callers should
+// stop punching once the peer shows up.
+func (t *TCPTransport) Punch(ctx context.Context, addr string) error {
+	if !t.ReusePort || t.listener == nil {
+		return errors.New("hole punching needs a listener bound with ReusePort")
+	}
+	local, ok := t.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("listener address %s is not a TCP address", t.listener.Addr())
+	}
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: local.Port},
+		Control:   reusePort,
+		Timeout:   time.Second,
+	}
+
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			go t.handleConn(conn, true)
+			log.Printf("Punched through to peer %s", addr)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to punch through to %s: %w", addr, err)
+		case <-time.After(punchRetryDelay):
+		}
+	}
+}
+
+// AddConn hands the transport a connection opened elsewhere, e.g. through a
+// relay, to be handled like one it dialed or accepted
+func (t *TCPTransport) AddConn(conn net.Conn, outbound bool) {
+	go t.handleConn(conn, outbound)
+}
+
 // start listening for incoming connections.
 func (t *TCPTransport) ListenAndAccept() error {
-	var err error
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
-	if err != nil {
-		return err
+	if t.Listener != nil {
+		t.listener = t.Listener
+	} else {
+		var lc net.ListenConfig
+		if t.ReusePort {
+			lc.Control = reusePort
+		}
+		var err error
+		t.listener, err = lc.Listen(context.Background(), "tcp", t.ListenAddr)
+		if err != nil {
+			return err
+		}
 	}
 	go t.startAcceptLoop()
 	log.Printf("TCP transport listening on %s\n", t.ListenAddr)
@@ -140,6 +398,11 @@ func (t *TCPTransport) startAcceptLoop() {
 		}
 		if err != nil {
 			log.Printf("TCP Error accepting connection: %s\n", err)
+			continue
+		}
+		if !t.allowAccept(conn) {
+			conn.Close()
+			continue
 		}
 		go t.handleConn(conn, false)
 	}
@@ -152,6 +415,7 @@ func (t *TCPTransport) startAcceptLoop() {
 // 3. Calls the OnPeer callback. Notifies the application that a new peer has been connected.
 // 4. Enters a read loop to decode and process incoming messages.
 // 5. If the message is a stream, it waits for the stream to finish before continuing.
+// 6. A multiplexed stream is delivered with a Body and the loop goes on (mux.go).
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	// Always close connection when function exits
 	defer func() {
@@ -160,21 +424,60 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	}()
 
 	peer := NewTCPPeer(conn, outbound)
+	defer close(peer.closed)
 	var err error
 
+	if tcpConn, ok := conn.(*net.TCPConn); ok && t.KeepAlive != 0 {
+		tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: t.KeepAlive > 0, Idle: t.KeepAlive, Interval: t.KeepAlive})
+	}
+
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
 	}
+	peer.idleTimeout = t.IdleTimeout
+	peer.heartbeatInterval = t.HeartbeatInterval
+	peer.heartbeatMisses = t.HeartbeatMisses
 
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
 			return
 		}
 	}
+	if t.OnPeerClose != nil {
+		defer t.OnPeerClose(peer)
+	}
+	defer peer.closeStreams()
 
+	marker := make([]byte, 1)
 	for {
+		if err = peer.awaitFrame(marker); err != nil {
+			if isTimeout(err) {
+				log.Printf("[%s] nothing received for %v, closing connection", conn.RemoteAddr(), t.IdleTimeout)
+			}
+			return
+		}
+		switch marker[0] {
+		case IncomingPing:
+			go peer.Send([]byte{IncomingPong})
+			continue
+		case IncomingPong:
+			peer.pong()
+			continue
+		}
+		if marker[0] == IncomingMux {
+			var st *muxStream
+			if st, err = peer.readFrame(); err != nil {
+				log.Printf("[%s] dropping connection: %v", conn.RemoteAddr(), err)
+				return
+			}
+			if st != nil {
+				t.rpcch <- RPC{From: conn.RemoteAddr().String(), Stream: true, Body: st}
+			}
+			continue
+		}
+
 		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
+		err = t.Decoder.Decode(io.MultiReader(bytes.NewReader(marker), peer), &rpc)
 		if err != nil {
 			return
 		}
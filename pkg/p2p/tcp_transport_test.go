@@ -1,7 +1,10 @@
 package p2p
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,3 +22,163 @@ func TestTCPTransport(t *testing.T) {
 	// checks that the ListenAndAccept method of the TCPTransport instance returns nil
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestTCPTransportListenerHandoff(t *testing.T) {
+	old := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:3100",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	})
+	assert.Nil(t, old.ListenAndAccept())
+
+	f, err := old.ListenerFile()
+	assert.Nil(t, err)
+	defer f.Close()
+
+	// The new transport keeps accepting on the same port after the old one closes
+	l, err := net.FileListener(f)
+	assert.Nil(t, err)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:3100",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		Listener:      l,
+	})
+	assert.Nil(t, old.Close())
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3100")
+	assert.Nil(t, err)
+	conn.Close()
+}
+
+func TestTCPTransportPunch(t *testing.T) {
+	joined := make(chan Peer, 4)
+	newTransport := func(addr string, reusePort bool) *TCPTransport {
+		tr := NewTCPTransport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			ReusePort:     reusePort,
+			OnPeer: func(p Peer) error {
+				joined <- p
+				return nil
+			},
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+
+	// Both sides punch at once; the connection comes from the listening ports
+	a := newTransport("127.0.0.1:3150", true)
+	b := newTransport("127.0.0.1:3151", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { errs <- a.Punch(ctx, "127.0.0.1:3151") }()
+	go func() { errs <- b.Punch(ctx, "127.0.0.1:3150") }()
+
+	var p Peer
+	select {
+	case p = <-joined:
+	case <-ctx.Done():
+		t.Fatal("no connection punched through")
+	}
+	ports := []string{"127.0.0.1:3150", "127.0.0.1:3151"}
+	assert.Contains(t, ports, p.LocalAddr().String())
+	assert.Contains(t, ports, p.RemoteAddr().String())
+	cancel()
+	<-errs
+	<-errs
+
+	// Without a shared port there is nothing to punch from
+	c := newTransport("127.0.0.1:3152", false)
+	assert.NotNil(t, c.Punch(context.Background(), "127.0.0.1:3150"))
+}
+
+func TestNetworkHandshake(t *testing.T) {
+	handshake := func(local, remote string) (error, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer l.Close()
+
+		accepted := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				accepted <- err
+				return
+			}
+			defer conn.Close()
+			accepted <- NetworkHandshakeFunc(remote)(NewTCPPeer(conn, false))
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.Nil(t, err)
+		defer conn.Close()
+		return NetworkHandshakeFunc(local)(NewTCPPeer(conn, true)), <-accepted
+	}
+
+	dialed, accepted := handshake("office", "office")
+	assert.Nil(t, dialed)
+	assert.Nil(t, accepted)
+
+	dialed, accepted = handshake("office", "lab")
+	assert.ErrorIs(t, dialed, ErrNetworkMismatch)
+	assert.ErrorIs(t, accepted, ErrNetworkMismatch)
+}
+
+func TestTCPTransportAcceptRate(t *testing.T) {
+	joined := make(chan Peer, 4)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:3190",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		AcceptRate:    0.1,
+		AcceptBurst:   2,
+		OnPeer: func(p Peer) error {
+			joined <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	// The burst is accepted, the connections after it are closed unhandled
+	for range 4 {
+		conn, err := net.Dial("tcp", "127.0.0.1:3190")
+		assert.Nil(t, err)
+		defer conn.Close()
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, joined, 2)
+}
+
+func TestTCPTransportDialBreaker(t *testing.T) {
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       "127.0.0.1:3191",
+		HandshakeFunc:    NOPHandshakeFunc,
+		Decoder:          DefaultDecoder{},
+		MaxRetries:       1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  200 * time.Millisecond,
+	})
+
+	// Nothing listens yet; after two failed dials the address is left alone
+	for range 2 {
+		err := tr.Dial("127.0.0.1:3192")
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.ErrorIs(t, tr.Dial("127.0.0.1:3192"), ErrCircuitOpen)
+
+	// Once the cooldown is over the address is tried again
+	l, err := net.Listen("tcp", "127.0.0.1:3192")
+	assert.Nil(t, err)
+	defer l.Close()
+	time.Sleep(250 * time.Millisecond)
+	assert.Nil(t, tr.Dial("127.0.0.1:3192"))
+	assert.Empty(t, tr.limits.breakers)
+}
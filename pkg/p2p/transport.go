@@ -1,17 +1,39 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 // Peer is an interface that represents the remote node.
+//
+// Transport implementations hand a Peer to OnPeer once a connection is
+// established. Reads from the Peer are only valid while a stream is open,
+// that is after an RPC with Stream set has been delivered for it and until
+// CloseStream is called; outside of that the transport owns the read side.
 type Peer interface {
 	net.Conn
+	// Send writes raw bytes to the remote node. Callers frame messages with
+	// EncodeMessage or open a stream with IncomingStream.
 	Send([]byte) error
+	// CloseStream tells the transport that the receiver finished reading a
+	// stream, so it can resume decoding messages from this peer.
 	CloseStream()
 }
 
 // Transport is anything that handles the communication
 // between the nodes in the network. This can be of the
 // form (TCP, UDP, websockets, ...)
+//
+// Implementations must:
+//   - call OnPeer for every connection, inbound and outbound, before
+//     delivering any RPC from it, and drop the connection if it returns an error
+//   - set RPC.From to the RemoteAddr().String() of the Peer passed to OnPeer
+//   - stop delivering RPCs from a peer after an RPC with Stream set and no
+//     Body, until that peer's CloseStream is called
+//   - call OnPeerClose once a peer accepted by OnPeer disconnects
+//
+// The conformance suite in pkg/p2p/p2ptest checks these rules.
 type Transport interface {
 	Addr() string
 	Dial(string) error
@@ -19,3 +41,32 @@ type Transport interface {
 	Consume() <-chan RPC
 	Close() error
 }
+
+// StreamOpener is implemented by peers that can carry several streams over
+// their connection at once. Their transport delivers the streams the
+// remote node opens as RPCs with a Body.
+type StreamOpener interface {
+	// OpenStream starts a stream and returns the writer for its bytes. With
+	// mux false it is sent the way nodes without multiplexing expect.
+	OpenStream(mux bool) (io.WriteCloser, error)
+}
+
+// OpenStream starts a stream to peer, multiplexed if mux is set and the
+// peer supports it. Otherwise the IncomingStream marker is sent and the
+// stream has the connection to itself, so the caller must keep other
+// writes to the peer away until it closes the stream.
+func OpenStream(peer Peer, mux bool) (io.WriteCloser, error) {
+	if opener, ok := peer.(StreamOpener); ok {
+		return opener.OpenStream(mux)
+	}
+	if err := peer.Send([]byte{IncomingStream}); err != nil {
+		return nil, err
+	}
+	return nopCloser{peer}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,348 @@
+// Package peervault embeds a PeerVault node in a Go program. A Node stores
+// files encrypted on local disk, replicates them to the peers it connects
+// to and fetches files it does not hold from them, like the peervault
+// daemon does, without its REPL, metrics server or control APIs.
+//
+//	node, err := peervault.New(peervault.Options{
+//		ListenAddr:  ":3000",
+//		StorageRoot: "/var/lib/myapp/vault",
+//		Key:         key, // 32 bytes shared by every node of the network
+//		Bootstrap:   []string{"vault1.example.com:3000"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err := node.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer node.Close(context.Background())
+//	err = node.Store(ctx, "reports/q3.pdf", f)
+package peervault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdityaKrSingh26/PeerVault/internal/crypto"
+	"github.com/AdityaKrSingh26/PeerVault/internal/events"
+	"github.com/AdityaKrSingh26/PeerVault/internal/network"
+	"github.com/AdityaKrSingh26/PeerVault/internal/quota"
+	"github.com/AdityaKrSingh26/PeerVault/internal/storage"
+	"github.com/AdityaKrSingh26/PeerVault/pkg/p2p"
+)
+
+// FileInfo describes a file stored on a node
+type FileInfo = storage.FileInfo
+
+// Event is something that happened on a node, see Node.Subscribe
+type Event = events.Event
+
+// EventType identifies what happened
+type EventType = events.Type
+
+// Event types delivered by Node.Subscribe
+const (
+	EventStored       = events.FileStored
+	EventReplicated   = events.FileReplicated
+	EventRetrieved    = events.FileRetrieved
+	EventDeleted      = events.FileDeleted
+	EventRestored     = events.FileRestored
+	EventPeerJoined   = events.PeerJoined
+	EventPeerLeft     = events.PeerLeft
+	EventGCFinding    = events.GCFinding
+	EventQuotaWarning = events.QuotaWarning
+)
+
+// Errors returned by Node methods, to be matched with errors.Is
+var (
+	ErrNotFound      = network.ErrNotFound
+	ErrNoPeers       = network.ErrNoPeers
+	ErrQuotaExceeded = network.ErrQuotaExceeded
+	ErrCorrupted     = network.ErrCorrupted
+	ErrReadOnly      = network.ErrReadOnly
+	ErrClosed        = network.ErrServerClosed
+	ErrWriteConcern  = network.ErrWriteConcern
+)
+
+// Options configure a Node. ListenAddr, StorageRoot and Key are required.
+type Options struct {
+	ListenAddr  string // address to accept peers on, e.g. ":3000"
+	StorageRoot string // directory of the stored files and the node's identity
+	Key         []byte // 32-byte network key, shared by every node of the network
+
+	// Network ID checked in the handshake with every peer, derived from
+	// Key if empty
+	NetworkID string
+
+	// Peers to connect to on Start
+	Bootstrap []string
+
+	// Find peers on the local network with mDNS, and learn peers from
+	// connected ones
+	DiscoverLocal bool
+	PeerExchange  bool
+
+	ReplicationFactor int           // copies of each file, including the local one; 3 if 0
+	FetchTimeout      time.Duration // how long a Get waits for peers without progress; 5s if 0
+	Quota             int64         // storage quota in bytes; the saved one, or the default, if 0
+
+	// Peers that must acknowledge a replica before Store returns, 0 to
+	// return once the file is stored locally
+	WriteConcern int
+
+	// Queue the replication of files stored without peers, and tell peers
+	// about deletes, handing both to peers as they reconnect
+	OfflineQueue bool
+
+	// Cipher files are encrypted with, "aes" (the default) or "chacha20",
+	// which is faster on CPUs without AES instructions. Files of either are
+	// always readable.
+	Cipher string
+
+	// Seal files in frames checked as they are read, which suits large
+	// files read in ranges
+	FramedEncryption bool
+
+	// Compress files before they are encrypted, "none" (the default),
+	// "gzip" or "zstd". Files that look compressed already are stored as
+	// they are.
+	Compression string
+
+	// Labels announced to peers, e.g. zone=eu
+	Labels map[string]string
+
+	// Transport registered with p2p.RegisterTransport and its settings;
+	// "tcp" if empty
+	Transport        string
+	TransportOptions map[string]string
+
+	Logger *slog.Logger // slog.Default() if nil
+}
+
+// Node is a running PeerVault node
+type Node struct {
+	opts   Options
+	server *network.FileServer
+
+	mu      sync.Mutex
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+// New creates a node, binding its listen address so that a port in use
+// fails here rather than on Start
+func New(opts Options) (*Node, error) {
+	if opts.ListenAddr == "" {
+		return nil, errors.New("peervault: ListenAddr is required")
+	}
+	if opts.StorageRoot == "" {
+		return nil, errors.New("peervault: StorageRoot is required")
+	}
+	if len(opts.Key) != 32 {
+		return nil, fmt.Errorf("peervault: Key is %d bytes, want 32", len(opts.Key))
+	}
+	suite, err := crypto.ParseSuite(opts.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("peervault: %w", err)
+	}
+	if opts.FramedEncryption {
+		suite = suite.Framed()
+	}
+	compression, err := storage.ParseCompression(opts.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("peervault: %w", err)
+	}
+	if opts.Transport == "" {
+		opts.Transport = "tcp"
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.NetworkID == "" {
+		opts.NetworkID = network.NetworkIDFromKey(opts.Key)
+	}
+	if err := os.MkdirAll(opts.StorageRoot, 0755); err != nil {
+		return nil, fmt.Errorf("peervault: %w", err)
+	}
+
+	server, err := network.NewFileServer(network.FileServerOpts{
+		EncKey:            opts.Key,
+		StorageRoot:       opts.StorageRoot,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		BootstrapNodes:    opts.Bootstrap,
+		Logger:            opts.Logger,
+		FetchTimeout:      opts.FetchTimeout,
+		ReplicationFactor: opts.ReplicationFactor,
+		Labels:            opts.Labels,
+		NetworkID:         opts.NetworkID,
+		WriteConcern:      opts.WriteConcern,
+		OfflineQueue:      opts.OfflineQueue,
+		Cipher:            suite,
+		Compression:       compression,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("peervault: %w", err)
+	}
+	if err := loadQuota(server, opts.Quota); err != nil {
+		return nil, fmt.Errorf("peervault: %w", err)
+	}
+
+	var listener net.Listener
+	if opts.Transport == "tcp" {
+		var err error
+		if listener, err = net.Listen("tcp", opts.ListenAddr); err != nil {
+			return nil, fmt.Errorf("peervault: %w", err)
+		}
+	}
+	transport, err := p2p.NewTransport(opts.Transport, p2p.TransportOptions{
+		ListenAddr:    opts.ListenAddr,
+		HandshakeFunc: p2p.NetworkHandshakeFunc(opts.NetworkID),
+		Decoder:       p2p.DefaultDecoder{},
+		OnPeer:        server.OnPeer,
+		OnPeerClose:   server.OnPeerClose,
+		Listener:      listener,
+		Params:        opts.TransportOptions,
+	})
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("peervault: %w", err)
+	}
+	server.Transport = transport
+
+	return &Node{opts: opts, server: server, done: make(chan struct{})}, nil
+}
+
+// loadQuota applies the saved storage quota, replaced by quota if it is
+// set, or the default quota if none was ever saved
+func loadQuota(server *network.FileServer, limit int64) error {
+	err := server.QuotaManager.Load()
+	if errors.Is(err, quota.ErrNotConfigured) {
+		if limit == 0 {
+			server.QuotaManager.SetMaxStorage(quota.DefaultMaxStorage)
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+	if limit > 0 {
+		server.QuotaManager.SetMaxStorage(limit)
+		return server.QuotaManager.Save()
+	}
+	return nil
+}
+
+// Start accepts peers, connects to the bootstrap peers and enables the
+// discovery the options ask for. The node runs in the background until
+// Close is called or ctx ends.
+func (n *Node) Start(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.started {
+		return errors.New("peervault: node already started")
+	}
+	n.started = true
+
+	if n.opts.DiscoverLocal {
+		if err := n.server.EnableLocalDiscovery(ctx, n.server.AdvertiseAddr()); err != nil {
+			n.opts.Logger.Warn("failed to enable local discovery", "err", err)
+		}
+	}
+	if n.opts.PeerExchange {
+		n.server.EnablePeerExchange(ctx)
+	}
+	go func() {
+		defer close(n.done)
+		n.err = n.server.Start(ctx)
+	}()
+	return nil
+}
+
+// Close stops the node gracefully: it stops accepting peers, waits for
+// running transfers until ctx ends, saves its state and disconnects.
+func (n *Node) Close(ctx context.Context) error {
+	n.mu.Lock()
+	started := n.started
+	n.started = true // a closed node cannot be started
+	n.mu.Unlock()
+	err := n.server.Shutdown(ctx)
+	if !started {
+		close(n.done)
+		return err
+	}
+	select {
+	case <-n.done:
+		return errors.Join(err, n.err)
+	case <-ctx.Done():
+		return errors.Join(err, ctx.Err())
+	}
+}
+
+// Done is closed once the node stopped running
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// ID returns the node's ID, under which it stores its files
+func (n *Node) ID() string {
+	return n.server.ID
+}
+
+// Addr returns the address the node listens on
+func (n *Node) Addr() string {
+	return n.server.Transport.Addr()
+}
+
+// Peers returns the addresses of the connected peers, one per node
+func (n *Node) Peers() []string {
+	n.server.PeerLock.Lock()
+	defer n.server.PeerLock.Unlock()
+	addrs := make([]string, 0, len(n.server.Peers))
+	for _, peer := range n.server.Peers {
+		addrs = append(addrs, peer.RemoteAddr().String())
+	}
+	return addrs
+}
+
+// Store stores the contents of r under key and replicates them to peers.
+// Cancelling ctx aborts the write and the replicas not yet started.
+func (n *Node) Store(ctx context.Context, key string, r io.Reader) error {
+	return n.server.Store(ctx, key, r)
+}
+
+// Get returns the contents stored under key, fetched from peers if the
+// node does not hold them. The returned reader stops with ctx's error once
+// ctx ends.
+func (n *Node) Get(ctx context.Context, key string) (io.Reader, error) {
+	return n.server.Get(ctx, key)
+}
+
+// Delete removes the file stored under key from this node. Peers holding
+// replicas keep them unless Options.OfflineQueue is set.
+func (n *Node) Delete(ctx context.Context, key string) error {
+	return n.server.DeleteContext(ctx, key)
+}
+
+// List returns the files the node holds
+func (n *Node) List(ctx context.Context) ([]FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return n.server.ListFiles(n.server.ID)
+}
+
+// Subscribe returns a channel receiving the events of the given types, of
+// every type if none are given, and a function that ends the subscription.
+// A subscriber that falls behind misses events.
+func (n *Node) Subscribe(types ...EventType) (<-chan Event, func()) {
+	return n.server.Subscribe(types...)
+}
@@ -0,0 +1,71 @@
+package peervault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodes(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	newNode := func(addr, name string, bootstrap ...string) *Node {
+		root := filepath.Join(os.TempDir(), name)
+		os.RemoveAll(root)
+		t.Cleanup(func() { os.RemoveAll(root) })
+		node, err := New(Options{ListenAddr: addr, StorageRoot: root, Key: key, Bootstrap: bootstrap})
+		assert.Nil(t, err)
+		assert.Nil(t, node.Start(context.Background()))
+		t.Cleanup(func() { node.Close(context.Background()) })
+		return node
+	}
+	a := newNode("127.0.0.1:4410", "pv_lib_node1")
+	b := newNode("127.0.0.1:4411", "pv_lib_node2", "127.0.0.1:4410")
+	assert.Eventually(t, func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 }, 5*time.Second, 50*time.Millisecond)
+
+	stored, cancel := b.Subscribe(EventStored)
+	defer cancel()
+	ctx := context.Background()
+	assert.Nil(t, b.Store(ctx, "notes.txt", bytes.NewReader([]byte("embedded"))))
+	assert.Equal(t, "notes.txt", (<-stored).Key)
+
+	files, err := b.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// The other node fetches it from its peer
+	r, err := a.Get(ctx, "notes.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "embedded", string(data))
+
+	assert.Nil(t, b.Delete(ctx, "notes.txt"))
+	files, err = b.List(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	// Closing stops the node
+	assert.Nil(t, b.Close(ctx))
+	<-b.Done()
+	assert.NotNil(t, b.Start(ctx))
+
+	// A port in use fails on New
+	_, err = New(Options{ListenAddr: "127.0.0.1:4410", StorageRoot: filepath.Join(os.TempDir(), "pv_lib_node3"), Key: key})
+	assert.NotNil(t, err)
+	os.RemoveAll(filepath.Join(os.TempDir(), "pv_lib_node3"))
+
+	// So does a storage root the node cannot load, without exiting the program
+	root := filepath.Join(os.TempDir(), "pv_lib_node4")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	assert.Nil(t, os.MkdirAll(root, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "identity.key"), []byte("not a key"), 0600))
+	_, err = New(Options{ListenAddr: "127.0.0.1:4412", StorageRoot: root, Key: key})
+	assert.ErrorContains(t, err, "identity")
+}